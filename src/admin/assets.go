@@ -0,0 +1,444 @@
+package admin
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"time"
+)
+
+// The admin site served when no assets dir is configured. It talks to
+// the http api with the credentials it's given, so it works against any
+// server of the cluster.
+
+type asset struct {
+	contentType string
+	content     string
+}
+
+var assets = map[string]*asset{
+	"/index.html": &asset{"text/html; charset=utf-8", indexHtml},
+	"/admin.js":   &asset{"application/javascript", adminJs},
+	"/admin.css":  &asset{"text/css", adminCss},
+}
+
+// the assets don't change while the process runs
+var assetsModTime = time.Now()
+
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean(r.URL.Path)
+	if name == "/" {
+		name = "/index.html"
+	}
+	a, ok := assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	http.ServeContent(w, r, name, assetsModTime, bytes.NewReader([]byte(a.content)))
+}
+
+const indexHtml = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>InfluxDB Admin</title>
+  <link rel="stylesheet" href="admin.css">
+</head>
+<body>
+  <header>
+    <h1>InfluxDB</h1>
+    <nav id="tabs">
+      <a href="#query" class="active">Query</a>
+      <a href="#databases">Databases</a>
+      <a href="#users">Users</a>
+      <a href="#stats">Stats</a>
+    </nav>
+  </header>
+
+  <section id="connect">
+    <form id="connect-form">
+      <input id="host" placeholder="host:port of the api">
+      <input id="username" placeholder="username">
+      <input id="password" type="password" placeholder="password">
+      <button>Connect</button>
+    </form>
+    <div id="connect-error" class="error"></div>
+  </section>
+
+  <main id="app" hidden>
+    <section id="query" class="tab">
+      <form id="query-form">
+        <select id="query-db"></select>
+        <input id="query-text" placeholder="select * from /.*/ limit 10">
+        <button>Run</button>
+      </form>
+      <div id="query-error" class="error"></div>
+      <div id="query-results"></div>
+    </section>
+
+    <section id="databases" class="tab" hidden>
+      <form id="create-db-form">
+        <input id="new-db" placeholder="database name">
+        <button>Create</button>
+      </form>
+      <div id="databases-error" class="error"></div>
+      <table id="databases-table"></table>
+      <h2 id="series-title"></h2>
+      <table id="series-table"></table>
+    </section>
+
+    <section id="users" class="tab" hidden>
+      <form id="users-form">
+        <select id="users-db"></select>
+        <input id="new-user" placeholder="username">
+        <input id="new-user-password" type="password" placeholder="password">
+        <label><input id="new-user-admin" type="checkbox"> admin</label>
+        <button>Create</button>
+      </form>
+      <div id="users-error" class="error"></div>
+      <table id="users-table"></table>
+    </section>
+
+    <section id="stats" class="tab" hidden>
+      <input id="stats-filter" placeholder="filter, e.g. write">
+      <div id="stats-error" class="error"></div>
+      <div id="stats-charts"></div>
+    </section>
+  </main>
+
+  <script src="admin.js"></script>
+</body>
+</html>
+`
+
+const adminJs = `(function() {
+  "use strict";
+
+  var api = {host: "", username: "", password: ""};
+
+  function $(id) { return document.getElementById(id); }
+
+  function request(method, path, params, body, callback) {
+    params = params || {};
+    params.u = api.username;
+    params.p = api.password;
+    var query = Object.keys(params).map(function(k) {
+      return encodeURIComponent(k) + "=" + encodeURIComponent(params[k]);
+    }).join("&");
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, "http://" + api.host + path + "?" + query);
+    xhr.onload = function() {
+      if (xhr.status < 200 || xhr.status >= 300) {
+        callback(xhr.responseText || xhr.statusText);
+        return;
+      }
+      var result = null;
+      try { result = JSON.parse(xhr.responseText); } catch (e) {}
+      callback(null, result);
+    };
+    xhr.onerror = function() { callback("Cannot connect to " + api.host); };
+    xhr.send(body === undefined ? null : JSON.stringify(body));
+  }
+
+  function showError(id, err) { $(id).textContent = err || ""; }
+
+  function clear(element) {
+    while (element.firstChild) element.removeChild(element.firstChild);
+  }
+
+  function cell(row, tag, content) {
+    var c = document.createElement(tag);
+    if (content instanceof Node) c.appendChild(content); else c.textContent = content;
+    row.appendChild(c);
+    return c;
+  }
+
+  function link(text, onclick) {
+    var a = document.createElement("a");
+    a.href = "#";
+    a.textContent = text;
+    a.onclick = function(e) { e.preventDefault(); onclick(); };
+    return a;
+  }
+
+  function fillTable(table, columns, rows) {
+    clear(table);
+    var header = table.insertRow();
+    columns.forEach(function(c) { cell(header, "th", c); });
+    rows.forEach(function(r) {
+      var row = table.insertRow();
+      r.forEach(function(v) { cell(row, "td", v === null ? "" : v); });
+    });
+  }
+
+  // tabs
+
+  function showTab(name) {
+    Array.prototype.forEach.call(document.querySelectorAll(".tab"), function(tab) {
+      tab.hidden = tab.id != name;
+    });
+    Array.prototype.forEach.call(document.querySelectorAll("#tabs a"), function(a) {
+      a.className = a.getAttribute("href") == "#" + name ? "active" : "";
+    });
+    if (name == "databases") loadDatabases();
+    if (name == "users") loadUsers();
+  }
+
+  window.onhashchange = function() { showTab(location.hash.slice(1) || "query"); };
+
+  // connecting
+
+  $("host").value = location.hostname + ":8086";
+  $("connect-form").onsubmit = function(e) {
+    e.preventDefault();
+    api.host = $("host").value;
+    api.username = $("username").value;
+    api.password = $("password").value;
+    request("GET", "/db", {}, undefined, function(err, databases) {
+      showError("connect-error", err);
+      if (err) return;
+      $("connect").hidden = true;
+      $("app").hidden = false;
+      fillDatabaseSelects(databases);
+      showTab(location.hash.slice(1) || "query");
+      startStats();
+    });
+  };
+
+  function fillDatabaseSelects(databases) {
+    ["query-db", "users-db"].forEach(function(id) {
+      var select = $(id), selected = select.value;
+      clear(select);
+      databases.forEach(function(db) {
+        var option = document.createElement("option");
+        option.value = option.textContent = db.name;
+        select.appendChild(option);
+      });
+      if (selected) select.value = selected;
+    });
+  }
+
+  // queries
+
+  function runQuery(db, query) {
+    $("query-db").value = db;
+    $("query-text").value = query;
+    location.hash = "query";
+    showError("query-error");
+    request("GET", "/db/" + encodeURIComponent(db) + "/series", {q: query, time_precision: "ms"}, undefined, function(err, series) {
+      var results = $("query-results");
+      clear(results);
+      showError("query-error", err);
+      if (err) return;
+      (series || []).forEach(function(s) {
+        var title = document.createElement("h2");
+        title.textContent = s.name;
+        results.appendChild(title);
+        var table = document.createElement("table");
+        var timeIndex = s.columns.indexOf("time");
+        fillTable(table, s.columns, s.points.map(function(p) {
+          if (timeIndex >= 0) p[timeIndex] = new Date(p[timeIndex]).toISOString();
+          return p;
+        }));
+        results.appendChild(table);
+      });
+    });
+  }
+
+  $("query-form").onsubmit = function(e) {
+    e.preventDefault();
+    runQuery($("query-db").value, $("query-text").value);
+  };
+
+  // databases
+
+  function loadDatabases() {
+    request("GET", "/db", {}, undefined, function(err, databases) {
+      showError("databases-error", err);
+      if (err) return;
+      fillDatabaseSelects(databases);
+      var table = $("databases-table");
+      clear(table);
+      var header = table.insertRow();
+      ["name", "retention", ""].forEach(function(c) { cell(header, "th", c); });
+      databases.forEach(function(db) {
+        var row = table.insertRow();
+        cell(row, "td", link(db.name, function() { loadSeries(db.name); }));
+        var retention = document.createElement("input");
+        retention.placeholder = "e.g. 30d or inf";
+        retention.onchange = function() {
+          request("POST", "/db/" + encodeURIComponent(db.name) + "/retention", {}, {retention: retention.value}, function(err) {
+            showError("databases-error", err);
+          });
+        };
+        cell(row, "td", retention);
+        cell(row, "td", link("drop", function() {
+          if (!confirm("Drop database " + db.name + " and all of its data?")) return;
+          request("DELETE", "/db/" + encodeURIComponent(db.name), {}, undefined, function(err) {
+            showError("databases-error", err);
+            loadDatabases();
+          });
+        }));
+      });
+    });
+  }
+
+  function loadSeries(db) {
+    $("series-title").textContent = "Series of " + db;
+    request("GET", "/db/" + encodeURIComponent(db) + "/series", {q: "list series"}, undefined, function(err, series) {
+      showError("databases-error", err);
+      var table = $("series-table");
+      clear(table);
+      if (err) return;
+      var names = [];
+      (series || []).forEach(function(s) {
+        var nameIndex = s.columns.indexOf("name");
+        s.points.forEach(function(p) { names.push(nameIndex >= 0 ? p[nameIndex] : s.name); });
+      });
+      var header = table.insertRow();
+      cell(header, "th", "name");
+      names.forEach(function(name) {
+        var row = table.insertRow();
+        cell(row, "td", link(name, function() {
+          runQuery(db, "select * from \"" + name + "\" limit 100");
+        }));
+      });
+    });
+  }
+
+  $("create-db-form").onsubmit = function(e) {
+    e.preventDefault();
+    request("POST", "/db", {}, {name: $("new-db").value}, function(err) {
+      showError("databases-error", err);
+      if (!err) $("new-db").value = "";
+      loadDatabases();
+    });
+  };
+
+  // users
+
+  function usersPath(user) {
+    var path = "/db/" + encodeURIComponent($("users-db").value) + "/users";
+    return user ? path + "/" + encodeURIComponent(user) : path;
+  }
+
+  function loadUsers() {
+    if (!$("users-db").value) return;
+    request("GET", usersPath(), {}, undefined, function(err, users) {
+      showError("users-error", err);
+      var table = $("users-table");
+      clear(table);
+      if (err) return;
+      var header = table.insertRow();
+      ["name", "admin", ""].forEach(function(c) { cell(header, "th", c); });
+      users.forEach(function(user) {
+        var row = table.insertRow();
+        cell(row, "td", user.name);
+        var admin = document.createElement("input");
+        admin.type = "checkbox";
+        admin.checked = user.isAdmin;
+        admin.onchange = function() {
+          request("POST", usersPath(user.name), {}, {admin: admin.checked}, function(err) {
+            showError("users-error", err);
+            loadUsers();
+          });
+        };
+        cell(row, "td", admin);
+        cell(row, "td", link("delete", function() {
+          if (!confirm("Delete user " + user.name + "?")) return;
+          request("DELETE", usersPath(user.name), {}, undefined, function(err) {
+            showError("users-error", err);
+            loadUsers();
+          });
+        }));
+      });
+    });
+  }
+
+  $("users-db").onchange = loadUsers;
+  $("users-form").onsubmit = function(e) {
+    e.preventDefault();
+    var user = {name: $("new-user").value, password: $("new-user-password").value, isAdmin: $("new-user-admin").checked};
+    request("POST", usersPath(), {}, user, function(err) {
+      showError("users-error", err);
+      if (!err) $("new-user").value = $("new-user-password").value = "";
+      loadUsers();
+    });
+  };
+
+  // stats, the metrics of /debug/vars are polled and charted
+
+  var STATS_INTERVAL = 5000, STATS_KEPT = 60;
+  var stats = {};
+
+  function startStats() {
+    pollStats();
+    setInterval(pollStats, STATS_INTERVAL);
+  }
+
+  function pollStats() {
+    request("GET", "/debug/vars", {}, undefined, function(err, snapshot) {
+      showError("stats-error", err);
+      if (err) return;
+      Object.keys(snapshot).forEach(function(name) {
+        var values = stats[name] = stats[name] || [];
+        values.push(snapshot[name]);
+        if (values.length > STATS_KEPT) values.shift();
+      });
+      if (!$("stats").hidden) drawStats();
+    });
+  }
+
+  function drawStats() {
+    var charts = $("stats-charts"), filter = $("stats-filter").value;
+    clear(charts);
+    Object.keys(stats).sort().forEach(function(name) {
+      if (filter && name.indexOf(filter) < 0) return;
+      var values = stats[name];
+      var chart = document.createElement("div");
+      chart.className = "chart";
+      var title = document.createElement("div");
+      title.textContent = name + ": " + values[values.length - 1];
+      chart.appendChild(title);
+      var canvas = document.createElement("canvas");
+      canvas.width = 300;
+      canvas.height = 80;
+      chart.appendChild(canvas);
+      charts.appendChild(chart);
+
+      var min = Math.min.apply(null, values), max = Math.max.apply(null, values);
+      var range = max - min || 1, step = canvas.width / (STATS_KEPT - 1);
+      var context = canvas.getContext("2d");
+      context.strokeStyle = "#22a7f0";
+      context.beginPath();
+      values.forEach(function(v, i) {
+        var y = canvas.height - 2 - (v - min) / range * (canvas.height - 4);
+        if (i == 0) context.moveTo(0, y); else context.lineTo(i * step, y);
+      });
+      context.stroke();
+    });
+  }
+
+  $("stats-filter").oninput = drawStats;
+})();
+`
+
+const adminCss = `body { font-family: sans-serif; margin: 0; color: #333; }
+header { background: #22a7f0; color: white; padding: 0 1em; display: flex; align-items: center; }
+header h1 { font-size: 1.4em; margin: 0.5em 1em 0.5em 0; }
+nav a { color: white; margin-right: 1em; text-decoration: none; opacity: 0.7; }
+nav a.active { opacity: 1; font-weight: bold; }
+section { padding: 1em; }
+form { margin-bottom: 1em; }
+input, select, button { font-size: 1em; padding: 0.2em 0.4em; }
+#query-text { width: 60%; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ddd; padding: 0.2em 0.6em; text-align: left; }
+th { background: #f4f4f4; }
+h2 { font-size: 1.1em; }
+.error { color: #c0392b; white-space: pre-wrap; }
+.chart { display: inline-block; margin: 0 1em 1em 0; font-size: 0.8em; }
+.chart canvas { border: 1px solid #ddd; display: block; }
+`
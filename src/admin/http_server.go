@@ -14,7 +14,8 @@ type HttpServer struct {
 }
 
 /*
-  homeDir is the directory that is the root of the admin site.
+  homeDir is the directory that is the root of the admin site, the site
+  built into the binary is served if it's empty.
   port should be a string that looks like ":8080" or whatever port to serve on.
 */
 func NewHttpServer(homeDir, port string) *HttpServer {
@@ -32,7 +33,11 @@ func (self *HttpServer) ListenAndServe() {
 	if err != nil {
 		panic(err)
 	}
-	err = http.Serve(self.listener, http.FileServer(http.Dir(self.homeDir)))
+	var handler http.Handler = http.HandlerFunc(serveAsset)
+	if self.homeDir != "" {
+		handler = http.FileServer(http.Dir(self.homeDir))
+	}
+	err = http.Serve(self.listener, handler)
 	if !strings.Contains(err.Error(), "closed") {
 		panic(err)
 	}
@@ -35,3 +35,29 @@ func (self *HttpServerSuite) TestServesIndexByDefault(c *C) {
 	c.Assert(string(actualContent), Equals, string(content))
 	c.Assert(err, IsNil)
 }
+
+func (self *HttpServerSuite) TestServesTheBuiltInSiteWithoutAnAssetsDir(c *C) {
+	s := NewHttpServer("", ":8084")
+	go func() { s.ListenAndServe() }()
+	defer s.Close()
+	for path, a := range assets {
+		resp, err := http.Get("http://localhost:8084" + path)
+		c.Assert(err, IsNil)
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, a.contentType)
+		c.Assert(string(content), Equals, a.content)
+	}
+
+	resp, err := http.Get("http://localhost:8084/")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = http.Get("http://localhost:8084/missing.js")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,175 @@
+// package collectd provides a udp listener that you can use to ingest
+// metrics into influxdb from collectd's network plugin, which sends
+// them in the collectd binary protocol.
+//
+// Every sample is written as a point of the series named after its
+// plugin and type, e.g. the if_octets samples of the interface plugin
+// go to interface.if_octets and the cpu samples of the cpu plugin go to
+// cpu. The point has a column for each value, named after the values of
+// the type in types.db, and the host, plugin_instance and type_instance
+// columns when they're set.
+package collectd
+
+import (
+	"cluster"
+	. "common"
+	"configuration"
+	"coordinator"
+	"net"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+type Server struct {
+	listenAddress string
+	database      string
+	coordinator   coordinator.Coordinator
+	clusterConfig *cluster.ClusterConfiguration
+	conn          *net.UDPConn
+	user          *cluster.ClusterAdmin
+	types         typesDB
+	stopped       bool
+}
+
+func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) (*Server, error) {
+	types, err := loadTypesDB(config.CollectdTypesDB)
+	if err != nil {
+		return nil, err
+	}
+	self := &Server{}
+	self.listenAddress = config.CollectdPortString()
+	self.database = config.CollectdDatabase
+	self.coordinator = coord
+	self.clusterConfig = clusterConfig
+	self.types = types
+
+	return self, nil
+}
+
+func (self *Server) getAuth() {
+	// just use any (the first) of the list of admins.
+	names := self.clusterConfig.GetClusterAdmins()
+	self.user = self.clusterConfig.GetClusterAdmin(names[0])
+}
+
+func (self *Server) ListenAndServe() {
+	self.getAuth()
+
+	addr, err := net.ResolveUDPAddr("udp", self.listenAddress)
+	if err != nil {
+		log.Error("CollectdServer: ResolveUDPAddr: ", err)
+		return
+	}
+	self.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Error("CollectdServer: Listen: ", err)
+		return
+	}
+	self.HandleSocket(self.conn)
+}
+
+func (self *Server) HandleSocket(socket *net.UDPConn) {
+	// collectd doesn't send packets bigger than this
+	buffer := make([]byte, 65535)
+
+	for {
+		n, _, err := socket.ReadFromUDP(buffer)
+		if err != nil {
+			if self.stopped {
+				return
+			}
+			log.Error("CollectdServer: ReadFromUDP error: %s", err)
+			continue
+		}
+
+		samples, err := decodePacket(buffer[:n])
+		if err != nil {
+			log.Error("CollectdServer: cannot decode packet: %s", err)
+			continue
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		self.writePoints(self.toSeries(samples))
+	}
+}
+
+func (self *Server) toSeries(samples []*sample) []*protocol.Series {
+	series := make([]*protocol.Series, 0, len(samples))
+	now := TimeToMicroseconds(time.Now())
+	for _, s := range samples {
+		// copied, the host and instance columns are appended to it
+		fields := append([]string{}, self.types.valueNames(s.typeName, len(s.values))...)
+		values := make([]*protocol.FieldValue, 0, len(s.values)+3)
+		for _, v := range s.values {
+			if v.isFloat {
+				values = append(values, &protocol.FieldValue{DoubleValue: protocol.Float64(v.floatValue)})
+			} else {
+				values = append(values, &protocol.FieldValue{Int64Value: protocol.Int64(v.intValue)})
+			}
+		}
+		for _, column := range []struct{ name, value string }{
+			{"host", s.host},
+			{"plugin_instance", s.pluginInstance},
+			{"type_instance", s.typeInstance},
+		} {
+			if column.value == "" {
+				continue
+			}
+			fields = append(fields, column.name)
+			values = append(values, &protocol.FieldValue{StringValue: protocol.String(column.value)})
+		}
+
+		timestamp := s.time
+		if timestamp == 0 {
+			timestamp = now
+		}
+		name := s.plugin
+		if s.typeName != s.plugin {
+			name += "." + s.typeName
+		}
+		series = append(series, &protocol.Series{
+			Name:   protocol.String(name),
+			Fields: fields,
+			Points: []*protocol.Point{
+				&protocol.Point{
+					Timestamp: protocol.Int64(timestamp),
+					Values:    values,
+					// the same sequence number keeps only the latest value
+					// sent for a sample and time
+					SequenceNumber: proto.Uint64(1),
+				},
+			},
+		})
+	}
+	return series
+}
+
+func (self *Server) writePoints(series []*protocol.Series) error {
+	err := self.coordinator.WriteSeriesData(self.user, self.database, series)
+	if err != nil {
+		switch err.(type) {
+		case AuthorizationError:
+			// user information got stale, get a fresh one (this should happen rarely)
+			self.getAuth()
+			err = self.coordinator.WriteSeriesData(self.user, self.database, series)
+			if err != nil {
+				log.Warn("CollectdServer: failed to write series after getting new auth: %s", err.Error())
+			}
+		default:
+			log.Warn("CollectdServer: failed write series: %s", err.Error())
+		}
+	}
+	return err
+}
+
+func (self *Server) Close() {
+	if self.conn != nil {
+		log.Info("CollectdServer: Closing collectd listener")
+		self.stopped = true
+		self.conn.Close()
+	}
+}
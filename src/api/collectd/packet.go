@@ -0,0 +1,164 @@
+package collectd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// The part types of the collectd binary protocol, see
+// https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	TYPE_HOST            = 0x0000
+	TYPE_TIME            = 0x0001
+	TYPE_PLUGIN          = 0x0002
+	TYPE_PLUGIN_INSTANCE = 0x0003
+	TYPE_TYPE            = 0x0004
+	TYPE_TYPE_INSTANCE   = 0x0005
+	TYPE_VALUES          = 0x0006
+	TYPE_INTERVAL        = 0x0007
+	TYPE_TIME_HR         = 0x0008
+	TYPE_INTERVAL_HR     = 0x0009
+)
+
+// The data source types of the values
+const (
+	DS_COUNTER  = 0
+	DS_GAUGE    = 1
+	DS_DERIVE   = 2
+	DS_ABSOLUTE = 3
+)
+
+// A values part along with the host, plugin, type and time parts sent
+// before it. The parts other than values only change the state of the
+// packet, so every sample gets the last ones seen.
+type sample struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typeName       string
+	typeInstance   string
+	// the time in microseconds
+	time int64
+	// the interval in microseconds
+	interval int64
+	values   []sampleValue
+}
+
+type sampleValue struct {
+	dataSourceType byte
+	isFloat        bool
+	intValue       int64
+	floatValue     float64
+}
+
+func decodePacket(data []byte) ([]*sample, error) {
+	state := sample{}
+	samples := []*sample{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("Collectd part header is truncated")
+		}
+		partType := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 4 || length > len(data) {
+			return nil, fmt.Errorf("Collectd part of type %d has an invalid length %d", partType, length)
+		}
+		body := data[4:length]
+		data = data[length:]
+
+		var err error
+		switch partType {
+		case TYPE_HOST:
+			state.host, err = decodeString(body)
+		case TYPE_PLUGIN:
+			state.plugin, err = decodeString(body)
+		case TYPE_PLUGIN_INSTANCE:
+			state.pluginInstance, err = decodeString(body)
+		case TYPE_TYPE:
+			state.typeName, err = decodeString(body)
+		case TYPE_TYPE_INSTANCE:
+			state.typeInstance, err = decodeString(body)
+		case TYPE_TIME, TYPE_INTERVAL:
+			var n uint64
+			n, err = decodeNumber(body)
+			if partType == TYPE_TIME {
+				state.time = int64(n) * 1000000
+			} else {
+				state.interval = int64(n) * 1000000
+			}
+		case TYPE_TIME_HR, TYPE_INTERVAL_HR:
+			var n uint64
+			n, err = decodeNumber(body)
+			if partType == TYPE_TIME_HR {
+				state.time = highResolutionToMicroseconds(n)
+			} else {
+				state.interval = highResolutionToMicroseconds(n)
+			}
+		case TYPE_VALUES:
+			s := state
+			s.values, err = decodeValues(body)
+			samples = append(samples, &s)
+		default:
+			// the notifications, signatures and encrypted parts aren't
+			// supported, they're skipped
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+func decodeString(body []byte) (string, error) {
+	if len(body) == 0 || body[len(body)-1] != 0 {
+		return "", fmt.Errorf("Collectd string part isn't null terminated")
+	}
+	return string(body[:len(body)-1]), nil
+}
+
+func decodeNumber(body []byte) (uint64, error) {
+	if len(body) != 8 {
+		return 0, fmt.Errorf("Collectd numeric part has %d bytes instead of 8", len(body))
+	}
+	return binary.BigEndian.Uint64(body), nil
+}
+
+// The high resolution times are in units of 2^-30 seconds
+func highResolutionToMicroseconds(n uint64) int64 {
+	seconds := n >> 30
+	fraction := n & (1<<30 - 1)
+	return int64(seconds*1000000 + (fraction*1000000)>>30)
+}
+
+func decodeValues(body []byte) ([]sampleValue, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("Collectd values part is truncated")
+	}
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) != 2+count*9 {
+		return nil, fmt.Errorf("Collectd values part has %d bytes for %d values", len(body), count)
+	}
+	types := body[2 : 2+count]
+	reader := bytes.NewReader(body[2+count:])
+	values := make([]sampleValue, 0, count)
+	for _, dataSourceType := range types {
+		value := sampleValue{dataSourceType: dataSourceType}
+		var n uint64
+		switch dataSourceType {
+		case DS_GAUGE:
+			// the gauges are the only values in little endian
+			binary.Read(reader, binary.LittleEndian, &n)
+			value.isFloat = true
+			value.floatValue = math.Float64frombits(n)
+		case DS_COUNTER, DS_DERIVE, DS_ABSOLUTE:
+			binary.Read(reader, binary.BigEndian, &n)
+			value.intValue = int64(n)
+		default:
+			return nil, fmt.Errorf("Collectd value has an unknown data source type %d", dataSourceType)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,138 @@
+package collectd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PacketSuite struct{}
+
+var _ = Suite(&PacketSuite{})
+
+type packetBuilder struct {
+	bytes.Buffer
+}
+
+func (self *packetBuilder) header(partType uint16, length int) {
+	binary.Write(self, binary.BigEndian, partType)
+	binary.Write(self, binary.BigEndian, uint16(4+length))
+}
+
+func (self *packetBuilder) addString(partType uint16, value string) {
+	self.header(partType, len(value)+1)
+	self.WriteString(value)
+	self.WriteByte(0)
+}
+
+func (self *packetBuilder) addNumber(partType uint16, value uint64) {
+	self.header(partType, 8)
+	binary.Write(self, binary.BigEndian, value)
+}
+
+func (self *packetBuilder) addGauges(values ...float64) {
+	self.header(TYPE_VALUES, 2+9*len(values))
+	binary.Write(self, binary.BigEndian, uint16(len(values)))
+	for _ = range values {
+		self.WriteByte(DS_GAUGE)
+	}
+	for _, value := range values {
+		binary.Write(self, binary.LittleEndian, math.Float64bits(value))
+	}
+}
+
+func (self *packetBuilder) addDerives(values ...int64) {
+	self.header(TYPE_VALUES, 2+9*len(values))
+	binary.Write(self, binary.BigEndian, uint16(len(values)))
+	for _ = range values {
+		self.WriteByte(DS_DERIVE)
+	}
+	for _, value := range values {
+		binary.Write(self, binary.BigEndian, value)
+	}
+}
+
+func (self *PacketSuite) TestSamplesAreDecoded(c *C) {
+	packet := &packetBuilder{}
+	packet.addString(TYPE_HOST, "server1")
+	packet.addNumber(TYPE_TIME_HR, 1400000000<<30+1<<29)
+	packet.addNumber(TYPE_INTERVAL_HR, 10<<30)
+	packet.addString(TYPE_PLUGIN, "load")
+	packet.addString(TYPE_TYPE, "load")
+	packet.addGauges(0.5, 0.25, 1)
+	// the later samples keep the parts that aren't sent again
+	packet.addString(TYPE_PLUGIN, "interface")
+	packet.addString(TYPE_PLUGIN_INSTANCE, "eth0")
+	packet.addString(TYPE_TYPE, "if_octets")
+	packet.addDerives(100, 200)
+
+	samples, err := decodePacket(packet.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(samples, HasLen, 2)
+	c.Assert(samples[0].host, Equals, "server1")
+	c.Assert(samples[0].time, Equals, int64(1400000000500000))
+	c.Assert(samples[0].interval, Equals, int64(10000000))
+	c.Assert(samples[0].plugin, Equals, "load")
+	c.Assert(samples[0].pluginInstance, Equals, "")
+	c.Assert(samples[0].values, DeepEquals, []sampleValue{
+		{DS_GAUGE, true, 0, 0.5},
+		{DS_GAUGE, true, 0, 0.25},
+		{DS_GAUGE, true, 0, 1},
+	})
+	c.Assert(samples[1].host, Equals, "server1")
+	c.Assert(samples[1].plugin, Equals, "interface")
+	c.Assert(samples[1].pluginInstance, Equals, "eth0")
+	c.Assert(samples[1].typeName, Equals, "if_octets")
+	c.Assert(samples[1].values, DeepEquals, []sampleValue{
+		{DS_DERIVE, false, 100, 0},
+		{DS_DERIVE, false, 200, 0},
+	})
+
+	samples, err = decodePacket(packet.Bytes()[:packet.Len()-3])
+	c.Assert(err, NotNil)
+}
+
+func (self *PacketSuite) TestSamplesAreConvertedToSeries(c *C) {
+	types, err := parseTypesDB(strings.NewReader(`
+# the values of the types
+load      shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000
+if_octets rx:DERIVE:0:U, tx:DERIVE:0:U
+`))
+	c.Assert(err, IsNil)
+	c.Assert(types["if_octets"], DeepEquals, []string{"rx", "tx"})
+	_, err = parseTypesDB(strings.NewReader("if_octets rx:DERIVE"))
+	c.Assert(err, NotNil)
+
+	server := &Server{types: types}
+	series := server.toSeries([]*sample{
+		{host: "server1", plugin: "load", typeName: "load", time: 1000000, values: []sampleValue{
+			{DS_GAUGE, true, 0, 0.5}, {DS_GAUGE, true, 0, 0.25}, {DS_GAUGE, true, 0, 1},
+		}},
+		{host: "server1", plugin: "interface", pluginInstance: "eth0", typeName: "if_octets", values: []sampleValue{
+			{DS_DERIVE, false, 100, 0}, {DS_DERIVE, false, 200, 0},
+		}},
+		{plugin: "df", typeName: "percent", values: []sampleValue{{DS_GAUGE, true, 0, 10}}},
+	})
+	c.Assert(series, HasLen, 3)
+	c.Assert(*series[0].Name, Equals, "load")
+	c.Assert(series[0].Fields, DeepEquals, []string{"shortterm", "midterm", "longterm", "host"})
+	c.Assert(*series[0].Points[0].Timestamp, Equals, int64(1000000))
+	c.Assert(*series[0].Points[0].Values[3].StringValue, Equals, "server1")
+	c.Assert(*series[1].Name, Equals, "interface.if_octets")
+	c.Assert(series[1].Fields, DeepEquals, []string{"rx", "tx", "host", "plugin_instance"})
+	c.Assert(*series[1].Points[0].Values[1].Int64Value, Equals, int64(200))
+	c.Assert(*series[2].Name, Equals, "df.percent")
+	c.Assert(series[2].Fields, DeepEquals, []string{"value"})
+	c.Assert(*series[2].Points[0].Values[0].DoubleValue, Equals, float64(10))
+	// the types.db names aren't changed by the columns added to them
+	c.Assert(types["if_octets"], DeepEquals, []string{"rx", "tx"})
+}
@@ -0,0 +1,71 @@
+package collectd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The names of the values of every collectd type, e.g. the if_octets
+// type has an rx and a tx value. The lines of types.db look like
+//
+//	if_octets rx:DERIVE:0:U, tx:DERIVE:0:U
+type typesDB map[string][]string
+
+func loadTypesDB(path string) (typesDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseTypesDB(file)
+}
+
+func parseTypesDB(reader io.Reader) (typesDB, error) {
+	types := typesDB{}
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Line %d of types.db has no data sources", line)
+		}
+		names := []string{}
+		for _, source := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			if source == "" {
+				continue
+			}
+			parts := strings.Split(source, ":")
+			if len(parts) != 4 {
+				return nil, fmt.Errorf("Line %d of types.db has an invalid data source %s", line, source)
+			}
+			names = append(names, parts[0])
+		}
+		types[fields[0]] = names
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+// Returns the column names of the values of the given type, the types
+// missing from types.db get value, or value_0, value_1, etc.
+func (self typesDB) valueNames(typeName string, count int) []string {
+	if names, ok := self[typeName]; ok && len(names) == count {
+		return names
+	}
+	if count == 1 {
+		return []string{"value"}
+	}
+	names := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		names = append(names, fmt.Sprintf("value_%d", i))
+	}
+	return names
+}
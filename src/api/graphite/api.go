@@ -27,6 +27,9 @@ import (
 	log "code.google.com/p/log4go"
 )
 
+// the points received are written at least this often
+const GRAPHITE_BATCH_INTERVAL = time.Second
+
 type Server struct {
 	listenAddress string
 	database      string
@@ -37,10 +40,19 @@ type Server struct {
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
 	udpEnabled    bool
+	template      *SeriesTemplate
+	batchSize     int
+	pending       chan *protocol.Series
+	stopBatches   chan bool
+	batchesDone   chan bool
 }
 
 // TODO: check that database exists and create it if not
-func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
+func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) (*Server, error) {
+	template, err := NewSeriesTemplate(config.GraphiteTemplate, config.GraphiteSeparator)
+	if err != nil {
+		return nil, err
+	}
 	self := &Server{}
 	self.listenAddress = config.GraphitePortString()
 	self.database = config.GraphiteDatabase
@@ -48,8 +60,13 @@ func NewServer(config *configuration.Configuration, coord coordinator.Coordinato
 	self.shutdown = make(chan bool, 1)
 	self.clusterConfig = clusterConfig
 	self.udpEnabled = config.GraphiteUdpEnabled
+	self.template = template
+	self.batchSize = config.GraphiteBatchSize
+	self.pending = make(chan *protocol.Series, config.GraphiteBatchSize)
+	self.stopBatches = make(chan bool)
+	self.batchesDone = make(chan bool)
 
-	return self
+	return self, nil
 }
 
 // getAuth assures that the user property is a user with access to the graphite database
@@ -62,6 +79,7 @@ func (self *Server) getAuth() {
 
 func (self *Server) ListenAndServe() {
 	self.getAuth()
+	go self.writeBatches()
 	var err error
 	if self.listenAddress != "" {
 		self.conn, err = net.Listen("tcp", self.listenAddress)
@@ -127,10 +145,55 @@ func (self *Server) Close() {
 		case <-self.shutdown:
 		}
 	}
+	if self.conn != nil || self.udpConn != nil {
+		// the listeners are closed, write the points received before
+		close(self.stopBatches)
+		select {
+		case <-time.After(time.Second * 5):
+			log.Error("GraphiteServer: Cannot write the last batch of points. Closing anyway")
+		case <-self.batchesDone:
+		}
+	}
+}
+
+// Writes the points received every GRAPHITE_BATCH_INTERVAL, or once
+// there are batchSize of them
+func (self *Server) writeBatches() {
+	defer close(self.batchesDone)
+	ticker := time.NewTicker(GRAPHITE_BATCH_INTERVAL)
+	defer ticker.Stop()
+	batch := newSeriesBatch()
+	flush := func() {
+		if batch.isEmpty() {
+			return
+		}
+		self.writePoints(batch.series)
+		batch = newSeriesBatch()
+	}
+	for {
+		select {
+		case series := <-self.pending:
+			batch.add(series)
+			if batch.points >= self.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-self.stopBatches:
+			for {
+				select {
+				case series := <-self.pending:
+					batch.add(series)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
 }
 
-func (self *Server) writePoints(series *protocol.Series) error {
-	serie := []*protocol.Series{series}
+func (self *Server) writePoints(serie []*protocol.Series) error {
 	err := self.coordinator.WriteSeriesData(self.user, self.database, serie)
 	if err != nil {
 		switch err.(type) {
@@ -176,6 +239,14 @@ func (self *Server) handleMessage(reader *bufio.Reader) error {
 	} else {
 		values = append(values, &protocol.FieldValue{DoubleValue: &graphiteMetric.floatValue})
 	}
+	name, columns, columnValues, err := self.template.Apply(graphiteMetric.name)
+	if err != nil {
+		log.Error("Error in graphite plugin: %s", err)
+		return nil
+	}
+	for i := range columnValues {
+		values = append(values, &protocol.FieldValue{StringValue: &columnValues[i]})
+	}
 	sn := uint64(1) // use same SN makes sure that we'll only keep the latest value for a given metric_id-timestamp pair
 	point := &protocol.Point{
 		Timestamp:      &graphiteMetric.timestamp,
@@ -183,13 +254,10 @@ func (self *Server) handleMessage(reader *bufio.Reader) error {
 		SequenceNumber: &sn,
 	}
 	series := &protocol.Series{
-		Name:   &graphiteMetric.name,
-		Fields: []string{"value"},
+		Name:   &name,
+		Fields: append([]string{"value"}, columns...),
 		Points: []*protocol.Point{point},
 	}
-	// little inefficient for now, later we might want to add multiple series in 1 writePoints request
-	if err := self.writePoints(series); err != nil {
-		log.Error("Error in graphite plugin: %s", err)
-	}
+	self.pending <- series
 	return nil
 }
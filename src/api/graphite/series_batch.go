@@ -0,0 +1,33 @@
+package graphite
+
+import (
+	"protocol"
+	"strings"
+)
+
+// The points received since the last write, the points of the metrics
+// with the same series and columns are in one series
+type seriesBatch struct {
+	series []*protocol.Series
+	byKey  map[string]*protocol.Series
+	points int
+}
+
+func newSeriesBatch() *seriesBatch {
+	return &seriesBatch{byKey: map[string]*protocol.Series{}}
+}
+
+func (self *seriesBatch) add(series *protocol.Series) {
+	key := *series.Name + "\x00" + strings.Join(series.Fields, "\x00")
+	self.points += len(series.Points)
+	if existing, ok := self.byKey[key]; ok {
+		existing.Points = append(existing.Points, series.Points...)
+		return
+	}
+	self.byKey[key] = series
+	self.series = append(self.series, series)
+}
+
+func (self *seriesBatch) isEmpty() bool {
+	return self.points == 0
+}
@@ -0,0 +1,63 @@
+package graphite
+
+import (
+	"common"
+	. "launchpad.net/gocheck"
+	"protocol"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type SeriesTemplateSuite struct{}
+
+var _ = Suite(&SeriesTemplateSuite{})
+
+func (self *SeriesTemplateSuite) TestMetricPathsAreMappedToSeries(c *C) {
+	template, err := common.NewSeriesTemplate("", ".")
+	c.Assert(err, IsNil)
+	name, columns, values, err := template.Apply("server1.cpu.idle")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "server1.cpu.idle")
+	c.Assert(columns, HasLen, 0)
+	c.Assert(values, HasLen, 0)
+
+	template, err = common.NewSeriesTemplate("host._.series", "_")
+	c.Assert(err, IsNil)
+	name, columns, values, err = template.Apply("server1.eu.cpu.idle")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "cpu_idle")
+	c.Assert(columns, DeepEquals, []string{"host"})
+	c.Assert(values, DeepEquals, []string{"server1"})
+
+	_, _, _, err = template.Apply("server1.eu")
+	c.Assert(err, NotNil)
+
+	for _, invalid := range []string{"host.host.series", "value.series", "host..series"} {
+		_, err = common.NewSeriesTemplate(invalid, ".")
+		c.Assert(err, NotNil)
+	}
+}
+
+func (self *SeriesTemplateSuite) TestTheMetricsOfASeriesAreBatchedTogether(c *C) {
+	batch := newSeriesBatch()
+	c.Assert(batch.isEmpty(), Equals, true)
+	for _, name := range []string{"cpu", "mem", "cpu"} {
+		batch.add(&protocol.Series{
+			Name:   protocol.String(name),
+			Fields: []string{"value"},
+			Points: []*protocol.Point{&protocol.Point{}},
+		})
+	}
+	batch.add(&protocol.Series{
+		Name:   protocol.String("cpu"),
+		Fields: []string{"value", "host"},
+		Points: []*protocol.Point{&protocol.Point{}},
+	})
+	c.Assert(batch.points, Equals, 4)
+	c.Assert(batch.series, HasLen, 3)
+	c.Assert(batch.series[0].Points, HasLen, 2)
+}
@@ -10,11 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"metrics"
 	"net"
 	libhttp "net/http"
 	"parser"
 	"path/filepath"
 	"protocol"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +31,7 @@ type HttpServer struct {
 	httpPort       string
 	httpSslPort    string
 	httpSslCert    string
+	httpSslKey     string
 	adminAssetsDir string
 	coordinator    coordinator.Coordinator
 	userManager    UserManager
@@ -36,6 +39,8 @@ type HttpServer struct {
 	clusterConfig  *cluster.ClusterConfiguration
 	raftServer     *coordinator.RaftServer
 	readTimeout    time.Duration
+	// the limit of the decompressed size of the writes, 0 is no limit
+	maxWriteBodySize int64
 }
 
 func NewHttpServer(httpPort string, readTimeout time.Duration, adminAssetsDir string, theCoordinator coordinator.Coordinator, userManager UserManager, clusterConfig *cluster.ClusterConfiguration, raftServer *coordinator.RaftServer) *HttpServer {
@@ -55,7 +60,9 @@ const (
 	INVALID_CREDENTIALS_MSG = "Invalid database/username/password"
 )
 
-func (self *HttpServer) EnableSsl(addr, certPath string) {
+// The key can be in the certificate file, keyPath is the certificate
+// if it's empty
+func (self *HttpServer) EnableSsl(addr, certPath, keyPath string) {
 	if addr == "" || certPath == "" {
 		// don't enable ssl unless both the address and the certificate
 		// path aren't empty
@@ -65,9 +72,17 @@ func (self *HttpServer) EnableSsl(addr, certPath string) {
 
 	self.httpSslPort = addr
 	self.httpSslCert = certPath
+	self.httpSslKey = keyPath
+	if keyPath == "" {
+		self.httpSslKey = certPath
+	}
 	return
 }
 
+func (self *HttpServer) SetMaxWriteBodySize(size int64) {
+	self.maxWriteBodySize = size
+}
+
 func (self *HttpServer) ListenAndServe() {
 	var err error
 	if self.httpPort != "" {
@@ -102,12 +117,27 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	// with each batch of points we get back
 	self.registerEndpoint(p, "get", "/db/:db/series", self.query)
 
+	// Same as the query above, the query and the values of its
+	// $placeholders are in the body
+	self.registerEndpoint(p, "post", "/db/:db/query", self.queryWithParameters)
+
 	// Write points to the given database
 	self.registerEndpoint(p, "post", "/db/:db/series", self.writePoints)
+	// Write points to many databases, the body has the series of every database
+	self.registerEndpoint(p, "post", "/series", self.writeMultipleDatabases)
 	self.registerEndpoint(p, "del", "/db/:db/series/:series", self.dropSeries)
+	// prometheus remote storage, the database is the db parameter
+	self.registerEndpoint(p, "post", "/api/v1/prom/write", self.prometheusWrite)
+	self.registerEndpoint(p, "post", "/api/v1/prom/read", self.prometheusRead)
 	self.registerEndpoint(p, "get", "/db", self.listDatabases)
 	self.registerEndpoint(p, "post", "/db", self.createDatabase)
 	self.registerEndpoint(p, "del", "/db/:name", self.dropDatabase)
+	self.registerEndpoint(p, "post", "/db/:db/write_consistency", self.setWriteConsistency)
+	self.registerEndpoint(p, "post", "/db/:db/retention", self.setDatabaseRetention)
+	self.registerEndpoint(p, "get", "/db/:db/disk_usage", self.diskUsage)
+	self.registerEndpoint(p, "post", "/db/:db/read_only", self.setDatabaseReadOnly)
+	self.registerEndpoint(p, "post", "/db/:db/max_series", self.setMaxSeries)
+	self.registerEndpoint(p, "get", "/db/:db/cardinality", self.seriesCardinality)
 
 	// cluster admins management interface
 	self.registerEndpoint(p, "get", "/cluster_admins", self.listClusterAdmins)
@@ -128,10 +158,14 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	self.registerEndpoint(p, "get", "/db/:db/continuous_queries", self.listDbContinuousQueries)
 	self.registerEndpoint(p, "post", "/db/:db/continuous_queries", self.createDbContinuousQueries)
 	self.registerEndpoint(p, "del", "/db/:db/continuous_queries/:id", self.deleteDbContinuousQueries)
+	self.registerEndpoint(p, "post", "/db/:db/continuous_queries/:id/backfill", self.backfillDbContinuousQuery)
 
 	// healthcheck
 	self.registerEndpoint(p, "get", "/ping", self.ping)
 
+	// the metrics of this server, like expvar's /debug/vars
+	self.registerEndpoint(p, "get", "/debug/vars", self.debugVars)
+
 	// force a raft log compaction
 	self.registerEndpoint(p, "post", "/raft/force_compaction", self.forceRaftCompaction)
 
@@ -140,10 +174,42 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// cluster config endpoints
 	self.registerEndpoint(p, "get", "/cluster/servers", self.listServers)
+	self.registerEndpoint(p, "post", "/cluster/servers", self.addServer)
+	self.registerEndpoint(p, "get", "/cluster/members", self.listMembers)
+	self.registerEndpoint(p, "get", "/cluster/wal", self.walStats)
+	self.registerEndpoint(p, "post", "/cluster/wal/consumers", self.subscribeToWal)
+	self.registerEndpoint(p, "del", "/cluster/wal/consumers/:name", self.unsubscribeFromWal)
+	self.registerEndpoint(p, "get", "/cluster/wal/consumers/:name/changes", self.walChanges)
+	self.registerEndpoint(p, "post", "/cluster/wal/consumers/:name/ack", self.ackWalChanges)
 	self.registerEndpoint(p, "del", "/cluster/servers/:id", self.removeServers)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/decommission", self.decommissionServer)
+	self.registerEndpoint(p, "get", "/cluster/rebalance", self.planRebalance)
+	self.registerEndpoint(p, "post", "/cluster/rebalance", self.rebalance)
+	self.registerEndpoint(p, "post", "/cluster/replication_factor", self.setReplicationFactor)
+	self.registerEndpoint(p, "post", "/cluster/shard_duration", self.setShardDuration)
+	self.registerEndpoint(p, "get", "/cluster/settings", self.listRuntimeSettings)
+	self.registerEndpoint(p, "post", "/cluster/settings", self.setRuntimeSetting)
+	self.registerEndpoint(p, "get", "/cluster/read_only", self.getReadOnlyStatus)
+	self.registerEndpoint(p, "post", "/cluster/read_only", self.setClusterReadOnly)
+	// reloads the config file of the server that gets the request
+	self.registerEndpoint(p, "post", "/config/reload", self.reloadConfiguration)
+	self.registerEndpoint(p, "post", "/cluster/leader", self.transferLeadership)
+	self.registerEndpoint(p, "post", "/cluster/backup", self.backup)
+	self.registerEndpoint(p, "post", "/cluster/restore", self.restore)
+	self.registerEndpoint(p, "get", "/cluster/replication_targets", self.listReplicationTargets)
+	self.registerEndpoint(p, "post", "/cluster/replication_targets", self.createReplicationTarget)
+	self.registerEndpoint(p, "del", "/cluster/replication_targets/:name", self.dropReplicationTarget)
 	self.registerEndpoint(p, "post", "/cluster/shards", self.createShard)
 	self.registerEndpoint(p, "get", "/cluster/shards", self.getShards)
+	self.registerEndpoint(p, "get", "/cluster/shards/details", self.listShards)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/move", self.moveShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/drop_orphan", self.dropOrphanedShard)
 	self.registerEndpoint(p, "del", "/cluster/shards/:id", self.dropShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/repair", self.repairShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/catch_up", self.catchUpShard)
+	self.registerEndpoint(p, "get", "/cluster/shards/:id/backup", self.backupShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/restore", self.restoreShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/compact", self.compactShard)
 
 	// return whether the cluster is in sync or not
 	self.registerEndpoint(p, "get", "/sync", self.isInSync)
@@ -167,7 +233,7 @@ func (self *HttpServer) startSsl(p *pat.PatternServeMux) {
 
 	log.Info("Starting SSL api on port %s using certificate in %s", self.httpSslPort, self.httpSslCert)
 
-	cert, err := tls.LoadX509KeyPair(self.httpSslCert, self.httpSslCert)
+	cert, err := tls.LoadX509KeyPair(self.httpSslCert, self.httpSslKey)
 	if err != nil {
 		panic(err)
 	}
@@ -211,6 +277,7 @@ type AllPointsWriter struct {
 	memSeries map[string]*protocol.Series
 	w         libhttp.ResponseWriter
 	precision TimePrecision
+	format    ResponseFormat
 }
 
 func (self *AllPointsWriter) yield(series *protocol.Series) error {
@@ -225,38 +292,62 @@ func (self *AllPointsWriter) yield(series *protocol.Series) error {
 }
 
 func (self *AllPointsWriter) done() {
-	data, err := serializeMultipleSeries(self.memSeries, self.precision)
+	data, err := self.format.MarshalAllSeries(self.memSeries, self.precision)
 	if err != nil {
 		self.w.WriteHeader(libhttp.StatusInternalServerError)
 		self.w.Write([]byte(err.Error()))
 		return
 	}
-	self.w.Header().Add("content-type", "application/json")
+	self.w.Header().Add("content-type", self.format.ContentType())
 	self.w.WriteHeader(libhttp.StatusOK)
 	self.w.Write(data)
 }
 
+// Writes every batch of points as a chunk as soon as the engine yields
+// it, so the results aren't held in memory
 type ChunkWriter struct {
-	w                libhttp.ResponseWriter
-	precision        TimePrecision
-	wroteContentType bool
+	w           libhttp.ResponseWriter
+	precision   TimePrecision
+	format      ResponseFormat
+	wroteHeader bool
 }
 
 func (self *ChunkWriter) yield(series *protocol.Series) error {
-	data, err := serializeSingleSeries(series, self.precision)
+	data, err := self.format.MarshalSeries(series, self.precision)
 	if err != nil {
 		return err
 	}
-	if !self.wroteContentType {
-		self.wroteContentType = true
-		self.w.Header().Add("content-type", "application/json")
+	return self.writeChunk(data)
+}
+
+func (self *ChunkWriter) writeChunk(data []byte) error {
+	if !self.wroteHeader {
+		self.wroteHeader = true
+		self.w.Header().Add("content-type", self.format.ContentType())
+		self.w.WriteHeader(libhttp.StatusOK)
+	}
+	// a failed write stops the query, the client went away
+	if _, err := self.w.Write(data); err != nil {
+		return err
+	}
+	if flusher, ok := self.w.(libhttp.Flusher); ok {
+		flusher.Flush()
 	}
-	self.w.WriteHeader(libhttp.StatusOK)
-	self.w.Write(data)
-	self.w.(libhttp.Flusher).Flush()
 	return nil
 }
 
+// The errors of the queries that already returned some points can't
+// change the status code, they're written as the last chunk. The
+// responses in the formats without errors just end.
+func (self *ChunkWriter) writeError(message string) {
+	data, err := self.format.MarshalError(message)
+	if err != nil || data == nil {
+		log.Error("Query failed after its first chunk: %s", message)
+		return
+	}
+	self.writeChunk(data)
+}
+
 func (self *ChunkWriter) done() {
 }
 
@@ -264,15 +355,17 @@ func TimePrecisionFromString(s string) (TimePrecision, error) {
 	switch s {
 	case "u":
 		return MicrosecondPrecision, nil
-	case "m":
+	case "m", "ms":
 		return MillisecondPrecision, nil
+	case "ns":
+		return NanosecondPrecision, nil
 	case "s":
 		return SecondPrecision, nil
 	case "":
 		return MillisecondPrecision, nil
 	}
 
-	return 0, fmt.Errorf("Unknown time precision %s", s)
+	return 0, fmt.Errorf("Unknown time precision %s, must be one of s, ms, u or ns", s)
 }
 
 func (self *HttpServer) forceRaftCompaction(w libhttp.ResponseWriter, r *libhttp.Request) {
@@ -287,34 +380,124 @@ func (self *HttpServer) sendCrossOriginHeader(w libhttp.ResponseWriter, r *libht
 }
 
 func (self *HttpServer) query(w libhttp.ResponseWriter, r *libhttp.Request) {
-	query := r.URL.Query().Get("q")
-	db := r.URL.Query().Get(":db")
-
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		return self.runQuery(w, r, user, r.URL.Query().Get("q"), nil)
+	})
+}
 
-		precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
-		if err != nil {
+// The body of a query with parameters
+type parameterizedQuery struct {
+	Query  string            `json:"q"`
+	Params parser.Parameters `json:"params"`
+}
+
+func (self *HttpServer) queryWithParameters(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		decoder := json.NewDecoder(r.Body)
+		// keep the integer parameters integers
+		decoder.UseNumber()
+		query := &parameterizedQuery{}
+		if err := decoder.Decode(query); err != nil {
 			return libhttp.StatusBadRequest, err.Error()
 		}
+		return self.runQuery(w, r, user, query.Query, query.Params)
+	})
+}
 
-		var writer Writer
-		if r.URL.Query().Get("chunked") == "true" {
-			writer = &ChunkWriter{w, precision, false}
-		} else {
-			writer = &AllPointsWriter{map[string]*protocol.Series{}, w, precision}
+// Runs the query and writes the series it returns to the response
+func (self *HttpServer) runQuery(w libhttp.ResponseWriter, r *libhttp.Request, user User, query string, params parser.Parameters) (int, interface{}) {
+	db := r.URL.Query().Get(":db")
+	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+	if err != nil {
+		return libhttp.StatusBadRequest, err.Error()
+	}
+
+	consistency, err := cluster.ParseReadConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		return libhttp.StatusBadRequest, err.Error()
+	}
+
+	format, err := ResponseFormatOf(r)
+	if err != nil {
+		return libhttp.StatusBadRequest, err.Error()
+	}
+
+	var writer Writer
+	chunkWriter := &ChunkWriter{w, precision, format, false}
+	// the rows of csv responses are streamed, chunked or not
+	_, csvFormat := format.(*CsvFormat)
+	if r.URL.Query().Get("chunked") == "true" || csvFormat {
+		writer = chunkWriter
+	} else {
+		writer = &AllPointsWriter{map[string]*protocol.Series{}, w, precision, format}
+	}
+	traced := r.URL.Query().Get("trace") == "true"
+	serialization := &serializationTimer{}
+	yield := writer.yield
+	if traced {
+		yield = serialization.timed(writer.yield)
+	}
+	seriesWriter := NewSeriesWriter(yield)
+	// stop the query if the client goes away
+	var done <-chan bool
+	if notifier, ok := w.(libhttp.CloseNotifier); ok {
+		done = notifier.CloseNotify()
+	}
+	var trace *coordinator.QueryTrace
+	if traced {
+		trace, err = self.coordinator.RunTracedQuery(user, db, query, params, consistency, done, seriesWriter)
+	} else {
+		err = self.coordinator.RunQueryWithCancel(user, db, query, params, consistency, done, seriesWriter)
+	}
+	if err != nil && chunkWriter.wroteHeader {
+		chunkWriter.writeError(err.Error())
+		return -1, nil
+	}
+	if err != nil {
+		if e, ok := err.(*parser.QueryError); ok {
+			return errorToStatusCode(err), e.PrettyPrint()
 		}
-		seriesWriter := NewSeriesWriter(writer.yield)
-		err = self.coordinator.RunQuery(user, db, query, seriesWriter)
-		if err != nil {
-			if e, ok := err.(*parser.QueryError); ok {
-				return errorToStatusCode(err), e.PrettyPrint()
-			}
-			return errorToStatusCode(err), err.Error()
+		// tell the client which limit the query went over
+		if e, ok := err.(*QueryLimitError); ok {
+			return errorToStatusCode(err), e
 		}
+		return errorToStatusCode(err), errorBody(err)
+	}
 
-		writer.done()
-		return -1, nil
-	})
+	if trace != nil {
+		if allPoints, ok := writer.(*AllPointsWriter); ok {
+			// the points are serialized at once with the trace, the trace
+			// has the time of a serialization without it
+			start := time.Now()
+			allPoints.format.MarshalAllSeries(allPoints.memSeries, precision)
+			serialization.add(start)
+		}
+		trace.AddStage("serialization", serialization.start, serialization.duration)
+		writer.yield(trace.Series())
+	}
+	writer.done()
+	return -1, nil
+}
+
+// Counts the time the series of a traced query take to be serialized and
+// written to the client
+type serializationTimer struct {
+	start    time.Time
+	duration time.Duration
+}
+
+func (self *serializationTimer) timed(yield func(*protocol.Series) error) func(*protocol.Series) error {
+	return func(series *protocol.Series) error {
+		defer self.add(time.Now())
+		return yield(series)
+	}
+}
+
+func (self *serializationTimer) add(start time.Time) {
+	if self.start.IsZero() {
+		self.start = start
+	}
+	self.duration += time.Since(start)
 }
 
 func errorToStatusCode(err error) int {
@@ -325,11 +508,26 @@ func errorToStatusCode(err error) int {
 		return libhttp.StatusForbidden // HTTP 403
 	case DatabaseExistsError:
 		return libhttp.StatusConflict // HTTP 409
+	case *RateLimitError:
+		return STATUS_TOO_MANY_REQUESTS // HTTP 429
 	default:
 		return libhttp.StatusBadRequest // HTTP 400
 	}
 }
 
+// the status of a write or a query that went over a rate limit
+const STATUS_TOO_MANY_REQUESTS = 429
+
+// The body of the response to a write or a query that failed, the ones
+// that went over a rate limit get the limit and how long to wait before
+// retrying them
+func errorBody(err error) interface{} {
+	if e, ok := err.(*RateLimitError); ok {
+		return e
+	}
+	return err.Error()
+}
+
 func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
 	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
@@ -339,10 +537,22 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 		return
 	}
 
+	// if the consistency isn't set the default of the database is used
+	consistencyString := r.URL.Query().Get("consistency")
+	consistency, err := cluster.ParseWriteConsistency(consistencyString)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
-		series, err := ioutil.ReadAll(r.Body)
+		series, err := ReadDecompressedBody(r, self.maxWriteBodySize)
 		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
+			if _, ok := err.(BodyTooLargeError); ok {
+				return libhttp.StatusRequestEntityTooLarge, err.Error()
+			}
+			return libhttp.StatusBadRequest, err.Error()
 		}
 		serializedSeries := []*SerializedSeries{}
 		err = json.Unmarshal(series, &serializedSeries)
@@ -350,29 +560,270 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 			return libhttp.StatusBadRequest, err.Error()
 		}
 
-		// convert the wire format to the internal representation of the time series
-		dataStoreSeries := make([]*protocol.Series, 0, len(serializedSeries))
-		for _, s := range serializedSeries {
-			if len(s.Points) == 0 {
+		if r.URL.Query().Get("partial_write") == "true" {
+			return self.writePartially(r, user, db, serializedSeries, precision, consistencyString, consistency)
+		}
+
+		dataStoreSeries, err := convertToDataStoreSeries(serializedSeries, precision)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.writeSeries(r, user, db, dataStoreSeries, consistencyString, consistency); err != nil {
+			return errorToStatusCode(err), errorBody(err)
+		}
+
+		return libhttp.StatusOK, nil
+	})
+}
+
+// A point of a partial write that wasn't written, Series and Point are
+// its indices in the body
+type rejectedPoint struct {
+	Series int    `json:"series"`
+	Point  int    `json:"point"`
+	Error  string `json:"error"`
+}
+
+type partialWriteResult struct {
+	Written  int              `json:"written"`
+	Rejected []*rejectedPoint `json:"rejected"`
+}
+
+type pointIndex struct {
+	series, point int
+}
+
+// Writes the valid points of the series and returns the ones that were
+// rejected with the reason. The points that can't be converted are
+// rejected up front, the ones with a value that doesn't match the type
+// of its field once the shards checked them, the write then goes on
+// without them. Returns 207 if some points were rejected, 400 if all of
+// them were.
+func (self *HttpServer) writePartially(r *libhttp.Request, user User, db string, serializedSeries []*SerializedSeries, precision TimePrecision, consistencyString string, consistency cluster.WriteConsistency) (int, interface{}) {
+	result := &partialWriteResult{Rejected: []*rejectedPoint{}}
+	indices := map[*protocol.Point]pointIndex{}
+	dataStoreSeries := make([]*protocol.Series, 0, len(serializedSeries))
+	for i, s := range serializedSeries {
+		series := &protocol.Series{Name: protocol.String(s.GetName()), Fields: DataStoreFields(s.GetColumns())}
+		for j, point := range s.GetPoints() {
+			p, err := ConvertToDataStorePoint(s.GetColumns(), point, precision)
+			if err == nil && s.GetName() == "" {
+				err = fmt.Errorf("Series name cannot be empty")
+			}
+			if err != nil {
+				result.Rejected = append(result.Rejected, &rejectedPoint{i, j, err.Error()})
 				continue
 			}
+			indices[p] = pointIndex{i, j}
+			series.Points = append(series.Points, p)
+		}
+		if len(series.Points) > 0 {
+			dataStoreSeries = append(dataStoreSeries, series)
+		}
+	}
 
-			series, err := ConvertToDataStoreSeries(s, precision)
+	for len(dataStoreSeries) > 0 {
+		err := self.writeSeries(r, user, db, dataStoreSeries, consistencyString, consistency)
+		conflicts, ok := err.(FieldTypeConflictError)
+		if !ok {
 			if err != nil {
-				return libhttp.StatusBadRequest, err.Error()
+				return errorToStatusCode(err), errorBody(err)
 			}
+			break
+		}
 
-			dataStoreSeries = append(dataStoreSeries, series)
+		// nothing was written, the write is retried without the points
+		// of the conflicts
+		rejected := map[*protocol.Point]bool{}
+		for _, conflict := range conflicts {
+			if !rejected[conflict.Point] {
+				rejected[conflict.Point] = true
+				index := indices[conflict.Point]
+				result.Rejected = append(result.Rejected, &rejectedPoint{index.series, index.point, conflict.Error()})
+			}
+		}
+		remaining := dataStoreSeries[:0]
+		for _, series := range dataStoreSeries {
+			points := series.Points[:0]
+			for _, point := range series.Points {
+				if !rejected[point] {
+					points = append(points, point)
+				}
+			}
+			if series.Points = points; len(points) > 0 {
+				remaining = append(remaining, series)
+			}
 		}
+		dataStoreSeries = remaining
+	}
+
+	for _, series := range dataStoreSeries {
+		result.Written += len(series.Points)
+	}
+	sort.Sort(rejectedPointsByIndex(result.Rejected))
+	switch {
+	case len(result.Rejected) == 0:
+		return libhttp.StatusOK, result
+	case result.Written == 0:
+		return libhttp.StatusBadRequest, result
+	}
+	return STATUS_MULTI_STATUS, result
+}
+
+type rejectedPointsByIndex []*rejectedPoint
 
-		err = self.coordinator.WriteSeriesData(user, db, dataStoreSeries)
+func (self rejectedPointsByIndex) Len() int      { return len(self) }
+func (self rejectedPointsByIndex) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self rejectedPointsByIndex) Less(i, j int) bool {
+	if self[i].Series != self[j].Series {
+		return self[i].Series < self[j].Series
+	}
+	return self[i].Point < self[j].Point
+}
+
+// converts the wire format to the internal representation of the time
+// series, the series without points are dropped
+func convertToDataStoreSeries(serializedSeries []*SerializedSeries, precision TimePrecision) ([]*protocol.Series, error) {
+	dataStoreSeries := make([]*protocol.Series, 0, len(serializedSeries))
+	for _, s := range serializedSeries {
+		if len(s.Points) == 0 {
+			continue
+		}
 
+		series, err := ConvertToDataStoreSeries(s, precision)
 		if err != nil {
-			return errorToStatusCode(err), err.Error()
+			return nil, err
 		}
 
-		return libhttp.StatusOK, nil
-	})
+		dataStoreSeries = append(dataStoreSeries, series)
+	}
+	return dataStoreSeries, nil
+}
+
+func (self *HttpServer) writeSeries(r *libhttp.Request, user User, db string, series []*protocol.Series, consistencyString string, consistency cluster.WriteConsistency) error {
+	// the retries of a write with a key are dropped by the shards
+	if key := idempotencyKey(r); key != "" {
+		return self.coordinator.WriteSeriesDataOnce(user, db, series, consistencyString, key)
+	}
+	if consistencyString == "" {
+		return self.coordinator.WriteSeriesData(user, db, series)
+	}
+	return self.coordinator.WriteSeriesDataWithConsistency(user, db, series, consistency)
+}
+
+// the status of a write to many databases that failed for some of them
+const STATUS_MULTI_STATUS = 207
+
+type databaseWrite struct {
+	Database string              `json:"database"`
+	Series   []*SerializedSeries `json:"series"`
+}
+
+type databaseWriteResult struct {
+	Database string `json:"database"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Writes the series of many databases in one request. The credentials
+// are checked for every database, the user may be a cluster admin or a
+// user of each of them. The body is checked before anything is written
+// but the databases are written one at a time, the result of every
+// database is returned so the ones that failed can be retried.
+func (self *HttpServer) writeMultipleDatabases(w libhttp.ResponseWriter, r *libhttp.Request) {
+	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	consistencyString := r.URL.Query().Get("consistency")
+	consistency, err := cluster.ParseWriteConsistency(consistencyString)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	username, password, err := getUsernameAndPassword(r)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if username == "" {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
+		w.WriteHeader(libhttp.StatusUnauthorized)
+		w.Write([]byte(INVALID_CREDENTIALS_MSG))
+		return
+	}
+
+	body, err := ReadDecompressedBody(r, self.maxWriteBodySize)
+	if err != nil {
+		if _, ok := err.(BodyTooLargeError); ok {
+			w.WriteHeader(libhttp.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(libhttp.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writes := []*databaseWrite{}
+	if err := json.Unmarshal(body, &writes); err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	series := make([][]*protocol.Series, len(writes))
+	for i, write := range writes {
+		if write.Database == "" {
+			w.WriteHeader(libhttp.StatusBadRequest)
+			w.Write([]byte("The database of every write must be set"))
+			return
+		}
+		if series[i], err = convertToDataStoreSeries(write.Series, precision); err != nil {
+			w.WriteHeader(libhttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	statusCode := libhttp.StatusOK
+	results := make([]*databaseWriteResult, 0, len(writes))
+	for i, write := range writes {
+		result := &databaseWriteResult{Database: write.Database, Status: libhttp.StatusOK}
+		results = append(results, result)
+		user, err := self.userManager.AuthenticateDbUser(write.Database, username, password)
+		if err == nil {
+			err = self.writeSeries(r, user, write.Database, series[i], consistencyString, consistency)
+		} else {
+			err = NewAuthenticationError("%s", err)
+		}
+		if err != nil {
+			result.Status = errorToStatusCode(err)
+			result.Error = err.Error()
+			statusCode = STATUS_MULTI_STATUS
+		}
+	}
+
+	content, contentType, err := toBytes(results)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("content-type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(content)
+}
+
+// Returns the idempotency key of the write, from the Idempotency-Key
+// header or the idempotency_key parameter
+func idempotencyKey(r *libhttp.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("idempotency_key")
 }
 
 type createDatabaseRequest struct {
@@ -410,78 +861,219 @@ func (self *HttpServer) createDatabase(w libhttp.ResponseWriter, r *libhttp.Requ
 	})
 }
 
-func (self *HttpServer) dropDatabase(w libhttp.ResponseWriter, r *libhttp.Request) {
-	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
-		name := r.URL.Query().Get(":name")
-		err := self.coordinator.DropDatabase(user, name)
-		if err != nil {
-			return errorToStatusCode(err), err.Error()
-		}
-		return libhttp.StatusNoContent, nil
-	})
+type writeConsistencyRequest struct {
+	Consistency string `json:"consistency"`
 }
 
-func (self *HttpServer) dropSeries(w libhttp.ResponseWriter, r *libhttp.Request) {
+func (self *HttpServer) setWriteConsistency(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
-	series := r.URL.Query().Get(":series")
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
-		f := func(s *protocol.Series) error {
-			return nil
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
 		}
-		seriesWriter := NewSeriesWriter(f)
-		err := self.coordinator.RunQuery(user, db, fmt.Sprintf("drop series %s", series), seriesWriter)
+		consistencyRequest := &writeConsistencyRequest{}
+		err = json.Unmarshal(body, consistencyRequest)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		err = self.coordinator.SetWriteConsistency(user, db, consistencyRequest.Consistency)
 		if err != nil {
 			return errorToStatusCode(err), err.Error()
 		}
-		return libhttp.StatusNoContent, nil
+		return libhttp.StatusOK, nil
 	})
 }
 
-type Point struct {
-	Timestamp      int64         `json:"timestamp"`
-	SequenceNumber uint32        `json:"sequenceNumber"`
-	Values         []interface{} `json:"values"`
+type databaseRetentionRequest struct {
+	Retention string `json:"retention"`
 }
 
-func serializeSingleSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
-	arg := map[string]*protocol.Series{"": series}
-	return json.Marshal(SerializeSeries(arg, precision)[0])
-}
+// Sets how long the points of the database are kept to "retention" in
+// the body, e.g. "30d" or "inf"
+func (self *HttpServer) setDatabaseRetention(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
 
-func serializeMultipleSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
-	return json.Marshal(SerializeSeries(series, precision))
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		retentionRequest := &databaseRetentionRequest{}
+		err = json.Unmarshal(body, retentionRequest)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		err = self.coordinator.SetDatabaseRetention(user, db, retentionRequest.Retention)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
 }
 
-// // cluster admins management interface
-
-func toBytes(body interface{}) ([]byte, string, error) {
-	if body == nil {
-		return nil, "text/plain", nil
-	}
-	switch x := body.(type) {
-	case string:
-		return []byte(x), "text/plain", nil
-	case []byte:
-		return x, "text/plain", nil
-	default:
-		body, err := json.Marshal(body)
-		return body, "application/json", err
-	}
+type readOnlyRequest struct {
+	ReadOnly bool `json:"readOnly"`
 }
 
-func yieldUser(user User, yield func(User) (int, interface{})) (int, string, []byte) {
-	statusCode, body := yield(user)
-	bodyContent, contentType, err := toBytes(body)
+func readOnlyFromBody(r *libhttp.Request) (bool, error) {
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return libhttp.StatusInternalServerError, "text/plain", []byte(err.Error())
+		return false, err
 	}
-
-	return statusCode, contentType, bodyContent
+	request := &readOnlyRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return false, err
+	}
+	return request.ReadOnly, nil
 }
 
-func getUsernameAndPassword(r *libhttp.Request) (string, string, error) {
-	q := r.URL.Query()
+// Rejects the writes of the database while "readOnly" in the body is
+// true, with a 403, the queries keep running
+func (self *HttpServer) setDatabaseReadOnly(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		readOnly, err := readOnlyFromBody(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.SetReadOnly(user, db, readOnly); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+type maxSeriesRequest struct {
+	MaxSeries int `json:"maxSeries"`
+}
+
+// Rejects the writes that would create more than "maxSeries" series in
+// the database, zero removes the limit
+func (self *HttpServer) setMaxSeries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		request := &maxSeriesRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.SetMaxSeries(u, db, request.MaxSeries); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Returns the estimated series of the database and its limit, the
+// cluster admins get the ones of every database
+func (self *HttpServer) seriesCardinality(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		cardinalities, err := self.coordinator.SeriesCardinality(user, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, cardinalities
+	})
+}
+
+// Returns the disk usage of the database in each of its shards, the
+// cluster admins also get the sizes of the files of the replicas
+func (self *HttpServer) diskUsage(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		usages, err := self.coordinator.DiskUsage(user, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, usages
+	})
+}
+
+func (self *HttpServer) dropDatabase(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		name := r.URL.Query().Get(":name")
+		err := self.coordinator.DropDatabase(user, name)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+func (self *HttpServer) dropSeries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	series := r.URL.Query().Get(":series")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		f := func(s *protocol.Series) error {
+			return nil
+		}
+		seriesWriter := NewSeriesWriter(f)
+		err := self.coordinator.RunQuery(user, db, fmt.Sprintf("drop series %s", series), seriesWriter)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+type Point struct {
+	Timestamp      int64         `json:"timestamp"`
+	SequenceNumber uint32        `json:"sequenceNumber"`
+	Values         []interface{} `json:"values"`
+}
+
+func serializeSingleSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
+	arg := map[string]*protocol.Series{"": series}
+	return json.Marshal(SerializeSeries(arg, precision)[0])
+}
+
+func serializeMultipleSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
+	return json.Marshal(SerializeSeries(series, precision))
+}
+
+// // cluster admins management interface
+
+func toBytes(body interface{}) ([]byte, string, error) {
+	if body == nil {
+		return nil, "text/plain", nil
+	}
+	switch x := body.(type) {
+	case string:
+		return []byte(x), "text/plain", nil
+	case []byte:
+		return x, "text/plain", nil
+	default:
+		body, err := json.Marshal(body)
+		return body, "application/json", err
+	}
+}
+
+func yieldUser(w libhttp.ResponseWriter, user User, yield func(User) (int, interface{})) (int, string, []byte) {
+	statusCode, body := yield(user)
+	if e, ok := body.(*RateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	bodyContent, contentType, err := toBytes(body)
+	if err != nil {
+		return libhttp.StatusInternalServerError, "text/plain", []byte(err.Error())
+	}
+
+	return statusCode, contentType, bodyContent
+}
+
+func getUsernameAndPassword(r *libhttp.Request) (string, string, error) {
+	q := r.URL.Query()
 	username, password := q.Get("u"), q.Get("p")
 
 	if username != "" && password != "" {
@@ -533,7 +1125,7 @@ func (self *HttpServer) tryAsClusterAdmin(w libhttp.ResponseWriter, r *libhttp.R
 		w.Write([]byte(err.Error()))
 		return
 	}
-	statusCode, contentType, body := yieldUser(user, yield)
+	statusCode, contentType, body := yieldUser(w, user, yield)
 	if statusCode < 0 {
 		return
 	}
@@ -578,6 +1170,13 @@ type NewContinuousQuery struct {
 	Query string `json:"query"`
 }
 
+// The range of the backfill in seconds since the epoch, the end defaults
+// to now
+type ContinuousQueryBackfill struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
 func (self *HttpServer) listClusterAdmins(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		names, err := self.userManager.ListClusterAdmins(u)
@@ -686,7 +1285,7 @@ func (self *HttpServer) tryAsDbUser(w libhttp.ResponseWriter, r *libhttp.Request
 		return libhttp.StatusUnauthorized, []byte(err.Error())
 	}
 
-	statusCode, contentType, v := yieldUser(user, yield)
+	statusCode, contentType, v := yieldUser(w, user, yield)
 	if statusCode == libhttp.StatusUnauthorized {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 	}
@@ -869,8 +1468,18 @@ func (self *HttpServer) ping(w libhttp.ResponseWriter, r *libhttp.Request) {
 	w.Write([]byte("{\"status\":\"ok\"}"))
 }
 
+func (self *HttpServer) debugVars(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, metrics.Snapshot()
+	})
+}
+
 func (self *HttpServer) listInterfaces(w libhttp.ResponseWriter, r *libhttp.Request) {
-	statusCode, contentType, body := yieldUser(nil, func(u User) (int, interface{}) {
+	statusCode, contentType, body := yieldUser(w, nil, func(u User) (int, interface{}) {
+		// the built in admin site doesn't have interfaces
+		if self.adminAssetsDir == "" {
+			return libhttp.StatusOK, []string{}
+		}
 		entries, err := ioutil.ReadDir(filepath.Join(self.adminAssetsDir, "interfaces"))
 
 		if err != nil {
@@ -944,126 +1553,810 @@ func (self *HttpServer) deleteDbContinuousQueries(w libhttp.ResponseWriter, r *l
 	})
 }
 
+func (self *HttpServer) backfillDbContinuousQuery(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	id, _ := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+
+		backfill := &ContinuousQueryBackfill{}
+		if err := json.Unmarshal(body, backfill); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		end := time.Now()
+		if backfill.End != 0 {
+			end = time.Unix(backfill.End, 0)
+		}
+
+		if err := self.coordinator.BackfillContinuousQuery(u, db, uint32(id), time.Unix(backfill.Start, 0), end); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		// the backfill runs in the background
+		return libhttp.StatusAccepted, nil
+	})
+}
+
 func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		servers := self.clusterConfig.Servers()
 		serverMaps := make([]map[string]interface{}, len(servers), len(servers))
 		for i, s := range servers {
-			serverMaps[i] = map[string]interface{}{"id": s.Id, "protobufConnectString": s.ProtobufConnectionString}
+			serverMaps[i] = map[string]interface{}{
+				"id":                    s.Id,
+				"name":                  s.RaftName,
+				"raftConnectString":     s.RaftConnectionString,
+				"protobufConnectString": s.ProtobufConnectionString,
+				"readLatencyMs":         float64(s.ReadLatency()) / float64(time.Millisecond),
+				"decommissioning":       s.IsDecommissioning(),
+				"failureDomain":         s.FailureDomain,
+				"isUp":                  s == self.clusterConfig.LocalServer || s.IsUp(),
+				"phi":                   s.Phi(),
+				"writeBuffer":           s.WriteBufferStats(),
+			}
 		}
 		return libhttp.StatusOK, serverMaps
 	})
 }
 
-func (self *HttpServer) removeServers(w libhttp.ResponseWriter, r *libhttp.Request) {
+// Returns the size of the wal of the server answering the request and
+// how much of it is waiting for other servers to commit their requests
+func (self *HttpServer) walStats(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
-		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
-		if err != nil {
-			return errorToStatusCode(err), err.Error()
-		}
-
-		err = self.raftServer.RemoveServer(uint32(id))
-		if err != nil {
-			return errorToStatusCode(err), err.Error()
-		}
-		return libhttp.StatusOK, nil
+		return libhttp.StatusOK, self.clusterConfig.WalStats()
 	})
 }
 
-type newShardInfo struct {
-	StartTime int64               `json:"startTime"`
-	EndTime   int64               `json:"endTime"`
-	Shards    []newShardServerIds `json:"shards"`
-	LongTerm  bool                `json:"longTerm"`
+type walConsumerInfo struct {
+	Name          string `json:"name"`
+	RequestNumber uint32 `json:"requestNumber"`
 }
 
-type newShardServerIds struct {
-	ServerIds []uint32 `json:"serverIds"`
+func readWalConsumerInfo(r *libhttp.Request) (*walConsumerInfo, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	info := &walConsumerInfo{}
+	return info, json.Unmarshal(body, info)
 }
 
-func (self *HttpServer) createShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+// Starts a consumer of the wal of the server answering the request at
+// "requestNumber" in the body. Every server only logs the writes it
+// received, a consumer has to tail the wal of every server to get all
+// the writes.
+func (self *HttpServer) subscribeToWal(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
-		newShards := &newShardInfo{}
-		body, err := ioutil.ReadAll(r.Body)
+		info, err := readWalConsumerInfo(r)
 		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
+			return libhttp.StatusBadRequest, err.Error()
 		}
-		err = json.Unmarshal(body, &newShards)
-		if err != nil {
+		if info.Name == "" {
+			return libhttp.StatusBadRequest, "The consumer name cannot be empty"
+		}
+		if err := self.clusterConfig.GetWal().Subscribe(info.Name, info.RequestNumber); err != nil {
 			return libhttp.StatusInternalServerError, err.Error()
 		}
-		shards := make([]*cluster.NewShardData, 0)
+		return libhttp.StatusCreated, nil
+	})
+}
 
-		shardType := cluster.SHORT_TERM
-		if newShards.LongTerm {
-			shardType = cluster.LONG_TERM
+func (self *HttpServer) unsubscribeFromWal(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if err := self.clusterConfig.GetWal().Unsubscribe(r.URL.Query().Get(":name")); err != nil {
+			return libhttp.StatusNotFound, err.Error()
 		}
-		for _, s := range newShards.Shards {
-			newShardData := &cluster.NewShardData{
-				StartTime: time.Unix(newShards.StartTime, 0),
-				EndTime:   time.Unix(newShards.EndTime, 0),
-				ServerIds: s.ServerIds,
-				Type:      shardType,
+		return libhttp.StatusOK, nil
+	})
+}
+
+type walChange struct {
+	RequestNumber uint32              `json:"requestNumber"`
+	ShardId       uint32              `json:"shardId"`
+	Type          string              `json:"type"`
+	Database      string              `json:"database"`
+	Query         string              `json:"query,omitempty"`
+	Series        []*SerializedSeries `json:"series,omitempty"`
+}
+
+var errEnoughWalChanges = errors.New("enough wal changes")
+
+// Returns up to "limit" requests, 1000 by default, after the last one the
+// consumer acked. The consumer gets the same requests until it acks
+// them.
+func (self *HttpServer) walChanges(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		limit := 1000
+		if param := r.URL.Query().Get("limit"); param != "" {
+			l, err := strconv.Atoi(param)
+			if err != nil || l <= 0 {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Invalid limit %s", param)
 			}
-			shards = append(shards, newShardData)
+			limit = l
 		}
-		_, err = self.raftServer.CreateShards(shards)
-		if err != nil {
+
+		changes := []*walChange{}
+		err := self.clusterConfig.GetWal().ReplayToConsumer(r.URL.Query().Get(":name"), func(request *protocol.Request, shardId uint32) error {
+			change := &walChange{
+				RequestNumber: request.GetRequestNumber(),
+				ShardId:       shardId,
+				Type:          request.GetType().String(),
+				Database:      request.GetDatabase(),
+				Query:         request.GetQuery(),
+			}
+			for _, s := range request.MultiSeries {
+				change.Series = append(change.Series, SerializeSeries(map[string]*protocol.Series{s.GetName(): s}, MicrosecondPrecision)...)
+			}
+			changes = append(changes, change)
+			if len(changes) >= limit {
+				return errEnoughWalChanges
+			}
+			return nil
+		})
+		if err != nil && err != errEnoughWalChanges {
 			return libhttp.StatusInternalServerError, err.Error()
 		}
-		return libhttp.StatusAccepted, nil
+		return libhttp.StatusOK, changes
 	})
 }
 
-func (self *HttpServer) getShards(w libhttp.ResponseWriter, r *libhttp.Request) {
+// Marks the requests up to "requestNumber" in the body as processed by
+// the consumer, the wal keeps them until every consumer acked them
+func (self *HttpServer) ackWalChanges(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
-		result := make(map[string]interface{})
-		result["shortTerm"] = self.convertShardsToMap(self.clusterConfig.GetShortTermShards())
-		result["longTerm"] = self.convertShardsToMap(self.clusterConfig.GetLongTermShards())
-		return libhttp.StatusOK, result
+		info, err := readWalConsumerInfo(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.clusterConfig.GetWal().Ack(r.URL.Query().Get(":name"), info.RequestNumber); err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+		return libhttp.StatusOK, nil
 	})
 }
 
-// Note: this is meant for testing purposes only and doesn't guarantee
-// data integrity and shouldn't be used in client code.
-func (self *HttpServer) isInSync(w libhttp.ResponseWriter, r *libhttp.Request) {
+// Lists the servers of the cluster with their raft role and what they
+// reported in their last heartbeat. The info of the server answering
+// the request is always current.
+func (self *HttpServer) listMembers(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
-		if self.clusterConfig.HasUncommitedWrites() {
-			return 500, "false"
-		}
-
-		if !self.raftServer.CommittedAllChanges() {
-			return 500, "false"
+		leader := self.raftServer.LeaderName()
+		servers := self.clusterConfig.Servers()
+		members := make([]map[string]interface{}, 0, len(servers))
+		for _, s := range servers {
+			role := "follower"
+			if s.RaftName == leader {
+				role = "leader"
+			} else if s.State == cluster.Observer {
+				role = "observer"
+			}
+			info := s.Info()
+			if s == self.clusterConfig.LocalServer {
+				info = self.clusterConfig.LocalServerInfo()
+			}
+			member := map[string]interface{}{
+				"id":                    s.Id,
+				"raftName":              s.RaftName,
+				"raftConnectString":     s.RaftConnectionString,
+				"protobufConnectString": s.ProtobufConnectionString,
+				"raftRole":              role,
+				"isUp":                  s == self.clusterConfig.LocalServer || s.IsUp(),
+			}
+			if info != nil {
+				member["buildVersion"] = info.BuildVersion
+				member["protocolVersion"] = info.ProtocolVersion
+				member["diskFree"] = info.DiskFree
+				member["lastHeartbeat"] = info.LastHeartbeat.Unix()
+			}
+			members = append(members, member)
 		}
-
-		return 200, "true"
+		return libhttp.StatusOK, members
 	})
 }
 
-func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+// Adds a server that isn't started yet, it joins the cluster once it's
+// started with the raft name and connection strings it was added with
+func (self *HttpServer) addServer(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
-		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
-		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
-		}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			return libhttp.StatusInternalServerError, err.Error()
 		}
-		serverIdInfo := &newShardServerIds{}
-		err = json.Unmarshal(body, &serverIdInfo)
+		server := &cluster.NewServer{}
+		err = json.Unmarshal(body, server)
 		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
+			return libhttp.StatusBadRequest, err.Error()
 		}
-		if len(serverIdInfo.ServerIds) < 1 {
-			return libhttp.StatusBadRequest, errors.New("Request must include an object with an array of 'serverIds'").Error()
+		if err := server.Validate(); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
 		}
 
-		err = self.raftServer.DropShard(uint32(id), serverIdInfo.ServerIds)
+		err = self.coordinator.AddServer(u, server)
 		if err != nil {
-			return libhttp.StatusInternalServerError, err.Error()
+			return errorToStatusCode(err), err.Error()
 		}
-		return libhttp.StatusAccepted, nil
+		return libhttp.StatusCreated, nil
+	})
+}
+
+func (self *HttpServer) removeServers(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
+		err = self.raftServer.RemoveServer(uint32(id))
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+type newShardInfo struct {
+	StartTime int64               `json:"startTime"`
+	EndTime   int64               `json:"endTime"`
+	Shards    []newShardServerIds `json:"shards"`
+	LongTerm  bool                `json:"longTerm"`
+}
+
+type newShardServerIds struct {
+	ServerIds []uint32 `json:"serverIds"`
+}
+
+func (self *HttpServer) decommissionServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.DecommissionServer(u, uint32(id))
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) planRebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		moves, err := self.coordinator.PlanRebalance(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, moves
+	})
+}
+
+func (self *HttpServer) rebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		moves := []*cluster.ShardMove{}
+		err = json.Unmarshal(body, &moves)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.Rebalance(u, moves)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) setReplicationFactor(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &struct {
+			ReplicationFactor int `json:"replicationFactor"`
+		}{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.SetReplicationFactor(u, info.ReplicationFactor)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+type backupInfo struct {
+	Dir string `json:"dir"`
+}
+
+func (self *HttpServer) readBackupInfo(r *libhttp.Request) (*backupInfo, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	info := &backupInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, err
+	}
+	if info.Dir == "" {
+		return nil, fmt.Errorf("The backup directory is missing")
+	}
+	return info, nil
+}
+
+// Backs up the cluster to the directory given by "dir" in the body and
+// returns the manifest of the backup
+func (self *HttpServer) backup(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		info, err := self.readBackupInfo(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		manifest, err := self.coordinator.Backup(u, info.Dir)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, manifest
+	})
+}
+
+func (self *HttpServer) restore(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		info, err := self.readBackupInfo(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.coordinator.Restore(u, info.Dir); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+// Changes the duration of new shards of the type given by "type" in the
+// body, either short-term or long-term, to "duration", e.g. "1d"
+func (self *HttpServer) setShardDuration(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &struct {
+			Type     string `json:"type"`
+			Duration string `json:"duration"`
+		}{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		shardType, err := cluster.ParseShardType(info.Type)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if info.Duration == "" {
+			return libhttp.StatusBadRequest, "The shard duration is missing"
+		}
+		duration, err := ParseTimeDuration(info.Duration)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.SetShardDuration(u, shardType, time.Duration(duration))
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) listRuntimeSettings(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		settings, err := self.coordinator.ListRuntimeSettings(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, settings
+	})
+}
+
+// Changes a setting on every server of the cluster, the body has the
+// name and the new value of the setting
+func (self *HttpServer) setRuntimeSetting(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		setting := &struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}{}
+		err = json.Unmarshal(body, setting)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.SetRuntimeSetting(u, setting.Name, setting.Value)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Same as setDatabaseReadOnly for the writes of every database
+func (self *HttpServer) setClusterReadOnly(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		readOnly, err := readOnlyFromBody(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.SetReadOnly(u, "", readOnly); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Returns whether the cluster is read-only and the databases that are
+func (self *HttpServer) getReadOnlyStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		status, err := self.coordinator.GetReadOnlyStatus(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, status
+	})
+}
+
+// Returns the settings that were applied, the ones that need a restart
+// and the ones that keep the value they were changed to at runtime
+func (self *HttpServer) reloadConfiguration(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		reload, err := self.coordinator.ReloadConfiguration(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, reload
+	})
+}
+
+// The buffered bytes and resume tokens in the response are the ones of
+// the server that answers the request
+func (self *HttpServer) listReplicationTargets(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		targets, err := self.coordinator.ListReplicationTargets(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, targets
+	})
+}
+
+func (self *HttpServer) createReplicationTarget(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		target := &cluster.ReplicationTarget{}
+		err = json.Unmarshal(body, target)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := target.Validate(); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		err = self.coordinator.CreateReplicationTarget(u, target)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusCreated, nil
+	})
+}
+
+func (self *HttpServer) dropReplicationTarget(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		name := r.URL.Query().Get(":name")
+		err := self.coordinator.DropReplicationTarget(u, name)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Moves the raft leadership to the server given by "serverId" in the
+// body, or to any other server if it's missing
+func (self *HttpServer) transferLeadership(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &struct {
+			ServerId uint32 `json:"serverId"`
+		}{}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, info); err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+
+		leader, err := self.raftServer.TransferLeadership(info.ServerId)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, map[string]string{"leader": leader}
+	})
+}
+
+func (self *HttpServer) createShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		newShards := &newShardInfo{}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		err = json.Unmarshal(body, &newShards)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		shards := make([]*cluster.NewShardData, 0)
+
+		shardType := cluster.SHORT_TERM
+		if newShards.LongTerm {
+			shardType = cluster.LONG_TERM
+		}
+		for _, s := range newShards.Shards {
+			newShardData := &cluster.NewShardData{
+				StartTime: time.Unix(newShards.StartTime, 0),
+				EndTime:   time.Unix(newShards.EndTime, 0),
+				ServerIds: s.ServerIds,
+				Type:      shardType,
+			}
+			shards = append(shards, newShardData)
+		}
+		_, err = self.raftServer.CreateShards(shards)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) getShards(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		result := make(map[string]interface{})
+		result["shortTerm"] = self.convertShardsToMap(self.clusterConfig.GetShortTermShards())
+		result["longTerm"] = self.convertShardsToMap(self.clusterConfig.GetLongTermShards())
+		return libhttp.StatusOK, result
+	})
+}
+
+// Note: this is meant for testing purposes only and doesn't guarantee
+// data integrity and shouldn't be used in client code.
+func (self *HttpServer) isInSync(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if self.clusterConfig.HasUncommitedWrites() {
+			return 500, "false"
+		}
+
+		if !self.raftServer.CommittedAllChanges() {
+			return 500, "false"
+		}
+
+		return 200, "true"
+	})
+}
+
+func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		serverIdInfo := &newShardServerIds{}
+		err = json.Unmarshal(body, &serverIdInfo)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		if len(serverIdInfo.ServerIds) < 1 {
+			return libhttp.StatusBadRequest, errors.New("Request must include an object with an array of 'serverIds'").Error()
+		}
+
+		err = self.raftServer.DropShard(uint32(id), serverIdInfo.ServerIds)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+// Lists the shards with the sizes of their replicas and the copies of
+// shards that are orphaned on the servers
+func (self *HttpServer) listShards(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		listing, err := self.coordinator.ListShards(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, listing
+	})
+}
+
+func (self *HttpServer) moveShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		move := &cluster.ShardMove{}
+		// the servers are given either as the from and to params or in
+		// the body
+		if from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to"); from != "" || to != "" {
+			fromId, err := strconv.ParseUint(from, 10, 32)
+			if err != nil {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Invalid server id %q", from)
+			}
+			toId, err := strconv.ParseUint(to, 10, 32)
+			if err != nil {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Invalid server id %q", to)
+			}
+			move.From, move.To = uint32(fromId), uint32(toId)
+		} else {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return libhttp.StatusInternalServerError, err.Error()
+			}
+			if err := json.Unmarshal(body, move); err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+		move.ShardId = uint32(id)
+
+		err = self.coordinator.MoveShard(u, move)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+func (self *HttpServer) dropOrphanedShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		serverIdInfo := &newShardServerIds{}
+		if len(body) > 0 {
+			err = json.Unmarshal(body, serverIdInfo)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+
+		err = self.coordinator.DropOrphanedShard(u, uint32(id), serverIdInfo.ServerIds)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Streams a backup of the local copy of the shard, the shard keeps
+// taking writes while it's backed up
+func (self *HttpServer) backupShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if shard := self.clusterConfig.GetShard(uint32(id)); shard == nil || !shard.IsLocal {
+			return libhttp.StatusNotFound, fmt.Sprintf("Shard %d isn't stored on this server", id)
+		}
+		w.Header().Add("content-type", "application/octet-stream")
+		w.WriteHeader(libhttp.StatusOK)
+		if err := self.clusterConfig.BackupShardTo(uint32(id), w); err != nil {
+			// the backup is cut short, restoring it will fail
+			log.Error("Cannot back up shard %d: %s", id, err)
+		}
+		return -1, nil
+	})
+}
+
+// Replaces the local copy of the shard with the backup in the body
+func (self *HttpServer) restoreShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.clusterConfig.RestoreShardFrom(uint32(id), r.Body); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Compacts the local copy of the shard, the response has the size on
+// disk of the shard before and after
+func (self *HttpServer) compactShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if shard := self.clusterConfig.GetShard(uint32(id)); shard == nil || !shard.IsLocal {
+			return libhttp.StatusNotFound, fmt.Sprintf("Shard %d isn't stored on this server", id)
+		}
+		before, after, err := self.clusterConfig.CompactShard(uint32(id))
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, map[string]int64{"sizeBefore": before, "sizeAfter": after}
+	})
+}
+
+func (self *HttpServer) repairShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		repaired, err := self.clusterConfig.RepairShard(uint32(id), u)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, map[string]int{"repairedRanges": repaired}
+	})
+}
+
+// Replays the writes the local copy of the shard missed from the write
+// log of the replica on the source server, or of every other replica
+// if no source is given
+func (self *HttpServer) catchUpShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		var replayed int
+		if source := r.URL.Query().Get("source"); source != "" {
+			sourceId, parseErr := strconv.ParseInt(source, 10, 64)
+			if parseErr != nil {
+				return libhttp.StatusBadRequest, parseErr.Error()
+			}
+			replayed, err = self.clusterConfig.CatchUpShard(uint32(id), uint32(sourceId), u)
+		} else {
+			replayed, err = self.clusterConfig.CatchUpShardWithReplicas(uint32(id), u)
+		}
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, map[string]int{"replayedWrites": replayed}
 	})
 }
 
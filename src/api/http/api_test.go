@@ -4,20 +4,29 @@ import (
 	"bytes"
 	"cluster"
 	. "common"
+	"compress/gzip"
+	"compress/zlib"
 	"configuration"
 	"coordinator"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"metrics"
 	"net"
 	libhttp "net/http"
 	"net/url"
 	"parser"
 	"protocol"
+	"strings"
 	"testing"
 	"time"
 
+	"code.google.com/p/goprotobuf/proto"
+	"code.google.com/p/snappy-go/snappy"
 	. "launchpad.net/gocheck"
 )
 
@@ -39,6 +48,9 @@ func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coor
 	if self.returnedError != nil {
 		return self.returnedError
 	}
+	if self.queryHandler != nil {
+		return self.queryHandler(query, yield)
+	}
 
 	series, err := StringToSeriesArray(`
 [
@@ -90,24 +102,116 @@ func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coor
 	if err := yield.Write(series[0]); err != nil {
 		return err
 	}
+	if self.streamError != nil {
+		return self.streamError
+	}
 	return yield.Write(series[1])
 }
 
 type MockCoordinator struct {
 	coordinator.Coordinator
-	series            []*protocol.Series
-	continuousQueries map[string][]*cluster.ContinuousQuery
-	deleteQueries     []*parser.DeleteQuery
-	db                string
-	droppedDb         string
-	returnedError     error
+	series             []*protocol.Series
+	continuousQueries  map[string][]*cluster.ContinuousQuery
+	deleteQueries      []*parser.DeleteQuery
+	db                 string
+	droppedDb          string
+	returnedError      error
+	consistency        cluster.WriteConsistency
+	dbConsistency      map[string]string
+	dbRetention        map[string]string
+	decommissioned     []uint32
+	addedServers       []*cluster.NewServer
+	moves              []*cluster.ShardMove
+	replicationFactor  int
+	backupDir          string
+	restoreDir         string
+	shardDurations     map[cluster.ShardType]time.Duration
+	replicationTargets []*cluster.ReplicationTarget
+	droppedOrphans     map[uint32][]uint32
+	readConsistency    cluster.ReadConsistency
+	runtimeSettings    map[string]string
+	streamError        error
+	backfills          []string
+	params             parser.Parameters
+	idempotencyKey     string
+	writtenDbs         []string
+	queryHandler       func(query string, yield coordinator.SeriesWriter) error
+}
+
+func (self *MockCoordinator) BackfillContinuousQuery(_ User, db string, id uint32, start, end time.Time) error {
+	self.backfills = append(self.backfills, fmt.Sprintf("%s %d %d %d", db, id, start.Unix(), end.Unix()))
+	return nil
+}
+
+func (self *MockCoordinator) RunQueryWithConsistency(user User, db string, query string, consistency cluster.ReadConsistency, yield coordinator.SeriesWriter) error {
+	self.readConsistency = consistency
+	return self.RunQuery(user, db, query, yield)
+}
+
+func (self *MockCoordinator) RunQueryWithCancel(user User, db string, query string, params parser.Parameters, consistency cluster.ReadConsistency, _ <-chan bool, yield coordinator.SeriesWriter) error {
+	self.params = params
+	return self.RunQueryWithConsistency(user, db, query, consistency, yield)
+}
+
+func (self *MockCoordinator) RunTracedQuery(user User, db string, query string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, yield coordinator.SeriesWriter) (*coordinator.QueryTrace, error) {
+	if err := self.RunQueryWithCancel(user, db, query, params, consistency, done, yield); err != nil {
+		return nil, err
+	}
+	return coordinator.NewQueryTrace(1), nil
 }
 
 func (self *MockCoordinator) WriteSeriesData(_ User, db string, series []*protocol.Series) error {
+	if db == "missing" {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if db == "limited" {
+		return NewRateLimitError("database-write-points-per-second", 10, "database limited", 1500*time.Millisecond)
+	}
+	// the fields of the typed database hold numbers
+	if db == "typed" {
+		var conflicts FieldTypeConflictError
+		for _, s := range series {
+			for _, point := range s.Points {
+				if t := FieldTypeOf(point.Values[0]); t != FIELD_TYPE_NUMBER {
+					conflicts = append(conflicts, &FieldTypeConflict{s.GetName(), s.Fields[0], point, point.Values[0], t, FIELD_TYPE_NUMBER})
+				}
+			}
+		}
+		if len(conflicts) > 0 {
+			return conflicts
+		}
+	}
+	self.writtenDbs = append(self.writtenDbs, db)
 	self.series = append(self.series, series...)
 	return nil
 }
 
+func (self *MockCoordinator) WriteSeriesDataWithConsistency(_ User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
+	self.consistency = consistency
+	return self.WriteSeriesData(nil, db, series)
+}
+
+func (self *MockCoordinator) WriteSeriesDataOnce(_ User, db string, series []*protocol.Series, consistency string, idempotencyKey string) error {
+	self.idempotencyKey = idempotencyKey
+	return self.WriteSeriesData(nil, db, series)
+}
+
+func (self *MockCoordinator) SetWriteConsistency(_ User, db string, consistency string) error {
+	if _, err := cluster.ParseWriteConsistency(consistency); err != nil {
+		return err
+	}
+	self.dbConsistency[db] = consistency
+	return nil
+}
+
+func (self *MockCoordinator) SetDatabaseRetention(_ User, db string, retention string) error {
+	if _, err := configuration.ParseRetention(retention); err != nil {
+		return err
+	}
+	self.dbRetention[db] = retention
+	return nil
+}
+
 func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.DeleteQuery, localOnly bool) error {
 	self.deleteQueries = append(self.deleteQueries, query)
 	return nil
@@ -163,6 +267,128 @@ func (self *MockCoordinator) DeleteContinuousQuery(_ User, db string, id uint32)
 	return nil
 }
 
+func (self *MockCoordinator) AddServer(_ User, server *cluster.NewServer) error {
+	for _, added := range self.addedServers {
+		if added.Name == server.Name {
+			return fmt.Errorf("Server %s already exist", server.Name)
+		}
+	}
+	self.addedServers = append(self.addedServers, server)
+	return nil
+}
+
+func (self *MockCoordinator) DecommissionServer(_ User, id uint32) error {
+	self.decommissioned = append(self.decommissioned, id)
+	return nil
+}
+
+func (self *MockCoordinator) PlanRebalance(_ User) ([]*cluster.ShardMove, error) {
+	return []*cluster.ShardMove{&cluster.ShardMove{ShardId: 1, From: 1, To: 2}}, nil
+}
+
+func (self *MockCoordinator) Rebalance(_ User, moves []*cluster.ShardMove) error {
+	self.moves = moves
+	return nil
+}
+
+func (self *MockCoordinator) ListShards(_ User) (*cluster.ShardListing, error) {
+	return &cluster.ShardListing{
+		Shards:  []*cluster.ShardInfo{&cluster.ShardInfo{Id: 1, Type: "short-term", Replicas: []*cluster.ShardReplicaInfo{&cluster.ShardReplicaInfo{ServerId: 1, Size: 1024}}}},
+		Orphans: []*cluster.OrphanedShard{&cluster.OrphanedShard{ShardId: 2, ServerId: 1, Size: 512}},
+	}, nil
+}
+
+func (self *MockCoordinator) MoveShard(_ User, move *cluster.ShardMove) error {
+	if move.From == move.To {
+		return fmt.Errorf("Shard %d already has a replica on server %d", move.ShardId, move.To)
+	}
+	self.moves = append(self.moves, move)
+	return nil
+}
+
+func (self *MockCoordinator) DropOrphanedShard(_ User, shardId uint32, serverIds []uint32) error {
+	if self.droppedOrphans == nil {
+		self.droppedOrphans = make(map[uint32][]uint32)
+	}
+	self.droppedOrphans[shardId] = serverIds
+	return nil
+}
+
+func (self *MockCoordinator) SetReplicationFactor(_ User, replicationFactor int) error {
+	if replicationFactor < 1 {
+		return fmt.Errorf("Replication factor must be at least 1")
+	}
+	self.replicationFactor = replicationFactor
+	return nil
+}
+
+func (self *MockCoordinator) SetShardDuration(_ User, shardType cluster.ShardType, duration time.Duration) error {
+	if duration < time.Second {
+		return fmt.Errorf("Shard duration must be at least a second, got %s", duration)
+	}
+	if self.shardDurations == nil {
+		self.shardDurations = make(map[cluster.ShardType]time.Duration)
+	}
+	self.shardDurations[shardType] = duration
+	return nil
+}
+
+func (self *MockCoordinator) SetRuntimeSetting(_ User, name, value string) error {
+	if err := cluster.ValidateRuntimeSetting(name, value); err != nil {
+		return err
+	}
+	if self.runtimeSettings == nil {
+		self.runtimeSettings = make(map[string]string)
+	}
+	self.runtimeSettings[name] = value
+	return nil
+}
+
+func (self *MockCoordinator) ListRuntimeSettings(_ User) (map[string]string, error) {
+	return self.runtimeSettings, nil
+}
+
+func (self *MockCoordinator) CreateReplicationTarget(_ User, target *cluster.ReplicationTarget) error {
+	if err := target.Validate(); err != nil {
+		return err
+	}
+	self.replicationTargets = append(self.replicationTargets, target)
+	return nil
+}
+
+func (self *MockCoordinator) DropReplicationTarget(_ User, name string) error {
+	for i, target := range self.replicationTargets {
+		if target.Name == name {
+			self.replicationTargets = append(self.replicationTargets[:i], self.replicationTargets[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Replication target %s doesn't exist", name)
+}
+
+func (self *MockCoordinator) ListReplicationTargets(_ User) ([]*coordinator.ReplicationTargetStatus, error) {
+	statuses := make([]*coordinator.ReplicationTargetStatus, 0, len(self.replicationTargets))
+	for _, target := range self.replicationTargets {
+		statuses = append(statuses, &coordinator.ReplicationTargetStatus{
+			Name:      target.Name,
+			Url:       target.Url,
+			Databases: target.Databases,
+			Username:  target.Username,
+		})
+	}
+	return statuses, nil
+}
+
+func (self *MockCoordinator) Backup(_ User, dir string) (*cluster.BackupManifest, error) {
+	self.backupDir = dir
+	return &cluster.BackupManifest{Shards: []*cluster.ShardBackup{{Id: 1, ServerId: 1, Dir: "shards/00001"}}}, nil
+}
+
+func (self *MockCoordinator) Restore(_ User, dir string) error {
+	self.restoreDir = dir
+	return nil
+}
+
 func (self *ApiSuite) formatUrl(path string, args ...interface{}) string {
 	path = fmt.Sprintf(path, args...)
 	port := self.listener.Addr().(*net.TCPAddr).Port
@@ -176,6 +402,8 @@ func (self *ApiSuite) SetUpSuite(c *C) {
 				&cluster.ContinuousQuery{1, "select * from foo into bar;"},
 			},
 		},
+		dbConsistency: map[string]string{},
+		dbRetention:   map[string]string{},
 	}
 
 	self.manager = &MockUserManager{
@@ -207,6 +435,10 @@ func (self *ApiSuite) TearDownSuite(c *C) {
 func (self *ApiSuite) SetUpTest(c *C) {
 	self.coordinator.series = nil
 	self.coordinator.returnedError = nil
+	self.coordinator.streamError = nil
+	self.coordinator.idempotencyKey = ""
+	self.coordinator.writtenDbs = nil
+	self.coordinator.queryHandler = nil
 	self.manager.ops = nil
 }
 
@@ -270,6 +502,33 @@ func (self *ApiSuite) TestQueryAsClusterAdmin(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
 }
 
+func (self *ApiSuite) TestTracedQueriesReturnTheTimeOfTheirSerialization(c *C) {
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&trace=true&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	series := []SerializedSeries{}
+	c.Assert(json.Unmarshal(data, &series), IsNil)
+	c.Assert(series, HasLen, 2)
+	for _, s := range series {
+		if s.Name != "query trace" {
+			continue
+		}
+		c.Assert(s.Points, HasLen, 1)
+		for i, column := range s.Columns {
+			if column == "stage" {
+				c.Assert(s.Points[0][i], Equals, "serialization")
+				return
+			}
+		}
+	}
+	c.Fail()
+}
+
 func (self *ApiSuite) TestQueryWithNullColumns(c *C) {
 	query := "select * from foo;"
 	query = url.QueryEscape(query)
@@ -303,6 +562,52 @@ func (self *ApiSuite) TestQueryErrorPropagatesProperly(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
 }
 
+func (self *ApiSuite) TestQueryLimitErrorsNameTheLimit(c *C) {
+	self.coordinator.returnedError = NewQueryLimitError("max-returned-points", 100)
+	defer func() { self.coordinator.returnedError = nil }()
+	query := url.QueryEscape("select * from /.*/;")
+	addr := self.formatUrl("/db/foo/series?q=%s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	limitError := &QueryLimitError{}
+	c.Assert(json.Unmarshal(body, limitError), IsNil)
+	c.Assert(limitError.Limit, Equals, "max-returned-points")
+	c.Assert(limitError.Value, Equals, "100")
+}
+
+func (self *ApiSuite) TestRateLimitedQueriesGetARetryAfter(c *C) {
+	self.coordinator.returnedError = NewRateLimitError("user-concurrent-queries", 2, "user dbuser of database foo", 0)
+	defer func() { self.coordinator.returnedError = nil }()
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 429)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "1")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	limitError := &RateLimitError{}
+	c.Assert(json.Unmarshal(body, limitError), IsNil)
+	c.Assert(limitError.Limit, Equals, "user-concurrent-queries")
+	c.Assert(limitError.Value, Equals, 2)
+}
+
+func (self *ApiSuite) TestRateLimitedWritesGetARetryAfter(c *C) {
+	data := `[{"name": "foo", "columns": ["column_one"], "points": [[1]]}]`
+	addr := self.formatUrl("/db/limited/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 429)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "2")
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
 func (self *ApiSuite) TestQueryWithSecondsPrecision(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -324,6 +629,52 @@ func (self *ApiSuite) TestQueryWithSecondsPrecision(c *C) {
 	c.Assert(int(series[0].Points[0][0].(float64)), Equals, 1381346631)
 }
 
+func (self *ApiSuite) TestQueryWithNanosecondsPrecision(c *C) {
+	query := url.QueryEscape("select * from foo where column_one == 'some_value';")
+	addr := self.formatUrl("/db/foo/series?q=%s&time_precision=ns&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	series := []SerializedSeries{}
+	c.Assert(json.Unmarshal(data, &series), IsNil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(int64(series[0].Points[0][0].(float64)), Equals, int64(1381346631000000000))
+}
+
+func (self *ApiSuite) TestQueryWithReadConsistency(c *C) {
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&consistency=quorum&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.readConsistency, Equals, cluster.READ_CONSISTENCY_QUORUM)
+
+	addr = self.formatUrl("/db/foo/series?q=%s&consistency=all&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestQueryWithParameters(c *C) {
+	data := `{"q": "select * from foo where column_one = $value and column_two > $min;", "params": {"value": "some_value", "min": 1}}`
+	addr := self.formatUrl("/db/foo/query?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.params, DeepEquals, parser.Parameters{"value": "some_value", "min": json.Number("1")})
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString("{"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
 func (self *ApiSuite) TestQueryWithInvalidPrecision(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -382,6 +733,102 @@ func (self *ApiSuite) TestChunkedQuery(c *C) {
 	}
 }
 
+func (self *ApiSuite) TestChunkedQueryErrorsAreTheLastChunk(c *C) {
+	self.coordinator.streamError = fmt.Errorf("some error")
+	query := "select * from foo where column_one == 'some_value';"
+	query = url.QueryEscape(query)
+	addr := self.formatUrl("/db/foo/series?q=%s&chunked=true&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	// the status was sent with the first chunk
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	decoder := json.NewDecoder(resp.Body)
+	series := SerializedSeries{}
+	c.Assert(decoder.Decode(&series), IsNil)
+	c.Assert(series.Name, Equals, "foo")
+	c.Assert(series.Points, HasLen, 2)
+	chunkError := map[string]string{}
+	c.Assert(decoder.Decode(&chunkError), IsNil)
+	c.Assert(chunkError["error"], Equals, "some error")
+	c.Assert(decoder.Decode(&chunkError), Equals, io.EOF)
+}
+
+func (self *ApiSuite) TestQueryResponseFormats(c *C) {
+	query := url.QueryEscape("select * from foo where column_one == 'some_value';")
+	addr := self.formatUrl("/db/foo/series?q=%s&format=protobuf&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("content-type"), Equals, "application/x-protobuf")
+	var size uint32
+	c.Assert(binary.Read(resp.Body, binary.LittleEndian, &size), IsNil)
+	data := make([]byte, size)
+	_, err = io.ReadFull(resp.Body, data)
+	c.Assert(err, IsNil)
+	series := &protocol.Series{}
+	c.Assert(proto.Unmarshal(data, series), IsNil)
+	c.Assert(*series.Name, Equals, "foo")
+	c.Assert(series.Fields, DeepEquals, []string{"column_one", "column_two"})
+	c.Assert(series.Points, HasLen, 4)
+	_, err = resp.Body.Read(data)
+	c.Assert(err, Equals, io.EOF)
+
+	// the Accept header picks the format without the format parameter
+	addr = self.formatUrl("/db/foo/series?q=%s&chunked=true&u=dbuser&p=password", query)
+	req, _ := libhttp.NewRequest("GET", addr, nil)
+	req.Header.Set("Accept", "application/x-msgpack;q=0.9, application/json;q=0.5")
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("content-type"), Equals, "application/x-msgpack")
+	data, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	// a map of the name, columns and points of the first chunk
+	c.Assert(data[:10], DeepEquals, []byte{0x83, 0xa4, 'n', 'a', 'm', 'e', 0xa3, 'f', 'o', 'o'})
+
+	addr = self.formatUrl("/db/foo/series?q=%s&format=xml&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestQueryResultsAsCsv(c *C) {
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&format=csv&time_precision=s&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("content-type"), Equals, "text/csv; charset=utf-8")
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	// the second batch has the same columns, the header isn't repeated
+	c.Assert(string(data), Equals, "name,time,sequence_number,column_one,column_two\r\n"+
+		"foo,1381346631,1,some_value,\r\n"+
+		"foo,1381346632,2,some_value,2\r\n"+
+		"foo,1381346633,1,some_value,3\r\n"+
+		"foo,1381346634,2,some_value,4\r\n")
+
+	req, _ := libhttp.NewRequest("GET", self.formatUrl("/db/foo/series?q=%s&time_format=rfc3339&u=dbuser&p=password", query), nil)
+	req.Header.Set("Accept", "text/csv")
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	lines := strings.Split(string(data), "\r\n")
+	c.Assert(lines[1], Equals, "foo,2013-10-09T19:23:51Z,1,some_value,")
+
+	resp, err = libhttp.Get(self.formatUrl("/db/foo/series?q=%s&format=csv&time_format=julian&u=dbuser&p=password", query))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
 func (self *ApiSuite) TestWriteDataWithTimeInSeconds(c *C) {
 	data := `
 [
@@ -412,6 +859,406 @@ func (self *ApiSuite) TestWriteDataWithTimeInSeconds(c *C) {
 	c.Assert(*series.Points[0].GetTimestampInMicroseconds(), Equals, int64(1382131686000000))
 }
 
+func (self *ApiSuite) TestWriteDataWithTimeInNanoseconds(c *C) {
+	data := `[{"points": [[1382131686000000000, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?time_precision=ns&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(*self.coordinator.series[0].Points[0].GetTimestampInMicroseconds(), Equals, int64(1382131686000000))
+}
+
+func (self *ApiSuite) TestWriteCompressedData(c *C) {
+	data := `[{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(data))
+	gzipWriter.Close()
+	deflated := &bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(deflated)
+	zlibWriter.Write([]byte(data))
+	zlibWriter.Close()
+
+	self.server.SetMaxWriteBodySize(int64(len(data)))
+	defer self.server.SetMaxWriteBodySize(0)
+	addr := self.formatUrl("/db/foo/series?time_precision=s&u=dbuser&p=password")
+	for encoding, body := range map[string]*bytes.Buffer{"gzip": gzipped, "deflate": deflated} {
+		self.coordinator.series = nil
+		req, _ := libhttp.NewRequest("POST", addr, bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		c.Assert(self.coordinator.series, HasLen, 1)
+		c.Assert(*self.coordinator.series[0].Points[0].Values[0].StringValue, Equals, "1")
+	}
+
+	// the size is checked once the body is decompressed
+	self.server.SetMaxWriteBodySize(int64(len(data) - 1))
+	req, _ := libhttp.NewRequest("POST", addr, bytes.NewReader(gzipped.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusRequestEntityTooLarge)
+
+	req, _ = libhttp.NewRequest("POST", addr, bytes.NewBufferString(data))
+	req.Header.Set("Content-Encoding", "br")
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestWriteDataWithConsistency(c *C) {
+	data := `
+[
+  {
+    "points": [
+				[1382131686, "1"]
+    ],
+    "name": "foo",
+    "columns": ["time", "column_one"]
+  }
+]
+`
+
+	addr := self.formatUrl("/db/foo/series?consistency=quorum&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.consistency, Equals, cluster.WRITE_CONSISTENCY_QUORUM)
+
+	addr = self.formatUrl("/db/foo/series?consistency=most&u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestWriteDataWithIdempotencyKey(c *C) {
+	data := `[{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	req, _ := libhttp.NewRequest("POST", addr, bytes.NewBufferString(data))
+	req.Header.Set("Idempotency-Key", "write-1")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.idempotencyKey, Equals, "write-1")
+
+	addr = self.formatUrl("/db/foo/series?idempotency_key=write-2&u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.idempotencyKey, Equals, "write-2")
+}
+
+func (self *ApiSuite) TestPartialWritesReportTheRejectedPoints(c *C) {
+	data := `[{"points": [[1382131686, 1], [1382131687, "high"], [1382131688], [1382131689, 2]], "name": "foo", "columns": ["time", "value"]}]`
+
+	addr := self.formatUrl("/db/typed/series?partial_write=true&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, STATUS_MULTI_STATUS)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	result := partialWriteResult{}
+	c.Assert(json.Unmarshal(body, &result), IsNil)
+	c.Assert(result.Written, Equals, 2)
+	c.Assert(result.Rejected, HasLen, 2)
+	c.Assert(result.Rejected[0].Point, Equals, 1)
+	c.Assert(result.Rejected[0].Error, Matches, ".*string value.*")
+	c.Assert(result.Rejected[1].Point, Equals, 2)
+	c.Assert(result.Rejected[1].Error, Equals, "invalid payload")
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.series[0].Points, HasLen, 2)
+
+	// without the flag the whole write fails
+	self.coordinator.series = nil
+	addr = self.formatUrl("/db/typed/series?u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteToMultipleDatabases(c *C) {
+	data := `
+[
+  {"database": "db1", "series": [{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]},
+  {"database": "missing", "series": [{"points": [[1382131686, "2"]], "name": "foo", "columns": ["time", "column_one"]}]},
+  {"database": "db2", "series": [{"points": [[1382131686, "3"]], "name": "bar", "columns": ["time", "column_one"]}]}
+]
+`
+	addr := self.formatUrl("/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 207)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	results := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &results), IsNil)
+	c.Assert(results, HasLen, 3)
+	c.Assert(results[0]["status"], Equals, float64(libhttp.StatusOK))
+	c.Assert(results[1]["status"], Equals, float64(libhttp.StatusBadRequest))
+	c.Assert(results[1]["error"], Equals, "Database missing doesn't exist")
+	c.Assert(results[2]["status"], Equals, float64(libhttp.StatusOK))
+	c.Assert(self.coordinator.writtenDbs, DeepEquals, []string{"db1", "db2"})
+	c.Assert(self.coordinator.series, HasLen, 2)
+
+	// nothing is written if a write is invalid
+	self.coordinator.series = nil
+	data = `[{"database": "db1", "series": [{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]}, {"series": []}]`
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 0)
+
+	// the credentials are checked for every database
+	data = `[{"database": "db1", "series": [{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]}]`
+	resp, err = libhttp.Post(self.formatUrl("/series?u=fail_auth&p=password"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 207)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestSetWriteConsistency(c *C) {
+	addr := self.formatUrl("/db/foo/write_consistency?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"consistency": "all"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.dbConsistency["foo"], Equals, "all")
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"consistency": "most"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestSetDatabaseRetention(c *C) {
+	addr := self.formatUrl("/db/foo/retention?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"retention": "30d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.dbRetention["foo"], Equals, "30d")
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"retention": "a while"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestDecommissionServer(c *C) {
+	addr := self.formatUrl("/cluster/servers/2/decommission?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.decommissioned, DeepEquals, []uint32{2})
+
+	addr = self.formatUrl("/cluster/servers/foo/decommission?u=root&p=root")
+	resp, err = libhttp.Post(addr, "application/json", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestAddServer(c *C) {
+	addr := self.formatUrl("/cluster/servers?u=root&p=root")
+	server := `{"name": "0123abcd", "raftConnectionString": "http://new:8090", "protobufConnectionString": "new:8099", "failureDomain": "b"}`
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(server))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusCreated)
+	c.Assert(self.coordinator.addedServers, DeepEquals, []*cluster.NewServer{&cluster.NewServer{
+		Name:                     "0123abcd",
+		RaftConnectionString:     "http://new:8090",
+		ProtobufConnectionString: "new:8099",
+		FailureDomain:            "b",
+	}})
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(server))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	// the raft connection string is a url
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "4567cdef", "raftConnectionString": "new:8090", "protobufConnectionString": "new:8099"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Post(self.formatUrl("/cluster/servers?u=dbuser&p=pass"), "application/json", bytes.NewBufferString(server))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusUnauthorized)
+}
+
+func (self *ApiSuite) TestRebalance(c *C) {
+	addr := self.formatUrl("/cluster/rebalance?u=root&p=root")
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	moves := []*cluster.ShardMove{}
+	c.Assert(json.Unmarshal(body, &moves), IsNil)
+	c.Assert(moves, DeepEquals, []*cluster.ShardMove{&cluster.ShardMove{ShardId: 1, From: 1, To: 2}})
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBuffer(body))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.moves, DeepEquals, moves)
+}
+
+func (self *ApiSuite) TestSetReplicationFactor(c *C) {
+	addr := self.formatUrl("/cluster/replication_factor?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"replicationFactor": 3}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.replicationFactor, Equals, 3)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"replicationFactor": 0}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestSetShardDuration(c *C) {
+	addr := self.formatUrl("/cluster/shard_duration?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"type": "short-term", "duration": "1d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.shardDurations[cluster.SHORT_TERM], Equals, 24*time.Hour)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"type": "medium-term", "duration": "1d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"type": "long-term"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestRuntimeSettings(c *C) {
+	addr := self.formatUrl("/cluster/settings?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "short-term-retention", "value": "7d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "concurrent-shard-query-limit", "value": "-1"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "data-dir", "value": "/tmp"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	settings := map[string]string{}
+	c.Assert(json.Unmarshal(body, &settings), IsNil)
+	c.Assert(settings, DeepEquals, map[string]string{"short-term-retention": "7d"})
+}
+
+func (self *ApiSuite) TestReplicationTargets(c *C) {
+	addr := self.formatUrl("/cluster/replication_targets?u=root&p=root")
+	data := `{"name": "standby", "url": "http://standby:8086", "databases": ["db1"], "username": "root", "password": "secret"}`
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusCreated)
+	c.Assert(self.coordinator.replicationTargets, HasLen, 1)
+	c.Assert(self.coordinator.replicationTargets[0].Password, Equals, "secret")
+
+	data = `{"name": "standby2", "url": "standby:8086", "databases": ["db1"]}`
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(string(body), Not(Matches), ".*secret.*")
+	targets := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &targets), IsNil)
+	c.Assert(targets, HasLen, 1)
+	c.Assert(targets[0]["name"], Equals, "standby")
+	c.Assert(targets[0]["url"], Equals, "http://standby:8086")
+
+	req, err := libhttp.NewRequest("DELETE", self.formatUrl("/cluster/replication_targets/standby?u=root&p=root"), nil)
+	c.Assert(err, IsNil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.replicationTargets, HasLen, 0)
+}
+
+func (self *ApiSuite) TestShardAdministration(c *C) {
+	addr := self.formatUrl("/cluster/shards/details?u=root&p=root")
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	listing := &cluster.ShardListing{}
+	c.Assert(json.Unmarshal(body, listing), IsNil)
+	c.Assert(listing.Shards, HasLen, 1)
+	c.Assert(listing.Shards[0].Replicas[0].Size, Equals, int64(1024))
+	c.Assert(listing.Orphans, HasLen, 1)
+	c.Assert(listing.Orphans[0].ShardId, Equals, uint32(2))
+
+	addr = self.formatUrl("/cluster/shards/1/move?u=root&p=root")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"from": 1, "to": 2}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.moves, DeepEquals, []*cluster.ShardMove{&cluster.ShardMove{ShardId: 1, From: 1, To: 2}})
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"from": 1, "to": 1}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	resp, err = libhttp.Post(addr+"&from=2&to=3", "application/json", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.moves[1], DeepEquals, &cluster.ShardMove{ShardId: 1, From: 2, To: 3})
+
+	resp, err = libhttp.Post(addr+"&from=2", "application/json", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	addr = self.formatUrl("/cluster/shards/2/drop_orphan?u=root&p=root")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"serverIds": [1]}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.droppedOrphans[2], DeepEquals, []uint32{1})
+}
+
+func (self *ApiSuite) TestBackupAndRestore(c *C) {
+	addr := self.formatUrl("/cluster/backup?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"dir": "/tmp/backup"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.backupDir, Equals, "/tmp/backup")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	manifest := &cluster.BackupManifest{}
+	c.Assert(json.Unmarshal(body, manifest), IsNil)
+	c.Assert(manifest.Shards, HasLen, 1)
+	c.Assert(manifest.Shards[0].Dir, Equals, "shards/00001")
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	addr = self.formatUrl("/cluster/restore?u=root&p=root")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"dir": "/tmp/backup"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.restoreDir, Equals, "/tmp/backup")
+}
+
 func (self *ApiSuite) TestWriteDataWithTime(c *C) {
 	data := `
 [
@@ -842,3 +1689,152 @@ func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
 	c.Assert(queries[0].Query, Equals, "select * from foo into bar;")
 	resp.Body.Close()
 }
+
+func (self *ApiSuite) TestContinuousQueryBackfill(c *C) {
+	self.coordinator.backfills = nil
+	url := self.formatUrl("/db/db1/continuous_queries/1/backfill?u=root&p=root")
+	resp, err := libhttp.Post(url, "application/json", bytes.NewBufferString(`{"start": 1400000000, "end": 1400086400}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(self.coordinator.backfills, DeepEquals, []string{"db1 1 1400000000 1400086400"})
+
+	resp, err = libhttp.Post(url, "application/json", bytes.NewBufferString(`{"start": `))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestDebugVarsHasTheMetricsOfTheServer(c *C) {
+	metrics.Default.Counter("test.requests").Add(3)
+	defer metrics.Default.Remove("test.requests")
+	resp, err := libhttp.Get(self.formatUrl("/debug/vars?u=root&p=root"))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	vars := map[string]float64{}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&vars), IsNil)
+	c.Assert(vars["test.requests"], Equals, float64(3))
+	_, ok := vars["runtime.goroutines"]
+	c.Assert(ok, Equals, true)
+}
+
+func prometheusLabelsOf(pairs ...string) []*protocol.PrometheusLabel {
+	labels := make([]*protocol.PrometheusLabel, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, &protocol.PrometheusLabel{Name: proto.String(pairs[i]), Value: proto.String(pairs[i+1])})
+	}
+	return labels
+}
+
+func postPrometheusRequest(c *C, addr string, request proto.Message) *libhttp.Response {
+	data, err := proto.Marshal(request)
+	c.Assert(err, IsNil)
+	compressed, err := snappy.Encode(nil, data)
+	c.Assert(err, IsNil)
+	req, err := libhttp.NewRequest("POST", addr, bytes.NewReader(compressed))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	return resp
+}
+
+func (self *ApiSuite) TestPrometheusSeriesNamesKeepTheLabels(c *C) {
+	labels := prometheusLabelsOf("path", "/a,b=c", "__name__", "http_requests", "code", "200", "empty", "")
+	name, err := prometheusSeriesName(labels)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "http_requests{code=200,path=/a%2Cb%3Dc}")
+	parsed, ok := parsePrometheusSeriesName(name)
+	c.Assert(ok, Equals, true)
+	c.Assert(parsed, DeepEquals, map[string]string{"__name__": "http_requests", "code": "200", "path": "/a,b=c"})
+
+	parsed, ok = parsePrometheusSeriesName("cpu")
+	c.Assert(ok, Equals, true)
+	c.Assert(parsed, DeepEquals, map[string]string{"__name__": "cpu"})
+	_, ok = parsePrometheusSeriesName("cpu.idle")
+	c.Assert(ok, Equals, false)
+
+	_, err = prometheusSeriesName(prometheusLabelsOf("code", "200"))
+	c.Assert(err, NotNil)
+}
+
+func (self *ApiSuite) TestPrometheusWritesAreWrittenToTheDatabase(c *C) {
+	request := &protocol.PrometheusWriteRequest{
+		Timeseries: []*protocol.PrometheusTimeSeries{&protocol.PrometheusTimeSeries{
+			Labels: prometheusLabelsOf("__name__", "http_requests", "code", "200"),
+			Samples: []*protocol.PrometheusSample{
+				&protocol.PrometheusSample{Value: proto.Float64(1.5), Timestamp: proto.Int64(1400000000000)},
+				&protocol.PrometheusSample{Value: proto.Float64(math.NaN()), Timestamp: proto.Int64(1400000001000)},
+			},
+		}},
+	}
+	resp := postPrometheusRequest(c, self.formatUrl("/api/v1/prom/write?db=foo&u=dbuser&p=password"), request)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusNoContent)
+	c.Assert(self.coordinator.writtenDbs, DeepEquals, []string{"foo"})
+	c.Assert(self.coordinator.series, HasLen, 1)
+	series := self.coordinator.series[0]
+	c.Assert(series.GetName(), Equals, "http_requests{code=200}")
+	c.Assert(series.Fields, DeepEquals, []string{"value"})
+	c.Assert(series.Points, HasLen, 1)
+	c.Assert(series.Points[0].GetTimestamp(), Equals, int64(1400000000000000))
+	c.Assert(series.Points[0].GetSequenceNumber(), Equals, uint64(1))
+	c.Assert(series.Points[0].Values[0].GetDoubleValue(), Equals, 1.5)
+
+	// a time series without a metric name can't be written
+	request.Timeseries[0].Labels = prometheusLabelsOf("code", "200")
+	resp = postPrometheusRequest(c, self.formatUrl("/api/v1/prom/write?db=foo&u=dbuser&p=password"), request)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestPrometheusReadsReturnTheMatchingTimeSeries(c *C) {
+	queries := []string{}
+	self.coordinator.queryHandler = func(query string, yield coordinator.SeriesWriter) error {
+		queries = append(queries, query)
+		if strings.HasPrefix(query, "list series") {
+			for _, name := range []string{"http_requests{code=200}", "http_requests{code=500}", "http_requests.total"} {
+				yield.Write(&protocol.Series{Name: protocol.String(name)})
+			}
+			return nil
+		}
+		point := &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(3)}}}
+		point.SetTimestampInMicroseconds(1400000000000000)
+		return yield.Write(&protocol.Series{Name: protocol.String("http_requests{code=500}"), Fields: []string{"value"}, Points: []*protocol.Point{point}})
+	}
+
+	request := &protocol.PrometheusReadRequest{
+		Queries: []*protocol.PrometheusQuery{&protocol.PrometheusQuery{
+			StartTimestampMs: proto.Int64(1300000000000),
+			EndTimestampMs:   proto.Int64(1500000000000),
+			Matchers: []*protocol.PrometheusLabelMatcher{
+				&protocol.PrometheusLabelMatcher{Type: protocol.PrometheusLabelMatcher_EQ.Enum(), Name: proto.String("__name__"), Value: proto.String("http_requests")},
+				&protocol.PrometheusLabelMatcher{Type: protocol.PrometheusLabelMatcher_RE.Enum(), Name: proto.String("code"), Value: proto.String("5..")},
+			},
+		}},
+	}
+	resp := postPrometheusRequest(c, self.formatUrl("/api/v1/prom/read?db=foo&u=dbuser&p=password"), request)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "snappy")
+	c.Assert(queries, DeepEquals, []string{
+		"list series /^http_requests(\\{|$)/",
+		"select value from \"http_requests{code=500}\" where time > 1299999999999999u and time < 1500000000000001u order asc",
+	})
+
+	compressed, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	data, err := snappy.Decode(nil, compressed)
+	c.Assert(err, IsNil)
+	response := &protocol.PrometheusReadResponse{}
+	c.Assert(proto.Unmarshal(data, response), IsNil)
+	c.Assert(response.Results, HasLen, 1)
+	c.Assert(response.Results[0].Timeseries, HasLen, 1)
+	timeseries := response.Results[0].Timeseries[0]
+	c.Assert(timeseries.Labels, DeepEquals, prometheusLabelsOf("__name__", "http_requests", "code", "500"))
+	c.Assert(timeseries.Samples, HasLen, 1)
+	c.Assert(timeseries.Samples[0].GetValue(), Equals, 3.0)
+	c.Assert(timeseries.Samples[0].GetTimestamp(), Equals, int64(1400000000000))
+}
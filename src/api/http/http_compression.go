@@ -3,11 +3,59 @@ package http
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
+	"io/ioutil"
 	libhttp "net/http"
 	"strings"
 )
 
+type BodyTooLargeError struct {
+	maxSize int64
+}
+
+func (self BodyTooLargeError) Error() string {
+	return fmt.Sprintf("The request body is bigger than %d bytes", self.maxSize)
+}
+
+// Reads the body of the request, decompressing it if its Content-Encoding
+// is gzip or deflate. The bodies bigger than maxSize once decompressed
+// return a BodyTooLargeError, maxSize of 0 doesn't limit them.
+func ReadDecompressedBody(req *libhttp.Request, maxSize int64) ([]byte, error) {
+	var reader io.Reader = req.Body
+	switch encoding := strings.TrimSpace(req.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		zlibReader, err := zlib.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zlibReader.Close()
+		reader = zlibReader
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %s", encoding)
+	}
+	if maxSize <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	// read one more byte to tell the bodies of maxSize from the bigger ones
+	body, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, BodyTooLargeError{maxSize}
+	}
+	return body, nil
+}
+
 type CompressedResponseWriter struct {
 	responseWriter libhttp.ResponseWriter
 	writer         io.Writer
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"bytes"
+	. "common"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Encodes the values of the serialized series in MessagePack, see
+// https://github.com/msgpack/msgpack/blob/master/spec.md. The series are
+// maps with the same keys as their JSON objects.
+func marshalMsgpack(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := writeMsgpack(buffer, value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeMsgpack(buffer *bytes.Buffer, value interface{}) error {
+	switch x := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+	case bool:
+		if x {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+	case int:
+		writeMsgpackInt(buffer, int64(x))
+	case int64:
+		writeMsgpackInt(buffer, x)
+	case uint32:
+		writeMsgpackUint(buffer, uint64(x))
+	case uint64:
+		writeMsgpackUint(buffer, x)
+	case float64:
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(x))
+	case string:
+		writeMsgpackString(buffer, x)
+	case []string:
+		writeMsgpackArrayHeader(buffer, len(x))
+		for _, s := range x {
+			writeMsgpackString(buffer, s)
+		}
+	case []interface{}:
+		writeMsgpackArrayHeader(buffer, len(x))
+		for _, v := range x {
+			if err := writeMsgpack(buffer, v); err != nil {
+				return err
+			}
+		}
+	case [][]interface{}:
+		writeMsgpackArrayHeader(buffer, len(x))
+		for _, v := range x {
+			if err := writeMsgpack(buffer, v); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		writeMsgpackMapHeader(buffer, len(x))
+		for k, v := range x {
+			writeMsgpackString(buffer, k)
+			writeMsgpackString(buffer, v)
+		}
+	case *SerializedSeries:
+		writeMsgpackMapHeader(buffer, 3)
+		writeMsgpackString(buffer, "name")
+		writeMsgpackString(buffer, x.Name)
+		writeMsgpackString(buffer, "columns")
+		writeMsgpack(buffer, x.Columns)
+		writeMsgpackString(buffer, "points")
+		return writeMsgpack(buffer, x.Points)
+	case []*SerializedSeries:
+		writeMsgpackArrayHeader(buffer, len(x))
+		for _, v := range x {
+			if err := writeMsgpack(buffer, v); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode %T in msgpack", value)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buffer *bytes.Buffer, x int64) {
+	switch {
+	case x >= 0:
+		writeMsgpackUint(buffer, uint64(x))
+	case x >= -32:
+		// negative fixint
+		buffer.WriteByte(byte(x))
+	case x >= math.MinInt8:
+		buffer.WriteByte(0xd0)
+		buffer.WriteByte(byte(x))
+	case x >= math.MinInt16:
+		buffer.WriteByte(0xd1)
+		binary.Write(buffer, binary.BigEndian, int16(x))
+	case x >= math.MinInt32:
+		buffer.WriteByte(0xd2)
+		binary.Write(buffer, binary.BigEndian, int32(x))
+	default:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, x)
+	}
+}
+
+func writeMsgpackUint(buffer *bytes.Buffer, x uint64) {
+	switch {
+	case x < 1<<7:
+		// positive fixint
+		buffer.WriteByte(byte(x))
+	case x <= math.MaxUint8:
+		buffer.WriteByte(0xcc)
+		buffer.WriteByte(byte(x))
+	case x <= math.MaxUint16:
+		buffer.WriteByte(0xcd)
+		binary.Write(buffer, binary.BigEndian, uint16(x))
+	case x <= math.MaxUint32:
+		buffer.WriteByte(0xce)
+		binary.Write(buffer, binary.BigEndian, uint32(x))
+	default:
+		buffer.WriteByte(0xcf)
+		binary.Write(buffer, binary.BigEndian, x)
+	}
+}
+
+func writeMsgpackString(buffer *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buffer.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buffer.WriteByte(0xd9)
+		buffer.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buffer.WriteByte(0xda)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	default:
+		buffer.WriteByte(0xdb)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	}
+	buffer.WriteString(s)
+}
+
+func writeMsgpackArrayHeader(buffer *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buffer.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buffer.WriteByte(0xdc)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	default:
+		buffer.WriteByte(0xdd)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackMapHeader(buffer *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buffer.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buffer.WriteByte(0xde)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	default:
+		buffer.WriteByte(0xdf)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	}
+}
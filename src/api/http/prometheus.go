@@ -0,0 +1,386 @@
+package http
+
+// Prometheus remote storage. Prometheus posts snappy compressed
+// protobufs to /api/v1/prom/write and /api/v1/prom/read with the
+// database in the db parameter. Every time series is stored in a series
+// named after its metric and labels the way Prometheus prints them,
+// e.g. http_requests{code=200,job=api}, with the labels in order of their
+// names and a value column. The label values have the characters that
+// would make the name ambiguous percent encoded.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	libhttp "net/http"
+	"net/url"
+	"protocol"
+	"regexp"
+	"sort"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+	"code.google.com/p/snappy-go/snappy"
+)
+
+const (
+	PROMETHEUS_METRIC_NAME_LABEL = "__name__"
+	PROMETHEUS_VALUE_COLUMN      = "value"
+)
+
+var prometheusMetricNameRegex = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// Returns the series name of the labels of a time series, the metric
+// name comes first
+func prometheusSeriesName(labels []*protocol.PrometheusLabel) (string, error) {
+	metric := ""
+	others := make([]*protocol.PrometheusLabel, 0, len(labels))
+	for _, label := range labels {
+		if label.GetName() == PROMETHEUS_METRIC_NAME_LABEL {
+			metric = label.GetValue()
+			continue
+		}
+		// prometheus doesn't keep the labels without a value
+		if label.GetValue() != "" {
+			others = append(others, label)
+		}
+	}
+	if !prometheusMetricNameRegex.MatchString(metric) {
+		return "", fmt.Errorf("Invalid metric name %q", metric)
+	}
+	if len(others) == 0 {
+		return metric, nil
+	}
+	sort.Sort(prometheusLabelsByName(others))
+	buffer := bytes.NewBufferString(metric)
+	buffer.WriteByte('{')
+	for i, label := range others {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(label.GetName())
+		buffer.WriteByte('=')
+		escapePrometheusLabelValue(buffer, label.GetValue())
+	}
+	buffer.WriteByte('}')
+	return buffer.String(), nil
+}
+
+// Returns the labels of the series with the metric name, false if the
+// series wasn't written by prometheus
+func parsePrometheusSeriesName(name string) (map[string]string, bool) {
+	metric := name
+	labels := map[string]string{}
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		if !strings.HasSuffix(name, "}") {
+			return nil, false
+		}
+		metric = name[:i]
+		for _, pair := range strings.Split(name[i+1:len(name)-1], ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, false
+			}
+			value, err := url.QueryUnescape(strings.Replace(parts[1], "+", "%2B", -1))
+			if err != nil {
+				return nil, false
+			}
+			labels[parts[0]] = value
+		}
+	}
+	if !prometheusMetricNameRegex.MatchString(metric) {
+		return nil, false
+	}
+	labels[PROMETHEUS_METRIC_NAME_LABEL] = metric
+	return labels, true
+}
+
+func escapePrometheusLabelValue(buffer *bytes.Buffer, value string) {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c < 0x20, c == '%', c == ',', c == '=', c == '{', c == '}', c == '"', c == '\\':
+			fmt.Fprintf(buffer, "%%%02X", c)
+		default:
+			buffer.WriteByte(c)
+		}
+	}
+}
+
+type prometheusLabelsByName []*protocol.PrometheusLabel
+
+func (self prometheusLabelsByName) Len() int           { return len(self) }
+func (self prometheusLabelsByName) Less(i, j int) bool { return self[i].GetName() < self[j].GetName() }
+func (self prometheusLabelsByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Converts the time series to series. The samples are written with a
+// sequence number of 1, so the samples prometheus sends again overwrite
+// the ones it sent first. NaN and infinite samples are dropped, that
+// includes the markers of stale series.
+func prometheusWriteToSeries(request *protocol.PrometheusWriteRequest) ([]*protocol.Series, error) {
+	series := make([]*protocol.Series, 0, len(request.Timeseries))
+	for _, timeseries := range request.Timeseries {
+		name, err := prometheusSeriesName(timeseries.Labels)
+		if err != nil {
+			return nil, err
+		}
+		s := &protocol.Series{Name: protocol.String(name), Fields: []string{PROMETHEUS_VALUE_COLUMN}}
+		for _, sample := range timeseries.Samples {
+			value := sample.GetValue()
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			point := &protocol.Point{
+				Values:         []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: protocol.Float64(value)}},
+				SequenceNumber: proto.Uint64(1),
+			}
+			point.SetTimestampInMicroseconds(sample.GetTimestamp() * 1000)
+			s.Points = append(s.Points, point)
+		}
+		if len(s.Points) > 0 {
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+type prometheusMatcher struct {
+	name   string
+	value  string
+	regex  *regexp.Regexp
+	negate bool
+}
+
+func newPrometheusMatcher(matcher *protocol.PrometheusLabelMatcher) (*prometheusMatcher, error) {
+	m := &prometheusMatcher{name: matcher.GetName(), value: matcher.GetValue()}
+	switch matcher.GetType() {
+	case protocol.PrometheusLabelMatcher_NEQ:
+		m.negate = true
+	case protocol.PrometheusLabelMatcher_RE, protocol.PrometheusLabelMatcher_NRE:
+		// prometheus regexes match the whole value
+		regex, err := regexp.Compile("^(?:" + matcher.GetValue() + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.regex = regex
+		m.negate = matcher.GetType() == protocol.PrometheusLabelMatcher_NRE
+	}
+	return m, nil
+}
+
+// a label the series doesn't have matches like an empty value
+func (self *prometheusMatcher) matches(labels map[string]string) bool {
+	value := labels[self.name]
+	if self.regex != nil {
+		return self.regex.MatchString(value) != self.negate
+	}
+	return (value == self.value) != self.negate
+}
+
+// Reads the snappy compressed body of a request, the bodies bigger than
+// maxSize once decompressed return a BodyTooLargeError
+func readSnappyBody(r *libhttp.Request, maxSize int64) ([]byte, error) {
+	var reader io.Reader = r.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(r.Body, maxSize+1)
+	}
+	compressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	length, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && (int64(len(compressed)) > maxSize || int64(length) > maxSize) {
+		return nil, BodyTooLargeError{maxSize}
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+// The database of the prometheus endpoints is a parameter, the users of
+// the database are authenticated against the :db parameter of the
+// route
+func withPrometheusDatabase(r *libhttp.Request) string {
+	q := r.URL.Query()
+	db := q.Get("db")
+	q.Set(":db", db)
+	r.URL.RawQuery = q.Encode()
+	return db
+}
+
+func (self *HttpServer) prometheusWrite(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := withPrometheusDatabase(r)
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := readSnappyBody(r, self.maxWriteBodySize)
+		if err != nil {
+			if _, ok := err.(BodyTooLargeError); ok {
+				return libhttp.StatusRequestEntityTooLarge, err.Error()
+			}
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		request := &protocol.PrometheusWriteRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		series, err := prometheusWriteToSeries(request)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if len(series) == 0 {
+			return libhttp.StatusNoContent, nil
+		}
+		if err := self.writeSeries(r, user, db, series, "", 0); err != nil {
+			return errorToStatusCode(err), errorBody(err)
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+func (self *HttpServer) prometheusRead(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := withPrometheusDatabase(r)
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := readSnappyBody(r, self.maxWriteBodySize)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		request := &protocol.PrometheusReadRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		response := &protocol.PrometheusReadResponse{}
+		for _, query := range request.Queries {
+			result, err := self.runPrometheusQuery(user, db, query)
+			if err != nil {
+				return errorToStatusCode(err), errorBody(err)
+			}
+			response.Results = append(response.Results, result)
+		}
+		data, err := proto.Marshal(response)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		compressed, err := snappy.Encode(nil, data)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.WriteHeader(libhttp.StatusOK)
+		w.Write(compressed)
+		return -1, nil
+	})
+}
+
+// Returns the time series of the series whose labels match the query,
+// with their samples between the start and the end of the query
+func (self *HttpServer) runPrometheusQuery(user User, db string, query *protocol.PrometheusQuery) (*protocol.PrometheusQueryResult, error) {
+	matchers := make([]*prometheusMatcher, 0, len(query.Matchers))
+	listQuery := "list series"
+	for _, matcher := range query.Matchers {
+		m, err := newPrometheusMatcher(matcher)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		// only the series of the metric have to be listed
+		if matcher.GetName() == PROMETHEUS_METRIC_NAME_LABEL && matcher.GetType() == protocol.PrometheusLabelMatcher_EQ && prometheusMetricNameRegex.MatchString(matcher.GetValue()) {
+			listQuery = fmt.Sprintf("list series /^%s(\\{|$)/", regexp.QuoteMeta(matcher.GetValue()))
+		}
+	}
+
+	names := []string{}
+	err := self.coordinator.RunQuery(user, db, listQuery, NewSeriesWriter(func(series *protocol.Series) error {
+		names = append(names, series.GetName())
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	result := &protocol.PrometheusQueryResult{Timeseries: []*protocol.PrometheusTimeSeries{}}
+	for _, name := range names {
+		labels, ok := parsePrometheusSeriesName(name)
+		if !ok {
+			continue
+		}
+		matched := true
+		for _, matcher := range matchers {
+			if !matcher.matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		samples, err := self.prometheusSamples(user, db, name, query.GetStartTimestampMs(), query.GetEndTimestampMs())
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		result.Timeseries = append(result.Timeseries, &protocol.PrometheusTimeSeries{
+			Labels:  prometheusLabels(labels),
+			Samples: samples,
+		})
+	}
+	return result, nil
+}
+
+// Returns the samples of the series from start to end, both included
+func (self *HttpServer) prometheusSamples(user User, db, name string, start, end int64) ([]*protocol.PrometheusSample, error) {
+	after := start*1000 - 1
+	if after < 0 {
+		after = 0
+	}
+	query := fmt.Sprintf("select %s from \"%s\" where time > %du and time < %du order asc", PROMETHEUS_VALUE_COLUMN, name, after, end*1000+1)
+	samples := []*protocol.PrometheusSample{}
+	err := self.coordinator.RunQuery(user, db, query, NewSeriesWriter(func(series *protocol.Series) error {
+		valueIndex := -1
+		for i, field := range series.Fields {
+			if field == PROMETHEUS_VALUE_COLUMN {
+				valueIndex = i
+			}
+		}
+		if valueIndex < 0 {
+			return nil
+		}
+		for _, point := range series.Points {
+			value := point.Values[valueIndex]
+			var v float64
+			switch {
+			case value.DoubleValue != nil:
+				v = value.GetDoubleValue()
+			case value.Int64Value != nil:
+				v = float64(value.GetInt64Value())
+			default:
+				continue
+			}
+			samples = append(samples, &protocol.PrometheusSample{
+				Value:     proto.Float64(v),
+				Timestamp: proto.Int64(point.GetTimestamp() / 1000),
+			})
+		}
+		return nil
+	}))
+	return samples, err
+}
+
+// Returns the labels in order of their names
+func prometheusLabels(labels map[string]string) []*protocol.PrometheusLabel {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*protocol.PrometheusLabel, 0, len(names))
+	for _, name := range names {
+		result = append(result, &protocol.PrometheusLabel{Name: proto.String(name), Value: proto.String(labels[name])})
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package http
+
+import (
+	"bytes"
+	. "common"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	libhttp "net/http"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// How the query results are encoded, every chunk of the chunked
+// responses is a series or an error
+type ResponseFormat interface {
+	ContentType() string
+	MarshalSeries(series *protocol.Series, precision TimePrecision) ([]byte, error)
+	MarshalAllSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error)
+	// Returns nil if the format can't encode the errors
+	MarshalError(message string) ([]byte, error)
+}
+
+// The format= parameter takes precedence over the Accept header, the
+// default is JSON
+func ResponseFormatOf(r *libhttp.Request) (ResponseFormat, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "json":
+		return JsonFormat{}, nil
+	case "msgpack":
+		return MsgpackFormat{}, nil
+	case "protobuf":
+		return ProtobufFormat{}, nil
+	case "csv":
+		return newCsvFormat(r)
+	case "":
+	default:
+		return nil, fmt.Errorf("Unknown response format %s", format)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		// ignore the quality of the media types
+		switch strings.TrimSpace(strings.Split(accepted, ";")[0]) {
+		case "application/json":
+			return JsonFormat{}, nil
+		case "application/x-msgpack", "application/msgpack":
+			return MsgpackFormat{}, nil
+		case "application/x-protobuf":
+			return ProtobufFormat{}, nil
+		case "text/csv":
+			return newCsvFormat(r)
+		}
+	}
+	return JsonFormat{}, nil
+}
+
+// The chunks are separated by new lines
+type JsonFormat struct{}
+
+func (self JsonFormat) ContentType() string {
+	return "application/json"
+}
+
+func (self JsonFormat) MarshalSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
+	data, err := serializeSingleSeries(series, precision)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (self JsonFormat) MarshalAllSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
+	return serializeMultipleSeries(series, precision)
+}
+
+func (self JsonFormat) MarshalError(message string) ([]byte, error) {
+	data, err := json.Marshal(map[string]string{"error": message})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// The series have the same keys as their JSON objects, the chunks are
+// one msgpack object each
+type MsgpackFormat struct{}
+
+func (self MsgpackFormat) ContentType() string {
+	return "application/x-msgpack"
+}
+
+func (self MsgpackFormat) MarshalSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
+	arg := map[string]*protocol.Series{"": series}
+	return marshalMsgpack(SerializeSeries(arg, precision)[0])
+}
+
+func (self MsgpackFormat) MarshalAllSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
+	return marshalMsgpack(SerializeSeries(series, precision))
+}
+
+func (self MsgpackFormat) MarshalError(message string) ([]byte, error) {
+	return marshalMsgpack(map[string]string{"error": message})
+}
+
+// The protocol.Series messages, each one prefixed by its length as a
+// little endian uint32 like the messages of the protobuf server. The
+// timestamps are always in microseconds and the time and sequence
+// number aren't in the fields of the series.
+type ProtobufFormat struct{}
+
+func (self ProtobufFormat) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (self ProtobufFormat) MarshalSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
+	data, err := proto.Marshal(series)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)+4))
+	binary.Write(buffer, binary.LittleEndian, uint32(len(data)))
+	buffer.Write(data)
+	return buffer.Bytes(), nil
+}
+
+func (self ProtobufFormat) MarshalAllSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	for _, s := range series {
+		data, err := self.MarshalSeries(s, precision)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(data)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (self ProtobufFormat) MarshalError(message string) ([]byte, error) {
+	return nil, nil
+}
+
+// RFC 4180 rows of the name of the series, the time, the sequence number
+// and the values of the points. A header row with the column names comes
+// before the first row and before the rows of a series with other
+// columns. The times are in the time precision or, with
+// time_format=rfc3339, RFC 3339 times in UTC. The errors can't be
+// told from the rows, the responses just end.
+type CsvFormat struct {
+	rfc3339 bool
+	columns []string
+}
+
+func newCsvFormat(r *libhttp.Request) (*CsvFormat, error) {
+	switch timeFormat := r.URL.Query().Get("time_format"); timeFormat {
+	case "", "epoch":
+		return &CsvFormat{}, nil
+	case "rfc3339":
+		return &CsvFormat{rfc3339: true}, nil
+	default:
+		return nil, fmt.Errorf("Unknown time format %s, it must be epoch or rfc3339", timeFormat)
+	}
+}
+
+func (self *CsvFormat) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (self *CsvFormat) MarshalSeries(series *protocol.Series, precision TimePrecision) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	writer.UseCRLF = true
+	columns := append([]string{"name", "time", "sequence_number"}, series.Fields...)
+	if !stringsEqual(columns, self.columns) {
+		self.columns = columns
+		writer.Write(columns)
+	}
+	row := make([]string, len(columns))
+	for _, point := range series.Points {
+		row[0] = series.GetName()
+		if self.rfc3339 {
+			row[1] = time.Unix(0, point.GetTimestamp()*int64(time.Microsecond)).UTC().Format(time.RFC3339Nano)
+		} else {
+			row[1] = strconv.FormatInt(precision.FromPointTimestamp(point.GetTimestamp()), 10)
+		}
+		row[2] = ""
+		if point.SequenceNumber != nil {
+			row[2] = strconv.FormatUint(point.GetSequenceNumber(), 10)
+		}
+		for i, value := range point.Values {
+			row[3+i] = csvValue(value)
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
+
+func (self *CsvFormat) MarshalAllSeries(series map[string]*protocol.Series, precision TimePrecision) ([]byte, error) {
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := &bytes.Buffer{}
+	for _, name := range names {
+		data, err := self.MarshalSeries(series[name], precision)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(data)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (self *CsvFormat) MarshalError(message string) ([]byte, error) {
+	return nil, nil
+}
+
+// nulls are empty
+func csvValue(value *protocol.FieldValue) string {
+	switch {
+	case value == nil || value.GetIsNull():
+		return ""
+	case value.StringValue != nil:
+		return value.GetStringValue()
+	case value.DoubleValue != nil:
+		return strconv.FormatFloat(value.GetDoubleValue(), 'g', -1, 64)
+	case value.Int64Value != nil:
+		return strconv.FormatInt(value.GetInt64Value(), 10)
+	case value.BoolValue != nil:
+		return strconv.FormatBool(value.GetBoolValue())
+	}
+	return ""
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
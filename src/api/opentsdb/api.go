@@ -0,0 +1,206 @@
+// package opentsdb provides a tcp listener that you can use to ingest
+// metrics into influxdb from the OpenTSDB collectors. Like a TSD it
+// accepts the telnet put command and the /api/put HTTP endpoint on the
+// same port, every data point is written to the series named after its
+// metric with a value column and a string column per tag.
+package opentsdb
+
+import (
+	"bufio"
+	"cluster"
+	. "common"
+	"configuration"
+	"coordinator"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	libhttp "net/http"
+	"protocol"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+type Server struct {
+	listenAddress string
+	database      string
+	coordinator   coordinator.Coordinator
+	clusterConfig *cluster.ClusterConfiguration
+	conn          net.Listener
+	httpConns     *connListener
+	user          *cluster.ClusterAdmin
+	shutdown      chan bool
+}
+
+func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
+	self := &Server{}
+	self.listenAddress = config.OpenTsdbPortString()
+	self.database = config.OpenTsdbDatabase
+	self.coordinator = coord
+	self.shutdown = make(chan bool, 1)
+	self.clusterConfig = clusterConfig
+
+	return self
+}
+
+// getAuth assures that the user property is a user with access to the opentsdb database
+// only call this function after everything (i.e. Raft) is initialized, so that there's at least 1 admin user
+func (self *Server) getAuth() {
+	// just use any (the first) of the list of admins.
+	names := self.clusterConfig.GetClusterAdmins()
+	self.user = self.clusterConfig.GetClusterAdmin(names[0])
+}
+
+func (self *Server) ListenAndServe() {
+	self.getAuth()
+	var err error
+	self.conn, err = net.Listen("tcp", self.listenAddress)
+	if err != nil {
+		log.Error("OpenTsdbServer: Listen: ", err)
+		return
+	}
+	self.Serve(self.conn)
+}
+
+func (self *Server) Serve(listener net.Listener) {
+	defer func() { self.shutdown <- true }()
+
+	self.httpConns = newConnListener(listener.Addr())
+	mux := libhttp.NewServeMux()
+	mux.HandleFunc("/api/put", self.handlePut)
+	go libhttp.Serve(self.httpConns, mux)
+	defer self.httpConns.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.Error("OpenTsdbServer: Accept: ", err)
+			continue
+		}
+		go self.handleClient(conn)
+	}
+}
+
+// The telnet connections start with a command, every other connection
+// is handed to the http server
+func (self *Server) handleClient(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	command, err := reader.Peek(4)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch string(command) {
+	case "put ", "vers":
+		defer conn.Close()
+		self.handleTelnet(conn, reader)
+	default:
+		self.httpConns.add(&bufferedConn{conn, reader})
+	}
+}
+
+func (self *Server) handleTelnet(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Error("OpenTsdbServer: cannot read from the telnet connection: %s", err)
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "version" {
+			fmt.Fprintf(conn, "InfluxDB OpenTSDB listener\n")
+			continue
+		}
+		if err := self.writeLine(line); err != nil {
+			// the TSDs reply to the failed puts only
+			fmt.Fprintf(conn, "put: %s\n", err)
+		}
+	}
+}
+
+func (self *Server) writeLine(line string) error {
+	point, err := parsePutLine(line)
+	if err != nil {
+		return err
+	}
+	series, err := point.toSeries()
+	if err != nil {
+		return err
+	}
+	return self.writePoints([]*protocol.Series{series})
+}
+
+func (self *Server) handlePut(w libhttp.ResponseWriter, r *libhttp.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(libhttp.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	points, err := parsePutBody(body)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	series := make([]*protocol.Series, 0, len(points))
+	for _, point := range points {
+		s, err := point.toSeries()
+		if err != nil {
+			w.WriteHeader(libhttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		series = append(series, s)
+	}
+	if err := self.writePoints(series); err != nil {
+		w.WriteHeader(libhttp.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(libhttp.StatusNoContent)
+}
+
+func (self *Server) writePoints(series []*protocol.Series) error {
+	err := self.coordinator.WriteSeriesData(self.user, self.database, series)
+	if err != nil {
+		switch err.(type) {
+		case AuthorizationError:
+			// user information got stale, get a fresh one (this should happen rarely)
+			self.getAuth()
+			err = self.coordinator.WriteSeriesData(self.user, self.database, series)
+			if err != nil {
+				log.Warn("OpenTsdbServer: failed to write series after getting new auth: %s", err.Error())
+			}
+		default:
+			log.Warn("OpenTsdbServer: failed write series: %s", err.Error())
+		}
+	}
+	return err
+}
+
+func (self *Server) Close() {
+	if self.conn != nil {
+		log.Info("OpenTsdbServer: Closing opentsdb server")
+		self.conn.Close()
+		select {
+		case <-time.After(time.Second * 5):
+			log.Error("OpenTsdbServer: The listener didn't stop. Closing anyway")
+		case <-self.shutdown:
+		}
+	}
+}
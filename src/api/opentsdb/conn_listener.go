@@ -0,0 +1,62 @@
+package opentsdb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// A net.Listener of the connections handed to it, the http server of
+// the /api/put endpoint serves the connections that aren't telnet ones
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+}
+
+func (self *connListener) add(conn net.Conn) {
+	select {
+	case self.conns <- conn:
+	case <-self.closed:
+		conn.Close()
+	}
+}
+
+func (self *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.closed:
+		return nil, fmt.Errorf("The listener is closed")
+	}
+}
+
+func (self *connListener) Close() error {
+	self.closeOnce.Do(func() { close(self.closed) })
+	return nil
+}
+
+func (self *connListener) Addr() net.Addr {
+	return self.addr
+}
+
+// A connection that reads through the reader used to peek at its first
+// bytes
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (self *bufferedConn) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
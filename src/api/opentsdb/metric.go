@@ -0,0 +1,124 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// The timestamps past this many seconds are in milliseconds, like
+// OpenTSDB does
+const MAX_SECONDS_TIMESTAMP = 1<<32 - 1
+
+// A data point of the put command or of the /api/put endpoint, the tags
+// are written as string columns next to the value column
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Parses the arguments of a put line, i.e.
+//
+//	put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+func parsePutLine(line string) (*dataPoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "put" {
+		return nil, fmt.Errorf("Unknown command %s", line)
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Not enough arguments (need at least 3, got %d)", len(fields)-1)
+	}
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timestamp %s", fields[2])
+	}
+	point := &dataPoint{
+		Metric:    fields[1],
+		Timestamp: timestamp,
+		Value:     json.Number(fields[3]),
+		Tags:      map[string]string{},
+	}
+	for _, tag := range fields[4:] {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid tag %s", tag)
+		}
+		point.Tags[parts[0]] = parts[1]
+	}
+	return point, nil
+}
+
+// Parses the body of /api/put, which is either one data point or an
+// array of them
+func parsePutBody(body []byte) ([]*dataPoint, error) {
+	points := []*dataPoint{}
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &points); err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+	point := &dataPoint{}
+	if err := json.Unmarshal(body, point); err != nil {
+		return nil, err
+	}
+	return append(points, point), nil
+}
+
+func (self *dataPoint) toSeries() (*protocol.Series, error) {
+	if self.Metric == "" {
+		return nil, fmt.Errorf("The data point has no metric name")
+	}
+	if self.Timestamp <= 0 {
+		return nil, fmt.Errorf("The data point of %s has an invalid timestamp %d", self.Metric, self.Timestamp)
+	}
+	value := &protocol.FieldValue{}
+	if i, err := strconv.ParseInt(string(self.Value), 10, 64); err == nil {
+		value.Int64Value = protocol.Int64(i)
+	} else if f, err := strconv.ParseFloat(string(self.Value), 64); err == nil {
+		value.DoubleValue = protocol.Float64(f)
+	} else {
+		return nil, fmt.Errorf("The data point of %s has an invalid value %s", self.Metric, self.Value)
+	}
+
+	// the tags are sorted so the points with the same tags have the same
+	// columns
+	tags := make([]string, 0, len(self.Tags))
+	for tag := range self.Tags {
+		if tag == "value" || tag == "time" || tag == "sequence_number" {
+			return nil, fmt.Errorf("The data point of %s uses the reserved column %s as a tag", self.Metric, tag)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	values := []*protocol.FieldValue{value}
+	for _, tag := range tags {
+		values = append(values, &protocol.FieldValue{StringValue: protocol.String(self.Tags[tag])})
+	}
+
+	timestamp := self.Timestamp * 1000000
+	if self.Timestamp > MAX_SECONDS_TIMESTAMP {
+		timestamp = self.Timestamp * 1000
+	}
+	return &protocol.Series{
+		Name:   protocol.String(self.Metric),
+		Fields: append([]string{"value"}, tags...),
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Timestamp: protocol.Int64(timestamp),
+				Values:    values,
+				// the same sequence number keeps only the latest value of a
+				// metric and time
+				SequenceNumber: proto.Uint64(1),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+package opentsdb
+
+import (
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type MetricSuite struct{}
+
+var _ = Suite(&MetricSuite{})
+
+func (self *MetricSuite) TestPutLinesAreConvertedToSeries(c *C) {
+	point, err := parsePutLine("put sys.cpu.user 1400000000 42.5 host=webserver01 cpu=0")
+	c.Assert(err, IsNil)
+	series, err := point.toSeries()
+	c.Assert(err, IsNil)
+	c.Assert(*series.Name, Equals, "sys.cpu.user")
+	// the tags are sorted
+	c.Assert(series.Fields, DeepEquals, []string{"value", "cpu", "host"})
+	c.Assert(series.Points, HasLen, 1)
+	c.Assert(*series.Points[0].Timestamp, Equals, int64(1400000000000000))
+	c.Assert(*series.Points[0].Values[0].DoubleValue, Equals, 42.5)
+	c.Assert(*series.Points[0].Values[1].StringValue, Equals, "0")
+	c.Assert(*series.Points[0].Values[2].StringValue, Equals, "webserver01")
+
+	// the timestamps can be in milliseconds
+	point, err = parsePutLine("put sys.cpu.user 1400000000123 42")
+	c.Assert(err, IsNil)
+	series, err = point.toSeries()
+	c.Assert(err, IsNil)
+	c.Assert(series.Fields, DeepEquals, []string{"value"})
+	c.Assert(*series.Points[0].Timestamp, Equals, int64(1400000000123000))
+	c.Assert(*series.Points[0].Values[0].Int64Value, Equals, int64(42))
+
+	for _, invalid := range []string{
+		"get sys.cpu.user 1400000000 42",
+		"put sys.cpu.user 1400000000",
+		"put sys.cpu.user now 42",
+		"put sys.cpu.user 1400000000 42 host",
+	} {
+		_, err = parsePutLine(invalid)
+		c.Assert(err, NotNil)
+	}
+	point, err = parsePutLine("put sys.cpu.user 1400000000 abc")
+	c.Assert(err, IsNil)
+	_, err = point.toSeries()
+	c.Assert(err, NotNil)
+	point, err = parsePutLine("put sys.cpu.user 1400000000 1 value=1")
+	c.Assert(err, IsNil)
+	_, err = point.toSeries()
+	c.Assert(err, NotNil)
+}
+
+func (self *MetricSuite) TestPutBodiesAreParsed(c *C) {
+	points, err := parsePutBody([]byte(`{"metric": "sys.cpu.nice", "timestamp": 1400000000, "value": 18, "tags": {"host": "web01"}}`))
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Metric, Equals, "sys.cpu.nice")
+	c.Assert(points[0].Tags, DeepEquals, map[string]string{"host": "web01"})
+
+	points, err = parsePutBody([]byte(`[
+    {"metric": "sys.cpu.nice", "timestamp": 1400000000, "value": 18, "tags": {"host": "web01"}},
+    {"metric": "sys.cpu.nice", "timestamp": 1400000001, "value": 9.5, "tags": {"host": "web02"}}
+  ]`))
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 2)
+	series, err := points[1].toSeries()
+	c.Assert(err, IsNil)
+	c.Assert(*series.Points[0].Values[0].DoubleValue, Equals, 9.5)
+
+	_, err = parsePutBody([]byte(`{"metric": `))
+	c.Assert(err, NotNil)
+}
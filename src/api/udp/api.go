@@ -7,11 +7,24 @@ import (
 	"encoding/json"
 	"net"
 	"protocol"
+	"sync/atomic"
+	"time"
 
 	log "code.google.com/p/log4go"
 )
 
+// The number of packets received since the server started, the invalid
+// ones are the packets that couldn't be parsed and the dropped ones are
+// the packets that were valid but weren't written
+type Stats struct {
+	PacketsReceived uint64 `json:"packetsReceived"`
+	InvalidPackets  uint64 `json:"invalidPackets"`
+	DroppedPackets  uint64 `json:"droppedPackets"`
+}
+
 type Server struct {
+	// first so the counters are 64 bit aligned
+	stats         Stats
 	listenAddress string
 	database      string
 	coordinator   coordinator.Coordinator
@@ -19,9 +32,14 @@ type Server struct {
 	conn          *net.UDPConn
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
+	batchSize     int
+	batchTimeout  time.Duration
+	pending       chan []*protocol.Series
+	stopBatches   chan bool
+	batchesDone   chan bool
 }
 
-func NewServer(listenAddress string, database string, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
+func NewServer(listenAddress string, database string, batchSize int, batchTimeout time.Duration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
 	self := &Server{}
 
 	self.listenAddress = listenAddress
@@ -29,6 +47,11 @@ func NewServer(listenAddress string, database string, coord coordinator.Coordina
 	self.coordinator = coord
 	self.shutdown = make(chan bool, 1)
 	self.clusterConfig = clusterConfig
+	self.batchSize = batchSize
+	self.batchTimeout = batchTimeout
+	self.pending = make(chan []*protocol.Series, batchSize)
+	self.stopBatches = make(chan bool)
+	self.batchesDone = make(chan bool)
 
 	return self
 }
@@ -58,45 +81,142 @@ func (self *Server) ListenAndServe() {
 		}
 	}
 	defer self.conn.Close()
+	go self.writeBatches()
 	self.HandleSocket(self.conn)
 }
 
 func (self *Server) HandleSocket(socket *net.UDPConn) {
+	defer func() { self.shutdown <- true }()
 	buffer := make([]byte, 2048)
 
 	for {
 		n, _, err := socket.ReadFromUDP(buffer)
 		if err != nil || n == 0 {
+			select {
+			case <-self.stopBatches:
+				return
+			default:
+			}
 			log.Error("UDP ReadFromUDP error: %s", err)
 			continue
 		}
+		atomic.AddUint64(&self.stats.PacketsReceived, 1)
 
-		serializedSeries := []*SerializedSeries{}
-		err = json.Unmarshal(buffer[0:n], &serializedSeries)
+		serie, err := self.parsePacket(buffer[0:n])
 		if err != nil {
-			log.Error("UDP json error: %s", err)
+			atomic.AddUint64(&self.stats.InvalidPackets, 1)
+			log.Debug("UDP invalid packet: %s", err)
+			continue
+		}
+		if len(serie) == 0 {
 			continue
 		}
 
-		for _, s := range serializedSeries {
-			if len(s.Points) == 0 {
-				continue
-			}
+		// the packets are dropped rather than waiting for the batches to
+		// be written, the senders don't wait for them anyway
+		select {
+		case self.pending <- serie:
+		default:
+			atomic.AddUint64(&self.stats.DroppedPackets, 1)
+		}
+	}
+}
 
-			series, err := ConvertToDataStoreSeries(s, SecondPrecision)
-			if err != nil {
-				log.Error("UDP cannot convert received data: %s", err)
-				continue
-			}
+func (self *Server) parsePacket(packet []byte) ([]*protocol.Series, error) {
+	serializedSeries := []*SerializedSeries{}
+	err := json.Unmarshal(packet, &serializedSeries)
+	if err != nil {
+		return nil, err
+	}
+
+	serie := make([]*protocol.Series, 0, len(serializedSeries))
+	for _, s := range serializedSeries {
+		if len(s.Points) == 0 {
+			continue
+		}
+
+		series, err := ConvertToDataStoreSeries(s, SecondPrecision)
+		if err != nil {
+			return nil, err
+		}
+		serie = append(serie, series)
+	}
+	return serie, nil
+}
 
-			serie := []*protocol.Series{series}
-			err = self.coordinator.WriteSeriesData(self.user, self.database, serie)
+// Writes the series received once there are batchSize points or
+// batchTimeout after the first packet of the batch
+func (self *Server) writeBatches() {
+	defer close(self.batchesDone)
+	batch := []*protocol.Series{}
+	packets := uint64(0)
+	points := 0
+	var timeout <-chan time.Time
+	flush := func() {
+		if len(batch) > 0 {
+			err := self.coordinator.WriteSeriesData(self.user, self.database, batch)
 			if err != nil {
+				atomic.AddUint64(&self.stats.DroppedPackets, packets)
 				log.Error("UDP cannot write data: %s", err)
-				continue
 			}
 		}
+		batch = []*protocol.Series{}
+		packets = 0
+		points = 0
+		timeout = nil
+	}
+	for {
+		select {
+		case serie := <-self.pending:
+			if len(batch) == 0 {
+				timeout = time.After(self.batchTimeout)
+			}
+			batch = append(batch, serie...)
+			packets++
+			for _, s := range serie {
+				points += len(s.Points)
+			}
+			if points >= self.batchSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		case <-self.stopBatches:
+			for {
+				select {
+				case serie := <-self.pending:
+					batch = append(batch, serie...)
+					packets++
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
 
+func (self *Server) Stats() *Stats {
+	return &Stats{
+		PacketsReceived: atomic.LoadUint64(&self.stats.PacketsReceived),
+		InvalidPackets:  atomic.LoadUint64(&self.stats.InvalidPackets),
+		DroppedPackets:  atomic.LoadUint64(&self.stats.DroppedPackets),
 	}
+}
 
+func (self *Server) Close() {
+	if self.conn == nil {
+		return
+	}
+	log.Info("UDPServer: Closing udp server on %s", self.listenAddress)
+	close(self.stopBatches)
+	self.conn.Close()
+	select {
+	case <-time.After(time.Second * 5):
+		log.Error("UDPServer: Cannot write the last batch of points. Closing anyway")
+	case <-self.batchesDone:
+	}
+	<-self.shutdown
+	stats := self.Stats()
+	log.Info("UDPServer: received %d packets, %d were invalid and %d were dropped", stats.PacketsReceived, stats.InvalidPackets, stats.DroppedPackets)
 }
@@ -0,0 +1,51 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type UdpSuite struct{}
+
+var _ = Suite(&UdpSuite{})
+
+func (self *UdpSuite) TestPacketsAreDroppedWhenTheBatchesAreFull(c *C) {
+	server := NewServer("127.0.0.1:0", "db1", 1, time.Second, nil, nil)
+	addr, err := net.ResolveUDPAddr("udp4", server.listenAddress)
+	c.Assert(err, IsNil)
+	server.conn, err = net.ListenUDP("udp", addr)
+	c.Assert(err, IsNil)
+	defer server.conn.Close()
+	// the batches aren't written, so only the first packet fits
+	go server.HandleSocket(server.conn)
+
+	client, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	c.Assert(err, IsNil)
+	defer client.Close()
+	for _, packet := range []string{
+		`[{"name": "foo", "columns": ["value"], "points": [[1]]}]`,
+		`[{"name": "foo", "columns": ["value"], "points": [[2]]}]`,
+		`[{"name": "foo", "columns": ["value"], "points": [[3]]}]`,
+		`[{"name": "foo", "columns"`,
+	} {
+		_, err := client.Write([]byte(packet))
+		c.Assert(err, IsNil)
+	}
+
+	for i := 0; i < 100 && server.Stats().PacketsReceived < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(server.Stats(), DeepEquals, &Stats{PacketsReceived: 4, InvalidPackets: 1, DroppedPackets: 2})
+	serie := <-server.pending
+	c.Assert(serie, HasLen, 1)
+	c.Assert(*serie[0].Name, Equals, "foo")
+	c.Assert(*serie[0].Points[0].Values[0].Int64Value, Equals, int64(1))
+}
@@ -0,0 +1,224 @@
+// Package client is a client of the HTTP API. It batches the points it
+// writes and fails over to the other servers of the cluster when a
+// server is down.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BATCH_SIZE     = 1000
+	DEFAULT_FLUSH_INTERVAL = time.Second
+	DEFAULT_RETRIES        = 3
+	DEFAULT_RETRY_WAIT     = 100 * time.Millisecond
+)
+
+// The user the client writes and queries as, the database users only
+// exist in their database
+type Auth struct {
+	Database string
+	Username string
+	Password string
+}
+
+// The status and the body of a request the server rejected
+type Error struct {
+	Host       string
+	StatusCode int
+	Body       string
+}
+
+func (self *Error) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", self.Host, self.StatusCode, strings.TrimSpace(self.Body))
+}
+
+// the servers are down or overloaded, another one may take the request
+func (self *Error) retryable() bool {
+	return self.StatusCode >= 500 || self.StatusCode == 429
+}
+
+// A series returned by a query, the values of the time column are
+// time.Time and the numbers are json.Number
+type Series struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Points  [][]interface{} `json:"points"`
+}
+
+// The settings are read when the client first writes, they can be changed
+// until then
+type Client struct {
+	// the points are sent once there are BatchSize of them, or after
+	// FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+	// a request that fails is retried up to Retries times on the next
+	// servers, after RetryWait
+	Retries    int
+	RetryWait  time.Duration
+	HttpClient *http.Client
+
+	urls []string
+	auth Auth
+	// the index of the server the requests go to first
+	next int
+	// the points that weren't sent yet and the error of the last flush
+	// in the background
+	pending  []*Point
+	flushErr error
+	// closed to stop the flushes in the background, nil until the first
+	// write
+	stop    chan bool
+	stopped chan bool
+	lock    sync.Mutex
+	// the batches are sent one at a time
+	flushLock sync.Mutex
+}
+
+// Returns a client of the servers at the urls, e.g. http://localhost:8086,
+// the requests go to the first one until it fails
+func NewClient(urls []string, auth Auth) (*Client, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("The client needs the url of at least one server")
+	}
+	if auth.Database == "" {
+		return nil, errors.New("The client needs a database")
+	}
+	trimmed := make([]string, 0, len(urls))
+	for _, u := range urls {
+		if _, err := url.Parse(u); err != nil {
+			return nil, err
+		}
+		trimmed = append(trimmed, strings.TrimRight(u, "/"))
+	}
+	return &Client{
+		BatchSize:     DEFAULT_BATCH_SIZE,
+		FlushInterval: DEFAULT_FLUSH_INTERVAL,
+		Retries:       DEFAULT_RETRIES,
+		RetryWait:     DEFAULT_RETRY_WAIT,
+		HttpClient:    http.DefaultClient,
+		urls:          trimmed,
+		auth:          auth,
+	}, nil
+}
+
+// Runs the query and returns the series it returned
+func (self *Client) Query(query string) ([]*Series, error) {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("time_precision", "u")
+	body, err := self.request("GET", self.path("series"), params, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// the integers would lose their precision as float64s
+	decoder.UseNumber()
+	series := []*Series{}
+	if err := decoder.Decode(&series); err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		if err := s.parseTimes(); err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+func (self *Series) parseTimes() error {
+	for i, column := range self.Columns {
+		if column != "time" {
+			continue
+		}
+		for _, point := range self.Points {
+			number, ok := point[i].(json.Number)
+			if !ok {
+				continue
+			}
+			micros, err := number.Int64()
+			if err != nil {
+				return err
+			}
+			point[i] = time.Unix(0, micros*int64(time.Microsecond))
+		}
+	}
+	return nil
+}
+
+func (self *Client) path(endpoint string) string {
+	return "/db/" + url.QueryEscape(self.auth.Database) + "/" + endpoint
+}
+
+// Sends the request to the servers until one of them takes it, the errors
+// other than the ones of the servers that are down aren't retried
+func (self *Client) request(method, path string, params url.Values, headers map[string]string, data []byte) ([]byte, error) {
+	params.Set("u", self.auth.Username)
+	params.Set("p", self.auth.Password)
+	var lastErr error
+	for attempt := 0; attempt <= self.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(self.RetryWait)
+		}
+		host := self.host()
+		body, err := self.send(method, self.urls[host]+path+"?"+params.Encode(), headers, data)
+		if err == nil {
+			return body, nil
+		}
+		if e, ok := err.(*Error); ok && !e.retryable() {
+			return nil, err
+		}
+		lastErr = err
+		self.failover(host)
+	}
+	return nil, lastErr
+}
+
+func (self *Client) send(method, u string, headers map[string]string, data []byte) ([]byte, error) {
+	request, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, err := self.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, &Error{request.URL.Host, response.StatusCode, string(body)}
+	}
+	return body, nil
+}
+
+func (self *Client) host() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.next
+}
+
+// the requests go to the next server once one fails, unless another
+// request moved on already
+func (self *Client) failover(host int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.next == host {
+		self.next = (host + 1) % len(self.urls)
+	}
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+type recordedWrite struct {
+	key    string
+	series []*Series
+}
+
+// a server that records the writes it takes and returns the status
+type recordingServer struct {
+	*httptest.Server
+	status int
+	lock   sync.Mutex
+	writes []*recordedWrite
+}
+
+func newRecordingServer(status int) *recordingServer {
+	server := &recordingServer{status: status}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		series := []*Series{}
+		json.Unmarshal(body, &series)
+		server.lock.Lock()
+		server.writes = append(server.writes, &recordedWrite{r.Header.Get("Idempotency-Key"), series})
+		server.lock.Unlock()
+		w.WriteHeader(server.status)
+	}))
+	return server
+}
+
+func (self *ClientSuite) TestWritesFailOverToTheNextServer(c *C) {
+	down := newRecordingServer(http.StatusInternalServerError)
+	defer down.Close()
+	up := newRecordingServer(http.StatusOK)
+	defer up.Close()
+
+	client, err := NewClient([]string{down.URL, up.URL}, Auth{"db1", "user", "pass"})
+	c.Assert(err, IsNil)
+	client.BatchSize = 2
+	client.RetryWait = time.Millisecond
+	now := time.Now()
+	c.Assert(client.Write(&Point{Series: "cpu", Time: now, Fields: map[string]interface{}{"value": 1}}), IsNil)
+	c.Assert(client.Write(&Point{Series: "cpu", Fields: map[string]interface{}{"value": 2}}), IsNil)
+
+	c.Assert(down.writes, HasLen, 1)
+	c.Assert(up.writes, HasLen, 1)
+	// the server that got the retry knows it's the same batch
+	c.Assert(up.writes[0].key, Not(Equals), "")
+	c.Assert(up.writes[0].key, Equals, down.writes[0].key)
+	series := up.writes[0].series
+	c.Assert(series, HasLen, 2)
+	c.Assert(series[0].Columns, DeepEquals, []string{"value", "time"})
+	c.Assert(series[0].Points[0][1], Equals, float64(now.UnixNano()/int64(time.Microsecond)))
+	c.Assert(series[1].Columns, DeepEquals, []string{"value"})
+
+	// the next requests go to the server that's up
+	c.Assert(client.Write(&Point{Series: "cpu", Fields: map[string]interface{}{"value": 3}}), IsNil)
+	c.Assert(client.Close(), IsNil)
+	c.Assert(down.writes, HasLen, 1)
+	c.Assert(up.writes, HasLen, 2)
+}
+
+func (self *ClientSuite) TestTheErrorsOfTheRequestsAreNotRetried(c *C) {
+	server := newRecordingServer(http.StatusBadRequest)
+	defer server.Close()
+
+	client, err := NewClient([]string{server.URL, server.URL}, Auth{"db1", "user", "pass"})
+	c.Assert(err, IsNil)
+	c.Assert(client.Write(&Point{Series: "cpu", Fields: map[string]interface{}{"value": 1}}), IsNil)
+	err = client.Close()
+	c.Assert(err, NotNil)
+	c.Assert(err.(*Error).StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(server.writes, HasLen, 1)
+}
+
+func (self *ClientSuite) TestQueriesReturnTheSeries(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/db/db1/series")
+		c.Check(r.URL.Query().Get("q"), Equals, "select value from cpu")
+		c.Check(r.URL.Query().Get("u"), Equals, "user")
+		w.Write([]byte(`[{"name":"cpu","columns":["time","sequence_number","value"],"points":[[1400000000000001,1,9007199254740993]]}]`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient([]string{server.URL}, Auth{"db1", "user", "pass"})
+	c.Assert(err, IsNil)
+	series, err := client.Query("select value from cpu")
+	c.Assert(err, IsNil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].Name, Equals, "cpu")
+	c.Assert(series[0].Points[0][0], Equals, time.Unix(1400000000, 1000))
+	c.Assert(series[0].Points[0][2], Equals, json.Number("9007199254740993"))
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A point of a series, the server sets the time of the points with a zero
+// time to the time of the write
+type Point struct {
+	Series string
+	Time   time.Time
+	Fields map[string]interface{}
+}
+
+// Adds the points to the batch, the batch is sent once it's full. The
+// errors of the batches sent in the background are returned by the next
+// write.
+func (self *Client) Write(points ...*Point) error {
+	self.lock.Lock()
+	if err := self.flushErr; err != nil {
+		self.flushErr = nil
+		self.lock.Unlock()
+		return err
+	}
+	self.pending = append(self.pending, points...)
+	full := len(self.pending) >= self.BatchSize
+	if self.stop == nil {
+		self.stop = make(chan bool)
+		self.stopped = make(chan bool)
+		go self.flushPeriodically(self.FlushInterval)
+	}
+	self.lock.Unlock()
+
+	if full {
+		return self.Flush()
+	}
+	return nil
+}
+
+// Sends the points that weren't sent yet. The points of a batch the
+// servers didn't take after the retries are dropped.
+func (self *Client) Flush() error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+
+	self.lock.Lock()
+	batch := self.pending
+	self.pending = nil
+	err := self.flushErr
+	self.flushErr = nil
+	self.lock.Unlock()
+
+	if len(batch) == 0 {
+		return err
+	}
+	data, e := json.Marshal(seriesOfPoints(batch))
+	if e != nil {
+		return e
+	}
+	params := url.Values{}
+	params.Set("time_precision", "u")
+	// the servers drop the retries of a batch they wrote already
+	headers := map[string]string{"Idempotency-Key": newIdempotencyKey(), "Content-Type": "application/json"}
+	if _, e := self.request("POST", self.path("series"), params, headers, data); e != nil {
+		return e
+	}
+	return err
+}
+
+// Sends the last points and stops the flushes in the background
+func (self *Client) Close() error {
+	self.lock.Lock()
+	stop, stopped := self.stop, self.stopped
+	self.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+	return self.Flush()
+}
+
+func (self *Client) flushPeriodically(interval time.Duration) {
+	defer close(self.stopped)
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-time.After(interval):
+		}
+		if err := self.Flush(); err != nil {
+			self.lock.Lock()
+			self.flushErr = err
+			self.lock.Unlock()
+		}
+	}
+}
+
+// Puts the points of the same series with the same fields together, the
+// columns are the names of the fields in order
+func seriesOfPoints(points []*Point) []*Series {
+	series := []*Series{}
+	byKey := map[string]*Series{}
+	for _, point := range points {
+		columns := make([]string, 0, len(point.Fields)+1)
+		for name := range point.Fields {
+			columns = append(columns, name)
+		}
+		sort.Strings(columns)
+		if !point.Time.IsZero() {
+			columns = append(columns, "time")
+		}
+		key := point.Series + "\x00" + strings.Join(columns, "\x00")
+		s := byKey[key]
+		if s == nil {
+			s = &Series{Name: point.Series, Columns: columns}
+			byKey[key] = s
+			series = append(series, s)
+		}
+		values := make([]interface{}, 0, len(columns))
+		for _, name := range columns[:len(point.Fields)] {
+			values = append(values, point.Fields[name])
+		}
+		if !point.Time.IsZero() {
+			values = append(values, point.Time.UnixNano()/int64(time.Microsecond))
+		}
+		s.Points = append(s.Points, values)
+	}
+	return series
+}
+
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	p "protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A cluster backup is a directory with the cluster metadata, a manifest
+// and a backup of every shard taken from one of its replicas. Every
+// server writes the backups of the shards it was asked for to the same
+// directory on its own disk, the manifest tells which server has which
+// shard. The directories have to be merged on one server to restore.
+
+const (
+	BACKUP_MANIFEST_FILE = "manifest.json"
+	BACKUP_METADATA_FILE = "metadata"
+)
+
+var backupShardsRequest = p.Request_BACKUP_SHARDS
+
+type BackupManifest struct {
+	Time   time.Time      `json:"time"`
+	Shards []*ShardBackup `json:"shards"`
+}
+
+type ShardBackup struct {
+	Id            uint32    `json:"id"`
+	Type          ShardType `json:"type"`
+	StartTime     time.Time `json:"startTime"`
+	EndTime       time.Time `json:"endTime"`
+	DurationSplit bool      `json:"durationSplit"`
+	// the server the backup was written on
+	ServerId uint32 `json:"serverId"`
+	// relative to the backup directory
+	Dir string `json:"dir"`
+}
+
+func shardBackupDir(shardId uint32) string {
+	return filepath.Join("shards", fmt.Sprintf("%.5d", shardId))
+}
+
+// Picks the replica every shard is backed up from, the local copy if
+// there's one. Returns the manifest of the backup and the ids of the
+// shards to back up on each server.
+func (self *ClusterConfiguration) PlanBackup() (*BackupManifest, map[uint32][]uint32, error) {
+	manifest := &BackupManifest{Time: time.Now()}
+	shardsByServer := make(map[uint32][]uint32)
+	for _, shard := range self.GetAllShards() {
+		serverId, err := self.backupServer(shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		shardsByServer[serverId] = append(shardsByServer[serverId], shard.id)
+		manifest.Shards = append(manifest.Shards, &ShardBackup{
+			Id:            shard.id,
+			Type:          shard.shardType,
+			StartTime:     shard.startTime,
+			EndTime:       shard.endTime,
+			DurationSplit: shard.durationIsSplit,
+			ServerId:      serverId,
+			Dir:           shardBackupDir(shard.id),
+		})
+	}
+	return manifest, shardsByServer, nil
+}
+
+func (self *ClusterConfiguration) backupServer(shard *ShardData) (uint32, error) {
+	if shard.IsLocal {
+		return self.LocalServer.Id, nil
+	}
+	for _, server := range shard.clusterServers {
+		if server.IsUp() {
+			return server.Id, nil
+		}
+	}
+	return 0, fmt.Errorf("None of the replicas of shard %d are up", shard.id)
+}
+
+// Backs up the given shards on the given server to dir, which is a
+// directory on that server
+func (self *ClusterConfiguration) BackupShardsOnServer(serverId uint32, shardIds []uint32, dir string, user common.User) error {
+	if self.LocalServer != nil && serverId == self.LocalServer.Id {
+		return self.BackupShards(shardIds, dir)
+	}
+
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", serverId)
+	}
+	userName := user.GetName()
+	isDbUser := !user.IsClusterAdmin()
+	request := &p.Request{
+		Type:           &backupShardsRequest,
+		Database:       p.String(""),
+		UserName:       &userName,
+		IsDbUser:       &isDbUser,
+		BackupShardIds: shardIds,
+		BackupDir:      &dir,
+	}
+
+	responseChan := make(chan *p.Response, 1)
+	server.MakeRequest(request, responseChan)
+	response := <-responseChan
+	if response.ErrorMessage != nil {
+		return errors.New(response.GetErrorMessage())
+	}
+	if response.GetType() == accessDeniedResponse {
+		return fmt.Errorf("Access denied to back up shards on server %d", serverId)
+	}
+	return nil
+}
+
+// Backs up the local copies of the given shards to dir. The snapshots
+// of all the shards are taken before any of them is written, so the
+// backups are from about the same point in time.
+func (self *ClusterConfiguration) BackupShards(shardIds []uint32, dir string) error {
+	snapshots := make(map[uint32]LocalShardSnapshot, len(shardIds))
+	defer func() {
+		for id, snapshot := range snapshots {
+			snapshot.Release()
+			self.shardStore.ReturnShard(id)
+		}
+	}()
+
+	for _, id := range shardIds {
+		shard := self.GetShard(id)
+		if shard == nil || !shard.IsLocal {
+			return fmt.Errorf("Shard %d isn't stored on this server", id)
+		}
+		db, err := self.shardStore.GetOrCreateShard(id)
+		if err != nil {
+			return err
+		}
+		snapshots[id] = db.Snapshot()
+	}
+
+	for id, snapshot := range snapshots {
+		shardDir := filepath.Join(dir, shardBackupDir(id))
+		if err := os.MkdirAll(filepath.Dir(shardDir), 0755); err != nil {
+			return err
+		}
+		log.Info("BACKUP: writing shard %d to %s", id, shardDir)
+		if err := snapshot.WriteTo(shardDir); err != nil {
+			return fmt.Errorf("Cannot back up shard %d: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// Replaces the local copy of the shard with the backup in dir
+func (self *ClusterConfiguration) RestoreShard(shardId uint32, dir string) error {
+	return self.shardStore.RestoreShard(shardId, dir)
+}
+
+// Streams a backup of the local copy of the shard to w
+func (self *ClusterConfiguration) BackupShardTo(shardId uint32, w io.Writer) error {
+	shard := self.GetShard(shardId)
+	if shard == nil || !shard.IsLocal {
+		return fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	db, err := self.shardStore.GetOrCreateShard(shardId)
+	if err != nil {
+		return err
+	}
+	defer self.shardStore.ReturnShard(shardId)
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+	log.Info("BACKUP: streaming shard %d", shardId)
+	return snapshot.Backup(w)
+}
+
+// Replaces the local copy of the shard with the backup streamed from r
+func (self *ClusterConfiguration) RestoreShardFrom(shardId uint32, r io.Reader) error {
+	shard := self.GetShard(shardId)
+	if shard == nil || !shard.IsLocal {
+		return fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	return self.shardStore.RestoreShardFrom(shardId, r)
+}
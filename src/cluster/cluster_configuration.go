@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"metrics"
 	"parser"
 	"protocol"
 	"sort"
@@ -39,6 +40,11 @@ type WAL interface {
 	CreateCheckpoint() error
 	RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
 	RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	Stats() *wal.Stats
+	Subscribe(name string, requestNumber uint32) error
+	Ack(name string, requestNumber uint32) error
+	Unsubscribe(name string) error
+	ReplayToConsumer(name string, yield func(request *protocol.Request, shardId uint32) error) error
 }
 
 type ShardCreator interface {
@@ -84,6 +90,32 @@ type ClusterConfiguration struct {
 	shardsByIdLock             sync.RWMutex
 	LocalRaftName              string
 	writeBuffers               []*WriteBuffer
+	writeConsistency           map[string]WriteConsistency
+	defaultWriteConsistency    WriteConsistency
+	databaseRetention          map[string]time.Duration
+	readOnly                   bool
+	readOnlyDatabases          map[string]bool
+	maxSeries                  map[string]int
+	replicationFactor          int
+	shortTermShardDuration     time.Duration
+	longTermShardDuration      time.Duration
+	shortTermPartitioner       SeriesPartitioner
+	longTermPartitioner        SeriesPartitioner
+	replicationTargets         map[string]*ReplicationTarget
+	replicationTargetsLock     sync.RWMutex
+	tombstones                 []*Tombstone
+	lastTombstoneId            uint32
+	appliedTombstoneId         uint32
+	tombstonesLock             sync.RWMutex
+	applyTombstonesLock        sync.Mutex
+	recoveryThrottle           *Throttle
+	shardLeases                map[uint32]*ShardLease
+	shardLeasesLock            sync.RWMutex
+	retryPolicy                *RetryPolicy
+	hedgePolicy                *HedgePolicy
+	runtimeSettings            map[string]string
+	runtimeSettingsLock        sync.RWMutex
+	fileSettings               map[string]string
 }
 
 type ContinuousQuery struct {
@@ -100,7 +132,11 @@ func NewClusterConfiguration(
 	wal WAL,
 	shardStore LocalShardStore,
 	connectionCreator func(string) ServerConnection) *ClusterConfiguration {
-	return &ClusterConfiguration{
+	defaultWriteConsistency, err := ParseWriteConsistency(config.DefaultWriteConsistency)
+	if err != nil {
+		log.Error("Invalid default write consistency, using any: %s", err)
+	}
+	clusterConfiguration := &ClusterConfiguration{
 		DatabaseReplicationFactors: make(map[string]struct{}),
 		clusterAdmins:              make(map[string]*ClusterAdmin),
 		dbUsers:                    make(map[string]map[string]*DbUser),
@@ -116,38 +152,77 @@ func NewClusterConfiguration(
 		shortTermShards:            make([]*ShardData, 0),
 		random:                     rand.New(rand.NewSource(time.Now().UnixNano())),
 		shardsById:                 make(map[uint32]*ShardData, 0),
-	}
+		writeConsistency:           make(map[string]WriteConsistency),
+		defaultWriteConsistency:    defaultWriteConsistency,
+		databaseRetention:          make(map[string]time.Duration),
+		readOnlyDatabases:          make(map[string]bool),
+		maxSeries:                  make(map[string]int),
+		replicationFactor:          config.ReplicationFactor,
+		shortTermShardDuration:     *config.ShortTermShard.ParsedDuration(),
+		longTermShardDuration:      *config.LongTermShard.ParsedDuration(),
+		shortTermPartitioner:       NewSeriesPartitioner(config.ShortTermShard),
+		longTermPartitioner:        NewSeriesPartitioner(config.LongTermShard),
+		runtimeSettings:            make(map[string]string),
+		fileSettings:               currentRuntimeSettings(config),
+		replicationTargets:         make(map[string]*ReplicationTarget),
+		recoveryThrottle:           NewThrottle(config.RecoveryMaxBandwidth, config.RecoveryMaxRequestRate),
+		shardLeases:                make(map[uint32]*ShardLease),
+		retryPolicy:                NewRetryPolicy(config.RemoteRequestAttempts, config.RemoteRequestMinBackoff, config.RemoteRequestMaxBackoff),
+		hedgePolicy:                NewHedgePolicy(config.HedgedReadPercentile, config.HedgedReadMinDelay),
+	}
+	clusterConfiguration.appliedTombstoneId = clusterConfiguration.loadAppliedTombstoneId()
+	return clusterConfiguration
 }
 
 func (self *ClusterConfiguration) SetShardCreator(shardCreator ShardCreator) {
 	self.shardCreator = shardCreator
 }
 
-// called by the server, this will wake up every 10 mintues to see if it should
+// called by the server, this will wake up periodically to see if it should
 // create a shard for the next window of time. This way shards get created before
 // a bunch of writes stream in and try to create it all at the same time.
 func (self *ClusterConfiguration) CreateFutureShardsAutomaticallyBeforeTimeComes() {
 	go func() {
 		for {
-			time.Sleep(time.Minute * 10)
+			time.Sleep(self.futureShardCheckInterval())
 			log.Debug("Checking to see if future shards should be created")
-			self.automaticallyCreateFutureShard(self.shortTermShards, SHORT_TERM)
-			self.automaticallyCreateFutureShard(self.longTermShards, LONG_TERM)
+			self.automaticallyCreateFutureShard(self.shortTermShards, SHORT_TERM, time.Now())
+			self.automaticallyCreateFutureShard(self.longTermShards, LONG_TERM, time.Now())
 		}
 	}()
 }
 
-func (self *ClusterConfiguration) automaticallyCreateFutureShard(shards []*ShardData, shardType ShardType) {
+// often enough to not miss the start of the lead time by much
+func (self *ClusterConfiguration) futureShardCheckInterval() time.Duration {
+	interval := self.config.ShardPrecreateLeadTime / 2
+	if interval > 10*time.Minute {
+		return 10 * time.Minute
+	}
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+func (self *ClusterConfiguration) automaticallyCreateFutureShard(shards []*ShardData, shardType ShardType, now time.Time) {
 	if len(shards) == 0 {
 		// don't automatically create shards if they haven't created any yet.
 		return
 	}
 	latestShard := shards[0]
-	if latestShard.endTime.Add(-15*time.Minute).Unix() < time.Now().Unix() {
-		newShardTime := latestShard.endTime.Add(time.Second)
-		microSecondEpochForNewShard := newShardTime.Unix() * 1000 * 1000
-		log.Info("Automatically creating shard for %s", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
-		self.createShards(microSecondEpochForNewShard, shardType)
+	// the latest shard is in the past when nothing was written for a
+	// while, there's no point in creating shards nobody writes to
+	if !latestShard.endTime.After(now) {
+		return
+	}
+	if latestShard.endTime.Add(-self.config.ShardPrecreateLeadTime).After(now) {
+		return
+	}
+	newShardTime := latestShard.endTime.Add(time.Second)
+	microSecondEpochForNewShard := newShardTime.Unix() * 1000 * 1000
+	log.Info("Automatically creating shard for %s", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
+	if _, err := self.createShards(microSecondEpochForNewShard, shardType); err != nil {
+		log.Error("Cannot create the %s shards for %s ahead of time: %s", shardType, newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"), err)
 	}
 }
 
@@ -218,7 +293,9 @@ func (self *ClusterConfiguration) ChangeProtobufConnectionString(server *Cluster
 }
 
 func (self *ClusterConfiguration) RemoveServer(server *ClusterServer) error {
-	server.connection.Close()
+	if server.connection != nil {
+		server.connection.Close()
+	}
 	i := 0
 	l := len(self.servers)
 	for i = 0; i < l; i++ {
@@ -231,10 +308,90 @@ func (self *ClusterConfiguration) RemoveServer(server *ClusterServer) error {
 		return fmt.Errorf("Cannot find server %d", server.Id)
 	}
 	self.servers[i], self.servers = self.servers[l-1], self.servers[:l-1]
+	metrics.Default.Remove(metrics.HandoffMetric(server.Id, "pending"))
+	metrics.Default.Remove(metrics.HandoffMetric(server.Id, "dropped"))
 	log.Debug("Removed server %d", server.Id)
 	return nil
 }
 
+// Changes the number of replicas new shards get, the existing shards
+// are brought up or down to the new factor by the coordinator
+func (self *ClusterConfiguration) SetReplicationFactor(replicationFactor int) error {
+	if replicationFactor < 1 {
+		return fmt.Errorf("Replication factor must be at least 1, got %d", replicationFactor)
+	}
+	self.replicationFactor = replicationFactor
+	return nil
+}
+
+func (self *ClusterConfiguration) GetReplicationFactor() int {
+	return self.replicationFactor
+}
+
+// Changes the duration of the shards of the given type that are created
+// from now on, the existing shards keep theirs. New shards are cut short
+// where they would overlap a shard created with the old duration.
+func (self *ClusterConfiguration) SetShardDuration(shardType ShardType, duration time.Duration) error {
+	if duration < time.Second {
+		return fmt.Errorf("Shard duration must be at least a second, got %s", duration)
+	}
+	if shardType == LONG_TERM {
+		self.longTermShardDuration = duration
+	} else {
+		self.shortTermShardDuration = duration
+	}
+	log.Info("Changed the duration of new %s shards to %s", shardType, duration)
+	return nil
+}
+
+func (self *ClusterConfiguration) GetShardDuration(shardType ShardType) time.Duration {
+	if shardType == LONG_TERM {
+		return self.longTermShardDuration
+	}
+	return self.shortTermShardDuration
+}
+
+// Stops assigning new shards to the given server
+func (self *ClusterConfiguration) DecommissionServer(id uint32) error {
+	server := self.GetServerById(&id)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", id)
+	}
+	server.State = Decommissioning
+	log.Info("Decommissioning server %d", id)
+	return nil
+}
+
+// Returns the servers that new shards can be assigned to. Observers
+// aren't included, they get a copy of every shard on top of the
+// replication factor.
+func (self *ClusterConfiguration) shardAssignableServers() []*ClusterServer {
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, server := range self.servers {
+		if !server.IsDecommissioning() && !server.IsObserver() {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func (self *ClusterConfiguration) observerServers() []*ClusterServer {
+	servers := make([]*ClusterServer, 0)
+	for _, server := range self.servers {
+		if server.IsObserver() {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Adds a server that replicates the data of every shard and serves reads
+// but isn't a raft peer, so it never votes or becomes the leader
+func (self *ClusterConfiguration) AddObserverServer(server *ClusterServer) {
+	self.AddPotentialServer(server)
+	server.State = Observer
+}
+
 func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	self.serversLock.Lock()
 	defer self.serversLock.Unlock()
@@ -260,17 +417,87 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 
 	// if this isn't the local server, connect to it
 	log.Info("Connecting to ProtobufServer: %s from %s", server.ProtobufConnectionString, self.config.ProtobufConnectionString())
+	server.retryPolicy = self.retryPolicy
+	server.hedgePolicy = self.hedgePolicy
 	if server.connection == nil {
 		server.connection = self.connectionCreator(server.ProtobufConnectionString)
 		server.Connect()
 	}
-	writeBuffer := NewWriteBuffer(fmt.Sprintf("%d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize)
+	writeBuffer := self.newServerWriteBuffer(fmt.Sprintf("%d", server.GetId()), server)
 	self.writeBuffers = append(self.writeBuffers, writeBuffer)
 	server.SetWriteBuffer(writeBuffer)
-	server.StartHeartbeat()
+	self.startHeartbeat(server)
 	return
 }
 
+func (self *ClusterConfiguration) newServerWriteBuffer(writerInfo string, server *ClusterServer) *WriteBuffer {
+	writeBuffer := NewWriteBufferWithHandoffLimits(
+		writerInfo,
+		server,
+		self.wal,
+		server.Id,
+		self.config.PerServerWriteBufferSize,
+		self.config.HintedHandoffMaxAge,
+		self.config.HintedHandoffMaxRequests,
+	)
+	writeBuffer.throttle = self.recoveryThrottle
+	if err := writeBuffer.SpillToDisk(self.config.WriteBufferOverflowDir, self.config.WriteBufferOverflowSize); err != nil {
+		log.Error("Cannot create the write buffer overflow of server %d, writes will be replayed from the WAL once its buffer is full: %s", server.Id, err)
+	}
+	metrics.Default.Gauge(metrics.HandoffMetric(server.Id, "pending"), func() int64 {
+		stats := writeBuffer.Stats()
+		return int64(stats.BufferedRequests + stats.OverflowRequests)
+	})
+	metrics.Default.Gauge(metrics.HandoffMetric(server.Id, "dropped"), func() int64 {
+		return int64(writeBuffer.Stats().DroppedRequests)
+	})
+	return writeBuffer
+}
+
+// sets up the connection and write buffer of a remote server that was
+// loaded from a snapshot
+func (self *ClusterConfiguration) connectToServer(server *ClusterServer) {
+	server.connection = self.connectionCreator(server.ProtobufConnectionString)
+	server.retryPolicy = self.retryPolicy
+	server.hedgePolicy = self.hedgePolicy
+	writeBuffer := self.newServerWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server)
+	self.writeBuffers = append(self.writeBuffers, writeBuffer)
+	server.SetWriteBuffer(writeBuffer)
+	server.Connect()
+	self.startHeartbeat(server)
+}
+
+func (self *ClusterConfiguration) startHeartbeat(server *ClusterServer) {
+	server.SetDownReportHandler(self.handleDownReports)
+	server.StartHeartbeat()
+}
+
+// Returns the ids of the remote servers that this server considers
+// down, they're sent along with the heartbeat responses so the other
+// servers find out about failures sooner.
+func (self *ClusterConfiguration) DownServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	ids := make([]uint32, 0)
+	for _, server := range self.servers {
+		if server != self.LocalServer && !server.IsUp() {
+			ids = append(ids, server.Id)
+		}
+	}
+	return ids
+}
+
+func (self *ClusterConfiguration) handleDownReports(reporter *ClusterServer, downServerIds []uint32) {
+	for _, id := range downServerIds {
+		if self.LocalServer != nil && id == self.LocalServer.Id {
+			continue
+		}
+		if server := self.GetServerById(&id); server != nil {
+			server.ReportedDown(reporter)
+		}
+	}
+}
+
 func (self *ClusterConfiguration) DatabasesExists(db string) bool {
 	self.createDatabaseLock.RLock()
 	defer self.createDatabaseLock.RUnlock()
@@ -318,6 +545,10 @@ func (self *ClusterConfiguration) DropDatabase(name string) error {
 	}
 
 	delete(self.DatabaseReplicationFactors, name)
+	delete(self.writeConsistency, name)
+	delete(self.databaseRetention, name)
+	delete(self.readOnlyDatabases, name)
+	delete(self.maxSeries, name)
 
 	self.continuousQueriesLock.Lock()
 	defer self.continuousQueriesLock.Unlock()
@@ -331,6 +562,34 @@ func (self *ClusterConfiguration) DropDatabase(name string) error {
 	return nil
 }
 
+func (self *ClusterConfiguration) SetWriteConsistency(db string, consistency string) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+
+	level, err := ParseWriteConsistency(consistency)
+	if err != nil {
+		return err
+	}
+	self.writeConsistency[db] = level
+	return nil
+}
+
+// Returns the write consistency of the given database, or the default
+// one from the configuration if it wasn't set for the database
+func (self *ClusterConfiguration) GetWriteConsistency(db string) WriteConsistency {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	if level, ok := self.writeConsistency[db]; ok {
+		return level
+	}
+	return self.defaultWriteConsistency
+}
+
 func (self *ClusterConfiguration) CreateContinuousQuery(db string, query string) error {
 	self.continuousQueriesLock.Lock()
 	defer self.continuousQueriesLock.Unlock()
@@ -513,6 +772,22 @@ type SavedConfiguration struct {
 	ShortTermShards   []*NewShardData
 	LongTermShards    []*NewShardData
 	ContinuousQueries map[string][]*ContinuousQuery
+	WriteConsistency  map[string]string
+	DatabaseRetention map[string]time.Duration
+	ReadOnly          bool
+	ReadOnlyDatabases map[string]bool
+	MaxSeries         map[string]int
+	// zero if it was never changed from the one in the config file
+	ReplicationFactor int
+	// same as above
+	ShortTermShardDuration time.Duration
+	LongTermShardDuration  time.Duration
+	ReplicationTargets     map[string]*ReplicationTarget
+	Tombstones             []*Tombstone
+	LastTombstoneId        uint32
+	ShardLeases            []*ShardLease
+	// the settings changed at runtime, by name
+	RuntimeSettings map[string]string
 }
 
 func (self *ClusterConfiguration) Save() ([]byte, error) {
@@ -525,12 +800,65 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 		ContinuousQueries: self.continuousQueries,
 		ShortTermShards:   self.convertShardsToNewShardData(self.shortTermShards),
 		LongTermShards:    self.convertShardsToNewShardData(self.longTermShards),
+		WriteConsistency:  make(map[string]string, len(self.writeConsistency)),
+		DatabaseRetention: make(map[string]time.Duration, len(self.databaseRetention)),
+		ReadOnly:          self.readOnly,
+		ReadOnlyDatabases: make(map[string]bool, len(self.readOnlyDatabases)),
+		MaxSeries:         make(map[string]int, len(self.maxSeries)),
+	}
+
+	if self.replicationFactor != self.config.ReplicationFactor {
+		data.ReplicationFactor = self.replicationFactor
+	}
+	if self.shortTermShardDuration != *self.config.ShortTermShard.ParsedDuration() {
+		data.ShortTermShardDuration = self.shortTermShardDuration
+	}
+	if self.longTermShardDuration != *self.config.LongTermShard.ParsedDuration() {
+		data.LongTermShardDuration = self.longTermShardDuration
 	}
 
 	for k, _ := range self.DatabaseReplicationFactors {
 		data.Databases[k] = 0
 	}
 
+	for k, v := range self.writeConsistency {
+		data.WriteConsistency[k] = v.String()
+	}
+	for k, v := range self.databaseRetention {
+		data.DatabaseRetention[k] = v
+	}
+	for k, v := range self.readOnlyDatabases {
+		data.ReadOnlyDatabases[k] = v
+	}
+	for k, v := range self.maxSeries {
+		data.MaxSeries[k] = v
+	}
+
+	self.replicationTargetsLock.RLock()
+	data.ReplicationTargets = make(map[string]*ReplicationTarget, len(self.replicationTargets))
+	for k, v := range self.replicationTargets {
+		data.ReplicationTargets[k] = v
+	}
+	self.replicationTargetsLock.RUnlock()
+
+	self.tombstonesLock.RLock()
+	data.Tombstones = self.tombstones
+	data.LastTombstoneId = self.lastTombstoneId
+	self.tombstonesLock.RUnlock()
+
+	self.shardLeasesLock.RLock()
+	for _, lease := range self.shardLeases {
+		data.ShardLeases = append(data.ShardLeases, lease)
+	}
+	self.shardLeasesLock.RUnlock()
+
+	self.runtimeSettingsLock.RLock()
+	data.RuntimeSettings = make(map[string]string, len(self.runtimeSettings))
+	for name, value := range self.runtimeSettings {
+		data.RuntimeSettings[name] = value
+	}
+	self.runtimeSettingsLock.RUnlock()
+
 	b := bytes.NewBuffer(nil)
 	err := gob.NewEncoder(b).Encode(&data)
 	if err != nil {
@@ -555,7 +883,7 @@ func (self *ClusterConfiguration) convertNewShardDataToShards(newShards []*NewSh
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range newShard.ServerIds {
 			if serverId == self.LocalServer.Id {
-				err := shard.SetLocalStore(self.shardStore, self.LocalServer.Id)
+				err := self.setLocalStore(shard)
 				if err != nil {
 					log.Error("CliusterConfig convertNewShardDataToShards: ", err)
 				}
@@ -570,13 +898,21 @@ func (self *ClusterConfiguration) convertNewShardDataToShards(newShards []*NewSh
 	return shards
 }
 
-func (self *ClusterConfiguration) Recovery(b []byte) error {
-	log.Info("Recovering the cluster configuration")
+// Decodes a snapshot of the cluster configuration returned by Save
+func DecodeSavedConfiguration(b []byte) (*SavedConfiguration, error) {
 	data := &SavedConfiguration{}
-
 	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data)
 	if err != nil {
 		log.Error("Error while decoding snapshot: %s", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (self *ClusterConfiguration) Recovery(b []byte) error {
+	log.Info("Recovering the cluster configuration")
+	data, err := DecodeSavedConfiguration(b)
+	if err != nil {
 		return err
 	}
 
@@ -584,6 +920,34 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 	for k, _ := range data.Databases {
 		self.DatabaseReplicationFactors[k] = struct{}{}
 	}
+	self.writeConsistency = make(map[string]WriteConsistency, len(data.WriteConsistency))
+	for k, v := range data.WriteConsistency {
+		level, err := ParseWriteConsistency(v)
+		if err != nil {
+			log.Error("Cannot recover write consistency of %s: %s", k, err)
+			continue
+		}
+		self.writeConsistency[k] = level
+	}
+	self.databaseRetention = make(map[string]time.Duration, len(data.DatabaseRetention))
+	for k, v := range data.DatabaseRetention {
+		self.databaseRetention[k] = v
+	}
+	self.readOnly = data.ReadOnly
+	self.readOnlyDatabases = make(map[string]bool, len(data.ReadOnlyDatabases))
+	for k, v := range data.ReadOnlyDatabases {
+		self.readOnlyDatabases[k] = v
+	}
+	self.maxSeries = make(map[string]int, len(data.MaxSeries))
+	for k, v := range data.MaxSeries {
+		self.maxSeries[k] = v
+	}
+	if data.ReplicationFactor > 0 {
+		self.replicationFactor = data.ReplicationFactor
+	}
+	self.restoreShardDurations(data)
+	self.restoreReplicationTargets(data)
+	self.restoreRuntimeSettings(data)
 	self.clusterAdmins = data.Admins
 	self.dbUsers = data.DbUsers
 	self.servers = data.Servers
@@ -597,12 +961,7 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 			continue
 		}
 
-		server.connection = self.connectionCreator(server.ProtobufConnectionString)
-		writeBuffer := NewWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize)
-		self.writeBuffers = append(self.writeBuffers, writeBuffer)
-		server.SetWriteBuffer(writeBuffer)
-		server.Connect()
-		server.StartHeartbeat()
+		self.connectToServer(server)
 	}
 
 	self.shardsByIdLock.Lock()
@@ -626,9 +985,22 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		}
 	}
 
+	self.restoreTombstones(data)
+	self.restoreShardLeases(data)
 	return nil
 }
 
+func (self *ClusterConfiguration) restoreShardDurations(data *SavedConfiguration) {
+	self.shortTermShardDuration = *self.config.ShortTermShard.ParsedDuration()
+	if data.ShortTermShardDuration > 0 {
+		self.shortTermShardDuration = data.ShortTermShardDuration
+	}
+	self.longTermShardDuration = *self.config.LongTermShard.ParsedDuration()
+	if data.LongTermShardDuration > 0 {
+		self.longTermShardDuration = data.LongTermShardDuration
+	}
+}
+
 func (self *ClusterConfiguration) AuthenticateDbUser(db, username, password string) (common.User, error) {
 	dbUsers := self.dbUsers[db]
 	if dbUsers == nil || dbUsers[username] == nil {
@@ -681,6 +1053,7 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	//	split := self.config.ShortTermShard.Split
 	hasRandomSplit := self.config.ShortTermShard.HasRandomSplit()
 	splitRegex := self.config.ShortTermShard.SplitRegex()
+	partitioner := self.shortTermPartitioner
 	shardType := SHORT_TERM
 
 	firstChar := series[0]
@@ -690,6 +1063,7 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 		//		split = self.config.LongTermShard.Split
 		hasRandomSplit = self.config.LongTermShard.HasRandomSplit()
 		splitRegex = self.config.LongTermShard.SplitRegex()
+		partitioner = self.longTermPartitioner
 	}
 	matchingShards := make([]*ShardData, 0)
 	for _, s := range shards {
@@ -701,13 +1075,23 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 		}
 	}
 
-	var err error
 	if len(matchingShards) == 0 {
 		log.Info("No matching shards for write at time %du, creating...", microsecondsEpoch)
-		matchingShards, err = self.createShards(microsecondsEpoch, shardType)
+		createdShards, err := self.createShards(microsecondsEpoch, shardType)
 		if err != nil {
 			return nil, err
 		}
+		// the leader returns the shards that already exist if another
+		// server created shards for this time first, with a different
+		// duration they may not include the time of the write
+		for _, s := range createdShards {
+			if s.IsMicrosecondInRange(microsecondsEpoch) {
+				matchingShards = append(matchingShards, s)
+			}
+		}
+		if len(matchingShards) == 0 {
+			return nil, fmt.Errorf("The shards for time %du were created with a different duration concurrently, retry the write", microsecondsEpoch)
+		}
 	}
 
 	if len(matchingShards) == 1 {
@@ -717,24 +1101,31 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	if hasRandomSplit && splitRegex.MatchString(series) {
 		return matchingShards[self.random.Intn(len(matchingShards))], nil
 	}
-	index := HashDbAndSeriesToInt(db, series)
-	index = index % len(matchingShards)
-	return matchingShards[index], nil
+	// the shards of a period are sorted by id so that every server maps
+	// the series to the same shard
+	sort.Sort(shardsById(matchingShards))
+	return matchingShards[partitioner.Partition(db, series, len(matchingShards))], nil
 }
 
 func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardType ShardType) ([]*ShardData, error) {
 	numberOfShardsToCreateForDuration := 1
-	var secondsOfDuration float64
+	existingShards := self.shortTermShards
 	if shardType == LONG_TERM {
 		numberOfShardsToCreateForDuration = self.config.LongTermShard.Split
-		secondsOfDuration = self.config.LongTermShard.ParsedDuration().Seconds()
+		existingShards = self.longTermShards
 	} else {
 		numberOfShardsToCreateForDuration = self.config.ShortTermShard.Split
-		secondsOfDuration = self.config.ShortTermShard.ParsedDuration().Seconds()
 	}
+	secondsOfDuration := self.GetShardDuration(shardType).Seconds()
+	servers := self.shardAssignableServers()
+	if len(servers) == 0 {
+		return nil, errors.New("There are no servers to assign new shards to")
+	}
+	observers := self.observerServers()
+
 	startIndex := 0
 	if self.lastServerToGetShard != nil {
-		for i, server := range self.servers {
+		for i, server := range servers {
 			if server == self.lastServerToGetShard {
 				startIndex = i + 1
 			}
@@ -743,6 +1134,7 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 
 	shards := make([]*NewShardData, 0)
 	startTime, endTime := self.getStartAndEndBasedOnDuration(microsecondsEpoch, secondsOfDuration)
+	startTime, endTime = clipShardWindow(existingShards, microsecondsEpoch, startTime, endTime)
 
 	log.Info("createShards: start: %s. end: %s",
 		startTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"), endTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
@@ -750,20 +1142,14 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 	for i := numberOfShardsToCreateForDuration; i > 0; i-- {
 		serverIds := make([]uint32, 0)
 
-		// if they have the replication factor set higher than the number of servers in the cluster, limit it
-		rf := self.config.ReplicationFactor
-		if rf > len(self.servers) {
-			rf = len(self.servers)
-		}
-
-		for rf = rf; rf > 0; rf-- {
-			if startIndex >= len(self.servers) {
-				startIndex = 0
-			}
-			server := self.servers[startIndex]
+		var picked []*ClusterServer
+		picked, startIndex = pickShardServers(servers, startIndex, self.GetReplicationFactor())
+		for _, server := range picked {
 			self.lastServerToGetShard = server
 			serverIds = append(serverIds, server.Id)
-			startIndex += 1
+		}
+		for _, observer := range observers {
+			serverIds = append(serverIds, observer.Id)
 		}
 		shards = append(shards, &NewShardData{StartTime: *startTime, EndTime: *endTime, ServerIds: serverIds, Type: shardType})
 	}
@@ -780,6 +1166,17 @@ func (self *ClusterConfiguration) CreateCheckpoint() error {
 	return self.wal.CreateCheckpoint()
 }
 
+// Returns the stats of the wal of this server
+func (self *ClusterConfiguration) WalStats() *wal.Stats {
+	return self.wal.Stats()
+}
+
+// Returns the wal of this server, it only logs the writes this server
+// received
+func (self *ClusterConfiguration) GetWal() WAL {
+	return self.wal
+}
+
 func (self *ClusterConfiguration) getStartAndEndBasedOnDuration(microsecondsEpoch int64, duration float64) (*time.Time, *time.Time) {
 	startTimeSeconds := math.Floor(float64(microsecondsEpoch)/1000.0/1000.0/duration) * duration
 	startTime := time.Unix(int64(startTimeSeconds), 0)
@@ -788,6 +1185,21 @@ func (self *ClusterConfiguration) getStartAndEndBasedOnDuration(microsecondsEpoc
 	return &startTime, &endTime
 }
 
+// After the shard duration changed the window of a new shard can overlap
+// the shards that were created with the old duration. The window is cut
+// down to the gap between the existing shards around the given time.
+func clipShardWindow(shards []*ShardData, microsecondsEpoch int64, startTime, endTime *time.Time) (*time.Time, *time.Time) {
+	for _, shard := range shards {
+		if shard.endMicro <= microsecondsEpoch && shard.endTime.After(*startTime) {
+			startTime = &shard.endTime
+		}
+		if shard.startMicro > microsecondsEpoch && shard.startTime.Before(*endTime) {
+			endTime = &shard.startTime
+		}
+	}
+	return startTime, endTime
+}
+
 func (self *ClusterConfiguration) GetShards(querySpec *parser.QuerySpec) []*ShardData {
 	self.shardsByIdLock.RLock()
 	defer self.shardsByIdLock.RUnlock()
@@ -904,8 +1316,10 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 		existingShards = self.longTermShards
 	}
 
+	// another server may have created shards for this time first, with a
+	// different duration if it was changed in between
 	for _, s := range existingShards {
-		if s.startTime.Unix() == startTime.Unix() && s.endTime.Unix() == endTime.Unix() {
+		if s.startTime.Before(endTime) && s.endTime.After(startTime) {
 			createdShards = append(createdShards, s)
 		}
 	}
@@ -925,7 +1339,7 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 			// server can't be one of the servers the shard belongs to,
 			// since the shard was created before the server existed
 			if self.LocalServer != nil && serverId == self.LocalServer.Id {
-				err := shard.SetLocalStore(self.shardStore, self.LocalServer.Id)
+				err := self.setLocalStore(shard)
 				if err != nil {
 					log.Error("AddShards: error setting local store: ", err)
 					return nil, err
@@ -969,7 +1383,7 @@ func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewS
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range s.ServerIds {
 			if serverId == self.LocalServer.Id {
-				err := shard.SetLocalStore(self.shardStore, self.LocalServer.Id)
+				err := self.setLocalStore(shard)
 				if err != nil {
 					log.Error("AddShards: error setting local store: ", err)
 					return nil, err
@@ -996,14 +1410,23 @@ func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
 	if shard == nil {
 		shard = NewShard(id, time.Now(), time.Now(), LONG_TERM, false, self.wal)
 		shard.SetServers([]*ClusterServer{})
-		shard.SetLocalStore(self.shardStore, self.LocalServer.Id)
+		self.setLocalStore(shard)
 	}
 	return shard
 }
 
+func (self *ClusterConfiguration) setLocalStore(shard *ShardData) error {
+	shard.SetReadPreference(self.LocalServer, self.config.PreferLocalReads)
+	shard.tombstones = self
+	shard.throttle = self.recoveryThrottle
+	return shard.SetLocalStore(self.shardStore, self.LocalServer.Id)
+}
+
 func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32) error {
 	// take it out of the memory map so writes and queries stop going to it
 	self.updateOrRemoveShard(shardId, serverIds)
+	self.pruneTombstones()
+	self.pruneShardLeases()
 
 	// now actually remove it from disk if it lives here
 	for _, serverId := range serverIds {
@@ -1014,11 +1437,176 @@ func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32)
 	return nil
 }
 
-func (self *ClusterConfiguration) RecoverFromWAL() error {
+// Adds a replica of the shard on the given server. The new replica
+// starts receiving writes right away, the existing data has to be
+// copied over with CopyShard.
+func (self *ClusterConfiguration) AddShardReplica(shardId, serverId uint32) error {
+	shard := self.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Cannot find shard %d", shardId)
+	}
+	if shard.HasServer(serverId) {
+		return nil
+	}
+
+	self.shardsByIdLock.Lock()
+	defer self.shardsByIdLock.Unlock()
+	if self.LocalServer != nil && serverId == self.LocalServer.Id {
+		return self.setLocalStore(shard)
+	}
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", serverId)
+	}
+	shard.AddServer(server)
+	return nil
+}
+
+// Returns the shard with the given id or nil if it doesn't exist
+func (self *ClusterConfiguration) GetShard(shardId uint32) *ShardData {
+	self.shardsByIdLock.RLock()
+	defer self.shardsByIdLock.RUnlock()
+	return self.shardsById[shardId]
+}
+
+// Returns the server that should get a new replica of the given shard,
+// that's the server with the fewest shards that doesn't have a copy of
+// the shard yet and isn't being decommissioned. Servers in a failure
+// domain that doesn't have a replica of the shard yet come first.
+func (self *ClusterConfiguration) PickReplicaTarget(shard *ShardData) *ClusterServer {
+	domains := self.replicaFailureDomains(shard.serverIds, 0)
+	var target *ClusterServer
+	targetShards := 0
+	targetDomainTaken := false
+	for _, server := range self.shardAssignableServers() {
+		if shard.HasServer(server.Id) {
+			continue
+		}
+		count := len(self.shardIdsForServerId(server.Id))
+		domainTaken := server.FailureDomain != "" && domains[server.FailureDomain]
+		if target == nil || (targetDomainTaken && !domainTaken) || (domainTaken == targetDomainTaken && count < targetShards) {
+			target = server
+			targetShards = count
+			targetDomainTaken = domainTaken
+		}
+	}
+	return target
+}
+
+// Returns the servers whose replicas of the shard should be dropped to
+// get rid of count replicas, those are the servers with the most shards
+func (self *ClusterConfiguration) PickReplicasToDrop(shard *ShardData, count int) []uint32 {
+	serverIds := append([]uint32{}, shard.serverIds...)
+	shardCounts := make(map[uint32]int, len(serverIds))
+	for _, id := range serverIds {
+		shardCounts[id] = len(self.shardIdsForServerId(id))
+	}
+	sort.Sort(&serverIdsByShardCount{serverIds, shardCounts})
+	if count > len(serverIds) {
+		count = len(serverIds)
+	}
+	return serverIds[:count]
+}
+
+// sorts server ids by descending number of shards
+type serverIdsByShardCount struct {
+	ids    []uint32
+	counts map[uint32]int
+}
+
+func (self *serverIdsByShardCount) Len() int {
+	return len(self.ids)
+}
+
+func (self *serverIdsByShardCount) Swap(i, j int) {
+	self.ids[i], self.ids[j] = self.ids[j], self.ids[i]
+}
+
+func (self *serverIdsByShardCount) Less(i, j int) bool {
+	return self.counts[self.ids[i]] > self.counts[self.ids[j]]
+}
+
+// Returns the ids of the shards that have a replica on the given server
+func (self *ClusterConfiguration) ShardIdsForServer(serverId uint32) []uint32 {
+	return self.shardIdsForServerId(serverId)
+}
+
+// Repairs the local copy of the given shard against the other servers
+// that have a copy of it, for every database. Returns the number of
+// ranges that had to be copied.
+func (self *ClusterConfiguration) RepairShard(shardId uint32, user common.User) (int, error) {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[shardId]
+	self.shardsByIdLock.RUnlock()
+
+	if shard == nil || !shard.IsLocal {
+		return 0, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+
+	repaired := 0
+	for _, database := range self.GetDatabases() {
+		count, err := shard.Repair(database.Name, user, DEFAULT_REPAIR_RANGES)
+		repaired += count
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// called by the server, this will periodically repair all the shards
+// that are stored on this server if anti entropy is enabled
+func (self *ClusterConfiguration) PeriodicallyRepairShards() {
+	interval := self.config.AntiEntropyInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			names := self.GetClusterAdmins()
+			if len(names) == 0 {
+				continue
+			}
+			user := self.GetClusterAdmin(names[0])
+			for _, shard := range self.GetAllShards() {
+				if !shard.IsLocal {
+					continue
+				}
+				count, err := self.RepairShard(shard.Id(), user)
+				if err != nil {
+					log.Error("Error while repairing shard %d: %s", shard.Id(), err)
+					continue
+				}
+				if count > 0 {
+					log.Info("Repaired %d ranges of shard %d", count, shard.Id())
+				}
+			}
+		}
+	}()
+}
+
+// Replays the requests of the wal the servers didn't commit, returns how
+// many requests were replayed to each server
+func (self *ClusterConfiguration) RecoverFromWAL() (map[uint32]int, error) {
 	writeBuffer := NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServer.Id, self.config.LocalStoreWriteBufferSize)
 	self.writeBuffers = append(self.writeBuffers, writeBuffer)
 	self.shardStore.SetWriteBuffer(writeBuffer)
+	pool := newWalReplayPool(self.config.WalReplayConcurrency)
+	defer pool.close()
 	var waitForAll sync.WaitGroup
+	var replayedLock sync.Mutex
+	replayed := map[uint32]int{}
+	replay := func(serverId uint32, writer Writer) {
+		count, err := self.recover(serverId, writer, pool)
+		if err != nil {
+			log.Error("Error while replaying the wal to server %d: %s", serverId, err)
+		}
+		replayedLock.Lock()
+		replayed[serverId] = count
+		replayedLock.Unlock()
+	}
 	for _, _server := range self.servers {
 		server := _server
 		waitForAll.Add(1)
@@ -1026,7 +1614,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 			self.LocalServer = server
 			go func(serverId uint32) {
 				log.Info("Recovering local server")
-				self.recover(serverId, self.shardStore)
+				replay(serverId, self.shardStore)
 				log.Info("Recovered local server")
 				waitForAll.Done()
 			}(server.Id)
@@ -1037,7 +1625,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 					server.Connect()
 				}
 				log.Info("Recovering remote server %d", serverId)
-				self.recover(serverId, server)
+				replay(serverId, server)
 				log.Info("Recovered remote server %d", serverId)
 				waitForAll.Done()
 			}(server.Id)
@@ -1045,31 +1633,52 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 	}
 	log.Info("Waiting for servers to recover")
 	waitForAll.Wait()
-	return nil
+	return replayed, nil
 }
 
-func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error {
+// Replays the wal to the server, returns the number of requests that
+// were replayed
+func (self *ClusterConfiguration) recover(serverId uint32, writer Writer, pool *walReplayPool) (int, error) {
 	shardIds := self.shardIdsForServerId(serverId)
 	if len(shardIds) == 0 {
 		log.Info("No shards to recover for %d", serverId)
-		return nil
+		return 0, nil
 	}
 
 	log.Debug("replaying wal for server %d and shardIds %#v", serverId, shardIds)
-	return self.wal.RecoverServerFromLastCommit(serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
+	// the requests of different shards are written concurrently, so a
+	// request number is only committed once every request before it
+	// was written
+	replay := &serverReplay{}
+	var lastRequestNumber uint32
+	replayed := 0
+	err := self.wal.RecoverServerFromLastCommit(serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
 		if request == nil {
 			log.Error("Error on recover, the wal yielded a nil request")
 			return nil
 		}
-		requestNumber := request.GetRequestNumber()
 		log.Debug("Sending request %s for shard %d to server %d", request.GetDescription(), shardId, serverId)
-		err := writer.Write(request)
-		if err != nil {
+		if err := pool.write(replay, writer, shardId, request); err != nil {
+			return err
+		}
+		lastRequestNumber = request.GetRequestNumber()
+		replayed++
+		if replayed%WAL_REPLAY_COMMIT_INTERVAL != 0 {
+			return nil
+		}
+		if err := replay.flush(); err != nil {
 			return err
 		}
-		log.Debug("Finished sending request %d to server %d", request.GetRequestNumber(), serverId)
-		return self.wal.Commit(requestNumber, serverId)
+		return self.wal.Commit(lastRequestNumber, serverId)
 	})
+	if flushErr := replay.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil || replayed%WAL_REPLAY_COMMIT_INTERVAL == 0 {
+		return replayed, err
+	}
+	log.Debug("Finished sending %d requests to server %d", replayed, serverId)
+	return replayed, self.wal.Commit(lastRequestNumber, serverId)
 }
 
 func (self *ClusterConfiguration) shardIdsForServerId(serverId uint32) []uint32 {
@@ -1109,20 +1718,7 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 	}
 	self.shardsByIdLock.Lock()
 	defer self.shardsByIdLock.Unlock()
-	newIds := make([]uint32, 0)
-	for _, oldId := range shard.serverIds {
-		include := true
-		for _, removeId := range serverIds {
-			if oldId == removeId {
-				include = false
-				break
-			}
-		}
-		if include {
-			newIds = append(newIds, oldId)
-		}
-	}
-	shard.serverIds = newIds
+	shard.RemoveServers(serverIds)
 }
 
 func (self *ClusterConfiguration) removeShard(shardId uint32) {
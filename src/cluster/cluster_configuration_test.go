@@ -0,0 +1,302 @@
+package cluster
+
+import (
+	"configuration"
+	p "protocol"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ClusterConfigurationSuite struct{}
+
+var _ = Suite(&ClusterConfigurationSuite{})
+
+type recordingShardCreator struct {
+	created []*NewShardData
+}
+
+func (self *recordingShardCreator) CreateShards(shards []*NewShardData) ([]*ShardData, error) {
+	self.created = append(self.created, shards...)
+	return nil, nil
+}
+
+func (self *ClusterConfigurationSuite) TestFutureShardsAreCreatedWithinTheLeadTime(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard:         &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:          &configuration.ShardConfiguration{Split: 1},
+		ReplicationFactor:      1,
+		ShardPrecreateLeadTime: time.Hour,
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	clusterConfig.shortTermShardDuration = time.Hour
+	clusterConfig.servers = []*ClusterServer{&ClusterServer{Id: 1}}
+	creator := &recordingShardCreator{}
+	clusterConfig.SetShardCreator(creator)
+
+	now := time.Now()
+	shards := []*ShardData{NewShard(1, now.Add(-time.Hour), now.Add(2*time.Hour), SHORT_TERM, false, nil)}
+	clusterConfig.automaticallyCreateFutureShard(shards, SHORT_TERM, now)
+	c.Assert(creator.created, HasLen, 0)
+
+	// within an hour of the end of the latest shard
+	clusterConfig.automaticallyCreateFutureShard(shards, SHORT_TERM, now.Add(90*time.Minute))
+	c.Assert(creator.created, HasLen, 1)
+	c.Assert(creator.created[0].StartTime.After(now.Add(time.Hour)), Equals, true)
+
+	// nothing is created once the latest shard is in the past
+	clusterConfig.automaticallyCreateFutureShard(shards, SHORT_TERM, now.Add(3*time.Hour))
+	c.Assert(creator.created, HasLen, 1)
+}
+
+func (self *ClusterConfigurationSuite) TestReplicasAreSpreadOverFailureDomains(c *C) {
+	servers := []*ClusterServer{
+		&ClusterServer{Id: 1, FailureDomain: "a"},
+		&ClusterServer{Id: 2, FailureDomain: "a"},
+		&ClusterServer{Id: 3, FailureDomain: "b"},
+		&ClusterServer{Id: 4, FailureDomain: "b"},
+	}
+	picked, next := pickShardServers(servers, 0, 2)
+	c.Assert(picked, DeepEquals, []*ClusterServer{servers[0], servers[2]})
+	c.Assert(next, Equals, 3)
+
+	picked, next = pickShardServers(servers, next, 2)
+	c.Assert(picked, DeepEquals, []*ClusterServer{servers[3], servers[0]})
+	c.Assert(next, Equals, 1)
+
+	// with more replicas than domains the domains get a second replica
+	picked, _ = pickShardServers(servers, 0, 3)
+	c.Assert(picked, DeepEquals, []*ClusterServer{servers[0], servers[2], servers[1]})
+}
+
+func (self *ClusterConfigurationSuite) TestShardLeasesAreExclusiveUntilTheyRunOut(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:  &configuration.ShardConfiguration{Split: 1},
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	now := time.Now()
+
+	lease, err := clusterConfig.AcquireShardLease(1, 1, now, now.Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(lease.ServerId, Equals, uint32(1))
+	_, err = clusterConfig.AcquireShardLease(1, 2, now.Add(time.Second), now.Add(time.Minute))
+	c.Assert(err, NotNil)
+
+	// the holder can renew it
+	_, err = clusterConfig.AcquireShardLease(1, 1, now.Add(time.Second), now.Add(2*time.Minute))
+	c.Assert(err, IsNil)
+
+	// another server gets it once it ran out
+	lease, err = clusterConfig.AcquireShardLease(1, 2, now.Add(3*time.Minute), now.Add(4*time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(clusterConfig.GetShardLease(1), DeepEquals, lease)
+	c.Assert(lease.IsValid(now.Add(5*time.Minute)), Equals, false)
+}
+
+type diskShardStore struct {
+	LocalShardStore
+	sizes map[uint32]int64
+}
+
+func (self *diskShardStore) ShardSizes() (map[uint32]int64, error) {
+	return self.sizes, nil
+}
+
+func (self *diskShardStore) DeleteShard(shardId uint32) error {
+	delete(self.sizes, shardId)
+	return nil
+}
+
+func (self *diskShardStore) CompactShard(shardId uint32) error {
+	self.sizes[shardId] /= 2
+	return nil
+}
+
+func (self *ClusterConfigurationSuite) TestOnlyLocalShardsAreCompacted(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:  &configuration.ShardConfiguration{Split: 1},
+	}
+	store := &diskShardStore{sizes: map[uint32]int64{1: 100}}
+	clusterConfig := NewClusterConfiguration(config, nil, store, nil)
+	clusterConfig.LocalServer = &ClusterServer{Id: 1}
+	shard := NewShard(1, time.Now(), time.Now().Add(time.Hour), SHORT_TERM, false, nil)
+	shard.IsLocal = true
+	clusterConfig.shardsById[1] = shard
+
+	before, after, err := clusterConfig.CompactShard(1)
+	c.Assert(err, IsNil)
+	c.Assert(before, Equals, int64(100))
+	c.Assert(after, Equals, int64(50))
+
+	_, _, err = clusterConfig.CompactShard(2)
+	c.Assert(err, NotNil)
+}
+
+func (self *ClusterConfigurationSuite) TestOrphanedShardsAreDeletedAtTheSecondSweep(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:  &configuration.ShardConfiguration{Split: 1},
+	}
+	store := &diskShardStore{sizes: map[uint32]int64{1: 100, 2: 200}}
+	clusterConfig := NewClusterConfiguration(config, nil, store, nil)
+	clusterConfig.LocalServer = &ClusterServer{Id: 1}
+	shard := NewShard(1, time.Now(), time.Now().Add(time.Hour), SHORT_TERM, false, nil)
+	shard.serverIds = []uint32{1}
+	clusterConfig.shardsById[1] = shard
+
+	orphans, err := clusterConfig.LocalOrphanedShards()
+	c.Assert(err, IsNil)
+	c.Assert(orphans, DeepEquals, []*OrphanedShard{&OrphanedShard{ShardId: 2, ServerId: 1, Size: 200}})
+
+	// without delete-orphans the orphans are only reported
+	suspects := clusterConfig.sweepOrphanedShards(map[uint32]bool{2: true}, false)
+	c.Assert(store.sizes, HasLen, 2)
+
+	suspects = clusterConfig.sweepOrphanedShards(map[uint32]bool{}, true)
+	c.Assert(suspects, DeepEquals, map[uint32]bool{2: true})
+	c.Assert(store.sizes, HasLen, 2)
+
+	suspects = clusterConfig.sweepOrphanedShards(suspects, true)
+	c.Assert(suspects, HasLen, 0)
+	c.Assert(store.sizes, DeepEquals, map[uint32]int64{1: 100})
+}
+
+func (self *ClusterConfigurationSuite) TestRuntimeSettingsOverrideTheConfigFile(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard:            &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:             &configuration.ShardConfiguration{Split: 1},
+		ConcurrentShardQueryLimit: 10,
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfig.SetRuntimeSetting("concurrent-shard-query-limit", "0"), NotNil)
+	c.Assert(clusterConfig.SetRuntimeSetting("short-term-retention", "7d"), IsNil)
+	c.Assert(config.ShortTermShard.ParsedRetention(), Equals, 7*24*time.Hour)
+	c.Assert(clusterConfig.GetRuntimeSettings()["long-term-retention"], Equals, "inf")
+
+	saved, err := clusterConfig.Save()
+	c.Assert(err, IsNil)
+	c.Assert(clusterConfig.SetRuntimeSetting("concurrent-shard-query-limit", "2"), IsNil)
+	c.Assert(config.ConcurrentShardQueryLimit, Equals, 2)
+
+	// the settings that weren't changed in the snapshot go back to the
+	// values of the config file
+	c.Assert(clusterConfig.Recovery(saved), IsNil)
+	c.Assert(config.ConcurrentShardQueryLimit, Equals, 10)
+	c.Assert(config.ShortTermShard.ParsedRetention(), Equals, 7*24*time.Hour)
+}
+
+func (self *ClusterConfigurationSuite) TestReloadedFileSettingsDontOverrideTheRuntimeSettings(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard:            &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:             &configuration.ShardConfiguration{Split: 1},
+		ConcurrentShardQueryLimit: 10,
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfig.SetRuntimeSetting("short-term-retention", "7d"), IsNil)
+
+	reloaded := &configuration.Configuration{
+		ShortTermShard:            &configuration.ShardConfiguration{Split: 1, Retention: "30d"},
+		LongTermShard:             &configuration.ShardConfiguration{Split: 1},
+		ConcurrentShardQueryLimit: 20,
+	}
+	c.Assert(clusterConfig.ReloadFileSettings(reloaded), DeepEquals, []string{"short-term-retention"})
+	c.Assert(config.ConcurrentShardQueryLimit, Equals, 20)
+	c.Assert(config.ShortTermShard.ParsedRetention(), Equals, 7*24*time.Hour)
+
+	// the reloaded file is the one the settings go back to
+	saved, err := clusterConfig.Save()
+	c.Assert(err, IsNil)
+	c.Assert(clusterConfig.SetRuntimeSetting("concurrent-shard-query-limit", "2"), IsNil)
+	c.Assert(clusterConfig.Recovery(saved), IsNil)
+	c.Assert(config.ConcurrentShardQueryLimit, Equals, 20)
+}
+
+func (self *ClusterConfigurationSuite) TestHeartbeatsRecordTheServerInfo(c *C) {
+	server := &ClusterServer{Id: 2}
+	c.Assert(server.Info(), IsNil)
+
+	now := time.Now()
+	server.recordHeartbeat(&p.Response{
+		BuildVersion:    p.String("0.7.0"),
+		ProtocolVersion: p.Uint32(p.PROTOCOL_VERSION),
+	}, now)
+	c.Assert(server.Info(), DeepEquals, &ServerInfo{
+		BuildVersion:    "0.7.0",
+		ProtocolVersion: p.PROTOCOL_VERSION,
+		DiskFree:        -1,
+		LastHeartbeat:   now,
+	})
+}
+
+func (self *ClusterConfigurationSuite) TestDatabaseRetentionsAreSaved(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:  &configuration.ShardConfiguration{Split: 1},
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfig.SetDatabaseRetention("db1", "30d"), NotNil)
+	c.Assert(clusterConfig.CreateDatabase("db1"), IsNil)
+	c.Assert(clusterConfig.CreateDatabase("db2"), IsNil)
+	c.Assert(clusterConfig.SetDatabaseRetention("db1", "30d"), IsNil)
+	c.Assert(clusterConfig.SetDatabaseRetention("db2", "1h"), IsNil)
+	c.Assert(clusterConfig.SetDatabaseRetention("db2", "inf"), IsNil)
+
+	saved, err := clusterConfig.Save()
+	c.Assert(err, IsNil)
+	recovered := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(recovered.Recovery(saved), IsNil)
+	c.Assert(recovered.GetDatabaseRetentions(), DeepEquals, map[string]time.Duration{"db1": 30 * 24 * time.Hour})
+}
+
+func (self *ClusterConfigurationSuite) TestReadOnlyFlagsAreSaved(c *C) {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{Split: 1},
+		LongTermShard:  &configuration.ShardConfiguration{Split: 1},
+	}
+	clusterConfig := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfig.SetReadOnly("db1", true), NotNil)
+	c.Assert(clusterConfig.CreateDatabase("db1"), IsNil)
+	c.Assert(clusterConfig.CreateDatabase("db2"), IsNil)
+	c.Assert(clusterConfig.SetReadOnly("db1", true), IsNil)
+	c.Assert(clusterConfig.IsReadOnly("db1"), Equals, true)
+	c.Assert(clusterConfig.IsReadOnly("db2"), Equals, false)
+
+	saved, err := clusterConfig.Save()
+	c.Assert(err, IsNil)
+	recovered := NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(recovered.Recovery(saved), IsNil)
+	c.Assert(recovered.GetReadOnlyStatus(), DeepEquals, &ReadOnlyStatus{ReadOnly: false, Databases: []string{"db1"}})
+
+	c.Assert(recovered.SetReadOnly("", true), IsNil)
+	c.Assert(recovered.IsReadOnly("db2"), Equals, true)
+	c.Assert(recovered.DropDatabase("db1"), IsNil)
+	c.Assert(recovered.SetReadOnly("", false), IsNil)
+	c.Assert(recovered.GetReadOnlyStatus(), DeepEquals, &ReadOnlyStatus{ReadOnly: false, Databases: []string{}})
+}
+
+func (self *ClusterConfigurationSuite) TestNewServersCannotTakeTheNameOrAddressOfAServer(c *C) {
+	clusterConfig := NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	clusterConfig.servers = []*ClusterServer{&ClusterServer{
+		Id:                       1,
+		RaftName:                 "0123abcd",
+		RaftConnectionString:     "http://one:8090",
+		ProtobufConnectionString: "one:8099",
+	}}
+
+	server := &NewServer{Name: "4567cdef", RaftConnectionString: "http://two:8090", ProtobufConnectionString: "two:8099"}
+	c.Assert(server.Validate(), IsNil)
+	c.Assert(clusterConfig.CheckNewServer(server), IsNil)
+
+	for _, taken := range []*NewServer{
+		&NewServer{Name: "0123abcd", RaftConnectionString: "http://two:8090", ProtobufConnectionString: "two:8099"},
+		&NewServer{Name: "4567cdef", RaftConnectionString: "http://one:8090", ProtobufConnectionString: "two:8099"},
+		&NewServer{Name: "4567cdef", RaftConnectionString: "http://two:8090", ProtobufConnectionString: "one:8099"},
+	} {
+		c.Assert(clusterConfig.CheckNewServer(taken), NotNil)
+	}
+
+	server.RaftConnectionString = "two:8090"
+	c.Assert(server.Validate(), NotNil)
+}
@@ -2,10 +2,10 @@ package cluster
 
 import (
 	c "configuration"
-	"errors"
 	"fmt"
 	"net"
 	"protocol"
+	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -13,6 +13,9 @@ import (
 
 const (
 	HEARTBEAT_TIMEOUT = 100 * time.Millisecond
+
+	// the weight of a new sample in the moving average of the read latency
+	READ_LATENCY_WEIGHT = 0.2
 )
 
 type ClusterServer struct {
@@ -21,14 +24,25 @@ type ClusterServer struct {
 	State                    ServerState
 	RaftConnectionString     string
 	ProtobufConnectionString string
+	FailureDomain            string
 	connection               ServerConnection
 	HeartbeatInterval        time.Duration
 	Backoff                  time.Duration
 	MinBackoff               time.Duration
 	MaxBackoff               time.Duration
+	PhiThreshold             float64
 	isUp                     bool
 	writeBuffer              *WriteBuffer
 	heartbeatStarted         bool
+	readLatency              time.Duration
+	readLatencyLock          sync.Mutex
+	detector                 *failureDetector
+	downReportHandler        func(reporter *ClusterServer, downServerIds []uint32)
+	retryPolicy              *RetryPolicy
+	hedgePolicy              *HedgePolicy
+	firstResponseLatencies   latencyWindow
+	info                     *ServerInfo
+	infoLock                 sync.Mutex
 }
 
 type ServerConnection interface {
@@ -46,6 +60,10 @@ const (
 	DeletingOldData
 	Running
 	Potential
+	// the server is being drained, no new shards are assigned to it
+	Decommissioning
+	// the server gets a copy of every shard but doesn't vote in raft
+	Observer
 )
 
 func NewClusterServer(raftName, raftConnectionString, protobufConnectionString string, connection ServerConnection, config *c.Configuration) *ClusterServer {
@@ -59,6 +77,7 @@ func NewClusterServer(raftName, raftConnectionString, protobufConnectionString s
 		Backoff:                  config.ProtobufMinBackoff.Duration,
 		MinBackoff:               config.ProtobufMinBackoff.Duration,
 		MaxBackoff:               config.ProtobufMaxBackoff.Duration,
+		PhiThreshold:             config.FailureDetectorThreshold,
 		heartbeatStarted:         false,
 	}
 
@@ -72,13 +91,30 @@ func (self *ClusterServer) StartHeartbeat() {
 
 	self.heartbeatStarted = true
 	self.isUp = true
+	if self.detector == nil {
+		self.detector = newFailureDetector(self.PhiThreshold)
+	}
 	go self.heartbeat()
 }
 
+// Sets the function that's called with the ids of the servers this
+// server reports as down in its heartbeat responses
+func (self *ClusterServer) SetDownReportHandler(handler func(reporter *ClusterServer, downServerIds []uint32)) {
+	self.downReportHandler = handler
+}
+
 func (self *ClusterServer) SetWriteBuffer(writeBuffer *WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
 
+// Returns nil for the local server, which doesn't have a write buffer
+func (self *ClusterServer) WriteBufferStats() *WriteBufferStats {
+	if self.writeBuffer == nil {
+		return nil
+	}
+	return self.writeBuffer.Stats()
+}
+
 func (self *ClusterServer) GetId() uint32 {
 	return self.Id
 }
@@ -97,35 +133,97 @@ func (self *ClusterServer) MakeRequest(request *protocol.Request, responseStream
 	if err != nil {
 		message := err.Error()
 		select {
-		case responseStream <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}:
+		case responseStream <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message, ErrorCode: &connectionErrorCode}:
 		default:
 		}
 		self.markServerAsDown()
 	}
 }
 
+// Sends the write to the server, writes that fail because of the
+// connection are retried according to the retry policy of the server.
+// Writing the same points twice is harmless since they keep their
+// sequence numbers.
 func (self *ClusterServer) Write(request *protocol.Request) error {
+	return self.retryPolicy.Do(fmt.Sprintf("write to server %d", self.Id), func(attempt int) error {
+		if attempt > 1 {
+			// the connection picks a new id
+			request.Id = nil
+		}
+		return self.write(request)
+	})
+}
+
+func (self *ClusterServer) write(request *protocol.Request) error {
 	responseChan := make(chan *protocol.Response, 1)
 	err := self.connection.MakeRequest(request, responseChan)
 	if err != nil {
-		return err
+		return &ConnectionError{err.Error()}
 	}
 	log.Debug("Waiting for response to %d", request.GetRequestNumber())
-	response := <-responseChan
-	if response.ErrorMessage != nil {
-		return errors.New(*response.ErrorMessage)
-	}
-	return nil
+	return responseError(<-responseChan)
 }
 
 func (self *ClusterServer) BufferWrite(request *protocol.Request) {
 	self.writeBuffer.Write(request)
 }
 
+func (self *ClusterServer) BufferWriteWithAck(request *protocol.Request, ack chan<- error) {
+	self.writeBuffer.WriteWithAck(request, ack)
+}
+
 func (self *ClusterServer) IsUp() bool {
 	return self.isUp
 }
 
+// Returns the suspicion level of the failure detector that the server is
+// down, 0 if the heartbeat isn't running
+func (self *ClusterServer) Phi() float64 {
+	if self.detector == nil {
+		return 0
+	}
+	return self.detector.phi(time.Now())
+}
+
+// Called when another server reports this one as down. The server is
+// marked as down right away if it already missed some heartbeats,
+// instead of waiting for the failure detector to reach its threshold.
+func (self *ClusterServer) ReportedDown(reporter *ClusterServer) {
+	if !self.isUp || self.detector == nil || !self.detector.isSuspected(time.Now()) {
+		return
+	}
+	log.Warn("Server marked as down. Server %d reported server %d - %s as down", reporter.Id, self.Id, self.ProtobufConnectionString)
+	self.markServerAsDown()
+}
+
+func (self *ClusterServer) IsDecommissioning() bool {
+	return self.State == Decommissioning
+}
+
+func (self *ClusterServer) IsObserver() bool {
+	return self.State == Observer
+}
+
+// Adds the time it took the server to answer a shard query to the
+// moving average that's used to pick the replica to read from
+func (self *ClusterServer) RecordReadLatency(latency time.Duration) {
+	self.readLatencyLock.Lock()
+	defer self.readLatencyLock.Unlock()
+	if self.readLatency == 0 {
+		self.readLatency = latency
+		return
+	}
+	self.readLatency = time.Duration(READ_LATENCY_WEIGHT*float64(latency) + (1-READ_LATENCY_WEIGHT)*float64(self.readLatency))
+}
+
+// Returns the moving average of the read latency, or 0 if the server
+// hasn't been read from yet
+func (self *ClusterServer) ReadLatency() time.Duration {
+	self.readLatencyLock.Lock()
+	defer self.readLatencyLock.Unlock()
+	return self.readLatency
+}
+
 // private methods
 
 var HEARTBEAT_TYPE = protocol.Request_HEARTBEAT
@@ -145,46 +243,60 @@ func (self *ClusterServer) heartbeat() {
 			Database: protocol.String(""),
 		}
 		self.MakeRequest(heartbeatRequest, responseChan)
-		err := self.getHeartbeatResponse(responseChan)
+		response, err := self.getHeartbeatResponse(responseChan)
 		if err != nil {
 			self.handleHeartbeatError(err)
 			continue
 		}
 
+		self.detector.heartbeat(time.Now())
+		self.recordHeartbeat(response, time.Now())
 		if !self.isUp {
 			log.Warn("Server marked as up. Hearbeat succeeded")
 		}
 		// otherwise, reset the backoff and mark the server as up
 		self.isUp = true
+		if len(response.DownServerIds) > 0 && self.downReportHandler != nil {
+			self.downReportHandler(self, response.DownServerIds)
+		}
 		self.Backoff = self.MinBackoff
 		time.Sleep(self.HeartbeatInterval)
 	}
 }
 
-func (self *ClusterServer) getHeartbeatResponse(responseChan <-chan *protocol.Response) error {
+func (self *ClusterServer) getHeartbeatResponse(responseChan <-chan *protocol.Response) (*protocol.Response, error) {
 	select {
 	case response := <-responseChan:
 		if response.ErrorMessage != nil {
-			return fmt.Errorf("Server %d returned error to heartbeat: %s", self.Id, *response.ErrorMessage)
+			return nil, fmt.Errorf("Server %d returned error to heartbeat: %s", self.Id, *response.ErrorMessage)
 		}
 
 		if *response.Type != protocol.Response_HEARTBEAT {
-			return fmt.Errorf("Server returned a non heartbeat response")
+			return nil, fmt.Errorf("Server returned a non heartbeat response")
 		}
+		return response, nil
 
 	case <-time.After(self.HeartbeatInterval):
-		return fmt.Errorf("Server failed to return heartbeat in %s: %d", self.HeartbeatInterval, self.Id)
+		return nil, fmt.Errorf("Server failed to return heartbeat in %s: %d", self.HeartbeatInterval, self.Id)
 	}
-
-	return nil
 }
 
 func (self *ClusterServer) markServerAsDown() {
 	self.isUp = false
+	if self.detector != nil {
+		self.detector.reset()
+	}
 	self.connection.ClearRequests()
 }
 
 func (self *ClusterServer) handleHeartbeatError(err error) {
+	// a late heartbeat isn't enough to mark the server as down, keep
+	// checking until the failure detector gives up on it
+	if self.isUp && self.detector.isAvailable(time.Now()) {
+		log.Debug("Heartbeat error for server: %d, phi: %f. %s", self.Id, self.detector.phi(time.Now()), err)
+		return
+	}
+
 	if self.isUp {
 		log.Warn("Server marked as down. Hearbeat error for server: %d - %s: %s", self.Id, self.ProtobufConnectionString, err)
 	}
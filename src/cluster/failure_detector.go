@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// the number of heartbeat intervals the failure detector keeps
+	FAILURE_DETECTOR_WINDOW = 100
+
+	DEFAULT_PHI_THRESHOLD = 8.0
+)
+
+// A phi accrual failure detector. Instead of marking a server as down
+// after a fixed timeout it keeps the intervals between the last
+// heartbeats and computes phi, the suspicion level that the server is
+// down given how long it's been since the last heartbeat. A phi of 1
+// means there's a 10% chance that a heartbeat will still arrive, a phi
+// of 2 a 1% chance and so on. The intervals are assumed to follow an
+// exponential distribution, which is good enough for heartbeats on a
+// LAN and doesn't need a variance estimate.
+type failureDetector struct {
+	lock          sync.Mutex
+	intervals     []time.Duration
+	next          int
+	sum           time.Duration
+	lastHeartbeat time.Time
+	threshold     float64
+}
+
+func newFailureDetector(threshold float64) *failureDetector {
+	if threshold <= 0 {
+		threshold = DEFAULT_PHI_THRESHOLD
+	}
+	return &failureDetector{
+		intervals: make([]time.Duration, 0, FAILURE_DETECTOR_WINDOW),
+		threshold: threshold,
+	}
+}
+
+func (self *failureDetector) heartbeat(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.lastHeartbeat.IsZero() {
+		interval := now.Sub(self.lastHeartbeat)
+		if len(self.intervals) < FAILURE_DETECTOR_WINDOW {
+			self.intervals = append(self.intervals, interval)
+		} else {
+			self.sum -= self.intervals[self.next]
+			self.intervals[self.next] = interval
+			self.next = (self.next + 1) % FAILURE_DETECTOR_WINDOW
+		}
+		self.sum += interval
+	}
+	self.lastHeartbeat = now
+}
+
+// Forgets the last heartbeat, the time the server was down shouldn't
+// count as an interval once it's back
+func (self *failureDetector) reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastHeartbeat = time.Time{}
+}
+
+// Returns 0 if there aren't enough heartbeats to tell
+func (self *failureDetector) phi(now time.Time) float64 {
+	phi, _ := self.computePhi(now)
+	return phi
+}
+
+func (self *failureDetector) computePhi(now time.Time) (float64, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.lastHeartbeat.IsZero() || len(self.intervals) == 0 || self.sum == 0 {
+		return 0, false
+	}
+	mean := float64(self.sum) / float64(len(self.intervals))
+	elapsed := float64(now.Sub(self.lastHeartbeat))
+	return elapsed / mean * math.Log10(math.E), true
+}
+
+// Without any heartbeat intervals to go by a single missed heartbeat
+// is enough to consider the server down
+func (self *failureDetector) isAvailable(now time.Time) bool {
+	phi, ok := self.computePhi(now)
+	return ok && phi < self.threshold
+}
+
+// true if phi is past half the threshold, servers the other nodes
+// report as down are marked down as soon as they're suspected
+func (self *failureDetector) isSuspected(now time.Time) bool {
+	phi, ok := self.computePhi(now)
+	return !ok || phi >= self.threshold/2
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// Servers can be labeled with the failure domain they're in, like a
+// rack or an availability zone. The replicas of a shard are spread over
+// as many domains as there are, a domain only gets a second replica of a
+// shard once every other domain has one. Servers without a label are
+// each treated as a domain of their own.
+
+// Picks rf servers for a new shard going around the servers from
+// startIndex and returns them along with the index the next shard should
+// start from. A server in a domain that already has a replica of the
+// shard is skipped until every domain has one.
+func pickShardServers(servers []*ClusterServer, startIndex, rf int) ([]*ClusterServer, int) {
+	if rf > len(servers) {
+		rf = len(servers)
+	}
+	picked := make([]*ClusterServer, 0, rf)
+	taken := make(map[int]bool, rf)
+	domains := make(map[string]bool, rf)
+	next := startIndex
+	for _, spread := range []bool{true, false} {
+		for i := 0; i < len(servers) && len(picked) < rf; i++ {
+			idx := (startIndex + i) % len(servers)
+			server := servers[idx]
+			if taken[idx] || (spread && server.FailureDomain != "" && domains[server.FailureDomain]) {
+				continue
+			}
+			picked = append(picked, server)
+			taken[idx] = true
+			domains[server.FailureDomain] = true
+			next = idx + 1
+		}
+	}
+	return picked, next % len(servers)
+}
+
+// Returns the failure domains that have a replica of the shard on one of
+// the given servers, other than except. Servers that are being
+// decommissioned don't count, their replicas are about to move.
+func (self *ClusterConfiguration) replicaFailureDomains(serverIds []uint32, except uint32) map[string]bool {
+	domains := make(map[string]bool)
+	for _, id := range serverIds {
+		if id == except {
+			continue
+		}
+		server := self.GetServerById(&id)
+		if server == nil || server.FailureDomain == "" || server.IsDecommissioning() {
+			continue
+		}
+		domains[server.FailureDomain] = true
+	}
+	return domains
+}
+
+// Returns true if moving the replica on from to the server to would put
+// it in a different failure domain that already has a replica of the
+// shard
+func (self *ClusterConfiguration) movesIntoTakenFailureDomain(serverIds []uint32, from, to uint32) bool {
+	toServer := self.GetServerById(&to)
+	if toServer == nil || toServer.FailureDomain == "" {
+		return false
+	}
+	if fromServer := self.GetServerById(&from); fromServer != nil && fromServer.FailureDomain == toServer.FailureDomain {
+		return false
+	}
+	return self.replicaFailureDomains(serverIds, from)[toServer.FailureDomain]
+}
+
+// Sets the failure domain of the given server. Only the shards created
+// afterwards and the replicas moved afterwards take it into account.
+func (self *ClusterConfiguration) SetFailureDomain(serverId uint32, domain string) error {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", serverId)
+	}
+	server.FailureDomain = domain
+	return nil
+}
@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"parser"
+	p "protocol"
+	"sort"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// the number of first response latencies kept per server
+	LATENCY_WINDOW_SIZE = 100
+	// a server isn't hedged against until it answered that many queries
+	MIN_LATENCY_SAMPLES = 10
+)
+
+// A read of a remote shard is sent to a second replica if the first one
+// takes longer than the given percentile of the time it usually takes
+// to send back the first response, whichever replica answers first is
+// used and the other one is ignored. A nil policy never hedges.
+type HedgePolicy struct {
+	percentile float64
+	minDelay   time.Duration
+}
+
+func NewHedgePolicy(percentile float64, minDelay time.Duration) *HedgePolicy {
+	if percentile <= 0 {
+		return nil
+	}
+	return &HedgePolicy{percentile, minDelay}
+}
+
+// Returns how long to wait for the server before hedging, false if the
+// server didn't answer enough queries yet to tell
+func (self *HedgePolicy) delay(server *ClusterServer) (time.Duration, bool) {
+	if self == nil {
+		return 0, false
+	}
+	latency, ok := server.firstResponseLatencies.percentile(self.percentile)
+	if !ok {
+		return 0, false
+	}
+	if latency < self.minDelay {
+		latency = self.minDelay
+	}
+	return latency, true
+}
+
+// The last LATENCY_WINDOW_SIZE latencies
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	lock    sync.Mutex
+}
+
+func (self *latencyWindow) add(latency time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.samples) < LATENCY_WINDOW_SIZE {
+		self.samples = append(self.samples, latency)
+		return
+	}
+	self.samples[self.next] = latency
+	self.next = (self.next + 1) % LATENCY_WINDOW_SIZE
+}
+
+func (self *latencyWindow) percentile(percentile float64) (time.Duration, bool) {
+	self.lock.Lock()
+	samples := make([]time.Duration, len(self.samples))
+	copy(samples, self.samples)
+	self.lock.Unlock()
+
+	if len(samples) < MIN_LATENCY_SAMPLES {
+		return 0, false
+	}
+	sort.Sort(durations(samples))
+	index := int(float64(len(samples)) * percentile / 100)
+	if index >= len(samples) {
+		index = len(samples) - 1
+	}
+	return samples[index], true
+}
+
+type durations []time.Duration
+
+func (self durations) Len() int {
+	return len(self)
+}
+
+func (self durations) Less(i, j int) bool {
+	return self[i] < self[j]
+}
+
+func (self durations) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// Returns the replica to hedge the read from server with, nil if the
+// query shouldn't be hedged
+func (self *ShardData) hedgeServer(querySpec *parser.QuerySpec, server *ClusterServer) *ClusterServer {
+	if querySpec.SelectQuery() == nil || querySpec.IsDestructiveQuery() || querySpec.QuorumRead {
+		return nil
+	}
+	if _, ok := server.hedgePolicy.delay(server); !ok {
+		return nil
+	}
+	var hedge *ClusterServer
+	for _, s := range self.clusterServers {
+		if s == server || !s.IsUp() {
+			continue
+		}
+		if hedge == nil || s.ReadLatency() < hedge.ReadLatency() {
+			hedge = s
+		}
+	}
+	return hedge
+}
+
+// Queries server and, if it hasn't sent anything back within the hedge
+// delay, hedge as well. The responses of the replica that answers first
+// are forwarded, the other replica's are dropped.
+func (self *ShardData) hedgedQuery(server, hedge *ClusterServer, querySpec *parser.QuerySpec, response chan *p.Response) {
+	delay, _ := server.hedgePolicy.delay(server)
+	first := make(chan *p.Response, cap(response)+1)
+	go self.queryServer(server, querySpec, first)
+
+	var r *p.Response
+	select {
+	case r = <-first:
+		forwardResponses(r, first, response)
+		return
+	case <-time.After(delay):
+	}
+
+	log.Debug("Server %d didn't answer the query of shard %d within %s, hedging with server %d", server.Id, self.id, delay, hedge.Id)
+	second := make(chan *p.Response, cap(response)+1)
+	go self.queryServer(hedge, querySpec, second)
+	winner, loser := first, second
+	select {
+	case r = <-first:
+	case r = <-second:
+		winner, loser = second, first
+	}
+	if isEndOfStream(r) && r.ErrorMessage != nil {
+		// the other replica might still answer
+		winner = loser
+		r = <-winner
+	} else {
+		go dropResponses(loser)
+	}
+	forwardResponses(r, winner, response)
+}
+
+// forwards the first response that was already read from responses and
+// the rest of them up to the end of the stream
+func forwardResponses(first *p.Response, responses <-chan *p.Response, response chan<- *p.Response) {
+	for r := first; ; r = <-responses {
+		response <- r
+		if isEndOfStream(r) {
+			return
+		}
+	}
+}
+
+func dropResponses(responses <-chan *p.Response) {
+	for r := range responses {
+		if isEndOfStream(r) {
+			return
+		}
+	}
+}
+
+func isEndOfStream(r *p.Response) bool {
+	return r.GetType() == endStreamResponse || r.GetType() == accessDeniedResponse
+}
@@ -0,0 +1,47 @@
+package cluster
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type HedgedReadSuite struct{}
+
+var _ = Suite(&HedgedReadSuite{})
+
+func (self *HedgedReadSuite) TestHedgeDelayIsThePercentileOfTheFirstResponseLatencies(c *C) {
+	server := &ClusterServer{}
+	policy := NewHedgePolicy(90, 5*time.Millisecond)
+	for i := 1; i < MIN_LATENCY_SAMPLES; i++ {
+		server.firstResponseLatencies.add(time.Duration(i) * time.Millisecond)
+	}
+	_, ok := policy.delay(server)
+	c.Assert(ok, Equals, false)
+
+	server.firstResponseLatencies.add(10 * time.Millisecond)
+	delay, ok := policy.delay(server)
+	c.Assert(ok, Equals, true)
+	c.Assert(delay, Equals, 10*time.Millisecond)
+
+	delay, _ = NewHedgePolicy(10, 5*time.Millisecond).delay(server)
+	c.Assert(delay, Equals, 5*time.Millisecond)
+}
+
+func (self *HedgedReadSuite) TestLatencyWindowOnlyKeepsTheLatestSamples(c *C) {
+	window := &latencyWindow{}
+	for i := 0; i < LATENCY_WINDOW_SIZE; i++ {
+		window.add(time.Second)
+	}
+	for i := 0; i < LATENCY_WINDOW_SIZE; i++ {
+		window.add(time.Millisecond)
+	}
+	latency, _ := window.percentile(100)
+	c.Assert(latency, Equals, time.Millisecond)
+}
+
+func (self *HedgedReadSuite) TestHedgingIsDisabledWithoutAPercentile(c *C) {
+	c.Assert(NewHedgePolicy(0, time.Millisecond), IsNil)
+	_, ok := (*HedgePolicy)(nil).delay(&ClusterServer{})
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// A server added to the cluster before it's started. It's a potential
+// server until it comes up and joins with the same raft name and
+// connection strings, which makes it a raft peer. The raft name of a
+// server is read from the name file in its raft dir, the file has to
+// be written before the server starts for the first time.
+type NewServer struct {
+	Name                     string `json:"name"`
+	RaftConnectionString     string `json:"raftConnectionString"`
+	ProtobufConnectionString string `json:"protobufConnectionString"`
+	FailureDomain            string `json:"failureDomain,omitempty"`
+}
+
+func (self *NewServer) Validate() error {
+	if self.Name == "" {
+		return fmt.Errorf("The raft name of the server is missing")
+	}
+	u, err := url.Parse(self.RaftConnectionString)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid raft connection string %s for server %s, it must be an http or https url", self.RaftConnectionString, self.Name)
+	}
+	if self.ProtobufConnectionString == "" {
+		return fmt.Errorf("The protobuf connection string of server %s is missing", self.Name)
+	}
+	return nil
+}
+
+// Returns an error if the name or one of the connection strings of the
+// server is taken by a server of the cluster
+func (self *ClusterConfiguration) CheckNewServer(server *NewServer) error {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	for _, s := range self.servers {
+		switch {
+		case s.RaftName == server.Name:
+			return fmt.Errorf("Server %s already exist", server.Name)
+		case s.RaftConnectionString == server.RaftConnectionString:
+			return fmt.Errorf("Server %d already has the raft connection string %s", s.Id, server.RaftConnectionString)
+		case s.ProtobufConnectionString == server.ProtobufConnectionString:
+			return fmt.Errorf("Server %d already has the protobuf connection string %s", s.Id, server.ProtobufConnectionString)
+		}
+	}
+	return nil
+}
+
+// Adds the server as a potential server, the raft peer is added when the
+// server joins
+func (self *ClusterConfiguration) AddNewServer(server *NewServer) error {
+	if err := self.CheckNewServer(server); err != nil {
+		return err
+	}
+	clusterServer := NewClusterServer(server.Name,
+		server.RaftConnectionString,
+		server.ProtobufConnectionString,
+		nil,
+		self.config)
+	clusterServer.FailureDomain = server.FailureDomain
+	self.AddPotentialServer(clusterServer)
+	return nil
+}
@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	log "code.google.com/p/log4go"
+)
+
+// Observers aren't raft peers, so they don't see the raft log. They keep
+// their copy of the cluster metadata up to date by periodically applying
+// a snapshot of the configuration taken on one of the seed servers.
+// Unlike Recovery this is called repeatedly, servers and shards that are
+// already known are kept as they are and only the differences are applied.
+func (self *ClusterConfiguration) SyncFromSnapshot(b []byte) error {
+	data, err := DecodeSavedConfiguration(b)
+	if err != nil {
+		return err
+	}
+
+	self.createDatabaseLock.Lock()
+	self.DatabaseReplicationFactors = make(map[string]struct{}, len(data.Databases))
+	for k, _ := range data.Databases {
+		self.DatabaseReplicationFactors[k] = struct{}{}
+	}
+	self.writeConsistency = make(map[string]WriteConsistency, len(data.WriteConsistency))
+	for k, v := range data.WriteConsistency {
+		if level, err := ParseWriteConsistency(v); err == nil {
+			self.writeConsistency[k] = level
+		}
+	}
+	self.createDatabaseLock.Unlock()
+
+	self.replicationFactor = self.config.ReplicationFactor
+	if data.ReplicationFactor > 0 {
+		self.replicationFactor = data.ReplicationFactor
+	}
+	self.restoreShardDurations(data)
+	self.restoreReplicationTargets(data)
+
+	self.usersLock.Lock()
+	self.clusterAdmins = data.Admins
+	self.dbUsers = data.DbUsers
+	self.usersLock.Unlock()
+
+	self.syncServers(data.Servers)
+	// the seed hasn't applied the join yet, the shards are synced once
+	// the local server shows up in a snapshot
+	if self.LocalServer != nil {
+		self.syncShards(append(data.ShortTermShards, data.LongTermShards...))
+	}
+
+	self.continuousQueriesLock.Lock()
+	self.continuousQueries = nil
+	self.ParsedContinuousQueries = nil
+	for db, queries := range data.ContinuousQueries {
+		for _, query := range queries {
+			self.addContinuousQuery(db, query)
+		}
+	}
+	self.continuousQueriesLock.Unlock()
+
+	self.restoreTombstones(data)
+	return nil
+}
+
+func (self *ClusterConfiguration) syncServers(servers []*ClusterServer) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+
+	for _, saved := range servers {
+		if server := self.GetServerByRaftName(saved.RaftName); server != nil {
+			server.State = saved.State
+			continue
+		}
+
+		self.servers = append(self.servers, saved)
+		log.Info("Observer: added server %d, %s", saved.Id, saved.ProtobufConnectionString)
+		if saved.RaftName == self.LocalRaftName {
+			self.LocalServer = saved
+			self.addedLocalServerWait <- true
+			self.addedLocalServer = true
+			continue
+		}
+		self.connectToServer(saved)
+	}
+
+	// drop the servers that were removed from the cluster
+	for i := 0; i < len(self.servers); {
+		server := self.servers[i]
+		if server == self.LocalServer || containsServer(servers, server.RaftName) {
+			i++
+			continue
+		}
+		log.Info("Observer: removing server %d", server.Id)
+		if server.connection != nil {
+			server.connection.Close()
+		}
+		self.servers = append(self.servers[:i], self.servers[i+1:]...)
+	}
+}
+
+func containsServer(servers []*ClusterServer, raftName string) bool {
+	for _, server := range servers {
+		if server.RaftName == raftName {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ClusterConfiguration) syncShards(savedShards []*NewShardData) {
+	saved := make(map[uint32]bool, len(savedShards))
+	for _, newShard := range savedShards {
+		saved[newShard.Id] = true
+
+		shard := self.GetShard(newShard.Id)
+		if shard == nil {
+			self.addSyncedShard(newShard)
+			continue
+		}
+
+		for _, serverId := range newShard.ServerIds {
+			if err := self.AddShardReplica(shard.id, serverId); err != nil {
+				log.Error("Observer: cannot add server %d to shard %d: %s", serverId, shard.id, err)
+			}
+		}
+		removed := make([]uint32, 0)
+		for _, serverId := range shard.ServerIds() {
+			if !containsId(newShard.ServerIds, serverId) {
+				removed = append(removed, serverId)
+			}
+		}
+		if len(removed) > 0 {
+			self.shardsByIdLock.Lock()
+			shard.RemoveServers(removed)
+			self.shardsByIdLock.Unlock()
+		}
+	}
+
+	for _, shard := range self.GetAllShards() {
+		if !saved[shard.id] {
+			log.Info("Observer: removing shard %d", shard.id)
+			self.removeShard(shard.id)
+			if shard.IsLocal {
+				if err := self.shardStore.DeleteShard(shard.id); err != nil {
+					log.Error("Observer: cannot delete shard %d: %s", shard.id, err)
+				}
+			}
+		}
+	}
+}
+
+func (self *ClusterConfiguration) addSyncedShard(newShard *NewShardData) {
+	shard := self.convertNewShardDataToShards([]*NewShardData{newShard})[0]
+
+	self.shardLock.Lock()
+	defer self.shardLock.Unlock()
+	self.shardsByIdLock.Lock()
+	self.shardsById[shard.id] = shard
+	self.shardsByIdLock.Unlock()
+
+	if newShard.Type == LONG_TERM {
+		self.longTermShards = append(self.longTermShards, shard)
+		SortShardsByTimeDescending(self.longTermShards)
+	} else {
+		self.shortTermShards = append(self.shortTermShards, shard)
+		SortShardsByTimeDescending(self.shortTermShards)
+	}
+	log.Info("Observer: added shard %d, servers: %v", shard.id, shard.ServerIds())
+}
+
+func containsId(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"configuration"
+	"sort"
+	"strings"
+)
+
+// Picks which of the shards of a period a series is written to. Queries
+// read every shard of the period, so the partitioning only decides where
+// the points of a series end up.
+type SeriesPartitioner interface {
+	// Returns the index of the shard the series goes to, shards is the
+	// number of shards the period is split into
+	Partition(db, series string, shards int) int
+}
+
+// Returns the partitioner of the given shard configuration, hash
+// partitioning unless another one is configured
+func NewSeriesPartitioner(config *configuration.ShardConfiguration) SeriesPartitioner {
+	switch config.Partitioning {
+	case "consistent-hash":
+		return consistentHashPartitioner{}
+	case "prefix":
+		return newPrefixPartitioner(config.Routes)
+	}
+	return hashPartitioner{}
+}
+
+// Spreads the series over the shards by the hash of the database and
+// series name. Changing the split moves most series to another shard.
+type hashPartitioner struct{}
+
+func (self hashPartitioner) Partition(db, series string, shards int) int {
+	return HashDbAndSeriesToInt(db, series) % shards
+}
+
+// Jump consistent hashing, when the split goes from n to n+1 shards only
+// 1/(n+1) of the series move and they all move to the new shard
+type consistentHashPartitioner struct{}
+
+func (self consistentHashPartitioner) Partition(db, series string, shards int) int {
+	key := uint64(HashDbAndSeriesToInt(db, series))
+	b, j := int64(-1), int64(0)
+	for j < int64(shards) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Routes the series by the longest prefix they start with, e.g. to keep
+// the series of a tenant apart from the others. Series that don't match
+// any route are hashed.
+type prefixPartitioner struct {
+	routes   []*configuration.ShardRoute
+	fallback SeriesPartitioner
+}
+
+type routesByPrefixLength []*configuration.ShardRoute
+
+func (self routesByPrefixLength) Len() int {
+	return len(self)
+}
+
+func (self routesByPrefixLength) Less(i, j int) bool {
+	return len(self[i].Prefix) > len(self[j].Prefix)
+}
+
+func (self routesByPrefixLength) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func newPrefixPartitioner(routes []*configuration.ShardRoute) *prefixPartitioner {
+	sorted := make([]*configuration.ShardRoute, len(routes))
+	copy(sorted, routes)
+	sort.Stable(routesByPrefixLength(sorted))
+	return &prefixPartitioner{sorted, hashPartitioner{}}
+}
+
+func (self *prefixPartitioner) Partition(db, series string, shards int) int {
+	for _, route := range self.routes {
+		if strings.HasPrefix(series, route.Prefix) {
+			return route.Index % shards
+		}
+	}
+	return self.fallback.Partition(db, series, shards)
+}
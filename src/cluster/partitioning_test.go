@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"configuration"
+	"fmt"
+
+	. "launchpad.net/gocheck"
+)
+
+type PartitioningSuite struct{}
+
+var _ = Suite(&PartitioningSuite{})
+
+func (self *PartitioningSuite) TestConsistentHashingOnlyMovesSeriesToNewShards(c *C) {
+	partitioner := NewSeriesPartitioner(&configuration.ShardConfiguration{Partitioning: "consistent-hash"})
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		series := fmt.Sprintf("series_%d", i)
+		before := partitioner.Partition("db", series, 4)
+		after := partitioner.Partition("db", series, 5)
+		c.Assert(before < 4, Equals, true)
+		if before != after {
+			c.Assert(after, Equals, 4)
+			moved++
+		}
+	}
+	c.Assert(moved > 0, Equals, true)
+	c.Assert(moved < 400, Equals, true)
+}
+
+func (self *PartitioningSuite) TestSeriesAreRoutedByTheirLongestPrefix(c *C) {
+	partitioner := NewSeriesPartitioner(&configuration.ShardConfiguration{
+		Partitioning: "prefix",
+		Routes: []*configuration.ShardRoute{
+			&configuration.ShardRoute{Prefix: "tenant_a.", Index: 1},
+			&configuration.ShardRoute{Prefix: "tenant_a.cpu", Index: 2},
+		},
+	})
+	c.Assert(partitioner.Partition("db", "tenant_a.mem", 3), Equals, 1)
+	c.Assert(partitioner.Partition("db", "tenant_a.cpu.idle", 3), Equals, 2)
+	c.Assert(partitioner.Partition("db", "tenant_b.cpu", 3), Equals, hashPartitioner{}.Partition("db", "tenant_b.cpu", 3))
+}
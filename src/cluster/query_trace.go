@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"common"
+	"math/rand"
+	"parser"
+	p "protocol"
+	"time"
+)
+
+// the stage of the spans of the shards, the coordinator has other stages
+const TRACE_STAGE_SHARD_SCAN = "shard_scan"
+
+// Counts the points the datastore yields to the processor it wraps
+type pointCountingProcessor struct {
+	QueryProcessor
+	points int64
+}
+
+func (self *pointCountingProcessor) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	self.points++
+	return self.QueryProcessor.YieldPoint(seriesName, columnNames, point)
+}
+
+func (self *pointCountingProcessor) YieldSeries(seriesIncoming *p.Series) bool {
+	self.points += int64(len(seriesIncoming.Points))
+	return self.QueryProcessor.YieldSeries(seriesIncoming)
+}
+
+// Returns the span of a query of the local copy of the shard that
+// started at startTime and just finished, under the span of the
+// coordinator of the query
+func (self *ShardData) traceSpan(querySpec *parser.QuerySpec, startTime time.Time, pointsRead int64) *p.TraceSpan {
+	serverId := self.localServerId
+	shardId := self.id
+	start := common.TimeToMicroseconds(startTime)
+	duration := int64(time.Since(startTime) / time.Microsecond)
+	stage := TRACE_STAGE_SHARD_SCAN
+	spanId := uint64(rand.Int63())
+	span := &p.TraceSpan{
+		ServerId:   &serverId,
+		ShardId:    &shardId,
+		StartTime:  &start,
+		Duration:   &duration,
+		PointsRead: &pointsRead,
+		Stage:      &stage,
+		SpanId:     &spanId,
+	}
+	if parentId := querySpec.ParentSpanId; parentId != 0 {
+		span.ParentId = &parentId
+	}
+	return span
+}
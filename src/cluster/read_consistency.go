@@ -0,0 +1,35 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The number of replicas of a shard a query has to see before it
+// returns
+type ReadConsistency int
+
+const (
+	// the query reads from a single replica
+	READ_CONSISTENCY_ONE ReadConsistency = iota
+	// the replica that runs the query first pulls the points it's missing
+	// from enough other replicas to make a quorum
+	READ_CONSISTENCY_QUORUM
+)
+
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch strings.ToLower(s) {
+	case "", "one":
+		return READ_CONSISTENCY_ONE, nil
+	case "quorum":
+		return READ_CONSISTENCY_QUORUM, nil
+	}
+	return READ_CONSISTENCY_ONE, fmt.Errorf("Unknown read consistency %s, must be one of one or quorum", s)
+}
+
+func (self ReadConsistency) String() string {
+	if self == READ_CONSISTENCY_QUORUM {
+		return "quorum"
+	}
+	return "one"
+}
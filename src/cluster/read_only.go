@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The writes of a read-only database are rejected while its queries keep
+// running, e.g. during a migration. The whole cluster is read-only when
+// the flag is set without a database.
+
+type ReadOnlyStatus struct {
+	ReadOnly  bool     `json:"readOnly"`
+	Databases []string `json:"databases"`
+}
+
+// Sets or clears the read-only flag of the database, or of the whole
+// cluster if the database is empty
+func (self *ClusterConfiguration) SetReadOnly(db string, readOnly bool) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if db == "" {
+		self.readOnly = readOnly
+		return nil
+	}
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if readOnly {
+		self.readOnlyDatabases[db] = true
+	} else {
+		delete(self.readOnlyDatabases, db)
+	}
+	return nil
+}
+
+// Returns true if the writes of the database are rejected, because either
+// the database or the cluster is read-only
+func (self *ClusterConfiguration) IsReadOnly(db string) bool {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	return self.readOnly || self.readOnlyDatabases[db]
+}
+
+func (self *ClusterConfiguration) GetReadOnlyStatus() *ReadOnlyStatus {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	status := &ReadOnlyStatus{ReadOnly: self.readOnly, Databases: make([]string, 0, len(self.readOnlyDatabases))}
+	for db := range self.readOnlyDatabases {
+		status.Databases = append(status.Databases, db)
+	}
+	sort.Strings(status.Databases)
+	return status
+}
@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// A move of a shard replica from one server to another
+type ShardMove struct {
+	ShardId uint32 `json:"shardId"`
+	From    uint32 `json:"from"`
+	To      uint32 `json:"to"`
+}
+
+// Computes the moves that even out the number of shard replicas across
+// the servers that can get new shards, until no two servers differ by
+// more than one replica. The most recent shards are moved first, they
+// are the ones still taking writes. Servers being decommissioned are
+// left out, they're drained as part of the decommission.
+func (self *ClusterConfiguration) PlanRebalance() []*ShardMove {
+	servers := self.shardAssignableServers()
+	if len(servers) < 2 {
+		return nil
+	}
+
+	replicas := make(map[uint32][]*ShardData, len(servers))
+	for _, server := range servers {
+		replicas[server.Id] = nil
+	}
+	placement := make(map[uint32]map[uint32]bool)
+	for _, shard := range self.GetAllShards() {
+		placement[shard.id] = make(map[uint32]bool)
+		for _, id := range shard.serverIds {
+			placement[shard.id][id] = true
+			if _, ok := replicas[id]; ok {
+				replicas[id] = append(replicas[id], shard)
+			}
+		}
+	}
+
+	moves := make([]*ShardMove, 0)
+	for {
+		var most, least uint32
+		for _, server := range servers {
+			if most == 0 || len(replicas[server.Id]) > len(replicas[most]) {
+				most = server.Id
+			}
+			if least == 0 || len(replicas[server.Id]) < len(replicas[least]) {
+				least = server.Id
+			}
+		}
+		if len(replicas[most])-len(replicas[least]) <= 1 {
+			return moves
+		}
+
+		moved := false
+		for i, shard := range replicas[most] {
+			if placement[shard.id][least] {
+				continue
+			}
+			if self.movesIntoTakenFailureDomain(placedServerIds(placement[shard.id]), most, least) {
+				continue
+			}
+			moves = append(moves, &ShardMove{ShardId: shard.id, From: most, To: least})
+			delete(placement[shard.id], most)
+			placement[shard.id][least] = true
+			replicas[most] = append(replicas[most][:i], replicas[most][i+1:]...)
+			replicas[least] = append(replicas[least], shard)
+			moved = true
+			break
+		}
+		// every shard on the busiest server already has a replica on the
+		// least busy one, there's nothing left to even out
+		if !moved {
+			return moves
+		}
+	}
+}
+
+func placedServerIds(placement map[uint32]bool) []uint32 {
+	serverIds := make([]uint32, 0, len(placement))
+	for id := range placement {
+		serverIds = append(serverIds, id)
+	}
+	return serverIds
+}
+
+// Returns an error if the move doesn't apply to the current placement of
+// the shard anymore
+func (self *ClusterConfiguration) ValidateShardMove(move *ShardMove) error {
+	shard := self.GetShard(move.ShardId)
+	if shard == nil {
+		return fmt.Errorf("Cannot find shard %d", move.ShardId)
+	}
+	if !shard.HasServer(move.From) {
+		return fmt.Errorf("Shard %d doesn't have a replica on server %d", move.ShardId, move.From)
+	}
+	if shard.HasServer(move.To) {
+		return fmt.Errorf("Shard %d already has a replica on server %d", move.ShardId, move.To)
+	}
+	server := self.GetServerById(&move.To)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", move.To)
+	}
+	if server.IsDecommissioning() {
+		return fmt.Errorf("Server %d is being decommissioned", move.To)
+	}
+	if self.movesIntoTakenFailureDomain(shard.serverIds, move.From, move.To) {
+		return fmt.Errorf("Failure domain %s of server %d already has a replica of shard %d", server.FailureDomain, move.To, move.ShardId)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the name is used as the directory of the replication buffer
+var replicationTargetNameRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// A remote cluster that gets a copy of the writes accepted for some of
+// the databases of this cluster, e.g. a warm standby in another
+// datacenter. The writes are sent to the http api of the remote cluster
+// asynchronously, so it can be behind by however much is buffered.
+// A udp target gets the writes as the json packets of the udp input
+// instead, e.g. for a stream processor. Nothing acknowledges them, the
+// packets that are lost aren't sent again.
+type ReplicationTarget struct {
+	Name string `json:"name"`
+	// the base url of the http api of the remote cluster, e.g.
+	// http://standby.example.com:8086, or the address of a udp target,
+	// e.g. udp://stream.example.com:4444
+	Url       string   `json:"url"`
+	Databases []string `json:"databases"`
+	// a cluster admin or a user with write access to every database
+	// on the remote cluster
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+func (self *ReplicationTarget) Validate() error {
+	if !replicationTargetNameRegex.MatchString(self.Name) {
+		return fmt.Errorf("Invalid replication target name %s, only letters, digits, _ and - are allowed", self.Name)
+	}
+	u, err := url.Parse(self.Url)
+	if err != nil {
+		return fmt.Errorf("Invalid url %s for replication target %s: %s", self.Url, self.Name, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" {
+		return fmt.Errorf("The url of replication target %s must be http, https or udp, got %s", self.Name, self.Url)
+	}
+	if u.Scheme == "udp" && u.Host == "" {
+		return fmt.Errorf("The url of replication target %s is missing the address to send to, got %s", self.Name, self.Url)
+	}
+	if len(self.Databases) == 0 {
+		return fmt.Errorf("Replication target %s doesn't replicate any databases", self.Name)
+	}
+	return nil
+}
+
+func (self *ReplicationTarget) IsUdp() bool {
+	return strings.HasPrefix(self.Url, "udp://")
+}
+
+func (self *ReplicationTarget) Replicates(db string) bool {
+	for _, d := range self.Databases {
+		if d == db {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ClusterConfiguration) CreateReplicationTarget(target *ReplicationTarget) error {
+	if err := target.Validate(); err != nil {
+		return err
+	}
+
+	self.replicationTargetsLock.Lock()
+	defer self.replicationTargetsLock.Unlock()
+	if _, ok := self.replicationTargets[target.Name]; ok {
+		return fmt.Errorf("Replication target %s already exists", target.Name)
+	}
+	self.replicationTargets[target.Name] = target
+	return nil
+}
+
+func (self *ClusterConfiguration) DropReplicationTarget(name string) error {
+	self.replicationTargetsLock.Lock()
+	defer self.replicationTargetsLock.Unlock()
+	if _, ok := self.replicationTargets[name]; !ok {
+		return fmt.Errorf("Replication target %s doesn't exist", name)
+	}
+	delete(self.replicationTargets, name)
+	return nil
+}
+
+// Returns the replication targets sorted by name
+func (self *ClusterConfiguration) GetReplicationTargets() []*ReplicationTarget {
+	self.replicationTargetsLock.RLock()
+	defer self.replicationTargetsLock.RUnlock()
+	names := make([]string, 0, len(self.replicationTargets))
+	for name, _ := range self.replicationTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := make([]*ReplicationTarget, 0, len(names))
+	for _, name := range names {
+		targets = append(targets, self.replicationTargets[name])
+	}
+	return targets
+}
+
+func (self *ClusterConfiguration) restoreReplicationTargets(data *SavedConfiguration) {
+	self.replicationTargetsLock.Lock()
+	defer self.replicationTargetsLock.Unlock()
+	self.replicationTargets = make(map[string]*ReplicationTarget, len(data.ReplicationTargets))
+	for name, target := range data.ReplicationTargets {
+		self.replicationTargets[name] = target
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"configuration"
+	"fmt"
+	"time"
+)
+
+// Returns the shards whose end time is further in the past than the
+// retention of their shard type allows. Shards are only ever dropped
+// as a whole, a shard that's partly within the retention is kept.
+func (self *ClusterConfiguration) ExpiredShards(now time.Time) []*ShardData {
+	expired := make([]*ShardData, 0)
+	for _, shard := range self.GetAllShards() {
+		retention := self.config.ShortTermShard.ParsedRetention()
+		if shard.shardType == LONG_TERM {
+			retention = self.config.LongTermShard.ParsedRetention()
+		}
+		if retention > 0 && shard.endTime.Before(now.Add(-retention)) {
+			expired = append(expired, shard)
+		}
+	}
+	return expired
+}
+
+// Sets how long the points of the database are kept, "inf" keeps them
+// forever. Unlike the retention of the shard types the points are
+// deleted from the shards that are still kept.
+func (self *ClusterConfiguration) SetDatabaseRetention(db string, retention string) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+
+	duration, err := configuration.ParseRetention(retention)
+	if err != nil {
+		return err
+	}
+	if duration == 0 {
+		delete(self.databaseRetention, db)
+		return nil
+	}
+	self.databaseRetention[db] = duration
+	return nil
+}
+
+// Returns the retention of every database that doesn't keep its points
+// forever
+func (self *ClusterConfiguration) GetDatabaseRetentions() map[string]time.Duration {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	retentions := make(map[string]time.Duration, len(self.databaseRetention))
+	for db, retention := range self.databaseRetention {
+		retentions[db] = retention
+	}
+	return retentions
+}
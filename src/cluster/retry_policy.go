@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"errors"
+	"io"
+	"net"
+	p "protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+var connectionErrorCode = p.Response_CONNECTION_ERROR
+
+// Retries the requests to a remote server that failed because of the
+// connection to it, waiting twice as long after each attempt. Errors
+// returned by the server itself aren't retried, it would fail the same
+// request the same way. A nil policy tries requests once.
+type RetryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+func NewRetryPolicy(maxAttempts int, minBackoff, maxBackoff time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		maxAttempts: maxAttempts,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+	}
+}
+
+// Calls f until it succeeds or returns an error that can't be retried,
+// or the attempts run out
+func (self *RetryPolicy) Do(description string, f func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := f(attempt)
+		if err == nil || !self.Retry(description, attempt, err) {
+			return err
+		}
+	}
+}
+
+// Returns false if the attempt that failed with the given error was the
+// last one. Otherwise waits for the backoff of the attempt and returns
+// true.
+func (self *RetryPolicy) Retry(description string, attempt int, err error) bool {
+	if self == nil || attempt >= self.maxAttempts || !IsRetryableError(err) {
+		return false
+	}
+	backoff := self.backoff(attempt)
+	log.Debug("Retrying %s in %s: %s", description, backoff, err)
+	time.Sleep(backoff)
+	return true
+}
+
+func (self *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := self.minBackoff << uint(attempt-1)
+	if backoff <= 0 || backoff > self.maxBackoff {
+		return self.maxBackoff
+	}
+	return backoff
+}
+
+// The request or its response got lost on the way, the remote server
+// may not have seen it at all
+type ConnectionError struct {
+	message string
+}
+
+func (self *ConnectionError) Error() string {
+	return self.message
+}
+
+func IsRetryableError(err error) bool {
+	switch err.(type) {
+	case *ConnectionError, net.Error:
+		return true
+	}
+	return err == io.EOF
+}
+
+// Returns the error of the response, a *ConnectionError if the response
+// was made up by the client because of a failed connection
+func responseError(response *p.Response) error {
+	if response.ErrorMessage == nil {
+		return nil
+	}
+	if response.GetErrorCode() == connectionErrorCode {
+		return &ConnectionError{response.GetErrorMessage()}
+	}
+	return errors.New(response.GetErrorMessage())
+}
@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"errors"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type RetryPolicySuite struct{}
+
+var _ = Suite(&RetryPolicySuite{})
+
+func (self *RetryPolicySuite) TestOnlyConnectionErrorsAreRetried(c *C) {
+	policy := NewRetryPolicy(3, time.Millisecond, 2*time.Millisecond)
+	attempts := 0
+	err := policy.Do("test", func(attempt int) error {
+		attempts = attempt
+		return &ConnectionError{"connection lost"}
+	})
+	c.Assert(err, NotNil)
+	c.Assert(attempts, Equals, 3)
+
+	attempts = 0
+	err = policy.Do("test", func(attempt int) error {
+		attempts = attempt
+		return errors.New("Couldn't find series")
+	})
+	c.Assert(err, NotNil)
+	c.Assert(attempts, Equals, 1)
+
+	err = policy.Do("test", func(attempt int) error {
+		if attempt < 2 {
+			return &ConnectionError{"connection lost"}
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	var none *RetryPolicy
+	c.Assert(none.Retry("test", 1, &ConnectionError{"connection lost"}), Equals, false)
+}
+
+func (self *RetryPolicySuite) TestBackoffDoubles(c *C) {
+	policy := NewRetryPolicy(10, 100*time.Millisecond, time.Second)
+	c.Assert(policy.backoff(1), Equals, 100*time.Millisecond)
+	c.Assert(policy.backoff(2), Equals, 200*time.Millisecond)
+	c.Assert(policy.backoff(4), Equals, 800*time.Millisecond)
+	c.Assert(policy.backoff(5), Equals, time.Second)
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"configuration"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "code.google.com/p/log4go"
+)
+
+// Some of the settings of the config file can be changed while the
+// cluster is running. A change goes through raft, so every server makes
+// it at the same point of the log, and it's kept in the cluster config
+// where it overrides the config file of every server, including the ones
+// that join later. The write buffer sizes only apply to the buffers
+// created after the change, the rate limits to the next write or query.
+// Replication targets have their own commands.
+
+type runtimeSetting struct {
+	validate func(value string) error
+	apply    func(config *configuration.Configuration, value string)
+	get      func(config *configuration.Configuration) string
+}
+
+var runtimeSettings = map[string]*runtimeSetting{
+	"local-store-write-buffer-size": intSetting(func(c *configuration.Configuration) *int { return &c.LocalStoreWriteBufferSize }),
+	"per-server-write-buffer-size":  intSetting(func(c *configuration.Configuration) *int { return &c.PerServerWriteBufferSize }),
+	"max-response-buffer-size":      intSetting(func(c *configuration.Configuration) *int { return &c.ClusterMaxResponseBufferSize }),
+	"concurrent-shard-query-limit":  intSetting(func(c *configuration.Configuration) *int { return &c.ConcurrentShardQueryLimit }),
+	"short-term-retention":          retentionSetting(SHORT_TERM),
+	"long-term-retention":           retentionSetting(LONG_TERM),
+
+	"database-write-points-per-second": limitSetting(func(c *configuration.Configuration) *int { return &c.DatabaseWritePointsPerSecond }),
+	"database-concurrent-queries":      limitSetting(func(c *configuration.Configuration) *int { return &c.DatabaseConcurrentQueries }),
+	"database-queries-per-minute":      limitSetting(func(c *configuration.Configuration) *int { return &c.DatabaseQueriesPerMinute }),
+	"user-write-points-per-second":     limitSetting(func(c *configuration.Configuration) *int { return &c.UserWritePointsPerSecond }),
+	"user-concurrent-queries":          limitSetting(func(c *configuration.Configuration) *int { return &c.UserConcurrentQueries }),
+	"user-queries-per-minute":          limitSetting(func(c *configuration.Configuration) *int { return &c.UserQueriesPerMinute }),
+}
+
+func intSetting(field func(config *configuration.Configuration) *int) *runtimeSetting {
+	return boundedIntSetting(1, "a positive integer", field)
+}
+
+// a rate limit, 0 turns it off
+func limitSetting(field func(config *configuration.Configuration) *int) *runtimeSetting {
+	return boundedIntSetting(0, "a non negative integer", field)
+}
+
+func boundedIntSetting(min int, description string, field func(config *configuration.Configuration) *int) *runtimeSetting {
+	return &runtimeSetting{
+		validate: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < min {
+				return fmt.Errorf("%s isn't %s", value, description)
+			}
+			return nil
+		},
+		apply: func(config *configuration.Configuration, value string) {
+			*field(config), _ = strconv.Atoi(value)
+		},
+		get: func(config *configuration.Configuration) string {
+			return strconv.Itoa(*field(config))
+		},
+	}
+}
+
+func retentionSetting(shardType ShardType) *runtimeSetting {
+	shardConfig := func(config *configuration.Configuration) *configuration.ShardConfiguration {
+		if shardType == LONG_TERM {
+			return config.LongTermShard
+		}
+		return config.ShortTermShard
+	}
+	return &runtimeSetting{
+		validate: func(value string) error {
+			_, err := configuration.ParseRetention(value)
+			return err
+		},
+		apply: func(config *configuration.Configuration, value string) {
+			shardConfig(config).SetRetention(value)
+		},
+		get: func(config *configuration.Configuration) string {
+			if retention := shardConfig(config).Retention; retention != "" {
+				return retention
+			}
+			return "inf"
+		},
+	}
+}
+
+// Returns an error if the setting can't be changed at runtime or if the
+// value isn't valid for it
+func ValidateRuntimeSetting(name, value string) error {
+	setting, ok := runtimeSettings[name]
+	if !ok {
+		names := make([]string, 0, len(runtimeSettings))
+		for name := range runtimeSettings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown setting %s, must be one of %s", name, strings.Join(names, ", "))
+	}
+	if err := setting.validate(value); err != nil {
+		return fmt.Errorf("Invalid value for %s: %s", name, err)
+	}
+	return nil
+}
+
+// Changes the setting on this server, called when the raft command that
+// changes it is applied
+func (self *ClusterConfiguration) SetRuntimeSetting(name, value string) error {
+	if err := ValidateRuntimeSetting(name, value); err != nil {
+		return err
+	}
+	self.runtimeSettingsLock.Lock()
+	defer self.runtimeSettingsLock.Unlock()
+	runtimeSettings[name].apply(self.config, value)
+	self.runtimeSettings[name] = value
+	log.Info("Changed %s to %s", name, value)
+	return nil
+}
+
+// Returns the current value of every setting that can be changed at
+// runtime
+func (self *ClusterConfiguration) GetRuntimeSettings() map[string]string {
+	self.runtimeSettingsLock.RLock()
+	defer self.runtimeSettingsLock.RUnlock()
+	return currentRuntimeSettings(self.config)
+}
+
+func currentRuntimeSettings(config *configuration.Configuration) map[string]string {
+	values := make(map[string]string, len(runtimeSettings))
+	for name, setting := range runtimeSettings {
+		values[name] = setting.get(config)
+	}
+	return values
+}
+
+// Takes the values of the settings from the reloaded config file of this
+// server. The ones that were changed at runtime keep their runtime value
+// and are returned.
+func (self *ClusterConfiguration) ReloadFileSettings(config *configuration.Configuration) []string {
+	self.runtimeSettingsLock.Lock()
+	defer self.runtimeSettingsLock.Unlock()
+	overridden := []string{}
+	for name, value := range currentRuntimeSettings(config) {
+		if self.fileSettings[name] == value {
+			continue
+		}
+		self.fileSettings[name] = value
+		if _, ok := self.runtimeSettings[name]; ok {
+			overridden = append(overridden, name)
+			continue
+		}
+		runtimeSettings[name].apply(self.config, value)
+		log.Info("Changed %s to %s from the config file", name, value)
+	}
+	sort.Strings(overridden)
+	return overridden
+}
+
+// goes back to the values of the config file for the settings that
+// weren't changed in the saved configuration
+func (self *ClusterConfiguration) restoreRuntimeSettings(data *SavedConfiguration) {
+	self.runtimeSettingsLock.Lock()
+	defer self.runtimeSettingsLock.Unlock()
+	self.runtimeSettings = make(map[string]string, len(data.RuntimeSettings))
+	for name, setting := range runtimeSettings {
+		value, ok := data.RuntimeSettings[name]
+		if !ok || setting.validate(value) != nil {
+			setting.apply(self.config, self.fileSettings[name])
+			continue
+		}
+		setting.apply(self.config, value)
+		self.runtimeSettings[name] = value
+	}
+}
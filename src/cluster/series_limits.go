@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// Sets the most series the database can have, the writes that would
+// create more are rejected. Zero removes the limit.
+func (self *ClusterConfiguration) SetMaxSeries(db string, maxSeries int) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if maxSeries < 0 {
+		return fmt.Errorf("The max series of %s can't be negative", db)
+	}
+	if maxSeries == 0 {
+		delete(self.maxSeries, db)
+	} else {
+		self.maxSeries[db] = maxSeries
+	}
+	return nil
+}
+
+// Returns the max series of the database, zero if it has no limit
+func (self *ClusterConfiguration) GetMaxSeries(db string) int {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	return self.maxSeries[db]
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"protocol"
+	"syscall"
+	"time"
+)
+
+// What a server reports about itself in its heartbeat responses. The
+// versions let the deployment tools check that a rolling upgrade went
+// through on every server. The free disk space is -1 if the server
+// couldn't tell.
+type ServerInfo struct {
+	BuildVersion    string    `json:"buildVersion"`
+	ProtocolVersion uint32    `json:"protocolVersion"`
+	DiskFree        int64     `json:"diskFree"`
+	LastHeartbeat   time.Time `json:"lastHeartbeat"`
+}
+
+// Returns the info of this server, the one it sends with its heartbeat
+// responses
+func (self *ClusterConfiguration) LocalServerInfo() *ServerInfo {
+	free, err := diskFree(self.config.DataDir)
+	if err != nil {
+		free = -1
+	}
+	return &ServerInfo{
+		BuildVersion:    self.config.InfluxDBVersion,
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		DiskFree:        free,
+		LastHeartbeat:   time.Now(),
+	}
+}
+
+// Returns the number of bytes available to unprivileged users on the
+// file system of dir
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Returns what the server reported in its last heartbeat response, nil
+// if it never answered one
+func (self *ClusterServer) Info() *ServerInfo {
+	self.infoLock.Lock()
+	defer self.infoLock.Unlock()
+	return self.info
+}
+
+func (self *ClusterServer) recordHeartbeat(response *protocol.Response, now time.Time) {
+	info := &ServerInfo{
+		BuildVersion:    response.GetBuildVersion(),
+		ProtocolVersion: response.GetProtocolVersion(),
+		DiskFree:        -1,
+		LastHeartbeat:   now,
+	}
+	if response.DiskFree != nil {
+		info.DiskFree = response.GetDiskFree()
+	}
+	self.infoLock.Lock()
+	defer self.infoLock.Unlock()
+	self.info = info
+}
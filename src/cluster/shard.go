@@ -3,7 +3,9 @@ package cluster
 import (
 	"common"
 	"engine"
+	"errors"
 	"fmt"
+	"io"
 	"parser"
 	p "protocol"
 	"sort"
@@ -23,6 +25,7 @@ type Shard interface {
 	StartTime() time.Time
 	EndTime() time.Time
 	Write(*p.Request) error
+	WriteWithConsistency(*p.Request, WriteConsistency) error
 	SyncWrite(*p.Request) error
 	Query(querySpec *parser.QuerySpec, response chan *p.Response)
 	IsMicrosecondInRange(t int64) bool
@@ -59,6 +62,23 @@ const (
 	SHORT_TERM
 )
 
+func (self ShardType) String() string {
+	if self == LONG_TERM {
+		return "long-term"
+	}
+	return "short-term"
+}
+
+func ParseShardType(s string) (ShardType, error) {
+	switch s {
+	case "long-term":
+		return LONG_TERM, nil
+	case "short-term":
+		return SHORT_TERM, nil
+	}
+	return SHORT_TERM, fmt.Errorf("Unknown shard type %s, must be short-term or long-term", s)
+}
+
 type ShardData struct {
 	id               uint32
 	startTime        time.Time
@@ -75,6 +95,10 @@ type ShardData struct {
 	shardDuration    time.Duration
 	shardNanoseconds uint64
 	localServerId    uint32
+	localServer      *ClusterServer
+	preferLocalReads bool
+	tombstones       tombstoneState
+	throttle         *Throttle
 	IsLocal          bool
 }
 
@@ -92,36 +116,89 @@ func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, dura
 		durationIsSplit:  durationIsSplit,
 		shardDuration:    shardDuration,
 		shardNanoseconds: uint64(shardDuration),
+		preferLocalReads: true,
 	}
 }
 
 const (
 	PER_SERVER_BUFFER_SIZE  = 10
 	LOCAL_WRITE_BUFFER_SIZE = 10
+
+	// how long to wait for replicas to acknowledge a write with a
+	// consistency level other than any
+	WRITE_CONSISTENCY_TIMEOUT = 10 * time.Second
 )
 
 var (
 	queryResponse        = p.Response_QUERY
 	endStreamResponse    = p.Response_END_STREAM
 	accessDeniedResponse = p.Response_ACCESS_DENIED
+	queryTraceResponse   = p.Response_QUERY_TRACE
 	queryRequest         = p.Request_QUERY
 	dropDatabaseRequest  = p.Request_DROP_DATABASE
 )
 
 type LocalShardDb interface {
 	Write(database string, series []*p.Series) error
+	// writes the series unless a write with the same idempotency key was
+	// written recently, returns false if the write was dropped
+	WriteOnce(database, key string, series []*p.Series) (bool, error)
+	// returns a common.FieldTypeConflictError if some values don't have
+	// the types of their fields, the values that can be coerced to them
+	// are if the shard is set to
+	CheckFieldTypes(database string, series []*p.Series) error
 	Query(*parser.QuerySpec, QueryProcessor) error
 	DropDatabase(database string) error
 	IsClosed() bool
+	Snapshot() LocalShardSnapshot
+	SeriesCursor(querySpec *parser.QuerySpec, series string, columns []string) (SeriesCursor, error)
+	// yields the logged writes with a sequence greater than the given one
+	// and returns the sequence of the last write to the shard. Returns
+	// ErrWriteLogTruncated if some of those writes aren't logged anymore.
+	WritesSince(sequence uint64, yield func(sequence uint64, database string, series []*p.Series) error) (uint64, error)
+	// the sequence of the replica on the given server the shard caught up
+	// to with WritesSince
+	ReplicaSequence(serverId uint32) (uint64, error)
+	SetReplicaSequence(serverId uint32, sequence uint64) error
+}
+
+// returned by LocalShardDb.WritesSince when the writes asked for were
+// dropped from the write log, the shard has to be copied instead
+var ErrWriteLogTruncated = errors.New("The writes since the given sequence aren't logged anymore")
+
+// Reads the points of a series of a local shard in batches, the next
+// batch is only read from disk when it's asked for
+type SeriesCursor interface {
+	Fields() []string
+	// returns an empty batch once there are no more points
+	NextBatch(n int) ([]*p.Point, error)
+	Close()
+}
+
+// A point in time view of a local shard that can be backed up while
+// the shard keeps taking writes
+type LocalShardSnapshot interface {
+	WriteTo(dir string) error
+	// streams the snapshot, the stream can be restored with
+	// LocalShardStore.RestoreShardFrom
+	Backup(w io.Writer) error
+	Release()
 }
 
 type LocalShardStore interface {
 	Write(request *p.Request) error
 	SetWriteBuffer(writeBuffer *WriteBuffer)
 	BufferWrite(request *p.Request)
+	BufferWriteWithAck(request *p.Request, ack chan<- error)
 	GetOrCreateShard(id uint32) (LocalShardDb, error)
 	ReturnShard(id uint32)
 	DeleteShard(shardId uint32) error
+	RestoreShard(shardId uint32, dir string) error
+	RestoreShardFrom(shardId uint32, r io.Reader) error
+	// rewrites the files of the shard without the deleted points
+	CompactShard(shardId uint32) error
+	// the size on disk of every shard stored here, by shard id
+	ShardSizes() (map[uint32]int64, error)
 }
 
 func (self *ShardData) Id() uint32 {
@@ -158,6 +235,59 @@ func (self *ShardData) SetServers(servers []*ClusterServer) {
 	self.sortServerIds()
 }
 
+// Adds a remote replica to the shard, writes to the shard are sent to
+// it from now on
+func (self *ShardData) AddServer(server *ClusterServer) {
+	self.clusterServers = append(self.clusterServers, server)
+	self.servers = append(self.servers, server)
+	self.serverIds = append(self.serverIds, server.Id)
+	self.sortServerIds()
+}
+
+// Removes the given replicas from the shard, if one of them is the
+// local server the shard won't be read or written locally anymore
+func (self *ShardData) RemoveServers(serverIds []uint32) {
+	shouldRemove := func(id uint32) bool {
+		for _, removeId := range serverIds {
+			if id == removeId {
+				return true
+			}
+		}
+		return false
+	}
+
+	clusterServers := make([]*ClusterServer, 0, len(self.clusterServers))
+	servers := make([]wal.Server, 0, len(self.servers))
+	for _, server := range self.clusterServers {
+		if !shouldRemove(server.Id) {
+			clusterServers = append(clusterServers, server)
+			servers = append(servers, server)
+		}
+	}
+	serverIds := make([]uint32, 0, len(self.serverIds))
+	for _, id := range self.serverIds {
+		if !shouldRemove(id) {
+			serverIds = append(serverIds, id)
+		}
+	}
+
+	self.clusterServers = clusterServers
+	self.servers = servers
+	self.serverIds = serverIds
+	if self.IsLocal && shouldRemove(self.localServerId) {
+		self.IsLocal = false
+	}
+}
+
+func (self *ShardData) HasServer(serverId uint32) bool {
+	for _, id := range self.serverIds {
+		if id == serverId {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32) error {
 	self.serverIds = append(self.serverIds, localServerId)
 	self.localServerId = localServerId
@@ -175,6 +305,13 @@ func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32
 	return nil
 }
 
+// If preferLocal is false, reads go to the local copy of the shard only
+// if it has been faster than the remote replicas so far
+func (self *ShardData) SetReadPreference(localServer *ClusterServer, preferLocal bool) {
+	self.localServer = localServer
+	self.preferLocalReads = preferLocal
+}
+
 func (self *ShardData) ServerIds() []uint32 {
 	return self.serverIds
 }
@@ -195,6 +332,71 @@ func (self *ShardData) SyncWrite(request *p.Request) error {
 }
 
 func (self *ShardData) Write(request *p.Request) error {
+	return self.bufferWrite(request, nil)
+}
+
+// Logs the request to the WAL like Write, then waits for as many
+// replicas as the consistency level requires to write it. Replicas
+// that don't acknowledge in time will still get the write from the
+// WAL later on.
+func (self *ShardData) WriteWithConsistency(request *p.Request, consistency WriteConsistency) error {
+	if consistency == WRITE_CONSISTENCY_ANY {
+		return self.Write(request)
+	}
+
+	replicas := len(self.clusterServers)
+	if self.store != nil {
+		replicas++
+	}
+	acks := make(chan error, replicas)
+	if err := self.bufferWrite(request, acks); err != nil {
+		return err
+	}
+
+	required := consistency.RequiredAcks(replicas)
+	acked := 0
+	var lastErr error
+	timeout := time.After(WRITE_CONSISTENCY_TIMEOUT)
+	for received := 0; received < replicas && acked < required; received++ {
+		select {
+		case err := <-acks:
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			acked++
+		case <-timeout:
+			lastErr = fmt.Errorf("timed out after %s", WRITE_CONSISTENCY_TIMEOUT)
+			received = replicas
+		}
+	}
+
+	if acked < required {
+		message := fmt.Sprintf("Write to shard %d was acknowledged by %d replicas, %d required for consistency %s", self.id, acked, required, consistency)
+		if lastErr != nil {
+			message += fmt.Sprintf(": %s", lastErr)
+		}
+		return errors.New(message)
+	}
+	return nil
+}
+
+// Checks the values of the series against the types of their fields in
+// the local copy of the shard. Without a local copy the types can't be
+// checked, the replicas drop the values that don't match.
+func (self *ShardData) CheckFieldTypes(database string, series []*p.Series) error {
+	if !self.IsLocal || self.store == nil {
+		return nil
+	}
+	local, err := self.store.GetOrCreateShard(self.id)
+	if err != nil {
+		return err
+	}
+	defer self.store.ReturnShard(self.id)
+	return local.CheckFieldTypes(database, series)
+}
+
+func (self *ShardData) bufferWrite(request *p.Request, acks chan<- error) error {
 	request.ShardId = &self.id
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
 	if err != nil {
@@ -202,12 +404,12 @@ func (self *ShardData) Write(request *p.Request) error {
 	}
 	request.RequestNumber = &requestNumber
 	if self.store != nil {
-		self.store.BufferWrite(request)
+		self.store.BufferWriteWithAck(request, acks)
 	}
 	for _, server := range self.clusterServers {
 		// we have to create a new reqeust object because the ID gets assigned on each server.
 		requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, MultiSeries: request.MultiSeries, ShardId: &self.id, RequestNumber: request.RequestNumber}
-		server.BufferWrite(requestWithoutId)
+		server.BufferWriteWithAck(requestWithoutId, acks)
 	}
 	return nil
 }
@@ -233,18 +435,43 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		}
 	}
 
-	if self.IsLocal {
+	server := self.fastestHealthyServer()
+	readLocally := self.IsLocal && (server == nil || self.shouldReadLocally(querySpec, server))
+	if querySpec.QuorumRead && querySpec.SelectQuery() != nil {
+		// the local copy is always used if there's one, a remote replica
+		// reconciles its own copy before running the query
+		readLocally = self.IsLocal
+		if readLocally {
+			if err := self.ReconcileForQuorumRead(querySpec); err != nil {
+				response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
+				log.Error("Error while reconciling shard %d for a quorum read: %s", self.id, err)
+				return
+			}
+		}
+	}
+	if readLocally {
 		var processor QueryProcessor
 		var err error
 
-		if querySpec.IsListSeriesQuery() {
+		if querySpec.IsListSeriesQuery() || querySpec.IsDropSeriesDryRun() {
 			processor = engine.NewListSeriesEngine(response)
-		} else if querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery() || querySpec.IsSinglePointQuery() {
+		} else if querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery() || querySpec.IsSinglePointQuery() || querySpec.IsListFieldsQuery() || querySpec.IsShowDiskUsageQuery() || querySpec.IsShowCardinalityQuery() {
 			maxDeleteResults := 10000
 			processor = engine.NewPassthroughEngine(response, maxDeleteResults)
 		} else {
-			query := querySpec.SelectQuery()
-			if self.ShouldAggregateLocally(querySpec) {
+			// the offset is applied once the points of all the shards are
+			// in the coordinator, the shards return the skipped points too
+			query := querySpec.SelectQuery().WithoutOffset()
+			if querySpec.PartialAggregation {
+				log.Debug("creating a partial aggregation engine")
+				processor, err = engine.NewPartialQueryEngine(query, response)
+				if err != nil {
+					response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
+					log.Error("Error while creating engine: %s", err)
+					return
+				}
+				processor.SetShardInfo(int(self.Id()), self.IsLocal)
+			} else if self.ShouldAggregateLocally(querySpec) {
 				log.Debug("creating a query engine")
 				processor, err = engine.NewQueryEngine(query, response)
 				if err != nil {
@@ -282,8 +509,17 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 			return
 		}
 		defer self.store.ReturnShard(self.id)
-		err = shard.Query(querySpec, processor)
+		startTime := time.Now()
+		counter := &pointCountingProcessor{QueryProcessor: processor}
+		err = shard.Query(querySpec, counter)
+		// the span has to go out before closing the processor, the
+		// processor ends the stream
+		log.Debug("Query trace %s: shard %d read %d points in %s", querySpec.TraceId, self.id, counter.points, time.Since(startTime))
+		response <- &p.Response{Type: &queryTraceResponse, TraceSpans: []*p.TraceSpan{self.traceSpan(querySpec, startTime, counter.points)}}
 		processor.Close()
+		if self.localServer != nil {
+			self.localServer.RecordReadLatency(time.Since(startTime))
+		}
 		if err != nil {
 			response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
 		}
@@ -291,10 +527,13 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		return
 	}
 
-	if server := self.randomHealthyServer(); server != nil {
+	if server != nil {
 		log.Debug("Querying server %d for shard %d", server.GetId(), self.Id())
-		request := self.createRequest(querySpec)
-		server.MakeRequest(request, response)
+		if hedge := self.hedgeServer(querySpec, server); hedge != nil {
+			self.hedgedQuery(server, hedge, querySpec, response)
+			return
+		}
+		self.queryServer(server, querySpec, response)
 		return
 	}
 
@@ -303,21 +542,84 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 	log.Error(message)
 }
 
-// Returns a random healthy server or nil if none currently exist
-func (self *ShardData) randomHealthyServer() *ClusterServer {
-	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
+// forwards the responses of the remote server to the response channel
+// and records how long the server took to answer the query. The query
+// is sent again if the connection failed before the server responded,
+// once some of the results went through it can't be retried anymore.
+func (self *ShardData) queryServer(server *ClusterServer, querySpec *parser.QuerySpec, response chan *p.Response) {
+	description := fmt.Sprintf("query of shard %d on server %d", self.id, server.Id)
+	for attempt := 1; ; attempt++ {
+		request := self.createRequest(querySpec)
+		responses := make(chan *p.Response, cap(response)+1)
+		startTime := time.Now()
+		server.MakeRequest(request, responses)
+		forwarded := false
+		retry := false
+		for {
+			r := <-responses
+			if !forwarded && r.GetType() == endStreamResponse {
+				if err := responseError(r); err != nil && server.retryPolicy.Retry(description, attempt, err) {
+					retry = true
+					break
+				}
+			}
+			if !forwarded {
+				server.firstResponseLatencies.add(time.Since(startTime))
+			}
+			response <- r
+			forwarded = true
+			switch r.GetType() {
+			case endStreamResponse, accessDeniedResponse:
+				if r.ErrorMessage == nil {
+					server.RecordReadLatency(time.Since(startTime))
+				}
+				return
+			}
+		}
+		if !retry {
+			return
+		}
+	}
+}
+
+// Only select queries can be sent to a remote replica instead of the
+// local copy, everything else has to run locally
+func (self *ShardData) shouldReadLocally(querySpec *parser.QuerySpec, fastest *ClusterServer) bool {
+	if self.preferLocalReads || self.localServer == nil {
+		return true
+	}
+	if querySpec.SelectQuery() == nil || querySpec.IsDestructiveQuery() {
+		return true
+	}
+	return self.localServer.ReadLatency() <= fastest.ReadLatency()
+}
+
+// Returns the healthy server with the lowest read latency or nil if
+// none currently exist. Servers that haven't been read from yet are
+// picked first so that every replica gets a latency sample, ties are
+// broken randomly to spread the load.
+func (self *ShardData) fastestHealthyServer() *ClusterServer {
+	var fastest []*ClusterServer
+	var fastestLatency time.Duration
 	for _, s := range self.clusterServers {
-		if s.IsUp() {
-			healthyServers = append(healthyServers, s)
+		if !s.IsUp() {
+			continue
+		}
+		latency := s.ReadLatency()
+		if len(fastest) == 0 || latency < fastestLatency {
+			fastest = []*ClusterServer{s}
+			fastestLatency = latency
+			continue
+		}
+		if latency == fastestLatency {
+			fastest = append(fastest, s)
 		}
 	}
 
-	healthyCount := len(healthyServers)
-	if healthyCount > 0 {
-		randServerIndex := int(time.Now().UnixNano() % int64(healthyCount))
-		return healthyServers[randServerIndex]
+	if len(fastest) == 0 {
+		return nil
 	}
-	return nil
+	return fastest[int(time.Now().UnixNano()%int64(len(fastest)))]
 }
 
 func (self *ShardData) DropDatabase(database string, sendToServers bool) {
@@ -367,6 +669,11 @@ func (self *ShardData) ShouldAggregateLocally(querySpec *parser.QuerySpec) bool
 	if self.durationIsSplit && querySpec.ReadsFromMultipleSeries() {
 		return false
 	}
+	// the buckets of a zone or of a calendar interval aren't aligned with
+	// the shards
+	if query := querySpec.SelectQuery(); query != nil && (query.Location != nil || query.GetGroupByClause().GetGroupByCalendarInterval() != nil) {
+		return false
+	}
 	groupByInterval := querySpec.GetGroupByInterval()
 	if groupByInterval == nil {
 		if querySpec.HasAggregates() {
@@ -377,6 +684,18 @@ func (self *ShardData) ShouldAggregateLocally(querySpec *parser.QuerySpec) bool
 	return self.shardDuration%*groupByInterval == 0
 }
 
+// Returns true if every remote replica of the shard reported in its
+// heartbeats that it can compute partial aggregates
+func (self *ShardData) SupportsPartialAggregation() bool {
+	for _, server := range self.clusterServers {
+		info := server.Info()
+		if info == nil || info.ProtocolVersion < p.PARTIAL_AGGREGATION_PROTOCOL_VERSION {
+			return false
+		}
+	}
+	return true
+}
+
 func (self *ShardData) QueryResponseBufferSize(querySpec *parser.QuerySpec, batchPointSize int) int {
 	groupByTime := querySpec.GetGroupByInterval()
 	if groupByTime == nil {
@@ -515,7 +834,7 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 	database := querySpec.Database()
 	isDbUser := !user.IsClusterAdmin()
 
-	return &p.Request{
+	request := &p.Request{
 		Type:     &queryRequest,
 		ShardId:  &self.id,
 		Query:    &queryString,
@@ -523,6 +842,19 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 		Database: &database,
 		IsDbUser: &isDbUser,
 	}
+	if querySpec.QuorumRead {
+		request.QuorumRead = &querySpec.QuorumRead
+	}
+	if querySpec.TraceId != "" {
+		request.TraceId = &querySpec.TraceId
+	}
+	if querySpec.ParentSpanId != 0 {
+		request.ParentSpanId = &querySpec.ParentSpanId
+	}
+	if querySpec.PartialAggregation {
+		request.PartialAggregation = &querySpec.PartialAggregation
+	}
+	return request
 }
 
 // used to serialize shards when sending around in raft or when snapshotting in the log
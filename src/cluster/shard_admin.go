@@ -0,0 +1,277 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	p "protocol"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A shard is orphaned on a server when the server has a copy of it on
+// disk that the cluster metadata doesn't assign to it anymore, e.g. a
+// drop that failed halfway through, or when none of the servers the
+// metadata assigns it to are in the cluster anymore.
+
+var (
+	shardSizesRequest        = p.Request_SHARD_SIZES
+	dropOrphanedShardRequest = p.Request_DROP_ORPHANED_SHARD
+)
+
+type ShardInfo struct {
+	Id        uint32              `json:"id"`
+	Type      string              `json:"type"`
+	StartTime int64               `json:"startTime"`
+	EndTime   int64               `json:"endTime"`
+	Replicas  []*ShardReplicaInfo `json:"replicas"`
+	// none of the servers of the shard are in the cluster
+	Orphaned bool `json:"orphaned"`
+}
+
+type ShardReplicaInfo struct {
+	ServerId uint32 `json:"serverId"`
+	// the size on disk in bytes, -1 if it isn't known
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+type OrphanedShard struct {
+	ShardId  uint32 `json:"shardId"`
+	ServerId uint32 `json:"serverId"`
+	Size     int64  `json:"size"`
+}
+
+type ShardListing struct {
+	Shards  []*ShardInfo     `json:"shards"`
+	Orphans []*OrphanedShard `json:"orphans"`
+}
+
+type shardsById []*ShardData
+
+func (self shardsById) Len() int           { return len(self) }
+func (self shardsById) Less(i, j int) bool { return self[i].id < self[j].id }
+func (self shardsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Lists every shard of the cluster with the size of each of its
+// replicas, and the shards found on the disks of the servers that the
+// cluster doesn't assign to them. Servers that are down are reported
+// with an unknown size for their replicas.
+func (self *ClusterConfiguration) ListShards(user common.User) *ShardListing {
+	sizes := make(map[uint32]map[uint32]int64)
+	errs := make(map[uint32]error)
+	for _, server := range self.Servers() {
+		serverSizes, err := self.ShardSizesOnServer(server.Id, user)
+		if err != nil {
+			errs[server.Id] = err
+			continue
+		}
+		sizes[server.Id] = serverSizes
+	}
+
+	shards := self.GetAllShards()
+	sort.Sort(shardsById(shards))
+	listing := &ShardListing{Shards: make([]*ShardInfo, 0, len(shards)), Orphans: make([]*OrphanedShard, 0)}
+	for _, shard := range shards {
+		info := &ShardInfo{
+			Id:        shard.id,
+			Type:      shard.shardType.String(),
+			StartTime: shard.startTime.Unix(),
+			EndTime:   shard.endTime.Unix(),
+			Replicas:  make([]*ShardReplicaInfo, 0, len(shard.serverIds)),
+			Orphaned:  self.IsShardOrphaned(shard),
+		}
+		for _, serverId := range shard.serverIds {
+			replica := &ShardReplicaInfo{ServerId: serverId, Size: -1}
+			if err, ok := errs[serverId]; ok {
+				replica.Error = err.Error()
+			} else if serverSizes, ok := sizes[serverId]; !ok {
+				replica.Error = fmt.Sprintf("Server %d isn't in the cluster", serverId)
+			} else if size, ok := serverSizes[shard.id]; ok {
+				replica.Size = size
+			} else {
+				replica.Error = fmt.Sprintf("Server %d doesn't have a copy of the shard", serverId)
+			}
+			info.Replicas = append(info.Replicas, replica)
+		}
+		listing.Shards = append(listing.Shards, info)
+	}
+
+	for _, server := range self.Servers() {
+		for shardId, size := range sizes[server.Id] {
+			if shard := self.GetShard(shardId); shard != nil && shard.HasServer(server.Id) {
+				continue
+			}
+			listing.Orphans = append(listing.Orphans, &OrphanedShard{ShardId: shardId, ServerId: server.Id, Size: size})
+		}
+	}
+	return listing
+}
+
+// Returns true if none of the servers the shard is assigned to are in the
+// cluster anymore
+func (self *ClusterConfiguration) IsShardOrphaned(shard *ShardData) bool {
+	for _, serverId := range shard.serverIds {
+		if self.GetServerById(&serverId) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the sizes of the shards stored on the given server
+func (self *ClusterConfiguration) ShardSizesOnServer(serverId uint32, user common.User) (map[uint32]int64, error) {
+	if self.LocalServer != nil && serverId == self.LocalServer.Id {
+		return self.shardStore.ShardSizes()
+	}
+
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return nil, fmt.Errorf("Cannot find server %d", serverId)
+	}
+	if !server.IsUp() {
+		return nil, fmt.Errorf("Server %d is down", serverId)
+	}
+	response, err := self.makeShardAdminRequest(server, &shardSizesRequest, 0, user)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[uint32]int64, len(response.ShardSizes))
+	for _, size := range response.ShardSizes {
+		sizes[size.GetId()] = size.GetSize()
+	}
+	return sizes, nil
+}
+
+// Deletes the copy of the shard on the given server if the shard is
+// orphaned there. A shard whose servers are all gone is dropped from
+// the cluster metadata by the caller.
+func (self *ClusterConfiguration) DropOrphanedShardOnServer(shardId, serverId uint32, user common.User) error {
+	if self.LocalServer != nil && serverId == self.LocalServer.Id {
+		return self.DropOrphanedShard(shardId)
+	}
+
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", serverId)
+	}
+	_, err := self.makeShardAdminRequest(server, &dropOrphanedShardRequest, shardId, user)
+	return err
+}
+
+// Deletes the local copy of the shard, unless the cluster still expects
+// it to be here
+func (self *ClusterConfiguration) DropOrphanedShard(shardId uint32) error {
+	if shard := self.GetShard(shardId); shard != nil && shard.HasServer(self.LocalServer.Id) {
+		return fmt.Errorf("Shard %d isn't orphaned on server %d, drop it from the cluster instead", shardId, self.LocalServer.Id)
+	}
+	log.Info("Dropping orphaned shard %d", shardId)
+	return self.shardStore.DeleteShard(shardId)
+}
+
+// Returns the shards stored on the local disk that the cluster doesn't
+// assign to this server
+func (self *ClusterConfiguration) LocalOrphanedShards() ([]*OrphanedShard, error) {
+	sizes, err := self.shardStore.ShardSizes()
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]*OrphanedShard, 0)
+	for shardId, size := range sizes {
+		if shard := self.GetShard(shardId); shard != nil && shard.HasServer(self.LocalServer.Id) {
+			continue
+		}
+		orphans = append(orphans, &OrphanedShard{ShardId: shardId, ServerId: self.LocalServer.Id, Size: size})
+	}
+	return orphans, nil
+}
+
+// called by the server, this will periodically look for orphaned shards
+// on the local disk and log them. If orphaned shards are to be deleted,
+// a shard is only deleted once it's still orphaned at the next sweep, in
+// case this server is behind on the raft log and hasn't heard of the
+// shard yet.
+func (self *ClusterConfiguration) PeriodicallySweepOrphanedShards() {
+	interval := self.config.OrphanedShardSweepPeriod
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		suspects := make(map[uint32]bool)
+		for {
+			time.Sleep(interval)
+			suspects = self.sweepOrphanedShards(suspects, self.config.DeleteOrphanedShards)
+		}
+	}()
+}
+
+// Logs the local orphaned shards and deletes the ones that were already
+// suspected at the previous sweep if remove is set. Returns the shards
+// to suspect at the next sweep.
+func (self *ClusterConfiguration) sweepOrphanedShards(suspects map[uint32]bool, remove bool) map[uint32]bool {
+	orphans, err := self.LocalOrphanedShards()
+	if err != nil {
+		log.Error("Cannot look for orphaned shards: %s", err)
+		return suspects
+	}
+	next := make(map[uint32]bool, len(orphans))
+	for _, orphan := range orphans {
+		if !remove || !suspects[orphan.ShardId] {
+			log.Warn("Shard %d (%d bytes) is stored on server %d but the cluster doesn't assign it to the server", orphan.ShardId, orphan.Size, orphan.ServerId)
+			next[orphan.ShardId] = true
+			continue
+		}
+		if err := self.DropOrphanedShard(orphan.ShardId); err != nil {
+			log.Error("Cannot drop orphaned shard %d: %s", orphan.ShardId, err)
+			next[orphan.ShardId] = true
+		}
+	}
+	return next
+}
+
+func (self *ClusterConfiguration) makeShardAdminRequest(server *ClusterServer, requestType *p.Request_Type, shardId uint32, user common.User) (*p.Response, error) {
+	userName := user.GetName()
+	isDbUser := !user.IsClusterAdmin()
+	request := &p.Request{
+		Type:     requestType,
+		Database: p.String(""),
+		UserName: &userName,
+		IsDbUser: &isDbUser,
+		ShardId:  &shardId,
+	}
+
+	responseChan := make(chan *p.Response, 1)
+	server.MakeRequest(request, responseChan)
+	response := <-responseChan
+	if response.ErrorMessage != nil {
+		return nil, errors.New(response.GetErrorMessage())
+	}
+	if response.GetType() == accessDeniedResponse {
+		return nil, fmt.Errorf("Access denied to the shards of server %d", server.Id)
+	}
+	return response, nil
+}
+
+// Compacts the local copy of the shard, returns its size on disk before
+// and after the compaction
+func (self *ClusterConfiguration) CompactShard(shardId uint32) (int64, int64, error) {
+	shard := self.GetShard(shardId)
+	if shard == nil || !shard.IsLocal {
+		return 0, 0, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	sizes, err := self.shardStore.ShardSizes()
+	if err != nil {
+		return 0, 0, err
+	}
+	before := sizes[shardId]
+	if err := self.shardStore.CompactShard(shardId); err != nil {
+		return 0, 0, err
+	}
+	if sizes, err = self.shardStore.ShardSizes(); err != nil {
+		return 0, 0, err
+	}
+	return before, sizes[shardId], nil
+}
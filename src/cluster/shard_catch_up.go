@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	p "protocol"
+
+	log "code.google.com/p/log4go"
+)
+
+// Catching up replays the writes the local copy of a shard missed while
+// this server was down from the write log of another replica, which is
+// much cheaper than comparing the checksums of the whole shard. The
+// local copy remembers the last write sequence of every replica it
+// caught up to. If the other replica dropped some of the writes since
+// then from its log, the shard is copied from it with CopyShard instead.
+
+var (
+	writesSinceRequest    = p.Request_WRITES_SINCE
+	writeLogEntryResponse = p.Response_WRITE_LOG_ENTRY
+)
+
+// Replays the writes logged by the replica of the shard on the source
+// server since the local copy last caught up to it. Returns the number
+// of writes replayed.
+func (self *ClusterConfiguration) CatchUpShard(shardId, sourceId uint32, user common.User) (int, error) {
+	shard := self.GetShard(shardId)
+	if shard == nil || !shard.IsLocal {
+		return 0, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	source := self.GetServerById(&sourceId)
+	if source == nil || !shard.HasServer(sourceId) {
+		return 0, fmt.Errorf("Server %d doesn't have a replica of shard %d", sourceId, shardId)
+	}
+
+	local, err := self.shardStore.GetOrCreateShard(shardId)
+	if err != nil {
+		return 0, err
+	}
+	defer self.shardStore.ReturnShard(shardId)
+	since, err := local.ReplicaSequence(sourceId)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info("Catching up shard %d with the writes of server %d since %d", shardId, sourceId, since)
+	request := shard.createRepairRequest("", user)
+	request.Type = &writesSinceRequest
+	request.SinceWriteSequence = &since
+	responseChan := make(chan *p.Response, 100)
+	source.MakeRequest(request, responseChan)
+
+	replayed := 0
+	last := since
+	for {
+		response := <-responseChan
+		switch response.GetType() {
+		case writeLogEntryResponse:
+			write := &p.Request{
+				Type:        &writeRequest,
+				Database:    response.Request.Database,
+				ShardId:     &shardId,
+				MultiSeries: []*p.Series{response.Series},
+			}
+			if err := self.shardStore.Write(write); err != nil {
+				return replayed, err
+			}
+			if sequence := response.Request.GetSequenceNumber(); sequence != last {
+				last = sequence
+				replayed++
+			}
+			continue
+		case accessDeniedResponse:
+			return replayed, fmt.Errorf("Access denied to shard %d on server %d", shardId, sourceId)
+		case endStreamResponse:
+		default:
+			continue
+		}
+
+		if response.ErrorMessage != nil {
+			return replayed, errors.New(response.GetErrorMessage())
+		}
+		if response.GetWriteLogTruncated() {
+			log.Info("Server %d doesn't have the writes of shard %d since %d anymore, copying the shard", sourceId, shardId, since)
+			if err := self.CopyShard(shardId, self.LocalServer.Id, user); err != nil {
+				return replayed, err
+			}
+		}
+		return replayed, local.SetReplicaSequence(sourceId, response.GetWriteSequence())
+	}
+}
+
+// Catches up the local copy of the shard with every other replica
+// that's up, returns the number of writes replayed
+func (self *ClusterConfiguration) CatchUpShardWithReplicas(shardId uint32, user common.User) (int, error) {
+	shard := self.GetShard(shardId)
+	if shard == nil || !shard.IsLocal {
+		return 0, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	replayed := 0
+	for _, server := range shard.clusterServers {
+		if !server.IsUp() {
+			continue
+		}
+		count, err := self.CatchUpShard(shardId, server.Id, user)
+		replayed += count
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Yields the series of the writes the local copy of the shard logged
+// since the given sequence, see LocalShardDb.WritesSince
+func (self *ClusterConfiguration) LocalWritesSince(shardId uint32, sequence uint64, yield func(sequence uint64, database string, series []*p.Series) error) (uint64, error) {
+	local, err := self.shardStore.GetOrCreateShard(shardId)
+	if err != nil {
+		return 0, err
+	}
+	defer self.shardStore.ReturnShard(shardId)
+	return local.WritesSince(sequence, yield)
+}
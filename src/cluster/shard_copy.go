@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	p "protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Copying a shard streams every range whose checksum differs between
+// the source and the target replica from the source to the target, then
+// compares the checksums again. The target pulls each range straight
+// from the source over the cluster protocol, the server running the
+// copy only tells it which ranges to pull. Writes that are sent to the
+// shard while the copy is running already go to the target, so a
+// mismatch after a copy only lasts until those writes are delivered.
+// Since ranges that match are skipped, a copy that was interrupted picks
+// up where it left off when it's started again.
+
+const (
+	SHARD_COPY_ATTEMPTS    = 5
+	SHARD_COPY_RETRY_DELAY = 5 * time.Second
+)
+
+// a copy of a shard that's either stored on this server or on a remote one
+type shardReplica interface {
+	checksums(database string, user common.User, ranges int, start, end int64) ([]uint64, error)
+	read(database string, user common.User, start, end int64, yield func(*p.Series) error) error
+	write(database string, series *p.Series) error
+}
+
+type localReplica struct {
+	shard *ShardData
+	store LocalShardStore
+}
+
+func (self *localReplica) checksums(database string, user common.User, ranges int, start, end int64) ([]uint64, error) {
+	processor := newChecksumProcessor(self.shard, ranges)
+	if err := self.query(database, user, start, end, processor); err != nil {
+		return nil, err
+	}
+	return processor.checksums, nil
+}
+
+func (self *localReplica) read(database string, user common.User, start, end int64, yield func(*p.Series) error) error {
+	forwarder := &repairForwarder{write: yield}
+	if err := self.query(database, user, start, end, forwarder); err != nil {
+		return err
+	}
+	forwarder.flush()
+	return forwarder.err
+}
+
+func (self *localReplica) query(database string, user common.User, start, end int64, processor QueryProcessor) error {
+	querySpec, err := repairQuerySpec(database, user, start, end)
+	if err != nil {
+		return err
+	}
+
+	shard, err := self.store.GetOrCreateShard(self.shard.id)
+	if err != nil {
+		return err
+	}
+	defer self.store.ReturnShard(self.shard.id)
+	return shard.Query(querySpec, processor)
+}
+
+func (self *localReplica) write(database string, series *p.Series) error {
+	request := &p.Request{
+		Type:        &writeRequest,
+		Database:    &database,
+		ShardId:     &self.shard.id,
+		MultiSeries: []*p.Series{series},
+	}
+	self.shard.throttle.Wait(fmt.Sprintf("%d", self.shard.localServerId), request.Size())
+	return self.store.Write(request)
+}
+
+type remoteReplica struct {
+	shard  *ShardData
+	server *ClusterServer
+}
+
+func (self *remoteReplica) checksums(database string, user common.User, ranges int, start, end int64) ([]uint64, error) {
+	return self.shard.remoteChecksums(self.server, database, user, ranges, start, end)
+}
+
+func (self *remoteReplica) read(database string, user common.User, start, end int64, yield func(*p.Series) error) error {
+	request := self.shard.createRepairRequest(database, user)
+	request.Query = p.String(repairQueryString(start, end))
+
+	responseChan := make(chan *p.Response, 100)
+	self.server.MakeRequest(request, responseChan)
+	for {
+		response := <-responseChan
+		switch response.GetType() {
+		case endStreamResponse, accessDeniedResponse:
+			if response.ErrorMessage != nil {
+				return errors.New(response.GetErrorMessage())
+			}
+			return nil
+		}
+
+		if response.Series == nil || len(response.Series.Points) == 0 {
+			continue
+		}
+		if err := yield(response.Series); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *remoteReplica) write(database string, series *p.Series) error {
+	request := &p.Request{
+		Type:        &writeRequest,
+		Database:    &database,
+		ShardId:     &self.shard.id,
+		MultiSeries: []*p.Series{series},
+	}
+	self.shard.throttle.Wait(fmt.Sprintf("%d", self.server.Id), request.Size())
+	return self.server.Write(request)
+}
+
+// Copies the data of the shard to the replica on the given server from
+// one of the other replicas and verifies that both copies match.
+func (self *ClusterConfiguration) CopyShard(shardId, serverId uint32, user common.User) error {
+	shard := self.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Cannot find shard %d", shardId)
+	}
+
+	target, err := self.shardReplica(shard, serverId)
+	if err != nil {
+		return err
+	}
+	source, sourceId, err := self.copySource(shard, serverId)
+	if err != nil {
+		return err
+	}
+	if err := self.checkTombstonesApplied(shard, sourceId, user); err != nil {
+		return err
+	}
+
+	log.Info("Copying shard %d from server %d to server %d", shardId, sourceId, serverId)
+	for attempt := 1; ; attempt++ {
+		copied := 0
+		for _, database := range self.GetDatabases() {
+			name := database.Name
+			count, err := copyDifferingRanges(shard, source, target, name, user, func(start, end int64) error {
+				return self.copyShardRange(shard, sourceId, serverId, name, user, start, end)
+			})
+			copied += count
+			if err != nil {
+				return err
+			}
+		}
+		if copied == 0 {
+			log.Info("Shard %d on server %d matches server %d", shardId, serverId, sourceId)
+			return nil
+		}
+		if attempt == SHARD_COPY_ATTEMPTS {
+			return fmt.Errorf("Shard %d on server %d still differs from server %d after %d attempts", shardId, serverId, sourceId, attempt)
+		}
+		log.Debug("Copied %d ranges of shard %d to server %d, verifying", copied, shardId, serverId)
+		time.Sleep(SHARD_COPY_RETRY_DELAY)
+	}
+}
+
+// Pulls the points of the shard in [start, end) from the source server
+// into the local copy of the shard. Called on the target of a copy.
+func (self *ClusterConfiguration) CopyShardRange(shardId, sourceId uint32, database string, user common.User, start, end int64) error {
+	// the replica may not have been added here yet if raft is behind,
+	// the points only need the shard id to be stored
+	shard := self.GetLocalShardById(shardId)
+	return self.copyShardRange(shard, sourceId, self.LocalServer.Id, database, user, start, end)
+}
+
+// has the target replica pull the range from the source replica
+func (self *ClusterConfiguration) copyShardRange(shard *ShardData, sourceId, targetId uint32, database string, user common.User, start, end int64) error {
+	if self.LocalServer != nil && targetId == self.LocalServer.Id {
+		source := self.GetServerById(&sourceId)
+		if source == nil {
+			return fmt.Errorf("Cannot find server %d", sourceId)
+		}
+		local := &localReplica{shard, self.shardStore}
+		return (&remoteReplica{shard, source}).read(database, user, start, end, func(series *p.Series) error {
+			return local.write(database, series)
+		})
+	}
+
+	target := self.GetServerById(&targetId)
+	if target == nil {
+		return fmt.Errorf("Cannot find server %d", targetId)
+	}
+	request := shard.createRepairRequest(database, user)
+	request.Type = &copyShardRangeRequest
+	request.CopySourceServerId = &sourceId
+	request.CopyStartTime = &start
+	request.CopyEndTime = &end
+
+	responseChan := make(chan *p.Response, 1)
+	target.MakeRequest(request, responseChan)
+	response := <-responseChan
+	if response.ErrorMessage != nil {
+		return errors.New(response.GetErrorMessage())
+	}
+	if response.GetType() == accessDeniedResponse {
+		return fmt.Errorf("Access denied to shard %d on server %d", shard.id, targetId)
+	}
+	return nil
+}
+
+func (self *ClusterConfiguration) shardReplica(shard *ShardData, serverId uint32) (shardReplica, error) {
+	if self.LocalServer != nil && serverId == self.LocalServer.Id {
+		return &localReplica{shard, self.shardStore}, nil
+	}
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return nil, fmt.Errorf("Cannot find server %d", serverId)
+	}
+	return &remoteReplica{shard, server}, nil
+}
+
+// returns a replica of the shard other than the target to copy from,
+// the local copy is preferred over remote ones
+func (self *ClusterConfiguration) copySource(shard *ShardData, targetId uint32) (shardReplica, uint32, error) {
+	if shard.IsLocal && shard.localServerId != targetId {
+		return &localReplica{shard, self.shardStore}, shard.localServerId, nil
+	}
+	for _, server := range shard.clusterServers {
+		if server.Id != targetId && server.IsUp() {
+			return &remoteReplica{shard, server}, server.Id, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("There's no replica of shard %d to copy from", shard.id)
+}
+
+// copies the ranges of the database whose checksums differ from source
+// to target using copyRange and returns the number of ranges copied
+func copyDifferingRanges(shard *ShardData, source, target shardReplica, database string, user common.User, copyRange func(start, end int64) error) (int, error) {
+	sourceChecksums, err := source.checksums(database, user, DEFAULT_REPAIR_RANGES, shard.startMicro, shard.endMicro)
+	if err != nil {
+		return 0, err
+	}
+	targetChecksums, err := target.checksums(database, user, DEFAULT_REPAIR_RANGES, shard.startMicro, shard.endMicro)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for idx, checksum := range sourceChecksums {
+		if idx < len(targetChecksums) && targetChecksums[idx] == checksum {
+			continue
+		}
+		start, end := shard.repairRange(idx, DEFAULT_REPAIR_RANGES)
+		if err := copyRange(start, end); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A write lease makes a single server the coordinator of the writes to a
+// shard for a bounded amount of time, the other servers forward their
+// writes to it. Leases are granted through raft, so a server cut off
+// from the majority can't get one and the server holding a lease on the
+// other side of the partition keeps it until it runs out. The holder
+// stops using its lease a bit before it runs out to make up for the
+// clocks of the servers not being in sync.
+
+type ShardLease struct {
+	ShardId    uint32    `json:"shardId"`
+	ServerId   uint32    `json:"serverId"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// Returns true if the lease is still valid at the given time
+func (self *ShardLease) IsValid(now time.Time) bool {
+	return self != nil && now.Before(self.Expiration)
+}
+
+// Grants the lease of the shard to the server until expiration, unless
+// another server holds a lease that's still valid at now. The time is
+// the one of the server that asked for the lease so that every server
+// comes to the same decision when applying the raft command.
+func (self *ClusterConfiguration) AcquireShardLease(shardId, serverId uint32, now, expiration time.Time) (*ShardLease, error) {
+	self.shardLeasesLock.Lock()
+	defer self.shardLeasesLock.Unlock()
+	current := self.shardLeases[shardId]
+	if current.IsValid(now) && current.ServerId != serverId {
+		return nil, fmt.Errorf("Shard %d is leased to server %d until %s", shardId, current.ServerId, current.Expiration)
+	}
+	if current == nil || current.ServerId != serverId {
+		log.Info("Leasing shard %d to server %d until %s", shardId, serverId, expiration)
+	}
+	lease := &ShardLease{ShardId: shardId, ServerId: serverId, Expiration: expiration}
+	self.shardLeases[shardId] = lease
+	return lease, nil
+}
+
+// Returns the last lease granted for the shard, nil if there's none
+func (self *ClusterConfiguration) GetShardLease(shardId uint32) *ShardLease {
+	self.shardLeasesLock.RLock()
+	defer self.shardLeasesLock.RUnlock()
+	return self.shardLeases[shardId]
+}
+
+// drops the leases of the shards that don't exist anymore
+func (self *ClusterConfiguration) pruneShardLeases() {
+	self.shardLeasesLock.Lock()
+	defer self.shardLeasesLock.Unlock()
+	for shardId := range self.shardLeases {
+		if self.GetShard(shardId) == nil {
+			delete(self.shardLeases, shardId)
+		}
+	}
+}
+
+func (self *ClusterConfiguration) restoreShardLeases(data *SavedConfiguration) {
+	self.shardLeasesLock.Lock()
+	defer self.shardLeasesLock.Unlock()
+	self.shardLeases = make(map[uint32]*ShardLease, len(data.ShardLeases))
+	for _, lease := range data.ShardLeases {
+		self.shardLeases[lease.ShardId] = lease
+	}
+}
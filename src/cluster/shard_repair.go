@@ -0,0 +1,533 @@
+package cluster
+
+import (
+	"common"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"parser"
+	p "protocol"
+
+	log "code.google.com/p/log4go"
+)
+
+// Anti-entropy repair splits the time range of a shard into a fixed
+// number of ranges and computes a checksum of the points in each
+// range. Ranges whose checksums don't match the ones of a remote
+// replica are read from that replica and written to the local store.
+// Repairs only ever pull data into the local copy, every replica runs
+// its own repair to converge. Read repairs are the exception, they only
+// look at the ranges a query touched and copy differing ranges both ways.
+// A range that differs is narrowed down like a merkle tree before it's
+// copied, so a few missing points don't copy a whole range.
+
+const (
+	DEFAULT_REPAIR_RANGES = 64
+
+	// a differing range is split in this many ranges at every level it's
+	// narrowed down, down to REPAIR_NARROWING_DEPTH levels
+	REPAIR_RANGE_SPLIT     = 8
+	REPAIR_NARROWING_DEPTH = 2
+
+	// the number of points sent in a single write when pushing a range
+	// to a remote replica
+	REPAIR_WRITE_BATCH_SIZE = 1000
+)
+
+var (
+	shardChecksumsRequest = p.Request_SHARD_CHECKSUMS
+	copyShardRangeRequest = p.Request_COPY_SHARD_RANGE
+	writeRequest          = p.Request_WRITE
+)
+
+type checksumProcessor struct {
+	shard     *ShardData
+	checksums []uint64
+	hash      hash.Hash64
+}
+
+func newChecksumProcessor(shard *ShardData, ranges int) *checksumProcessor {
+	return &checksumProcessor{
+		shard:     shard,
+		checksums: make([]uint64, ranges, ranges),
+		hash:      fnv.New64a(),
+	}
+}
+
+func (self *checksumProcessor) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	if point != nil {
+		self.addPoint(*seriesName, columnNames, point)
+	}
+	return true
+}
+
+func (self *checksumProcessor) YieldSeries(series *p.Series) bool {
+	for _, point := range series.Points {
+		self.addPoint(series.GetName(), series.Fields, point)
+	}
+	return true
+}
+
+func (self *checksumProcessor) Close() {}
+
+func (self *checksumProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *checksumProcessor) GetName() string {
+	return "ChecksumProcessor"
+}
+
+// sends the points yielded by a local query to a remote replica in batches
+type repairForwarder struct {
+	series *p.Series
+	write  func(*p.Series) error
+	err    error
+}
+
+func (self *repairForwarder) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	if point == nil {
+		return self.err == nil
+	}
+	if self.series != nil && (self.series.GetName() != *seriesName || !sameFields(self.series.Fields, columnNames)) {
+		self.flush()
+	}
+	if self.series == nil {
+		self.series = &p.Series{Name: seriesName, Fields: columnNames}
+	}
+	self.series.Points = append(self.series.Points, point)
+	if len(self.series.Points) >= REPAIR_WRITE_BATCH_SIZE {
+		self.flush()
+	}
+	return self.err == nil
+}
+
+func (self *repairForwarder) YieldSeries(series *p.Series) bool {
+	for _, point := range series.Points {
+		if !self.YieldPoint(series.Name, series.Fields, point) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *repairForwarder) Close() {}
+
+func (self *repairForwarder) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *repairForwarder) GetName() string {
+	return "RepairForwarder"
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *repairForwarder) flush() {
+	if self.series == nil || len(self.series.Points) == 0 || self.err != nil {
+		self.series = nil
+		return
+	}
+	self.err = self.write(self.series)
+	self.series = nil
+}
+
+// the checksum of a range is the sum of the hashes of its values, so
+// the order in which the points are yielded doesn't matter
+func (self *checksumProcessor) addPoint(seriesName string, fields []string, point *p.Point) {
+	idx := self.shard.repairRangeIndex(point.GetTimestamp(), len(self.checksums))
+	if idx < 0 {
+		return
+	}
+	for i, value := range point.Values {
+		if value == nil || value.GetIsNull() || i >= len(fields) {
+			continue
+		}
+		self.hash.Reset()
+		self.hash.Write([]byte(seriesName))
+		self.hash.Write([]byte(fields[i]))
+		binary.Write(self.hash, binary.BigEndian, point.GetTimestamp())
+		binary.Write(self.hash, binary.BigEndian, point.GetSequenceNumber())
+		self.hash.Write([]byte(point.GetFieldValueAsString(i)))
+		self.checksums[idx] += self.hash.Sum64()
+	}
+}
+
+// Returns the checksums of the local copy of the shard for the given database
+func (self *ShardData) LocalChecksums(database string, user common.User, ranges int) ([]uint64, error) {
+	return self.LocalChecksumsInRange(database, user, ranges, self.startMicro, self.endMicro)
+}
+
+// Same as LocalChecksums but only the points in [start, end) are
+// included, the checksums of the ranges outside of it are zero
+func (self *ShardData) LocalChecksumsInRange(database string, user common.User, ranges int, start, end int64) ([]uint64, error) {
+	if !self.IsLocal {
+		return nil, fmt.Errorf("Shard %d isn't stored on this server", self.id)
+	}
+	if ranges <= 0 {
+		ranges = DEFAULT_REPAIR_RANGES
+	}
+
+	return (&localReplica{self, self.store}).checksums(database, user, ranges, start, end)
+}
+
+// Compares the local copy of the shard with the copies on the other
+// servers that are up, and copies over any range that doesn't match.
+// Returns the number of ranges that were copied.
+func (self *ShardData) Repair(database string, user common.User, ranges int) (int, error) {
+	if ranges <= 0 {
+		ranges = DEFAULT_REPAIR_RANGES
+	}
+
+	local, err := self.LocalChecksums(database, user, ranges)
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	for _, server := range self.clusterServers {
+		if !server.IsUp() {
+			log.Debug("REPAIR: skipping shard %d on server %d since it's down", self.id, server.Id)
+			continue
+		}
+
+		remote, tombstoneId, err := self.remoteChecksumsAndTombstone(server, database, user, ranges, self.startMicro, self.endMicro)
+		if err != nil {
+			log.Warn("REPAIR: cannot get checksums of shard %d from server %d: %s", self.id, server.Id, err)
+			continue
+		}
+		if !self.hasAppliedTombstones(tombstoneId) {
+			log.Info("REPAIR: skipping shard %d on server %d until it has applied the deletes of the shard", self.id, server.Id)
+			continue
+		}
+
+		for idx, checksum := range local {
+			if idx >= len(remote) || remote[idx] == checksum {
+				continue
+			}
+			start, end := self.repairRange(idx, ranges)
+			differing, err := narrowDifferingRange(self, &localReplica{self, self.store}, &remoteReplica{self, server}, database, user, ranges, idx)
+			if err != nil {
+				log.Warn("REPAIR: cannot narrow down range [%d, %d) of shard %d, copying all of it: %s", start, end, self.id, err)
+				differing = [][2]int64{{start, end}}
+			}
+			for _, r := range differing {
+				log.Info("REPAIR: shard %d range [%d, %d) of %s differs from server %d", self.id, r[0], r[1], database, server.Id)
+				if err := self.copyRangeFromServer(server, database, user, r[0], r[1]); err != nil {
+					return repaired, err
+				}
+				repaired++
+			}
+		}
+	}
+	return repaired, nil
+}
+
+// Compares the ranges of the local copy of the shard that overlap the
+// time range of the query with the other replicas. A range that differs
+// is copied in both directions, since there's no way to tell which of
+// the copies is missing points. Points are keyed by timestamp and
+// sequence number, so writing a point a replica already has is a no-op.
+// Returns the number of ranges that were copied.
+func (self *ShardData) ReadRepair(querySpec *parser.QuerySpec) (int, error) {
+	database := querySpec.Database()
+	user := querySpec.User()
+
+	start, end := self.queryRange(querySpec)
+	if start >= end {
+		return 0, nil
+	}
+
+	if self.tombstones != nil && !self.hasAppliedTombstones(self.tombstones.AppliedTombstoneId()) {
+		log.Debug("READ REPAIR: skipping shard %d until the local copy has applied its deletes", self.id)
+		return 0, nil
+	}
+
+	local, err := self.LocalChecksumsInRange(database, user, DEFAULT_REPAIR_RANGES, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	firstRange := self.repairRangeIndex(start, DEFAULT_REPAIR_RANGES)
+	lastRange := self.repairRangeIndex(end-1, DEFAULT_REPAIR_RANGES)
+
+	repaired := 0
+	for _, server := range self.clusterServers {
+		if !server.IsUp() {
+			continue
+		}
+
+		remote, tombstoneId, err := self.remoteChecksumsAndTombstone(server, database, user, DEFAULT_REPAIR_RANGES, start, end)
+		if err != nil {
+			log.Warn("READ REPAIR: cannot get checksums of shard %d from server %d: %s", self.id, server.Id, err)
+			continue
+		}
+		if !self.hasAppliedTombstones(tombstoneId) {
+			continue
+		}
+
+		for idx := firstRange; idx <= lastRange; idx++ {
+			if idx >= len(remote) || remote[idx] == local[idx] {
+				continue
+			}
+			rangeStart, rangeEnd := self.repairRange(idx, DEFAULT_REPAIR_RANGES)
+			if rangeStart < start {
+				rangeStart = start
+			}
+			if rangeEnd > end {
+				rangeEnd = end
+			}
+			log.Info("READ REPAIR: shard %d range [%d, %d) of %s differs from server %d", self.id, rangeStart, rangeEnd, database, server.Id)
+			if err := self.copyRangeToServer(server, database, user, rangeStart, rangeEnd); err != nil {
+				return repaired, err
+			}
+			if err := self.copyRangeFromServer(server, database, user, rangeStart, rangeEnd); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// Makes the local copy of the shard include every point of the time
+// range of the query that a quorum of the replicas has, by pulling the
+// ranges that differ from enough of the other replicas to make a
+// quorum with the local one. A write acknowledged with quorum
+// consistency is on at least one of them. Replicas that haven't applied
+// the deletes of the shard yet can't be used, if there aren't enough
+// replicas left the query fails instead of returning stale results.
+func (self *ShardData) ReconcileForQuorumRead(querySpec *parser.QuerySpec) error {
+	// the local copy counts towards the quorum
+	needed := len(self.serverIds) / 2
+	if needed <= 0 {
+		return nil
+	}
+	if self.tombstones != nil && !self.hasAppliedTombstones(self.tombstones.AppliedTombstoneId()) {
+		return fmt.Errorf("Shard %d hasn't applied its deletes on this server yet", self.id)
+	}
+
+	start, end := self.queryRange(querySpec)
+	if start >= end {
+		return nil
+	}
+	database := querySpec.Database()
+	user := querySpec.User()
+	local, err := self.LocalChecksumsInRange(database, user, DEFAULT_REPAIR_RANGES, start, end)
+	if err != nil {
+		return err
+	}
+	firstRange := self.repairRangeIndex(start, DEFAULT_REPAIR_RANGES)
+	lastRange := self.repairRangeIndex(end-1, DEFAULT_REPAIR_RANGES)
+
+	reconciled := 0
+	for _, server := range self.clusterServers {
+		if reconciled == needed {
+			break
+		}
+		if !server.IsUp() {
+			continue
+		}
+
+		remote, tombstoneId, err := self.remoteChecksumsAndTombstone(server, database, user, DEFAULT_REPAIR_RANGES, start, end)
+		if err != nil {
+			log.Warn("QUORUM READ: cannot get checksums of shard %d from server %d: %s", self.id, server.Id, err)
+			continue
+		}
+		if !self.hasAppliedTombstones(tombstoneId) {
+			continue
+		}
+
+		for idx := firstRange; idx <= lastRange; idx++ {
+			if idx < len(remote) && remote[idx] == local[idx] {
+				continue
+			}
+			rangeStart, rangeEnd := self.repairRange(idx, DEFAULT_REPAIR_RANGES)
+			if rangeStart < start {
+				rangeStart = start
+			}
+			if rangeEnd > end {
+				rangeEnd = end
+			}
+			log.Debug("QUORUM READ: pulling range [%d, %d) of shard %d from server %d", rangeStart, rangeEnd, self.id, server.Id)
+			if err := self.copyRangeFromServer(server, database, user, rangeStart, rangeEnd); err != nil {
+				return err
+			}
+		}
+		reconciled++
+	}
+
+	if reconciled < needed {
+		return fmt.Errorf("Cannot read shard %d from a quorum of its replicas, only %d of %d are available", self.id, reconciled+1, len(self.serverIds))
+	}
+	return nil
+}
+
+// returns the time range of the query in microseconds limited to the
+// range of the shard
+func (self *ShardData) queryRange(querySpec *parser.QuerySpec) (int64, int64) {
+	start := common.TimeToMicroseconds(querySpec.GetStartTime())
+	if start < self.startMicro {
+		start = self.startMicro
+	}
+	end := common.TimeToMicroseconds(querySpec.GetEndTime())
+	if end > self.endMicro {
+		end = self.endMicro
+	}
+	return start, end
+}
+
+func (self *ShardData) remoteChecksums(server *ClusterServer, database string, user common.User, ranges int, start, end int64) ([]uint64, error) {
+	checksums, _, err := self.remoteChecksumsAndTombstone(server, database, user, ranges, start, end)
+	return checksums, err
+}
+
+// Same as remoteChecksums, also returns the id of the last tombstone
+// the remote server applied
+func (self *ShardData) remoteChecksumsAndTombstone(server *ClusterServer, database string, user common.User, ranges int, start, end int64) ([]uint64, uint32, error) {
+	request := self.createRepairRequest(database, user)
+	request.Type = &shardChecksumsRequest
+	request.ChecksumRanges = p.Uint32(uint32(ranges))
+	request.ChecksumStartTime = &start
+	request.ChecksumEndTime = &end
+
+	responseChan := make(chan *p.Response, 1)
+	server.MakeRequest(request, responseChan)
+	response := <-responseChan
+	if response.ErrorMessage != nil {
+		return nil, 0, errors.New(response.GetErrorMessage())
+	}
+	if response.GetType() == accessDeniedResponse {
+		return nil, 0, fmt.Errorf("Access denied to shard %d on server %d", self.id, server.Id)
+	}
+	return response.Checksums, response.GetAppliedTombstoneId(), nil
+}
+
+// Copying points from a replica that hasn't run every delete of the
+// shard yet would bring the deleted points back
+func (self *ShardData) hasAppliedTombstones(appliedTombstoneId uint32) bool {
+	if self.tombstones == nil {
+		return true
+	}
+	return appliedTombstoneId >= self.tombstones.LastTombstoneIdForShard(self.id)
+}
+
+func (self *ShardData) copyRangeFromServer(server *ClusterServer, database string, user common.User, start, end int64) error {
+	local := &localReplica{self, self.store}
+	return (&remoteReplica{self, server}).read(database, user, start, end, func(series *p.Series) error {
+		return local.write(database, series)
+	})
+}
+
+func (self *ShardData) copyRangeToServer(server *ClusterServer, database string, user common.User, start, end int64) error {
+	remote := &remoteReplica{self, server}
+	return (&localReplica{self, self.store}).read(database, user, start, end, func(series *p.Series) error {
+		return remote.write(database, series)
+	})
+}
+
+func (self *ShardData) createRepairRequest(database string, user common.User) *p.Request {
+	userName := user.GetName()
+	isDbUser := !user.IsClusterAdmin()
+	return &p.Request{
+		Type:     &queryRequest,
+		ShardId:  &self.id,
+		UserName: &userName,
+		Database: &database,
+		IsDbUser: &isDbUser,
+	}
+}
+
+// returns the start and end (exclusive) in microseconds of the given range
+func (self *ShardData) repairRange(idx, ranges int) (int64, int64) {
+	width := (self.endMicro - self.startMicro) / int64(ranges)
+	start := self.startMicro + int64(idx)*width
+	end := start + width
+	if idx == ranges-1 {
+		end = self.endMicro
+	}
+	return start, end
+}
+
+// Narrows the range idx of the shard, whose checksums differ between the
+// two replicas, down to the smaller ranges in it that differ. Every level
+// splits the ranges that differed at the level above, only the points of
+// those ranges are checksummed again. Returns the [start, end) of the
+// ranges to copy, none if the replicas matched by the time they were
+// compared again.
+func narrowDifferingRange(shard *ShardData, a, b shardReplica, database string, user common.User, ranges, idx int) ([][2]int64, error) {
+	differing := []int{idx}
+	for depth := 0; depth < REPAIR_NARROWING_DEPTH; depth++ {
+		subRanges := ranges * REPAIR_RANGE_SPLIT
+		if (shard.endMicro-shard.startMicro)/int64(subRanges) == 0 {
+			break
+		}
+
+		seen := map[int]bool{}
+		next := []int{}
+		for _, i := range differing {
+			start, end := shard.repairRange(i, ranges)
+			aChecksums, err := a.checksums(database, user, subRanges, start, end)
+			if err != nil {
+				return nil, err
+			}
+			bChecksums, err := b.checksums(database, user, subRanges, start, end)
+			if err != nil {
+				return nil, err
+			}
+			for j, checksum := range aChecksums {
+				if seen[j] || (j < len(bChecksums) && bChecksums[j] == checksum) {
+					continue
+				}
+				seen[j] = true
+				next = append(next, j)
+			}
+		}
+		if len(next) == 0 {
+			return nil, nil
+		}
+		differing, ranges = next, subRanges
+	}
+
+	result := make([][2]int64, 0, len(differing))
+	for _, i := range differing {
+		start, end := shard.repairRange(i, ranges)
+		result = append(result, [2]int64{start, end})
+	}
+	return result, nil
+}
+
+func (self *ShardData) repairRangeIndex(t int64, ranges int) int {
+	if !self.IsMicrosecondInRange(t) {
+		return -1
+	}
+	width := (self.endMicro - self.startMicro) / int64(ranges)
+	if width == 0 {
+		return 0
+	}
+	idx := int((t - self.startMicro) / width)
+	if idx >= ranges {
+		idx = ranges - 1
+	}
+	return idx
+}
+
+func repairQueryString(start, end int64) string {
+	return fmt.Sprintf("select * from /.*/ where time > %du and time < %du", start-1, end)
+}
+
+func repairQuerySpec(database string, user common.User, start, end int64) (*parser.QuerySpec, error) {
+	queries, err := parser.ParseQuery(repairQueryString(start, end))
+	if err != nil {
+		return nil, err
+	}
+	return parser.NewQuerySpec(user, database, queries[0]), nil
+}
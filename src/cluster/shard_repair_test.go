@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"common"
+	p "protocol"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ShardRepairSuite struct{}
+
+var _ = Suite(&ShardRepairSuite{})
+
+// a replica that only knows the timestamps of its points
+type timestampsReplica struct {
+	shard      *ShardData
+	timestamps []int64
+}
+
+func (self *timestampsReplica) checksums(database string, user common.User, ranges int, start, end int64) ([]uint64, error) {
+	checksums := make([]uint64, ranges)
+	for _, t := range self.timestamps {
+		if t < start || t >= end {
+			continue
+		}
+		checksums[self.shard.repairRangeIndex(t, ranges)] += uint64(t)
+	}
+	return checksums, nil
+}
+
+func (self *timestampsReplica) read(database string, user common.User, start, end int64, yield func(*p.Series) error) error {
+	return nil
+}
+
+func (self *timestampsReplica) write(database string, series *p.Series) error {
+	return nil
+}
+
+func (self *ShardRepairSuite) TestDifferingRangesAreNarrowedDown(c *C) {
+	now := time.Now()
+	shard := NewShard(1, now.Add(-time.Hour), now, SHORT_TERM, false, nil)
+	missing := shard.startMicro + 10*int64(time.Second/time.Microsecond)
+	timestamps := []int64{shard.startMicro, missing, missing + 1000, shard.startMicro + 40*int64(time.Second/time.Microsecond)}
+	a := &timestampsReplica{shard, timestamps}
+	b := &timestampsReplica{shard, []int64{timestamps[0], timestamps[2], timestamps[3]}}
+
+	idx := shard.repairRangeIndex(missing, DEFAULT_REPAIR_RANGES)
+	differing, err := narrowDifferingRange(shard, a, b, "db1", nil, DEFAULT_REPAIR_RANGES, idx)
+	c.Assert(err, IsNil)
+	c.Assert(differing, HasLen, 1)
+	c.Assert(differing[0][0] <= missing && missing < differing[0][1], Equals, true)
+	ranges := DEFAULT_REPAIR_RANGES * REPAIR_RANGE_SPLIT * REPAIR_RANGE_SPLIT
+	c.Assert(differing[0][1]-differing[0][0], Equals, (shard.endMicro-shard.startMicro)/int64(ranges))
+
+	// nothing to copy if the replicas match when they're compared again
+	differing, err = narrowDifferingRange(shard, a, a, "db1", nil, DEFAULT_REPAIR_RANGES, idx)
+	c.Assert(err, IsNil)
+	c.Assert(differing, HasLen, 0)
+}
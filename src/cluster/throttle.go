@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits the background traffic sent to each destination (a server or
+// a remote cluster) so that recovering a replica doesn't starve the
+// writes and queries it's serving. Each destination gets its own bucket
+// that refills at the configured rates and holds up to a second worth
+// of traffic. A zero rate isn't limited, a nil throttle doesn't limit
+// anything.
+type Throttle struct {
+	bytesPerSecond    int64
+	requestsPerSecond int
+	lock              sync.Mutex
+	buckets           map[string]*throttleBucket
+}
+
+type throttleBucket struct {
+	bytes    float64
+	requests float64
+	last     time.Time
+}
+
+func NewThrottle(bytesPerSecond int64, requestsPerSecond int) *Throttle {
+	return &Throttle{
+		bytesPerSecond:    bytesPerSecond,
+		requestsPerSecond: requestsPerSecond,
+		buckets:           make(map[string]*throttleBucket),
+	}
+}
+
+// Blocks until a request of the given size can be sent to the
+// destination
+func (self *Throttle) Wait(destination string, bytes int) {
+	if wait := self.reserve(destination, bytes, time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Takes the request out of the bucket of the destination and returns
+// how long to wait before sending it. The bucket can go below zero, a
+// request bigger than the bucket waits for as long as it takes to send
+// it at the configured rate.
+func (self *Throttle) reserve(destination string, bytes int, now time.Time) time.Duration {
+	if self == nil || (self.bytesPerSecond <= 0 && self.requestsPerSecond <= 0) {
+		return 0
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	bucket := self.buckets[destination]
+	if bucket == nil {
+		bucket = &throttleBucket{
+			bytes:    float64(self.bytesPerSecond),
+			requests: float64(self.requestsPerSecond),
+			last:     now,
+		}
+		self.buckets[destination] = bucket
+	}
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.last = now
+
+	var wait time.Duration
+	if self.bytesPerSecond > 0 {
+		rate := float64(self.bytesPerSecond)
+		bucket.bytes = refill(bucket.bytes, elapsed, rate) - float64(bytes)
+		if d := deficit(bucket.bytes, rate); d > wait {
+			wait = d
+		}
+	}
+	if self.requestsPerSecond > 0 {
+		rate := float64(self.requestsPerSecond)
+		bucket.requests = refill(bucket.requests, elapsed, rate) - 1
+		if d := deficit(bucket.requests, rate); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func refill(available, elapsed, rate float64) float64 {
+	available += elapsed * rate
+	if available > rate {
+		return rate
+	}
+	return available
+}
+
+// the time it takes for the bucket to be back at zero
+func deficit(available, rate float64) time.Duration {
+	if available >= 0 {
+		return 0
+	}
+	return time.Duration(-available / rate * float64(time.Second))
+}
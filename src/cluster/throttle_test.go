@@ -0,0 +1,35 @@
+package cluster
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ThrottleSuite struct{}
+
+var _ = Suite(&ThrottleSuite{})
+
+func (self *ThrottleSuite) TestThrottleLimitsEachDestination(c *C) {
+	throttle := NewThrottle(1000, 0)
+	now := time.Now()
+
+	// the first second worth of traffic goes through right away
+	c.Assert(throttle.reserve("1", 1000, now), Equals, time.Duration(0))
+	c.Assert(throttle.reserve("1", 500, now), Equals, 500*time.Millisecond)
+	c.Assert(throttle.reserve("2", 1000, now), Equals, time.Duration(0))
+
+	// the bucket refills at the configured rate
+	c.Assert(throttle.reserve("1", 0, now.Add(time.Second)), Equals, time.Duration(0))
+}
+
+func (self *ThrottleSuite) TestThrottleLimitsRequestRate(c *C) {
+	throttle := NewThrottle(0, 2)
+	now := time.Now()
+	c.Assert(throttle.reserve("1", 1000000, now), Equals, time.Duration(0))
+	c.Assert(throttle.reserve("1", 1000000, now), Equals, time.Duration(0))
+	c.Assert(throttle.reserve("1", 1000000, now), Equals, 500*time.Millisecond)
+
+	var unlimited *Throttle
+	c.Assert(unlimited.reserve("1", 1000000, now), Equals, time.Duration(0))
+}
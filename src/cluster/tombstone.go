@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"parser"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Deletes and series drops are recorded as tombstones in the cluster
+// metadata before they're run. Tombstones are replicated through raft,
+// so a server that was down during a delete gets it once it catches up
+// and runs it against its copies of the shards the delete touched.
+// Every server keeps the id of the last tombstone it applied on disk,
+// tombstones are applied once and in order. Repairs don't copy data
+// from or to a replica that hasn't applied all the tombstones of the
+// shard yet, which would bring the deleted points back.
+
+const TOMBSTONE_STATE_FILE = "tombstones"
+
+type Tombstone struct {
+	Id       uint32 `json:"id"`
+	Database string `json:"database"`
+	// the delete query with its time condition or the drop series query
+	Query  string            `json:"query"`
+	Shards []*TombstoneShard `json:"shards"`
+	Time   time.Time         `json:"time"`
+}
+
+// A shard the tombstone applies to and the servers that had a copy of
+// it when the tombstone was created. Replicas added later get their
+// data from a replica that already applied it.
+type TombstoneShard struct {
+	ShardId   uint32   `json:"shardId"`
+	ServerIds []uint32 `json:"serverIds"`
+}
+
+type tombstoneState interface {
+	AppliedTombstoneId() uint32
+	LastTombstoneIdForShard(shardId uint32) uint32
+}
+
+// Called when the raft command is applied, assigns the id of the
+// tombstone and applies it to the local shards in the background
+func (self *ClusterConfiguration) AddTombstone(tombstone *Tombstone) error {
+	if _, err := parser.ParseQuery(tombstone.Query); err != nil {
+		return fmt.Errorf("Invalid tombstone query %s: %s", tombstone.Query, err)
+	}
+
+	self.tombstonesLock.Lock()
+	self.lastTombstoneId++
+	tombstone.Id = self.lastTombstoneId
+	self.tombstones = append(self.tombstones, tombstone)
+	self.tombstonesLock.Unlock()
+
+	go self.applyTombstones()
+	return nil
+}
+
+func (self *ClusterConfiguration) GetTombstones() []*Tombstone {
+	self.tombstonesLock.RLock()
+	defer self.tombstonesLock.RUnlock()
+	tombstones := make([]*Tombstone, len(self.tombstones))
+	copy(tombstones, self.tombstones)
+	return tombstones
+}
+
+func (self *ClusterConfiguration) AppliedTombstoneId() uint32 {
+	self.tombstonesLock.RLock()
+	defer self.tombstonesLock.RUnlock()
+	return self.appliedTombstoneId
+}
+
+// Returns the id of the last tombstone that touches the shard, 0 if
+// there's none
+func (self *ClusterConfiguration) LastTombstoneIdForShard(shardId uint32) uint32 {
+	self.tombstonesLock.RLock()
+	defer self.tombstonesLock.RUnlock()
+	for i := len(self.tombstones) - 1; i >= 0; i-- {
+		if self.tombstones[i].shard(shardId) != nil {
+			return self.tombstones[i].Id
+		}
+	}
+	return 0
+}
+
+func (self *Tombstone) shard(shardId uint32) *TombstoneShard {
+	for _, shard := range self.Shards {
+		if shard.ShardId == shardId {
+			return shard
+		}
+	}
+	return nil
+}
+
+// Applies the tombstones this server hasn't applied yet to its copies
+// of their shards
+func (self *ClusterConfiguration) applyTombstones() {
+	self.applyTombstonesLock.Lock()
+	defer self.applyTombstonesLock.Unlock()
+
+	for _, tombstone := range self.GetTombstones() {
+		if tombstone.Id <= self.AppliedTombstoneId() {
+			continue
+		}
+		if self.LocalServer == nil {
+			return
+		}
+		if err := self.applyTombstone(tombstone); err != nil {
+			// retried with the next tombstone or on restart
+			log.Error("Cannot apply tombstone %d (%s): %s", tombstone.Id, tombstone.Query, err)
+			return
+		}
+
+		self.tombstonesLock.Lock()
+		self.appliedTombstoneId = tombstone.Id
+		self.tombstonesLock.Unlock()
+		if err := self.saveAppliedTombstoneId(tombstone.Id); err != nil {
+			log.Error("Cannot save the id of the last applied tombstone: %s", err)
+		}
+	}
+}
+
+func (self *ClusterConfiguration) applyTombstone(tombstone *Tombstone) error {
+	queries, err := parser.ParseQuery(tombstone.Query)
+	if err != nil {
+		return err
+	}
+	names := self.GetClusterAdmins()
+	if len(names) == 0 {
+		return fmt.Errorf("There are no cluster admins to run the tombstone as")
+	}
+	querySpec := parser.NewQuerySpec(self.GetClusterAdmin(names[0]), tombstone.Database, queries[0])
+
+	for _, tombstoneShard := range tombstone.Shards {
+		if !containsId(tombstoneShard.ServerIds, self.LocalServer.Id) {
+			continue
+		}
+		shard := self.GetShard(tombstoneShard.ShardId)
+		if shard == nil || !shard.IsLocal {
+			// the shard was dropped in the meantime
+			continue
+		}
+		log.Info("Applying tombstone %d to shard %d: %s", tombstone.Id, shard.id, tombstone.Query)
+		responses, err := shard.deleteDataLocally(querySpec)
+		if err != nil {
+			return err
+		}
+		for len(responses) > 0 {
+			if response := <-responses; response.ErrorMessage != nil {
+				return errors.New(response.GetErrorMessage())
+			}
+		}
+	}
+	return nil
+}
+
+// Returns an error if the replica of the shard on the given server
+// hasn't applied every tombstone of the shard yet
+func (self *ClusterConfiguration) checkTombstonesApplied(shard *ShardData, serverId uint32, user common.User) error {
+	last := self.LastTombstoneIdForShard(shard.id)
+	databases := self.GetDatabases()
+	if last == 0 || len(databases) == 0 {
+		return nil
+	}
+
+	applied := self.AppliedTombstoneId()
+	if self.LocalServer == nil || serverId != self.LocalServer.Id {
+		server := self.GetServerById(&serverId)
+		if server == nil {
+			return fmt.Errorf("Cannot find server %d", serverId)
+		}
+		var err error
+		// the range is empty, only the tombstone id is needed
+		_, applied, err = shard.remoteChecksumsAndTombstone(server, databases[0].Name, user, 1, shard.startMicro, shard.startMicro)
+		if err != nil {
+			return err
+		}
+	}
+	if applied < last {
+		return fmt.Errorf("Server %d hasn't applied the deletes of shard %d yet, retry later", serverId, shard.id)
+	}
+	return nil
+}
+
+func (self *ClusterConfiguration) tombstoneStateFile() string {
+	return filepath.Join(self.config.DataDir, TOMBSTONE_STATE_FILE)
+}
+
+func (self *ClusterConfiguration) saveAppliedTombstoneId(id uint32) error {
+	if self.config.DataDir == "" {
+		return nil
+	}
+	tmp := self.tombstoneStateFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(uint64(id), 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.tombstoneStateFile())
+}
+
+func (self *ClusterConfiguration) loadAppliedTombstoneId() uint32 {
+	if self.config.DataDir == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(self.tombstoneStateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Cannot read the id of the last applied tombstone: %s", err)
+		}
+		return 0
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		log.Error("Cannot parse the id of the last applied tombstone: %s", err)
+		return 0
+	}
+	return uint32(id)
+}
+
+// Forgets the shards that don't exist anymore and the tombstones that
+// don't have any shards left
+func (self *ClusterConfiguration) pruneTombstones() {
+	self.tombstonesLock.Lock()
+	defer self.tombstonesLock.Unlock()
+	tombstones := make([]*Tombstone, 0, len(self.tombstones))
+	for _, tombstone := range self.tombstones {
+		shards := make([]*TombstoneShard, 0, len(tombstone.Shards))
+		for _, shard := range tombstone.Shards {
+			if self.GetShard(shard.ShardId) != nil {
+				shards = append(shards, shard)
+			}
+		}
+		if len(shards) == 0 {
+			continue
+		}
+		// the tombstone may be being applied, don't change it in place
+		pruned := *tombstone
+		pruned.Shards = shards
+		tombstones = append(tombstones, &pruned)
+	}
+	self.tombstones = tombstones
+}
+
+func (self *ClusterConfiguration) restoreTombstones(data *SavedConfiguration) {
+	self.tombstonesLock.Lock()
+	self.tombstones = data.Tombstones
+	self.lastTombstoneId = data.LastTombstoneId
+	self.tombstonesLock.Unlock()
+	go self.applyTombstones()
+}
@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"configuration"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type TombstoneSuite struct{}
+
+var _ = Suite(&TombstoneSuite{})
+
+func newTombstoneTestConfiguration() *ClusterConfiguration {
+	config := &configuration.Configuration{
+		ShortTermShard: &configuration.ShardConfiguration{},
+		LongTermShard:  &configuration.ShardConfiguration{},
+	}
+	return NewClusterConfiguration(config, nil, nil, nil)
+}
+
+func (self *TombstoneSuite) TestTombstonesAreNumberedInOrder(c *C) {
+	config := newTombstoneTestConfiguration()
+	c.Assert(config.AddTombstone(&Tombstone{
+		Database: "db1",
+		Query:    "drop series foo",
+		Shards:   []*TombstoneShard{&TombstoneShard{ShardId: 1, ServerIds: []uint32{1, 2}}},
+	}), IsNil)
+	c.Assert(config.AddTombstone(&Tombstone{
+		Database: "db1",
+		Query:    "delete from bar where time < 1400000000s",
+		Shards:   []*TombstoneShard{&TombstoneShard{ShardId: 2, ServerIds: []uint32{2, 3}}},
+	}), IsNil)
+	c.Assert(config.AddTombstone(&Tombstone{Database: "db1", Query: "not a query"}), NotNil)
+
+	tombstones := config.GetTombstones()
+	c.Assert(tombstones, HasLen, 2)
+	c.Assert(tombstones[0].Id, Equals, uint32(1))
+	c.Assert(tombstones[1].Id, Equals, uint32(2))
+	c.Assert(config.LastTombstoneIdForShard(1), Equals, uint32(1))
+	c.Assert(config.LastTombstoneIdForShard(2), Equals, uint32(2))
+	c.Assert(config.LastTombstoneIdForShard(3), Equals, uint32(0))
+}
+
+func (self *TombstoneSuite) TestRepairsSkipReplicasThatAreBehind(c *C) {
+	config := newTombstoneTestConfiguration()
+	c.Assert(config.AddTombstone(&Tombstone{
+		Database: "db1",
+		Query:    "drop series foo",
+		Shards:   []*TombstoneShard{&TombstoneShard{ShardId: 1, ServerIds: []uint32{1, 2}}},
+	}), IsNil)
+
+	now := time.Now()
+	shard := NewShard(1, now.Add(-time.Hour), now, SHORT_TERM, false, nil)
+	shard.tombstones = config
+	c.Assert(shard.hasAppliedTombstones(0), Equals, false)
+	c.Assert(shard.hasAppliedTombstones(1), Equals, true)
+
+	other := NewShard(2, now.Add(-time.Hour), now, SHORT_TERM, false, nil)
+	other.tombstones = config
+	c.Assert(other.hasAppliedTombstones(0), Equals, true)
+}
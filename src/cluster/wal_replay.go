@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"protocol"
+	"sync"
+)
+
+// how many requests are replayed to a server between commits
+const WAL_REPLAY_COMMIT_INTERVAL = 1000
+
+// Writes the requests replayed from the wal at startup with a bounded
+// number of workers, shared by the replays of all the servers. The
+// requests of a shard always go to the same worker, so they're written
+// in the order they were logged, the shards don't depend on each other.
+type walReplayPool struct {
+	workers []chan *replayJob
+}
+
+type replayJob struct {
+	request *protocol.Request
+	writer  Writer
+	replay  *serverReplay
+}
+
+// the requests replayed to one server that haven't been written yet and
+// the first error writing them
+type serverReplay struct {
+	pending sync.WaitGroup
+	errLock sync.Mutex
+	err     error
+}
+
+func newWalReplayPool(size int) *walReplayPool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &walReplayPool{}
+	for i := 0; i < size; i++ {
+		jobs := make(chan *replayJob, 100)
+		pool.workers = append(pool.workers, jobs)
+		go pool.run(jobs)
+	}
+	return pool
+}
+
+func (self *walReplayPool) run(jobs <-chan *replayJob) {
+	for job := range jobs {
+		// once a write failed the rest of the replay will be retried anyway
+		if job.replay.error() == nil {
+			if err := job.writer.Write(job.request); err != nil {
+				job.replay.setError(err)
+			}
+		}
+		job.replay.pending.Done()
+	}
+}
+
+// Queues the request, returns the error of an earlier request of the
+// same replay if there was one
+func (self *walReplayPool) write(replay *serverReplay, writer Writer, shardId uint32, request *protocol.Request) error {
+	if err := replay.error(); err != nil {
+		return err
+	}
+	replay.pending.Add(1)
+	self.workers[int(shardId)%len(self.workers)] <- &replayJob{request, writer, replay}
+	return nil
+}
+
+func (self *walReplayPool) close() {
+	for _, jobs := range self.workers {
+		close(jobs)
+	}
+}
+
+// Waits for the queued requests to be written
+func (self *serverReplay) flush() error {
+	self.pending.Wait()
+	return self.error()
+}
+
+func (self *serverReplay) error() error {
+	self.errLock.Lock()
+	defer self.errLock.Unlock()
+	return self.err
+}
+
+func (self *serverReplay) setError(err error) {
+	self.errLock.Lock()
+	defer self.errLock.Unlock()
+	if self.err == nil {
+		self.err = err
+	}
+}
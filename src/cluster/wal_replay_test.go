@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"fmt"
+	"protocol"
+	"sync"
+
+	. "launchpad.net/gocheck"
+)
+
+type WalReplaySuite struct{}
+
+var _ = Suite(&WalReplaySuite{})
+
+// records the request numbers written to every shard, fails the writes
+// of failShard unless it's 0
+type shardRecordingWriter struct {
+	lock      sync.Mutex
+	requests  map[uint32][]uint32
+	failShard uint32
+}
+
+func (self *shardRecordingWriter) Write(request *protocol.Request) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.failShard != 0 && request.GetShardId() == self.failShard {
+		return fmt.Errorf("cannot write to shard %d", self.failShard)
+	}
+	self.requests[request.GetShardId()] = append(self.requests[request.GetShardId()], request.GetRequestNumber())
+	return nil
+}
+
+func replayRequest(shardId, requestNumber uint32) *protocol.Request {
+	return &protocol.Request{ShardId: &shardId, RequestNumber: &requestNumber}
+}
+
+func (self *WalReplaySuite) TestTheRequestsOfAShardAreReplayedInOrder(c *C) {
+	pool := newWalReplayPool(3)
+	defer pool.close()
+	writer := &shardRecordingWriter{requests: map[uint32][]uint32{}}
+	replay := &serverReplay{}
+	for rn := uint32(1); rn <= 100; rn++ {
+		shardId := rn%5 + 1
+		c.Assert(pool.write(replay, writer, shardId, replayRequest(shardId, rn)), IsNil)
+	}
+	c.Assert(replay.flush(), IsNil)
+	for shardId, requests := range writer.requests {
+		c.Assert(requests, HasLen, 20)
+		for i, rn := range requests {
+			c.Assert(rn%5+1, Equals, shardId)
+			if i > 0 {
+				c.Assert(rn > requests[i-1], Equals, true)
+			}
+		}
+	}
+}
+
+func (self *WalReplaySuite) TestTheReplayStopsAfterAFailedWrite(c *C) {
+	pool := newWalReplayPool(2)
+	defer pool.close()
+	writer := &shardRecordingWriter{requests: map[uint32][]uint32{}, failShard: 1}
+	replay := &serverReplay{}
+	c.Assert(pool.write(replay, writer, 1, replayRequest(1, 1)), IsNil)
+	c.Assert(replay.flush(), NotNil)
+	c.Assert(pool.write(replay, writer, 2, replayRequest(2, 2)), NotNil)
+	c.Assert(writer.requests, HasLen, 0)
+}
@@ -1,8 +1,10 @@
 package cluster
 
 import (
+	"fmt"
 	"protocol"
 	"reflect"
+	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -20,13 +22,72 @@ type WriteBuffer struct {
 	shardLastRequestNumber     map[uint32]uint32
 	shardCommitedRequestNumber map[uint32]uint32
 	writerInfo                 string
+
+	// hinted handoff limits. The pending writes for a down server are
+	// kept in the WAL, these bound how long and how many of them we
+	// hold on to before dropping them. Zero means unbounded.
+	maxHandoffAge      time.Duration
+	maxHandoffRequests int
+	lastRequestNumber  uint32
+	downSince          time.Time
+
+	// requests that someone is waiting to be written, by request number
+	acks     map[uint32]chan<- error
+	acksLock sync.Mutex
+
+	// writes that don't fit in the writes channel go to the overflow on
+	// disk, they're only replayed from the WAL once that's full too
+	overflow     *writeBufferOverflow
+	overflowLock sync.Mutex
+	stats        WriteBufferStats
+
+	// limits the replays of the hinted handoff and of the overflow
+	throttle *Throttle
+}
+
+type WriteBufferStats struct {
+	// requests waiting in memory
+	BufferedRequests int `json:"bufferedRequests"`
+	// requests waiting on disk and their size in bytes
+	OverflowRequests int   `json:"overflowRequests"`
+	OverflowBytes    int64 `json:"overflowBytes"`
+	// totals since startup of the requests that went to the overflow
+	// and of the ones that were read back from it
+	SpilledRequests   uint64 `json:"spilledRequests"`
+	UnspilledRequests uint64 `json:"unspilledRequests"`
+	// how many times the buffers filled up and the requests had to be
+	// replayed from the WAL, whether that's happening right now and
+	// how many requests the current replay wrote so far
+	WalReplays          uint64 `json:"walReplays"`
+	Replaying           bool   `json:"replaying"`
+	ReplayedWalRequests uint64 `json:"replayedWalRequests"`
+	// the requests dropped because the server was down for longer than
+	// the hinted handoff limits
+	DroppedRequests uint64 `json:"droppedRequests"`
 }
 
 type Writer interface {
 	Write(request *protocol.Request) error
 }
 
+// A writer that can write several requests at once, the local store
+// writes all the requests of a shard in one leveldb batch
+type BatchWriter interface {
+	Writer
+	WriteBatch(requests []*protocol.Request) error
+}
+
+// how many of the buffered requests are written in one batch at most
+const MAX_WRITE_BATCH_REQUESTS = 100
+
 func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int) *WriteBuffer {
+	return NewWriteBufferWithHandoffLimits(writerInfo, writer, wal, serverId, bufferSize, 0, 0)
+}
+
+// Creates a write buffer that will stop retrying writes to a down
+// server once they're older than maxAge or once more than maxRequests
+// requests are queued up behind them.
+func NewWriteBufferWithHandoffLimits(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int, maxAge time.Duration, maxRequests int) *WriteBuffer {
 	log.Info("%s: Initializing write buffer with buffer size of %d", writerInfo, bufferSize)
 	buff := &WriteBuffer{
 		writer:                     writer,
@@ -39,11 +100,39 @@ func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32,
 		shardLastRequestNumber:     map[uint32]uint32{},
 		shardCommitedRequestNumber: map[uint32]uint32{},
 		writerInfo:                 writerInfo,
+		maxHandoffAge:              maxAge,
+		maxHandoffRequests:         maxRequests,
+		acks:                       map[uint32]chan<- error{},
 	}
 	go buff.handleWrites()
 	return buff
 }
 
+// Lets the writes that don't fit in memory spill to a file in the
+// given directory, up to maxSize bytes
+func (self *WriteBuffer) SpillToDisk(dir string, maxSize int64) error {
+	overflow, err := openWriteBufferOverflow(dir, fmt.Sprintf("server_%d", self.serverId), maxSize)
+	if err != nil {
+		return err
+	}
+	self.overflowLock.Lock()
+	defer self.overflowLock.Unlock()
+	self.overflow = overflow
+	return nil
+}
+
+func (self *WriteBuffer) Stats() *WriteBufferStats {
+	self.overflowLock.Lock()
+	defer self.overflowLock.Unlock()
+	stats := self.stats
+	stats.BufferedRequests = len(self.writes)
+	if self.overflow != nil {
+		stats.OverflowRequests = self.overflow.requests
+		stats.OverflowBytes = self.overflow.size()
+	}
+	return &stats
+}
+
 func (self *WriteBuffer) ShardsRequestNumber() map[uint32]uint32 {
 	return self.shardLastRequestNumber
 }
@@ -52,15 +141,25 @@ func (self *WriteBuffer) HasUncommitedWrites() bool {
 	return !reflect.DeepEqual(self.shardCommitedRequestNumber, self.shardLastRequestNumber)
 }
 
-// This method never blocks. It'll buffer writes until they fill the buffer then drop the on the
-// floor and let the background goroutine replay from the WAL
+// This method never blocks. It'll buffer writes until they fill the buffer and the overflow, then
+// drop them on the floor and let the background goroutine replay from the WAL
 func (self *WriteBuffer) Write(request *protocol.Request) {
 	self.shardLastRequestNumber[request.GetShardId()] = request.GetRequestNumber()
+	self.lastRequestNumber = request.GetRequestNumber()
+
+	// keep the writes in order, once some of them are on disk the new
+	// ones go there too until the overflow is empty again
+	if self.spill(request, true) {
+		return
+	}
 	select {
 	case self.writes <- request:
 		log.Debug("Buffering %d:%d for %s", request.GetRequestNumber(), request.GetShardId(), self.writerInfo)
 		return
 	default:
+		if self.spill(request, false) {
+			return
+		}
 		select {
 		case self.stoppedWrites <- *request.RequestNumber:
 			return
@@ -70,13 +169,90 @@ func (self *WriteBuffer) Write(request *protocol.Request) {
 	}
 }
 
+// Same as Write, but once the request is written (or dropped) the
+// result is sent to the given channel. The channel should be buffered
+// since the write buffer will never block on it.
+func (self *WriteBuffer) WriteWithAck(request *protocol.Request, ack chan<- error) {
+	if ack != nil && request.RequestNumber != nil {
+		self.acksLock.Lock()
+		self.acks[*request.RequestNumber] = ack
+		self.acksLock.Unlock()
+	}
+	self.Write(request)
+}
+
+// Adds the request to the overflow, if onlyIfSpilling is set only if
+// there are requests in the overflow already. Returns false if the
+// request wasn't added.
+func (self *WriteBuffer) spill(request *protocol.Request, onlyIfSpilling bool) bool {
+	self.overflowLock.Lock()
+	defer self.overflowLock.Unlock()
+	if self.overflow == nil || self.stats.Replaying {
+		return false
+	}
+	if onlyIfSpilling && self.overflow.requests == 0 {
+		return false
+	}
+	if err := self.overflow.push(request); err != nil {
+		if err != errOverflowFull {
+			log.Error("%s: WriteBuffer: cannot write request %d:%d to the overflow: %s", self.writerInfo, request.GetRequestNumber(), request.GetShardId(), err)
+		}
+		return false
+	}
+	if self.stats.SpilledRequests%10000 == 0 {
+		log.Warn("%s: WriteBuffer: write buffer is full, spilling writes to disk (%d bytes queued)", self.writerInfo, self.overflow.size())
+	}
+	self.stats.SpilledRequests++
+	return true
+}
+
+func (self *WriteBuffer) unspill() (*protocol.Request, error) {
+	self.overflowLock.Lock()
+	defer self.overflowLock.Unlock()
+	if self.overflow == nil {
+		return nil, nil
+	}
+	request, err := self.overflow.pop()
+	if err != nil {
+		self.overflow.reset()
+		return nil, err
+	}
+	if request != nil {
+		self.stats.UnspilledRequests++
+	}
+	return request, nil
+}
+
 func (self *WriteBuffer) handleWrites() {
 	for {
+		select {
+		case requestDropped := <-self.stoppedWrites:
+			self.replayAndRecover(requestDropped)
+			continue
+		case request := <-self.writes:
+			self.writeBuffered(request)
+			continue
+		default:
+		}
+
+		// the writes channel is empty, catch up with the overflow
+		request, err := self.unspill()
+		if err != nil {
+			// the WAL still has the requests that were in the overflow
+			log.Error("%s: WriteBuffer: cannot read from the overflow, replaying from the WAL: %s", self.writerInfo, err)
+			self.replayFromLastCommit()
+			continue
+		}
+		if request != nil {
+			self.throttledWrite(request)
+			continue
+		}
+
 		select {
 		case requestDropped := <-self.stoppedWrites:
 			self.replayAndRecover(requestDropped)
 		case request := <-self.writes:
-			self.write(request)
+			self.writeBuffered(request)
 		}
 	}
 }
@@ -85,16 +261,23 @@ func (self *WriteBuffer) write(request *protocol.Request) {
 	attempts := 0
 	for {
 		self.shardIds[*request.ShardId] = true
-		err := self.writer.Write(request)
+		err := self.writeIfUp(request)
 		if err == nil {
-			requestNumber := request.RequestNumber
-			if requestNumber == nil {
-				return
-			}
-
-			self.shardCommitedRequestNumber[request.GetShardId()] = *requestNumber
-			log.Debug("Commiting %d:%d for %s", request.GetRequestNumber(), request.GetShardId(), self.writerInfo)
-			self.wal.Commit(*requestNumber, self.serverId)
+			self.downSince = time.Time{}
+			self.commit(request)
+			self.ack(request, nil)
+			return
+		}
+		if self.downSince.IsZero() {
+			self.downSince = time.Now()
+		}
+		if self.shouldDropHandoff(request) {
+			log.Warn("%s: WriteBuffer: dropping request %d:%d for server %d, server has been down since %s", self.writerInfo, request.GetRequestNumber(), request.GetShardId(), self.serverId, self.downSince)
+			self.commit(request)
+			self.ack(request, fmt.Errorf("server %d has been down since %s", self.serverId, self.downSince))
+			self.overflowLock.Lock()
+			self.stats.DroppedRequests++
+			self.overflowLock.Unlock()
 			return
 		}
 		if attempts%100 == 0 {
@@ -106,9 +289,148 @@ func (self *WriteBuffer) write(request *protocol.Request) {
 	}
 }
 
+// Writes the request along with the requests buffered behind it if the
+// writer can write them in one batch. If the batch fails the requests
+// are retried one by one.
+func (self *WriteBuffer) writeBuffered(request *protocol.Request) {
+	batchWriter, ok := self.writer.(BatchWriter)
+	if !ok {
+		self.write(request)
+		return
+	}
+
+	requests := []*protocol.Request{request}
+BatchLoop:
+	for len(requests) < MAX_WRITE_BATCH_REQUESTS {
+		select {
+		case r := <-self.writes:
+			requests = append(requests, r)
+		default:
+			break BatchLoop
+		}
+	}
+	if len(requests) == 1 {
+		self.write(request)
+		return
+	}
+
+	if err := batchWriter.WriteBatch(requests); err != nil {
+		log.Error("%s: WriteBuffer: error on writing a batch of %d requests, writing them one by one: %s", self.writerInfo, len(requests), err)
+		for _, r := range requests {
+			self.write(r)
+		}
+		return
+	}
+	self.downSince = time.Time{}
+	for _, r := range requests {
+		self.shardIds[r.GetShardId()] = true
+		if r.RequestNumber != nil {
+			self.shardCommitedRequestNumber[r.GetShardId()] = *r.RequestNumber
+		}
+	}
+	// committing the last request commits the ones before it in the wal
+	self.commit(requests[len(requests)-1])
+	for _, r := range requests {
+		self.ack(r, nil)
+	}
+}
+
+// writes a request that's being caught up on, either from the WAL or
+// from the overflow
+func (self *WriteBuffer) throttledWrite(request *protocol.Request) {
+	self.throttle.Wait(fmt.Sprintf("%d", self.serverId), request.Size())
+	self.write(request)
+}
+
+// The failure detector usually finds out that a server is down before a
+// write to it times out, writes to a down server go straight to the
+// hinted handoff instead of waiting on the connection
+func (self *WriteBuffer) writeIfUp(request *protocol.Request) error {
+	if server, ok := self.writer.(*ClusterServer); ok && server.heartbeatStarted && !server.IsUp() {
+		return fmt.Errorf("server %d is down", self.serverId)
+	}
+	return self.writer.Write(request)
+}
+
+func (self *WriteBuffer) commit(request *protocol.Request) {
+	requestNumber := request.RequestNumber
+	if requestNumber == nil {
+		return
+	}
+
+	self.shardCommitedRequestNumber[request.GetShardId()] = *requestNumber
+	log.Debug("Commiting %d:%d for %s", request.GetRequestNumber(), request.GetShardId(), self.writerInfo)
+	self.wal.Commit(*requestNumber, self.serverId)
+}
+
+func (self *WriteBuffer) ack(request *protocol.Request, err error) {
+	if request.RequestNumber == nil {
+		return
+	}
+
+	self.acksLock.Lock()
+	ack, ok := self.acks[*request.RequestNumber]
+	delete(self.acks, *request.RequestNumber)
+	self.acksLock.Unlock()
+
+	if !ok {
+		return
+	}
+	select {
+	case ack <- err:
+	default:
+	}
+}
+
+// Returns true if the given request has been waiting on a down server
+// for longer than the hinted handoff limits allow
+func (self *WriteBuffer) shouldDropHandoff(request *protocol.Request) bool {
+	if self.maxHandoffAge > 0 && time.Now().Sub(self.downSince) > self.maxHandoffAge {
+		return true
+	}
+	if self.maxHandoffRequests > 0 && request.RequestNumber != nil {
+		pending := int(self.lastRequestNumber - *request.RequestNumber)
+		return pending > self.maxHandoffRequests
+	}
+	return false
+}
+
+func (self *WriteBuffer) setReplaying(replaying bool) {
+	self.overflowLock.Lock()
+	defer self.overflowLock.Unlock()
+	self.stats.Replaying = replaying
+	if replaying {
+		self.stats.WalReplays++
+		self.stats.ReplayedWalRequests = 0
+	}
+}
+
+func (self *WriteBuffer) replayFromLastCommit() {
+	self.setReplaying(true)
+	defer self.setReplaying(false)
+
+	shardIds := make([]uint32, 0)
+	for shardId, _ := range self.shardIds {
+		shardIds = append(shardIds, shardId)
+	}
+	self.wal.RecoverServerFromLastCommit(self.serverId, shardIds, func(request *protocol.Request, shardId uint32) error {
+		request.ShardId = &shardId
+		self.throttledWrite(request)
+		self.overflowLock.Lock()
+		self.stats.ReplayedWalRequests++
+		self.overflowLock.Unlock()
+		return nil
+	})
+}
+
 func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 	var req *protocol.Request
 
+	// nothing is spilled while replaying, the WAL has everything after
+	// the first request that's still buffered
+	self.setReplaying(true)
+	defer self.setReplaying(false)
+
 	// empty out the buffer before the replay so new writes can buffer while we're replaying
 	channelLen := len(self.writes)
 	// This is the first run through the replay. Start from the start of the write queue
@@ -119,6 +441,17 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 		}
 	}
 
+	// the overflow has the requests that came after the ones in the
+	// channel, they'll be replayed too
+	self.overflowLock.Lock()
+	if self.overflow != nil {
+		if req == nil {
+			req, _ = self.overflow.pop()
+		}
+		self.overflow.reset()
+	}
+	self.overflowLock.Unlock()
+
 	if req == nil {
 		log.Error("%s: REPLAY: emptied channel, but no request set", self.writerInfo)
 		return
@@ -139,7 +472,10 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 			log.Debug("%s: REPLAY: writing request number: %d", self.writerInfo, request.GetRequestNumber())
 			req = request
 			request.ShardId = &shardId
-			self.write(request)
+			self.throttledWrite(request)
+			self.overflowLock.Lock()
+			self.stats.ReplayedWalRequests++
+			self.overflowLock.Unlock()
 			return nil
 		})
 
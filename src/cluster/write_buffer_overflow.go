@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"protocol"
+)
+
+var errOverflowFull = errors.New("the write buffer overflow is full")
+
+// A bounded queue on disk for the writes that don't fit in the memory
+// buffer of a server. Each request is stored with a 4 byte big endian
+// length in front of it. The queue isn't kept across restarts, the
+// writes that weren't committed are replayed from the WAL on startup.
+type writeBufferOverflow struct {
+	file        *os.File
+	maxSize     int64
+	readOffset  int64
+	writeOffset int64
+	requests    int
+}
+
+func openWriteBufferOverflow(dir string, name string, maxSize int64) (*writeBufferOverflow, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeBufferOverflow{file: file, maxSize: maxSize}, nil
+}
+
+func (self *writeBufferOverflow) push(request *protocol.Request) error {
+	data, err := request.Encode()
+	if err != nil {
+		return err
+	}
+	if self.writeOffset+int64(len(data))+4 > self.maxSize {
+		return errOverflowFull
+	}
+	buff := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buff, uint32(len(data)))
+	copy(buff[4:], data)
+	if _, err := self.file.WriteAt(buff, self.writeOffset); err != nil {
+		return err
+	}
+	self.writeOffset += int64(len(buff))
+	self.requests++
+	return nil
+}
+
+// Returns the oldest request in the queue or nil if it's empty
+func (self *writeBufferOverflow) pop() (*protocol.Request, error) {
+	if self.requests == 0 {
+		return nil, nil
+	}
+	header := make([]byte, 4)
+	if _, err := self.file.ReadAt(header, self.readOffset); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := self.file.ReadAt(data, self.readOffset+4); err != nil {
+		return nil, err
+	}
+	request := &protocol.Request{}
+	if err := request.Decode(data); err != nil {
+		return nil, err
+	}
+	self.readOffset += int64(len(data)) + 4
+	self.requests--
+	if self.requests == 0 {
+		return request, self.reset()
+	}
+	return request, nil
+}
+
+func (self *writeBufferOverflow) size() int64 {
+	return self.writeOffset - self.readOffset
+}
+
+// Empties the queue and gives the space back to the file system
+func (self *writeBufferOverflow) reset() error {
+	self.readOffset = 0
+	self.writeOffset = 0
+	self.requests = 0
+	return self.file.Truncate(0)
+}
+
+func (self *writeBufferOverflow) close() error {
+	return self.file.Close()
+}
@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"protocol"
+	"sync"
+	"time"
+	"wal"
+
+	. "launchpad.net/gocheck"
+)
+
+type WriteBufferSuite struct {
+	dir string
+}
+
+var _ = Suite(&WriteBufferSuite{})
+
+func (self *WriteBufferSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "write_buffer_test")
+	c.Assert(err, IsNil)
+	self.dir = dir
+}
+
+func (self *WriteBufferSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+// blocks every write until it's released
+type blockedWriter struct {
+	release  chan bool
+	lock     sync.Mutex
+	requests []uint32
+}
+
+func (self *blockedWriter) Write(request *protocol.Request) error {
+	<-self.release
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.requests = append(self.requests, request.GetRequestNumber())
+	return nil
+}
+
+func (self *blockedWriter) written() []uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]uint32{}, self.requests...)
+}
+
+type committingWal struct {
+	lock      sync.Mutex
+	committed uint32
+	recovered bool
+}
+
+func (self *committingWal) AssignSequenceNumbersAndLog(request *protocol.Request, shard wal.Shard) (uint32, error) {
+	return 0, nil
+}
+
+func (self *committingWal) Commit(requestNumber uint32, serverId uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.committed = requestNumber
+	return nil
+}
+
+func (self *committingWal) CreateCheckpoint() error {
+	return nil
+}
+
+func (self *committingWal) RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.recovered = true
+	return nil
+}
+
+func (self *committingWal) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
+	return nil
+}
+
+func (self *committingWal) Stats() *wal.Stats {
+	return &wal.Stats{}
+}
+
+func (self *committingWal) Subscribe(name string, requestNumber uint32) error {
+	return nil
+}
+
+func (self *committingWal) Ack(name string, requestNumber uint32) error {
+	return nil
+}
+
+func (self *committingWal) Unsubscribe(name string) error {
+	return nil
+}
+
+func (self *committingWal) ReplayToConsumer(name string, yield func(request *protocol.Request, shardId uint32) error) error {
+	return nil
+}
+
+func newWriteBufferTestRequest(requestNumber uint32) *protocol.Request {
+	shardId := uint32(1)
+	requestType := protocol.Request_WRITE
+	return &protocol.Request{
+		Type:          &requestType,
+		Database:      protocol.String("db1"),
+		ShardId:       &shardId,
+		RequestNumber: &requestNumber,
+	}
+}
+
+func (self *WriteBufferSuite) TestFullBufferSpillsToDisk(c *C) {
+	writer := &blockedWriter{release: make(chan bool)}
+	requestLog := &committingWal{}
+	buffer := NewWriteBuffer("test", writer, requestLog, 2, 2)
+	c.Assert(buffer.SpillToDisk(self.dir, 1024*1024), IsNil)
+
+	for i := uint32(1); i <= 10; i++ {
+		buffer.Write(newWriteBufferTestRequest(i))
+	}
+	stats := buffer.Stats()
+	c.Assert(stats.OverflowRequests > 0, Equals, true)
+	c.Assert(stats.OverflowBytes > 0, Equals, true)
+	c.Assert(stats.WalReplays, Equals, uint64(0))
+
+	close(writer.release)
+	for i := 0; i < 100 && len(writer.written()) < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(writer.written(), DeepEquals, []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	stats = buffer.Stats()
+	c.Assert(stats.OverflowRequests, Equals, 0)
+	c.Assert(stats.UnspilledRequests, Equals, stats.SpilledRequests)
+	c.Assert(requestLog.recovered, Equals, false)
+}
+
+func (self *WriteBufferSuite) TestOverflowKeepsRequestsInOrder(c *C) {
+	overflow, err := openWriteBufferOverflow(self.dir, "test", 1024*1024)
+	c.Assert(err, IsNil)
+	defer overflow.close()
+	for i := uint32(1); i <= 3; i++ {
+		c.Assert(overflow.push(newWriteBufferTestRequest(i)), IsNil)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		request, err := overflow.pop()
+		c.Assert(err, IsNil)
+		c.Assert(request.GetRequestNumber(), Equals, i)
+	}
+	request, err := overflow.pop()
+	c.Assert(err, IsNil)
+	c.Assert(request, IsNil)
+	c.Assert(overflow.size(), Equals, int64(0))
+
+	full, err := openWriteBufferOverflow(self.dir, "full", 10)
+	c.Assert(err, IsNil)
+	defer full.close()
+	c.Assert(full.push(newWriteBufferTestRequest(1)), Equals, errOverflowFull)
+}
+
+// blocks every write until it's released, records the batches
+type batchingWriter struct {
+	blockedWriter
+	batches [][]uint32
+}
+
+func (self *batchingWriter) WriteBatch(requests []*protocol.Request) error {
+	<-self.release
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	batch := []uint32{}
+	for _, request := range requests {
+		batch = append(batch, request.GetRequestNumber())
+	}
+	self.batches = append(self.batches, batch)
+	self.requests = append(self.requests, batch...)
+	return nil
+}
+
+func (self *WriteBufferSuite) TestBufferedRequestsAreWrittenInBatches(c *C) {
+	writer := &batchingWriter{blockedWriter: blockedWriter{release: make(chan bool)}}
+	requestLog := &committingWal{}
+	buffer := NewWriteBuffer("test", writer, requestLog, 2, 10)
+
+	buffer.Write(newWriteBufferTestRequest(1))
+	// wait for the first request to be written alone
+	for i := 0; i < 100 && len(buffer.writes) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := uint32(2); i <= 6; i++ {
+		buffer.Write(newWriteBufferTestRequest(i))
+	}
+
+	close(writer.release)
+	for i := 0; i < 100 && len(writer.written()) < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(writer.written(), DeepEquals, []uint32{1, 2, 3, 4, 5, 6})
+	writer.lock.Lock()
+	c.Assert(writer.batches, DeepEquals, [][]uint32{{2, 3, 4, 5, 6}})
+	writer.lock.Unlock()
+
+	committed := func() uint32 {
+		requestLog.lock.Lock()
+		defer requestLog.lock.Unlock()
+		return requestLog.committed
+	}
+	for i := 0; i < 100 && committed() < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(committed(), Equals, uint32(6))
+}
+
+// fails every write, like a server that's down
+type downWriter struct{}
+
+func (self *downWriter) Write(request *protocol.Request) error {
+	return fmt.Errorf("connection refused")
+}
+
+func (self *WriteBufferSuite) TestDroppedHandoffRequestsAreCounted(c *C) {
+	requestLog := &committingWal{}
+	buffer := NewWriteBufferWithHandoffLimits("test", &downWriter{}, requestLog, 2, 10, time.Nanosecond, 0)
+
+	buffer.Write(newWriteBufferTestRequest(1))
+	for i := 0; i < 100 && buffer.Stats().DroppedRequests == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(buffer.Stats().DroppedRequests, Equals, uint64(1))
+	// the dropped request is committed so it won't be replayed
+	requestLog.lock.Lock()
+	defer requestLog.lock.Unlock()
+	c.Assert(requestLog.committed, Equals, uint32(1))
+}
@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The number of replicas of a shard that have to acknowledge a write
+// before it's acknowledged to the client
+type WriteConsistency int
+
+const (
+	// the write is acknowledged once it's logged to the local WAL, the
+	// replicas get it asynchronously
+	WRITE_CONSISTENCY_ANY WriteConsistency = iota
+	WRITE_CONSISTENCY_ONE
+	WRITE_CONSISTENCY_QUORUM
+	WRITE_CONSISTENCY_ALL
+)
+
+func ParseWriteConsistency(s string) (WriteConsistency, error) {
+	switch strings.ToLower(s) {
+	case "", "any":
+		return WRITE_CONSISTENCY_ANY, nil
+	case "one":
+		return WRITE_CONSISTENCY_ONE, nil
+	case "quorum":
+		return WRITE_CONSISTENCY_QUORUM, nil
+	case "all":
+		return WRITE_CONSISTENCY_ALL, nil
+	}
+	return WRITE_CONSISTENCY_ANY, fmt.Errorf("Unknown write consistency %s, must be one of any, one, quorum or all", s)
+}
+
+func (self WriteConsistency) String() string {
+	switch self {
+	case WRITE_CONSISTENCY_ONE:
+		return "one"
+	case WRITE_CONSISTENCY_QUORUM:
+		return "quorum"
+	case WRITE_CONSISTENCY_ALL:
+		return "all"
+	}
+	return "any"
+}
+
+// Returns the number of replicas out of the given total that have to
+// acknowledge a write
+func (self WriteConsistency) RequiredAcks(replicas int) int {
+	switch self {
+	case WRITE_CONSISTENCY_ONE:
+		return 1
+	case WRITE_CONSISTENCY_QUORUM:
+		return replicas/2 + 1
+	case WRITE_CONSISTENCY_ALL:
+		return replicas
+	}
+	return 0
+}
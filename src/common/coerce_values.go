@@ -69,7 +69,7 @@ func CoerceValues(leftValue, rightValue *protocol.FieldValue) (interface{}, inte
 
 	if leftValue.BoolValue != nil {
 		if rightValue.BoolValue == nil {
-			return nil, nil, TYPE_BOOL
+			return nil, nil, TYPE_UNKNOWN
 		}
 
 		return *leftValue.BoolValue, *rightValue.BoolValue, TYPE_BOOL
@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
@@ -52,3 +53,50 @@ func (self DatabaseExistsError) Error() string {
 func NewDatabaseExistsError(db string) DatabaseExistsError {
 	return DatabaseExistsError(fmt.Sprintf("database %s exists", db))
 }
+
+// Returned when a query goes over one of the query limits of the config,
+// Limit is the name of the limit, e.g. max-returned-points
+type QueryLimitError struct {
+	Message string `json:"error"`
+	Limit   string `json:"limit"`
+	Value   string `json:"value"`
+}
+
+func (self *QueryLimitError) Error() string {
+	return self.Message
+}
+
+func NewQueryLimitError(limit string, value interface{}) *QueryLimitError {
+	return &QueryLimitError{
+		Message: fmt.Sprintf("The query went over the %s limit of %v", limit, value),
+		Limit:   limit,
+		Value:   fmt.Sprint(value),
+	}
+}
+
+// Returned when a write or a query goes over one of the rate limits of
+// its database or its user, it can be retried in RetryAfter seconds
+type RateLimitError struct {
+	Message    string `json:"error"`
+	Limit      string `json:"limit"`
+	Value      int    `json:"value"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+func (self *RateLimitError) Error() string {
+	return self.Message
+}
+
+// The wait is rounded up to the second, it's at least a second
+func NewRateLimitError(limit string, value int, subject string, wait time.Duration) *RateLimitError {
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	return &RateLimitError{
+		Message:    fmt.Sprintf("The %s limit of %d of %s is reached, retry in %ds", limit, value, subject, retryAfter),
+		Limit:      limit,
+		Value:      value,
+		RetryAfter: retryAfter,
+	}
+}
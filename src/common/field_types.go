@@ -0,0 +1,125 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"protocol"
+	"strconv"
+	"time"
+)
+
+// The type of the values a field holds. The ints and the doubles of a
+// field are both numbers, JSON doesn't tell 1.0 from 1.
+type FieldType byte
+
+const (
+	FIELD_TYPE_NONE FieldType = iota
+	FIELD_TYPE_NUMBER
+	FIELD_TYPE_STRING
+	FIELD_TYPE_BOOL
+)
+
+func (self FieldType) String() string {
+	switch self {
+	case FIELD_TYPE_NUMBER:
+		return "number"
+	case FIELD_TYPE_STRING:
+		return "string"
+	case FIELD_TYPE_BOOL:
+		return "bool"
+	}
+	return "none"
+}
+
+// Returns the field type with the name String() returns
+func ParseFieldType(name string) (FieldType, error) {
+	for _, fieldType := range []FieldType{FIELD_TYPE_NUMBER, FIELD_TYPE_STRING, FIELD_TYPE_BOOL} {
+		if fieldType.String() == name {
+			return fieldType, nil
+		}
+	}
+	return FIELD_TYPE_NONE, fmt.Errorf("Unknown field type '%s', it should be number, string or bool", name)
+}
+
+// Returns the field type of the value, FIELD_TYPE_NONE for a null
+func FieldTypeOf(value *protocol.FieldValue) FieldType {
+	switch {
+	case value == nil || value.GetIsNull():
+		return FIELD_TYPE_NONE
+	case value.Int64Value != nil || value.DoubleValue != nil:
+		return FIELD_TYPE_NUMBER
+	case value.StringValue != nil:
+		return FIELD_TYPE_STRING
+	case value.BoolValue != nil:
+		return FIELD_TYPE_BOOL
+	}
+	return FIELD_TYPE_NONE
+}
+
+// Converts the value to the field type, returns false if it can't be.
+// Anything can be a string, strings that parse can be numbers or bools.
+func CoerceFieldValue(value *protocol.FieldValue, fieldType FieldType) (*protocol.FieldValue, bool) {
+	if FieldTypeOf(value) == fieldType {
+		return value, true
+	}
+	switch fieldType {
+	case FIELD_TYPE_STRING:
+		v, _ := value.GetValue()
+		return &protocol.FieldValue{StringValue: protocol.String(fmt.Sprint(v))}, true
+	case FIELD_TYPE_NUMBER:
+		if value.StringValue == nil {
+			return nil, false
+		}
+		if i, err := strconv.ParseInt(*value.StringValue, 10, 64); err == nil {
+			return &protocol.FieldValue{Int64Value: protocol.Int64(i)}, true
+		}
+		if f, err := strconv.ParseFloat(*value.StringValue, 64); err == nil {
+			return &protocol.FieldValue{DoubleValue: protocol.Float64(f)}, true
+		}
+	case FIELD_TYPE_BOOL:
+		if value.StringValue == nil {
+			return nil, false
+		}
+		if b, err := strconv.ParseBool(*value.StringValue); err == nil {
+			return &protocol.FieldValue{BoolValue: &b}, true
+		}
+	}
+	return nil, false
+}
+
+// A value written to a field that holds values of another type
+type FieldTypeConflict struct {
+	Series    string
+	Field     string
+	Point     *protocol.Point
+	Value     *protocol.FieldValue
+	Type      FieldType
+	FieldType FieldType
+}
+
+func (self *FieldTypeConflict) Error() string {
+	return fmt.Sprintf("%s.%s: the point at %s has a %s value, the field holds %s values",
+		self.Series, self.Field, time.Unix(0, self.Point.GetTimestamp()*int64(time.Microsecond)).UTC().Format(time.RFC3339Nano), self.Type, self.FieldType)
+}
+
+// the number of conflicts listed in the message of a FieldTypeConflictError
+const MAX_LISTED_FIELD_TYPE_CONFLICTS = 10
+
+// Returned when some of the values of a write don't have the type of
+// their field, nothing is written
+type FieldTypeConflictError []*FieldTypeConflict
+
+func (self FieldTypeConflictError) Error() string {
+	buffer := bytes.NewBufferString("Values don't match the type of their field: ")
+	for i, conflict := range self {
+		if i == MAX_LISTED_FIELD_TYPE_CONFLICTS {
+			fmt.Fprintf(buffer, ", and %d more", len(self)-i)
+			break
+		}
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(conflict.Error())
+	}
+	return buffer.String()
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// The sketches have 2^HYPERLOGLOG_PRECISION registers of a byte each, the
+// standard error of the estimates is 1.04/sqrt(2^precision), i.e. about
+// 1.6%
+const HYPERLOGLOG_PRECISION = 12
+
+// Estimates the number of distinct strings added to it. Adding a string
+// that was added already never changes the sketch, the sketches of
+// different sets can be merged into the sketch of their union.
+type HyperLogLog struct {
+	registers []byte
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{make([]byte, 1<<HYPERLOGLOG_PRECISION)}
+}
+
+// Returns the sketch the registers were returned by Bytes() of
+func HyperLogLogFromBytes(registers []byte) (*HyperLogLog, error) {
+	if len(registers) != 1<<HYPERLOGLOG_PRECISION {
+		return nil, errors.New("The sketch doesn't have the right number of registers")
+	}
+	return &HyperLogLog{append([]byte{}, registers...)}, nil
+}
+
+// Adds the string and returns true if the sketch changed, in which case
+// the string was never added before
+func (self *HyperLogLog) Add(value string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	hash := mixHash(h.Sum64())
+	index := hash >> (64 - HYPERLOGLOG_PRECISION)
+	// the rank is the position of the first set bit after the index bits,
+	// the last bit is set so the rank is at most 64 - precision + 1
+	rest := hash<<HYPERLOGLOG_PRECISION | 1<<(HYPERLOGLOG_PRECISION-1)
+	rank := byte(1)
+	for rest&(1<<63) == 0 {
+		rank++
+		rest <<= 1
+	}
+	if self.registers[index] >= rank {
+		return false
+	}
+	self.registers[index] = rank
+	return true
+}
+
+// Adds the strings of the other sketch to this one
+func (self *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > self.registers[i] {
+			self.registers[i] = rank
+		}
+	}
+}
+
+func (self *HyperLogLog) Copy() *HyperLogLog {
+	return &HyperLogLog{append([]byte{}, self.registers...)}
+}
+
+func (self *HyperLogLog) Bytes() []byte {
+	return self.registers
+}
+
+// Returns the estimated number of distinct strings of the sketch
+func (self *HyperLogLog) Estimate() uint64 {
+	m := float64(len(self.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range self.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// linear counting is more accurate while a lot of the registers are
+	// still empty
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// fnv doesn't spread the bits of similar strings, e.g. uuids, enough for
+// the registers, this is the finalizer of murmur3
+func mixHash(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"protocol"
+	"time"
 
 	log "code.google.com/p/log4go"
 )
@@ -18,11 +19,42 @@ const (
 	MicrosecondPrecision TimePrecision = iota
 	MillisecondPrecision
 	SecondPrecision
+	NanosecondPrecision
 )
 
 func init() {
 }
 
+// Returns the unit of the timestamps in the precision
+func (self TimePrecision) Unit() time.Duration {
+	switch self {
+	case MillisecondPrecision:
+		return time.Millisecond
+	case SecondPrecision:
+		return time.Second
+	case NanosecondPrecision:
+		return time.Nanosecond
+	}
+	return time.Microsecond
+}
+
+// Converts the timestamp in the precision to a timestamp of the points,
+// the timestamps finer than protocol.TIMESTAMP_PRECISION are truncated
+func (self TimePrecision) ToPointTimestamp(t int64) int64 {
+	if unit := self.Unit(); unit < protocol.TIMESTAMP_PRECISION {
+		return t / int64(protocol.TIMESTAMP_PRECISION/unit)
+	}
+	return t * int64(self.Unit()/protocol.TIMESTAMP_PRECISION)
+}
+
+// Converts the timestamp of a point to a timestamp in the precision
+func (self TimePrecision) FromPointTimestamp(t int64) int64 {
+	if unit := self.Unit(); unit < protocol.TIMESTAMP_PRECISION {
+		return t * int64(protocol.TIMESTAMP_PRECISION/unit)
+	}
+	return t / int64(self.Unit()/protocol.TIMESTAMP_PRECISION)
+}
+
 func removeField(fields []string, name string) []string {
 	index := -1
 	for idx, field := range fields {
@@ -53,80 +85,84 @@ type ApiSeries interface {
 func ConvertToDataStoreSeries(s ApiSeries, precision TimePrecision) (*protocol.Series, error) {
 	points := make([]*protocol.Point, 0, len(s.GetPoints()))
 	for _, point := range s.GetPoints() {
-		if len(point) != len(s.GetColumns()) {
-			return nil, fmt.Errorf("invalid payload")
+		p, err := ConvertToDataStorePoint(s.GetColumns(), point, precision)
+		if err != nil {
+			return nil, err
 		}
+		points = append(points, p)
+	}
 
-		values := make([]*protocol.FieldValue, 0, len(point))
-		var timestamp *int64
-		var sequence *uint64
-
-		for idx, field := range s.GetColumns() {
-
-			value := point[idx]
-			if field == "time" {
-				switch value.(type) {
-				case float64:
-					_timestamp := int64(value.(float64))
-					switch precision {
-					case SecondPrecision:
-						_timestamp *= 1000
-						fallthrough
-					case MillisecondPrecision:
-						_timestamp *= 1000
-					}
-
-					timestamp = &_timestamp
-					continue
-				default:
-					return nil, fmt.Errorf("time field must be float but is %T (%v)", value, value)
-				}
-			}
+	return &protocol.Series{
+		Name:   protocol.String(s.GetName()),
+		Fields: DataStoreFields(s.GetColumns()),
+		Points: points,
+	}, nil
+}
 
-			if field == "sequence_number" {
-				switch value.(type) {
-				case float64:
-					_sequenceNumber := uint64(value.(float64))
-					sequence = &_sequenceNumber
-					continue
-				default:
-					return nil, fmt.Errorf("sequence_number field must be float but is %T (%v)", value, value)
-				}
-			}
+// Returns the fields of the points of a series with the columns, the
+// time and the sequence number aren't fields
+func DataStoreFields(columns []string) []string {
+	return removeTimestampFieldDefinition(append([]string{}, columns...))
+}
+
+// Converts a point of a series with the given columns
+func ConvertToDataStorePoint(columns []string, point []interface{}, precision TimePrecision) (*protocol.Point, error) {
+	if len(point) != len(columns) {
+		return nil, fmt.Errorf("invalid payload")
+	}
+
+	values := make([]*protocol.FieldValue, 0, len(point))
+	var timestamp *int64
+	var sequence *uint64
 
-			switch v := value.(type) {
-			case string:
-				values = append(values, &protocol.FieldValue{StringValue: &v})
+	for idx, field := range columns {
+
+		value := point[idx]
+		if field == "time" {
+			switch value.(type) {
 			case float64:
-				if i := int64(v); float64(i) == v {
-					values = append(values, &protocol.FieldValue{Int64Value: &i})
-				} else {
-					values = append(values, &protocol.FieldValue{DoubleValue: &v})
-				}
-			case bool:
-				values = append(values, &protocol.FieldValue{BoolValue: &v})
-			case nil:
-				values = append(values, &protocol.FieldValue{IsNull: &TRUE})
+				_timestamp := precision.ToPointTimestamp(int64(value.(float64)))
+				timestamp = &_timestamp
+				continue
 			default:
-				// if we reached this line then the dynamic type didn't match
-				return nil, fmt.Errorf("Unknown type %T", value)
+				return nil, fmt.Errorf("time field must be float but is %T (%v)", value, value)
 			}
 		}
-		points = append(points, &protocol.Point{
-			Values:         values,
-			Timestamp:      timestamp,
-			SequenceNumber: sequence,
-		})
-	}
 
-	fields := removeTimestampFieldDefinition(s.GetColumns())
+		if field == "sequence_number" {
+			switch value.(type) {
+			case float64:
+				_sequenceNumber := uint64(value.(float64))
+				sequence = &_sequenceNumber
+				continue
+			default:
+				return nil, fmt.Errorf("sequence_number field must be float but is %T (%v)", value, value)
+			}
+		}
 
-	series := &protocol.Series{
-		Name:   protocol.String(s.GetName()),
-		Fields: fields,
-		Points: points,
+		switch v := value.(type) {
+		case string:
+			values = append(values, &protocol.FieldValue{StringValue: &v})
+		case float64:
+			if i := int64(v); float64(i) == v {
+				values = append(values, &protocol.FieldValue{Int64Value: &i})
+			} else {
+				values = append(values, &protocol.FieldValue{DoubleValue: &v})
+			}
+		case bool:
+			values = append(values, &protocol.FieldValue{BoolValue: &v})
+		case nil:
+			values = append(values, &protocol.FieldValue{IsNull: &TRUE})
+		default:
+			// if we reached this line then the dynamic type didn't match
+			return nil, fmt.Errorf("Unknown type %T", value)
+		}
 	}
-	return series, nil
+	return &protocol.Point{
+		Values:         values,
+		Timestamp:      timestamp,
+		SequenceNumber: sequence,
+	}, nil
 }
 
 // takes a slice of protobuf series and convert them to the format
@@ -152,14 +188,7 @@ func SerializeSeries(memSeries map[string]*protocol.Series, precision TimePrecis
 		for _, row := range series.Points {
 			timestamp := int64(0)
 			if t := row.Timestamp; t != nil {
-				timestamp = *row.GetTimestampInMicroseconds()
-				switch precision {
-				case SecondPrecision:
-					timestamp /= 1000
-					fallthrough
-				case MillisecondPrecision:
-					timestamp /= 1000
-				}
+				timestamp = precision.FromPointTimestamp(*row.GetTimestampInMicroseconds())
 			}
 
 			rowValues := []interface{}{timestamp}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// the template parts that make up the name of the series
+	TEMPLATE_SERIES = "series"
+	// the template parts that are dropped
+	TEMPLATE_SKIP = "_"
+)
+
+// Maps the dotted paths of the metrics to series. Every part of the
+// template names the part of the path at the same position, e.g. the
+// template host.series.series turns server1.cpu.idle into the series
+// cpu.idle with a host column of server1. The parts of the path past the
+// end of the template are added to the name of the series. The graphite
+// listener and the series-template ingest processor map the names with
+// it.
+type SeriesTemplate struct {
+	parts     []string
+	separator string
+}
+
+// Returns the template, the parts of the name of the series are joined
+// with the separator. The empty template keeps the whole path.
+func NewSeriesTemplate(template, separator string) (*SeriesTemplate, error) {
+	self := &SeriesTemplate{separator: separator}
+	if template == "" {
+		return self, nil
+	}
+	columns := map[string]bool{}
+	for _, part := range strings.Split(template, ".") {
+		switch part {
+		case "":
+			return nil, fmt.Errorf("Template %s has an empty part", template)
+		// value is the column of the graphite metrics
+		case "value", "time", "sequence_number":
+			return nil, fmt.Errorf("Template %s uses the reserved column %s", template, part)
+		case TEMPLATE_SERIES, TEMPLATE_SKIP:
+		default:
+			if columns[part] {
+				return nil, fmt.Errorf("Template %s has the column %s twice", template, part)
+			}
+			columns[part] = true
+		}
+		self.parts = append(self.parts, part)
+	}
+	return self, nil
+}
+
+// Returns the name of the series of the metric path, and the columns with
+// their values taken from the path
+func (self *SeriesTemplate) Apply(path string) (string, []string, []string, error) {
+	name := []string{}
+	columns := []string{}
+	values := []string{}
+	for i, part := range strings.Split(path, ".") {
+		if i >= len(self.parts) {
+			name = append(name, part)
+			continue
+		}
+		switch self.parts[i] {
+		case TEMPLATE_SERIES:
+			name = append(name, part)
+		case TEMPLATE_SKIP:
+		default:
+			columns = append(columns, self.parts[i])
+			values = append(values, part)
+		}
+	}
+	if len(name) == 0 {
+		return "", nil, nil, fmt.Errorf("The metric %s has no series name in template %s", path, strings.Join(self.parts, "."))
+	}
+	return strings.Join(name, self.separator), columns, values, nil
+}
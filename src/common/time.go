@@ -9,3 +9,7 @@ type EnhancedTime time.Time
 func TimeToMicroseconds(t time.Time) int64 {
 	return t.Unix()*int64(time.Second/time.Microsecond) + int64(t.Nanosecond())/int64(time.Microsecond)
 }
+
+func TimeFromMicroseconds(micros int64) time.Time {
+	return time.Unix(0, micros*int64(time.Microsecond)).UTC()
+}
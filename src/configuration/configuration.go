@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"time"
 
@@ -19,21 +21,48 @@ type size struct {
 }
 
 const (
-	ONE_MEGABYTE int64 = 1024 * 1024
+	ONE_KILOBYTE int64 = 1024
+	ONE_MEGABYTE       = 1024 * ONE_KILOBYTE
 	ONE_GIGABYTE       = 1024 * ONE_MEGABYTE
 	// Maximum integer representable by a word (32bit or 64bit depending
 	// on the architecture)
 	MAX_INT = int64(^uint(0) >> 1)
 )
 
+// When the wal fsyncs its log file
+const (
+	// after flush-after requests
+	WAL_SYNC_REQUESTS = "requests"
+	// after every request
+	WAL_SYNC_ALWAYS = "always"
+	// every sync-interval
+	WAL_SYNC_INTERVAL = "interval"
+	// after sync-after-bytes were written
+	WAL_SYNC_BYTES = "bytes"
+)
+
+// Whether the servers check the certificates of the servers connecting
+// to them when the cluster uses tls
+const (
+	// only accept the servers whose certificate is signed by tls-ca
+	CLUSTER_TLS_CLIENT_AUTH_VERIFY = "verify"
+	// encrypt the traffic but accept any server
+	CLUSTER_TLS_CLIENT_AUTH_NONE = "none"
+)
+
 func (d *size) UnmarshalText(text []byte) error {
 	str := string(text)
 	length := len(str)
+	if length == 0 {
+		return nil
+	}
 	size, err := strconv.ParseInt(string(text[:length-1]), 10, 64)
 	if err != nil {
 		return err
 	}
 	switch suffix := text[len(text)-1]; suffix {
+	case 'k':
+		size *= ONE_KILOBYTE
 	case 'm':
 		size *= ONE_MEGABYTE
 	case 'g':
@@ -69,27 +98,50 @@ type AdminConfig struct {
 type ApiConfig struct {
 	SslPort     int    `toml:"ssl-port"`
 	SslCertPath string `toml:"ssl-cert"`
+	SslKeyPath  string `toml:"ssl-key"`
 	Port        int
 	ReadTimeout duration `toml:"read-timeout"`
+	// the limit of the decompressed size of the bodies of the writes
+	MaxWriteBodySize size `toml:"max-write-body-size"`
 }
 
 type GraphiteConfig struct {
 	Enabled    bool
 	Port       int
 	Database   string
-	UdpEnabled bool `toml:"udp_enabled"`
+	UdpEnabled bool   `toml:"udp_enabled"`
+	Separator  string `toml:"separator"`
+	Template   string `toml:"template"`
+	BatchSize  int    `toml:"batch-size"`
 }
 
-type UdpInputConfig struct {
+type CollectdConfig struct {
+	Enabled  bool
+	Port     int
+	Database string
+	TypesDB  string `toml:"typesdb"`
+}
+
+type OpenTsdbConfig struct {
 	Enabled  bool
 	Port     int
 	Database string
 }
 
+type UdpInputConfig struct {
+	Enabled      bool
+	Port         int
+	Database     string
+	BatchSize    int      `toml:"batch-size"`
+	BatchTimeout duration `toml:"batch-timeout"`
+}
+
 type RaftConfig struct {
-	Port    int
-	Dir     string
-	Timeout duration `toml:"election-timeout"`
+	Port                  int
+	Dir                   string
+	Timeout               duration `toml:"election-timeout"`
+	LogCompactionSize     size     `toml:"log-compaction-size"`
+	LogCompactionInterval duration `toml:"log-compaction-interval"`
 }
 
 type StorageConfig struct {
@@ -99,14 +151,52 @@ type StorageConfig struct {
 
 type ClusterConfig struct {
 	SeedServers               []string `toml:"seed-servers"`
+	BindAddress               string   `toml:"bind-address"`
+	TlsCert                   string   `toml:"tls-cert"`
+	TlsKey                    string   `toml:"tls-key"`
+	TlsCa                     string   `toml:"tls-ca"`
+	TlsClientAuth             string   `toml:"tls-client-auth"`
 	ProtobufPort              int      `toml:"protobuf_port"`
 	ProtobufTimeout           duration `toml:"protobuf_timeout"`
 	ProtobufHeartbeatInterval duration `toml:"protobuf_heartbeat"`
+	ProtobufConnections       int      `toml:"protobuf_connections"`
+	ProtobufRequestTimeout    duration `toml:"protobuf_request_timeout"`
+	RemoteRequestAttempts     int      `toml:"remote-request-attempts"`
+	RemoteRequestMinBackoff   duration `toml:"remote-request-min-backoff"`
+	RemoteRequestMaxBackoff   duration `toml:"remote-request-max-backoff"`
+	HedgedReadPercentile      float64  `toml:"hedged-read-percentile"`
+	HedgedReadMinDelay        duration `toml:"hedged-read-min-delay"`
 	MinBackoff                duration `toml:"protobuf_min_backoff"`
 	MaxBackoff                duration `toml:"protobuf_max_backoff"`
 	WriteBufferSize           int      `toml:"write-buffer-size"`
+	WriteBufferOverflowDir    string   `toml:"write-buffer-overflow-dir"`
+	WriteBufferOverflowSize   size     `toml:"write-buffer-overflow-size"`
+	RecoveryMaxBandwidth      size     `toml:"recovery-max-bandwidth"`
+	RecoveryMaxRequests       int      `toml:"recovery-max-requests-per-second"`
 	ConcurrentShardQueryLimit int      `toml:"concurrent-shard-query-limit"`
 	MaxResponseBufferSize     int      `toml:"max-response-buffer-size"`
+	QueryTimeout              duration `toml:"query-timeout"`
+	MaxReturnedPoints         int      `toml:"max-returned-points"`
+	MaxSelectSeries           int      `toml:"max-select-series"`
+	DatabaseWritePoints       int      `toml:"database-write-points-per-second"`
+	DatabaseConcurrentQueries int      `toml:"database-concurrent-queries"`
+	DatabaseQueriesPerMinute  int      `toml:"database-queries-per-minute"`
+	UserWritePoints           int      `toml:"user-write-points-per-second"`
+	UserConcurrentQueries     int      `toml:"user-concurrent-queries"`
+	UserQueriesPerMinute      int      `toml:"user-queries-per-minute"`
+	HintedHandoffMaxAge       duration `toml:"hinted-handoff-max-age"`
+	HintedHandoffMaxRequests  int      `toml:"hinted-handoff-max-requests"`
+	AntiEntropyInterval       duration `toml:"anti-entropy-interval"`
+	DefaultWriteConsistency   string   `toml:"default-write-consistency"`
+	ReadRepairChance          float64  `toml:"read-repair-chance"`
+	ReadFromFastestReplica    bool     `toml:"read-from-fastest-replica"`
+	RebalanceMoveInterval     duration `toml:"rebalance-move-interval"`
+	Observer                  bool     `toml:"observer"`
+	FailureDomain             string   `toml:"failure-domain"`
+	ShardWriteLeaseDuration   duration `toml:"shard-write-lease-duration"`
+	FailureDetectorThreshold  float64  `toml:"failure-detector-threshold"`
+	WriteCoalesceDelay        duration `toml:"write-coalesce-delay"`
+	WriteCoalesceMaxPoints    int      `toml:"write-coalesce-max-points"`
 }
 
 type LoggingConfig struct {
@@ -115,17 +205,40 @@ type LoggingConfig struct {
 }
 
 type LevelDbConfiguration struct {
-	MaxOpenFiles   int  `toml:"max-open-files"`
-	LruCacheSize   size `toml:"lru-cache-size"`
-	MaxOpenShards  int  `toml:"max-open-shards"`
-	PointBatchSize int  `toml:"point-batch-size"`
-	WriteBatchSize int  `toml:"write-batch-size"`
+	MaxOpenFiles       int      `toml:"max-open-files"`
+	LruCacheSize       size     `toml:"lru-cache-size"`
+	MaxOpenShards      int      `toml:"max-open-shards"`
+	PointBatchSize     int      `toml:"point-batch-size"`
+	WriteBatchSize     int      `toml:"write-batch-size"`
+	ValueCodec         string   `toml:"value-codec"`
+	WriteDedupWindow   duration `toml:"write-dedup-window"`
+	ShardIdleTimeout   duration `toml:"shard-idle-timeout"`
+	BlockSize          size     `toml:"block-size"`
+	WriteBufferSize    size     `toml:"write-buffer-size"`
+	SyncWrites         bool     `toml:"sync-writes"`
+	ParanoidChecks     bool     `toml:"paranoid-checks"`
+	FieldTypeConflicts string   `toml:"field-type-conflicts"`
+	IndexedColumns     []string `toml:"indexed-columns"`
 }
 
 type ShardingDefinition struct {
-	ReplicationFactor int                `toml:"replication-factor"`
-	ShortTerm         ShardConfiguration `toml:"short-term"`
-	LongTerm          ShardConfiguration `toml:"long-term"`
+	ReplicationFactor    int                `toml:"replication-factor"`
+	ShortTerm            ShardConfiguration `toml:"short-term"`
+	LongTerm             ShardConfiguration `toml:"long-term"`
+	RetentionSweepPeriod duration           `toml:"retention-sweep-period"`
+	OrphanSweepPeriod    duration           `toml:"orphan-sweep-period"`
+	DeleteOrphans        bool               `toml:"delete-orphans"`
+	PrecreateLeadTime    duration           `toml:"precreate-lead-time"`
+	Rollups              []RollupConfig     `toml:"rollups"`
+}
+
+// Aggregates the points of the shards of the database once the shards
+// ended more than After ago, then deletes the points of the series the
+// queries read. The queries need an into clause and a group by time.
+type RollupConfig struct {
+	Database string
+	Queries  []string
+	After    string
 }
 
 type ShardConfiguration struct {
@@ -135,6 +248,24 @@ type ShardConfiguration struct {
 	SplitRandom      string `toml:"split-random"`
 	splitRandomRegex *regexp.Regexp
 	hasRandomSplit   bool
+	Retention        string
+	parsedRetention  time.Duration
+	Partitioning     string
+	Routes           []*ShardRoute
+}
+
+// Sends the series starting with the prefix to the shard with the given
+// index among the shards of a period, with prefix partitioning
+type ShardRoute struct {
+	Prefix string
+	Index  int
+}
+
+var partitioningStrategies = map[string]bool{
+	"":                true,
+	"hash":            true,
+	"consistent-hash": true,
+	"prefix":          true,
 }
 
 func (self *ShardConfiguration) ParseAndValidate(defaultShardDuration time.Duration) error {
@@ -151,6 +282,17 @@ func (self *ShardConfiguration) ParseAndValidate(defaultShardDuration time.Durat
 			return err
 		}
 	}
+	if !partitioningStrategies[self.Partitioning] {
+		return fmt.Errorf("Unknown partitioning %s, must be one of hash, consistent-hash or prefix", self.Partitioning)
+	}
+	for _, route := range self.Routes {
+		if route.Prefix == "" || route.Index < 0 || route.Index >= self.Split {
+			return fmt.Errorf("Invalid route of prefix '%s' to shard %d, the index must be less than the split", route.Prefix, route.Index)
+		}
+	}
+	if err := self.SetRetention(self.Retention); err != nil {
+		return err
+	}
 	if self.Duration == "" {
 		self.parsedDuration = defaultShardDuration
 		return nil
@@ -167,6 +309,83 @@ func (self *ShardConfiguration) ParsedDuration() *time.Duration {
 	return &self.parsedDuration
 }
 
+// Returns how long the shards are kept after their end time, 0 if
+// they're kept forever
+func (self *ShardConfiguration) ParsedRetention() time.Duration {
+	return self.parsedRetention
+}
+
+// Changes how long the shards are kept after their end time, "" or
+// "inf" keeps them forever
+func (self *ShardConfiguration) SetRetention(retention string) error {
+	parsed, err := ParseRetention(retention)
+	if err != nil {
+		return err
+	}
+	self.Retention = retention
+	self.parsedRetention = parsed
+	return nil
+}
+
+// Parses a shard retention, 0 means the shards are kept forever
+func ParseRetention(retention string) (time.Duration, error) {
+	if retention == "" || retention == "inf" {
+		return 0, nil
+	}
+	val, err := common.ParseTimeDuration(retention)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(val), nil
+}
+
+// Returns the bounds of the section and the ones of every database of
+// it, which start from the ones of the section
+func parseTimestampBounds(config TimestampBoundsConfig) (TimestampBounds, map[string]TimestampBounds, error) {
+	bounds := TimestampBounds{}
+	if err := bounds.parse(config.MaxPointAge, config.MaxFutureOffset); err != nil {
+		return bounds, nil, err
+	}
+	databases := make(map[string]TimestampBounds, len(config.Databases))
+	for _, database := range config.Databases {
+		if database.Database == "" {
+			return bounds, nil, fmt.Errorf("The timestamp bounds of a database need the database")
+		}
+		databaseBounds := bounds
+		if err := databaseBounds.parse(database.MaxPointAge, database.MaxFutureOffset); err != nil {
+			return bounds, nil, fmt.Errorf("Invalid timestamp bounds of %s: %s", database.Database, err)
+		}
+		databases[database.Database] = databaseBounds
+	}
+	return bounds, databases, nil
+}
+
+// Sets the bounds that aren't empty
+func (self *TimestampBounds) parse(maxPointAge, maxFutureOffset string) error {
+	for _, bound := range []struct {
+		value  string
+		parsed *time.Duration
+	}{{maxPointAge, &self.MaxPointAge}, {maxFutureOffset, &self.MaxFutureOffset}} {
+		if bound.value == "" {
+			continue
+		}
+		val, err := common.ParseTimeDuration(bound.value)
+		if err != nil {
+			return err
+		}
+		*bound.parsed = time.Duration(val)
+	}
+	return nil
+}
+
+// Returns the timestamp bounds of the writes to the database
+func (self *Configuration) GetTimestampBounds(db string) TimestampBounds {
+	if bounds, ok := self.DatabaseTimestampBounds[db]; ok {
+		return bounds
+	}
+	return self.TimestampBounds
+}
+
 func (self *ShardConfiguration) HasRandomSplit() bool {
 	return self.hasRandomSplit
 }
@@ -176,15 +395,95 @@ func (self *ShardConfiguration) SplitRegex() *regexp.Regexp {
 }
 
 type WalConfig struct {
-	Dir                   string `toml:"dir"`
-	FlushAfterRequests    int    `toml:"flush-after"`
-	BookmarkAfterRequests int    `toml:"bookmark-after"`
-	IndexAfterRequests    int    `toml:"index-after"`
-	RequestsPerLogFile    int    `toml:"requests-per-log-file"`
+	Dir                   string   `toml:"dir"`
+	FlushAfterRequests    int      `toml:"flush-after"`
+	BookmarkAfterRequests int      `toml:"bookmark-after"`
+	IndexAfterRequests    int      `toml:"index-after"`
+	RequestsPerLogFile    int      `toml:"requests-per-log-file"`
+	Compress              bool     `toml:"compress"`
+	ReplayConcurrency     int      `toml:"replay-concurrency"`
+	SyncPolicy            string   `toml:"sync-policy"`
+	SyncInterval          duration `toml:"sync-interval"`
+	SyncAfterBytes        size     `toml:"sync-after-bytes"`
+	MaxLogFileSize        size     `toml:"max-log-file-size"`
+	MaxSize               size     `toml:"max-size"`
+	GroupCommitWindow     duration `toml:"group-commit-window"`
+	Preallocate           bool     `toml:"preallocate"`
+	RecycleLogFiles       int      `toml:"recycle-log-files"`
+}
+
+type ReplicationConfig struct {
+	Dir                  string `toml:"dir"`
+	MaxBufferSize        size   `toml:"max-buffer-size"`
+	MaxBandwidth         size   `toml:"max-bandwidth"`
+	MaxRequestsPerSecond int    `toml:"max-requests-per-second"`
+}
+
+type MonitoringConfig struct {
+	Enabled   bool
+	Database  string
+	Interval  duration
+	Retention string
+}
+
+type QueryCacheConfig struct {
+	MaxEntries int `toml:"max-entries"`
+	Freshness  duration
+}
+
+type SlowQueryLogConfig struct {
+	Threshold  duration
+	Format     string
+	MaxEntries int `toml:"max-entries"`
+}
+
+// A processor the series of the writes go through before they're
+// written, in the order of the config. Which of the other fields are used
+// depends on the type. The processor only sees the writes of the database
+// if there's one.
+type IngestProcessorConfig struct {
+	Type        string
+	Database    string
+	Pattern     string
+	Replacement string
+	MaxAge      string `toml:"max-age"`
+	// the fields the validation rules check, all of them if it's empty
+	Fields     []string
+	FieldTypes []string `toml:"field-types"`
+	// the bounds of value-range, nil doesn't bound the values
+	Min *float64
+	Max *float64
+	// the template series-template maps the names with, their parts are
+	// joined with the separator, a dot by default
+	Template  string
+	Separator string
+}
+
+// The oldest and the furthest in the future the points of a write can be,
+// relative to the time of the write. The databases can have their own
+// bounds, the ones they don't set are the ones of the section.
+type TimestampBoundsConfig struct {
+	MaxPointAge     string `toml:"max-point-age"`
+	MaxFutureOffset string `toml:"max-future-offset"`
+	Databases       []DatabaseTimestampBoundsConfig
+}
+
+type DatabaseTimestampBoundsConfig struct {
+	Database        string
+	MaxPointAge     string `toml:"max-point-age"`
+	MaxFutureOffset string `toml:"max-future-offset"`
+}
+
+// The parsed bounds of a database, 0 doesn't limit the timestamps
+type TimestampBounds struct {
+	MaxPointAge     time.Duration
+	MaxFutureOffset time.Duration
 }
 
 type InputPlugins struct {
 	Graphite        GraphiteConfig   `toml:"graphite"`
+	Collectd        CollectdConfig   `toml:"collectd"`
+	OpenTsdb        OpenTsdbConfig   `toml:"opentsdb"`
 	UdpInput        UdpInputConfig   `toml:"udp"`
 	UdpServersInput []UdpInputConfig `toml:"udp_servers"`
 }
@@ -199,47 +498,117 @@ type TomlConfiguration struct {
 	Logging           LoggingConfig
 	LevelDb           LevelDbConfiguration
 	Hostname          string
-	BindAddress       string             `toml:"bind-address"`
-	ReportingDisabled bool               `toml:"reporting-disabled"`
-	Sharding          ShardingDefinition `toml:"sharding"`
-	WalConfig         WalConfig          `toml:"wal"`
+	BindAddress       string                  `toml:"bind-address"`
+	ReportingDisabled bool                    `toml:"reporting-disabled"`
+	StorageEngine     string                  `toml:"storage-engine"`
+	ShutdownTimeout   duration                `toml:"shutdown-timeout"`
+	Sharding          ShardingDefinition      `toml:"sharding"`
+	WalConfig         WalConfig               `toml:"wal"`
+	Replication       ReplicationConfig       `toml:"replication"`
+	Monitoring        MonitoringConfig        `toml:"monitoring"`
+	QueryCache        QueryCacheConfig        `toml:"query-cache"`
+	SlowQueryLog      SlowQueryLogConfig      `toml:"slow-query-log"`
+	TimestampBounds   TimestampBoundsConfig   `toml:"timestamp-bounds"`
+	IngestProcessors  []IngestProcessorConfig `toml:"ingest-processors"`
 }
 
 type Configuration struct {
-	AdminHttpPort   int
-	AdminAssetsDir  string
-	ApiHttpSslPort  int
-	ApiHttpCertPath string
-	ApiHttpPort     int
-	ApiReadTimeout  time.Duration
+	// the file the config was loaded from, it's reloaded from it
+	FileName string
+
+	AdminHttpPort       int
+	AdminAssetsDir      string
+	ApiHttpSslPort      int
+	ApiHttpCertPath     string
+	ApiHttpKeyPath      string
+	ApiHttpPort         int
+	ApiReadTimeout      time.Duration
+	ApiMaxWriteBodySize int64
 
 	GraphiteEnabled    bool
 	GraphitePort       int
 	GraphiteDatabase   string
 	GraphiteUdpEnabled bool
+	GraphiteSeparator  string
+	GraphiteTemplate   string
+	GraphiteBatchSize  int
+
+	CollectdEnabled  bool
+	CollectdPort     int
+	CollectdDatabase string
+	CollectdTypesDB  string
+
+	OpenTsdbEnabled  bool
+	OpenTsdbPort     int
+	OpenTsdbDatabase string
 
 	UdpServers []UdpInputConfig
 
+	MonitoringEnabled   bool
+	MonitoringDatabase  string
+	MonitoringInterval  time.Duration
+	MonitoringRetention string
+
+	QueryCacheMaxEntries int
+	QueryCacheFreshness  time.Duration
+
+	SlowQueryThreshold  time.Duration
+	SlowQueryLogFormat  string
+	SlowQueryMaxEntries int
+
 	RaftServerPort               int
 	RaftTimeout                  duration
 	SeedServers                  []string
 	DataDir                      string
 	RaftDir                      string
+	RaftLogCompactionSize        int64
+	RaftLogCompactionInterval    time.Duration
 	ProtobufPort                 int
 	ProtobufTimeout              duration
 	ProtobufHeartbeatInterval    duration
+	ProtobufConnections          int
+	ProtobufRequestTimeout       time.Duration
+	RemoteRequestAttempts        int
+	RemoteRequestMinBackoff      time.Duration
+	RemoteRequestMaxBackoff      time.Duration
+	HedgedReadPercentile         float64
+	HedgedReadMinDelay           time.Duration
 	ProtobufMinBackoff           duration
 	ProtobufMaxBackoff           duration
 	Hostname                     string
 	LogFile                      string
 	LogLevel                     string
 	BindAddress                  string
+	ClusterBindAddress           string
+	ClusterTlsCert               string
+	ClusterTlsKey                string
+	ClusterTlsCa                 string
+	ClusterTlsClientAuth         string
+	StorageEngine                string
+	ShutdownTimeout              time.Duration
 	LevelDbMaxOpenFiles          int
 	LevelDbLruCacheSize          int
 	LevelDbMaxOpenShards         int
 	LevelDbPointBatchSize        int
 	LevelDbWriteBatchSize        int
+	LevelDbValueCodec            string
+	LevelDbWriteDedupWindow      time.Duration
+	LevelDbShardIdleTimeout      time.Duration
+	LevelDbBlockSize             int
+	LevelDbWriteBufferSize       int
+	LevelDbSyncWrites            bool
+	LevelDbParanoidChecks        bool
+	LevelDbFieldTypeConflicts    string
+	LevelDbIndexedColumns        []string
 	ShortTermShard               *ShardConfiguration
+	RetentionSweepPeriod         time.Duration
+	OrphanedShardSweepPeriod     time.Duration
+	DeleteOrphanedShards         bool
+	ShardPrecreateLeadTime       time.Duration
+	Rollups                      []RollupConfig
+	IngestProcessors             []IngestProcessorConfig
+	TimestampBounds              TimestampBounds
+	DatabaseTimestampBounds      map[string]TimestampBounds
 	LongTermShard                *ShardConfiguration
 	ReplicationFactor            int
 	WalDir                       string
@@ -247,10 +616,50 @@ type Configuration struct {
 	WalBookmarkAfterRequests     int
 	WalIndexAfterRequests        int
 	WalRequestsPerLogFile        int
+	WalCompress                  bool
+	WalReplayConcurrency         int
+	WalSyncPolicy                string
+	WalSyncInterval              time.Duration
+	WalSyncAfterBytes            int64
+	WalMaxLogFileSize            int64
+	WalMaxSize                   int64
+	WalGroupCommitWindow         time.Duration
+	WalPreallocate               bool
+	WalRecycleLogFiles           int
+	ReplicationDir               string
+	ReplicationMaxBufferSize     int64
+	ReplicationMaxBandwidth      int64
+	ReplicationMaxRequestRate    int
+	RecoveryMaxBandwidth         int64
+	RecoveryMaxRequestRate       int
 	LocalStoreWriteBufferSize    int
 	PerServerWriteBufferSize     int
+	WriteBufferOverflowDir       string
+	WriteBufferOverflowSize      int64
 	ClusterMaxResponseBufferSize int
 	ConcurrentShardQueryLimit    int
+	QueryTimeout                 time.Duration
+	MaxReturnedPoints            int
+	MaxSelectSeries              int
+	DatabaseWritePointsPerSecond int
+	DatabaseConcurrentQueries    int
+	DatabaseQueriesPerMinute     int
+	UserWritePointsPerSecond     int
+	UserConcurrentQueries        int
+	UserQueriesPerMinute         int
+	HintedHandoffMaxAge          time.Duration
+	HintedHandoffMaxRequests     int
+	AntiEntropyInterval          time.Duration
+	DefaultWriteConsistency      string
+	ReadRepairChance             float64
+	PreferLocalReads             bool
+	RebalanceMoveInterval        time.Duration
+	Observer                     bool
+	FailureDomain                string
+	ShardWriteLeaseDuration      time.Duration
+	FailureDetectorThreshold     float64
+	WriteCoalesceDelay           time.Duration
+	WriteCoalesceMaxPoints       int
 	ReportingDisabled            bool
 	Version                      string
 	InfluxDBVersion              string
@@ -258,7 +667,7 @@ type Configuration struct {
 
 func LoadConfiguration(fileName string) *Configuration {
 	log.Info("Loading configuration file %s", fileName)
-	config, err := parseTomlConfiguration(fileName)
+	config, err := ParseConfiguration(fileName)
 	if err != nil {
 		log.Error("Couldn't parse configuration file: " + fileName)
 		panic(err)
@@ -266,6 +675,16 @@ func LoadConfiguration(fileName string) *Configuration {
 	return config
 }
 
+// Same as LoadConfiguration, returns the error instead of panicking
+func ParseConfiguration(fileName string) (*Configuration, error) {
+	config, err := parseTomlConfiguration(fileName)
+	if err != nil {
+		return nil, err
+	}
+	config.FileName = fileName
+	return config, nil
+}
+
 func parseTomlConfiguration(filename string) (*Configuration, error) {
 	body, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -284,6 +703,62 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cluster := tomlConfiguration.Cluster; cluster.TlsCert != "" || cluster.TlsKey != "" || cluster.TlsCa != "" {
+		if cluster.TlsCert == "" || cluster.TlsKey == "" || cluster.TlsCa == "" {
+			return nil, fmt.Errorf("tls-cert, tls-key and tls-ca must all be set to use tls between the servers")
+		}
+	}
+
+	switch tomlConfiguration.Cluster.TlsClientAuth {
+	case "", CLUSTER_TLS_CLIENT_AUTH_VERIFY, CLUSTER_TLS_CLIENT_AUTH_NONE:
+	default:
+		return nil, fmt.Errorf("Unknown tls-client-auth %s, must be %s or %s",
+			tomlConfiguration.Cluster.TlsClientAuth, CLUSTER_TLS_CLIENT_AUTH_VERIFY, CLUSTER_TLS_CLIENT_AUTH_NONE)
+	}
+
+	if _, err := ParseRetention(tomlConfiguration.Monitoring.Retention); err != nil {
+		return nil, err
+	}
+
+	switch tomlConfiguration.WalConfig.SyncPolicy {
+	case "", WAL_SYNC_REQUESTS, WAL_SYNC_ALWAYS, WAL_SYNC_INTERVAL, WAL_SYNC_BYTES:
+	default:
+		return nil, fmt.Errorf("Unknown wal sync-policy %s, must be one of %s, %s, %s or %s",
+			tomlConfiguration.WalConfig.SyncPolicy, WAL_SYNC_REQUESTS, WAL_SYNC_ALWAYS, WAL_SYNC_INTERVAL, WAL_SYNC_BYTES)
+	}
+
+	if wal := tomlConfiguration.WalConfig; wal.MaxSize.int64 != 0 && wal.MaxSize.int64 < wal.MaxLogFileSize.int64 {
+		return nil, fmt.Errorf("The wal max-size cannot be smaller than max-log-file-size")
+	}
+	// the wal files would be taken for shards or raft files
+	if walDir := filepath.Clean(tomlConfiguration.WalConfig.Dir); walDir == filepath.Clean(tomlConfiguration.Storage.Dir) || walDir == filepath.Clean(tomlConfiguration.Raft.Dir) {
+		return nil, fmt.Errorf("The wal dir %s cannot be the storage or the raft dir", tomlConfiguration.WalConfig.Dir)
+	}
+	if wal := tomlConfiguration.WalConfig; wal.Preallocate && wal.MaxLogFileSize.int64 == 0 {
+		return nil, fmt.Errorf("The wal max-log-file-size must be set to preallocate the log files")
+	}
+
+	// the codecs of the datastore
+	switch tomlConfiguration.LevelDb.ValueCodec {
+	case "", "protobuf", "compact":
+	default:
+		return nil, fmt.Errorf("Unknown leveldb value-codec %s, must be protobuf or compact", tomlConfiguration.LevelDb.ValueCodec)
+	}
+	switch tomlConfiguration.LevelDb.FieldTypeConflicts {
+	case "", "reject", "coerce":
+	default:
+		return nil, fmt.Errorf("Unknown leveldb field-type-conflicts %s, must be reject or coerce", tomlConfiguration.LevelDb.FieldTypeConflicts)
+	}
+	switch tomlConfiguration.SlowQueryLog.Format {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("Unknown slow-query-log format %s, must be text or json", tomlConfiguration.SlowQueryLog.Format)
+	}
+
+	timestampBounds, databaseTimestampBounds, err := parseTimestampBounds(tomlConfiguration.TimestampBounds)
+	if err != nil {
+		return nil, err
+	}
 
 	if tomlConfiguration.WalConfig.IndexAfterRequests == 0 {
 		tomlConfiguration.WalConfig.IndexAfterRequests = 1000
@@ -320,26 +795,61 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 	}
 
 	config := &Configuration{
-		AdminHttpPort:   tomlConfiguration.Admin.Port,
-		AdminAssetsDir:  tomlConfiguration.Admin.Assets,
-		ApiHttpPort:     tomlConfiguration.HttpApi.Port,
-		ApiHttpCertPath: tomlConfiguration.HttpApi.SslCertPath,
-		ApiHttpSslPort:  tomlConfiguration.HttpApi.SslPort,
-		ApiReadTimeout:  apiReadTimeout,
+		AdminHttpPort:       tomlConfiguration.Admin.Port,
+		AdminAssetsDir:      tomlConfiguration.Admin.Assets,
+		ApiHttpPort:         tomlConfiguration.HttpApi.Port,
+		ApiHttpCertPath:     tomlConfiguration.HttpApi.SslCertPath,
+		ApiHttpKeyPath:      tomlConfiguration.HttpApi.SslKeyPath,
+		ApiHttpSslPort:      tomlConfiguration.HttpApi.SslPort,
+		ApiReadTimeout:      apiReadTimeout,
+		ApiMaxWriteBodySize: tomlConfiguration.HttpApi.MaxWriteBodySize.int64,
 
 		GraphiteEnabled:    tomlConfiguration.InputPlugins.Graphite.Enabled,
 		GraphitePort:       tomlConfiguration.InputPlugins.Graphite.Port,
 		GraphiteDatabase:   tomlConfiguration.InputPlugins.Graphite.Database,
 		GraphiteUdpEnabled: tomlConfiguration.InputPlugins.Graphite.UdpEnabled,
+		GraphiteSeparator:  tomlConfiguration.InputPlugins.Graphite.Separator,
+		GraphiteTemplate:   tomlConfiguration.InputPlugins.Graphite.Template,
+		GraphiteBatchSize:  tomlConfiguration.InputPlugins.Graphite.BatchSize,
+
+		CollectdEnabled:  tomlConfiguration.InputPlugins.Collectd.Enabled,
+		CollectdPort:     tomlConfiguration.InputPlugins.Collectd.Port,
+		CollectdDatabase: tomlConfiguration.InputPlugins.Collectd.Database,
+		CollectdTypesDB:  tomlConfiguration.InputPlugins.Collectd.TypesDB,
+
+		OpenTsdbEnabled:  tomlConfiguration.InputPlugins.OpenTsdb.Enabled,
+		OpenTsdbPort:     tomlConfiguration.InputPlugins.OpenTsdb.Port,
+		OpenTsdbDatabase: tomlConfiguration.InputPlugins.OpenTsdb.Database,
 
 		UdpServers: tomlConfiguration.InputPlugins.UdpServersInput,
 
+		MonitoringEnabled:   tomlConfiguration.Monitoring.Enabled,
+		MonitoringDatabase:  tomlConfiguration.Monitoring.Database,
+		MonitoringInterval:  tomlConfiguration.Monitoring.Interval.Duration,
+		MonitoringRetention: tomlConfiguration.Monitoring.Retention,
+
+		QueryCacheMaxEntries: tomlConfiguration.QueryCache.MaxEntries,
+		QueryCacheFreshness:  tomlConfiguration.QueryCache.Freshness.Duration,
+
+		SlowQueryThreshold:  tomlConfiguration.SlowQueryLog.Threshold.Duration,
+		SlowQueryLogFormat:  tomlConfiguration.SlowQueryLog.Format,
+		SlowQueryMaxEntries: tomlConfiguration.SlowQueryLog.MaxEntries,
+
 		RaftServerPort:               tomlConfiguration.Raft.Port,
 		RaftTimeout:                  tomlConfiguration.Raft.Timeout,
 		RaftDir:                      tomlConfiguration.Raft.Dir,
+		RaftLogCompactionSize:        tomlConfiguration.Raft.LogCompactionSize.int64,
+		RaftLogCompactionInterval:    tomlConfiguration.Raft.LogCompactionInterval.Duration,
 		ProtobufPort:                 tomlConfiguration.Cluster.ProtobufPort,
 		ProtobufTimeout:              tomlConfiguration.Cluster.ProtobufTimeout,
 		ProtobufHeartbeatInterval:    tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
+		ProtobufConnections:          tomlConfiguration.Cluster.ProtobufConnections,
+		ProtobufRequestTimeout:       tomlConfiguration.Cluster.ProtobufRequestTimeout.Duration,
+		RemoteRequestAttempts:        tomlConfiguration.Cluster.RemoteRequestAttempts,
+		RemoteRequestMinBackoff:      tomlConfiguration.Cluster.RemoteRequestMinBackoff.Duration,
+		RemoteRequestMaxBackoff:      tomlConfiguration.Cluster.RemoteRequestMaxBackoff.Duration,
+		HedgedReadPercentile:         tomlConfiguration.Cluster.HedgedReadPercentile,
+		HedgedReadMinDelay:           tomlConfiguration.Cluster.HedgedReadMinDelay.Duration,
 		ProtobufMinBackoff:           tomlConfiguration.Cluster.MinBackoff,
 		ProtobufMaxBackoff:           tomlConfiguration.Cluster.MaxBackoff,
 		SeedServers:                  tomlConfiguration.Cluster.SeedServers,
@@ -348,43 +858,255 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		LogLevel:                     tomlConfiguration.Logging.Level,
 		Hostname:                     tomlConfiguration.Hostname,
 		BindAddress:                  tomlConfiguration.BindAddress,
+		ClusterBindAddress:           tomlConfiguration.Cluster.BindAddress,
+		ClusterTlsCert:               tomlConfiguration.Cluster.TlsCert,
+		ClusterTlsKey:                tomlConfiguration.Cluster.TlsKey,
+		ClusterTlsCa:                 tomlConfiguration.Cluster.TlsCa,
+		ClusterTlsClientAuth:         tomlConfiguration.Cluster.TlsClientAuth,
 		ReportingDisabled:            tomlConfiguration.ReportingDisabled,
+		StorageEngine:                tomlConfiguration.StorageEngine,
+		ShutdownTimeout:              tomlConfiguration.ShutdownTimeout.Duration,
 		LevelDbMaxOpenFiles:          tomlConfiguration.LevelDb.MaxOpenFiles,
 		LevelDbLruCacheSize:          int(tomlConfiguration.LevelDb.LruCacheSize.int64),
 		LevelDbMaxOpenShards:         tomlConfiguration.LevelDb.MaxOpenShards,
 		LongTermShard:                &tomlConfiguration.Sharding.LongTerm,
 		LevelDbPointBatchSize:        tomlConfiguration.LevelDb.PointBatchSize,
 		LevelDbWriteBatchSize:        tomlConfiguration.LevelDb.WriteBatchSize,
+		LevelDbValueCodec:            tomlConfiguration.LevelDb.ValueCodec,
+		LevelDbWriteDedupWindow:      tomlConfiguration.LevelDb.WriteDedupWindow.Duration,
+		LevelDbShardIdleTimeout:      tomlConfiguration.LevelDb.ShardIdleTimeout.Duration,
+		LevelDbBlockSize:             int(tomlConfiguration.LevelDb.BlockSize.int64),
+		LevelDbWriteBufferSize:       int(tomlConfiguration.LevelDb.WriteBufferSize.int64),
+		LevelDbSyncWrites:            tomlConfiguration.LevelDb.SyncWrites,
+		LevelDbParanoidChecks:        tomlConfiguration.LevelDb.ParanoidChecks,
+		LevelDbFieldTypeConflicts:    tomlConfiguration.LevelDb.FieldTypeConflicts,
+		LevelDbIndexedColumns:        tomlConfiguration.LevelDb.IndexedColumns,
 		ShortTermShard:               &tomlConfiguration.Sharding.ShortTerm,
+		RetentionSweepPeriod:         tomlConfiguration.Sharding.RetentionSweepPeriod.Duration,
+		OrphanedShardSweepPeriod:     tomlConfiguration.Sharding.OrphanSweepPeriod.Duration,
+		DeleteOrphanedShards:         tomlConfiguration.Sharding.DeleteOrphans,
+		ShardPrecreateLeadTime:       tomlConfiguration.Sharding.PrecreateLeadTime.Duration,
+		Rollups:                      tomlConfiguration.Sharding.Rollups,
+		IngestProcessors:             tomlConfiguration.IngestProcessors,
+		TimestampBounds:              timestampBounds,
+		DatabaseTimestampBounds:      databaseTimestampBounds,
 		ReplicationFactor:            tomlConfiguration.Sharding.ReplicationFactor,
 		WalDir:                       tomlConfiguration.WalConfig.Dir,
 		WalFlushAfterRequests:        tomlConfiguration.WalConfig.FlushAfterRequests,
 		WalBookmarkAfterRequests:     tomlConfiguration.WalConfig.BookmarkAfterRequests,
 		WalIndexAfterRequests:        tomlConfiguration.WalConfig.IndexAfterRequests,
 		WalRequestsPerLogFile:        tomlConfiguration.WalConfig.RequestsPerLogFile,
+		WalCompress:                  tomlConfiguration.WalConfig.Compress,
+		WalReplayConcurrency:         tomlConfiguration.WalConfig.ReplayConcurrency,
+		WalSyncPolicy:                tomlConfiguration.WalConfig.SyncPolicy,
+		WalSyncInterval:              tomlConfiguration.WalConfig.SyncInterval.Duration,
+		WalSyncAfterBytes:            tomlConfiguration.WalConfig.SyncAfterBytes.int64,
+		WalMaxLogFileSize:            tomlConfiguration.WalConfig.MaxLogFileSize.int64,
+		WalMaxSize:                   tomlConfiguration.WalConfig.MaxSize.int64,
+		WalGroupCommitWindow:         tomlConfiguration.WalConfig.GroupCommitWindow.Duration,
+		WalPreallocate:               tomlConfiguration.WalConfig.Preallocate,
+		WalRecycleLogFiles:           tomlConfiguration.WalConfig.RecycleLogFiles,
+		ReplicationDir:               tomlConfiguration.Replication.Dir,
+		ReplicationMaxBufferSize:     tomlConfiguration.Replication.MaxBufferSize.int64,
+		ReplicationMaxBandwidth:      tomlConfiguration.Replication.MaxBandwidth.int64,
+		ReplicationMaxRequestRate:    tomlConfiguration.Replication.MaxRequestsPerSecond,
+		RecoveryMaxBandwidth:         tomlConfiguration.Cluster.RecoveryMaxBandwidth.int64,
+		RecoveryMaxRequestRate:       tomlConfiguration.Cluster.RecoveryMaxRequests,
 		LocalStoreWriteBufferSize:    tomlConfiguration.Storage.WriteBufferSize,
 		PerServerWriteBufferSize:     tomlConfiguration.Cluster.WriteBufferSize,
+		WriteBufferOverflowDir:       tomlConfiguration.Cluster.WriteBufferOverflowDir,
+		WriteBufferOverflowSize:      tomlConfiguration.Cluster.WriteBufferOverflowSize.int64,
 		ClusterMaxResponseBufferSize: tomlConfiguration.Cluster.MaxResponseBufferSize,
 		ConcurrentShardQueryLimit:    defaultConcurrentShardQueryLimit,
+		QueryTimeout:                 tomlConfiguration.Cluster.QueryTimeout.Duration,
+		MaxReturnedPoints:            tomlConfiguration.Cluster.MaxReturnedPoints,
+		MaxSelectSeries:              tomlConfiguration.Cluster.MaxSelectSeries,
+		DatabaseWritePointsPerSecond: tomlConfiguration.Cluster.DatabaseWritePoints,
+		DatabaseConcurrentQueries:    tomlConfiguration.Cluster.DatabaseConcurrentQueries,
+		DatabaseQueriesPerMinute:     tomlConfiguration.Cluster.DatabaseQueriesPerMinute,
+		UserWritePointsPerSecond:     tomlConfiguration.Cluster.UserWritePoints,
+		UserConcurrentQueries:        tomlConfiguration.Cluster.UserConcurrentQueries,
+		UserQueriesPerMinute:         tomlConfiguration.Cluster.UserQueriesPerMinute,
+		HintedHandoffMaxAge:          tomlConfiguration.Cluster.HintedHandoffMaxAge.Duration,
+		HintedHandoffMaxRequests:     tomlConfiguration.Cluster.HintedHandoffMaxRequests,
+		AntiEntropyInterval:          tomlConfiguration.Cluster.AntiEntropyInterval.Duration,
+		DefaultWriteConsistency:      tomlConfiguration.Cluster.DefaultWriteConsistency,
+		ReadRepairChance:             tomlConfiguration.Cluster.ReadRepairChance,
+		PreferLocalReads:             !tomlConfiguration.Cluster.ReadFromFastestReplica,
+		RebalanceMoveInterval:        tomlConfiguration.Cluster.RebalanceMoveInterval.Duration,
+		Observer:                     tomlConfiguration.Cluster.Observer,
+		FailureDomain:                tomlConfiguration.Cluster.FailureDomain,
+		ShardWriteLeaseDuration:      tomlConfiguration.Cluster.ShardWriteLeaseDuration.Duration,
+		FailureDetectorThreshold:     tomlConfiguration.Cluster.FailureDetectorThreshold,
+		WriteCoalesceDelay:           tomlConfiguration.Cluster.WriteCoalesceDelay.Duration,
+		WriteCoalesceMaxPoints:       tomlConfiguration.Cluster.WriteCoalesceMaxPoints,
 	}
 
 	config.UdpServers = append(config.UdpServers, UdpInputConfig{
-		Enabled:  tomlConfiguration.InputPlugins.UdpInput.Enabled,
-		Database: tomlConfiguration.InputPlugins.UdpInput.Database,
-		Port:     tomlConfiguration.InputPlugins.UdpInput.Port,
+		Enabled:      tomlConfiguration.InputPlugins.UdpInput.Enabled,
+		Database:     tomlConfiguration.InputPlugins.UdpInput.Database,
+		Port:         tomlConfiguration.InputPlugins.UdpInput.Port,
+		BatchSize:    tomlConfiguration.InputPlugins.UdpInput.BatchSize,
+		BatchTimeout: tomlConfiguration.InputPlugins.UdpInput.BatchTimeout,
 	})
 
+	for i := range config.UdpServers {
+		if config.UdpServers[i].BatchSize == 0 {
+			config.UdpServers[i].BatchSize = 1000
+		}
+		if config.UdpServers[i].BatchTimeout.Duration == 0 {
+			config.UdpServers[i].BatchTimeout.Duration = time.Second
+		}
+	}
+
 	if config.LocalStoreWriteBufferSize == 0 {
 		config.LocalStoreWriteBufferSize = 1000
 	}
 	if config.PerServerWriteBufferSize == 0 {
 		config.PerServerWriteBufferSize = 1000
 	}
+	if config.ProtobufConnections == 0 {
+		config.ProtobufConnections = 4
+	}
+	if config.ProtobufRequestTimeout == 0 {
+		config.ProtobufRequestTimeout = 20 * time.Minute
+	}
+	if config.RemoteRequestAttempts == 0 {
+		config.RemoteRequestAttempts = 3
+	}
+	if config.RemoteRequestMinBackoff == 0 {
+		config.RemoteRequestMinBackoff = 100 * time.Millisecond
+	}
+	if config.RemoteRequestMaxBackoff == 0 {
+		config.RemoteRequestMaxBackoff = 2 * time.Second
+	}
+	if config.WalSyncPolicy == "" {
+		config.WalSyncPolicy = WAL_SYNC_REQUESTS
+	}
+	if config.WalSyncInterval == 0 {
+		config.WalSyncInterval = 100 * time.Millisecond
+	}
+	if config.WalSyncAfterBytes == 0 {
+		config.WalSyncAfterBytes = ONE_MEGABYTE
+	}
+	if config.WalReplayConcurrency == 0 {
+		config.WalReplayConcurrency = runtime.NumCPU()
+	}
+	if config.HedgedReadMinDelay == 0 {
+		config.HedgedReadMinDelay = 10 * time.Millisecond
+	}
+
+	if config.WriteBufferOverflowDir == "" {
+		config.WriteBufferOverflowDir = filepath.Join(config.DataDir, "write_buffers")
+	}
+	if config.WriteBufferOverflowSize == 0 {
+		config.WriteBufferOverflowSize = 100 * ONE_MEGABYTE
+	}
+
+	// by default hold on to writes for a down server for a day
+	if config.HintedHandoffMaxAge == 0 {
+		config.HintedHandoffMaxAge = 24 * time.Hour
+	}
+
+	if config.ApiMaxWriteBodySize == 0 {
+		config.ApiMaxWriteBodySize = 100 * ONE_MEGABYTE
+	}
+
+	if config.RaftLogCompactionSize == 0 {
+		config.RaftLogCompactionSize = 10 * ONE_MEGABYTE
+	}
+
+	if config.RaftLogCompactionInterval == 0 {
+		config.RaftLogCompactionInterval = 24 * time.Hour
+	}
+
+	if config.ReplicationDir == "" {
+		config.ReplicationDir = filepath.Join(config.DataDir, "replication")
+	}
+
+	if config.ReplicationMaxBufferSize == 0 {
+		config.ReplicationMaxBufferSize = ONE_GIGABYTE
+	}
+
+	if config.RetentionSweepPeriod == 0 {
+		config.RetentionSweepPeriod = 10 * time.Minute
+	}
+
+	if config.GraphiteSeparator == "" {
+		config.GraphiteSeparator = "."
+	}
+
+	if config.GraphiteBatchSize == 0 {
+		config.GraphiteBatchSize = 1000
+	}
+
+	if config.CollectdTypesDB == "" {
+		config.CollectdTypesDB = "/usr/share/collectd/types.db"
+	}
+
+	if config.ShardPrecreateLeadTime == 0 {
+		config.ShardPrecreateLeadTime = 15 * time.Minute
+	}
+
+	if config.ClusterTlsClientAuth == "" {
+		config.ClusterTlsClientAuth = CLUSTER_TLS_CLIENT_AUTH_VERIFY
+	}
+
+	if config.MonitoringDatabase == "" {
+		config.MonitoringDatabase = "_internal"
+	}
+
+	if config.MonitoringInterval == 0 {
+		config.MonitoringInterval = 10 * time.Second
+	}
+
+	if config.MonitoringRetention == "" {
+		config.MonitoringRetention = "7d"
+	}
+
+	if config.QueryCacheFreshness == 0 {
+		config.QueryCacheFreshness = 10 * time.Second
+	}
+
+	if config.SlowQueryLogFormat == "" {
+		config.SlowQueryLogFormat = "text"
+	}
+
+	if config.SlowQueryMaxEntries == 0 {
+		config.SlowQueryMaxEntries = 100
+	}
+
+	if config.FailureDetectorThreshold == 0 {
+		config.FailureDetectorThreshold = 8
+	}
+
+	if config.WriteCoalesceMaxPoints == 0 {
+		config.WriteCoalesceMaxPoints = 1000
+	}
+
+	if config.RebalanceMoveInterval == 0 {
+		config.RebalanceMoveInterval = time.Minute
+	}
 
 	if config.ClusterMaxResponseBufferSize == 0 {
 		config.ClusterMaxResponseBufferSize = 100
 	}
 
+	// the cluster listeners bind to the same interface as the api unless
+	// they have their own
+	if config.ClusterBindAddress == "" {
+		config.ClusterBindAddress = config.BindAddress
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
+
+	// the only engine until others are registered in the datastore
+	if config.StorageEngine == "" {
+		config.StorageEngine = "leveldb"
+	}
+
 	// if it wasn't set, set it to 100
 	if config.LevelDbMaxOpenFiles == 0 {
 		config.LevelDbMaxOpenFiles = 100
@@ -395,6 +1117,11 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.LevelDbLruCacheSize = int(200 * ONE_MEGABYTE)
 	}
 
+	// if it wasn't set, set it to 64 KB
+	if config.LevelDbBlockSize == 0 {
+		config.LevelDbBlockSize = int(64 * ONE_KILOBYTE)
+	}
+
 	// if it wasn't set, set it to 100
 	if config.LevelDbPointBatchSize == 0 {
 		config.LevelDbPointBatchSize = 100
@@ -405,6 +1132,20 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.LevelDbWriteBatchSize = 10 * 1024 * 1024
 	}
 
+	// if it wasn't set, keep the format of the shards created before the
+	// codecs
+	if config.LevelDbValueCodec == "" {
+		config.LevelDbValueCodec = "protobuf"
+	}
+
+	if config.LevelDbWriteDedupWindow == 0 {
+		config.LevelDbWriteDedupWindow = 10 * time.Minute
+	}
+
+	if config.LevelDbFieldTypeConflicts == "" {
+		config.LevelDbFieldTypeConflicts = "reject"
+	}
+
 	return config, nil
 }
 
@@ -454,6 +1195,22 @@ func (self *Configuration) GraphitePortString() string {
 	return fmt.Sprintf("%s:%d", self.BindAddress, self.GraphitePort)
 }
 
+func (self *Configuration) CollectdPortString() string {
+	if self.CollectdPort <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d", self.BindAddress, self.CollectdPort)
+}
+
+func (self *Configuration) OpenTsdbPortString() string {
+	if self.OpenTsdbPort <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d", self.BindAddress, self.OpenTsdbPort)
+}
+
 func (self *Configuration) UdpInputPortString(port int) string {
 	if port <= 0 {
 		return ""
@@ -480,13 +1237,26 @@ func (self *Configuration) ProtobufConnectionString() string {
 }
 
 func (self *Configuration) RaftConnectionString() string {
-	return fmt.Sprintf("http://%s:%d", self.HostnameOrDetect(), self.RaftServerPort)
+	return fmt.Sprintf("%s://%s:%d", self.RaftScheme(), self.HostnameOrDetect(), self.RaftServerPort)
+}
+
+// Returns the scheme of the raft urls, https if the servers talk to each
+// other over tls
+func (self *Configuration) RaftScheme() string {
+	if self.ClusterTlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func (self *Configuration) ClusterTlsEnabled() bool {
+	return self.ClusterTlsCert != ""
 }
 
 func (self *Configuration) ProtobufListenString() string {
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.ProtobufPort)
+	return fmt.Sprintf("%s:%d", self.ClusterBindAddress, self.ProtobufPort)
 }
 
 func (self *Configuration) RaftListenString() string {
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.RaftServerPort)
+	return fmt.Sprintf("%s:%d", self.ClusterBindAddress, self.RaftServerPort)
 }
@@ -1,6 +1,7 @@
 package configuration
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -30,24 +31,53 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	// file
 	c.Assert(config.LevelDbMaxOpenFiles, Equals, 100)
 	c.Assert(config.LevelDbPointBatchSize, Equals, 50)
+	c.Assert(config.LevelDbValueCodec, Equals, "compact")
+	c.Assert(config.LevelDbWriteDedupWindow, Equals, 30*time.Minute)
+	c.Assert(config.LevelDbShardIdleTimeout, Equals, time.Hour)
+	c.Assert(config.LevelDbBlockSize, Equals, 32*1024)
+	c.Assert(config.LevelDbWriteBufferSize, Equals, 8*1024*1024)
+	c.Assert(config.LevelDbSyncWrites, Equals, true)
+	c.Assert(config.LevelDbParanoidChecks, Equals, true)
+	c.Assert(config.LevelDbFieldTypeConflicts, Equals, "coerce")
+	c.Assert(config.LevelDbIndexedColumns, DeepEquals, []string{"host", "region"})
+	c.Assert(config.StorageEngine, Equals, "leveldb")
+	c.Assert(config.ShutdownTimeout, Equals, 10*time.Second)
 
 	c.Assert(config.ApiHttpPort, Equals, 0)
 	c.Assert(config.ApiHttpSslPort, Equals, 8087)
 	c.Assert(config.ApiHttpCertPath, Equals, "../cert.pem")
+	c.Assert(config.ApiHttpKeyPath, Equals, "../key.pem")
 	c.Assert(config.ApiHttpPortString(), Equals, "")
+	c.Assert(config.ApiMaxWriteBodySize, Equals, 10*ONE_MEGABYTE)
 
 	c.Assert(config.GraphiteEnabled, Equals, false)
 	c.Assert(config.GraphitePort, Equals, 2003)
 	c.Assert(config.GraphiteDatabase, Equals, "")
+	c.Assert(config.GraphiteSeparator, Equals, "_")
+	c.Assert(config.GraphiteTemplate, Equals, "host.series.series")
+	c.Assert(config.GraphiteBatchSize, Equals, 500)
+
+	c.Assert(config.CollectdEnabled, Equals, false)
+	c.Assert(config.CollectdPort, Equals, 25826)
+	c.Assert(config.CollectdDatabase, Equals, "collectd")
+	c.Assert(config.CollectdTypesDB, Equals, "/usr/share/collectd/types.db")
+
+	c.Assert(config.OpenTsdbEnabled, Equals, false)
+	c.Assert(config.OpenTsdbPort, Equals, 4242)
+	c.Assert(config.OpenTsdbDatabase, Equals, "opentsdb")
 
 	c.Assert(config.UdpServers, HasLen, 1)
 	c.Assert(config.UdpServers[0].Enabled, Equals, true)
 	c.Assert(config.UdpServers[0].Port, Equals, 4444)
 	c.Assert(config.UdpServers[0].Database, Equals, "test")
+	c.Assert(config.UdpServers[0].BatchSize, Equals, 100)
+	c.Assert(config.UdpServers[0].BatchTimeout.Duration, Equals, 50*time.Millisecond)
 
 	c.Assert(config.RaftDir, Equals, "/tmp/influxdb/development/raft")
 	c.Assert(config.RaftServerPort, Equals, 8090)
 	c.Assert(config.RaftTimeout.Duration, Equals, time.Second)
+	c.Assert(config.RaftLogCompactionSize, Equals, 5*ONE_MEGABYTE)
+	c.Assert(config.RaftLogCompactionInterval, Equals, 12*time.Hour)
 
 	c.Assert(config.DataDir, Equals, "/tmp/influxdb/development/db")
 
@@ -56,15 +86,106 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.ProtobufMinBackoff.Duration, Equals, 100*time.Millisecond)
 	c.Assert(config.ProtobufMaxBackoff.Duration, Equals, time.Second)
 	c.Assert(config.ProtobufTimeout.Duration, Equals, 2*time.Second)
+	c.Assert(config.ProtobufConnections, Equals, 2)
+	c.Assert(config.ProtobufRequestTimeout, Equals, 5*time.Minute)
+	c.Assert(config.RemoteRequestAttempts, Equals, 5)
+	c.Assert(config.RemoteRequestMinBackoff, Equals, 50*time.Millisecond)
+	c.Assert(config.RemoteRequestMaxBackoff, Equals, time.Second)
+	c.Assert(config.HedgedReadPercentile, Equals, 95.0)
+	c.Assert(config.HedgedReadMinDelay, Equals, 5*time.Millisecond)
 	c.Assert(config.SeedServers, DeepEquals, []string{"hosta:8090", "hostb:8090"})
+	c.Assert(config.ProtobufListenString(), Equals, "10.0.0.1:8099")
+	c.Assert(config.ClusterTlsEnabled(), Equals, true)
+	c.Assert(config.ClusterTlsCert, Equals, "/etc/influxdb/server.pem")
+	c.Assert(config.ClusterTlsKey, Equals, "/etc/influxdb/server.key")
+	c.Assert(config.ClusterTlsCa, Equals, "/etc/influxdb/ca.pem")
+	c.Assert(config.ClusterTlsClientAuth, Equals, CLUSTER_TLS_CLIENT_AUTH_NONE)
+	c.Assert(strings.HasPrefix(config.RaftConnectionString(), "https://"), Equals, true)
 
 	c.Assert(config.WalDir, Equals, "/tmp/influxdb/development/wal")
 	c.Assert(config.WalFlushAfterRequests, Equals, 0)
 	c.Assert(config.WalBookmarkAfterRequests, Equals, 0)
 	c.Assert(config.WalIndexAfterRequests, Equals, 1000)
 	c.Assert(config.WalRequestsPerLogFile, Equals, 10000)
+	c.Assert(config.WalCompress, Equals, true)
+	c.Assert(config.WalReplayConcurrency, Equals, 8)
+	c.Assert(config.WalSyncPolicy, Equals, WAL_SYNC_INTERVAL)
+	c.Assert(config.WalSyncInterval, Equals, 50*time.Millisecond)
+	c.Assert(config.WalSyncAfterBytes, Equals, ONE_MEGABYTE)
+	c.Assert(config.WalMaxLogFileSize, Equals, 64*ONE_MEGABYTE)
+	c.Assert(config.WalMaxSize, Equals, ONE_GIGABYTE)
+	c.Assert(config.WalGroupCommitWindow, Equals, 2*time.Millisecond)
+	c.Assert(config.WalPreallocate, Equals, true)
+	c.Assert(config.WalRecycleLogFiles, Equals, 4)
+
+	c.Assert(config.ReplicationDir, Equals, "/tmp/influxdb/development/replication")
+	c.Assert(config.ReplicationMaxBufferSize, Equals, 100*ONE_MEGABYTE)
+	c.Assert(config.ReplicationMaxBandwidth, Equals, 10*ONE_MEGABYTE)
+	c.Assert(config.ReplicationMaxRequestRate, Equals, 100)
 
 	c.Assert(config.ClusterMaxResponseBufferSize, Equals, 5)
+	c.Assert(config.QueryTimeout, Equals, time.Minute)
+	c.Assert(config.MaxReturnedPoints, Equals, 1000000)
+	c.Assert(config.MaxSelectSeries, Equals, 1000)
+	c.Assert(config.DatabaseWritePointsPerSecond, Equals, 50000)
+	c.Assert(config.DatabaseConcurrentQueries, Equals, 20)
+	c.Assert(config.DatabaseQueriesPerMinute, Equals, 600)
+	c.Assert(config.UserWritePointsPerSecond, Equals, 10000)
+	c.Assert(config.UserConcurrentQueries, Equals, 5)
+	c.Assert(config.UserQueriesPerMinute, Equals, 120)
+	c.Assert(config.WriteBufferOverflowDir, Equals, "/tmp/influxdb/development/write_buffers")
+	c.Assert(config.WriteBufferOverflowSize, Equals, 10*ONE_MEGABYTE)
+	c.Assert(config.RecoveryMaxBandwidth, Equals, 5*ONE_MEGABYTE)
+	c.Assert(config.RecoveryMaxRequestRate, Equals, 50)
+	c.Assert(config.HintedHandoffMaxAge, Equals, time.Hour)
+	c.Assert(config.HintedHandoffMaxRequests, Equals, 50000)
+	c.Assert(config.AntiEntropyInterval, Equals, 6*time.Hour)
+	c.Assert(config.DefaultWriteConsistency, Equals, "quorum")
+	c.Assert(config.ReadRepairChance, Equals, 0.5)
+	c.Assert(config.PreferLocalReads, Equals, false)
+	c.Assert(config.RebalanceMoveInterval, Equals, 10*time.Second)
+	c.Assert(config.Observer, Equals, true)
+	c.Assert(config.FailureDomain, Equals, "us-east-1a")
+	c.Assert(config.ShardWriteLeaseDuration, Equals, 10*time.Second)
+	c.Assert(config.FailureDetectorThreshold, Equals, 10.0)
+	c.Assert(config.WriteCoalesceDelay, Equals, 10*time.Millisecond)
+	c.Assert(config.WriteCoalesceMaxPoints, Equals, 500)
+	c.Assert(config.RetentionSweepPeriod, Equals, time.Minute)
+	c.Assert(config.OrphanedShardSweepPeriod, Equals, 30*time.Minute)
+	c.Assert(config.DeleteOrphanedShards, Equals, true)
+	c.Assert(config.ShardPrecreateLeadTime, Equals, time.Hour)
+	c.Assert(config.MonitoringEnabled, Equals, true)
+	c.Assert(config.MonitoringDatabase, Equals, "_monitoring")
+	c.Assert(config.MonitoringInterval, Equals, 30*time.Second)
+	c.Assert(config.MonitoringRetention, Equals, "2d")
+	c.Assert(config.QueryCacheMaxEntries, Equals, 500)
+	c.Assert(config.QueryCacheFreshness, Equals, 5*time.Second)
+	c.Assert(config.SlowQueryThreshold, Equals, 2*time.Second)
+	c.Assert(config.SlowQueryLogFormat, Equals, "json")
+	c.Assert(config.SlowQueryMaxEntries, Equals, 50)
+	c.Assert(config.Rollups, DeepEquals, []RollupConfig{
+		RollupConfig{
+			Database: "metrics",
+			Queries: []string{
+				"select mean(value) from cpu group by time(5m) into cpu.5m",
+				"select max(value) from disk group by time(1h) into disk.1h",
+			},
+			After: "7d",
+		},
+	})
+	c.Assert(config.GetTimestampBounds("db1"), Equals, TimestampBounds{365 * 24 * time.Hour, time.Hour})
+	c.Assert(config.GetTimestampBounds("metrics"), Equals, TimestampBounds{30 * 24 * time.Hour, time.Hour})
+	minPercent, maxPercent := 0.0, 100.0
+	c.Assert(config.IngestProcessors, DeepEquals, []IngestProcessorConfig{
+		IngestProcessorConfig{Type: "rename-series", Pattern: `^servers\.([^.]+)\.cpu$`, Replacement: "cpu.$1"},
+		IngestProcessorConfig{Type: "drop-old-points", Database: "metrics", MaxAge: "30d"},
+		IngestProcessorConfig{Type: "value-range", Database: "metrics", Fields: []string{"cpu_percent"}, Min: &minPercent, Max: &maxPercent},
+	})
+	c.Assert(config.ShortTermShard.ParsedRetention(), Equals, 14*24*time.Hour)
+	c.Assert(config.LongTermShard.ParsedRetention(), Equals, time.Duration(0))
+	c.Assert(config.ShortTermShard.Partitioning, Equals, "prefix")
+	c.Assert(config.ShortTermShard.Routes, DeepEquals, []*ShardRoute{&ShardRoute{Prefix: "tenant_a.", Index: 0}})
+	c.Assert(config.LongTermShard.Partitioning, Equals, "")
 }
 
 func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
@@ -74,3 +195,16 @@ func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
 	c.Assert(s.UnmarshalText([]byte("10g")), IsNil)
 	c.Assert(s.int64, Equals, 10*ONE_GIGABYTE)
 }
+
+func (self *LoadConfigurationSuite) TestTheChangedSettingsOfAReloadedConfigAreListed(c *C) {
+	config := LoadConfiguration("config.toml")
+	c.Assert(config.FileName, Equals, "config.toml")
+	reloaded, err := ParseConfiguration("config.toml")
+	c.Assert(err, IsNil)
+	c.Assert(config.ChangedSettings(reloaded), HasLen, 0)
+
+	reloaded.QueryTimeout = time.Minute
+	reloaded.DataDir = "/tmp/influxdb/reloaded"
+	c.Assert(reloaded.ShortTermShard.SetRetention("1d"), IsNil)
+	c.Assert(config.ChangedSettings(reloaded), DeepEquals, []string{"DataDir", "QueryTimeout", "ShortTermShard.Retention"})
+}
@@ -0,0 +1,52 @@
+package configuration
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Returns the names of the fields of the config that have another value
+// in the other config, e.g. QueryTimeout. The retention of the shards is
+// compared on its own, as ShortTermShard.Retention, since it can change
+// without the rest of the shard config.
+func (self *Configuration) ChangedSettings(other *Configuration) []string {
+	changed := []string{}
+	value, otherValue := reflect.ValueOf(self).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		switch name {
+		case "FileName":
+			continue
+		case "ShortTermShard", "LongTermShard":
+			shard, otherShard := value.Field(i).Interface().(*ShardConfiguration), otherValue.Field(i).Interface().(*ShardConfiguration)
+			changed = append(changed, changedShardSettings(name, shard, otherShard)...)
+			continue
+		}
+		if !reflect.DeepEqual(value.Field(i).Interface(), otherValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func changedShardSettings(name string, shard, other *ShardConfiguration) []string {
+	if shard == nil || other == nil {
+		if shard != other {
+			return []string{name}
+		}
+		return nil
+	}
+	changed := []string{}
+	if shard.Retention != other.Retention {
+		changed = append(changed, name+".Retention")
+	}
+	// the compiled regexes aren't compared, their sources are
+	a, b := *shard, *other
+	a.Retention, a.parsedRetention, a.splitRandomRegex = "", 0, nil
+	b.Retention, b.parsedRetention, b.splitRandomRegex = "", 0, nil
+	if !reflect.DeepEqual(a, b) {
+		changed = append(changed, name)
+	}
+	return changed
+}
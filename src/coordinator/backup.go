@@ -0,0 +1,250 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Backs up the cluster metadata and every shard to dir, which has to be
+// an absolute path since every server writes the backups of its shards
+// to the same directory on its own disk. The servers are asked to back
+// up their shards at the same time and each of them takes snapshots of
+// all its shards before writing any of them.
+func (self *CoordinatorImpl) Backup(user common.User, dir string) (*cluster.BackupManifest, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to back up the cluster")
+	}
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("The backup directory must be an absolute path, got %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	metadata, err := self.clusterConfiguration.Save()
+	if err != nil {
+		return nil, err
+	}
+	manifest, shardsByServer, err := self.clusterConfiguration.PlanBackup()
+	if err != nil {
+		return nil, err
+	}
+
+	errors := make(chan error, len(shardsByServer))
+	for serverId, shardIds := range shardsByServer {
+		go func(serverId uint32, shardIds []uint32) {
+			err := self.clusterConfiguration.BackupShardsOnServer(serverId, shardIds, dir, user)
+			if err != nil {
+				err = fmt.Errorf("Cannot back up shards %v on server %d: %s", shardIds, serverId, err)
+			}
+			errors <- err
+		}(serverId, shardIds)
+	}
+	for i := 0; i < len(shardsByServer); i++ {
+		if e := <-errors; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, cluster.BACKUP_METADATA_FILE), metadata, 0644); err != nil {
+		return nil, err
+	}
+	js, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, cluster.BACKUP_MANIFEST_FILE), js, 0644); err != nil {
+		return nil, err
+	}
+	log.Info("Backed up %d shards to %s", len(manifest.Shards), dir)
+	return manifest, nil
+}
+
+// Restores a backup on a cluster that doesn't have any shards yet. The
+// backups of all the shards have to be in dir on this server. The
+// databases, users and continuous queries are recreated first, then
+// every shard is created on this server with the data from the backup
+// and copied to as many other servers as the replication factor asks
+// for. The copies run in the background.
+func (self *CoordinatorImpl) Restore(user common.User, dir string) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to restore a backup")
+	}
+	if len(self.clusterConfiguration.GetAllShards()) > 0 {
+		return fmt.Errorf("Backups can only be restored on a cluster without any shards")
+	}
+
+	manifest := &cluster.BackupManifest{}
+	js, err := ioutil.ReadFile(filepath.Join(dir, cluster.BACKUP_MANIFEST_FILE))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(js, manifest); err != nil {
+		return err
+	}
+	metadata, err := ioutil.ReadFile(filepath.Join(dir, cluster.BACKUP_METADATA_FILE))
+	if err != nil {
+		return err
+	}
+	data, err := cluster.DecodeSavedConfiguration(metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := self.restoreMetadata(data); err != nil {
+		return err
+	}
+
+	shardIds, err := self.restoreShards(manifest, dir)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		replicationFactor := self.clusterConfiguration.GetReplicationFactor()
+		for _, id := range shardIds {
+			shard := self.waitForShard(id)
+			if shard == nil {
+				log.Error("Cannot replicate restored shard %d, it never showed up in the cluster config", id)
+				continue
+			}
+			if err := self.replicateShard(user, shard, replicationFactor); err != nil {
+				log.Error("Cannot replicate restored shard %d: %s", id, err)
+			}
+		}
+		log.Info("Finished restoring %d shards from %s", len(shardIds), dir)
+	}()
+	return nil
+}
+
+func (self *CoordinatorImpl) restoreMetadata(data *cluster.SavedConfiguration) error {
+	for db, _ := range data.Databases {
+		if self.clusterConfiguration.DatabaseExists(db) {
+			continue
+		}
+		if err := self.raftServer.CreateDatabase(db); err != nil {
+			return err
+		}
+	}
+	for db, consistency := range data.WriteConsistency {
+		if err := self.raftServer.SetWriteConsistency(db, consistency); err != nil {
+			return err
+		}
+	}
+	for db, retention := range data.DatabaseRetention {
+		if err := self.raftServer.SetDatabaseRetention(db, retention.String()); err != nil {
+			return err
+		}
+	}
+	if data.ReplicationFactor > 0 {
+		if err := self.raftServer.SetReplicationFactor(data.ReplicationFactor); err != nil {
+			return err
+		}
+	}
+	if data.ShortTermShardDuration > 0 {
+		if err := self.raftServer.SetShardDuration(cluster.SHORT_TERM, data.ShortTermShardDuration); err != nil {
+			return err
+		}
+	}
+	if data.LongTermShardDuration > 0 {
+		if err := self.raftServer.SetShardDuration(cluster.LONG_TERM, data.LongTermShardDuration); err != nil {
+			return err
+		}
+	}
+	for _, target := range data.ReplicationTargets {
+		if err := self.raftServer.CreateReplicationTarget(target); err != nil {
+			return err
+		}
+	}
+	for _, admin := range data.Admins {
+		if err := self.raftServer.SaveClusterAdminUser(admin); err != nil {
+			return err
+		}
+	}
+	for _, users := range data.DbUsers {
+		for _, user := range users {
+			if err := self.raftServer.SaveDbUser(user); err != nil {
+				return err
+			}
+		}
+	}
+	for db, queries := range data.ContinuousQueries {
+		for _, query := range queries {
+			if err := self.raftServer.CreateContinuousQuery(db, query.Query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates the shards of the backup on this server and loads their data,
+// returns the ids of the new shards
+func (self *CoordinatorImpl) restoreShards(manifest *cluster.BackupManifest, dir string) ([]uint32, error) {
+	localId := self.clusterConfiguration.ServerId()
+
+	// the shards of a split duration have to be created together
+	groups := make([][]*cluster.ShardBackup, 0)
+	for _, backup := range manifest.Shards {
+		last := len(groups) - 1
+		if last >= 0 && sameShardDuration(groups[last][0], backup) {
+			groups[last] = append(groups[last], backup)
+			continue
+		}
+		groups = append(groups, []*cluster.ShardBackup{backup})
+	}
+
+	shardIds := make([]uint32, 0, len(manifest.Shards))
+	for _, group := range groups {
+		newShards := make([]*cluster.NewShardData, 0, len(group))
+		for _, backup := range group {
+			newShards = append(newShards, &cluster.NewShardData{
+				Type:          backup.Type,
+				StartTime:     backup.StartTime,
+				EndTime:       backup.EndTime,
+				DurationSplit: backup.DurationSplit,
+				ServerIds:     []uint32{localId},
+			})
+		}
+		shards, err := self.raftServer.CreateShards(newShards)
+		if err != nil {
+			return nil, err
+		}
+		for i, shard := range shards {
+			backup := group[i]
+			log.Info("Restoring shard %d from the backup of shard %d", shard.Id(), backup.Id)
+			if err := self.clusterConfiguration.RestoreShard(shard.Id(), filepath.Join(dir, backup.Dir)); err != nil {
+				return nil, err
+			}
+			shardIds = append(shardIds, shard.Id())
+		}
+	}
+	return shardIds, nil
+}
+
+func sameShardDuration(a, b *cluster.ShardBackup) bool {
+	return a.Type == b.Type && a.StartTime.Equal(b.StartTime) && a.EndTime.Equal(b.EndTime)
+}
+
+// the shards are created through raft, this server may not have
+// applied the command yet
+func (self *CoordinatorImpl) waitForShard(id uint32) *cluster.ShardData {
+	for i := 0; i < 100; i++ {
+		if shard := self.clusterConfiguration.GetShard(id); shard != nil {
+			return shard
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
@@ -81,6 +81,33 @@ func (self *ClientServerSuite) TestClientCanMakeRequests(c *C) {
 	}
 }
 
+// never responds
+type silentRequestHandler struct{}
+
+func (self *silentRequestHandler) HandleRequest(request *protocol.Request, conn net.Conn) error {
+	return nil
+}
+
+func (self *ClientServerSuite) TestRequestsTimeOut(c *C) {
+	protobufServer := NewProtobufServer(":8092", &silentRequestHandler{})
+	go protobufServer.ListenAndServe()
+	pool := NewProtobufConnectionPool("localhost:8092", 2, 0, time.Millisecond)
+	pool.Connect()
+	time.Sleep(time.Second)
+
+	responseStream := make(chan *protocol.Response, 1)
+	requestType := protocol.Request_QUERY
+	request := &protocol.Request{Type: &requestType, Database: protocol.String("db1")}
+	c.Assert(pool.MakeRequest(request, responseStream), IsNil)
+	select {
+	case <-time.After(3 * REQUEST_SWEEP_INTERVAL):
+		c.Error("Timed out waiting for the request to time out")
+	case response := <-responseStream:
+		c.Assert(response.GetType(), Equals, protocol.Response_END_STREAM)
+		c.Assert(response.ErrorMessage, NotNil)
+	}
+}
+
 func (self *ClientServerSuite) TestClientReconnectsIfDisconnected(c *C) {
 }
 
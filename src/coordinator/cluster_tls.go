@@ -0,0 +1,68 @@
+package coordinator
+
+import (
+	"configuration"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Returns the tls config the servers use to talk to each other, nil if
+// the cluster traffic isn't encrypted. Both ends of every connection
+// present their certificate, the servers always check the certificate of
+// the server they connect to against the configured ca and the one of
+// the connecting server too unless tls-client-auth is none.
+func NewClusterTlsConfig(config *configuration.Configuration) (*tls.Config, error) {
+	if !config.ClusterTlsEnabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.ClusterTlsCert, config.ClusterTlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load the cluster certificate: %s", err)
+	}
+	ca, err := ioutil.ReadFile(config.ClusterTlsCa)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the cluster ca: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", config.ClusterTlsCa)
+	}
+	clientAuth := tls.RequireAndVerifyClientCert
+	if config.ClusterTlsClientAuth == configuration.CLUSTER_TLS_CLIENT_AUTH_NONE {
+		clientAuth = tls.NoClientCert
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   clientAuth,
+	}, nil
+}
+
+// wraps the listener to accept only tls connections if tlsConfig is set
+func clusterListener(listener net.Listener, tlsConfig *tls.Config) net.Listener {
+	if tlsConfig == nil {
+		return listener
+	}
+	return tls.NewListener(listener, tlsConfig)
+}
+
+func dialCluster(address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, tlsConfig)
+}
+
+// Returns the client used for the raft http requests
+func clusterHttpClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
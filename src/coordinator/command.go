@@ -17,6 +17,8 @@ func init() {
 	internalRaftCommands = map[string]raft.Command{}
 	for _, command := range []raft.Command{
 		&InfluxJoinCommand{},
+		&InfluxJoinObserverCommand{},
+		&AddServerCommand{},
 		&InfluxForceLeaveCommand{},
 		&InfluxChangeConnectionStringCommand{},
 		&CreateDatabaseCommand{},
@@ -30,6 +32,20 @@ func init() {
 		&SetContinuousQueryTimestampCommand{},
 		&CreateShardsCommand{},
 		&DropShardCommand{},
+		&SetWriteConsistencyCommand{},
+		&SetDatabaseRetentionCommand{},
+		&SetReadOnlyCommand{},
+		&SetMaxSeriesCommand{},
+		&DecommissionServerCommand{},
+		&SetFailureDomainCommand{},
+		&AcquireShardLeaseCommand{},
+		&AddShardReplicaCommand{},
+		&SetReplicationFactorCommand{},
+		&SetShardDurationCommand{},
+		&SetRuntimeSettingCommand{},
+		&CreateReplicationTargetCommand{},
+		&DropReplicationTargetCommand{},
+		&CreateTombstoneCommand{},
 	} {
 		internalRaftCommands[command.CommandName()] = command
 	}
@@ -127,6 +143,84 @@ func (c *CreateDatabaseCommand) Apply(server raft.Server) (interface{}, error) {
 	return nil, err
 }
 
+type SetWriteConsistencyCommand struct {
+	Database    string `json:"database"`
+	Consistency string `json:"consistency"`
+}
+
+func NewSetWriteConsistencyCommand(database, consistency string) *SetWriteConsistencyCommand {
+	return &SetWriteConsistencyCommand{database, consistency}
+}
+
+func (c *SetWriteConsistencyCommand) CommandName() string {
+	return "set_write_consistency"
+}
+
+func (c *SetWriteConsistencyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetWriteConsistency(c.Database, c.Consistency)
+	return nil, err
+}
+
+type SetDatabaseRetentionCommand struct {
+	Database  string `json:"database"`
+	Retention string `json:"retention"`
+}
+
+func NewSetDatabaseRetentionCommand(database, retention string) *SetDatabaseRetentionCommand {
+	return &SetDatabaseRetentionCommand{database, retention}
+}
+
+func (c *SetDatabaseRetentionCommand) CommandName() string {
+	return "set_database_retention"
+}
+
+func (c *SetDatabaseRetentionCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetDatabaseRetention(c.Database, c.Retention)
+	return nil, err
+}
+
+// an empty database sets the read-only flag of the cluster
+type SetReadOnlyCommand struct {
+	Database string `json:"database"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+func NewSetReadOnlyCommand(database string, readOnly bool) *SetReadOnlyCommand {
+	return &SetReadOnlyCommand{database, readOnly}
+}
+
+func (c *SetReadOnlyCommand) CommandName() string {
+	return "set_read_only"
+}
+
+func (c *SetReadOnlyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetReadOnly(c.Database, c.ReadOnly)
+	return nil, err
+}
+
+// zero removes the limit of the database
+type SetMaxSeriesCommand struct {
+	Database  string `json:"database"`
+	MaxSeries int    `json:"maxSeries"`
+}
+
+func NewSetMaxSeriesCommand(database string, maxSeries int) *SetMaxSeriesCommand {
+	return &SetMaxSeriesCommand{database, maxSeries}
+}
+
+func (c *SetMaxSeriesCommand) CommandName() string {
+	return "set_max_series"
+}
+
+func (c *SetMaxSeriesCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetMaxSeries(c.Database, c.MaxSeries)
+	return nil, err
+}
+
 type SaveDbUserCommand struct {
 	User *cluster.DbUser `json:"user"`
 }
@@ -222,6 +316,7 @@ type InfluxJoinCommand struct {
 	Name                     string `json:"name"`
 	ConnectionString         string `json:"connectionString"`
 	ProtobufConnectionString string `json:"protobufConnectionString"`
+	FailureDomain            string `json:"failureDomain,omitempty"`
 }
 
 // The name of the Join command in the log
@@ -240,6 +335,10 @@ func (c *InfluxJoinCommand) Apply(server raft.Server) (interface{}, error) {
 	newServer := clusterConfig.GetServerByRaftName(c.Name)
 	// it's a new server the cluster has never seen, make it a potential
 	if newServer != nil {
+		// a server added with AddServerCommand joining for the first time
+		if newServer.RaftConnectionString == c.ConnectionString && newServer.ProtobufConnectionString == c.ProtobufConnectionString {
+			return nil, nil
+		}
 		return nil, fmt.Errorf("Server %s already exist", c.Name)
 	}
 
@@ -249,6 +348,7 @@ func (c *InfluxJoinCommand) Apply(server raft.Server) (interface{}, error) {
 		c.ProtobufConnectionString,
 		nil,
 		clusterConfig.GetLocalConfiguration())
+	clusterServer.FailureDomain = c.FailureDomain
 	clusterConfig.AddPotentialServer(clusterServer)
 	return nil, nil
 }
@@ -257,6 +357,58 @@ func (c *InfluxJoinCommand) NodeName() string {
 	return c.Name
 }
 
+// Adds a server that wasn't started yet to the cluster config, it
+// becomes a raft peer with the InfluxJoinCommand it sends once it's up
+type AddServerCommand struct {
+	Server *cluster.NewServer `json:"server"`
+}
+
+func NewAddServerCommand(server *cluster.NewServer) *AddServerCommand {
+	return &AddServerCommand{server}
+}
+
+func (c *AddServerCommand) CommandName() string {
+	return "add_server"
+}
+
+func (c *AddServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.AddNewServer(c.Server)
+	return nil, err
+}
+
+// Adds an observer to the cluster config. Unlike InfluxJoinCommand the
+// server isn't added as a raft peer.
+type InfluxJoinObserverCommand struct {
+	Name                     string `json:"name"`
+	ConnectionString         string `json:"connectionString"`
+	ProtobufConnectionString string `json:"protobufConnectionString"`
+	FailureDomain            string `json:"failureDomain,omitempty"`
+}
+
+func (c *InfluxJoinObserverCommand) CommandName() string {
+	return "join_observer"
+}
+
+func (c *InfluxJoinObserverCommand) Apply(server raft.Server) (interface{}, error) {
+	clusterConfig := server.Context().(*cluster.ClusterConfiguration)
+
+	// the observer keeps asking to join until it shows up in a snapshot
+	if clusterConfig.GetServerByRaftName(c.Name) != nil {
+		return nil, nil
+	}
+
+	log.Info("Adding new observer to the cluster config %s", c.Name)
+	clusterServer := cluster.NewClusterServer(c.Name,
+		c.ConnectionString,
+		c.ProtobufConnectionString,
+		nil,
+		clusterConfig.GetLocalConfiguration())
+	clusterServer.FailureDomain = c.FailureDomain
+	clusterConfig.AddObserverServer(clusterServer)
+	return nil, nil
+}
+
 type InfluxForceLeaveCommand struct {
 	Id uint32 `json:"id"`
 }
@@ -378,3 +530,190 @@ func (c *DropShardCommand) Apply(server raft.Server) (interface{}, error) {
 	err := config.DropShard(c.ShardId, c.ServerIds)
 	return nil, err
 }
+
+type DecommissionServerCommand struct {
+	Id uint32 `json:"id"`
+}
+
+func NewDecommissionServerCommand(id uint32) *DecommissionServerCommand {
+	return &DecommissionServerCommand{id}
+}
+
+func (c *DecommissionServerCommand) CommandName() string {
+	return "decommission_server"
+}
+
+func (c *DecommissionServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DecommissionServer(c.Id)
+	return nil, err
+}
+
+type SetFailureDomainCommand struct {
+	ServerId      uint32 `json:"serverId"`
+	FailureDomain string `json:"failureDomain"`
+}
+
+func NewSetFailureDomainCommand(serverId uint32, failureDomain string) *SetFailureDomainCommand {
+	return &SetFailureDomainCommand{serverId, failureDomain}
+}
+
+func (c *SetFailureDomainCommand) CommandName() string {
+	return "set_failure_domain"
+}
+
+func (c *SetFailureDomainCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetFailureDomain(c.ServerId, c.FailureDomain)
+	return nil, err
+}
+
+type AcquireShardLeaseCommand struct {
+	ShardId    uint32    `json:"shardId"`
+	ServerId   uint32    `json:"serverId"`
+	Now        time.Time `json:"now"`
+	Expiration time.Time `json:"expiration"`
+}
+
+func NewAcquireShardLeaseCommand(shardId, serverId uint32, now, expiration time.Time) *AcquireShardLeaseCommand {
+	return &AcquireShardLeaseCommand{shardId, serverId, now, expiration}
+}
+
+func (c *AcquireShardLeaseCommand) CommandName() string {
+	return "acquire_shard_lease"
+}
+
+func (c *AcquireShardLeaseCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	_, err := config.AcquireShardLease(c.ShardId, c.ServerId, c.Now, c.Expiration)
+	return nil, err
+}
+
+type AddShardReplicaCommand struct {
+	ShardId  uint32 `json:"shardId"`
+	ServerId uint32 `json:"serverId"`
+}
+
+func NewAddShardReplicaCommand(shardId, serverId uint32) *AddShardReplicaCommand {
+	return &AddShardReplicaCommand{shardId, serverId}
+}
+
+func (c *AddShardReplicaCommand) CommandName() string {
+	return "add_shard_replica"
+}
+
+func (c *AddShardReplicaCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.AddShardReplica(c.ShardId, c.ServerId)
+	return nil, err
+}
+
+type SetReplicationFactorCommand struct {
+	ReplicationFactor int `json:"replicationFactor"`
+}
+
+func NewSetReplicationFactorCommand(replicationFactor int) *SetReplicationFactorCommand {
+	return &SetReplicationFactorCommand{replicationFactor}
+}
+
+func (c *SetReplicationFactorCommand) CommandName() string {
+	return "set_replication_factor"
+}
+
+func (c *SetReplicationFactorCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetReplicationFactor(c.ReplicationFactor)
+	return nil, err
+}
+
+type SetShardDurationCommand struct {
+	ShardType cluster.ShardType `json:"shardType"`
+	Duration  time.Duration     `json:"duration"`
+}
+
+func NewSetShardDurationCommand(shardType cluster.ShardType, duration time.Duration) *SetShardDurationCommand {
+	return &SetShardDurationCommand{shardType, duration}
+}
+
+func (c *SetShardDurationCommand) CommandName() string {
+	return "set_shard_duration"
+}
+
+func (c *SetShardDurationCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetShardDuration(c.ShardType, c.Duration)
+	return nil, err
+}
+
+type SetRuntimeSettingCommand struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func NewSetRuntimeSettingCommand(name, value string) *SetRuntimeSettingCommand {
+	return &SetRuntimeSettingCommand{name, value}
+}
+
+func (c *SetRuntimeSettingCommand) CommandName() string {
+	return "set_runtime_setting"
+}
+
+func (c *SetRuntimeSettingCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetRuntimeSetting(c.Name, c.Value)
+	return nil, err
+}
+
+type CreateReplicationTargetCommand struct {
+	Target *cluster.ReplicationTarget `json:"target"`
+}
+
+func NewCreateReplicationTargetCommand(target *cluster.ReplicationTarget) *CreateReplicationTargetCommand {
+	return &CreateReplicationTargetCommand{target}
+}
+
+func (c *CreateReplicationTargetCommand) CommandName() string {
+	return "create_replication_target"
+}
+
+func (c *CreateReplicationTargetCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.CreateReplicationTarget(c.Target)
+	return nil, err
+}
+
+type DropReplicationTargetCommand struct {
+	Name string `json:"name"`
+}
+
+func NewDropReplicationTargetCommand(name string) *DropReplicationTargetCommand {
+	return &DropReplicationTargetCommand{name}
+}
+
+func (c *DropReplicationTargetCommand) CommandName() string {
+	return "drop_replication_target"
+}
+
+func (c *DropReplicationTargetCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DropReplicationTarget(c.Name)
+	return nil, err
+}
+
+type CreateTombstoneCommand struct {
+	Tombstone *cluster.Tombstone `json:"tombstone"`
+}
+
+func NewCreateTombstoneCommand(tombstone *cluster.Tombstone) *CreateTombstoneCommand {
+	return &CreateTombstoneCommand{tombstone}
+}
+
+func (c *CreateTombstoneCommand) CommandName() string {
+	return "create_tombstone"
+}
+
+func (c *CreateTombstoneCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.AddTombstone(c.Tombstone)
+	return nil, err
+}
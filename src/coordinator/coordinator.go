@@ -5,11 +5,15 @@ import (
 	"common"
 	"configuration"
 	"engine"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"metrics"
 	"parser"
 	"protocol"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +25,19 @@ type CoordinatorImpl struct {
 	clusterConfiguration *cluster.ClusterConfiguration
 	raftServer           ClusterConsensus
 	config               *configuration.Configuration
+	rebalanceLock        sync.Mutex
+	rebalancing          bool
+	replicator           *Replicator
+	writeLeases          map[uint32]time.Time
+	writeLeasesLock      sync.Mutex
+	queryCache           *queryCache
+	runningQueries       *runningQueries
+	slowQueries          *slowQueryLog
+	rateLimits           *rateLimits
+	writeCoalescer       *writeCoalescer
+	ingestProcessors     []*databaseIngestProcessor
+	drain                requestDrain
+	seriesSketches       seriesSketches
 }
 
 const (
@@ -39,6 +56,12 @@ var (
 	BARRIER_TIME_MAX int64 = math.MaxInt64
 )
 
+// stops querying the shards once the limit of the query is reached, it
+// isn't returned to the client
+var errLimitReached = errors.New("The limit of the query is reached")
+
+var errQueryCancelled = errors.New("The query was cancelled")
+
 // shorter constants for readability
 var (
 	dropDatabase         = protocol.Request_DROP_DATABASE
@@ -47,6 +70,7 @@ var (
 	queryResponse        = protocol.Response_QUERY
 	heartbeatResponse    = protocol.Response_HEARTBEAT
 	explainQueryResponse = protocol.Response_EXPLAIN_QUERY
+	queryTraceResponse   = protocol.Response_QUERY_TRACE
 	write                = protocol.Request_WRITE
 )
 
@@ -60,26 +84,99 @@ func NewCoordinatorImpl(config *configuration.Configuration, raftServer ClusterC
 		config:               config,
 		clusterConfiguration: clusterConfiguration,
 		raftServer:           raftServer,
+		replicator:           NewReplicator(config, clusterConfiguration),
+		writeLeases:          make(map[uint32]time.Time),
+		queryCache:           newQueryCache(config.QueryCacheMaxEntries, config.QueryCacheFreshness),
+		runningQueries:       newRunningQueries(),
+		slowQueries:          newSlowQueryLog(config),
+		rateLimits:           newRateLimits(config),
+	}
+	if config.WriteCoalesceDelay > 0 {
+		coordinator.writeCoalescer = newWriteCoalescer(config.WriteCoalesceDelay, config.WriteCoalesceMaxPoints, func(db string, series []*protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error {
+			return coordinator.write(db, series, shard, false, consistency, "")
+		})
 	}
 
 	return coordinator
 }
 
-func (self *CoordinatorImpl) RunQuery(user common.User, database string, queryString string, seriesWriter SeriesWriter) (err error) {
-	log.Info("Start Query: db: %s, u: %s, q: %s", database, user.GetName(), queryString)
+func (self *CoordinatorImpl) RunQuery(user common.User, database string, queryString string, seriesWriter SeriesWriter) error {
+	return self.RunQueryWithConsistency(user, database, queryString, cluster.READ_CONSISTENCY_ONE, seriesWriter)
+}
+
+// Same as RunQuery, with quorum consistency every shard the query reads
+// is reconciled with a quorum of its replicas first
+func (self *CoordinatorImpl) RunQueryWithConsistency(user common.User, database string, queryString string, consistency cluster.ReadConsistency, seriesWriter SeriesWriter) error {
+	return self.RunQueryWithCancel(user, database, queryString, nil, consistency, nil, seriesWriter)
+}
+
+// Same as RunQueryWithConsistency, the $placeholders of the query are
+// bound to params and the query is cancelled once done is closed, e.g.
+// when the client of the query went away
+func (self *CoordinatorImpl) RunQueryWithCancel(user common.User, database string, queryString string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, seriesWriter SeriesWriter) error {
+	_, err := self.RunTracedQuery(user, database, queryString, params, consistency, done, seriesWriter)
+	return err
+}
+
+// Same as RunQueryWithCancel, returns the trace of the query once it's
+// done. The trace is nil if the query didn't start.
+func (self *CoordinatorImpl) RunTracedQuery(user common.User, database string, queryString string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, seriesWriter SeriesWriter) (*QueryTrace, error) {
+	trace := &QueryTrace{serverId: self.localServerId()}
+	err := self.runQueryWithTrace(trace, user, database, queryString, params, consistency, done, seriesWriter)
+	if trace.trace == nil {
+		return nil, err
+	}
+	return trace, err
+}
+
+func (self *CoordinatorImpl) runQueryWithTrace(trace *QueryTrace, user common.User, database string, queryString string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, seriesWriter SeriesWriter) (err error) {
+	traceId := newTraceId()
+	log.Info("Start Query: db: %s, u: %s, q: %s, trace: %s", database, user.GetName(), queryString, traceId)
 	defer func(t time.Time) {
-		log.Debug("End Query: db: %s, u: %s, q: %s, t: %s", database, user.GetName(), queryString, time.Now().Sub(t))
+		duration := time.Now().Sub(t)
+		log.Debug("End Query: db: %s, u: %s, q: %s, trace: %s, t: %s", database, user.GetName(), queryString, traceId, duration)
+		if trace.trace != nil {
+			span := stageSpan("query", trace.serverId, 0, t, duration)
+			span.SpanId = &trace.trace.spanId
+			trace.trace.addSpans([]*protocol.TraceSpan{span})
+		}
+		metrics.Default.Histogram("query.duration_ms", metrics.LatencyBuckets).Update(float64(duration) / float64(time.Millisecond))
+		if err != nil {
+			metrics.Default.Counter("query.errors").Inc()
+		}
 	}(time.Now())
 	// don't let a panic pass beyond RunQuery
 	defer common.RecoverFunc(database, queryString, nil)
 
-	q, err := parser.ParseQuery(queryString)
+	if err := self.drain.start(); err != nil {
+		return err
+	}
+	defer self.drain.finish()
+
+	finished, err := self.rateLimits.startQuery(user, database, time.Now())
 	if err != nil {
 		return err
 	}
+	defer finished()
+
+	running := self.runningQueries.add(user, database, queryString, traceId, done)
+	defer self.runningQueries.remove(running)
+	defer self.slowQueries.add(running)
+	trace.trace = running.trace
+
+	parseStart := time.Now()
+	q, err := parser.ParseQueryWithParameters(queryString, params)
+	if err != nil {
+		return err
+	}
+	running.trace.addSpans([]*protocol.TraceSpan{stageSpan("parse", trace.serverId, running.trace.spanId, parseStart, time.Since(parseStart))})
 
 	for _, query := range q {
 		querySpec := parser.NewQuerySpec(user, database, query)
+		querySpec.QuorumRead = consistency == cluster.READ_CONSISTENCY_QUORUM
+		querySpec.TraceId = traceId
+		querySpec.ParentSpanId = running.trace.spanId
+		querySpec.Cancelled = running.cancelled
 
 		if query.DeleteQuery != nil {
 			if err := self.clusterConfiguration.CreateCheckpoint(); err != nil {
@@ -99,9 +196,20 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 			continue
 		}
 
+		if query.KillQuery != nil {
+			if err := self.KillQuery(user, uint32(query.KillQuery.Id)); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if query.IsListQuery() {
 			if query.IsListSeriesQuery() {
 				self.runListSeriesQuery(querySpec, seriesWriter)
+			} else if query.IsListFieldsQuery() {
+				if err := self.runListFieldsQuery(querySpec, seriesWriter); err != nil {
+					return err
+				}
 			} else if query.IsListContinuousQueriesQuery() {
 				queries, err := self.ListContinuousQueries(user, database)
 				if err != nil {
@@ -112,6 +220,30 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 						return err
 					}
 				}
+			} else if query.IsShowStatsQuery() {
+				stats, err := self.ShowStats(user)
+				if err != nil {
+					return err
+				}
+				if err := seriesWriter.Write(stats); err != nil {
+					return err
+				}
+			} else if query.IsShowQueriesQuery() {
+				if err := seriesWriter.Write(self.ShowQueries(user)); err != nil {
+					return err
+				}
+			} else if query.IsShowSlowQueriesQuery() {
+				if err := seriesWriter.Write(self.ShowSlowQueries(user)); err != nil {
+					return err
+				}
+			} else if query.IsShowDiskUsageQuery() {
+				if err := self.runShowDiskUsageQuery(user, database, seriesWriter); err != nil {
+					return err
+				}
+			} else if query.IsShowCardinalityQuery() {
+				if err := self.runShowCardinalityQuery(user, database, seriesWriter); err != nil {
+					return err
+				}
 			}
 			continue
 		}
@@ -132,7 +264,17 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 		if err := self.checkPermission(user, querySpec); err != nil {
 			return err
 		}
-		return self.runQuery(querySpec, seriesWriter)
+		if selectQuery.IsSelectIntoQuery() {
+			return self.runSelectIntoQuery(querySpec, seriesWriter)
+		}
+		limitedWriter, stopTimeout := self.limitQuery(running, seriesWriter)
+		err := self.runQuery(querySpec, limitedWriter)
+		stopTimeout()
+		// the shards only know the query was cancelled, not why
+		if cancelErr := running.cancelError(); cancelErr != nil {
+			return cancelErr
+		}
+		return err
 	}
 	seriesWriter.Close()
 	return nil
@@ -141,6 +283,9 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 func (self *CoordinatorImpl) checkPermission(user common.User, querySpec *parser.QuerySpec) error {
 	// if this isn't a regex query do the permission check here
 	fromClause := querySpec.SelectQuery().GetFromClause()
+	if fromClause.Type == parser.FromClauseSubQuery {
+		return self.checkPermission(user, parser.NewQuerySpec(user, querySpec.Database(), &parser.Query{SelectQuery: fromClause.SubQuery}))
+	}
 
 	for _, n := range fromClause.Names {
 		if _, ok := n.Name.GetCompiledRegex(); ok {
@@ -154,10 +299,37 @@ func (self *CoordinatorImpl) checkPermission(user common.User, querySpec *parser
 
 // This should only get run for SelectQuery types
 func (self *CoordinatorImpl) runQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	// only the inner query of a subquery is cached, the writes to its
+	// series invalidate it
+	if querySpec.SelectQuery().GetFromClause().Type == parser.FromClauseSubQuery {
+		return self.runSubQuery(querySpec, seriesWriter)
+	}
+	if len(querySpec.SelectQuery().GetFromClause().GetOtherDatabases(querySpec.Database())) > 0 {
+		return self.runCrossDatabaseQuery(querySpec, seriesWriter)
+	}
+	if querySpec.SelectQuery().GetFromClause().Regex != nil {
+		expanded, err := self.expandRegexTables(querySpec)
+		if err != nil {
+			return err
+		}
+		if len(expanded.SelectQuery().GetFromClause().Names) == 0 {
+			seriesWriter.Close()
+			return nil
+		}
+		if err := self.checkPermission(expanded.User(), expanded); err != nil {
+			return err
+		}
+		querySpec = expanded
+	}
+	if self.queryCache.cacheable(querySpec) {
+		return self.runCachedQuery(querySpec, seriesWriter)
+	}
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
 
-func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+// Returns the latest short and long term shards, the ones the series
+// are listed from
+func (self *CoordinatorImpl) shardsToList() []*cluster.ShardData {
 	shortTermShards := self.clusterConfiguration.GetShortTermShards()
 	if len(shortTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
 		shortTermShards = shortTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
@@ -166,11 +338,107 @@ func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, ser
 	if len(longTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
 		longTermShards = longTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
 	}
-	seriesYielded := make(map[string]bool)
 
 	var shards []*cluster.ShardData
 	shards = append(shards, shortTermShards...)
 	shards = append(shards, longTermShards...)
+	return shards
+}
+
+func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	shards := self.shardsToList()
+	listQuery := querySpec.Query().ListQuery
+	if listQuery.HasLastWriteCondition() {
+		return self.runListSeriesByLastWrite(shards, querySpec, seriesWriter)
+	}
+	if listQuery.Limit == 0 {
+		return self.writeSeriesNamesOfShards(shards, querySpec, seriesWriter)
+	}
+
+	// every shard returns its first offset + limit names, the page is
+	// cut from their union in the order of the names
+	writer := &seriesNamesWriter{}
+	if err := self.writeSeriesNamesOfShards(shards, querySpec, writer); err != nil {
+		return err
+	}
+	sort.Strings(writer.names)
+	names := writer.names
+	if listQuery.Offset < len(names) {
+		names = names[listQuery.Offset:]
+	} else {
+		names = nil
+	}
+	if len(names) > listQuery.Limit {
+		names = names[:listQuery.Limit]
+	}
+	for _, name := range names {
+		seriesWriter.Write(&protocol.Series{Name: protocol.String(name)})
+	}
+	seriesWriter.Close()
+	return nil
+}
+
+// Writes the series whose last point is in the range of the last_write
+// condition in the order of their names, every series has a point at the
+// time of its last write. The last write of a series is the latest one of
+// the shards, so the limit is applied once every shard is read.
+func (self *CoordinatorImpl) runListSeriesByLastWrite(shards []*cluster.ShardData, querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	lastWrites := map[string]int64{}
+	for _, shard := range shards {
+		responseChan := make(chan *protocol.Response, shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize))
+		go shard.Query(querySpec, responseChan)
+		for {
+			response := <-responseChan
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				if response.ErrorMessage != nil {
+					return common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				}
+				break
+			}
+			for _, series := range response.MultiSeries {
+				if len(series.Points) == 0 {
+					continue
+				}
+				name, timestamp := series.GetName(), series.Points[0].GetTimestamp()
+				if last, ok := lastWrites[name]; !ok || timestamp > last {
+					lastWrites[name] = timestamp
+				}
+			}
+		}
+	}
+
+	listQuery := querySpec.Query().ListQuery
+	names := make([]string, 0, len(lastWrites))
+	for name, timestamp := range lastWrites {
+		if listQuery.MatchesLastWrite(common.TimeFromMicroseconds(timestamp)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if listQuery.Limit > 0 {
+		if listQuery.Offset < len(names) {
+			names = names[listQuery.Offset:]
+		} else {
+			names = nil
+		}
+		if len(names) > listQuery.Limit {
+			names = names[:listQuery.Limit]
+		}
+	}
+	for _, name := range names {
+		seriesWriter.Write(&protocol.Series{
+			Name:   protocol.String(name),
+			Points: []*protocol.Point{&protocol.Point{Timestamp: protocol.Int64(lastWrites[name])}},
+		})
+	}
+	seriesWriter.Close()
+	return nil
+}
+
+// Writes the names of the series the shards return once, closes the
+// writer when all the shards are done
+func (self *CoordinatorImpl) writeSeriesNamesOfShards(shards []*cluster.ShardData, querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	seriesYielded := make(map[string]bool)
 
 	var err error
 	for _, shard := range shards {
@@ -197,12 +465,106 @@ func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, ser
 	return err
 }
 
+// Writes a series for every listed series with its fields and their
+// types in the order of their names. The shards only know the type of
+// the last value they have, a field's type is the one of the first
+// shard that knows it.
+func (self *CoordinatorImpl) runListFieldsQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	fieldTypes := map[string]map[string]*protocol.FieldValue{}
+	for _, shard := range self.shardsToList() {
+		responseChan := make(chan *protocol.Response, shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize))
+		go shard.Query(querySpec, responseChan)
+		for {
+			response := <-responseChan
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				if response.ErrorMessage != nil {
+					return common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				}
+				break
+			}
+			if response.Series == nil {
+				continue
+			}
+			types := fieldTypes[response.Series.GetName()]
+			if types == nil {
+				types = map[string]*protocol.FieldValue{}
+				fieldTypes[response.Series.GetName()] = types
+			}
+			for _, point := range response.Series.Points {
+				name := point.Values[0].GetStringValue()
+				if known := types[name]; known == nil || known.StringValue == nil {
+					types[name] = point.Values[1]
+				}
+			}
+		}
+	}
+
+	seriesNames := make([]string, 0, len(fieldTypes))
+	for name := range fieldTypes {
+		seriesNames = append(seriesNames, name)
+	}
+	sort.Strings(seriesNames)
+	for _, seriesName := range seriesNames {
+		types := fieldTypes[seriesName]
+		names := make([]string, 0, len(types))
+		for name := range types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		points := make([]*protocol.Point, 0, len(names))
+		for _, name := range names {
+			points = append(points, &protocol.Point{
+				Values: []*protocol.FieldValue{&protocol.FieldValue{StringValue: protocol.String(name)}, types[name]},
+			})
+		}
+		if err := seriesWriter.Write(&protocol.Series{Name: protocol.String(seriesName), Fields: []string{"name", "type"}, Points: points}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the select once and writes the points it returns into the
+// target of its into clause instead of returning them
+func (self *CoordinatorImpl) runSelectIntoQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	user := querySpec.User()
+	db := querySpec.Database()
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to write the results of a query")
+	}
+
+	query := querySpec.SelectQuery()
+	selectQuery := *query
+	selectQuery.IntoClause = nil
+	spec := parser.NewQuerySpec(user, db, &parser.Query{SelectQuery: &selectQuery})
+	spec.QuorumRead = querySpec.QuorumRead
+	spec.TraceId = querySpec.TraceId
+	spec.ParentSpanId = querySpec.ParentSpanId
+	spec.Cancelled = querySpec.Cancelled
+
+	targetName := query.GetIntoClause().Target.Name
+	writer := NewContinuousQueryWriter(func(series *protocol.Series) error {
+		return self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, true)
+	})
+	if err := self.runQuery(spec, writer); err != nil {
+		return err
+	}
+	seriesWriter.Close()
+	return nil
+}
+
 func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
 	user := querySpec.User()
 	db := querySpec.Database()
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
 		return common.NewAuthorizationError("Insufficient permission to write to %s", db)
 	}
+	if err := self.checkWritable(db); err != nil {
+		return err
+	}
+	if err := self.createTombstone(querySpec, querySpec.GetQueryStringWithTimeCondition()); err != nil {
+		return err
+	}
 	querySpec.RunAgainstAllServersInShard = true
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
@@ -210,14 +572,51 @@ func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesW
 func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
 	user := querySpec.User()
 	db := querySpec.Database()
-	series := querySpec.Query().DropSeriesQuery.GetTableName()
-	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) && !user.HasWriteAccess(series) {
+	query := querySpec.Query().DropSeriesQuery
+	series := query.GetTableName()
+	if _, ok := query.GetRegex(); ok {
+		// the permissions are by series name, only the admins can drop
+		// the series matching a regex
+		if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+			return common.NewAuthorizationError("Insufficient permissions to drop series matching /%s/", series)
+		}
+	} else if !user.IsClusterAdmin() && !user.IsDbAdmin(db) && !user.HasWriteAccess(series) {
 		return common.NewAuthorizationError("Insufficient permissions to drop series")
 	}
+	if query.Explain {
+		return self.writeSeriesNamesOfShards(self.clusterConfiguration.GetShards(querySpec), querySpec, seriesWriter)
+	}
+	if err := self.checkWritable(db); err != nil {
+		return err
+	}
+	if err := self.createTombstone(querySpec, querySpec.GetQueryString()); err != nil {
+		return err
+	}
 	querySpec.RunAgainstAllServersInShard = true
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
 
+// Records the delete in the cluster metadata before it's run, so the
+// replicas that miss it because they're down run it when they're back
+func (self *CoordinatorImpl) createTombstone(querySpec *parser.QuerySpec, query string) error {
+	shards := self.clusterConfiguration.GetShards(querySpec)
+	if len(shards) == 0 {
+		return nil
+	}
+	tombstone := &cluster.Tombstone{
+		Database: querySpec.Database(),
+		Query:    query,
+		Time:     time.Now(),
+	}
+	for _, shard := range shards {
+		tombstone.Shards = append(tombstone.Shards, &cluster.TombstoneShard{
+			ShardId:   shard.Id(),
+			ServerIds: shard.ServerIds(),
+		})
+	}
+	return self.raftServer.CreateTombstone(tombstone)
+}
+
 func (self *CoordinatorImpl) shouldAggregateLocally(shards []*cluster.ShardData, querySpec *parser.QuerySpec) bool {
 	for _, s := range shards {
 		if !s.ShouldAggregateLocally(querySpec) {
@@ -227,6 +626,18 @@ func (self *CoordinatorImpl) shouldAggregateLocally(shards []*cluster.ShardData,
 	return true
 }
 
+func (self *CoordinatorImpl) shouldMergePartialAggregates(shards []*cluster.ShardData, querySpec *parser.QuerySpec) bool {
+	if !engine.IsMergeable(querySpec.SelectQuery()) {
+		return false
+	}
+	for _, s := range shards {
+		if !s.SupportsPartialAggregation() {
+			return false
+		}
+	}
+	return true
+}
+
 func (self *CoordinatorImpl) shouldQuerySequentially(shards []*cluster.ShardData, querySpec *parser.QuerySpec) bool {
 	// if the query isn't a select, then it doesn't matter
 	if querySpec.SelectQuery() == nil {
@@ -287,14 +698,19 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 
 	selectQuery := querySpec.SelectQuery()
 	if selectQuery != nil {
-		if !shouldAggregateLocally {
+		if !shouldAggregateLocally && self.shouldMergePartialAggregates(shards, querySpec) {
+			// the shards aggregate what they have of every bucket and the
+			// coordinator merges the partial aggregates
+			querySpec.PartialAggregation = true
+			processor, err = engine.NewMergingQueryEngine(selectQuery, responseChan)
+		} else if !shouldAggregateLocally {
 			// if we should aggregate in the coordinator (i.e. aggregation
 			// isn't happening locally at the shard level), create an engine
 			processor, err = engine.NewQueryEngine(querySpec.SelectQuery(), responseChan)
 		} else {
 			// if we have a query with limit, then create an engine, or we can
 			// make the passthrough limit aware
-			processor = engine.NewPassthroughEngineWithLimit(responseChan, 100, selectQuery.Limit)
+			processor = engine.NewPassthroughEngineWithLimitAndOffset(responseChan, 100, selectQuery.Limit, selectQuery.Offset)
 		}
 	} else if !shouldAggregateLocally {
 		processor = engine.NewPassthroughEngine(responseChan, 100)
@@ -331,13 +747,23 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryProcessor,
 	writer SeriesWriter,
 	isExplainQuery bool,
+	trace *queryTrace,
+	limitReached func() bool,
 	errors chan<- error,
 	channels <-chan (<-chan *protocol.Response)) {
 
 	defer close(errors)
 
 	for responseChan := range channels {
+		done := false
 		for response := range responseChan {
+			// drain the rest of the responses so the shard doesn't block
+			if done {
+				if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+					break
+				}
+				continue
+			}
 
 			//log.Debug("GOT RESPONSE: ", response.Type, response.Series)
 			log.Debug("GOT RESPONSE: %v", response.Type)
@@ -352,6 +778,11 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 				return
 			}
 
+			if *response.Type == queryTraceResponse {
+				trace.addSpans(response.TraceSpans)
+				continue
+			}
+
 			if response.Series == nil || len(response.Series.Points) == 0 {
 				log.Debug("Series has no points, continue")
 				continue
@@ -365,6 +796,7 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 				// the data here
 				log.Debug("YIELDING: %d points with %d columns", len(response.Series.Points), len(response.Series.Fields))
 				processor.YieldSeries(response.Series)
+				done = limitReached()
 				continue
 			}
 
@@ -375,6 +807,12 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 			}
 		}
 
+		if done {
+			log.Debug("The limit of the query is reached, not querying the rest of the shards")
+			errors <- errLimitReached
+			return
+		}
+
 		// once we're done with a response channel signal queryShards to
 		// start querying a new shard
 		errors <- nil
@@ -395,6 +833,9 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 		if err != nil {
 			return err
 		}
+		if querySpec.IsCancelled() {
+			return errQueryCancelled
+		}
 		shard := shards[i]
 		bufferSize := shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize)
 		if bufferSize > self.config.ClusterMaxResponseBufferSize {
@@ -411,14 +852,32 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 }
 
 func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	trace := &queryTrace{id: querySpec.TraceId}
+	if querySpec.IsExplainQuery() {
+		seriesWriter = &traceSeriesWriter{seriesWriter, trace}
+	}
+
+	planStart := time.Now()
 	shards, processor, seriesClosed, err := self.getShardsAndProcessor(querySpec, seriesWriter)
 	if err != nil {
 		return err
 	}
+	self.traceStage(querySpec, "plan", planStart, time.Since(planStart))
+	if querySpec.IsExplainQuery() {
+		seriesWriter.Write(queryPlan(querySpec, shards, processor))
+	}
 
+	limitReached := shardsLimitReached(querySpec, processor)
+	var timed *timedProcessor
+	if processor != nil {
+		timed = &timedProcessor{QueryProcessor: processor}
+		processor = timed
+	}
+	aggregationStart := time.Now()
 	defer func() {
 		if processor != nil {
 			processor.Close()
+			self.traceStage(querySpec, "aggregation", aggregationStart, timed.duration)
 			<-seriesClosed
 		} else {
 			seriesWriter.Close()
@@ -438,7 +897,7 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 	}
 	responseChannels := make(chan (<-chan *protocol.Response), shardConcurrentLimit)
 
-	go self.readFromResponseChannels(processor, seriesWriter, querySpec.IsExplainQuery(), errors, responseChannels)
+	go self.readFromResponseChannels(processor, seriesWriter, querySpec.IsExplainQuery(), trace, limitReached, errors, responseChannels)
 
 	err = self.queryShards(querySpec, shards, errors, responseChannels)
 
@@ -460,9 +919,61 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 			break
 		}
 	}
+
+	self.runningQueries.addSpans(querySpec.TraceId, trace.spans)
+
+	if err == errLimitReached {
+		err = nil
+	}
+	if err == nil {
+		self.readRepair(querySpec, shards)
+	}
 	return err
 }
 
+// Returns a function that tells if the processor got all the points the
+// limit of the query lets through, the shards that weren't read yet don't
+// have to be queried. The series have to be known up front, so a query
+// of a regex always reads all its shards.
+func shardsLimitReached(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) func() bool {
+	passthrough, ok := processor.(*engine.PassthroughEngine)
+	selectQuery := querySpec.SelectQuery()
+	if !ok || selectQuery == nil || selectQuery.Limit <= 0 || querySpec.IsExplainQuery() ||
+		querySpec.IsRegex() || selectQuery.GetFromClause().Type != parser.FromClauseArray {
+		return func() bool { return false }
+	}
+	names := querySpec.TableNames()
+	return func() bool { return passthrough.HitLimit(names) }
+}
+
+// Picks the local shards that have other replicas with a probability of
+// ReadRepairChance and compares the queried time range with the
+// replicas in the background.
+func (self *CoordinatorImpl) readRepair(querySpec *parser.QuerySpec, shards []*cluster.ShardData) {
+	if self.config.ReadRepairChance <= 0 || querySpec.QuorumRead || querySpec.SelectQuery() == nil || querySpec.IsExplainQuery() {
+		return
+	}
+
+	for _, shard := range shards {
+		if !shard.IsLocal || len(shard.ServerIds()) < 2 {
+			continue
+		}
+		if rand.Float64() >= self.config.ReadRepairChance {
+			continue
+		}
+		go func(shard *cluster.ShardData) {
+			repaired, err := shard.ReadRepair(querySpec)
+			if err != nil {
+				log.Error("Error while read repairing shard %d: %s", shard.Id(), err)
+				return
+			}
+			if repaired > 0 {
+				log.Info("Read repair copied %d ranges of shard %d", repaired, shard.Id())
+			}
+		}(shard)
+	}
+}
+
 func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 	if !user.IsClusterAdmin() {
 		return fmt.Errorf("Insufficient permissions to force a log compaction")
@@ -472,11 +983,52 @@ func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 }
 
 func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series []*protocol.Series) error {
+	return self.WriteSeriesDataWithConsistency(user, db, series, self.clusterConfiguration.GetWriteConsistency(db))
+}
+
+func (self *CoordinatorImpl) WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
+	return self.writeSeriesData(user, db, series, consistency, "")
+}
+
+// Writes the series unless a write with the same idempotency key was
+// written in the dedup window of the shards, so the clients can retry
+// the writes that timed out. If the consistency is empty the default
+// of the database is used.
+func (self *CoordinatorImpl) WriteSeriesDataOnce(user common.User, db string, series []*protocol.Series, consistency string, idempotencyKey string) error {
+	level := self.clusterConfiguration.GetWriteConsistency(db)
+	if consistency != "" {
+		var err error
+		if level, err = cluster.ParseWriteConsistency(consistency); err != nil {
+			return err
+		}
+	}
+	return self.writeSeriesData(user, db, series, level, idempotencyKey)
+}
+
+func (self *CoordinatorImpl) writeSeriesData(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency, idempotencyKey string) error {
+	if err := self.drain.start(); err != nil {
+		return err
+	}
+	defer self.drain.finish()
+
 	// make sure that the db exist
 	if !self.clusterConfiguration.DatabasesExists(db) {
 		return fmt.Errorf("Database %s doesn't exist", db)
 	}
 
+	if err := self.checkWritable(db); err != nil {
+		return err
+	}
+
+	// the write permissions are checked for the series as they're written
+	series, err := self.processIngest(db, series)
+	if err != nil {
+		return err
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
 	for _, s := range series {
 		seriesName := s.GetName()
 		if user.HasWriteAccess(seriesName) {
@@ -485,11 +1037,31 @@ func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series
 		return common.NewAuthorizationError("User %s doesn't have write permissions for %s", user.GetName(), seriesName)
 	}
 
-	err := self.CommitSeriesData(db, series, false)
+	if err := self.checkTimestampBounds(db, series); err != nil {
+		return err
+	}
+
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	if err := self.rateLimits.write(user, db, points, time.Now()); err != nil {
+		return err
+	}
+	if err := self.checkSeriesLimit(user, db, series); err != nil {
+		return err
+	}
+
+	err = self.commitSeriesData(db, series, false, consistency, idempotencyKey)
 	if err != nil {
 		return err
 	}
 
+	metrics.Default.Counter("write.requests").Inc()
+	metrics.Default.Counter("write.points").Add(int64(points))
+
+	self.replicator.Replicate(db, series)
+
 	for _, s := range series {
 		self.ProcessContinuousQueries(db, s)
 	}
@@ -628,7 +1200,12 @@ nextfield:
 }
 
 func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Series, sync bool) error {
+	return self.commitSeriesData(db, serieses, sync, cluster.WRITE_CONSISTENCY_ANY, "")
+}
+
+func (self *CoordinatorImpl) commitSeriesData(db string, serieses []*protocol.Series, sync bool, consistency cluster.WriteConsistency, idempotencyKey string) error {
 	now := common.CurrentTime()
+	self.queryCache.invalidate(db, serieses)
 
 	shardToSerieses := map[uint32]map[string]*protocol.Series{}
 	shardIdToShard := map[uint32]*cluster.ShardData{}
@@ -680,15 +1257,48 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 		}
 	}
 
+	shardToSeriesesSlice := make(map[uint32][]*protocol.Series, len(shardToSerieses))
 	for id, serieses := range shardToSerieses {
-		shard := shardIdToShard[id]
-
 		seriesesSlice := make([]*protocol.Series, 0, len(serieses))
 		for _, s := range serieses {
 			seriesesSlice = append(seriesesSlice, s)
 		}
+		shardToSeriesesSlice[id] = seriesesSlice
+	}
+	if err := self.checkFieldTypes(db, shardToSeriesesSlice, shardIdToShard); err != nil {
+		return err
+	}
+
+	for id, seriesesSlice := range shardToSeriesesSlice {
+		shard := shardIdToShard[id]
+
+		if idempotencyKey != "" {
+			// a retry has to be split in the same requests to get the
+			// same keys
+			sort.Sort(seriesByName(seriesesSlice))
+		}
+
+		// sync writes come with their sequence numbers
+		if !sync && self.config.ShardWriteLeaseDuration > 0 {
+			holder, err := self.shardLeaseHolder(shard)
+			if err != nil {
+				return err
+			}
+			if holder != nil {
+				if err := self.forwardLeasedWrite(holder, db, seriesesSlice, shard, consistency, idempotencyKey); err != nil {
+					return err
+				}
+				continue
+			}
+		}
 
-		err := self.write(db, seriesesSlice, shard, sync)
+		var err error
+		// the writes with a key are deduplicated by themselves
+		if !sync && self.writeCoalescer != nil && idempotencyKey == "" {
+			err = self.writeCoalescer.Write(db, seriesesSlice, shard, consistency)
+		} else {
+			err = self.write(db, seriesesSlice, shard, sync, consistency, idempotencyKey)
+		}
 		if err != nil {
 			log.Error("COORD error writing: ", err)
 			return err
@@ -698,34 +1308,74 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 	return nil
 }
 
-func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool) error {
+func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool, consistency cluster.WriteConsistency, idempotencyKey string) error {
 	request := &protocol.Request{Type: &write, Database: &db, MultiSeries: series}
+	if idempotencyKey != "" {
+		request.IdempotencyKey = &idempotencyKey
+	}
 	// break the request if it's too big
 	if request.Size() >= MAX_REQUEST_SIZE {
 		if l := len(series); l > 1 {
 			// create two requests with half the serie
-			if err := self.write(db, series[:l/2], shard, sync); err != nil {
+			if err := self.write(db, series[:l/2], shard, sync, consistency, splitIdempotencyKey(idempotencyKey, 0)); err != nil {
 				return err
 			}
-			return self.write(db, series[l/2:], shard, sync)
+			return self.write(db, series[l/2:], shard, sync, consistency, splitIdempotencyKey(idempotencyKey, 1))
 		}
 
 		// otherwise, split the points of the only series
 		s := series[0]
 		l := len(s.Points)
 		s1 := &protocol.Series{Name: s.Name, Fields: s.Fields, Points: s.Points[:l/2]}
-		if err := self.write(db, []*protocol.Series{s1}, shard, sync); err != nil {
+		if err := self.write(db, []*protocol.Series{s1}, shard, sync, consistency, splitIdempotencyKey(idempotencyKey, 0)); err != nil {
 			return err
 		}
 		s2 := &protocol.Series{Name: s.Name, Fields: s.Fields, Points: s.Points[l/2:]}
-		return self.write(db, []*protocol.Series{s2}, shard, sync)
+		return self.write(db, []*protocol.Series{s2}, shard, sync, consistency, splitIdempotencyKey(idempotencyKey, 1))
 	}
 	if sync {
 		return shard.SyncWrite(request)
 	}
-	return shard.Write(request)
+	return shard.WriteWithConsistency(request, consistency)
 }
 
+// Checks the values against the types of their fields in every shard
+// before anything is written, a write with conflicting values isn't
+// written to any shard. Returns the conflicts of all the shards.
+func (self *CoordinatorImpl) checkFieldTypes(db string, shardToSerieses map[uint32][]*protocol.Series, shards map[uint32]*cluster.ShardData) error {
+	var conflicts common.FieldTypeConflictError
+	for id, serieses := range shardToSerieses {
+		err := shards[id].CheckFieldTypes(db, serieses)
+		if err == nil {
+			continue
+		}
+		shardConflicts, ok := err.(common.FieldTypeConflictError)
+		if !ok {
+			return err
+		}
+		conflicts = append(conflicts, shardConflicts...)
+	}
+	if len(conflicts) > 0 {
+		return conflicts
+	}
+	return nil
+}
+
+// Returns the key of a half of a split write, every half of the write
+// has to be deduplicated by itself
+func splitIdempotencyKey(key string, half int) string {
+	if key == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", key, half)
+}
+
+type seriesByName []*protocol.Series
+
+func (self seriesByName) Len() int           { return len(self) }
+func (self seriesByName) Less(i, j int) bool { return self[i].GetName() < self[j].GetName() }
+func (self seriesByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
 func (self *CoordinatorImpl) CreateContinuousQuery(user common.User, db string, query string) error {
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
 		return common.NewAuthorizationError("Insufficient permissions to create continuous query")
@@ -750,6 +1400,14 @@ func (self *CoordinatorImpl) DeleteContinuousQuery(user common.User, db string,
 	return nil
 }
 
+func (self *CoordinatorImpl) BackfillContinuousQuery(user common.User, db string, id uint32, start, end time.Time) error {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to backfill continuous query")
+	}
+
+	return self.raftServer.BackfillContinuousQuery(db, id, start, end)
+}
+
 func (self *CoordinatorImpl) ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error) {
 	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
 		return nil, common.NewAuthorizationError("Insufficient permissions to list continuous queries")
@@ -777,6 +1435,32 @@ func (self *CoordinatorImpl) ListContinuousQueries(user common.User, db string)
 	return series, nil
 }
 
+// Returns the metrics of this server, one point per metric with its
+// name and value
+func (self *CoordinatorImpl) ShowStats(user common.User) (*protocol.Series, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to show the stats")
+	}
+
+	snapshot := metrics.Snapshot()
+	points := make([]*protocol.Point, 0, len(snapshot))
+	for _, name := range metrics.SortedNames(snapshot) {
+		name, value := name, snapshot[name]
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: &name},
+				&protocol.FieldValue{DoubleValue: &value},
+			},
+		})
+	}
+	seriesName := "stats"
+	return &protocol.Series{
+		Name:   &seriesName,
+		Fields: []string{"name", "value"},
+		Points: points,
+	}, nil
+}
+
 func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
 	if !user.IsClusterAdmin() {
 		return common.NewAuthorizationError("Insufficient permissions to create database")
@@ -793,6 +1477,30 @@ func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
 	return nil
 }
 
+func (self *CoordinatorImpl) SetWriteConsistency(user common.User, db string, consistency string) error {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to change the write consistency of %s", db)
+	}
+
+	if _, err := cluster.ParseWriteConsistency(consistency); err != nil {
+		return err
+	}
+
+	return self.raftServer.SetWriteConsistency(db, consistency)
+}
+
+func (self *CoordinatorImpl) SetDatabaseRetention(user common.User, db string, retention string) error {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to change the retention of %s", db)
+	}
+
+	if _, err := configuration.ParseRetention(retention); err != nil {
+		return err
+	}
+
+	return self.raftServer.SetDatabaseRetention(db, retention)
+}
+
 func (self *CoordinatorImpl) ListDatabases(user common.User) ([]*cluster.Database, error) {
 	if !user.IsClusterAdmin() {
 		return nil, common.NewAuthorizationError("Insufficient permissions to list databases")
@@ -919,6 +1627,10 @@ func (self *CoordinatorImpl) CreateDbUser(requester common.User, db, username, p
 		return err
 	}
 
+	if err := validatePermissions(permissions...); err != nil {
+		return err
+	}
+
 	if !self.clusterConfiguration.DatabaseExists(db) {
 		return fmt.Errorf("No such database %s", db)
 	}
@@ -993,9 +1705,24 @@ func (self *CoordinatorImpl) ChangeDbUserPermissions(requester common.User, db,
 		return common.NewAuthorizationError("Insufficient permissions")
 	}
 
+	if err := validatePermissions(readPermissions, writePermissions); err != nil {
+		return err
+	}
+
 	return self.raftServer.ChangeDbUserPermissions(db, username, readPermissions, writePermissions)
 }
 
+// The permissions are regexes of the series names, an invalid one would
+// keep the user from reading or writing anything
+func validatePermissions(permissions ...string) error {
+	for _, permission := range permissions {
+		if _, err := regexp.Compile(permission); err != nil {
+			return common.NewQueryError(common.InvalidArgument, "Invalid permission '%s': %s", permission, err)
+		}
+	}
+	return nil
+}
+
 func (self *CoordinatorImpl) SetDbAdmin(requester common.User, db, username string, isAdmin bool) error {
 	if !requester.IsClusterAdmin() && !requester.IsDbAdmin(db) {
 		return common.NewAuthorizationError("Insufficient permissions")
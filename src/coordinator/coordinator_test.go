@@ -2,9 +2,12 @@ package coordinator
 
 import (
 	"cluster"
+	"common"
 	"configuration"
 	"fmt"
+	"metrics"
 	"parser"
+	"protocol"
 	"time"
 	. "launchpad.net/gocheck"
 )
@@ -40,3 +43,524 @@ func (self *CoordinatorSuite) TestShouldQuerySequentially(c *C) {
 		c.Assert(coordinator.shouldQuerySequentially(shards, querySpec), Equals, result)
 	}
 }
+
+type recordingSeriesWriter struct {
+	series []*protocol.Series
+	closed bool
+}
+
+func (self *recordingSeriesWriter) Write(series *protocol.Series) error {
+	self.series = append(self.series, series)
+	return nil
+}
+
+func (self *recordingSeriesWriter) Close() {
+	self.closed = true
+}
+
+func (self *CoordinatorSuite) TestTraceIsWrittenBeforeClosing(c *C) {
+	trace := &queryTrace{id: newTraceId()}
+	serverId, shardId := uint32(2), uint32(3)
+	startTime, duration, pointsRead := int64(1000), int64(250), int64(10)
+	trace.addSpans([]*protocol.TraceSpan{
+		&protocol.TraceSpan{
+			ServerId:   &serverId,
+			ShardId:    &shardId,
+			StartTime:  &startTime,
+			Duration:   &duration,
+			PointsRead: &pointsRead,
+		},
+	})
+
+	recorder := &recordingSeriesWriter{}
+	writer := &traceSeriesWriter{recorder, trace}
+	writer.Close()
+	c.Assert(recorder.closed, Equals, true)
+	c.Assert(recorder.series, HasLen, 1)
+	series := recorder.series[0]
+	c.Assert(series.GetName(), Equals, "query trace")
+	c.Assert(series.Points, HasLen, 1)
+	point := series.Points[0]
+	c.Assert(point.GetTimestamp(), Equals, startTime)
+	c.Assert(point.Values[0].GetStringValue(), Equals, trace.id)
+	c.Assert(point.Values[1].GetInt64Value(), Equals, int64(serverId))
+	c.Assert(point.Values[2].GetInt64Value(), Equals, int64(shardId))
+	c.Assert(point.Values[3].GetDoubleValue(), Equals, float64(duration))
+	c.Assert(point.Values[4].GetInt64Value(), Equals, pointsRead)
+	c.Assert(point.Values[5].GetStringValue(), Equals, "shard_scan")
+}
+
+func (self *CoordinatorSuite) TestTheStagesOfATraceAreUnderTheSpanOfTheQuery(c *C) {
+	trace := NewQueryTrace(2)
+	trace.AddStage("serialization", time.Now(), 5*time.Millisecond)
+	series := trace.Series()
+	c.Assert(series.Points, HasLen, 1)
+	point := series.Points[0]
+	c.Assert(point.Values[1].GetInt64Value(), Equals, int64(2))
+	c.Assert(point.Values[3].GetDoubleValue(), Equals, float64(5000))
+	c.Assert(point.Values[5].GetStringValue(), Equals, "serialization")
+	c.Assert(point.Values[6].GetInt64Value(), Not(Equals), int64(0))
+	c.Assert(point.Values[7].GetInt64Value(), Equals, int64(trace.trace.spanId))
+
+	// the stages aren't shards the query read
+	shards, points := trace.trace.shardsAndPoints()
+	c.Assert(shards, HasLen, 0)
+	c.Assert(points, Equals, int64(0))
+}
+
+func (self *CoordinatorSuite) TestBackfillsAreSplitInWindowsOfGroupByIntervals(c *C) {
+	start := time.Unix(1400000000, 0)
+	end := start.Add(2500 * time.Minute)
+	windows := continuousQueryBackfillWindows(start, end, time.Minute)
+	c.Assert(windows, HasLen, 3)
+	// the windows are aligned to the interval
+	c.Assert(windows[0][0], Equals, time.Unix(1399999980, 0))
+	c.Assert(windows[0][1], Equals, windows[0][0].Add(1000*time.Minute))
+	c.Assert(windows[1][1], Equals, windows[1][0].Add(1000*time.Minute))
+	c.Assert(windows[2][1], Equals, end.Truncate(time.Minute))
+	c.Assert(windows[2][1].Sub(windows[2][0]), Equals, 500*time.Minute)
+
+	c.Assert(continuousQueryBackfillWindows(end, start, time.Minute), HasLen, 0)
+}
+
+func (self *CoordinatorSuite) TestRollupsNeedAnIntoClauseAndAGroupByTime(c *C) {
+	rollups, err := parseRollups([]configuration.RollupConfig{
+		configuration.RollupConfig{
+			Database: "db1",
+			Queries:  []string{"select mean(value) from cpu group by time(5m) into cpu.5m"},
+			After:    "7d",
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rollups, HasLen, 1)
+	c.Assert(rollups[0].after, Equals, 7*24*time.Hour)
+	c.Assert(rollups[0].queries, HasLen, 1)
+
+	for _, query := range []string{
+		"select mean(value) from cpu group by time(5m)",
+		"select mean(value) from cpu into cpu.5m",
+		"select mean(value) from /.*/ group by time(5m) into cpu.5m",
+		"select mean(value) from cpu where host = 'a' group by time(5m) into cpu.5m",
+	} {
+		_, err := parseRollups([]configuration.RollupConfig{
+			configuration.RollupConfig{Database: "db1", Queries: []string{query}, After: "7d"},
+		})
+		c.Assert(err, NotNil, Commentf("query: %s", query))
+	}
+	_, err = parseRollups([]configuration.RollupConfig{configuration.RollupConfig{Database: "db1"}})
+	c.Assert(err, NotNil)
+}
+
+func (self *CoordinatorSuite) TestIngestProcessorsRenameTheSeriesAndDropTheOldPoints(c *C) {
+	coordinator := &CoordinatorImpl{}
+	err := coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "rename-series", Pattern: `^servers\.([^.]+)\.cpu$`, Replacement: "cpu.$1"},
+		configuration.IngestProcessorConfig{Type: "drop-old-points", Database: "db1", MaxAge: "1h"},
+	})
+	c.Assert(err, IsNil)
+
+	now := common.CurrentTime()
+	old := now - int64(2*time.Hour/time.Microsecond)
+	newSeries := func() []*protocol.Series {
+		return []*protocol.Series{
+			&protocol.Series{Name: protocol.String("servers.a.cpu"), Fields: []string{"value"}, Points: []*protocol.Point{
+				&protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}}, Timestamp: &now},
+				&protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(2)}}, Timestamp: &old},
+			}},
+			&protocol.Series{Name: protocol.String("disk"), Fields: []string{"value"}, Points: []*protocol.Point{
+				&protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(3)}}, Timestamp: &old},
+			}},
+		}
+	}
+
+	series, err := coordinator.processIngest("db1", newSeries())
+	c.Assert(err, IsNil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].GetName(), Equals, "cpu.a")
+	c.Assert(series[0].Points, HasLen, 1)
+	c.Assert(series[0].Points[0].Values[0].GetInt64Value(), Equals, int64(1))
+
+	// the old points are only dropped from the writes of db1
+	series, err = coordinator.processIngest("db2", newSeries())
+	c.Assert(err, IsNil)
+	c.Assert(series, HasLen, 2)
+	c.Assert(series[0].GetName(), Equals, "cpu.a")
+	c.Assert(series[0].Points, HasLen, 2)
+
+	for _, config := range []configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "unknown"},
+		configuration.IngestProcessorConfig{Type: "rename-series", Pattern: "cpu"},
+		configuration.IngestProcessorConfig{Type: "rename-series", Pattern: "(", Replacement: "cpu"},
+		configuration.IngestProcessorConfig{Type: "drop-old-points"},
+	} {
+		c.Assert(coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{config}), NotNil, Commentf("config: %v", config))
+	}
+}
+
+func (self *CoordinatorSuite) TestValidationRulesRejectTheWritesAndCountThem(c *C) {
+	coordinator := &CoordinatorImpl{}
+	min, max := 0.0, 100.0
+	err := coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "series-whitelist", Database: "validated", Pattern: `^cpu\.`},
+		configuration.IngestProcessorConfig{Type: "require-fields", Database: "validated", Fields: []string{"value"}},
+		configuration.IngestProcessorConfig{Type: "field-types", Database: "validated", FieldTypes: []string{"number"}, Fields: []string{"value"}},
+		configuration.IngestProcessorConfig{Type: "value-range", Database: "validated", Fields: []string{"value"}, Min: &min, Max: &max},
+	})
+	c.Assert(err, IsNil)
+
+	newSeries := func(name string, fields []string, values ...*protocol.FieldValue) []*protocol.Series {
+		return []*protocol.Series{
+			&protocol.Series{Name: protocol.String(name), Fields: fields, Points: []*protocol.Point{&protocol.Point{Values: values}}},
+		}
+	}
+	host := &protocol.FieldValue{StringValue: protocol.String("web-1")}
+	series, err := coordinator.processIngest("validated", newSeries("cpu.idle", []string{"value", "host"}, &protocol.FieldValue{Int64Value: protocol.Int64(42)}, host))
+	c.Assert(err, IsNil)
+	c.Assert(series, HasLen, 1)
+
+	for rule, s := range map[string][]*protocol.Series{
+		"series-whitelist": newSeries("disk", []string{"value"}, &protocol.FieldValue{Int64Value: protocol.Int64(1)}),
+		"require-fields":   newSeries("cpu.idle", []string{"host"}, host),
+		"field-types":      newSeries("cpu.idle", []string{"value"}, host),
+		"value-range":      newSeries("cpu.idle", []string{"value"}, &protocol.FieldValue{DoubleValue: protocol.Float64(100.5)}),
+	} {
+		counter := metrics.Default.Counter(metrics.DatabaseMetric("validated", "rejected_writes."+rule))
+		before := counter.Count()
+		_, err := coordinator.processIngest("validated", s)
+		c.Assert(err, NotNil, Commentf("rule: %s", rule))
+		c.Assert(counter.Count(), Equals, before+1, Commentf("rule: %s", rule))
+		// the rules only check the writes of their database
+		_, err = coordinator.processIngest("db1", s)
+		c.Assert(err, IsNil)
+	}
+
+	for _, config := range []configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "require-fields"},
+		configuration.IngestProcessorConfig{Type: "field-types", FieldTypes: []string{"integer"}},
+		configuration.IngestProcessorConfig{Type: "series-whitelist"},
+		configuration.IngestProcessorConfig{Type: "value-range"},
+		configuration.IngestProcessorConfig{Type: "value-range", Min: &max, Max: &min},
+	} {
+		c.Assert(coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{config}), NotNil, Commentf("config: %v", config))
+	}
+}
+
+func (self *CoordinatorSuite) TestSeriesTemplatesSplitTheNamesIntoColumns(c *C) {
+	coordinator := &CoordinatorImpl{}
+	err := coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "series-template", Pattern: `^web-`, Template: "host.series.series"},
+	})
+	c.Assert(err, IsNil)
+
+	value := &protocol.FieldValue{Int64Value: protocol.Int64(42)}
+	original := &protocol.Point{Values: []*protocol.FieldValue{value}, Timestamp: protocol.Int64(1000)}
+	series, err := coordinator.processIngest("db1", []*protocol.Series{
+		&protocol.Series{Name: protocol.String("web-1.cpu.idle"), Fields: []string{"value"}, Points: []*protocol.Point{original}},
+		&protocol.Series{Name: protocol.String("disk"), Fields: []string{"value"}, Points: []*protocol.Point{original}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(series, HasLen, 2)
+	c.Assert(series[0].GetName(), Equals, "cpu.idle")
+	c.Assert(series[0].Fields, DeepEquals, []string{"value", "host"})
+	c.Assert(series[0].Points[0].GetTimestamp(), Equals, int64(1000))
+	c.Assert(series[0].Points[0].Values[1].GetStringValue(), Equals, "web-1")
+	// the series that don't match the pattern and the points of the write
+	// aren't changed
+	c.Assert(series[1].GetName(), Equals, "disk")
+	c.Assert(original.Values, HasLen, 1)
+
+	_, err = coordinator.processIngest("db1", []*protocol.Series{
+		&protocol.Series{Name: protocol.String("web-1.cpu"), Fields: []string{"host"}, Points: []*protocol.Point{original}},
+	})
+	c.Assert(err, NotNil)
+
+	for _, config := range []configuration.IngestProcessorConfig{
+		configuration.IngestProcessorConfig{Type: "series-template"},
+		configuration.IngestProcessorConfig{Type: "series-template", Template: "host.host.series"},
+	} {
+		c.Assert(coordinator.SetIngestProcessors([]configuration.IngestProcessorConfig{config}), NotNil, Commentf("config: %v", config))
+	}
+}
+
+func (self *CoordinatorSuite) TestWritesWithPointsOutOfTheTimestampBoundsAreRejected(c *C) {
+	coordinator := &CoordinatorImpl{config: &configuration.Configuration{
+		TimestampBounds:         configuration.TimestampBounds{MaxFutureOffset: time.Hour},
+		DatabaseTimestampBounds: map[string]configuration.TimestampBounds{"db1": {24 * time.Hour, time.Hour}},
+	}}
+	newSeries := func(offsets ...time.Duration) []*protocol.Series {
+		points := []*protocol.Point{}
+		for _, offset := range offsets {
+			timestamp := common.TimeToMicroseconds(time.Now().Add(offset))
+			points = append(points, &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}}, Timestamp: &timestamp})
+		}
+		points = append(points, &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}}})
+		return []*protocol.Series{&protocol.Series{Name: protocol.String("cpu"), Fields: []string{"value"}, Points: points}}
+	}
+
+	c.Assert(coordinator.checkTimestampBounds("db1", newSeries(-time.Hour, 30*time.Minute)), IsNil)
+	c.Assert(coordinator.checkTimestampBounds("db2", newSeries(-48*time.Hour)), IsNil)
+
+	tooOld := metrics.Default.Counter(metrics.DatabaseMetric("db1", "points_too_old")).Count()
+	inFuture := metrics.Default.Counter(metrics.DatabaseMetric("db1", "points_in_future")).Count()
+	err := coordinator.checkTimestampBounds("db1", newSeries(-48*time.Hour, 10*365*24*time.Hour, 20*365*24*time.Hour))
+	c.Assert(err, ErrorMatches, "The point of cpu at .* is older than 24h0m0s, the max-point-age of the database db1 \\(3 points .*")
+	c.Assert(metrics.Default.Counter(metrics.DatabaseMetric("db1", "points_too_old")).Count(), Equals, tooOld+1)
+	c.Assert(metrics.Default.Counter(metrics.DatabaseMetric("db1", "points_in_future")).Count(), Equals, inFuture+2)
+
+	err = coordinator.checkTimestampBounds("db2", newSeries(2*time.Hour))
+	c.Assert(err, ErrorMatches, "The point of cpu at .* is more than 1h0m0s in the future, the max-future-offset of the database db2 .*")
+}
+
+func (self *CoordinatorSuite) TestDrainingCancelsTheQueriesThatDontFinishInTime(c *C) {
+	coordinator := &CoordinatorImpl{runningQueries: newRunningQueries()}
+	c.Assert(coordinator.drain.start(), IsNil)
+	running := coordinator.runningQueries.add(&MockUser{}, "db1", "select * from cpu", "", nil)
+	go func() {
+		<-running.cancelled
+		coordinator.runningQueries.remove(running)
+		coordinator.drain.finish()
+	}()
+
+	coordinator.Drain(10 * time.Millisecond)
+	c.Assert(running.cancelError(), Equals, errShuttingDown)
+	c.Assert(coordinator.drain.start(), Equals, errShuttingDown)
+}
+
+func (self *CoordinatorSuite) TestRollupsDeleteTheSeriesTheyReadInTheShard(c *C) {
+	query, err := parser.ParseSelectQuery("select mean(value) from cpu group by time(5m) into cpu.5m")
+	c.Assert(err, IsNil)
+	start := time.Unix(1400000000, 0)
+	end := start.Add(7 * 24 * time.Hour)
+	queries, err := parser.ParseQuery(rollupDeleteQuery(query, start, end))
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	deleteQuery := queries[0].DeleteQuery
+	c.Assert(deleteQuery, NotNil)
+	c.Assert(deleteQuery.GetFromClause().GetString(), Equals, "cpu")
+	c.Assert(deleteQuery.GetStartTime().UnixNano(), Equals, start.UnixNano())
+	c.Assert(deleteQuery.GetEndTime().UnixNano(), Equals, end.UnixNano())
+}
+
+func (self *CoordinatorSuite) TestUserPermissionsHaveToBeValidRegexes(c *C) {
+	c.Assert(validatePermissions("^cpu\\..*", ".*"), IsNil)
+	c.Assert(validatePermissions(".*", "cpu.(*"), NotNil)
+}
+
+func (self *CoordinatorSuite) TestQueryCacheIsInvalidatedByWritesToTheSeriesItRead(c *C) {
+	cache := newQueryCache(2, time.Minute)
+	querySpec := func(query string) *parser.QuerySpec {
+		queries, err := parser.ParseQuery(query)
+		c.Assert(err, IsNil)
+		return parser.NewQuerySpec(&MockUser{}, "db1", queries[0])
+	}
+	cpu := querySpec("select mean(value) from cpu where time > 1400000000s and time < 1400003600s group by time(1m)")
+	regex := querySpec("select count(value) from /^disk\\./ where time > 1400000000s and time < 1400003600s group by time(1m)")
+	result := []*protocol.Series{&protocol.Series{Name: protocol.String("cpu")}}
+
+	series, generation := cache.get(cpu)
+	c.Assert(series, IsNil)
+	cache.put(cpu, generation, result)
+	_, generation = cache.get(regex)
+	cache.put(regex, generation, []*protocol.Series{})
+	series, _ = cache.get(querySpec("select  mean(value) from cpu where time > 1400000000s and time < 1400003600s group by time(1m)"))
+	c.Assert(series, DeepEquals, result)
+
+	cache.invalidate("db1", []*protocol.Series{&protocol.Series{Name: protocol.String("disk.sda")}})
+	series, _ = cache.get(regex)
+	c.Assert(series, IsNil)
+	series, generation = cache.get(cpu)
+	c.Assert(series, NotNil)
+	cache.invalidate("db1", []*protocol.Series{&protocol.Series{Name: protocol.String("cpu")}})
+	series, _ = cache.get(cpu)
+	c.Assert(series, IsNil)
+
+	// the results of a query that ran during a write aren't cached
+	cache.put(cpu, generation, result)
+	series, _ = cache.get(cpu)
+	c.Assert(series, IsNil)
+}
+
+func (self *CoordinatorSuite) TestRunningQueriesCanBeListedAndKilled(c *C) {
+	coordinator := &CoordinatorImpl{runningQueries: newRunningQueries()}
+	user := &MockUser{}
+	done := make(chan bool)
+	first := coordinator.runningQueries.add(user, "", "select * from cpu", "", nil)
+	second := coordinator.runningQueries.add(user, "", "select * from disk", "", done)
+
+	series := coordinator.ShowQueries(user)
+	c.Assert(series.Points, HasLen, 2)
+	c.Assert(series.Points[0].Values[0].GetInt64Value(), Equals, int64(first.id))
+	c.Assert(series.Points[1].Values[3].GetStringValue(), Equals, "select * from disk")
+
+	c.Assert(coordinator.KillQuery(user, first.id), IsNil)
+	querySpec := &parser.QuerySpec{Cancelled: first.cancelled}
+	c.Assert(querySpec.IsCancelled(), Equals, true)
+	c.Assert(coordinator.KillQuery(user, first.id), IsNil)
+
+	// the query stops when its client goes away
+	close(done)
+	select {
+	case <-second.cancelled:
+	case <-time.After(time.Second):
+		c.Fatal("the query wasn't cancelled")
+	}
+
+	coordinator.runningQueries.remove(first)
+	c.Assert(coordinator.KillQuery(user, first.id), NotNil)
+	c.Assert(coordinator.ShowQueries(user).Points, HasLen, 1)
+	c.Assert((&parser.QuerySpec{}).IsCancelled(), Equals, false)
+}
+
+func (self *CoordinatorSuite) TestQueriesAreStoppedOnceTheyGoOverTheLimits(c *C) {
+	coordinator := &CoordinatorImpl{
+		config:         &configuration.Configuration{MaxReturnedPoints: 3, MaxSelectSeries: 2},
+		runningQueries: newRunningQueries(),
+	}
+	point := &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}}}
+	newSeries := func(name string, points int) *protocol.Series {
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}}
+		for i := 0; i < points; i++ {
+			series.Points = append(series.Points, point)
+		}
+		return series
+	}
+
+	running := coordinator.runningQueries.add(&MockUser{}, "db1", "select * from /.*/", "", nil)
+	writer, stopTimeout := coordinator.limitQuery(running, NewContinuousQueryWriter(func(*protocol.Series) error { return nil }))
+	defer stopTimeout()
+	c.Assert(writer.Write(newSeries("cpu", 2)), IsNil)
+	c.Assert(running.cancelError(), IsNil)
+	err := writer.Write(newSeries("cpu", 2))
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.QueryLimitError).Limit, Equals, "max-returned-points")
+	c.Assert(running.cancelError(), Equals, err)
+
+	running = coordinator.runningQueries.add(&MockUser{}, "db1", "select * from /.*/", "", nil)
+	writer, _ = coordinator.limitQuery(running, NewContinuousQueryWriter(func(*protocol.Series) error { return nil }))
+	c.Assert(writer.Write(newSeries("cpu", 1)), IsNil)
+	c.Assert(writer.Write(newSeries("disk", 1)), IsNil)
+	c.Assert(writer.Write(newSeries("mem", 0)).(*common.QueryLimitError).Limit, Equals, "max-select-series")
+
+	coordinator.config.QueryTimeout = time.Millisecond
+	running = coordinator.runningQueries.add(&MockUser{}, "db1", "select * from /.*/", "", nil)
+	coordinator.limitQuery(running, NewContinuousQueryWriter(func(*protocol.Series) error { return nil }))
+	select {
+	case <-running.cancelled:
+	case <-time.After(time.Second):
+		c.Fatal("the query didn't time out")
+	}
+	c.Assert(running.cancelError().(*common.QueryLimitError).Limit, Equals, "query-timeout")
+}
+
+func (self *CoordinatorSuite) TestWritesToAShardAreCoalesced(c *C) {
+	shard := cluster.NewShard(1, time.Now(), time.Now(), cluster.SHORT_TERM, false, nil)
+	writes := make(chan []*protocol.Series, 10)
+	coalescer := newWriteCoalescer(50*time.Millisecond, 4, func(db string, series []*protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error {
+		writes <- series
+		return fmt.Errorf("write failed")
+	})
+	newSeries := func(fields ...string) []*protocol.Series {
+		point := &protocol.Point{Values: make([]*protocol.FieldValue, len(fields))}
+		return []*protocol.Series{&protocol.Series{Name: protocol.String("foo"), Fields: fields, Points: []*protocol.Point{point}}}
+	}
+
+	errs := make(chan error, 4)
+	for _, fields := range [][]string{{"value"}, {"value"}, {"other"}} {
+		series := newSeries(fields...)
+		go func() {
+			errs <- coalescer.Write("db1", series, shard, cluster.WRITE_CONSISTENCY_ANY)
+		}()
+	}
+	written := <-writes
+	// the series with other columns aren't merged
+	c.Assert(written, HasLen, 2)
+	c.Assert(len(written[0].Points)+len(written[1].Points), Equals, 3)
+	for i := 0; i < 3; i++ {
+		c.Assert(<-errs, ErrorMatches, "write failed")
+	}
+
+	// a write with enough points goes out without waiting
+	series := newSeries("value")
+	series[0].Points = append(series[0].Points, series[0].Points[0], series[0].Points[0], series[0].Points[0])
+	start := time.Now()
+	c.Assert(coalescer.Write("db1", series, shard, cluster.WRITE_CONSISTENCY_ANY), NotNil)
+	c.Assert(time.Now().Sub(start) < 50*time.Millisecond, Equals, true)
+	c.Assert(<-writes, HasLen, 1)
+}
+
+func (self *CoordinatorSuite) TestRateLimits(c *C) {
+	config := &configuration.Configuration{DatabaseWritePointsPerSecond: 100, UserQueriesPerMinute: 2, DatabaseConcurrentQueries: 1}
+	limits := newRateLimits(config)
+	user := &MockUser{}
+	now := time.Now()
+
+	c.Assert(limits.write(user, "db1", 60, now), IsNil)
+	err := limits.write(user, "db1", 60, now)
+	c.Assert(err, FitsTypeOf, &common.RateLimitError{})
+	c.Assert(err.(*common.RateLimitError).Limit, Equals, "database-write-points-per-second")
+	// the other databases have their own bucket
+	c.Assert(limits.write(user, "db2", 60, now), IsNil)
+	// a write bigger than the bucket goes through once it's full
+	c.Assert(limits.write(user, "db1", 500, now.Add(time.Second)), IsNil)
+	err = limits.write(user, "db1", 10, now.Add(2*time.Second))
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.RateLimitError).RetryAfter, Equals, 4)
+
+	finished, err := limits.startQuery(user, "db1", now)
+	c.Assert(err, IsNil)
+	_, err = limits.startQuery(user, "db1", now)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.RateLimitError).Limit, Equals, "database-concurrent-queries")
+	finished()
+	finished, err = limits.startQuery(user, "db1", now)
+	c.Assert(err, IsNil)
+	finished()
+	_, err = limits.startQuery(user, "db1", now)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*common.RateLimitError).Limit, Equals, "user-queries-per-minute")
+	c.Assert(err.(*common.RateLimitError).RetryAfter, Equals, 30)
+
+	// the limits are read from the config on every request
+	config.UserQueriesPerMinute = 0
+	_, err = limits.startQuery(user, "db1", now)
+	c.Assert(err, IsNil)
+}
+
+func (self *CoordinatorSuite) TestNormalizeQuery(c *C) {
+	c.Assert(normalizeQuery("select  value from \"cpu 1\"\n where host = 'a\\'b' and time > now() - 1h limit 10;"), Equals,
+		`select value from "cpu 1" where host = '?' and time > now() - ? limit ?`)
+	c.Assert(normalizeQuery("select mean(value) from cpu.5m group by time(5m)"), Equals, "select mean(value) from cpu.5m group by time(?)")
+}
+
+func (self *CoordinatorSuite) TestSlowQueryLog(c *C) {
+	config := &configuration.Configuration{SlowQueryThreshold: time.Second, SlowQueryMaxEntries: 2}
+	coordinator := &CoordinatorImpl{runningQueries: newRunningQueries(), slowQueries: newSlowQueryLog(config)}
+	user := &MockUser{}
+	run := func(query string, duration time.Duration, spans ...*protocol.TraceSpan) {
+		running := coordinator.runningQueries.add(user, "", query, "trace", nil)
+		running.start = time.Now().Add(-duration)
+		coordinator.runningQueries.addSpans("trace", spans)
+		coordinator.slowQueries.add(running)
+		coordinator.runningQueries.remove(running)
+	}
+	span := func(shardId uint32, points int64) *protocol.TraceSpan {
+		return &protocol.TraceSpan{ShardId: &shardId, PointsRead: &points}
+	}
+
+	run("select * from a", 2*time.Second)
+	run("select * from b", 0)
+	run("select * from c where time > 1h", 3*time.Second, span(3, 10), span(1, 5), span(3, 1))
+	series := coordinator.ShowSlowQueries(user)
+	c.Assert(series.Points, HasLen, 2)
+	c.Assert(series.Points[0].Values[2].GetStringValue(), Equals, "select * from a")
+	c.Assert(series.Points[1].Values[2].GetStringValue(), Equals, "select * from c where time > ?")
+	c.Assert(series.Points[1].Values[3].GetStringValue(), Equals, "1,3")
+	c.Assert(series.Points[1].Values[4].GetInt64Value(), Equals, int64(16))
+
+	// only the last slow queries are kept
+	run("select * from d", 2*time.Second)
+	series = coordinator.ShowSlowQueries(user)
+	c.Assert(series.Points, HasLen, 2)
+	c.Assert(series.Points[0].Values[2].GetStringValue(), Equals, "select * from c where time > ?")
+	c.Assert(series.Points[1].Values[2].GetStringValue(), Equals, "select * from d")
+}
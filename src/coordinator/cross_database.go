@@ -0,0 +1,113 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"fmt"
+	"parser"
+	"protocol"
+	"strings"
+)
+
+// Renames the series an inner query of a cross-database query returns to
+// the name of its table in the outer query
+type crossDatabaseWriter struct {
+	processor cluster.QueryProcessor
+	name      string
+	done      bool
+}
+
+func (self *crossDatabaseWriter) Write(series *protocol.Series) error {
+	if self.done {
+		return nil
+	}
+	renamed := &protocol.Series{Name: &self.name, Fields: series.Fields, Points: series.Points}
+	self.done = !self.processor.YieldSeries(renamed)
+	return nil
+}
+
+func (self *crossDatabaseWriter) Close() {
+}
+
+// Returns the name the series of the table has in the outer query of a
+// cross-database query, the series of the other databases keep their
+// database so they don't collide with the ones of the query's database
+func crossDatabaseName(db string, table *parser.TableName) string {
+	if table.Database == "" || table.Database == db {
+		return table.Name.Name
+	}
+	return table.Database + ".." + table.Name.Name
+}
+
+// Returns the query that reads the points of the table in the time range
+// of the query, in its order
+func crossDatabaseInnerQuery(query *parser.SelectQuery, table *parser.TableName) string {
+	condition := fmt.Sprintf("time < %d", query.GetEndTime().UnixNano())
+	// the earliest start time doesn't fit in nanoseconds
+	if query.IsStartTimeSpecified() {
+		condition += fmt.Sprintf(" and time > %d", query.GetStartTime().UnixNano())
+	}
+	order := "desc"
+	if query.Ascending {
+		order = "asc"
+	}
+	return fmt.Sprintf(`select * from "%s" where %s order %s`, strings.Replace(table.Name.Name, `"`, `\"`, -1), condition, order)
+}
+
+// Runs a query that reads series of other databases, e.g. select * from
+// "metrics".."cpu.load" merge cpu. Every series is read by an inner query
+// of its own database from the shards, then the outer query merges, joins
+// or aggregates them in the coordinator. The user has to be able to read
+// every database of the query.
+func (self *CoordinatorImpl) runCrossDatabaseQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	user := querySpec.User()
+	outer := querySpec.SelectQuery()
+	fromClause := outer.GetFromClause()
+
+	innerSpecs := make([]*parser.QuerySpec, 0, len(fromClause.Names))
+	outerFrom := &parser.FromClause{Type: fromClause.Type}
+	for _, table := range fromClause.Names {
+		db := table.Database
+		if db == "" {
+			db = querySpec.Database()
+		}
+		if !user.IsClusterAdmin() && db != user.GetDb() {
+			return common.NewAuthorizationError("User %s can't read the series of %s", user.GetName(), db)
+		}
+		if !self.clusterConfiguration.DatabasesExists(db) {
+			return fmt.Errorf("Database %s doesn't exist", db)
+		}
+
+		queries, err := parser.ParseQuery(crossDatabaseInnerQuery(outer, table))
+		if err != nil {
+			return err
+		}
+		innerSpec := parser.NewQuerySpec(user, db, queries[0])
+		innerSpec.QuorumRead = querySpec.QuorumRead
+		innerSpec.TraceId = querySpec.TraceId
+		innerSpec.ParentSpanId = querySpec.ParentSpanId
+		innerSpec.Cancelled = querySpec.Cancelled
+		if err := self.checkPermission(user, innerSpec); err != nil {
+			return err
+		}
+		innerSpecs = append(innerSpecs, innerSpec)
+
+		name := crossDatabaseName(querySpec.Database(), table)
+		outerFrom.Names = append(outerFrom.Names, &parser.TableName{Name: &parser.Value{Name: name, Type: parser.ValueSimpleName}, Alias: table.Alias})
+	}
+
+	query := *outer
+	query.FromClause = outerFrom
+	// the series are read one after the other, a merge or a join keeps
+	// the points of the series that were read until the others have
+	// points that come after them
+	return self.runCoordinatorEngine(&query, seriesWriter, func(processor cluster.QueryProcessor) error {
+		for i, innerSpec := range innerSpecs {
+			writer := &crossDatabaseWriter{processor: processor, name: outerFrom.Names[i].Name.Name}
+			if err := self.runQuery(innerSpec, writer); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
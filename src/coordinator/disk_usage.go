@@ -0,0 +1,144 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"parser"
+	"protocol"
+	"sort"
+)
+
+// The disk usage of a database in one shard, the bytes of the buckets are
+// the approximate sizes of the ranges of keys the shard uses for the
+// points and the indexes of the database
+type ShardDiskUsage struct {
+	ShardId       uint32           `json:"shardId"`
+	StartTime     int64            `json:"startTime"`
+	EndTime       int64            `json:"endTime"`
+	Series        int64            `json:"series"`
+	Columns       int64            `json:"columns"`
+	PointsWritten int64            `json:"pointsWritten"`
+	Buckets       map[string]int64 `json:"buckets"`
+	// the bytes of every database in the shard
+	ShardBytes int64 `json:"shardBytes"`
+	// the sizes of the files of the replicas, only for the cluster admins
+	Replicas []*cluster.ShardReplicaInfo `json:"replicas,omitempty"`
+}
+
+var diskUsageBuckets = map[string]string{
+	"points_bytes":             "points",
+	"series_index_bytes":       "series_index",
+	"column_index_bytes":       "column_index",
+	"field_types_bytes":        "field_types",
+	"column_value_index_bytes": "column_value_index",
+}
+
+type shardsById []*cluster.ShardData
+
+func (self shardsById) Len() int           { return len(self) }
+func (self shardsById) Less(i, j int) bool { return self[i].Id() < self[j].Id() }
+func (self shardsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the disk usage of the database in every shard that has series
+// of it, ordered by the shard ids
+func (self *CoordinatorImpl) DiskUsage(user common.User, db string) ([]*ShardDiskUsage, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return nil, common.NewAuthorizationError("Insufficient permissions to show the disk usage of %s", db)
+	}
+	queries, err := parser.ParseQuery("show disk usage")
+	if err != nil {
+		return nil, err
+	}
+	querySpec := parser.NewQuerySpec(user, db, queries[0])
+
+	replicas := map[uint32][]*cluster.ShardReplicaInfo{}
+	if user.IsClusterAdmin() {
+		for _, info := range self.clusterConfiguration.ListShards(user).Shards {
+			replicas[info.Id] = info.Replicas
+		}
+	}
+
+	shards := self.clusterConfiguration.GetAllShards()
+	sort.Sort(shardsById(shards))
+	usages := make([]*ShardDiskUsage, 0, len(shards))
+	for _, shard := range shards {
+		values, err := self.queryShardDiskUsage(shard, querySpec)
+		if err != nil {
+			return nil, err
+		}
+		if values["series"] == 0 {
+			continue
+		}
+		usage := &ShardDiskUsage{
+			ShardId:       shard.Id(),
+			StartTime:     shard.StartTime().Unix(),
+			EndTime:       shard.EndTime().Unix(),
+			Series:        values["series"],
+			Columns:       values["columns"],
+			PointsWritten: values["points_written"],
+			Buckets:       make(map[string]int64, len(diskUsageBuckets)),
+			ShardBytes:    values["shard_bytes"],
+			Replicas:      replicas[shard.Id()],
+		}
+		for field, bucket := range diskUsageBuckets {
+			usage.Buckets[bucket] = values[field]
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// Returns the values of the point the shard returns by their field names
+func (self *CoordinatorImpl) queryShardDiskUsage(shard *cluster.ShardData, querySpec *parser.QuerySpec) (map[string]int64, error) {
+	responseChan := make(chan *protocol.Response, shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize))
+	go shard.Query(querySpec, responseChan)
+	values := map[string]int64{}
+	for {
+		response := <-responseChan
+		if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+			if response.ErrorMessage != nil {
+				return nil, common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+			}
+			return values, nil
+		}
+		if response.Series == nil {
+			continue
+		}
+		for _, point := range response.Series.Points {
+			for i, field := range response.Series.Fields {
+				values[field] += point.Values[i].GetInt64Value()
+			}
+		}
+	}
+}
+
+// Writes the disk usage of the database as a series with a point per
+// shard
+func (self *CoordinatorImpl) runShowDiskUsageQuery(user common.User, db string, seriesWriter SeriesWriter) error {
+	usages, err := self.DiskUsage(user, db)
+	if err != nil {
+		return err
+	}
+	buckets := make([]string, 0, len(diskUsageBuckets))
+	for field := range diskUsageBuckets {
+		buckets = append(buckets, field)
+	}
+	sort.Strings(buckets)
+	fields := append([]string{"shard_id", "start_time", "end_time", "series", "columns", "points_written"}, buckets...)
+	fields = append(fields, "shard_bytes")
+
+	points := make([]*protocol.Point, 0, len(usages))
+	for _, usage := range usages {
+		values := []int64{int64(usage.ShardId), usage.StartTime, usage.EndTime, usage.Series, usage.Columns, usage.PointsWritten}
+		for _, field := range buckets {
+			values = append(values, usage.Buckets[diskUsageBuckets[field]])
+		}
+		values = append(values, usage.ShardBytes)
+		point := &protocol.Point{Values: make([]*protocol.FieldValue, 0, len(values))}
+		for _, value := range values {
+			point.Values = append(point.Values, &protocol.FieldValue{Int64Value: protocol.Int64(value)})
+		}
+		points = append(points, point)
+	}
+	return seriesWriter.Write(&protocol.Series{Name: protocol.String("disk usage"), Fields: fields, Points: points})
+}
@@ -0,0 +1,226 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"fmt"
+	"protocol"
+	"regexp"
+	"time"
+)
+
+// Transforms the series of a write before they're written, e.g. to drop
+// columns, rename the series or reject the write by returning an error.
+// The processors can't change the series they're given, they return new
+// ones instead. The series left without points aren't written.
+type IngestProcessor interface {
+	Process(series []*protocol.Series) ([]*protocol.Series, error)
+}
+
+// Creates the processor of an ingest-processors section of the config
+type IngestProcessorInitializer func(config configuration.IngestProcessorConfig) (IngestProcessor, error)
+
+var registeredIngestProcessors = make(map[string]IngestProcessorInitializer)
+
+func init() {
+	RegisterIngestProcessor("rename-series", NewRenameSeriesProcessor)
+	RegisterIngestProcessor("drop-old-points", NewDropOldPointsProcessor)
+	RegisterIngestProcessor("require-fields", NewRequireFieldsProcessor)
+	RegisterIngestProcessor("field-types", NewFieldTypesProcessor)
+	RegisterIngestProcessor("series-whitelist", NewSeriesWhitelistProcessor)
+	RegisterIngestProcessor("value-range", NewValueRangeProcessor)
+	RegisterIngestProcessor("series-template", NewSeriesTemplateProcessor)
+}
+
+// Makes the processor available to the config under the given type, has
+// to be called before the server starts
+func RegisterIngestProcessor(processorType string, initializer IngestProcessorInitializer) {
+	registeredIngestProcessors[processorType] = initializer
+}
+
+type databaseIngestProcessor struct {
+	database  string
+	processor IngestProcessor
+}
+
+func parseIngestProcessors(configs []configuration.IngestProcessorConfig) ([]*databaseIngestProcessor, error) {
+	processors := make([]*databaseIngestProcessor, 0, len(configs))
+	for _, config := range configs {
+		initializer := registeredIngestProcessors[config.Type]
+		if initializer == nil {
+			return nil, fmt.Errorf("Unknown ingest processor type '%s'", config.Type)
+		}
+		processor, err := initializer(config)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, &databaseIngestProcessor{config.Database, processor})
+	}
+	return processors, nil
+}
+
+// Replaces the ingest processors of the writes with the ones of the
+// config
+func (self *CoordinatorImpl) SetIngestProcessors(configs []configuration.IngestProcessorConfig) error {
+	processors, err := parseIngestProcessors(configs)
+	if err != nil {
+		return err
+	}
+	self.ingestProcessors = processors
+	return nil
+}
+
+// Runs the series through the processors of the database and drops the
+// series that don't have any points left
+func (self *CoordinatorImpl) processIngest(db string, series []*protocol.Series) ([]*protocol.Series, error) {
+	for _, p := range self.ingestProcessors {
+		if p.database != "" && p.database != db {
+			continue
+		}
+		var err error
+		if series, err = p.processor.Process(series); err != nil {
+			return nil, err
+		}
+	}
+	if len(self.ingestProcessors) == 0 {
+		return series, nil
+	}
+	processed := make([]*protocol.Series, 0, len(series))
+	for _, s := range series {
+		if len(s.Points) > 0 {
+			processed = append(processed, s)
+		}
+	}
+	return processed, nil
+}
+
+// Renames the series matching the pattern to the replacement, which can
+// refer to the groups of the pattern like regexp.Regexp.ReplaceAllString
+type RenameSeriesProcessor struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func NewRenameSeriesProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if config.Pattern == "" || config.Replacement == "" {
+		return nil, fmt.Errorf("The rename-series ingest processor needs a pattern and a replacement")
+	}
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RenameSeriesProcessor{pattern, config.Replacement}, nil
+}
+
+func (self *RenameSeriesProcessor) Process(series []*protocol.Series) ([]*protocol.Series, error) {
+	renamed := make([]*protocol.Series, 0, len(series))
+	for _, s := range series {
+		if !self.pattern.MatchString(s.GetName()) {
+			renamed = append(renamed, s)
+			continue
+		}
+		name := self.pattern.ReplaceAllString(s.GetName(), self.replacement)
+		if name == "" {
+			return nil, fmt.Errorf("The series %s can't be renamed to an empty name", s.GetName())
+		}
+		renamed = append(renamed, &protocol.Series{Name: protocol.String(name), Fields: s.Fields, Points: s.Points})
+	}
+	return renamed, nil
+}
+
+// Splits the dotted names of the series matching the pattern, all of them
+// if there's no pattern, into the name and the columns of the template.
+// The values of the columns are added to every point of the series so
+// the queries can filter on them.
+type SeriesTemplateProcessor struct {
+	pattern  *regexp.Regexp
+	template *common.SeriesTemplate
+}
+
+func NewSeriesTemplateProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if config.Template == "" {
+		return nil, fmt.Errorf("The series-template ingest processor needs a template")
+	}
+	var pattern *regexp.Regexp
+	if config.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(config.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	separator := config.Separator
+	if separator == "" {
+		separator = "."
+	}
+	template, err := common.NewSeriesTemplate(config.Template, separator)
+	if err != nil {
+		return nil, err
+	}
+	return &SeriesTemplateProcessor{pattern, template}, nil
+}
+
+func (self *SeriesTemplateProcessor) Process(series []*protocol.Series) ([]*protocol.Series, error) {
+	templated := make([]*protocol.Series, 0, len(series))
+	for _, s := range series {
+		if self.pattern != nil && !self.pattern.MatchString(s.GetName()) {
+			templated = append(templated, s)
+			continue
+		}
+		name, columns, values, err := self.template.Apply(s.GetName())
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range columns {
+			for _, field := range s.Fields {
+				if field == column {
+					return nil, fmt.Errorf("The series %s has the column %s of the template already", s.GetName(), column)
+				}
+			}
+		}
+		fieldValues := make([]*protocol.FieldValue, 0, len(values))
+		for i := range values {
+			fieldValues = append(fieldValues, &protocol.FieldValue{StringValue: &values[i]})
+		}
+		points := make([]*protocol.Point, 0, len(s.Points))
+		for _, point := range s.Points {
+			pointValues := make([]*protocol.FieldValue, 0, len(point.Values)+len(fieldValues))
+			pointValues = append(append(pointValues, point.Values...), fieldValues...)
+			points = append(points, &protocol.Point{Timestamp: point.Timestamp, SequenceNumber: point.SequenceNumber, Values: pointValues})
+		}
+		fields := append(append([]string{}, s.Fields...), columns...)
+		templated = append(templated, &protocol.Series{Name: protocol.String(name), Fields: fields, Points: points})
+	}
+	return templated, nil
+}
+
+// Drops the points older than the max age, the points without a
+// timestamp are written with the current time and are kept
+type DropOldPointsProcessor struct {
+	maxAge time.Duration
+}
+
+func NewDropOldPointsProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if config.MaxAge == "" {
+		return nil, fmt.Errorf("The drop-old-points ingest processor needs a max-age")
+	}
+	maxAge, err := common.ParseTimeDuration(config.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &DropOldPointsProcessor{time.Duration(maxAge)}, nil
+}
+
+func (self *DropOldPointsProcessor) Process(series []*protocol.Series) ([]*protocol.Series, error) {
+	oldest := common.CurrentTime() - int64(self.maxAge/time.Microsecond)
+	kept := make([]*protocol.Series, 0, len(series))
+	for _, s := range series {
+		points := make([]*protocol.Point, 0, len(s.Points))
+		for _, point := range s.Points {
+			if point.Timestamp == nil || point.GetTimestamp() >= oldest {
+				points = append(points, point)
+			}
+		}
+		kept = append(kept, &protocol.Series{Name: s.Name, Fields: s.Fields, Points: points})
+	}
+	return kept, nil
+}
@@ -0,0 +1,167 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"fmt"
+	"metrics"
+	"protocol"
+	"regexp"
+	"strings"
+)
+
+// Rejects the writes with a series that fails the check of the rule and
+// counts them, under databases.<db>.rejected_writes.<type> for the rules
+// of a database and ingest.rejected_writes.<type> for the others. The
+// rules of the same type and database share their counter.
+type ValidationProcessor struct {
+	rejections *metrics.Counter
+	check      func(s *protocol.Series) error
+}
+
+func newValidationProcessor(config configuration.IngestProcessorConfig, check func(s *protocol.Series) error) *ValidationProcessor {
+	name := "ingest.rejected_writes." + config.Type
+	if config.Database != "" {
+		name = metrics.DatabaseMetric(config.Database, "rejected_writes."+config.Type)
+	}
+	return &ValidationProcessor{metrics.Default.Counter(name), check}
+}
+
+func (self *ValidationProcessor) Process(series []*protocol.Series) ([]*protocol.Series, error) {
+	for _, s := range series {
+		if err := self.check(s); err != nil {
+			self.rejections.Inc()
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+// Returns the indexes of the fields of the series that are in the rule,
+// every field of the series if the rule doesn't have any
+func checkedFields(s *protocol.Series, fields map[string]bool) []int {
+	indexes := make([]int, 0, len(s.Fields))
+	for i, field := range s.Fields {
+		if len(fields) == 0 || fields[field] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func fieldSet(fields []string) map[string]bool {
+	set := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		set[field] = true
+	}
+	return set
+}
+
+// Rejects the points that don't have a value for every one of the fields
+func NewRequireFieldsProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("The require-fields ingest processor needs fields")
+	}
+	required := config.Fields
+	return newValidationProcessor(config, func(s *protocol.Series) error {
+		for _, field := range required {
+			index := -1
+			for i, f := range s.Fields {
+				if f == field {
+					index = i
+					break
+				}
+			}
+			if index == -1 {
+				return fmt.Errorf("The series %s doesn't have the required field %s", s.GetName(), field)
+			}
+			for _, point := range s.Points {
+				if point.Values[index].GetIsNull() {
+					return fmt.Errorf("A point of %s has no value for the required field %s", s.GetName(), field)
+				}
+			}
+		}
+		return nil
+	}), nil
+}
+
+// Rejects the values of the fields that aren't of one of the field types,
+// the nulls are always allowed
+func NewFieldTypesProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if len(config.FieldTypes) == 0 {
+		return nil, fmt.Errorf("The field-types ingest processor needs field-types")
+	}
+	allowed := make(map[common.FieldType]bool, len(config.FieldTypes))
+	for _, name := range config.FieldTypes {
+		fieldType, err := common.ParseFieldType(name)
+		if err != nil {
+			return nil, err
+		}
+		allowed[fieldType] = true
+	}
+	fields := fieldSet(config.Fields)
+	allowedNames := strings.Join(config.FieldTypes, " or ")
+	return newValidationProcessor(config, func(s *protocol.Series) error {
+		for _, i := range checkedFields(s, fields) {
+			for _, point := range s.Points {
+				fieldType := common.FieldTypeOf(point.Values[i])
+				if fieldType != common.FIELD_TYPE_NONE && !allowed[fieldType] {
+					return fmt.Errorf("The field %s of %s is a %s, it should be a %s", s.Fields[i], s.GetName(), fieldType, allowedNames)
+				}
+			}
+		}
+		return nil
+	}), nil
+}
+
+// Rejects the series whose names don't match the pattern
+func NewSeriesWhitelistProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if config.Pattern == "" {
+		return nil, fmt.Errorf("The series-whitelist ingest processor needs a pattern")
+	}
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return newValidationProcessor(config, func(s *protocol.Series) error {
+		if !pattern.MatchString(s.GetName()) {
+			return fmt.Errorf("The series %s doesn't match the allowed pattern %s", s.GetName(), config.Pattern)
+		}
+		return nil
+	}), nil
+}
+
+// Rejects the numbers of the fields that are below the min or above the
+// max, the values that aren't numbers aren't checked
+func NewValueRangeProcessor(config configuration.IngestProcessorConfig) (IngestProcessor, error) {
+	if config.Min == nil && config.Max == nil {
+		return nil, fmt.Errorf("The value-range ingest processor needs a min or a max")
+	}
+	if config.Min != nil && config.Max != nil && *config.Min > *config.Max {
+		return nil, fmt.Errorf("The min of the value-range ingest processor is above its max")
+	}
+	min, max := config.Min, config.Max
+	fields := fieldSet(config.Fields)
+	return newValidationProcessor(config, func(s *protocol.Series) error {
+		for _, i := range checkedFields(s, fields) {
+			for _, point := range s.Points {
+				value := point.Values[i]
+				var number float64
+				if value.Int64Value != nil {
+					number = float64(value.GetInt64Value())
+				} else if value.DoubleValue != nil {
+					number = value.GetDoubleValue()
+				} else {
+					continue
+				}
+				if min != nil && number < *min {
+					return fmt.Errorf("The value %v of the field %s of %s is below the min of %v", number, s.Fields[i], s.GetName(), *min)
+				}
+				if max != nil && number > *max {
+					return fmt.Errorf("The value %v of the field %s of %s is above the max of %v", number, s.Fields[i], s.GetName(), *max)
+				}
+			}
+		}
+		return nil
+	}), nil
+}
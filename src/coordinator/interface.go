@@ -4,7 +4,9 @@ import (
 	"cluster"
 	"common"
 	"net"
+	"parser"
 	"protocol"
+	"time"
 )
 
 type Coordinator interface {
@@ -17,23 +19,76 @@ type Coordinator interface {
 	//   4. The end of a time series is signaled by returning a series with no data points
 	//   5. TODO: Aggregation on the nodes
 	WriteSeriesData(user common.User, db string, series []*protocol.Series) error
+	WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error
+	// writes the series unless a write with the same key was written
+	// already, the default consistency of the database is used if the
+	// consistency is empty
+	WriteSeriesDataOnce(user common.User, db string, series []*protocol.Series, consistency string, idempotencyKey string) error
+	SetWriteConsistency(user common.User, db string, consistency string) error
+	// how long the points of the database are kept, e.g. "30d" or "inf"
+	SetDatabaseRetention(user common.User, db string, retention string) error
+	// rejects the writes of the database, or of every database if db is
+	// empty, until the flag is cleared
+	SetReadOnly(user common.User, db string, readOnly bool) error
+	GetReadOnlyStatus(user common.User) (*cluster.ReadOnlyStatus, error)
+	// the writes that would create more than maxSeries series in the
+	// database are rejected, zero removes the limit
+	SetMaxSeries(user common.User, db string, maxSeries int) error
+	// the estimated number of series of every database for the cluster
+	// admins, of db for the other users
+	SeriesCardinality(user common.User, db string) ([]*DatabaseCardinality, error)
 	DropDatabase(user common.User, db string) error
 	CreateDatabase(user common.User, db string) error
 	ForceCompaction(user common.User) error
 	ListDatabases(user common.User) ([]*cluster.Database, error)
 	DeleteContinuousQuery(user common.User, db string, id uint32) error
 	CreateContinuousQuery(user common.User, db string, query string) error
+	BackfillContinuousQuery(user common.User, db string, id uint32, start, end time.Time) error
 	ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error)
+	// adds a server that will join the cluster when it's started
+	AddServer(user common.User, server *cluster.NewServer) error
+	DecommissionServer(user common.User, id uint32) error
+	PlanRebalance(user common.User) ([]*cluster.ShardMove, error)
+	Rebalance(user common.User, moves []*cluster.ShardMove) error
+	ListShards(user common.User) (*cluster.ShardListing, error)
+	// the disk usage of the database in each of the shards it has series in
+	DiskUsage(user common.User, db string) ([]*ShardDiskUsage, error)
+	MoveShard(user common.User, move *cluster.ShardMove) error
+	DropOrphanedShard(user common.User, shardId uint32, serverIds []uint32) error
+	SetReplicationFactor(user common.User, replicationFactor int) error
+	SetShardDuration(user common.User, shardType cluster.ShardType, duration time.Duration) error
+	SetRuntimeSetting(user common.User, name, value string) error
+	ListRuntimeSettings(user common.User) (map[string]string, error)
+	// re-reads the config file of this server and applies the settings
+	// that can change while it's running
+	ReloadConfiguration(user common.User) (*ConfigReload, error)
+	CreateReplicationTarget(user common.User, target *cluster.ReplicationTarget) error
+	DropReplicationTarget(user common.User, name string) error
+	ListReplicationTargets(user common.User) ([]*ReplicationTargetStatus, error)
+	Backup(user common.User, dir string) (*cluster.BackupManifest, error)
+	Restore(user common.User, dir string) error
 
 	// v2 clustering, based on sharding instead of the circular hash ring
 	RunQuery(user common.User, db, query string, seriesWriter SeriesWriter) error
+	RunQueryWithConsistency(user common.User, db, query string, consistency cluster.ReadConsistency, seriesWriter SeriesWriter) error
+	RunQueryWithCancel(user common.User, db, query string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, seriesWriter SeriesWriter) error
+	// returns the trace of the query with the time each of its stages took
+	RunTracedQuery(user common.User, db, query string, params parser.Parameters, consistency cluster.ReadConsistency, done <-chan bool, seriesWriter SeriesWriter) (*QueryTrace, error)
+
+	// writes forwarded by the servers that don't hold the write lease of the shard
+	WriteToLeasedShard(db string, shardId uint32, series []*protocol.Series, consistency cluster.WriteConsistency, idempotencyKey string) error
 }
 
 type ClusterConsensus interface {
 	CreateDatabase(name string) error
 	DropDatabase(name string) error
+	SetWriteConsistency(db, consistency string) error
+	SetDatabaseRetention(db, retention string) error
+	SetReadOnly(db string, readOnly bool) error
+	SetMaxSeries(db string, maxSeries int) error
 	CreateContinuousQuery(db string, query string) error
 	DeleteContinuousQuery(db string, id uint32) error
+	BackfillContinuousQuery(db string, id uint32, start, end time.Time) error
 	SaveClusterAdminUser(u *cluster.ClusterAdmin) error
 	SaveDbUser(user *cluster.DbUser) error
 	ChangeDbUserPassword(db, username string, hash []byte) error
@@ -42,6 +97,19 @@ type ClusterConsensus interface {
 	// When a cluster is turned on for the first time.
 	CreateRootUser() error
 	ForceLogCompaction() error
+	RemoveServer(id uint32) error
+	AddServer(server *cluster.NewServer) error
+	DecommissionServer(id uint32) error
+	AcquireShardLease(shardId, serverId uint32, now, expiration time.Time) error
+	AddShardReplica(shardId, serverId uint32) error
+	SetReplicationFactor(replicationFactor int) error
+	SetShardDuration(shardType cluster.ShardType, duration time.Duration) error
+	SetRuntimeSetting(name, value string) error
+	CreateReplicationTarget(target *cluster.ReplicationTarget) error
+	DropReplicationTarget(name string) error
+	CreateTombstone(tombstone *cluster.Tombstone) error
+	DropShard(id uint32, serverIds []uint32) error
+	CreateShards(shards []*cluster.NewShardData) ([]*cluster.ShardData, error)
 }
 
 type RequestHandler interface {
@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -24,33 +25,45 @@ type ProtobufClient struct {
 	connectCalled     bool
 	lastRequestId     uint32
 	writeTimeout      time.Duration
+	requestTimeout    time.Duration
 	attempts          int
 	stopped           bool
+	tlsConfig         *tls.Config
 }
 
 type runningRequest struct {
 	timeMade     time.Time
+	deadline     time.Time
 	responseChan chan *protocol.Response
 	request      *protocol.Request
 }
 
+var connectionError = protocol.Response_CONNECTION_ERROR
+
 const (
 	REQUEST_RETRY_ATTEMPTS = 2
 	MAX_RESPONSE_SIZE      = MAX_REQUEST_SIZE
 	MAX_REQUEST_TIME       = time.Second * 1200
 	RECONNECT_RETRY_WAIT   = time.Millisecond * 100
+	REQUEST_SWEEP_INTERVAL = time.Second
 )
 
 func NewProtobufClient(hostAndPort string, writeTimeout time.Duration) *ProtobufClient {
 	log.Debug("NewProtobufClient: ", hostAndPort)
 	return &ProtobufClient{
-		hostAndPort:   hostAndPort,
-		requestBuffer: make(map[uint32]*runningRequest),
-		writeTimeout:  writeTimeout,
-		stopped:       false,
+		hostAndPort:    hostAndPort,
+		requestBuffer:  make(map[uint32]*runningRequest),
+		writeTimeout:   writeTimeout,
+		requestTimeout: MAX_REQUEST_TIME,
+		stopped:        false,
 	}
 }
 
+// Makes the client connect over tls, has to be called before Connect
+func (self *ProtobufClient) EnableTls(tlsConfig *tls.Config) {
+	self.tlsConfig = tlsConfig
+}
+
 func (self *ProtobufClient) Connect() {
 	self.connLock.Lock()
 	defer self.connLock.Unlock()
@@ -83,25 +96,46 @@ func (self *ProtobufClient) getConnection() net.Conn {
 }
 
 func (self *ProtobufClient) ClearRequests() {
+	self.failRequests("clearing all requests")
+}
+
+// ends every running request with the given error
+func (self *ProtobufClient) failRequests(message string) {
 	self.requestBufferLock.Lock()
 	defer self.requestBufferLock.Unlock()
 
-	message := "clearing all requests"
 	for _, req := range self.requestBuffer {
-		select {
-		case req.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}:
-		default:
-			log.Debug("Cannot send response on channel")
-		}
+		failRequest(req, message)
 	}
 
 	self.requestBuffer = map[uint32]*runningRequest{}
 }
 
+func failRequest(req *runningRequest, message string) {
+	select {
+	case req.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message, ErrorCode: &connectionError, RequestId: req.request.Id}:
+	default:
+		log.Debug("Cannot send response on channel")
+	}
+}
+
+// Returns the number of requests waiting for a response
+func (self *ProtobufClient) RunningRequests() int {
+	self.requestBufferLock.RLock()
+	defer self.requestBufferLock.RUnlock()
+	return len(self.requestBuffer)
+}
+
 // Makes a request to the server. If the responseStream chan is not nil it will expect a response from the server
 // with a matching request.Id. The REQUEST_RETRY_ATTEMPTS constant of 3 and the RECONNECT_RETRY_WAIT of 100ms means
 // that an attempt to make a request to a downed server will take 300ms to time out.
 func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	return self.MakeRequestWithTimeout(request, responseStream, self.requestTimeout)
+}
+
+// Same as MakeRequest, the request is ended with an error if the server
+// didn't finish responding within the timeout
+func (self *ProtobufClient) MakeRequestWithTimeout(request *protocol.Request, responseStream chan *protocol.Response, timeout time.Duration) error {
 	if request.Id == nil {
 		id := atomic.AddUint32(&self.lastRequestId, uint32(1))
 		request.Id = &id
@@ -116,7 +150,8 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 			log.Error(message)
 			oldReq.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
 		}
-		self.requestBuffer[*request.Id] = &runningRequest{timeMade: time.Now(), responseChan: responseStream, request: request}
+		now := time.Now()
+		self.requestBuffer[*request.Id] = &runningRequest{timeMade: now, deadline: now.Add(timeout), responseChan: responseStream, request: request}
 		self.requestBufferLock.Unlock()
 	}
 
@@ -167,7 +202,7 @@ func (self *ProtobufClient) readResponses() {
 		err = binary.Read(conn, binary.LittleEndian, &messageSizeU)
 		if err != nil {
 			log.Error("Error while reading messsage size: %d", err)
-			time.Sleep(200 * time.Millisecond)
+			self.connectionLost(conn)
 			continue
 		}
 		messageSize := int64(messageSizeU)
@@ -175,7 +210,7 @@ func (self *ProtobufClient) readResponses() {
 		_, err = io.Copy(buff, messageReader)
 		if err != nil {
 			log.Error("Error while reading message: %d", err)
-			time.Sleep(200 * time.Millisecond)
+			self.connectionLost(conn)
 			continue
 		}
 		response, err := protocol.DecodeResponse(buff)
@@ -202,6 +237,20 @@ func (self *ProtobufClient) sendResponse(response *protocol.Response) {
 	}
 }
 
+// The responses to the running requests were lost with the connection,
+// they're ended with an error so that the callers don't wait for them
+// until they time out. Nothing is done if the connection was already
+// replaced, e.g. by a request that failed to write to it.
+func (self *ProtobufClient) connectionLost(conn net.Conn) {
+	if self.stopped || self.getConnection() != conn {
+		return
+	}
+	self.failRequests(fmt.Sprintf("Lost the connection to %s", self.hostAndPort))
+	if self.reconnect() == nil {
+		time.Sleep(RECONNECT_RETRY_WAIT)
+	}
+}
+
 func (self *ProtobufClient) reconnect() net.Conn {
 	self.connLock.Lock()
 	defer self.connLock.Unlock()
@@ -209,7 +258,7 @@ func (self *ProtobufClient) reconnect() net.Conn {
 	if self.conn != nil {
 		self.conn.Close()
 	}
-	conn, err := net.DialTimeout("tcp", self.hostAndPort, self.writeTimeout)
+	conn, err := dialCluster(self.hostAndPort, self.writeTimeout, self.tlsConfig)
 	if err == nil {
 		self.conn = conn
 		log.Info("connected to %s", self.hostAndPort)
@@ -224,14 +273,15 @@ func (self *ProtobufClient) reconnect() net.Conn {
 }
 
 func (self *ProtobufClient) peridicallySweepTimedOutRequests() {
-	for {
-		time.Sleep(time.Minute)
+	for !self.stopped {
+		time.Sleep(REQUEST_SWEEP_INTERVAL)
 		self.requestBufferLock.Lock()
-		maxAge := time.Now().Add(-MAX_REQUEST_TIME)
+		now := time.Now()
 		for k, req := range self.requestBuffer {
-			if req.timeMade.Before(maxAge) {
+			if req.deadline.Before(now) {
 				delete(self.requestBuffer, k)
 				log.Warn("Request timed out: ", req.request)
+				failRequest(req, fmt.Sprintf("Request to %s timed out after %s", self.hostAndPort, req.deadline.Sub(req.timeMade)))
 			}
 		}
 		self.requestBufferLock.Unlock()
@@ -0,0 +1,83 @@
+package coordinator
+
+import (
+	"crypto/tls"
+	"protocol"
+	"sync/atomic"
+	"time"
+)
+
+// Spreads the requests to a server over several connections. Every
+// connection multiplexes its requests by id, but the responses are read
+// one at a time, so a big query response that's slow to be consumed
+// holds up whatever else is sent over the same connection. New requests
+// go to the connection with the fewest running requests.
+type ProtobufConnectionPool struct {
+	clients []*ProtobufClient
+	next    uint32
+}
+
+func NewProtobufConnectionPool(hostAndPort string, size int, writeTimeout, requestTimeout time.Duration) *ProtobufConnectionPool {
+	if size < 1 {
+		size = 1
+	}
+	if requestTimeout <= 0 {
+		requestTimeout = MAX_REQUEST_TIME
+	}
+	clients := make([]*ProtobufClient, 0, size)
+	for i := 0; i < size; i++ {
+		client := NewProtobufClient(hostAndPort, writeTimeout)
+		client.requestTimeout = requestTimeout
+		clients = append(clients, client)
+	}
+	return &ProtobufConnectionPool{clients: clients}
+}
+
+func (self *ProtobufConnectionPool) EnableTls(tlsConfig *tls.Config) {
+	for _, client := range self.clients {
+		client.EnableTls(tlsConfig)
+	}
+}
+
+func (self *ProtobufConnectionPool) Connect() {
+	for _, client := range self.clients {
+		client.Connect()
+	}
+}
+
+func (self *ProtobufConnectionPool) Close() {
+	for _, client := range self.clients {
+		client.Close()
+	}
+}
+
+func (self *ProtobufConnectionPool) ClearRequests() {
+	for _, client := range self.clients {
+		client.ClearRequests()
+	}
+}
+
+func (self *ProtobufConnectionPool) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	return self.pick().MakeRequest(request, responseStream)
+}
+
+func (self *ProtobufConnectionPool) MakeRequestWithTimeout(request *protocol.Request, responseStream chan *protocol.Response, timeout time.Duration) error {
+	return self.pick().MakeRequestWithTimeout(request, responseStream, timeout)
+}
+
+// returns the least busy connection, ties are broken by going around
+// the connections so they all get used
+func (self *ProtobufConnectionPool) pick() *ProtobufClient {
+	start := int(atomic.AddUint32(&self.next, 1))
+	var picked *ProtobufClient
+	pickedRequests := 0
+	for i := range self.clients {
+		client := self.clients[(start+i)%len(self.clients)]
+		requests := client.RunningRequests()
+		if picked == nil || requests < pickedRequests {
+			picked = client
+			pickedRequests = requests
+		}
+	}
+	return picked
+}
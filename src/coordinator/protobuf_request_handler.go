@@ -21,8 +21,9 @@ type ProtobufRequestHandler struct {
 }
 
 var (
-	internalError        = protocol.Response_INTERNAL_ERROR
-	accessDeniedResponse = protocol.Response_ACCESS_DENIED
+	internalError         = protocol.Response_INTERNAL_ERROR
+	accessDeniedResponse  = protocol.Response_ACCESS_DENIED
+	writeLogEntryResponse = protocol.Response_WRITE_LOG_ENTRY
 )
 
 func NewProtobufRequestHandler(coordinator Coordinator, clusterConfig *cluster.ClusterConfiguration) *ProtobufRequestHandler {
@@ -33,12 +34,34 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 	switch *request.Type {
 	case protocol.Request_WRITE:
 		go self.handleWrites(request, conn)
+	case protocol.Request_LEASED_WRITE:
+		go self.handleLeasedWrite(request, conn)
 	case protocol.Request_DROP_DATABASE:
 		go self.handleDropDatabase(request, conn)
 	case protocol.Request_QUERY:
 		go self.handleQuery(request, conn)
+	case protocol.Request_SHARD_CHECKSUMS:
+		go self.handleShardChecksums(request, conn)
+	case protocol.Request_COPY_SHARD_RANGE:
+		go self.handleCopyShardRange(request, conn)
+	case protocol.Request_BACKUP_SHARDS:
+		go self.handleBackupShards(request, conn)
+	case protocol.Request_SHARD_SIZES:
+		go self.handleShardSizes(request, conn)
+	case protocol.Request_DROP_ORPHANED_SHARD:
+		go self.handleDropOrphanedShard(request, conn)
+	case protocol.Request_WRITES_SINCE:
+		go self.handleWritesSince(request, conn)
 	case protocol.Request_HEARTBEAT:
-		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse}
+		info := self.clusterConfig.LocalServerInfo()
+		response := &protocol.Response{
+			RequestId:       request.Id,
+			Type:            &heartbeatResponse,
+			DownServerIds:   self.clusterConfig.DownServerIds(),
+			BuildVersion:    &info.BuildVersion,
+			ProtocolVersion: &info.ProtocolVersion,
+			DiskFree:        &info.DiskFree,
+		}
 		return self.WriteResponse(conn, response)
 	default:
 		log.Error("unknown request type: %v", request)
@@ -73,13 +96,7 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 		return
 	}
 	query := queries[0]
-	var user common.User
-	if *request.IsDbUser {
-		user = self.clusterConfig.GetDbUser(*request.Database, *request.UserName)
-	} else {
-		user = self.clusterConfig.GetClusterAdmin(*request.UserName)
-	}
-
+	user := self.getUser(request)
 	if user == nil {
 		errorMsg := fmt.Sprintf("Cannot find user %s", *request.UserName)
 		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
@@ -90,6 +107,11 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 
 	querySpec := parser.NewQuerySpec(user, *request.Database, query)
+	querySpec.QuorumRead = request.GetQuorumRead()
+	querySpec.PartialAggregation = request.GetPartialAggregation()
+	querySpec.TraceId = request.GetTraceId()
+	querySpec.ParentSpanId = request.GetParentSpanId()
+	log.Debug("Query trace %s: querying shard %d for %s", querySpec.TraceId, request.GetShardId(), query.GetQueryString())
 
 	responseChan := make(chan *protocol.Response)
 	if querySpec.IsDestructiveQuery() {
@@ -107,6 +129,174 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	}
 }
 
+func (self *ProtobufRequestHandler) handleLeasedWrite(request *protocol.Request, conn net.Conn) {
+	consistency, err := cluster.ParseWriteConsistency(request.GetWriteConsistency())
+	if err == nil {
+		err = self.coordinator.WriteToLeasedShard(request.GetDatabase(), request.GetShardId(), request.MultiSeries, consistency, request.GetIdempotencyKey())
+	}
+	var errorMsg *string
+	if err != nil {
+		log.Error("ProtobufRequestHandler: error writing to leased shard: %s", err)
+		errorMsg = protocol.String(err.Error())
+	}
+	response := &protocol.Response{RequestId: request.Id, Type: &self.writeOk, ErrorMessage: errorMsg}
+	if err := self.WriteResponse(conn, response); err != nil {
+		log.Error("ProtobufRequestHandler: error writing response: %s", err)
+	}
+}
+
+func (self *ProtobufRequestHandler) handleShardChecksums(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil {
+		errorMsg := fmt.Sprintf("Cannot find user %s", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
+	start, end := shard.StartMicro(), shard.EndMicro()
+	if request.ChecksumStartTime != nil {
+		start = request.GetChecksumStartTime()
+	}
+	if request.ChecksumEndTime != nil {
+		end = request.GetChecksumEndTime()
+	}
+	checksums, err := shard.LocalChecksumsInRange(*request.Database, user, int(request.GetChecksumRanges()), start, end)
+	response := &protocol.Response{
+		Type:               &endStreamResponse,
+		RequestId:          request.Id,
+		Checksums:          checksums,
+		AppliedTombstoneId: protocol.Uint32(self.clusterConfig.AppliedTombstoneId()),
+	}
+	if err != nil {
+		log.Error("Error while computing checksums for shard %d: %s", request.GetShardId(), err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleCopyShardRange(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil {
+		errorMsg := fmt.Sprintf("Cannot find user %s", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	err := self.clusterConfig.CopyShardRange(request.GetShardId(), request.GetCopySourceServerId(), *request.Database, user, request.GetCopyStartTime(), request.GetCopyEndTime())
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if err != nil {
+		log.Error("Error while copying shard %d from server %d: %s", request.GetShardId(), request.GetCopySourceServerId(), err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleBackupShards(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil || !user.IsClusterAdmin() {
+		errorMsg := fmt.Sprintf("User %s cannot back up shards", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	err := self.clusterConfig.BackupShards(request.BackupShardIds, request.GetBackupDir())
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if err != nil {
+		log.Error("Error while backing up shards %v: %s", request.BackupShardIds, err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleShardSizes(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil || !user.IsClusterAdmin() {
+		errorMsg := fmt.Sprintf("User %s cannot list the shards", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	sizes, err := self.clusterConfig.ShardSizesOnServer(self.clusterConfig.LocalServer.Id, user)
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if err != nil {
+		log.Error("Error while getting the shard sizes: %s", err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	for id, size := range sizes {
+		response.ShardSizes = append(response.ShardSizes, &protocol.ShardSize{Id: protocol.Uint32(id), Size: protocol.Int64(size)})
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleDropOrphanedShard(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil || !user.IsClusterAdmin() {
+		errorMsg := fmt.Sprintf("User %s cannot drop shards", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	err := self.clusterConfig.DropOrphanedShard(request.GetShardId())
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if err != nil {
+		log.Error("Error while dropping orphaned shard %d: %s", request.GetShardId(), err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleWritesSince(request *protocol.Request, conn net.Conn) {
+	user := self.getUser(request)
+	if user == nil || !user.IsClusterAdmin() {
+		errorMsg := fmt.Sprintf("User %s cannot read the write log of shards", *request.UserName)
+		response := &protocol.Response{Type: &accessDeniedResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+
+	last, err := self.clusterConfig.LocalWritesSince(request.GetShardId(), request.GetSinceWriteSequence(), func(sequence uint64, database string, series []*protocol.Series) error {
+		for _, s := range series {
+			response := &protocol.Response{
+				Type:      &writeLogEntryResponse,
+				RequestId: request.Id,
+				Series:    s,
+				Request:   &protocol.Request{Type: request.Type, Database: &database, SequenceNumber: &sequence},
+			}
+			if err := self.WriteResponse(conn, response); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id, WriteSequence: &last}
+	if err == cluster.ErrWriteLogTruncated {
+		response.WriteLogTruncated = &common.TRUE
+	} else if err != nil {
+		log.Error("Error while reading the write log of shard %d: %s", request.GetShardId(), err)
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) getUser(request *protocol.Request) common.User {
+	if *request.IsDbUser {
+		if user := self.clusterConfig.GetDbUser(*request.Database, *request.UserName); user != nil {
+			return user
+		}
+		return nil
+	}
+	if user := self.clusterConfig.GetClusterAdmin(*request.UserName); user != nil {
+		return user
+	}
+	return nil
+}
+
 func (self *ProtobufRequestHandler) handleDropDatabase(request *protocol.Request, conn net.Conn) {
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 	shard.DropDatabase(*request.Database, false)
@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
@@ -19,6 +20,7 @@ type ProtobufServer struct {
 	requestHandler    RequestHandler
 	connectionMapLock sync.Mutex
 	connectionMap     map[net.Conn]bool
+	tlsConfig         *tls.Config
 }
 
 const KILOBYTE = 1024
@@ -30,6 +32,12 @@ func NewProtobufServer(port string, requestHandler RequestHandler) *ProtobufServ
 	return server
 }
 
+// Makes the server only accept tls connections, has to be called before
+// ListenAndServe
+func (self *ProtobufServer) EnableTls(tlsConfig *tls.Config) {
+	self.tlsConfig = tlsConfig
+}
+
 func (self *ProtobufServer) Close() {
 	self.listener.Close()
 	self.connectionMapLock.Lock()
@@ -58,6 +66,7 @@ func (self *ProtobufServer) ListenAndServe() {
 	if err != nil {
 		panic(err)
 	}
+	ln = clusterListener(ln, self.tlsConfig)
 	self.listener = ln
 	log.Info("ProtobufServer listening on %s", self.port)
 	for {
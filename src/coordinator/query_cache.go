@@ -0,0 +1,215 @@
+package coordinator
+
+import (
+	"container/list"
+	"fmt"
+	"metrics"
+	"parser"
+	"protocol"
+	"sync"
+	"time"
+)
+
+const (
+	// the results with more points than this aren't cached, they'd take
+	// the memory of many dashboard queries
+	QUERY_CACHE_MAX_POINTS = 10000
+)
+
+// An lru cache of the results of the select queries. The results are
+// keyed by the query, the user and the time range of the query rounded
+// down to the freshness, so a dashboard query ending at now() is
+// answered from the cache until the next freshness boundary. Writes to
+// a series drop the results that read it.
+type queryCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	freshness  time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	// incremented on every write to a database, results of queries that
+	// ran while the database was written to aren't cached
+	generations map[string]uint64
+}
+
+type queryCacheEntry struct {
+	key      string
+	database string
+	names    []*parser.TableName
+	series   []*protocol.Series
+	expires  time.Time
+}
+
+func newQueryCache(maxEntries int, freshness time.Duration) *queryCache {
+	return &queryCache{
+		maxEntries:  maxEntries,
+		freshness:   freshness,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		generations: map[string]uint64{},
+	}
+}
+
+// Changes the size and the freshness of the cache, the entries over the
+// new size are dropped
+func (self *queryCache) setLimits(maxEntries int, freshness time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maxEntries = maxEntries
+	self.freshness = freshness
+	for self.lru.Len() > self.maxEntries {
+		self.remove(self.lru.Back())
+	}
+}
+
+func (self *queryCache) limits() (int, time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.maxEntries, self.freshness
+}
+
+// Returns true if the results of the query can be cached
+func (self *queryCache) cacheable(querySpec *parser.QuerySpec) bool {
+	maxEntries, _ := self.limits()
+	return maxEntries > 0 && querySpec.SelectQuery() != nil && !querySpec.IsExplainQuery() && !querySpec.QuorumRead
+}
+
+func (self *queryCache) key(querySpec *parser.QuerySpec) string {
+	user := querySpec.User()
+	_, freshness := self.limits()
+	start := querySpec.GetStartTime().Truncate(freshness)
+	end := querySpec.GetEndTime().Truncate(freshness)
+	return fmt.Sprintf("%s\x00%s\x00%v\x00%d\x00%d\x00%s", querySpec.Database(), user.GetName(), user.IsClusterAdmin(),
+		start.UnixNano(), end.UnixNano(), querySpec.GetQueryString())
+}
+
+// Returns the cached results of the query and the generation of its
+// database, the results are nil if they aren't cached
+func (self *queryCache) get(querySpec *parser.QuerySpec) ([]*protocol.Series, uint64) {
+	key := self.key(querySpec)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	generation := self.generations[querySpec.Database()]
+	element, ok := self.entries[key]
+	if !ok {
+		return nil, generation
+	}
+	entry := element.Value.(*queryCacheEntry)
+	if time.Now().After(entry.expires) {
+		self.remove(element)
+		return nil, generation
+	}
+	self.lru.MoveToFront(element)
+	return entry.series, generation
+}
+
+// Caches the results of the query, unless its database was written to
+// since the given generation
+func (self *queryCache) put(querySpec *parser.QuerySpec, generation uint64, series []*protocol.Series) {
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	if points > QUERY_CACHE_MAX_POINTS {
+		return
+	}
+
+	key := self.key(querySpec)
+	database := querySpec.Database()
+	names := querySpec.GetFromClause().Names
+	if regex := querySpec.GetFromClause().Regex; regex != nil {
+		// new series matching the regex change the results too
+		names = []*parser.TableName{&parser.TableName{Name: regex}}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.generations[database] != generation {
+		return
+	}
+	if element, ok := self.entries[key]; ok {
+		self.remove(element)
+	}
+	self.entries[key] = self.lru.PushFront(&queryCacheEntry{
+		key:      key,
+		database: database,
+		names:    names,
+		series:   series,
+		expires:  time.Now().Add(self.freshness),
+	})
+	for self.lru.Len() > self.maxEntries {
+		self.remove(self.lru.Back())
+	}
+}
+
+// Drops the cached results of the queries that read the given series
+func (self *queryCache) invalidate(database string, series []*protocol.Series) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.generations[database]++
+	for key, element := range self.entries {
+		entry := element.Value.(*queryCacheEntry)
+		if entry.database != database || !entry.readsAny(series) {
+			continue
+		}
+		delete(self.entries, key)
+		self.lru.Remove(element)
+	}
+}
+
+func (self *queryCache) remove(element *list.Element) {
+	delete(self.entries, element.Value.(*queryCacheEntry).key)
+	self.lru.Remove(element)
+}
+
+func (self *queryCacheEntry) readsAny(series []*protocol.Series) bool {
+	for _, s := range series {
+		for _, name := range self.names {
+			if regex, ok := name.Name.GetCompiledRegex(); ok {
+				if regex.MatchString(s.GetName()) {
+					return true
+				}
+			} else if name.Name.Name == s.GetName() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Forwards the series to the writer and keeps them to be cached
+type cachingSeriesWriter struct {
+	SeriesWriter
+	series []*protocol.Series
+}
+
+func (self *cachingSeriesWriter) Write(series *protocol.Series) error {
+	self.series = append(self.series, series)
+	return self.SeriesWriter.Write(series)
+}
+
+// Answers the query from the cache if its results are fresh, otherwise
+// runs it and caches the results
+func (self *CoordinatorImpl) runCachedQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	cached, generation := self.queryCache.get(querySpec)
+	if cached != nil {
+		metrics.Default.Counter("query_cache.hits").Inc()
+		for _, series := range cached {
+			if err := seriesWriter.Write(series); err != nil {
+				return err
+			}
+		}
+		seriesWriter.Close()
+		return nil
+	}
+
+	metrics.Default.Counter("query_cache.misses").Inc()
+	writer := &cachingSeriesWriter{SeriesWriter: seriesWriter}
+	if err := self.runQuerySpec(querySpec, writer); err != nil {
+		return err
+	}
+	if writer.series == nil {
+		writer.series = []*protocol.Series{}
+	}
+	self.queryCache.put(querySpec, generation, writer.series)
+	return nil
+}
@@ -0,0 +1,119 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"engine"
+	"fmt"
+	"parser"
+	"protocol"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns the "query plan" series explain queries return before their
+// stats, one point for every series a shard reads. The points tell the
+// time range of the keys the shard scans, the columns and number of
+// points it reads, whether it matches a regex against its own series
+// and the stages that run on the shard and on this server.
+func queryPlan(querySpec *parser.QuerySpec, shards []*cluster.ShardData, processor cluster.QueryProcessor) *protocol.Series {
+	timestamp := time.Now().UnixNano() / int64(time.Microsecond)
+	coordinatorStages := "none"
+	if staged, ok := processor.(engine.StagedQueryProcessor); ok {
+		coordinatorStages = strings.Join(staged.Stages(), ", ")
+	}
+
+	seriesAndColumns := querySpec.SeriesValuesAndColumns()
+	series := make([]*parser.Value, 0, len(seriesAndColumns))
+	for value := range seriesAndColumns {
+		series = append(series, value)
+	}
+	sort.Sort(valuesByName(series))
+
+	pointLimit := int64(querySpec.PointLimit())
+	points := []*protocol.Point{}
+	for _, shard := range shards {
+		shardId := int64(shard.Id())
+		servers := make([]string, 0, len(shard.ServerIds()))
+		for _, id := range shard.ServerIds() {
+			servers = append(servers, fmt.Sprintf("%d", id))
+		}
+		local := shard.IsLocal
+		startTime := shard.StartMicro()
+		if queryStart := common.TimeToMicroseconds(querySpec.GetStartTime()); queryStart > startTime {
+			startTime = queryStart
+		}
+		endTime := shard.EndMicro()
+		if queryEnd := common.TimeToMicroseconds(querySpec.GetEndTime()); queryEnd < endTime {
+			endTime = queryEnd
+		}
+		shardStages := strings.Join(shardStages(shard, querySpec), ", ")
+
+		for _, value := range series {
+			_, isRegex := value.GetCompiledRegex()
+			columns := strings.Join(seriesAndColumns[value], ", ")
+			points = append(points, &protocol.Point{
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{Int64Value: protocol.Int64(shardId)},
+					&protocol.FieldValue{StringValue: protocol.String(strings.Join(servers, ","))},
+					&protocol.FieldValue{BoolValue: &local},
+					&protocol.FieldValue{StringValue: protocol.String(value.GetString())},
+					&protocol.FieldValue{BoolValue: &isRegex},
+					&protocol.FieldValue{StringValue: &columns},
+					&protocol.FieldValue{Int64Value: protocol.Int64(startTime)},
+					&protocol.FieldValue{Int64Value: protocol.Int64(endTime)},
+					&protocol.FieldValue{Int64Value: &pointLimit},
+					&protocol.FieldValue{StringValue: &shardStages},
+					&protocol.FieldValue{StringValue: &coordinatorStages},
+				},
+				Timestamp: &timestamp,
+			})
+		}
+	}
+
+	return &protocol.Series{
+		Name: protocol.String("query plan"),
+		Fields: []string{"shard_id", "servers", "local", "series", "regex", "columns", "start_time", "end_time",
+			"point_limit", "shard_stages", "coordinator_stages"},
+		Points: points,
+	}
+}
+
+// Returns the stages of the processor the shard runs the query with,
+// see ShardData.Query
+func shardStages(shard *cluster.ShardData, querySpec *parser.QuerySpec) []string {
+	query := querySpec.SelectQuery().WithoutOffset()
+	stages := []string{}
+	// joins filter the points once they're joined on the coordinator
+	if query.GetWhereCondition() != nil && query.GetFromClause().Type != parser.FromClauseInnerJoin {
+		stages = append(stages, "where")
+	}
+
+	var processor engine.StagedQueryProcessor
+	switch {
+	case querySpec.PartialAggregation:
+		queryEngine, err := engine.NewPartialQueryEngine(query, nil)
+		if err != nil {
+			return append(stages, err.Error())
+		}
+		processor = queryEngine
+	case shard.ShouldAggregateLocally(querySpec):
+		queryEngine, err := engine.NewQueryEngine(query, nil)
+		if err != nil {
+			return append(stages, err.Error())
+		}
+		processor = queryEngine
+	case query.HasAggregates():
+		processor = engine.NewPassthroughEngine(nil, 0)
+	default:
+		processor = engine.NewPassthroughEngineWithLimit(nil, 0, query.Limit)
+	}
+	return append(stages, processor.Stages()...)
+}
+
+type valuesByName []*parser.Value
+
+func (self valuesByName) Len() int           { return len(self) }
+func (self valuesByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self valuesByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,176 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"fmt"
+	"math/rand"
+	"parser"
+	"protocol"
+	"sync"
+	"time"
+)
+
+// Every query gets a trace id that's sent along with the requests to the
+// other servers. The servers return a span for every shard they query
+// with the end of the stream and the spans are put together in a
+// "query trace" series that explain queries return after their stats.
+// The coordinator adds the spans of the stages it runs itself, they and
+// the spans of the shards are under the span of the whole query.
+type queryTrace struct {
+	id        string
+	spanId    uint64
+	spans     []*protocol.TraceSpan
+	spansLock sync.Mutex
+}
+
+func newTraceId() string {
+	return fmt.Sprintf("%016x", uint64(rand.Int63()))
+}
+
+func newSpanId() uint64 {
+	return uint64(rand.Int63())
+}
+
+// Returns the span of a stage of the coordinator that started at start,
+// the spans of the stages don't have a shard or points
+func stageSpan(stage string, serverId uint32, parentId uint64, start time.Time, duration time.Duration) *protocol.TraceSpan {
+	span := &protocol.TraceSpan{
+		ServerId:   protocol.Uint32(serverId),
+		ShardId:    protocol.Uint32(0),
+		StartTime:  protocol.Int64(common.TimeToMicroseconds(start)),
+		Duration:   protocol.Int64(int64(duration / time.Microsecond)),
+		PointsRead: protocol.Int64(0),
+		Stage:      protocol.String(stage),
+	}
+	spanId := newSpanId()
+	span.SpanId = &spanId
+	if parentId != 0 {
+		span.ParentId = &parentId
+	}
+	return span
+}
+
+// the servers that don't send the stage of their spans only send the
+// ones of their shards
+func isShardSpan(span *protocol.TraceSpan) bool {
+	return span.Stage == nil || span.GetStage() == cluster.TRACE_STAGE_SHARD_SCAN
+}
+
+func (self *queryTrace) addSpans(spans []*protocol.TraceSpan) {
+	self.spansLock.Lock()
+	defer self.spansLock.Unlock()
+	self.spans = append(self.spans, spans...)
+}
+
+// returns the spans as a series, one point per span at the time the
+// shard started being queried
+func (self *queryTrace) series() *protocol.Series {
+	self.spansLock.Lock()
+	defer self.spansLock.Unlock()
+	points := make([]*protocol.Point, 0, len(self.spans))
+	for _, span := range self.spans {
+		serverId := int64(span.GetServerId())
+		shardId := int64(span.GetShardId())
+		runTime := float64(span.GetDuration())
+		pointsRead := span.GetPointsRead()
+		stage := cluster.TRACE_STAGE_SHARD_SCAN
+		if span.Stage != nil {
+			stage = span.GetStage()
+		}
+		spanId := int64(span.GetSpanId())
+		parentId := int64(span.GetParentId())
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: &self.id},
+				&protocol.FieldValue{Int64Value: &serverId},
+				&protocol.FieldValue{Int64Value: &shardId},
+				&protocol.FieldValue{DoubleValue: &runTime},
+				&protocol.FieldValue{Int64Value: &pointsRead},
+				&protocol.FieldValue{StringValue: &stage},
+				&protocol.FieldValue{Int64Value: &spanId},
+				&protocol.FieldValue{Int64Value: &parentId},
+			},
+			Timestamp: span.StartTime,
+		})
+	}
+	return &protocol.Series{
+		Name:   protocol.String("query trace"),
+		Fields: []string{"trace_id", "server_id", "shard_id", "run_time", "points_read", "stage", "span_id", "parent_id"},
+		Points: points,
+	}
+}
+
+// The trace of a query that ran, with the spans of its stages and of the
+// shards it read. The caller adds the stages that come after the query,
+// e.g. the serialization of its results.
+type QueryTrace struct {
+	trace    *queryTrace
+	serverId uint32
+}
+
+// Returns an empty trace of the given server
+func NewQueryTrace(serverId uint32) *QueryTrace {
+	return &QueryTrace{&queryTrace{id: newTraceId(), spanId: newSpanId()}, serverId}
+}
+
+func (self *QueryTrace) AddStage(stage string, start time.Time, duration time.Duration) {
+	self.trace.addSpans([]*protocol.TraceSpan{stageSpan(stage, self.serverId, self.trace.spanId, start, duration)})
+}
+
+// Returns the spans as a query trace series, in the order they ended
+func (self *QueryTrace) Series() *protocol.Series {
+	return self.trace.series()
+}
+
+// Adds the spans of a stage of the query the spec is part of
+func (self *CoordinatorImpl) traceStage(querySpec *parser.QuerySpec, stage string, start time.Time, duration time.Duration) {
+	span := stageSpan(stage, self.localServerId(), querySpec.ParentSpanId, start, duration)
+	self.runningQueries.addSpans(querySpec.TraceId, []*protocol.TraceSpan{span})
+}
+
+func (self *CoordinatorImpl) localServerId() uint32 {
+	if self.clusterConfiguration == nil || self.clusterConfiguration.LocalServer == nil {
+		return 0
+	}
+	return self.clusterConfiguration.LocalServer.Id
+}
+
+// Counts the time the processor it wraps takes to aggregate the points
+// of the shards
+type timedProcessor struct {
+	cluster.QueryProcessor
+	duration time.Duration
+}
+
+func (self *timedProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	defer self.add(time.Now())
+	return self.QueryProcessor.YieldPoint(seriesName, columnNames, point)
+}
+
+func (self *timedProcessor) YieldSeries(seriesIncoming *protocol.Series) bool {
+	defer self.add(time.Now())
+	return self.QueryProcessor.YieldSeries(seriesIncoming)
+}
+
+func (self *timedProcessor) Close() {
+	defer self.add(time.Now())
+	self.QueryProcessor.Close()
+}
+
+func (self *timedProcessor) add(start time.Time) {
+	self.duration += time.Since(start)
+}
+
+// Writes the trace to the wrapped writer right before closing it
+type traceSeriesWriter struct {
+	SeriesWriter
+	trace *queryTrace
+}
+
+func (self *traceSeriesWriter) Close() {
+	if series := self.trace.series(); len(series.Points) > 0 {
+		self.SeriesWriter.Write(series)
+	}
+	self.SeriesWriter.Close()
+}
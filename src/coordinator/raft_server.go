@@ -5,6 +5,7 @@ import (
 	"cluster"
 	"common"
 	"configuration"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -30,6 +31,14 @@ const (
 	DEFAULT_ROOT_PWD        = "root"
 	DEFAULT_ROOT_PWD_ENVKEY = "INFLUXDB_INIT_PWD"
 	RAFT_NAME_SIZE          = 8
+
+	// how often observers pull the cluster config from a seed server
+	OBSERVER_SYNC_INTERVAL = time.Second
+
+	DEFAULT_RETENTION_SWEEP_PERIOD = 10 * time.Minute
+
+	// the number of group by intervals a backfill queries at once
+	CONTINUOUS_QUERY_BACKFILL_INTERVALS = 1000
 )
 
 // The raftd server is a combination of the Raft server and an HTTP
@@ -49,6 +58,9 @@ type RaftServer struct {
 	notLeader                chan bool
 	coordinator              *CoordinatorImpl
 	processContinuousQueries bool
+	tlsConfig                *tls.Config
+	client                   *http.Client
+	rollups                  []*rollup
 }
 
 var registeredCommands bool
@@ -69,6 +81,7 @@ func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.C
 		notLeader:     make(chan bool, 1),
 		router:        mux.NewRouter(),
 		config:        config,
+		client:        http.DefaultClient,
 	}
 	// Read existing name or generate a new one.
 	if b, err := ioutil.ReadFile(filepath.Join(s.path, "name")); err == nil {
@@ -114,6 +127,11 @@ func (s *RaftServer) GetRaftName() string {
 	return s.name
 }
 
+// Returns the raft name of the current leader, empty if there's none
+func (s *RaftServer) LeaderName() string {
+	return s.raftServer.Leader()
+}
+
 func (s *RaftServer) leaderConnectString() (string, bool) {
 	leader := s.raftServer.Leader()
 	peers := s.raftServer.Peers()
@@ -142,6 +160,10 @@ func (s *RaftServer) doOrProxyCommand(command raft.Command) (interface{}, error)
 
 func (s *RaftServer) doOrProxyCommandOnce(command raft.Command) (interface{}, error) {
 
+	if s.config.Observer {
+		return s.sendCommandToSeed(command)
+	}
+
 	if s.raftServer.State() == raft.Leader {
 		value, err := s.raftServer.Do(command)
 		if err != nil {
@@ -152,18 +174,40 @@ func (s *RaftServer) doOrProxyCommandOnce(command raft.Command) (interface{}, er
 		if leader, ok := s.leaderConnectString(); !ok {
 			return nil, errors.New("Couldn't connect to the cluster leader...")
 		} else {
-			return SendCommandToServer(leader, command)
+			return s.sendCommandToServer(leader, command)
 		}
 	}
 	return nil, nil
 }
 
-func SendCommandToServer(url string, command raft.Command) (interface{}, error) {
+// Observers don't know who the leader is, the command is sent to one of
+// the seeds which proxies it to the leader
+func (s *RaftServer) sendCommandToSeed(command raft.Command) (interface{}, error) {
+	err := errors.New("There are no seed servers to send the command to")
+	for _, seed := range s.config.SeedServers {
+		var value interface{}
+		value, err = s.sendCommandToServer(s.seedUrl(seed), command)
+		if err == nil {
+			return value, nil
+		}
+		log.Warn("Cannot send command %s to seed %s: %s", command.CommandName(), seed, err)
+	}
+	return nil, err
+}
+
+func (s *RaftServer) seedUrl(seed string) string {
+	if !strings.Contains(seed, "://") {
+		return s.config.RaftScheme() + "://" + seed
+	}
+	return seed
+}
+
+func (s *RaftServer) sendCommandToServer(url string, command raft.Command) (interface{}, error) {
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(command); err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
+	resp, err := s.client.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +236,30 @@ func (s *RaftServer) DropDatabase(name string) error {
 	return err
 }
 
+func (s *RaftServer) SetWriteConsistency(db, consistency string) error {
+	command := NewSetWriteConsistencyCommand(db, consistency)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetDatabaseRetention(db, retention string) error {
+	command := NewSetDatabaseRetentionCommand(db, retention)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetReadOnly(db string, readOnly bool) error {
+	command := NewSetReadOnlyCommand(db, readOnly)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetMaxSeries(db string, maxSeries int) error {
+	command := NewSetMaxSeriesCommand(db, maxSeries)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
 func (s *RaftServer) SaveDbUser(u *cluster.DbUser) error {
 	command := NewSaveDbUserCommand(u)
 	_, err := s.doOrProxyCommand(command)
@@ -266,6 +334,57 @@ func (s *RaftServer) CreateContinuousQuery(db string, query string) error {
 	return err
 }
 
+// Runs the continuous query over the group by intervals between start
+// and end in the background. The intervals after the last run of the
+// continuous queries are left to the next run.
+func (s *RaftServer) BackfillContinuousQuery(db string, id uint32, start, end time.Time) error {
+	query := s.clusterConfig.ParsedContinuousQueries[db][id]
+	if query == nil {
+		return fmt.Errorf("Continuous query %d doesn't exist in %s", id, db)
+	}
+	duration, err := query.GetGroupByClause().GetGroupByTime()
+	if err != nil {
+		return fmt.Errorf("Couldn't get group by time for continuous query: %s", err)
+	}
+	if duration == nil {
+		return fmt.Errorf("Only the continuous queries with a group by time can be backfilled")
+	}
+	if lastRun := s.clusterConfig.LastContinuousQueryRunTime(); !lastRun.IsZero() && end.After(lastRun) {
+		end = lastRun
+	}
+	windows := continuousQueryBackfillWindows(start, end, *duration)
+	if len(windows) == 0 {
+		return fmt.Errorf("There are no group by intervals between %s and %s", start, end)
+	}
+
+	go func() {
+		log.Info("Backfilling continuous query %d of %s from %s to %s", id, db, windows[0][0], windows[len(windows)-1][1])
+		for _, window := range windows {
+			s.runContinuousQuery(db, query, window[0], window[1])
+		}
+		log.Info("Backfilled continuous query %d of %s", id, db)
+	}()
+	return nil
+}
+
+// Splits the time between start and end, aligned to the group by
+// interval, in windows of CONTINUOUS_QUERY_BACKFILL_INTERVALS intervals
+// so the backfill doesn't query the whole range at once
+func continuousQueryBackfillWindows(start, end time.Time, interval time.Duration) [][2]time.Time {
+	start = start.Truncate(interval)
+	end = end.Truncate(interval)
+	windows := [][2]time.Time{}
+	for start.Before(end) {
+		windowEnd := start.Add(CONTINUOUS_QUERY_BACKFILL_INTERVALS * interval)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		windows = append(windows, [2]time.Time{start, windowEnd})
+		start = windowEnd
+	}
+	return windows
+}
+
 func (s *RaftServer) DeleteContinuousQuery(db string, id uint32) error {
 	command := NewDeleteContinuousQueryCommand(db, id)
 	_, err := s.doOrProxyCommand(command)
@@ -279,9 +398,9 @@ func (s *RaftServer) ChangeConnectionString(raftName, protobufConnectionString,
 		ConnectionString:         raftConnectionString,
 		ProtobufConnectionString: protobufConnectionString,
 	}
-	for _, s := range s.raftServer.Peers() {
+	for _, peer := range s.raftServer.Peers() {
 		// send the command and ignore errors in case a server is down
-		SendCommandToServer(s.ConnectionString, command)
+		s.sendCommandToServer(peer.ConnectionString, command)
 	}
 
 	// make the change permament
@@ -297,7 +416,11 @@ func (s *RaftServer) AssignCoordinator(coordinator *CoordinatorImpl) error {
 }
 
 const (
-	MAX_SIZE = 10 * MEGABYTE
+	// while stepping down the leader uses an election timeout this many
+	// times longer than usual, the server taking over one that's
+	// CAMPAIGN_TIMEOUT_DIVISOR times shorter
+	STEP_DOWN_TIMEOUT_FACTOR = 5
+	CAMPAIGN_TIMEOUT_DIVISOR = 10
 )
 
 func (s *RaftServer) ForceLogCompaction() error {
@@ -311,7 +434,7 @@ func (s *RaftServer) ForceLogCompaction() error {
 
 func (s *RaftServer) CompactLog() {
 	checkSizeTicker := time.Tick(time.Minute)
-	forceCompactionTicker := time.Tick(time.Hour * 24)
+	forceCompactionTicker := time.Tick(s.config.RaftLogCompactionInterval)
 
 	for {
 		select {
@@ -323,7 +446,7 @@ func (s *RaftServer) CompactLog() {
 			if err != nil {
 				log.Error("Error getting size of file '%s': %s", path, err)
 			}
-			if size < MAX_SIZE {
+			if size < s.config.RaftLogCompactionSize {
 				continue
 			}
 			s.ForceLogCompaction()
@@ -354,12 +477,19 @@ func (s *RaftServer) startRaft() error {
 
 	// Initialize and start Raft server.
 	transporter := raft.NewHTTPTransporter("/raft")
+	transporter.Transport.TLSClientConfig = s.tlsConfig
 	var err error
 	s.raftServer, err = raft.NewServer(s.name, s.path, transporter, s.clusterConfig, s.clusterConfig, "")
 	if err != nil {
 		return err
 	}
 
+	// observers never start the raft server, if they did they'd elect
+	// themselves leader of a cluster of one
+	if s.config.Observer {
+		return s.startObserver()
+	}
+
 	s.raftServer.SetElectionTimeout(s.config.RaftTimeout.Duration)
 	s.raftServer.LoadSnapshot() // ignore errors
 
@@ -384,6 +514,7 @@ func (s *RaftServer) startRaft() error {
 			Name:                     name,
 			ConnectionString:         s.config.RaftConnectionString(),
 			ProtobufConnectionString: s.config.ProtobufConnectionString(),
+			FailureDomain:            s.config.FailureDomain,
 		})
 
 		if err != nil {
@@ -410,6 +541,59 @@ func (s *RaftServer) startRaft() error {
 	return nil
 }
 
+func (s *RaftServer) startObserver() error {
+	if len(s.config.SeedServers) == 0 {
+		return errors.New("Observers need at least one seed server")
+	}
+
+	// joining is idempotent, so restarted observers just join again
+	command := &InfluxJoinObserverCommand{
+		Name:                     s.raftServer.Name(),
+		ConnectionString:         s.config.RaftConnectionString(),
+		ProtobufConnectionString: s.config.ProtobufConnectionString(),
+		FailureDomain:            s.config.FailureDomain,
+	}
+	for {
+		if _, err := s.sendCommandToSeed(command); err == nil {
+			log.Info("(raft:%s) Joined the cluster as an observer", s.raftServer.Name())
+			go s.syncObserver()
+			return nil
+		}
+
+		log.Warn("Couldn't join any of the seeds as an observer, sleeping and retrying...")
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *RaftServer) syncObserver() {
+	for !s.closing {
+		for _, seed := range s.config.SeedServers {
+			err := s.syncFromSeed(s.seedUrl(seed))
+			if err == nil {
+				break
+			}
+			log.Warn("Cannot get the cluster config from seed %s: %s", seed, err)
+		}
+		time.Sleep(OBSERVER_SYNC_INTERVAL)
+	}
+}
+
+func (s *RaftServer) syncFromSeed(url string) error {
+	resp, err := s.client.Get(url + "/cluster_snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+	return s.clusterConfig.SyncFromSnapshot(body)
+}
+
 func (s *RaftServer) raftEventHandler(e raft.Event) {
 	if e.Value() == "leader" {
 		log.Info("(raft:%s) Selected as leader. Starting leader loop.", s.raftServer.Name())
@@ -423,12 +607,24 @@ func (s *RaftServer) raftEventHandler(e raft.Event) {
 }
 
 func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
+	retentionPeriod := s.config.RetentionSweepPeriod
+	if retentionPeriod <= 0 {
+		retentionPeriod = DEFAULT_RETENTION_SWEEP_PERIOD
+	}
+	retentionTimer := time.NewTicker(retentionPeriod)
+	defer retentionTimer.Stop()
+
 	for {
 		select {
 		case <-loopTimer.C:
 			log.Debug("(raft:%s) Executing leader loop.", s.raftServer.Name())
 			s.checkContinuousQueries()
 			break
+		case <-retentionTimer.C:
+			// roll up first, the rollups of shards that are about to
+			// expire are written before the shards are dropped
+			s.rollUpShards()
+			s.dropExpiredShards()
 		case <-s.notLeader:
 			log.Debug("(raft:%s) Exiting leader loop.", s.raftServer.Name())
 			return
@@ -436,6 +632,19 @@ func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
 	}
 }
 
+// Drops the shards that are past their retention from all their
+// replicas. The drop goes through raft, so the shard disappears from
+// the cluster config of every server at the same log index and each
+// replica deletes its copy when it applies the command.
+func (s *RaftServer) dropExpiredShards() {
+	for _, shard := range s.clusterConfig.ExpiredShards(time.Now()) {
+		log.Info("Dropping shard %d, it ended at %s which is past the retention", shard.Id(), shard.EndTime())
+		if err := s.DropShard(shard.Id(), shard.ServerIds()); err != nil {
+			log.Error("Cannot drop expired shard %d: %s", shard.Id(), err)
+		}
+	}
+}
+
 func (s *RaftServer) StartProcessingContinuousQueries() {
 	s.processContinuousQueries = true
 }
@@ -504,7 +713,14 @@ func (s *RaftServer) ListenAndServe() error {
 	if err != nil {
 		panic(err)
 	}
-	return s.Serve(l)
+	return s.Serve(clusterListener(l, s.tlsConfig))
+}
+
+// Makes the raft server talk to the other servers over tls, has to be
+// called before ListenAndServe
+func (s *RaftServer) EnableTls(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+	s.client = clusterHttpClient(tlsConfig)
 }
 
 func (s *RaftServer) Serve(l net.Listener) error {
@@ -520,6 +736,9 @@ func (s *RaftServer) Serve(l net.Listener) error {
 	s.router.HandleFunc("/cluster_config", s.configHandler).Methods("GET")
 	s.router.HandleFunc("/join", s.joinHandler).Methods("POST")
 	s.router.HandleFunc("/process_command/{command_type}", s.processCommandHandler).Methods("POST")
+	s.router.HandleFunc("/transfer_leadership", s.transferLeadershipHandler).Methods("POST")
+	s.router.HandleFunc("/campaign", s.campaignHandler).Methods("POST")
+	s.router.HandleFunc("/cluster_snapshot", s.snapshotHandler).Methods("GET")
 
 	log.Info("Raft Server Listening at %s", s.config.RaftListenString())
 
@@ -541,7 +760,9 @@ func (s *RaftServer) Serve(l net.Listener) error {
 func (self *RaftServer) Close() {
 	if !self.closing || self.raftServer == nil {
 		self.closing = true
-		self.raftServer.Stop()
+		if self.raftServer.Running() {
+			self.raftServer.Stop()
+		}
 		self.listener.Close()
 		self.notLeader <- true
 	}
@@ -558,9 +779,9 @@ func (s *RaftServer) RemoveServer(id uint32) error {
 	command := &InfluxForceLeaveCommand{
 		Id: id,
 	}
-	for _, s := range s.raftServer.Peers() {
+	for _, peer := range s.raftServer.Peers() {
 		// send the command and ignore errors in case a server is down
-		SendCommandToServer(s.ConnectionString, command)
+		s.sendCommandToServer(peer.ConnectionString, command)
 	}
 
 	if _, err := command.Apply(s.raftServer); err != nil {
@@ -579,11 +800,9 @@ func (s *RaftServer) Join(leader string) error {
 		Name:                     s.raftServer.Name(),
 		ConnectionString:         s.config.RaftConnectionString(),
 		ProtobufConnectionString: s.config.ProtobufConnectionString(),
+		FailureDomain:            s.config.FailureDomain,
 	}
-	connectUrl := leader
-	if !strings.HasPrefix(connectUrl, "http://") {
-		connectUrl = "http://" + connectUrl
-	}
+	connectUrl := s.seedUrl(leader)
 	if !strings.HasSuffix(connectUrl, "/join") {
 		connectUrl = connectUrl + "/join"
 	}
@@ -593,6 +812,7 @@ func (s *RaftServer) Join(leader string) error {
 	log.Debug("(raft:%s) Posting to seed server %s", s.raftServer.Name(), connectUrl)
 	tr := &http.Transport{
 		ResponseHeaderTimeout: time.Second,
+		TLSClientConfig:       s.tlsConfig,
 	}
 	client := &http.Client{Transport: tr}
 	resp, err := client.Post(connectUrl, "application/json", &b)
@@ -658,6 +878,17 @@ func (s *RaftServer) configHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(js)
 }
 
+// returns the same snapshot the raft log is compacted to, observers
+// apply it to their cluster config
+func (s *RaftServer) snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := s.clusterConfig.Save()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
 func (s *RaftServer) marshalAndDoCommandFromBody(command raft.Command, req *http.Request) (interface{}, error) {
 	if err := json.NewDecoder(req.Body).Decode(&command); err != nil {
 		return nil, err
@@ -670,7 +901,8 @@ func (s *RaftServer) marshalAndDoCommandFromBody(command raft.Command, req *http
 		return c.Apply(s.raftServer)
 	}
 
-	if result, err := s.raftServer.Do(command); err != nil {
+	// commands sent by observers can end up on a follower
+	if result, err := s.doOrProxyCommand(command); err != nil {
 		return nil, err
 	} else {
 		return result, nil
@@ -693,6 +925,114 @@ func (s *RaftServer) processCommandHandler(w http.ResponseWriter, req *http.Requ
 	}
 }
 
+type leadershipTransfer struct {
+	ServerId uint32 `json:"serverId"`
+}
+
+// Makes the server with the given id the raft leader and returns the
+// raft name of the new leader. The target is told to lower its election
+// timeout, then the leader restarts its raft server as a follower with
+// a higher election timeout, so the target is the first one to start an
+// election. If the id is 0 the leader just steps down and any other
+// server can take over.
+func (s *RaftServer) TransferLeadership(serverId uint32) (string, error) {
+	if s.raftServer.State() != raft.Leader {
+		leader, ok := s.leaderConnectString()
+		if !ok {
+			return "", errors.New("Couldn't connect to the cluster leader...")
+		}
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(&leadershipTransfer{serverId}); err != nil {
+			return "", err
+		}
+		resp, err := s.client.Post(leader+"/transfer_leadership", "application/json", &b)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", errors.New(strings.TrimSpace(string(body)))
+		}
+		return string(body), nil
+	}
+
+	timeout := s.config.RaftTimeout.Duration
+	if serverId != 0 {
+		server := s.clusterConfig.GetServerById(&serverId)
+		if server == nil {
+			return "", fmt.Errorf("Cannot find server %d", serverId)
+		}
+		if server.RaftName == s.name {
+			return s.name, nil
+		}
+		peer, ok := s.raftServer.Peers()[server.RaftName]
+		if !ok {
+			return "", fmt.Errorf("Server %d isn't a raft peer", serverId)
+		}
+		if time.Now().Sub(peer.LastActivity()) > timeout {
+			return "", fmt.Errorf("Server %d hasn't responded to the leader in %s", serverId, timeout)
+		}
+		resp, err := s.client.Post(peer.ConnectionString+"/campaign", "application/json", nil)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		// give the target a couple of heartbeats to pick up the new timeout
+		time.Sleep(2 * s.raftServer.HeartbeatInterval())
+	}
+
+	log.Info("(raft:%s) Stepping down as leader", s.name)
+	s.raftServer.SetElectionTimeout(STEP_DOWN_TIMEOUT_FACTOR * timeout)
+	defer s.raftServer.SetElectionTimeout(timeout)
+	s.raftServer.Stop()
+	if err := s.raftServer.Start(); err != nil {
+		return "", err
+	}
+
+	for deadline := time.Now().Add(STEP_DOWN_TIMEOUT_FACTOR * timeout); time.Now().Before(deadline); {
+		if leader := s.raftServer.Leader(); leader != "" && leader != s.name {
+			log.Info("(raft:%s) %s is the new leader", s.name, leader)
+			return leader, nil
+		}
+		time.Sleep(s.raftServer.HeartbeatInterval())
+	}
+	return "", fmt.Errorf("No new leader was elected in %s", STEP_DOWN_TIMEOUT_FACTOR*timeout)
+}
+
+func (s *RaftServer) transferLeadershipHandler(w http.ResponseWriter, req *http.Request) {
+	transfer := &leadershipTransfer{}
+	if err := json.NewDecoder(req.Body).Decode(transfer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.raftServer.State() != raft.Leader {
+		http.Error(w, "Not the leader of the cluster", http.StatusInternalServerError)
+		return
+	}
+	leader, err := s.TransferLeadership(transfer.ServerId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(leader))
+}
+
+// Lowers the election timeout of this server for a while, so it
+// starts an election as soon as the current leader steps down
+func (s *RaftServer) campaignHandler(w http.ResponseWriter, req *http.Request) {
+	timeout := s.config.RaftTimeout.Duration
+	log.Info("(raft:%s) Campaigning to become the leader", s.name)
+	s.raftServer.SetElectionTimeout(timeout / CAMPAIGN_TIMEOUT_DIVISOR)
+	go func() {
+		time.Sleep(STEP_DOWN_TIMEOUT_FACTOR * timeout)
+		s.raftServer.SetElectionTimeout(timeout)
+	}()
+}
+
 func (self *RaftServer) CreateShards(shards []*cluster.NewShardData) ([]*cluster.ShardData, error) {
 	log.Debug("RAFT: CreateShards")
 	command := NewCreateShardsCommand(shards)
@@ -719,3 +1059,69 @@ func (self *RaftServer) DropShard(id uint32, serverIds []uint32) error {
 	_, err := self.doOrProxyCommand(command)
 	return err
 }
+
+func (self *RaftServer) DecommissionServer(id uint32) error {
+	command := NewDecommissionServerCommand(id)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) AddServer(server *cluster.NewServer) error {
+	command := NewAddServerCommand(server)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) SetFailureDomain(serverId uint32, failureDomain string) error {
+	command := NewSetFailureDomainCommand(serverId, failureDomain)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) AcquireShardLease(shardId, serverId uint32, now, expiration time.Time) error {
+	command := NewAcquireShardLeaseCommand(shardId, serverId, now, expiration)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) SetReplicationFactor(replicationFactor int) error {
+	command := NewSetReplicationFactorCommand(replicationFactor)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) SetShardDuration(shardType cluster.ShardType, duration time.Duration) error {
+	command := NewSetShardDurationCommand(shardType, duration)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) SetRuntimeSetting(name, value string) error {
+	command := NewSetRuntimeSettingCommand(name, value)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) CreateReplicationTarget(target *cluster.ReplicationTarget) error {
+	command := NewCreateReplicationTargetCommand(target)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) DropReplicationTarget(name string) error {
+	command := NewDropReplicationTargetCommand(name)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) CreateTombstone(tombstone *cluster.Tombstone) error {
+	command := NewCreateTombstoneCommand(tombstone)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+func (self *RaftServer) AddShardReplica(shardId, serverId uint32) error {
+	command := NewAddShardReplicaCommand(shardId, serverId)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
@@ -0,0 +1,165 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Enforces the rate limits of the config on the writes and the queries
+// of each database and each user. The rates are token buckets that hold
+// up to a period worth of tokens, the limits are read from the config on
+// every request so they can be changed at runtime. A nil rateLimits
+// doesn't limit anything.
+type rateLimits struct {
+	config  *configuration.Configuration
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+	running map[string]int
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A request takes tokens out of the bucket of the limit for the subject,
+// the bucket refills value tokens every period
+type rateCheck struct {
+	limit   string
+	subject string
+	value   int
+	period  time.Duration
+	tokens  int
+}
+
+func (self *rateCheck) rate() float64 {
+	return float64(self.value) / self.period.Seconds()
+}
+
+func newRateLimits(config *configuration.Configuration) *rateLimits {
+	return &rateLimits{
+		config:  config,
+		buckets: make(map[string]*rateBucket),
+		running: make(map[string]int),
+	}
+}
+
+func databaseSubject(db string) string {
+	return "database " + db
+}
+
+// the db users of different databases can have the same name
+func userSubject(user common.User) string {
+	if user.IsClusterAdmin() {
+		return "cluster admin " + user.GetName()
+	}
+	return fmt.Sprintf("user %s of database %s", user.GetName(), user.GetDb())
+}
+
+// Returns a RateLimitError if writing the points to the database would
+// go over the write rate of the database or the user
+func (self *rateLimits) write(user common.User, db string, points int, now time.Time) error {
+	if self == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.take([]*rateCheck{
+		{"database-write-points-per-second", databaseSubject(db), self.config.DatabaseWritePointsPerSecond, time.Second, points},
+		{"user-write-points-per-second", userSubject(user), self.config.UserWritePointsPerSecond, time.Second, points},
+	}, now)
+}
+
+// Returns a RateLimitError if the query would go over the concurrent
+// queries or the query rate of the database or the user, otherwise the
+// query counts as running until the returned function is called
+func (self *rateLimits) startQuery(user common.User, db string, now time.Time) (func(), error) {
+	if self == nil {
+		return func() {}, nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	dbKey, userKey := databaseSubject(db), userSubject(user)
+	// there's no telling when a running query finishes
+	if limit := self.config.DatabaseConcurrentQueries; limit > 0 && self.running[dbKey] >= limit {
+		return nil, common.NewRateLimitError("database-concurrent-queries", limit, dbKey, time.Second)
+	}
+	if limit := self.config.UserConcurrentQueries; limit > 0 && self.running[userKey] >= limit {
+		return nil, common.NewRateLimitError("user-concurrent-queries", limit, userKey, time.Second)
+	}
+	err := self.take([]*rateCheck{
+		{"database-queries-per-minute", dbKey, self.config.DatabaseQueriesPerMinute, time.Minute, 1},
+		{"user-queries-per-minute", userKey, self.config.UserQueriesPerMinute, time.Minute, 1},
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	self.running[dbKey]++
+	self.running[userKey]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			self.finishQuery(dbKey)
+			self.finishQuery(userKey)
+		})
+	}, nil
+}
+
+func (self *rateLimits) finishQuery(subject string) {
+	if self.running[subject]--; self.running[subject] <= 0 {
+		delete(self.running, subject)
+	}
+}
+
+// Takes the tokens of every check or none of them. A request bigger than
+// a bucket goes through once the bucket is full and leaves it below zero,
+// the next requests wait until it's refilled. Returns the error of the
+// check that has to wait the longest. Has to be called with the lock.
+func (self *rateLimits) take(checks []*rateCheck, now time.Time) error {
+	buckets := make([]*rateBucket, len(checks))
+	var exceeded *rateCheck
+	var wait time.Duration
+	for i, check := range checks {
+		if check.value <= 0 {
+			continue
+		}
+		key := check.limit + " " + check.subject
+		bucket := self.buckets[key]
+		if bucket == nil {
+			bucket = &rateBucket{float64(check.value), now}
+			self.buckets[key] = bucket
+		}
+		bucket.tokens += now.Sub(bucket.last).Seconds() * check.rate()
+		if bucket.tokens > float64(check.value) {
+			bucket.tokens = float64(check.value)
+		}
+		bucket.last = now
+		buckets[i] = bucket
+
+		needed := float64(check.tokens)
+		if needed > float64(check.value) {
+			needed = float64(check.value)
+		}
+		if bucket.tokens >= needed {
+			continue
+		}
+		if d := time.Duration((needed - bucket.tokens) / check.rate() * float64(time.Second)); exceeded == nil || d > wait {
+			exceeded, wait = check, d
+		}
+	}
+	if exceeded != nil {
+		return common.NewRateLimitError(exceeded.limit, exceeded.value, exceeded.subject, wait)
+	}
+	for i, bucket := range buckets {
+		if bucket != nil {
+			bucket.tokens -= float64(checks[i].tokens)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+)
+
+func (self *CoordinatorImpl) SetReadOnly(user common.User, db string, readOnly bool) error {
+	if db == "" && !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to make the cluster read-only")
+	}
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return common.NewAuthorizationError("Insufficient permissions to make %s read-only", db)
+	}
+	return self.raftServer.SetReadOnly(db, readOnly)
+}
+
+func (self *CoordinatorImpl) GetReadOnlyStatus(user common.User) (*cluster.ReadOnlyStatus, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the read-only databases")
+	}
+	return self.clusterConfiguration.GetReadOnlyStatus(), nil
+}
+
+// Returns an authorization error if the writes of the database are
+// rejected, the queries of a read-only database still run
+func (self *CoordinatorImpl) checkWritable(db string) error {
+	if !self.clusterConfiguration.IsReadOnly(db) {
+		return nil
+	}
+	if self.clusterConfiguration.GetReadOnlyStatus().ReadOnly {
+		return common.NewAuthorizationError("The cluster is read-only, the writes to %s are rejected", db)
+	}
+	return common.NewAuthorizationError("The database %s is read-only, its writes are rejected", db)
+}
@@ -0,0 +1,53 @@
+package coordinator
+
+import (
+	"parser"
+	"protocol"
+	"sort"
+)
+
+// Collects the names of the series that match a regex, or every name if
+// the regex is nil
+type seriesNamesWriter struct {
+	regex *parser.Value
+	names []string
+}
+
+func (self *seriesNamesWriter) Write(series *protocol.Series) error {
+	if self.regex != nil {
+		if regex, _ := self.regex.GetCompiledRegex(); !regex.MatchString(series.GetName()) {
+			return nil
+		}
+	}
+	self.names = append(self.names, series.GetName())
+	return nil
+}
+
+func (self *seriesNamesWriter) Close() {
+}
+
+// Returns the query spec of a merge or join of a regex with the series
+// that match the regex, the engine has to know all the series it merges
+// before it gets their points
+func (self *CoordinatorImpl) expandRegexTables(querySpec *parser.QuerySpec) (*parser.QuerySpec, error) {
+	queries, err := parser.ParseQuery("list series")
+	if err != nil {
+		return nil, err
+	}
+	fromClause := querySpec.SelectQuery().GetFromClause()
+	writer := &seriesNamesWriter{regex: fromClause.Regex}
+	listSpec := parser.NewQuerySpec(querySpec.User(), querySpec.Database(), queries[0])
+	if err := self.runListSeriesQuery(listSpec, writer); err != nil {
+		return nil, err
+	}
+	sort.Strings(writer.names)
+
+	selectQuery := *querySpec.SelectQuery()
+	selectQuery.FromClause = fromClause.WithTableNames(writer.names)
+	expanded := parser.NewQuerySpec(querySpec.User(), querySpec.Database(), &parser.Query{SelectQuery: &selectQuery})
+	expanded.QuorumRead = querySpec.QuorumRead
+	expanded.TraceId = querySpec.TraceId
+	expanded.ParentSpanId = querySpec.ParentSpanId
+	expanded.Cancelled = querySpec.Cancelled
+	return expanded, nil
+}
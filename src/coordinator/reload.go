@@ -0,0 +1,123 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"sort"
+
+	log "code.google.com/p/log4go"
+)
+
+// The result of a config reload, the settings are the names of the
+// fields of the config that changed in the file. The overridden ones are
+// the runtime settings that were changed for the whole cluster, they
+// keep that value.
+type ConfigReload struct {
+	Applied    []string `json:"applied"`
+	Ignored    []string `json:"ignored"`
+	Overridden []string `json:"overridden"`
+}
+
+// The settings that can be changed at runtime for the whole cluster, see
+// cluster/runtime_settings.go
+var reloadedRuntimeSettings = map[string]bool{
+	"LocalStoreWriteBufferSize":    true,
+	"PerServerWriteBufferSize":     true,
+	"ClusterMaxResponseBufferSize": true,
+	"ConcurrentShardQueryLimit":    true,
+	"ShortTermShard.Retention":     true,
+	"LongTermShard.Retention":      true,
+	"DatabaseWritePointsPerSecond": true,
+	"DatabaseConcurrentQueries":    true,
+	"DatabaseQueriesPerMinute":     true,
+	"UserWritePointsPerSecond":     true,
+	"UserConcurrentQueries":        true,
+	"UserQueriesPerMinute":         true,
+}
+
+// Re-reads the config file of this server and applies the settings that
+// can change while it's running
+func (self *CoordinatorImpl) ReloadConfiguration(user common.User) (*ConfigReload, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to reload the config")
+	}
+	return self.ReloadConfigurationFile()
+}
+
+// Same as ReloadConfiguration, for the SIGHUP of the server
+func (self *CoordinatorImpl) ReloadConfigurationFile() (*ConfigReload, error) {
+	log.Info("Reloading the config file %s", self.config.FileName)
+	reloaded, err := configuration.ParseConfiguration(self.config.FileName)
+	if err != nil {
+		log.Error("Cannot reload the config file %s: %s", self.config.FileName, err)
+		return nil, err
+	}
+	reload := self.applyConfiguration(reloaded)
+	if len(reload.Ignored) > 0 {
+		log.Warn("The changes of %v need a restart", reload.Ignored)
+	}
+	return reload, nil
+}
+
+func (self *CoordinatorImpl) applyConfiguration(reloaded *configuration.Configuration) *ConfigReload {
+	// they can be set on the command line and can't change anyway
+	reloaded.Hostname = self.config.Hostname
+	reloaded.RaftServerPort = self.config.RaftServerPort
+	reloaded.ProtobufPort = self.config.ProtobufPort
+	reloaded.Version = self.config.Version
+	reloaded.InfluxDBVersion = self.config.InfluxDBVersion
+
+	reload := &ConfigReload{Applied: []string{}, Ignored: []string{}, Overridden: []string{}}
+	runtimeSettingsChanged := false
+	for _, name := range self.config.ChangedSettings(reloaded) {
+		// the settings that are read on every request are copied to the
+		// config of the server
+		switch name {
+		case "QueryTimeout":
+			self.config.QueryTimeout = reloaded.QueryTimeout
+		case "MaxReturnedPoints":
+			self.config.MaxReturnedPoints = reloaded.MaxReturnedPoints
+		case "MaxSelectSeries":
+			self.config.MaxSelectSeries = reloaded.MaxSelectSeries
+		case "TimestampBounds", "DatabaseTimestampBounds":
+			self.config.TimestampBounds = reloaded.TimestampBounds
+			self.config.DatabaseTimestampBounds = reloaded.DatabaseTimestampBounds
+		case "QueryCacheMaxEntries", "QueryCacheFreshness":
+			self.config.QueryCacheMaxEntries = reloaded.QueryCacheMaxEntries
+			self.config.QueryCacheFreshness = reloaded.QueryCacheFreshness
+			self.queryCache.setLimits(reloaded.QueryCacheMaxEntries, reloaded.QueryCacheFreshness)
+		case "LogLevel":
+			self.config.LogLevel = reloaded.LogLevel
+			setLogLevel(reloaded.LogLevel)
+		default:
+			if !reloadedRuntimeSettings[name] {
+				reload.Ignored = append(reload.Ignored, name)
+				continue
+			}
+			runtimeSettingsChanged = true
+		}
+		reload.Applied = append(reload.Applied, name)
+	}
+	if runtimeSettingsChanged {
+		reload.Overridden = append(reload.Overridden, self.clusterConfiguration.ReloadFileSettings(reloaded)...)
+	}
+	sort.Strings(reload.Applied)
+	return reload
+}
+
+// Changes the level of the loggers the server started with
+func setLogLevel(logLevel string) {
+	level := log.DEBUG
+	switch logLevel {
+	case "info":
+		level = log.INFO
+	case "warn":
+		level = log.WARNING
+	case "error":
+		level = log.ERROR
+	}
+	for _, filter := range log.Global {
+		filter.Level = level
+	}
+	log.Info("Changed the log level to %s", logLevel)
+}
@@ -0,0 +1,569 @@
+package coordinator
+
+import (
+	"bytes"
+	"cluster"
+	"common"
+	"configuration"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Every server sends the writes accepted by its own api to the
+// replication targets of their database. The writes are appended to an
+// on disk buffer per target first, so a remote cluster that's down or
+// slow doesn't hold up the writes to this cluster. A sender goroutine
+// per target posts the buffered writes to the remote api in order and
+// moves the resume token, the offset of the first write the remote
+// cluster hasn't acknowledged, past them. The token is saved next to
+// the buffer, after a restart the sender resumes from it. Writes are
+// sent with their sequence numbers, so the ones that get sent twice
+// after a crash overwrite the same points.
+
+const (
+	REPLICATION_BUFFER_FILE = "buffer"
+	REPLICATION_TOKEN_FILE  = "token"
+
+	// the maximum size of the buffered writes sent in one go
+	REPLICATION_BATCH_SIZE = 1024 * 1024
+
+	// how often the streams are checked against the replication targets
+	// of the cluster
+	REPLICATION_SYNC_INTERVAL = 10 * time.Second
+
+	// the size of the packets sent to udp targets, the udp input
+	// doesn't read packets that are bigger
+	REPLICATION_UDP_PACKET_SIZE = 2048
+
+	REPLICATION_TIMEOUT     = time.Minute
+	REPLICATION_MIN_BACKOFF = time.Second
+	REPLICATION_MAX_BACKOFF = time.Minute
+)
+
+type ReplicationTargetStatus struct {
+	Name      string   `json:"name"`
+	Url       string   `json:"url"`
+	Databases []string `json:"databases"`
+	Username  string   `json:"username"`
+	// the offset in the buffer of the first write that wasn't
+	// acknowledged by the remote cluster yet
+	ResumeToken   int64  `json:"resumeToken"`
+	BufferedBytes int64  `json:"bufferedBytes"`
+	DroppedWrites int64  `json:"droppedWrites"`
+	LastError     string `json:"lastError,omitempty"`
+}
+
+type Replicator struct {
+	clusterConfiguration *cluster.ClusterConfiguration
+	dir                  string
+	maxBufferSize        int64
+	client               *http.Client
+	throttle             *cluster.Throttle
+	streamsLock          sync.Mutex
+	streams              map[string]*replicationStream
+}
+
+func NewReplicator(config *configuration.Configuration, clusterConfiguration *cluster.ClusterConfiguration) *Replicator {
+	return &Replicator{
+		clusterConfiguration: clusterConfiguration,
+		dir:                  config.ReplicationDir,
+		maxBufferSize:        config.ReplicationMaxBufferSize,
+		client: &http.Client{
+			Transport: &http.Transport{
+				ResponseHeaderTimeout: REPLICATION_TIMEOUT,
+				Dial: func(network, address string) (net.Conn, error) {
+					return net.DialTimeout(network, address, REPLICATION_TIMEOUT)
+				},
+			},
+		},
+		throttle: cluster.NewThrottle(config.ReplicationMaxBandwidth, config.ReplicationMaxRequestRate),
+		streams:  make(map[string]*replicationStream),
+	}
+}
+
+// Starts sending the writes that were buffered before a restart and
+// keeps the streams in line with the replication targets as they get
+// created and dropped
+func (self *Replicator) Start() {
+	go func() {
+		for {
+			self.syncStreams()
+			time.Sleep(REPLICATION_SYNC_INTERVAL)
+		}
+	}()
+}
+
+func (self *Replicator) syncStreams() {
+	targets := self.clusterConfiguration.GetReplicationTargets()
+	names := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		names[target.Name] = true
+		if _, err := self.getStream(target); err != nil {
+			log.Error("Cannot open the replication buffer of %s: %s", target.Name, err)
+		}
+	}
+
+	self.streamsLock.Lock()
+	defer self.streamsLock.Unlock()
+	for name, stream := range self.streams {
+		if names[name] {
+			continue
+		}
+		log.Info("Replication target %s was dropped, deleting its buffer", name)
+		stream.close()
+		if err := os.RemoveAll(stream.dir); err != nil {
+			log.Error("Cannot delete the replication buffer of %s: %s", name, err)
+		}
+		delete(self.streams, name)
+	}
+}
+
+func (self *Replicator) getStream(target *cluster.ReplicationTarget) (*replicationStream, error) {
+	self.streamsLock.Lock()
+	defer self.streamsLock.Unlock()
+	if stream := self.streams[target.Name]; stream != nil {
+		stream.setTarget(target)
+		return stream, nil
+	}
+	stream, err := openReplicationStream(filepath.Join(self.dir, target.Name), target, self.maxBufferSize, self.client)
+	if err != nil {
+		return nil, err
+	}
+	stream.throttle = self.throttle
+	self.streams[target.Name] = stream
+	go stream.run()
+	return stream, nil
+}
+
+// Buffers the series for every replication target of the database.
+// Errors are only logged, the write was already accepted by this
+// cluster.
+func (self *Replicator) Replicate(db string, series []*protocol.Series) {
+	for _, target := range self.clusterConfiguration.GetReplicationTargets() {
+		if !target.Replicates(db) {
+			continue
+		}
+		stream, err := self.getStream(target)
+		if err != nil {
+			log.Error("Cannot replicate write to %s: %s", target.Name, err)
+			continue
+		}
+		if err := stream.append(db, series); err != nil {
+			log.Error("Cannot replicate write to %s: %s", target.Name, err)
+		}
+	}
+}
+
+// Returns the replication targets of the cluster with the state of
+// their stream on this server
+func (self *Replicator) Status() []*ReplicationTargetStatus {
+	statuses := make([]*ReplicationTargetStatus, 0)
+	for _, target := range self.clusterConfiguration.GetReplicationTargets() {
+		status := &ReplicationTargetStatus{
+			Name:      target.Name,
+			Url:       target.Url,
+			Databases: target.Databases,
+			Username:  target.Username,
+		}
+		self.streamsLock.Lock()
+		stream := self.streams[target.Name]
+		self.streamsLock.Unlock()
+		if stream != nil {
+			stream.fillStatus(status)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+type replicationStream struct {
+	dir      string
+	client   *http.Client
+	throttle *cluster.Throttle
+	maxSize  int64
+	lock     sync.Mutex
+	target   *cluster.ReplicationTarget
+	buffer   *os.File
+	size     int64
+	token    int64
+	dropped  int64
+	lastErr  error
+	wake     chan bool
+	closed   chan bool
+}
+
+func openReplicationStream(dir string, target *cluster.ReplicationTarget, maxSize int64, client *http.Client) (*replicationStream, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	buffer, err := os.OpenFile(filepath.Join(dir, REPLICATION_BUFFER_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := buffer.Stat()
+	if err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	token, err := readResumeToken(dir)
+	if err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	stream := &replicationStream{
+		dir:     dir,
+		client:  client,
+		maxSize: maxSize,
+		target:  target,
+		buffer:  buffer,
+		size:    info.Size(),
+		token:   token,
+		wake:    make(chan bool, 1),
+		closed:  make(chan bool),
+	}
+	// the buffer is truncated before the token is reset once everything
+	// was sent, a crash in between leaves the token past the end
+	if stream.token > stream.size {
+		stream.token = stream.size
+	}
+	if err := stream.truncatePartialWrite(); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	if stream.token < stream.size {
+		log.Info("Resuming replication to %s at %d, %d bytes buffered", target.Name, stream.token, stream.size-stream.token)
+	}
+	return stream, nil
+}
+
+func readResumeToken(dir string) (int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, REPLICATION_TOKEN_FILE))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (self *replicationStream) saveResumeToken() error {
+	tmp := filepath.Join(self.dir, REPLICATION_TOKEN_FILE+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(self.token, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(self.dir, REPLICATION_TOKEN_FILE))
+}
+
+// Drops the last write if the server crashed while it was appended
+func (self *replicationStream) truncatePartialWrite() error {
+	offset := self.token
+	header := make([]byte, 4)
+	for offset < self.size {
+		if _, err := self.buffer.ReadAt(header, offset); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		if offset+4+length > self.size {
+			break
+		}
+		offset += 4 + length
+	}
+	if offset == self.size {
+		return nil
+	}
+	log.Warn("Dropping %d bytes of a partial write at the end of the replication buffer of %s", self.size-offset, self.target.Name)
+	self.size = offset
+	return self.buffer.Truncate(offset)
+}
+
+func (self *replicationStream) setTarget(target *cluster.ReplicationTarget) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.target = target
+}
+
+func (self *replicationStream) append(db string, series []*protocol.Series) error {
+	request := &protocol.Request{
+		Type:        &write,
+		Database:    &db,
+		MultiSeries: series,
+	}
+	data, err := request.Encode()
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(entry, uint32(len(data)))
+	copy(entry[4:], data)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.size-self.token+int64(len(entry)) > self.maxSize {
+		self.dropped++
+		return fmt.Errorf("The replication buffer is full, %d bytes haven't been sent yet", self.size-self.token)
+	}
+	if _, err := self.buffer.WriteAt(entry, self.size); err != nil {
+		self.buffer.Truncate(self.size)
+		return err
+	}
+	self.size += int64(len(entry))
+
+	select {
+	case self.wake <- true:
+	default:
+	}
+	return nil
+}
+
+func (self *replicationStream) fillStatus(status *ReplicationTargetStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	status.ResumeToken = self.token
+	status.BufferedBytes = self.size - self.token
+	status.DroppedWrites = self.dropped
+	if self.lastErr != nil {
+		status.LastError = self.lastErr.Error()
+	}
+}
+
+func (self *replicationStream) close() {
+	close(self.closed)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.buffer.Close()
+}
+
+func (self *replicationStream) run() {
+	backoff := REPLICATION_MIN_BACKOFF
+	for {
+		sent, err := self.sendBatch()
+
+		self.lock.Lock()
+		self.lastErr = err
+		name := self.target.Name
+		self.lock.Unlock()
+
+		if err != nil {
+			log.Warn("Cannot replicate to %s, retrying in %s: %s", name, backoff, err)
+			select {
+			case <-self.closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > REPLICATION_MAX_BACKOFF {
+				backoff = REPLICATION_MAX_BACKOFF
+			}
+			continue
+		}
+		backoff = REPLICATION_MIN_BACKOFF
+		if sent {
+			continue
+		}
+
+		select {
+		case <-self.closed:
+			return
+		case <-self.wake:
+		}
+	}
+}
+
+// Sends the buffered writes after the resume token, up to
+// REPLICATION_BATCH_SIZE bytes of them. Returns false if there was
+// nothing to send.
+func (self *replicationStream) sendBatch() (bool, error) {
+	self.lock.Lock()
+	token, size, target := self.token, self.size, self.target
+	self.lock.Unlock()
+	if token == size {
+		return false, nil
+	}
+
+	offset := token
+	header := make([]byte, 4)
+	databases := make([]string, 0)
+	seriesByDb := make(map[string][]*protocol.Series)
+	for offset < size && offset-token < REPLICATION_BATCH_SIZE {
+		if _, err := self.buffer.ReadAt(header, offset); err != nil {
+			return false, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := self.buffer.ReadAt(data, offset+4); err != nil && err != io.EOF {
+			return false, err
+		}
+		request := &protocol.Request{}
+		if err := request.Decode(data); err != nil {
+			return false, fmt.Errorf("Corrupt write at %d of the replication buffer: %s", offset, err)
+		}
+		db := request.GetDatabase()
+		if _, ok := seriesByDb[db]; !ok {
+			databases = append(databases, db)
+		}
+		seriesByDb[db] = append(seriesByDb[db], request.MultiSeries...)
+		offset += int64(4 + len(data))
+	}
+
+	for _, db := range databases {
+		if err := self.post(target, db, seriesByDb[db]); err != nil {
+			return false, err
+		}
+	}
+	return true, self.advance(offset)
+}
+
+func (self *replicationStream) post(target *cluster.ReplicationTarget, db string, series []*protocol.Series) error {
+	if target.IsUdp() {
+		return self.sendPackets(target, series)
+	}
+	serializedSeries := make([]*common.SerializedSeries, 0, len(series))
+	for _, s := range series {
+		serializedSeries = append(serializedSeries, common.SerializeSeries(map[string]*protocol.Series{s.GetName(): s}, common.MicrosecondPrecision)...)
+	}
+	body, err := json.Marshal(serializedSeries)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("u", target.Username)
+	params.Set("p", target.Password)
+	params.Set("time_precision", "u")
+	addr := fmt.Sprintf("%s/db/%s/series?%s", strings.TrimRight(target.Url, "/"), url.QueryEscape(db), params.Encode())
+	self.throttle.Wait(target.Name, len(body))
+	resp, err := self.client.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s responded to the write to %s with %d: %s", target.Url, db, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// Sends the series to a udp target, the points of a series are split
+// over as many packets as they need. The timestamps are in seconds like
+// the udp input expects them.
+func (self *replicationStream) sendPackets(target *cluster.ReplicationTarget, series []*protocol.Series) error {
+	conn, err := net.Dial("udp", strings.TrimPrefix(target.Url, "udp://"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, s := range series {
+		packets, err := udpPackets(s)
+		if err != nil {
+			return err
+		}
+		for _, packet := range packets {
+			self.throttle.Wait(target.Name, len(packet))
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Halves the points of the series until each half fits in a packet. A
+// point that doesn't fit in a packet on its own is dropped.
+func udpPackets(series *protocol.Series) ([][]byte, error) {
+	packet, err := json.Marshal(common.SerializeSeries(map[string]*protocol.Series{series.GetName(): series}, common.SecondPrecision))
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) <= REPLICATION_UDP_PACKET_SIZE {
+		return [][]byte{packet}, nil
+	}
+	if len(series.Points) == 1 {
+		log.Warn("Cannot replicate a point of %s over udp, it's %d bytes", series.GetName(), len(packet))
+		return nil, nil
+	}
+	half := len(series.Points) / 2
+	first, err := udpPackets(&protocol.Series{Name: series.Name, Fields: series.Fields, Points: series.Points[:half]})
+	if err != nil {
+		return nil, err
+	}
+	second, err := udpPackets(&protocol.Series{Name: series.Name, Fields: series.Fields, Points: series.Points[half:]})
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// Moves the resume token past the writes that were acknowledged, the
+// buffer is emptied once everything in it was sent
+func (self *replicationStream) advance(offset int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	select {
+	case <-self.closed:
+		return nil
+	default:
+	}
+
+	self.token = offset
+	if self.token == self.size {
+		if err := self.buffer.Truncate(0); err != nil {
+			return err
+		}
+		self.size = 0
+		self.token = 0
+	}
+	return self.saveResumeToken()
+}
+
+func (self *CoordinatorImpl) CreateReplicationTarget(user common.User, target *cluster.ReplicationTarget) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to create a replication target")
+	}
+	if err := target.Validate(); err != nil {
+		return err
+	}
+	for _, db := range target.Databases {
+		if !self.clusterConfiguration.DatabaseExists(db) {
+			return fmt.Errorf("Database %s doesn't exist", db)
+		}
+	}
+	return self.raftServer.CreateReplicationTarget(target)
+}
+
+// Stops replicating to the target. The writes that were buffered for
+// it on the servers are deleted.
+func (self *CoordinatorImpl) DropReplicationTarget(user common.User, name string) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to drop a replication target")
+	}
+	return self.raftServer.DropReplicationTarget(name)
+}
+
+// The buffer sizes and resume tokens are the ones of this server, the
+// other servers have their own
+func (self *CoordinatorImpl) ListReplicationTargets(user common.User) ([]*ReplicationTargetStatus, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the replication targets")
+	}
+	return self.replicator.Status(), nil
+}
+
+func (self *CoordinatorImpl) StartReplication() {
+	self.replicator.Start()
+}
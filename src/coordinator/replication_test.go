@@ -0,0 +1,184 @@
+package coordinator
+
+import (
+	"cluster"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"protocol"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ReplicationSuite struct {
+	dir string
+}
+
+var _ = Suite(&ReplicationSuite{})
+
+func (self *ReplicationSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "replication_test")
+	c.Assert(err, IsNil)
+	self.dir = dir
+}
+
+func (self *ReplicationSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+type mockRemoteCluster struct {
+	lock   sync.Mutex
+	fail   bool
+	dbs    []string
+	series []map[string]interface{}
+}
+
+func (self *mockRemoteCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	series := []map[string]interface{}{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &series); err != nil || r.URL.Query().Get("time_precision") != "u" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	self.dbs = append(self.dbs, r.URL.Path)
+	self.series = append(self.series, series...)
+}
+
+func (self *mockRemoteCluster) received() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.series)
+}
+
+func replicationTestSeries(name string) []*protocol.Series {
+	timestamp := int64(1400000000000000)
+	sequenceNumber := uint64(1)
+	value := int64(42)
+	return []*protocol.Series{
+		&protocol.Series{
+			Name:   &name,
+			Fields: []string{"value"},
+			Points: []*protocol.Point{
+				&protocol.Point{
+					Timestamp:      &timestamp,
+					SequenceNumber: &sequenceNumber,
+					Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: &value}},
+				},
+			},
+		},
+	}
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (self *ReplicationSuite) TestReplicationResumesFromToken(c *C) {
+	remote := &mockRemoteCluster{fail: true}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+
+	target := &cluster.ReplicationTarget{Name: "standby", Url: server.URL, Databases: []string{"db1"}}
+	stream, err := openReplicationStream(self.dir, target, 1024*1024, http.DefaultClient)
+	c.Assert(err, IsNil)
+	c.Assert(stream.append("db1", replicationTestSeries("foo")), IsNil)
+	c.Assert(stream.append("db1", replicationTestSeries("bar")), IsNil)
+
+	// nothing is acknowledged while the remote cluster fails
+	_, err = stream.sendBatch()
+	c.Assert(err, NotNil)
+	status := &ReplicationTargetStatus{}
+	stream.fillStatus(status)
+	c.Assert(status.ResumeToken, Equals, int64(0))
+	c.Assert(status.BufferedBytes > 0, Equals, true)
+	stream.close()
+
+	// the buffered writes survive a restart and are sent once the
+	// remote cluster is back
+	remote.fail = false
+	stream, err = openReplicationStream(self.dir, target, 1024*1024, http.DefaultClient)
+	c.Assert(err, IsNil)
+	go stream.run()
+	defer stream.close()
+	c.Assert(waitFor(func() bool { return remote.received() == 2 }), Equals, true)
+	c.Assert(remote.dbs, DeepEquals, []string{"/db/db1/series"})
+	c.Assert(remote.series[0]["name"], Equals, "foo")
+	c.Assert(remote.series[1]["name"], Equals, "bar")
+
+	c.Assert(waitFor(func() bool {
+		stream.fillStatus(status)
+		return status.BufferedBytes == 0
+	}), Equals, true)
+	token, err := readResumeToken(self.dir)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, int64(0))
+}
+
+func (self *ReplicationSuite) TestFullBufferDropsWrites(c *C) {
+	target := &cluster.ReplicationTarget{Name: "standby", Url: "http://localhost:1", Databases: []string{"db1"}}
+	stream, err := openReplicationStream(self.dir, target, 10, http.DefaultClient)
+	c.Assert(err, IsNil)
+	defer stream.close()
+	c.Assert(stream.append("db1", replicationTestSeries("foo")), NotNil)
+	status := &ReplicationTargetStatus{}
+	stream.fillStatus(status)
+	c.Assert(status.DroppedWrites, Equals, int64(1))
+	c.Assert(status.BufferedBytes, Equals, int64(0))
+}
+
+func (self *ReplicationSuite) TestUdpTargetsGetTheWritesInPackets(c *C) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	target := &cluster.ReplicationTarget{Name: "stream", Url: "udp://" + conn.LocalAddr().String(), Databases: []string{"db1"}}
+	c.Assert(target.Validate(), IsNil)
+	stream, err := openReplicationStream(self.dir, target, 1024*1024, http.DefaultClient)
+	c.Assert(err, IsNil)
+	defer stream.close()
+
+	// enough points to need a few packets
+	series := replicationTestSeries("foo")
+	for i := 0; i < 200; i++ {
+		point := *series[0].Points[0]
+		timestamp := point.GetTimestamp() + int64(i+1)*1000000
+		point.Timestamp = &timestamp
+		series[0].Points = append(series[0].Points, &point)
+	}
+	c.Assert(stream.append("db1", series), IsNil)
+	sent, err := stream.sendBatch()
+	c.Assert(err, IsNil)
+	c.Assert(sent, Equals, true)
+
+	points := 0
+	packet := make([]byte, REPLICATION_UDP_PACKET_SIZE+1)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for points < 201 {
+		n, _, err := conn.ReadFromUDP(packet)
+		c.Assert(err, IsNil)
+		c.Assert(n <= REPLICATION_UDP_PACKET_SIZE, Equals, true)
+		received := []map[string]interface{}{}
+		c.Assert(json.Unmarshal(packet[:n], &received), IsNil)
+		c.Assert(received, HasLen, 1)
+		c.Assert(received[0]["name"], Equals, "foo")
+		points += len(received[0]["points"].([]interface{}))
+	}
+	c.Assert(points, Equals, 201)
+}
@@ -0,0 +1,146 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"fmt"
+	"parser"
+	"protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// The queries of a database that aggregate the points of the shards
+// that ended more than after ago. rolledUp has the ids of the shards
+// this server already rolled up and deleted the points of.
+type rollup struct {
+	database string
+	queries  []*parser.SelectQuery
+	after    time.Duration
+	rolledUp map[uint32]bool
+}
+
+func parseRollups(configs []configuration.RollupConfig) ([]*rollup, error) {
+	rollups := make([]*rollup, 0, len(configs))
+	for _, config := range configs {
+		if config.Database == "" {
+			return nil, fmt.Errorf("Rollups need a database")
+		}
+		if config.After == "" {
+			return nil, fmt.Errorf("Rollups of %s need an after duration", config.Database)
+		}
+		after, err := common.ParseTimeDuration(config.After)
+		if err != nil {
+			return nil, err
+		}
+		r := &rollup{
+			database: config.Database,
+			after:    time.Duration(after),
+			rolledUp: map[uint32]bool{},
+		}
+		for _, queryString := range config.Queries {
+			query, err := parseRollupQuery(queryString)
+			if err != nil {
+				return nil, err
+			}
+			r.queries = append(r.queries, query)
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, nil
+}
+
+func parseRollupQuery(queryString string) (*parser.SelectQuery, error) {
+	query, err := parser.ParseSelectQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
+	if query.GetIntoClause() == nil {
+		return nil, fmt.Errorf("Rollup query '%s' doesn't have an into clause", queryString)
+	}
+	if interval, err := query.GetGroupByClause().GetGroupByTime(); err != nil || interval == nil {
+		return nil, fmt.Errorf("Rollup query '%s' doesn't have a group by time", queryString)
+	}
+	if !query.IsNonRecursiveContinuousQuery() {
+		return nil, fmt.Errorf("Rollup query '%s' would read the series it writes", queryString)
+	}
+	// the points are deleted with a delete query, which can only have
+	// time conditions
+	if query.GetWhereCondition() != nil {
+		return nil, fmt.Errorf("Rollup query '%s' can only have time conditions", queryString)
+	}
+	return query, nil
+}
+
+// Returns the delete query of the points the query reads between start
+// and end
+func rollupDeleteQuery(query *parser.SelectQuery, start, end time.Time) string {
+	return fmt.Sprintf("delete from %s where %s", query.GetFromClause().GetString(), query.GetWhereConditionWithTime(start, end).GetString())
+}
+
+// Checks the rollups, has to be called before the server starts
+// leading
+func (s *RaftServer) SetRollups(configs []configuration.RollupConfig) error {
+	rollups, err := parseRollups(configs)
+	if err != nil {
+		return err
+	}
+	s.rollups = rollups
+	return nil
+}
+
+// Rolls up the shards that ended more than the after of a rollup ago.
+// The points of a shard are only deleted once all the queries of the
+// rollup wrote their points, a shard that failed is tried again at the
+// next sweep.
+func (s *RaftServer) rollUpShards() {
+	now := time.Now()
+	for _, r := range s.rollups {
+		for _, shard := range s.clusterConfig.GetAllShards() {
+			if r.rolledUp[shard.Id()] || shard.EndTime().After(now.Add(-r.after)) {
+				continue
+			}
+			if err := s.rollUpShard(r, shard.StartTime(), shard.EndTime()); err != nil {
+				log.Error("Cannot roll up shard %d of %s: %s", shard.Id(), r.database, err)
+				continue
+			}
+			r.rolledUp[shard.Id()] = true
+		}
+	}
+}
+
+func (s *RaftServer) rollUpShard(r *rollup, start, end time.Time) error {
+	adminName := s.clusterConfig.GetClusterAdmins()[0]
+	clusterAdmin := s.clusterConfig.GetClusterAdmin(adminName)
+	// the time conditions are exclusive, the points at the start time
+	// of the shard are in the shard too
+	start = start.Add(-time.Microsecond)
+
+	for _, query := range r.queries {
+		var writeErr error
+		f := func(series *protocol.Series) error {
+			err := s.coordinator.InterpolateValuesAndCommit(query.GetQueryString(), r.database, series, query.GetIntoClause().Target.Name, true)
+			if err != nil && writeErr == nil {
+				writeErr = err
+			}
+			return err
+		}
+		queryString := query.GetQueryStringWithTimesAndNoIntoClause(start, end)
+		if err := s.coordinator.RunQuery(clusterAdmin, r.database, queryString, NewContinuousQueryWriter(f)); err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+
+	for _, query := range r.queries {
+		ignore := func(series *protocol.Series) error { return nil }
+		if err := s.coordinator.RunQuery(clusterAdmin, r.database, rollupDeleteQuery(query, start, end), NewContinuousQueryWriter(ignore)); err != nil {
+			return err
+		}
+	}
+	log.Info("Rolled up the points of %s between %s and %s", r.database, start, end)
+	return nil
+}
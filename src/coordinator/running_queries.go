@@ -0,0 +1,228 @@
+package coordinator
+
+import (
+	"common"
+	"protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A query that's running on this server, it can be listed with show
+// queries and stopped with kill query
+type runningQuery struct {
+	id         uint32
+	database   string
+	user       string
+	query      string
+	start      time.Time
+	cancelled  chan bool
+	cancelOnce sync.Once
+	err        error
+	finished   chan bool
+	// the spans of the shards the query read so far
+	trace *queryTrace
+}
+
+// Stops the query, the query returns the error of the first cancel
+func (self *runningQuery) cancel(err error) {
+	self.cancelOnce.Do(func() {
+		self.err = err
+		close(self.cancelled)
+	})
+}
+
+// Returns the error the query was cancelled with, nil if it wasn't
+func (self *runningQuery) cancelError() error {
+	select {
+	case <-self.cancelled:
+		return self.err
+	default:
+		return nil
+	}
+}
+
+type runningQueries struct {
+	lock    sync.Mutex
+	nextId  uint32
+	queries map[uint32]*runningQuery
+}
+
+func newRunningQueries() *runningQueries {
+	return &runningQueries{queries: map[uint32]*runningQuery{}}
+}
+
+// Registers the query, it's cancelled when done is closed before the
+// query is removed
+func (self *runningQueries) add(user common.User, database, query, traceId string, done <-chan bool) *runningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nextId++
+	running := &runningQuery{
+		id:        self.nextId,
+		database:  database,
+		user:      user.GetName(),
+		query:     query,
+		start:     time.Now(),
+		cancelled: make(chan bool),
+		finished:  make(chan bool),
+		trace:     &queryTrace{id: traceId, spanId: newSpanId()},
+	}
+	self.queries[running.id] = running
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				running.cancel(errQueryCancelled)
+			case <-running.finished:
+			}
+		}()
+	}
+	return running
+}
+
+func (self *runningQueries) remove(running *runningQuery) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.queries, running.id)
+	close(running.finished)
+}
+
+func (self *runningQueries) get(id uint32) *runningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.queries[id]
+}
+
+// Adds the spans of a part of a query, e.g. a statement or a subquery,
+// to the running query with the trace id
+func (self *runningQueries) addSpans(traceId string, spans []*protocol.TraceSpan) {
+	if traceId == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, running := range self.queries {
+		if running.trace.id == traceId {
+			running.trace.addSpans(spans)
+			return
+		}
+	}
+}
+
+// Returns the running queries ordered by id
+func (self *runningQueries) list() []*runningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ids := make([]int, 0, len(self.queries))
+	for id := range self.queries {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	queries := make([]*runningQuery, 0, len(ids))
+	for _, id := range ids {
+		queries = append(queries, self.queries[uint32(id)])
+	}
+	return queries
+}
+
+// Stops the query once it returned more points or series than the
+// limits of the config allow
+type limitedSeriesWriter struct {
+	SeriesWriter
+	running   *runningQuery
+	maxPoints int
+	maxSeries int
+	points    int
+	series    map[string]bool
+}
+
+func (self *limitedSeriesWriter) Write(series *protocol.Series) error {
+	if self.maxSeries > 0 {
+		self.series[series.GetName()] = true
+		if len(self.series) > self.maxSeries {
+			return self.exceeded(common.NewQueryLimitError("max-select-series", self.maxSeries))
+		}
+	}
+	if self.maxPoints > 0 {
+		self.points += len(series.Points)
+		if self.points > self.maxPoints {
+			return self.exceeded(common.NewQueryLimitError("max-returned-points", self.maxPoints))
+		}
+	}
+	return self.SeriesWriter.Write(series)
+}
+
+func (self *limitedSeriesWriter) exceeded(err error) error {
+	self.running.cancel(err)
+	return err
+}
+
+// Enforces the query limits of the config on a select query, returns
+// the writer that counts its points and series and a function that
+// stops the query timeout
+func (self *CoordinatorImpl) limitQuery(running *runningQuery, seriesWriter SeriesWriter) (SeriesWriter, func()) {
+	stopTimeout := func() {}
+	if timeout := self.config.QueryTimeout; timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			running.cancel(common.NewQueryLimitError("query-timeout", timeout))
+		})
+		stopTimeout = func() { timer.Stop() }
+	}
+	if self.config.MaxReturnedPoints <= 0 && self.config.MaxSelectSeries <= 0 {
+		return seriesWriter, stopTimeout
+	}
+	return &limitedSeriesWriter{
+		SeriesWriter: seriesWriter,
+		running:      running,
+		maxPoints:    self.config.MaxReturnedPoints,
+		maxSeries:    self.config.MaxSelectSeries,
+		series:       map[string]bool{},
+	}, stopTimeout
+}
+
+// The cluster admins can see and kill every query, the other users
+// only their own
+func canManageQuery(user common.User, running *runningQuery) bool {
+	return user.IsClusterAdmin() || (user.GetName() == running.user && user.GetDb() == running.database)
+}
+
+// Returns the queries running on this server with their id, database,
+// user, query and how long they've been running in seconds
+func (self *CoordinatorImpl) ShowQueries(user common.User) *protocol.Series {
+	now := time.Now()
+	points := []*protocol.Point{}
+	for _, running := range self.runningQueries.list() {
+		if !canManageQuery(user, running) {
+			continue
+		}
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: protocol.Int64(int64(running.id))},
+				&protocol.FieldValue{StringValue: protocol.String(running.database)},
+				&protocol.FieldValue{StringValue: protocol.String(running.user)},
+				&protocol.FieldValue{StringValue: protocol.String(running.query)},
+				&protocol.FieldValue{DoubleValue: protocol.Float64(now.Sub(running.start).Seconds())},
+			},
+		})
+	}
+	return &protocol.Series{
+		Name:   protocol.String("queries"),
+		Fields: []string{"id", "database", "user", "query", "duration"},
+		Points: points,
+	}
+}
+
+// Cancels the running query with the given id, the shards of this server
+// stop reading its points and no more shards are queried
+func (self *CoordinatorImpl) KillQuery(user common.User, id uint32) error {
+	running := self.runningQueries.get(id)
+	if running == nil {
+		return common.NewQueryError(common.InvalidArgument, "Query %d isn't running", id)
+	}
+	if !canManageQuery(user, running) {
+		return common.NewAuthorizationError("Insufficient permissions to kill query %d", id)
+	}
+	running.cancel(common.NewQueryError(common.InvalidArgument, "Query %d was killed", id))
+	return nil
+}
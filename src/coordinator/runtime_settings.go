@@ -0,0 +1,25 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+)
+
+// Changes one of the settings that can be changed at runtime on every
+// server of the cluster
+func (self *CoordinatorImpl) SetRuntimeSetting(user common.User, name, value string) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to change the cluster settings")
+	}
+	if err := cluster.ValidateRuntimeSetting(name, value); err != nil {
+		return err
+	}
+	return self.raftServer.SetRuntimeSetting(name, value)
+}
+
+func (self *CoordinatorImpl) ListRuntimeSettings(user common.User) (map[string]string, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the cluster settings")
+	}
+	return self.clusterConfiguration.GetRuntimeSettings(), nil
+}
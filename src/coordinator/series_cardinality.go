@@ -0,0 +1,184 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"encoding/base64"
+	"parser"
+	"protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The sketches of the series of the databases are merged from the ones
+// of the shards when a database with a limit is first written to, then
+// updated with the series this server writes. They're merged again from
+// the shards after this long to count the series the other servers
+// wrote.
+const SERIES_SKETCH_REFRESH_INTERVAL = time.Minute
+
+type DatabaseCardinality struct {
+	Database string `json:"database"`
+	// estimated from the sketches of the shards, the series in several
+	// shards are counted once
+	Series int64 `json:"series"`
+	// zero if the database has no limit
+	MaxSeries int `json:"maxSeries"`
+}
+
+type seriesSketch struct {
+	sketch    *common.HyperLogLog
+	refreshed time.Time
+}
+
+type seriesSketches struct {
+	lock     sync.Mutex
+	sketches map[string]*seriesSketch
+}
+
+func (self *CoordinatorImpl) SetMaxSeries(user common.User, db string, maxSeries int) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to set the max series of %s", db)
+	}
+	return self.raftServer.SetMaxSeries(db, maxSeries)
+}
+
+// Returns the estimated series of every database for the cluster admins,
+// the other users get the one of the database
+func (self *CoordinatorImpl) SeriesCardinality(user common.User, db string) ([]*DatabaseCardinality, error) {
+	sketches, err := self.querySeriesSketches(user, db)
+	if err != nil {
+		return nil, err
+	}
+	databases := make([]string, 0, len(sketches))
+	for name := range sketches {
+		if user.IsClusterAdmin() || name == db {
+			databases = append(databases, name)
+		}
+	}
+	sort.Strings(databases)
+	cardinalities := make([]*DatabaseCardinality, 0, len(databases))
+	for _, name := range databases {
+		cardinalities = append(cardinalities, &DatabaseCardinality{
+			Database:  name,
+			Series:    int64(sketches[name].Estimate()),
+			MaxSeries: self.clusterConfiguration.GetMaxSeries(name),
+		})
+	}
+	return cardinalities, nil
+}
+
+// Returns the sketches of the series of each database merged from the
+// ones of every shard
+func (self *CoordinatorImpl) querySeriesSketches(user common.User, db string) (map[string]*common.HyperLogLog, error) {
+	queries, err := parser.ParseQuery("show cardinality")
+	if err != nil {
+		return nil, err
+	}
+	querySpec := parser.NewQuerySpec(user, db, queries[0])
+	sketches := map[string]*common.HyperLogLog{}
+	for _, shard := range self.clusterConfiguration.GetAllShards() {
+		if err := self.queryShardSeriesSketches(shard, querySpec, sketches); err != nil {
+			return nil, err
+		}
+	}
+	return sketches, nil
+}
+
+func (self *CoordinatorImpl) queryShardSeriesSketches(shard *cluster.ShardData, querySpec *parser.QuerySpec, sketches map[string]*common.HyperLogLog) error {
+	responseChan := make(chan *protocol.Response, shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize))
+	go shard.Query(querySpec, responseChan)
+	for {
+		response := <-responseChan
+		if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+			if response.ErrorMessage != nil {
+				return common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+			}
+			return nil
+		}
+		if response.Series == nil {
+			continue
+		}
+		for _, point := range response.Series.Points {
+			registers, err := base64.StdEncoding.DecodeString(point.Values[2].GetStringValue())
+			if err != nil {
+				return err
+			}
+			sketch, err := common.HyperLogLogFromBytes(registers)
+			if err != nil {
+				return err
+			}
+			db := point.Values[0].GetStringValue()
+			if sketches[db] == nil {
+				sketches[db] = sketch
+			} else {
+				sketches[db].Merge(sketch)
+			}
+		}
+	}
+}
+
+// Returns an error if the series that are new to the sketch of the
+// database would take its estimate over the max series of the database.
+// The writes to the series the database has already are never rejected.
+func (self *CoordinatorImpl) checkSeriesLimit(user common.User, db string, series []*protocol.Series) error {
+	maxSeries := self.clusterConfiguration.GetMaxSeries(db)
+	if maxSeries == 0 {
+		return nil
+	}
+
+	self.seriesSketches.lock.Lock()
+	defer self.seriesSketches.lock.Unlock()
+	if self.seriesSketches.sketches == nil {
+		self.seriesSketches.sketches = make(map[string]*seriesSketch)
+	}
+	cached := self.seriesSketches.sketches[db]
+	if cached == nil || time.Now().Sub(cached.refreshed) > SERIES_SKETCH_REFRESH_INTERVAL {
+		sketches, err := self.querySeriesSketches(user, db)
+		if err != nil {
+			return err
+		}
+		cached = &seriesSketch{sketches[db], time.Now()}
+		if cached.sketch == nil {
+			cached.sketch = common.NewHyperLogLog()
+		}
+		self.seriesSketches.sketches[db] = cached
+	}
+
+	sketch := cached.sketch.Copy()
+	added := 0
+	for _, s := range series {
+		if sketch.Add(s.GetName()) {
+			added++
+		}
+	}
+	if added == 0 {
+		return nil
+	}
+	if estimate := sketch.Estimate(); estimate > uint64(maxSeries) {
+		return common.NewQueryError(common.InvalidArgument, "The write would take %s to about %d series, over its limit of %d", db, estimate, maxSeries)
+	}
+	cached.sketch = sketch
+	return nil
+}
+
+// Writes the estimated series of the databases as a series with a point
+// per database
+func (self *CoordinatorImpl) runShowCardinalityQuery(user common.User, db string, seriesWriter SeriesWriter) error {
+	cardinalities, err := self.SeriesCardinality(user, db)
+	if err != nil {
+		return err
+	}
+	points := make([]*protocol.Point, 0, len(cardinalities))
+	for _, cardinality := range cardinalities {
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: protocol.String(cardinality.Database)},
+				&protocol.FieldValue{Int64Value: protocol.Int64(cardinality.Series)},
+				&protocol.FieldValue{Int64Value: protocol.Int64(int64(cardinality.MaxSeries))},
+			},
+		})
+	}
+	return seriesWriter.Write(&protocol.Series{Name: protocol.String("cardinality"), Fields: []string{"database", "series", "max_series"}, Points: points})
+}
@@ -0,0 +1,76 @@
+package coordinator
+
+import (
+	"cluster"
+	"fmt"
+	"protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+var leasedWrite = protocol.Request_LEASED_WRITE
+
+// Returns the server holding the write lease of the shard if it's
+// another server. Returns nil if this server holds it, in which case the
+// lease is renewed when it's halfway through.
+func (self *CoordinatorImpl) shardLeaseHolder(shard *cluster.ShardData) (*cluster.ClusterServer, error) {
+	now := time.Now()
+	localId := self.clusterConfiguration.LocalServer.Id
+	if lease := self.clusterConfiguration.GetShardLease(shard.Id()); lease.IsValid(now) && lease.ServerId != localId {
+		holder := self.clusterConfiguration.GetServerById(&lease.ServerId)
+		if holder == nil {
+			return nil, fmt.Errorf("Cannot find server %d holding the write lease of shard %d", lease.ServerId, shard.Id())
+		}
+		return holder, nil
+	}
+
+	duration := self.config.ShardWriteLeaseDuration
+	self.writeLeasesLock.Lock()
+	defer self.writeLeasesLock.Unlock()
+	if expiration, ok := self.writeLeases[shard.Id()]; ok && now.Add(duration/2).Before(expiration) {
+		return nil, nil
+	}
+	if err := self.raftServer.AcquireShardLease(shard.Id(), localId, now, now.Add(duration)); err != nil {
+		return nil, err
+	}
+	// stop using the lease before the other servers think it ran out in
+	// case their clocks are ahead
+	self.writeLeases[shard.Id()] = now.Add(duration - duration/4)
+	return nil, nil
+}
+
+// Sends the write to the server holding the write lease of the shard
+func (self *CoordinatorImpl) forwardLeasedWrite(holder *cluster.ClusterServer, db string, series []*protocol.Series, shard *cluster.ShardData, consistency cluster.WriteConsistency, idempotencyKey string) error {
+	log.Debug("Forwarding the write to shard %d to server %d holding its lease", shard.Id(), holder.Id)
+	shardId := shard.Id()
+	request := &protocol.Request{
+		Type:             &leasedWrite,
+		Database:         &db,
+		ShardId:          &shardId,
+		MultiSeries:      series,
+		WriteConsistency: protocol.String(consistency.String()),
+	}
+	if idempotencyKey != "" {
+		request.IdempotencyKey = &idempotencyKey
+	}
+	return holder.Write(request)
+}
+
+// Writes the series to the shard on behalf of a server that doesn't hold
+// the write lease of the shard. Fails if another server got the lease in
+// the meantime.
+func (self *CoordinatorImpl) WriteToLeasedShard(db string, shardId uint32, series []*protocol.Series, consistency cluster.WriteConsistency, idempotencyKey string) error {
+	shard := self.clusterConfiguration.GetShard(shardId)
+	if shard == nil {
+		return fmt.Errorf("Cannot find shard %d", shardId)
+	}
+	holder, err := self.shardLeaseHolder(shard)
+	if err != nil {
+		return err
+	}
+	if holder != nil {
+		return fmt.Errorf("Server %d holds the write lease of shard %d", holder.Id, shardId)
+	}
+	return self.write(db, series, shard, false, consistency, idempotencyKey)
+}
@@ -0,0 +1,259 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"fmt"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Adds a server to the cluster ahead of starting it, so it's in the
+// cluster config with its failure domain before it has its first shard.
+// New shards can be assigned to it right away, their writes are buffered
+// until it's up.
+func (self *CoordinatorImpl) AddServer(user common.User, server *cluster.NewServer) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to add a server")
+	}
+	if err := server.Validate(); err != nil {
+		return err
+	}
+	// the command checks it too, checking first keeps a command that
+	// fails out of the raft log
+	if err := self.clusterConfiguration.CheckNewServer(server); err != nil {
+		return err
+	}
+	return self.raftServer.AddServer(server)
+}
+
+// Decommissioning a server stops new shards from being assigned to it,
+// then moves each of its shard replicas to another server and finally
+// removes it from the cluster. The moves run in the background, the
+// server shows up as decommissioning until they're done.
+func (self *CoordinatorImpl) DecommissionServer(user common.User, id uint32) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to decommission a server")
+	}
+
+	server := self.clusterConfiguration.GetServerById(&id)
+	if server == nil {
+		return fmt.Errorf("Cannot find server %d", id)
+	}
+	if id == self.clusterConfiguration.ServerId() {
+		return fmt.Errorf("Server %d cannot decommission itself, send the request to another server", id)
+	}
+
+	if err := self.raftServer.DecommissionServer(id); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := self.drainServer(user, id); err != nil {
+			log.Error("Cannot decommission server %d: %s", id, err)
+			return
+		}
+		log.Info("Moved all shards off server %d, removing it from the cluster", id)
+		if err := self.raftServer.RemoveServer(id); err != nil {
+			log.Error("Cannot remove decommissioned server %d: %s", id, err)
+		}
+	}()
+	return nil
+}
+
+func (self *CoordinatorImpl) drainServer(user common.User, id uint32) error {
+	for _, shardId := range self.clusterConfiguration.ShardIdsForServer(id) {
+		shard := self.clusterConfiguration.GetShard(shardId)
+		if shard == nil {
+			continue
+		}
+		target := self.clusterConfiguration.PickReplicaTarget(shard)
+		if target == nil {
+			return fmt.Errorf("There's no server to move shard %d to", shardId)
+		}
+		if err := self.moveShardReplica(user, shardId, id, target.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a replica of the shard on the target server, copies the data of
+// the shard over and drops the replica from the source server once the
+// copy is verified
+func (self *CoordinatorImpl) moveShardReplica(user common.User, shardId, from, to uint32) error {
+	log.Info("Moving shard %d from server %d to server %d", shardId, from, to)
+	if err := self.raftServer.AddShardReplica(shardId, to); err != nil {
+		return err
+	}
+	if err := self.clusterConfiguration.CopyShard(shardId, to, user); err != nil {
+		return err
+	}
+	return self.raftServer.DropShard(shardId, []uint32{from})
+}
+
+func (self *CoordinatorImpl) PlanRebalance(user common.User) ([]*cluster.ShardMove, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to rebalance the cluster")
+	}
+	return self.clusterConfiguration.PlanRebalance(), nil
+}
+
+// Runs the given moves, usually a plan returned by PlanRebalance that
+// was approved, one at a time in the background. All the moves are
+// checked against the current placement of the shards first.
+func (self *CoordinatorImpl) Rebalance(user common.User, moves []*cluster.ShardMove) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to rebalance the cluster")
+	}
+
+	for _, move := range moves {
+		if err := self.clusterConfiguration.ValidateShardMove(move); err != nil {
+			return err
+		}
+	}
+
+	self.rebalanceLock.Lock()
+	defer self.rebalanceLock.Unlock()
+	if self.rebalancing {
+		return fmt.Errorf("A rebalance is already running")
+	}
+	self.rebalancing = true
+
+	go func() {
+		defer func() {
+			self.rebalanceLock.Lock()
+			self.rebalancing = false
+			self.rebalanceLock.Unlock()
+		}()
+
+		for i, move := range moves {
+			if i > 0 {
+				time.Sleep(self.config.RebalanceMoveInterval)
+			}
+			if err := self.clusterConfiguration.ValidateShardMove(move); err != nil {
+				log.Warn("Skipping move of shard %d from server %d to server %d: %s", move.ShardId, move.From, move.To, err)
+				continue
+			}
+			if err := self.moveShardReplica(user, move.ShardId, move.From, move.To); err != nil {
+				log.Error("Stopping rebalance, cannot move shard %d from server %d to server %d: %s", move.ShardId, move.From, move.To, err)
+				return
+			}
+		}
+		log.Info("Finished rebalancing %d shards", len(moves))
+	}()
+	return nil
+}
+
+func (self *CoordinatorImpl) ListShards(user common.User) (*cluster.ShardListing, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the shards")
+	}
+	return self.clusterConfiguration.ListShards(user), nil
+}
+
+// Moves a single shard replica in the background, the same way a move
+// of a rebalance does
+func (self *CoordinatorImpl) MoveShard(user common.User, move *cluster.ShardMove) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to move a shard")
+	}
+	if err := self.clusterConfiguration.ValidateShardMove(move); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := self.moveShardReplica(user, move.ShardId, move.From, move.To); err != nil {
+			log.Error("Cannot move shard %d from server %d to server %d: %s", move.ShardId, move.From, move.To, err)
+			return
+		}
+		log.Info("Moved shard %d from server %d to server %d", move.ShardId, move.From, move.To)
+	}()
+	return nil
+}
+
+// Deletes the copies of the shard on the given servers that the cluster
+// doesn't assign to them. If none of the servers of the shard are in the
+// cluster anymore the shard is dropped from the cluster instead.
+func (self *CoordinatorImpl) DropOrphanedShard(user common.User, shardId uint32, serverIds []uint32) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to drop a shard")
+	}
+
+	shard := self.clusterConfiguration.GetShard(shardId)
+	if shard != nil && self.clusterConfiguration.IsShardOrphaned(shard) {
+		log.Info("None of the servers of shard %d are in the cluster, dropping it", shardId)
+		return self.raftServer.DropShard(shardId, shard.ServerIds())
+	}
+	if len(serverIds) == 0 {
+		return fmt.Errorf("Shard %d isn't orphaned, give the servers to drop its copies from", shardId)
+	}
+	for _, serverId := range serverIds {
+		if err := self.clusterConfiguration.DropOrphanedShardOnServer(shardId, serverId, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes the replication factor of the cluster. Shards that have fewer
+// replicas get new ones that are copied from the existing replicas,
+// shards that have more lose the replicas on the busiest servers. This
+// runs in the background, one shard at a time.
+func (self *CoordinatorImpl) SetReplicationFactor(user common.User, replicationFactor int) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to change the replication factor")
+	}
+	if replicationFactor < 1 {
+		return fmt.Errorf("Replication factor must be at least 1, got %d", replicationFactor)
+	}
+
+	if err := self.raftServer.SetReplicationFactor(replicationFactor); err != nil {
+		return err
+	}
+
+	go func() {
+		for _, shard := range self.clusterConfiguration.GetAllShards() {
+			if err := self.replicateShard(user, shard, replicationFactor); err != nil {
+				log.Error("Cannot change the number of replicas of shard %d to %d: %s", shard.Id(), replicationFactor, err)
+			}
+		}
+		log.Info("Finished changing the replication factor to %d", replicationFactor)
+	}()
+	return nil
+}
+
+// Changes the duration of the shards of the given type that get created
+// from now on. The existing shards aren't touched.
+func (self *CoordinatorImpl) SetShardDuration(user common.User, shardType cluster.ShardType, duration time.Duration) error {
+	if !user.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to change the shard duration")
+	}
+	if duration < time.Second {
+		return fmt.Errorf("Shard duration must be at least a second, got %s", duration)
+	}
+	return self.raftServer.SetShardDuration(shardType, duration)
+}
+
+func (self *CoordinatorImpl) replicateShard(user common.User, shard *cluster.ShardData, replicationFactor int) error {
+	if extra := len(shard.ServerIds()) - replicationFactor; extra > 0 {
+		serverIds := self.clusterConfiguration.PickReplicasToDrop(shard, extra)
+		return self.raftServer.DropShard(shard.Id(), serverIds)
+	}
+
+	for len(shard.ServerIds()) < replicationFactor {
+		target := self.clusterConfiguration.PickReplicaTarget(shard)
+		if target == nil {
+			log.Warn("Shard %d has %d replicas, there are no more servers to add one to", shard.Id(), len(shard.ServerIds()))
+			return nil
+		}
+		if err := self.raftServer.AddShardReplica(shard.Id(), target.Id); err != nil {
+			return err
+		}
+		if err := self.clusterConfiguration.CopyShard(shard.Id(), target.Id, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
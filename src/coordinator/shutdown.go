@@ -0,0 +1,75 @@
+package coordinator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+var errShuttingDown = errors.New("The server is shutting down")
+
+// Tracks the queries and the writes that are running so the server can
+// wait for them before it closes the shards. Once it's draining the new
+// requests are refused.
+type requestDrain struct {
+	lock     sync.Mutex
+	draining bool
+	running  sync.WaitGroup
+}
+
+// Returns errShuttingDown if the server is draining, otherwise the
+// request counts as running until finish is called
+func (self *requestDrain) start() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.draining {
+		return errShuttingDown
+	}
+	self.running.Add(1)
+	return nil
+}
+
+func (self *requestDrain) finish() {
+	self.running.Done()
+}
+
+// Refuses the new requests and waits up to the timeout for the running
+// ones, returns false if some of them are still running
+func (self *requestDrain) drain(timeout time.Duration) bool {
+	self.lock.Lock()
+	self.draining = true
+	self.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		self.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stops accepting queries and writes and waits up to the timeout for the
+// running ones to finish. The queries still running then are cancelled,
+// the writes can't be, the server waits up to the timeout again for them
+// and for the cancelled queries to return.
+func (self *CoordinatorImpl) Drain(timeout time.Duration) {
+	log.Info("Waiting up to %s for the running queries and writes", timeout)
+	if self.drain.drain(timeout) {
+		return
+	}
+	queries := self.runningQueries.list()
+	log.Warn("Cancelling %d queries that are still running", len(queries))
+	for _, running := range queries {
+		running.cancel(errShuttingDown)
+	}
+	if !self.drain.drain(timeout) {
+		log.Error("Some writes or queries are still running, shutting down anyway")
+	}
+}
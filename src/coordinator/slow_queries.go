@@ -0,0 +1,229 @@
+package coordinator
+
+import (
+	"bytes"
+	"common"
+	"configuration"
+	"encoding/json"
+	"fmt"
+	"protocol"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A query that took longer than the slow query threshold, the query is
+// normalized so the slow queries that only differ by their values look
+// the same
+type slowQuery struct {
+	Start    time.Time `json:"start"`
+	Database string    `json:"database"`
+	User     string    `json:"user"`
+	Query    string    `json:"query"`
+	Shards   []uint32  `json:"shards"`
+	Points   int64     `json:"pointsScanned"`
+	Duration float64   `json:"duration"`
+}
+
+// Logs the slow queries and keeps the last ones in a ring buffer for
+// show slow queries. A nil log doesn't log anything.
+type slowQueryLog struct {
+	threshold  time.Duration
+	jsonFormat bool
+	lock       sync.Mutex
+	entries    []*slowQuery
+	next       int
+}
+
+// Returns nil if the slow query log is turned off
+func newSlowQueryLog(config *configuration.Configuration) *slowQueryLog {
+	if config.SlowQueryThreshold <= 0 {
+		return nil
+	}
+	return &slowQueryLog{
+		threshold:  config.SlowQueryThreshold,
+		jsonFormat: config.SlowQueryLogFormat == "json",
+		entries:    make([]*slowQuery, 0, config.SlowQueryMaxEntries),
+	}
+}
+
+// Logs the query if it's been running for longer than the threshold,
+// called once the query is done
+func (self *slowQueryLog) add(running *runningQuery) {
+	if self == nil {
+		return
+	}
+	duration := time.Now().Sub(running.start)
+	if duration < self.threshold {
+		return
+	}
+
+	entry := &slowQuery{
+		Start:    running.start,
+		Database: running.database,
+		User:     running.user,
+		Query:    normalizeQuery(running.query),
+		Duration: duration.Seconds(),
+	}
+	entry.Shards, entry.Points = running.trace.shardsAndPoints()
+	self.log(entry)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.entries) < cap(self.entries) {
+		self.entries = append(self.entries, entry)
+		return
+	}
+	if len(self.entries) == 0 {
+		return
+	}
+	self.entries[self.next] = entry
+	self.next = (self.next + 1) % len(self.entries)
+}
+
+func (self *slowQueryLog) log(entry *slowQuery) {
+	if self.jsonFormat {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Error("Cannot marshal slow query %s: %s", entry.Query, err)
+			return
+		}
+		log.Warn("%s", data)
+		return
+	}
+	log.Warn("Slow query: db: %s, u: %s, q: %s, shards: %v, points: %d, t: %s",
+		entry.Database, entry.User, entry.Query, entry.Shards, entry.Points, time.Duration(entry.Duration*float64(time.Second)))
+}
+
+// Returns the slow queries from the oldest to the latest
+func (self *slowQueryLog) list() []*slowQuery {
+	if self == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entries := make([]*slowQuery, 0, len(self.entries))
+	entries = append(entries, self.entries[self.next:]...)
+	return append(entries, self.entries[:self.next]...)
+}
+
+// Returns the distinct shards of the spans of the shards and the points
+// they read
+func (self *queryTrace) shardsAndPoints() ([]uint32, int64) {
+	self.spansLock.Lock()
+	defer self.spansLock.Unlock()
+	seen := map[uint32]bool{}
+	ids := []int{}
+	points := int64(0)
+	for _, span := range self.spans {
+		if !isShardSpan(span) {
+			continue
+		}
+		points += span.GetPointsRead()
+		if id := span.GetShardId(); !seen[id] {
+			seen[id] = true
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	shards := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		shards = append(shards, uint32(id))
+	}
+	return shards, points
+}
+
+// Replaces the strings and the numbers of the query with ? and collapses
+// the white space. The quoted names are kept as they are.
+func normalizeQuery(query string) string {
+	buffer := bytes.NewBuffer(nil)
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = buffer.Len() > 0
+			continue
+		case space:
+			buffer.WriteByte(' ')
+			space = false
+		}
+
+		switch {
+		case c == '\'' || c == '"':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if c == '\'' {
+				buffer.WriteString("'?'")
+			} else if end < len(query) {
+				buffer.WriteString(query[i : end+1])
+			} else {
+				buffer.WriteString(query[i:])
+			}
+			i = end
+		case isDigit(c) && (i == 0 || !isNameByte(query[i-1])):
+			// the unit of a duration, e.g. 1h, goes with the number
+			end := i
+			for end < len(query) && (isWordByte(query[end]) || query[end] == '.') {
+				end++
+			}
+			buffer.WriteByte('?')
+			i = end - 1
+		default:
+			buffer.WriteByte(c)
+		}
+	}
+	return strings.TrimRight(buffer.String(), "; ")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordByte(c byte) bool {
+	return isDigit(c) || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// the names of the series can have dots, e.g. cpu.5m
+func isNameByte(c byte) bool {
+	return isWordByte(c) || c == '.'
+}
+
+// Returns the slow queries of this server from the oldest to the latest,
+// the cluster admins see every query, the other users only their own
+func (self *CoordinatorImpl) ShowSlowQueries(user common.User) *protocol.Series {
+	points := []*protocol.Point{}
+	for _, entry := range self.slowQueries.list() {
+		if !user.IsClusterAdmin() && (user.GetName() != entry.User || user.GetDb() != entry.Database) {
+			continue
+		}
+		shards := make([]string, 0, len(entry.Shards))
+		for _, id := range entry.Shards {
+			shards = append(shards, fmt.Sprint(id))
+		}
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: protocol.String(entry.Database)},
+				&protocol.FieldValue{StringValue: protocol.String(entry.User)},
+				&protocol.FieldValue{StringValue: protocol.String(entry.Query)},
+				&protocol.FieldValue{StringValue: protocol.String(strings.Join(shards, ","))},
+				&protocol.FieldValue{Int64Value: protocol.Int64(entry.Points)},
+				&protocol.FieldValue{DoubleValue: protocol.Float64(entry.Duration)},
+			},
+			Timestamp: protocol.Int64(common.TimeToMicroseconds(entry.Start)),
+		})
+	}
+	return &protocol.Series{
+		Name:   protocol.String("slow queries"),
+		Fields: []string{"database", "user", "query", "shards", "points_scanned", "duration"},
+		Points: points,
+	}
+}
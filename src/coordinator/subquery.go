@@ -0,0 +1,76 @@
+package coordinator
+
+import (
+	"cluster"
+	"engine"
+	"parser"
+	"protocol"
+)
+
+// Streams the series the inner query of a subquery returns to the
+// engine of the outer query
+type subQueryWriter struct {
+	processor cluster.QueryProcessor
+	done      bool
+}
+
+func (self *subQueryWriter) Write(series *protocol.Series) error {
+	// the outer query stops yielding once it reached its limit
+	if !self.done && !self.processor.YieldSeries(series) {
+		self.done = true
+	}
+	return nil
+}
+
+func (self *subQueryWriter) Close() {
+}
+
+// Runs a select from a subquery, the inner query reads the shards like
+// any other query and the outer query is computed by an engine in the
+// coordinator from the series the inner query returns
+func (self *CoordinatorImpl) runSubQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	outer := querySpec.SelectQuery()
+	innerSpec := parser.NewQuerySpec(querySpec.User(), querySpec.Database(), &parser.Query{SelectQuery: outer.GetFromClause().SubQuery})
+	innerSpec.QuorumRead = querySpec.QuorumRead
+	innerSpec.TraceId = querySpec.TraceId
+	innerSpec.ParentSpanId = querySpec.ParentSpanId
+	innerSpec.Cancelled = querySpec.Cancelled
+
+	return self.runCoordinatorEngine(outer, seriesWriter, func(processor cluster.QueryProcessor) error {
+		return self.runQuery(innerSpec, &subQueryWriter{processor: processor})
+	})
+}
+
+// Computes the query with an engine in the coordinator from the series
+// the function yields to the processor
+func (self *CoordinatorImpl) runCoordinatorEngine(query *parser.SelectQuery, seriesWriter SeriesWriter, yieldSeries func(processor cluster.QueryProcessor) error) error {
+	responseChan := make(chan *protocol.Response)
+	queryEngine, err := engine.NewQueryEngine(query, responseChan)
+	if err != nil {
+		return err
+	}
+	var processor cluster.QueryProcessor = queryEngine
+	// the joins filter the points they join
+	if query.GetWhereCondition() != nil && query.GetFromClause().Type != parser.FromClauseInnerJoin {
+		processor = engine.NewFilteringEngine(query, processor)
+	}
+
+	seriesClosed := make(chan bool)
+	go func() {
+		for response := range responseChan {
+			if *response.Type == endStreamResponse {
+				seriesWriter.Close()
+				seriesClosed <- true
+				return
+			}
+			if response.Series != nil && len(response.Series.Points) > 0 {
+				seriesWriter.Write(response.Series)
+			}
+		}
+	}()
+
+	err = yieldSeries(processor)
+	processor.Close()
+	<-seriesClosed
+	return err
+}
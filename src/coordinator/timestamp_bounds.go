@@ -0,0 +1,59 @@
+package coordinator
+
+import (
+	"common"
+	"fmt"
+	"metrics"
+	"protocol"
+	"time"
+)
+
+// Returns an error if any point of the write is older than the max point
+// age of the database or further in the future than its max future
+// offset, the rejected points are counted in the metrics of the database.
+// The points without a timestamp get the current time.
+func (self *CoordinatorImpl) checkTimestampBounds(db string, series []*protocol.Series) error {
+	bounds := self.config.GetTimestampBounds(db)
+	if bounds.MaxPointAge == 0 && bounds.MaxFutureOffset == 0 {
+		return nil
+	}
+	now := common.CurrentTime()
+	tooOld, inFuture := 0, 0
+	var err error
+	for _, s := range series {
+		for _, point := range s.Points {
+			if point.Timestamp == nil {
+				continue
+			}
+			timestamp := point.GetTimestamp()
+			switch {
+			case bounds.MaxPointAge > 0 && timestamp < now-int64(bounds.MaxPointAge/time.Microsecond):
+				tooOld++
+				if err == nil {
+					err = fmt.Errorf("The point of %s at %s is older than %s, the max-point-age of the database %s",
+						s.GetName(), formatPointTime(timestamp), bounds.MaxPointAge, db)
+				}
+			case bounds.MaxFutureOffset > 0 && timestamp > now+int64(bounds.MaxFutureOffset/time.Microsecond):
+				inFuture++
+				if err == nil {
+					err = fmt.Errorf("The point of %s at %s is more than %s in the future, the max-future-offset of the database %s",
+						s.GetName(), formatPointTime(timestamp), bounds.MaxFutureOffset, db)
+				}
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if tooOld > 0 {
+		metrics.Default.Counter(metrics.DatabaseMetric(db, "points_too_old")).Add(int64(tooOld))
+	}
+	if inFuture > 0 {
+		metrics.Default.Counter(metrics.DatabaseMetric(db, "points_in_future")).Add(int64(inFuture))
+	}
+	return fmt.Errorf("%s (%d points of the write are out of bounds, none of them were written)", err, tooOld+inFuture)
+}
+
+func formatPointTime(timestamp int64) string {
+	return common.TimeFromMicroseconds(timestamp).UTC().Format(time.RFC3339)
+}
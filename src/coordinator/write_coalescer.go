@@ -0,0 +1,113 @@
+package coordinator
+
+import (
+	"cluster"
+	"metrics"
+	"protocol"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Coalesces the writes to the same shard that arrive within the delay of
+// each other into a single write, so a lot of small writes don't each
+// become a request to every replica and a batch on disk. The write goes
+// out once the delay passed since the first of its writes or once it has
+// maxPoints points. Every writer waits for the write its points went out
+// with and gets its error.
+type writeCoalescer struct {
+	delay     time.Duration
+	maxPoints int
+	write     func(db string, series []*protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error
+	lock      sync.Mutex
+	pending   map[coalescedWriteKey]*coalescedWrite
+}
+
+// only the writes with the same consistency are coalesced, a write
+// can't be acknowledged sooner than its writer asked for
+type coalescedWriteKey struct {
+	shardId     uint32
+	database    string
+	consistency cluster.WriteConsistency
+}
+
+type coalescedWrite struct {
+	key     coalescedWriteKey
+	shard   cluster.Shard
+	series  []*protocol.Series
+	points  int
+	writers []chan error
+}
+
+func newWriteCoalescer(delay time.Duration, maxPoints int, write func(string, []*protocol.Series, cluster.Shard, cluster.WriteConsistency) error) *writeCoalescer {
+	return &writeCoalescer{
+		delay:     delay,
+		maxPoints: maxPoints,
+		write:     write,
+		pending:   map[coalescedWriteKey]*coalescedWrite{},
+	}
+}
+
+// Adds the series to the pending write of the shard and waits for it to
+// be written
+func (self *writeCoalescer) Write(db string, series []*protocol.Series, shard cluster.Shard, consistency cluster.WriteConsistency) error {
+	key := coalescedWriteKey{shard.Id(), db, consistency}
+	done := make(chan error, 1)
+
+	self.lock.Lock()
+	write := self.pending[key]
+	if write == nil {
+		write = &coalescedWrite{key: key, shard: shard}
+		self.pending[key] = write
+		time.AfterFunc(self.delay, func() { self.flush(write) })
+	}
+	write.add(series)
+	write.writers = append(write.writers, done)
+	full := write.points >= self.maxPoints
+	self.lock.Unlock()
+
+	if full {
+		self.flush(write)
+	}
+	return <-done
+}
+
+// Sends the write unless it was sent already
+func (self *writeCoalescer) flush(write *coalescedWrite) {
+	self.lock.Lock()
+	if self.pending[write.key] != write {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.pending, write.key)
+	self.lock.Unlock()
+
+	// the writes that didn't need a write of their own
+	metrics.Default.Counter("write.coalesced").Add(int64(len(write.writers) - 1))
+	err := self.write(write.key.database, write.series, write.shard, write.key.consistency)
+	for _, writer := range write.writers {
+		writer <- err
+	}
+}
+
+// Appends the points to the series of the write with the same name and
+// columns. Series with other columns are kept apart, merging them would
+// write nulls for the columns a series doesn't have, which deletes them.
+func (self *coalescedWrite) add(series []*protocol.Series) {
+	for _, s := range series {
+		self.points += len(s.Points)
+		merged := false
+		for _, pending := range self.series {
+			if pending.GetName() == s.GetName() && reflect.DeepEqual(pending.Fields, s.Fields) {
+				pending.Points = append(pending.Points, s.Points...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			points := make([]*protocol.Point, len(s.Points))
+			copy(points, s.Points)
+			self.series = append(self.series, &protocol.Series{Name: s.Name, Fields: s.Fields, Points: points})
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"configuration"
+	"datastore"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// influxd export, import and verify read and write the shards of the
+// data dir directly, the server must not be running
+func runDumpCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "export":
+		err = exportData(args[1:])
+	case "import":
+		err = importData(args[1:])
+	case "verify":
+		err = verifyData(args[1:])
+	default:
+		return false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func openDatastore(fileName string) (*datastore.LevelDbShardDatastore, error) {
+	config := configuration.LoadConfiguration(fileName)
+	setupLogging(config.LogLevel, config.LogFile)
+	return datastore.NewLevelDbShardDatastore(config)
+}
+
+func parseShardIds(shards string) ([]uint32, error) {
+	shardIds := []uint32{}
+	for _, shard := range strings.Split(shards, ",") {
+		if shard == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(shard), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard id %s", shard)
+		}
+		shardIds = append(shardIds, uint32(id))
+	}
+	return shardIds, nil
+}
+
+func exportData(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	fileName := flags.String("config", "config.sample.toml", "Config file")
+	out := flags.String("out", "", "The file the gzipped export is written to")
+	database := flags.String("database", "", "Only export the points of this database")
+	shards := flags.String("shards", "", "Comma separated ids of the shards to export, all the shards of the data dir by default")
+	flags.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	shardIds, err := parseShardIds(*shards)
+	if err != nil {
+		return err
+	}
+
+	store, err := openDatastore(*fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	file, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := store.Export(file, *database, shardIds); err != nil {
+		file.Close()
+		os.Remove(*out)
+		return err
+	}
+	return file.Close()
+}
+
+func importData(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	fileName := flags.String("config", "config.sample.toml", "Config file")
+	in := flags.String("in", "", "The file written by influxd export")
+	database := flags.String("database", "", "Only import the points of this database")
+	flags.Parse(args)
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	store, err := openDatastore(*fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	count, err := store.Import(file, *database)
+	fmt.Printf("Imported %d points\n", count)
+	return err
+}
+
+func verifyData(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	fileName := flags.String("config", "config.sample.toml", "Config file")
+	shards := flags.String("shards", "", "Comma separated ids of the shards to verify, all the shards of the data dir by default")
+	flags.Parse(args)
+	shardIds, err := parseShardIds(*shards)
+	if err != nil {
+		return err
+	}
+
+	store, err := openDatastore(*fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	corrupt, err := store.Verify(shardIds)
+	if err != nil {
+		return err
+	}
+	for _, r := range corrupt {
+		if r.Series == "" {
+			fmt.Printf("shard %d: %s\n", r.Shard, r.Error)
+			continue
+		}
+		fmt.Printf("shard %d: %s.%s column %s after %du: %s\n", r.Shard, r.Database, r.Series, r.Column, r.After, r.Error)
+	}
+	if len(corrupt) > 0 {
+		return fmt.Errorf("%d corrupt ranges found", len(corrupt))
+	}
+	fmt.Println("No corruption found")
+	return nil
+}
@@ -54,6 +54,10 @@ func setupLogging(loggingLevel, logFile string) {
 }
 
 func main() {
+	if runDumpCommand(os.Args[1:]) {
+		return
+	}
+
 	fileName := flag.String("config", "config.sample.toml", "Config file")
 	wantsVersion := flag.Bool("v", false, "Get version number")
 	resetRootPassword := flag.Bool("reset-root", false, "Reset root password")
@@ -18,11 +18,13 @@ func startProfiler(stoppable Stoppable) error {
 
 func waitForSignals(stoppable Stoppable) {
 	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	for {
 		sig := <-ch
 		log.Info("Received signal: %s", sig.String())
 		switch sig {
+		case syscall.SIGHUP:
+			stoppable.Reload()
 		case syscall.SIGINT, syscall.SIGTERM:
 			stoppable.Stop()
 			time.Sleep(time.Second)
@@ -30,12 +30,14 @@ func init() {
 
 func waitForSignals(stoppable Stoppable, filename string, stopped <-chan bool) {
 	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 outer:
 	for {
 		sig := <-ch
 		log.Info("Received signal: %s", sig.String())
 		switch sig {
+		case syscall.SIGHUP:
+			stoppable.Reload()
 		case syscall.SIGINT, syscall.SIGTERM:
 			runtime.SetCPUProfileRate(0)
 			f, err := os.OpenFile(fmt.Sprintf("%s.mem", filename), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
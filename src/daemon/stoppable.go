@@ -2,4 +2,6 @@ package main
 
 type Stoppable interface {
 	Stop()
+	// reloads the config file on SIGHUP
+	Reload()
 }
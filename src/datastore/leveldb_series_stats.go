@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"bytes"
+	"common"
+	"encoding/binary"
+	"fmt"
+	"protocol"
+	"time"
+)
+
+// The stats of a series are the value of its key in the database to
+// series index, so they're read without going through the points. All
+// the points of the series are between MinTime and MaxTime, which are
+// bounds rather than the exact times of the first and last point.
+// PointsWritten counts the points as they're written, the points that
+// are overwritten or deleted later are still counted until retention
+// drops all the points of the series.
+type seriesStats struct {
+	PointsWritten uint64
+	MinTime       int64
+	MaxTime       int64
+}
+
+func (self *seriesStats) encode() []byte {
+	data := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(data, self.PointsWritten)
+	n += binary.PutVarint(data[n:], self.MinTime)
+	n += binary.PutVarint(data[n:], self.MaxTime)
+	return data[:n]
+}
+
+// Returns nil for the series indexed before the shards kept the stats
+func decodeSeriesStats(data []byte) (*seriesStats, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	buffer := bytes.NewBuffer(data)
+	stats := &seriesStats{}
+	var err error
+	if stats.PointsWritten, err = binary.ReadUvarint(buffer); err != nil {
+		return nil, fmt.Errorf("Invalid series stats: %s", err)
+	}
+	if stats.MinTime, err = binary.ReadVarint(buffer); err != nil {
+		return nil, fmt.Errorf("Invalid series stats: %s", err)
+	}
+	if stats.MaxTime, err = binary.ReadVarint(buffer); err != nil {
+		return nil, fmt.Errorf("Invalid series stats: %s", err)
+	}
+	return stats, nil
+}
+
+func (self *seriesStats) add(points []*protocol.Point) {
+	for _, point := range points {
+		timestamp := *point.GetTimestampInMicroseconds()
+		if self.PointsWritten == 0 || timestamp < self.MinTime {
+			self.MinTime = timestamp
+		}
+		if self.PointsWritten == 0 || timestamp > self.MaxTime {
+			self.MaxTime = timestamp
+		}
+		self.PointsWritten++
+	}
+}
+
+// Returns true unless the stats show the series has no points between
+// the two times
+func (self *seriesStats) mayHavePointsBetween(startTime, endTime time.Time) bool {
+	if self == nil {
+		return true
+	}
+	if self.PointsWritten == 0 {
+		return false
+	}
+	return self.MaxTime >= common.TimeToMicroseconds(startTime) && self.MinTime <= common.TimeToMicroseconds(endTime)
+}
+
+func seriesStatsKey(database, series string) []byte {
+	return append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+series)...)
+}
+
+func (self *LevelDbShard) getSeriesStats(database, series string) (*seriesStats, error) {
+	data, err := self.db.Get(self.readOptions, seriesStatsKey(database, series))
+	if err != nil {
+		return nil, err
+	}
+	return decodeSeriesStats(data)
+}
+
+// Adds the written points to the stats of their series, the series were
+// indexed when their columns got their ids
+func (self *LevelDbShard) updateSeriesStats(database string, series []*protocol.Series) error {
+	self.seriesStatsLock.Lock()
+	defer self.seriesStatsLock.Unlock()
+	for _, s := range series {
+		stats, err := self.getSeriesStats(database, *s.Name)
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			stats = &seriesStats{}
+		}
+		stats.add(s.Points)
+		if err := self.db.Put(self.writeOptions, seriesStatsKey(database, *s.Name), stats.encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the lower bound of the series to t once its older points are
+// deleted
+func (self *LevelDbShard) raiseSeriesMinTime(database, series string, t time.Time) error {
+	self.seriesStatsLock.Lock()
+	defer self.seriesStatsLock.Unlock()
+	stats, err := self.getSeriesStats(database, series)
+	if err != nil || stats == nil {
+		return err
+	}
+	micros := common.TimeToMicroseconds(t)
+	if micros <= stats.MinTime {
+		return nil
+	}
+	stats.MinTime = micros
+	if stats.MaxTime < micros {
+		// none of the points are left
+		stats.PointsWritten = 0
+	}
+	return self.db.Put(self.writeOptions, seriesStatsKey(database, series), stats.encode())
+}
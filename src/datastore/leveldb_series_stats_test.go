@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"common"
+	"os"
+	"parser"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_SERIES_STATS_DIR = "/tmp/influxdb/leveldb_series_stats_test"
+
+type LevelDbSeriesStatsSuite struct{}
+
+var _ = Suite(&LevelDbSeriesStatsSuite{})
+
+func (self *LevelDbSeriesStatsSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_SERIES_STATS_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbSeriesStatsSuite) TestTheStatsOfTheSeriesAreKeptOnWrite(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_SERIES_STATS_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	write := func(fields []string, timestamps ...int64) {
+		series := &protocol.Series{Name: protocol.String("foo"), Fields: fields}
+		for _, timestamp := range timestamps {
+			point := &protocol.Point{SequenceNumber: proto.Uint64(1)}
+			for _ = range fields {
+				point.Values = append(point.Values, &protocol.FieldValue{Int64Value: protocol.Int64(1)})
+			}
+			point.SetTimestampInMicroseconds(timestamp)
+			series.Points = append(series.Points, point)
+		}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+	write([]string{"value"}, now-3000000, now-2000000)
+	// a new column doesn't reset the stats
+	write([]string{"value", "other"}, now-1000000)
+
+	stats, err := shard.getSeriesStats("db1", "foo")
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, &seriesStats{PointsWritten: 3, MinTime: now - 3000000, MaxTime: now - 1000000})
+
+	// the series isn't read for the queries outside of its time range
+	queries, err := parser.ParseQuery("select value from foo where time > now() - 1h and time < now() - 1m;")
+	c.Assert(err, IsNil)
+	cursor, err := shard.SeriesCursor(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+	c.Assert(cursor.(*levelDbSeriesCursor).iterators, HasLen, 0)
+	points, err := cursor.NextBatch(10)
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 0)
+
+	// the series indexed before the stats can still be queried
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	c.Assert(db.Put(wo, seriesStatsKey("db1", "foo"), []byte{}), IsNil)
+	stats, err = shard.getSeriesStats("db1", "foo")
+	c.Assert(err, IsNil)
+	c.Assert(stats, IsNil)
+	c.Assert(stats.mayHavePointsBetween(time.Now().Add(-time.Hour), time.Now()), Equals, true)
+}
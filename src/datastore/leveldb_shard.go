@@ -11,6 +11,8 @@ import (
 	"parser"
 	"protocol"
 	"regexp"
+	"regexp/syntax"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,9 +31,26 @@ type LevelDbShard struct {
 	closed         bool
 	pointBatchSize int
 	writeBatchSize int
+	valueCodec     ValueCodec
+	// guards the read-modify-write of the series stats
+	seriesStatsLock sync.Mutex
+	// the sequence of the last logged write
+	writeSequence uint64
+	writeLogLock  sync.Mutex
+	// how long the idempotency keys of the writes are kept
+	writeDedupWindow time.Duration
+	dedupLock        sync.Mutex
+	// whether the values that don't match the type of their field are
+	// converted to it instead of rejected
+	coerceFieldTypes bool
+	fieldTypesLock   sync.Mutex
+	// the columns whose values are indexed
+	indexedColumns map[string]bool
 }
 
-func NewLevelDbShard(db *levigo.DB, pointBatchSize, writeBatchSize int) (*LevelDbShard, error) {
+// Opens the shard, the field values of a new shard are encoded with the
+// given codec. Shards keep the codec they were created with.
+func NewLevelDbShard(db *levigo.DB, pointBatchSize, writeBatchSize int, valueCodec string) (*LevelDbShard, error) {
 	ro := levigo.NewReadOptions()
 	lastIdBytes, err2 := db.Get(ro, NEXT_ID_KEY)
 	if err2 != nil {
@@ -46,13 +65,37 @@ func NewLevelDbShard(db *levigo.DB, pointBatchSize, writeBatchSize int) (*LevelD
 		}
 	}
 
+	codecName, err2 := db.Get(ro, VALUE_CODEC_KEY)
+	if err2 != nil {
+		return nil, err2
+	}
+	if codecName == nil {
+		// shards created before the codecs have their values marshaled
+		// with protobuf
+		if lastIdBytes != nil {
+			codecName = []byte(PROTOBUF_VALUE_CODEC)
+		} else {
+			codecName = []byte(valueCodec)
+		}
+		if err2 = db.Put(levigo.NewWriteOptions(), VALUE_CODEC_KEY, codecName); err2 != nil {
+			return nil, err2
+		}
+	}
+	codec, err2 := getValueCodec(string(codecName))
+	if err2 != nil {
+		return nil, err2
+	}
+
 	return &LevelDbShard{
-		db:             db,
-		writeOptions:   levigo.NewWriteOptions(),
-		readOptions:    ro,
-		lastIdUsed:     lastId,
-		pointBatchSize: pointBatchSize,
-		writeBatchSize: writeBatchSize,
+		db:               db,
+		writeOptions:     levigo.NewWriteOptions(),
+		readOptions:      ro,
+		lastIdUsed:       lastId,
+		pointBatchSize:   pointBatchSize,
+		writeBatchSize:   writeBatchSize,
+		valueCodec:       codec,
+		writeSequence:    lastWriteSequence(db, ro),
+		writeDedupWindow: DEFAULT_WRITE_DEDUP_WINDOW,
 	}, nil
 }
 
@@ -60,6 +103,16 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 	wb := levigo.NewWriteBatch()
 	defer wb.Close()
 
+	self.fieldTypesLock.Lock()
+	defer self.fieldTypesLock.Unlock()
+	dropped, err := self.recordFieldTypes(wb, database, series)
+	if err != nil {
+		return err
+	}
+	if err := self.indexColumnValues(wb, database, series); err != nil {
+		return err
+	}
+
 	for _, s := range series {
 		if len(s.Points) == 0 {
 			return errors.New("Unable to write no data. Series was nil or had no points.")
@@ -73,10 +126,9 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 				return err
 			}
 			keyBuffer := bytes.NewBuffer(make([]byte, 0, 24))
-			dataBuffer := proto.NewBuffer(nil)
+			var data []byte
 			for _, point := range s.Points {
 				keyBuffer.Reset()
-				dataBuffer.Reset()
 
 				keyBuffer.Write(id)
 				timestamp := self.convertTimestampToUint(point.GetTimestampInMicroseconds())
@@ -90,12 +142,15 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 					wb.Delete(pointKey)
 					goto check
 				}
+				if dropped[point.Values[fieldIndex]] {
+					goto check
+				}
 
-				err = dataBuffer.Marshal(point.Values[fieldIndex])
+				data, err = self.valueCodec.Encode(point.Values[fieldIndex])
 				if err != nil {
 					return err
 				}
-				wb.Put(pointKey, dataBuffer.Bytes())
+				wb.Put(pointKey, data)
 			check:
 				count++
 				if count >= self.writeBatchSize {
@@ -110,16 +165,25 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 		}
 	}
 
-	return self.db.Write(self.writeOptions, wb)
+	if err := self.commitLoggedWrite(wb, database, series); err != nil {
+		return err
+	}
+	return self.updateSeriesStats(database, series)
 }
 
 func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	if querySpec.IsListSeriesQuery() {
 		return self.executeListSeriesQuery(querySpec, processor)
+	} else if querySpec.IsListFieldsQuery() {
+		return self.executeListFieldsQuery(querySpec, processor)
 	} else if querySpec.IsDeleteFromSeriesQuery() {
 		return self.executeDeleteQuery(querySpec, processor)
 	} else if querySpec.IsDropSeriesQuery() {
 		return self.executeDropSeriesQuery(querySpec, processor)
+	} else if querySpec.IsShowDiskUsageQuery() {
+		return self.executeDiskUsageQuery(querySpec, processor)
+	} else if querySpec.IsShowCardinalityQuery() {
+		return self.executeCardinalityQuery(processor)
 	}
 
 	seriesAndColumns := querySpec.SelectQuery().GetReferencedColumns()
@@ -158,7 +222,7 @@ func (self *LevelDbShard) DropDatabase(database string) error {
 			return err
 		}
 	}
-	self.compact()
+	self.Compact()
 	return nil
 }
 
@@ -167,9 +231,6 @@ func (self *LevelDbShard) IsClosed() bool {
 }
 
 func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, seriesName string, columns []string, processor cluster.QueryProcessor) error {
-	startTimeBytes := self.byteArrayForTime(querySpec.GetStartTime())
-	endTimeBytes := self.byteArrayForTime(querySpec.GetEndTime())
-
 	fields, err := self.getFieldsForSeries(querySpec.Database(), seriesName, columns)
 	if err != nil {
 		// because a db is distributed across the cluster, it's possible we don't have the series indexed here. ignore
@@ -183,8 +244,6 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 		}
 	}
 
-	fieldCount := len(fields)
-	rawColumnValues := make([]rawColumnValue, fieldCount, fieldCount)
 	query := querySpec.SelectQuery()
 
 	aliases := query.GetTableAliases(seriesName)
@@ -200,128 +259,49 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 		return nil
 	}
 
-	fieldNames, iterators := self.getIterators(fields, startTimeBytes, endTimeBytes, query.Ascending)
-	defer func() {
-		for _, it := range iterators {
-			it.Close()
-		}
-	}()
-
-	seriesOutgoing := &protocol.Series{Name: protocol.String(seriesName), Fields: fieldNames, Points: make([]*protocol.Point, 0, self.pointBatchSize)}
+	cursor, err := self.queryCursor(querySpec, seriesName, fields)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	fieldNames := cursor.Fields()
 
-	// TODO: clean up, this is super gnarly
-	// optimize for the case where we're pulling back only a single column or aggregate
-	buffer := bytes.NewBuffer(nil)
-	valueBuffer := proto.NewBuffer(nil)
+	// the points are read from leveldb one batch at a time, no more
+	// points are read once the processor doesn't want them or the limit
+	// of the query is reached
+	limit := querySpec.PointLimit()
+	read := 0
+	var remaining []*protocol.Point
 	for {
-		isValid := false
-		point := &protocol.Point{Values: make([]*protocol.FieldValue, fieldCount, fieldCount)}
-
-		for i, it := range iterators {
-			if rawColumnValues[i].value != nil || !it.Valid() {
-				continue
-			}
-
-			key := it.Key()
-			if len(key) < 16 {
-				continue
-			}
-
-			if !isPointInRange(fields[i].Id, startTimeBytes, endTimeBytes, key) {
-				continue
-			}
-
-			value := it.Value()
-			sequenceNumber := key[16:]
-
-			rawTime := key[8:16]
-			rawColumnValues[i] = rawColumnValue{time: rawTime, sequence: sequenceNumber, value: value}
+		if querySpec.IsCancelled() {
+			return errors.New("The query was cancelled")
 		}
-
-		var pointTimeRaw []byte
-		var pointSequenceRaw []byte
-		// choose the highest (or lowest in case of ascending queries) timestamp
-		// and sequence number. that will become the timestamp and sequence of
-		// the next point.
-		for _, value := range rawColumnValues {
-			if value.value == nil {
-				continue
-			}
-
-			pointTimeRaw, pointSequenceRaw = value.updatePointTimeAndSequence(pointTimeRaw,
-				pointSequenceRaw, query.Ascending)
+		batchSize := self.pointBatchSize
+		if limit > 0 && limit-read < batchSize {
+			batchSize = limit - read
 		}
-
-		for i, iterator := range iterators {
-			// if the value is nil or doesn't match the point's timestamp and sequence number
-			// then skip it
-			if rawColumnValues[i].value == nil ||
-				!bytes.Equal(rawColumnValues[i].time, pointTimeRaw) ||
-				!bytes.Equal(rawColumnValues[i].sequence, pointSequenceRaw) {
-
-				point.Values[i] = &protocol.FieldValue{IsNull: &TRUE}
-				continue
-			}
-
-			// if we emitted at lease one column, then we should keep
-			// trying to get more points
-			isValid = true
-
-			// advance the iterator to read a new value in the next iteration
-			if query.Ascending {
-				iterator.Next()
-			} else {
-				iterator.Prev()
-			}
-
-			fv := &protocol.FieldValue{}
-			valueBuffer.SetBuf(rawColumnValues[i].value)
-			err := valueBuffer.Unmarshal(fv)
-			if err != nil {
-				log.Error("Error while running query: %s", err)
-				return err
-			}
-			point.Values[i] = fv
-			rawColumnValues[i].value = nil
+		points, err := cursor.NextBatch(batchSize)
+		if err != nil {
+			log.Error("Error while running query: %s", err)
+			return err
 		}
-
-		var sequence uint64
-		var t uint64
-
-		// set the point sequence number and timestamp
-		buffer.Reset()
-		buffer.Write(pointSequenceRaw)
-		binary.Read(buffer, binary.BigEndian, &sequence)
-		buffer.Reset()
-		buffer.Write(pointTimeRaw)
-		binary.Read(buffer, binary.BigEndian, &t)
-
-		time := self.convertUintTimestampToInt64(&t)
-		point.SetTimestampInMicroseconds(time)
-		point.SequenceNumber = &sequence
-
-		// stop the loop if we ran out of points
-		if !isValid {
+		read += len(points)
+		if len(points) < self.pointBatchSize || (limit > 0 && read >= limit) {
+			remaining = points
 			break
 		}
 
 		shouldContinue := true
-
-		seriesOutgoing.Points = append(seriesOutgoing.Points, point)
-
-		if len(seriesOutgoing.Points) >= self.pointBatchSize {
-			for _, alias := range aliases {
-				series := &protocol.Series{
-					Name:   proto.String(alias),
-					Fields: fieldNames,
-					Points: seriesOutgoing.Points,
-				}
-				if !processor.YieldSeries(series) {
-					log.Info("Stopping processing")
-					shouldContinue = false
-				}
+		for _, alias := range aliases {
+			series := &protocol.Series{
+				Name:   proto.String(alias),
+				Fields: fieldNames,
+				Points: points,
+			}
+			if !processor.YieldSeries(series) {
+				log.Info("Stopping processing")
+				shouldContinue = false
 			}
-			seriesOutgoing = &protocol.Series{Name: protocol.String(seriesName), Fields: fieldNames, Points: make([]*protocol.Point, 0, self.pointBatchSize)}
 		}
 
 		if !shouldContinue {
@@ -332,7 +312,7 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 	//Yield remaining data
 	for _, alias := range aliases {
 		log.Debug("Final Flush %s", alias)
-		series := &protocol.Series{Name: protocol.String(alias), Fields: seriesOutgoing.Fields, Points: seriesOutgoing.Points}
+		series := &protocol.Series{Name: protocol.String(alias), Fields: fieldNames, Points: remaining}
 		if !processor.YieldSeries(series) {
 			log.Debug("Cancelled...")
 		}
@@ -342,10 +322,40 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 	return nil
 }
 
+// Returns a cursor over the points of the series, only the time ranges
+// of the index are read when the query has an equality on an indexed
+// column
+func (self *LevelDbShard) queryCursor(querySpec *parser.QuerySpec, seriesName string, fields []*Field) (cluster.SeriesCursor, error) {
+	ranges, ok, err := self.indexedTimeRanges(querySpec, seriesName)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return self.newRangesCursor(querySpec, seriesName, fields, ranges), nil
+	}
+	cursor, err := self.newSeriesCursor(querySpec, seriesName, fields)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// Yields the names of the series of the database in order. With a limit
+// only the first offset + limit names are yielded, the coordinator skips
+// the offset once it merged the names of every shard. With a last_write
+// condition every series is yielded with a point at the max time of its
+// stats, the coordinator filters them once it has the last write of the
+// series in every shard. The series indexed before the shards kept the
+// stats don't have a last write and aren't yielded.
 func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	it := self.db.NewIterator(self.readOptions)
 	defer it.Close()
 
+	listQuery := querySpec.Query().ListQuery
+	remaining := -1
+	if listQuery.Limit > 0 && !listQuery.HasLastWriteCondition() {
+		remaining = listQuery.Limit + listQuery.Offset
+	}
 	database := querySpec.Database()
 	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(querySpec.Database()+"~")...)
 	it.Seek(seekKey)
@@ -362,15 +372,100 @@ func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, pr
 				break
 			}
 			name := parts[1]
-			shouldContinue := processor.YieldPoint(&name, nil, nil)
+			if !listQuery.Matches(name) {
+				continue
+			}
+			var point *protocol.Point
+			if listQuery.HasLastWriteCondition() {
+				stats, err := decodeSeriesStats(it.Value())
+				if err != nil {
+					return err
+				}
+				if stats == nil || stats.PointsWritten == 0 {
+					continue
+				}
+				point = &protocol.Point{Timestamp: proto.Int64(stats.MaxTime)}
+			}
+			shouldContinue := processor.YieldPoint(&name, nil, point)
 			if !shouldContinue {
 				return nil
 			}
+			if remaining--; remaining == 0 {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Yields a series for every listed series the user can read with a point
+// for each of its fields. The type of a field is the one of its last
+// value in the shard, null if the shard doesn't have any.
+func (self *LevelDbShard) executeListFieldsQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	listQuery := querySpec.Query().ListQuery
+	database := querySpec.Database()
+	names := []string{listQuery.Series}
+	if listQuery.Regex != nil {
+		regex, _ := listQuery.Regex.GetCompiledRegex()
+		names = self.getSeriesForDbAndRegex(database, regex)
+	}
+
+	for _, name := range names {
+		if !querySpec.HasReadAccess(name) {
+			continue
+		}
+		columns := self.getColumnNamesForSeries(database, name)
+		if len(columns) == 0 {
+			continue
+		}
+		points := make([]*protocol.Point, 0, len(columns))
+		for _, column := range columns {
+			fieldType, err := self.getFieldType(database, name, column)
+			if err != nil {
+				return err
+			}
+			// a value without any of its fields set is a null
+			typeValue := &protocol.FieldValue{}
+			if fieldType != "" {
+				typeValue.StringValue = protocol.String(fieldType)
+			}
+			points = append(points, &protocol.Point{
+				Values: []*protocol.FieldValue{&protocol.FieldValue{StringValue: protocol.String(column)}, typeValue},
+			})
+		}
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"name", "type"}, Points: points}
+		if !processor.YieldSeries(series) {
+			return nil
 		}
 	}
 	return nil
 }
 
+// Returns the type name of the last value of the column, empty if the
+// shard doesn't have any
+func (self *LevelDbShard) getFieldType(database, series, column string) (string, error) {
+	id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+	if err != nil || id == nil {
+		return "", err
+	}
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	it.Seek(append(append(append([]byte{}, id...), MAX_SEQUENCE...), MAX_SEQUENCE...))
+	if it.Valid() {
+		it.Prev()
+	} else {
+		it.SeekToLast()
+	}
+	if !it.Valid() || !bytes.HasPrefix(it.Key(), id) {
+		return "", it.GetError()
+	}
+	value := &protocol.FieldValue{}
+	if err := self.valueCodec.Decode(it.Value(), value); err != nil {
+		return "", err
+	}
+	return value.GetTypeName(), nil
+}
+
 func (self *LevelDbShard) executeDeleteQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	query := querySpec.DeleteQuery()
 	series := query.GetFromClause()
@@ -391,41 +486,68 @@ func (self *LevelDbShard) executeDeleteQuery(querySpec *parser.QuerySpec, proces
 			return err
 		}
 	}
-	self.compact()
+	self.Compact()
 	return nil
 }
 
 func (self *LevelDbShard) executeDropSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	database := querySpec.Database()
-	series := querySpec.Query().DropSeriesQuery.GetTableName()
-	err := self.dropSeries(database, series)
+	query := querySpec.Query().DropSeriesQuery
+	series := []string{query.GetTableName()}
+	if regex, ok := query.GetRegex(); ok {
+		series = self.getSeriesForDbAndRegex(database, regex)
+	}
+
+	if query.Explain {
+		// only tell which series would be dropped
+		for _, name := range series {
+			name := name
+			if !processor.YieldPoint(&name, nil, nil) {
+				break
+			}
+		}
+		return nil
+	}
+
+	err := self.dropSeries(database, series...)
 	if err != nil {
 		return err
 	}
-	self.compact()
+	self.Compact()
 	return nil
 }
 
-func (self *LevelDbShard) dropSeries(database, series string) error {
+// Deletes the points of the series then removes all of them from the
+// indexes at once
+func (self *LevelDbShard) dropSeries(database string, series ...string) error {
 	startTimeBytes := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	endTimeBytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
 	wb := levigo.NewWriteBatch()
 	defer wb.Close()
 
-	if err := self.deleteRangeOfSeriesCommon(database, series, startTimeBytes, endTimeBytes); err != nil {
-		return err
+	for _, s := range series {
+		if err := self.deleteRangeOfSeriesCommon(database, s, startTimeBytes, endTimeBytes); err != nil {
+			return err
+		}
+		self.deleteSeriesIndexes(wb, database, s)
 	}
 
+	// remove the column indeces for these time series
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// Removes the series, its columns and their field types and value
+// indexes from the indexes of the shard in the batch
+func (self *LevelDbShard) deleteSeriesIndexes(wb *levigo.WriteBatch, database, series string) {
 	for _, name := range self.getColumnNamesForSeries(database, series) {
 		indexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(database+"~"+series+"~"+name)...)
 		wb.Delete(indexKey)
+		wb.Delete(fieldTypeKey(database, series, name))
 	}
 
 	wb.Delete(append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+series)...))
-
-	// remove the column indeces for this time series
-	return self.db.Write(self.writeOptions, wb)
+	self.deleteColumnIndex(wb, database, series)
 }
 
 func (self *LevelDbShard) byteArrayForTimeInt(time int64) []byte {
@@ -440,38 +562,39 @@ func (self *LevelDbShard) byteArraysForStartAndEndTimes(startTime, endTime int64
 }
 
 func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, startTimeBytes, endTimeBytes []byte) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	if _, err := self.deleteRangeOfSeriesInBatch(wb, 0, database, series, startTimeBytes, endTimeBytes); err != nil {
+		return err
+	}
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// Adds the deletes of the points of the series between the two times to
+// the write batch, which is written every writeBatchSize deletes. Only
+// the keys are looked at, the iterator seeks to the start of the range of
+// every column. Returns the number of deletes left in the batch.
+func (self *LevelDbShard) deleteRangeOfSeriesInBatch(wb *levigo.WriteBatch, count int, database, series string, startTimeBytes, endTimeBytes []byte) (int, error) {
 	columns := self.getColumnNamesForSeries(database, series)
 	fields, err := self.getFieldsForSeries(database, series, columns)
 	if err != nil {
 		// because a db is distributed across the cluster, it's possible we don't have the series indexed here. ignore
 		switch err := err.(type) {
 		case FieldLookupError:
-			return nil
+			return count, nil
 		default:
-			return err
+			return count, err
 		}
 	}
 	ro := levigo.NewReadOptions()
 	defer ro.Close()
 	ro.SetFillCache(false)
-	wb := levigo.NewWriteBatch()
-	count := 0
-	defer wb.Close()
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+
 	for _, field := range fields {
-		it := self.db.NewIterator(ro)
-		defer it.Close()
-
-		startKey := append(field.Id, startTimeBytes...)
-		it.Seek(startKey)
-		if it.Valid() {
-			if !bytes.Equal(it.Key()[:8], field.Id) {
-				it.Next()
-				if it.Valid() {
-					startKey = it.Key()
-				}
-			}
-		}
-		for it = it; it.Valid(); it.Next() {
+		startKey := append(append([]byte{}, field.Id...), startTimeBytes...)
+		for it.Seek(startKey); it.Valid(); it.Next() {
 			k := it.Key()
 			if len(k) < 16 || !bytes.Equal(k[:8], field.Id) || bytes.Compare(k[8:16], endTimeBytes) == 1 {
 				break
@@ -479,19 +602,61 @@ func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, sta
 			wb.Delete(k)
 			count++
 			if count >= self.writeBatchSize {
-				err = self.db.Write(self.writeOptions, wb)
-				if err != nil {
-					return err
+				if err := self.db.Write(self.writeOptions, wb); err != nil {
+					return count, err
 				}
 				count = 0
 				wb.Clear()
 			}
 		}
 	}
-	return self.db.Write(self.writeOptions, wb)
+	return count, nil
 }
 
-func (self *LevelDbShard) compact() {
+// Deletes the points of every series of the database older than the
+// given time, writeBatchSize points at a time
+func (self *LevelDbShard) DropPointsBefore(database string, t time.Time) error {
+	startTimeBytes, endTimeBytes := self.byteArraysForStartAndEndTimes(math.MinInt64, common.TimeToMicroseconds(t)-1)
+	for _, series := range self.getSeriesForDatabase(database) {
+		stats, err := self.getSeriesStats(database, series)
+		if err != nil {
+			return err
+		}
+		if stats != nil && stats.MinTime >= common.TimeToMicroseconds(t) {
+			continue
+		}
+		if err := self.deleteRangeOfSeriesCommon(database, series, startTimeBytes, endTimeBytes); err != nil {
+			return err
+		}
+		if err := self.raiseSeriesMinTime(database, series, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the number of levels of the sstables of leveldb
+const LEVELDB_LEVELS = 7
+
+// Returns the number of sstables of the shard in every level and in
+// total. Many tables in level 0 mean the compactions can't keep up with
+// the writes, the reads have to look at every one of them.
+func (self *LevelDbShard) Stats() map[string]int64 {
+	stats := map[string]int64{}
+	if self.closed {
+		return stats
+	}
+	total := int64(0)
+	for level := 0; level < LEVELDB_LEVELS; level++ {
+		files, _ := strconv.ParseInt(self.db.PropertyValue(fmt.Sprintf("leveldb.num-files-at-level%d", level)), 10, 64)
+		stats[fmt.Sprintf("leveldb.level%d_files", level)] = files
+		total += files
+	}
+	stats["leveldb.files"] = total
+	return stats
+}
+
+func (self *LevelDbShard) Compact() {
 	log.Info("Compacting shard")
 	self.db.CompactRange(levigo.Range{})
 	log.Info("Shard compaction is done")
@@ -503,19 +668,35 @@ func (self *LevelDbShard) deleteRangeOfSeries(database, series string, startTime
 }
 
 func (self *LevelDbShard) deleteRangeOfRegex(database string, regex *regexp.Regexp, startTime, endTime time.Time) error {
-	series := self.getSeriesForDbAndRegex(database, regex)
-	for _, name := range series {
-		err := self.deleteRangeOfSeries(database, name, startTime, endTime)
-		if err != nil {
+	startTimeBytes, endTimeBytes := self.byteArraysForStartAndEndTimes(common.TimeToMicroseconds(startTime), common.TimeToMicroseconds(endTime))
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	// the deletes of the series share the batches, matching many small
+	// series doesn't mean as many writes
+	count := 0
+	for _, name := range self.getSeriesForDbAndRegex(database, regex) {
+		var err error
+		if count, err = self.deleteRangeOfSeriesInBatch(wb, count, database, name, startTimeBytes, endTimeBytes); err != nil {
 			return err
 		}
 	}
-	return nil
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// a wildcard selects every column of the series, no matter which other
+// columns are referenced, e.g. `select value, * from foo`
+func isWildcardSelect(columns []string) bool {
+	for _, column := range columns {
+		if column == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 func (self *LevelDbShard) getFieldsForSeries(db, series string, columns []string) ([]*Field, error) {
 	isCountQuery := false
-	if len(columns) > 0 && columns[0] == "*" {
+	if isWildcardSelect(columns) {
 		columns = self.getColumnNamesForSeries(db, series)
 	} else if len(columns) == 0 {
 		isCountQuery = true
@@ -592,7 +773,7 @@ func (self *LevelDbShard) byteArrayForTime(t time.Time) []byte {
 
 func (self *LevelDbShard) getSeriesForDbAndRegex(database string, regex *regexp.Regexp) []string {
 	names := []string{}
-	allSeries := self.getSeriesForDatabase(database)
+	allSeries := self.getSeriesForDatabaseWithPrefix(database, seriesPrefixOfRegex(regex))
 	for _, name := range allSeries {
 		if regex.MatchString(name) {
 			names = append(names, name)
@@ -601,11 +782,56 @@ func (self *LevelDbShard) getSeriesForDbAndRegex(database string, regex *regexp.
 	return names
 }
 
+// Returns the literal prefix of the names matched by an anchored regex,
+// e.g. cpu. for /^cpu\./, the series index is sorted by name so only the
+// series with the prefix have to be matched against the regex
+func seriesPrefixOfRegex(regex *regexp.Regexp) string {
+	re, err := syntax.Parse(regex.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	prefix, _ := regex.LiteralPrefix()
+	return prefix
+}
+
+func (self *LevelDbShard) Databases() []string {
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+
+	dbNameStart := len(DATABASE_SERIES_INDEX_PREFIX)
+	databases := []string{}
+	for it.Seek(DATABASE_SERIES_INDEX_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < dbNameStart || !bytes.Equal(key[:dbNameStart], DATABASE_SERIES_INDEX_PREFIX) {
+			break
+		}
+		parts := strings.Split(string(key[dbNameStart:]), "~")
+		if len(parts) < 2 {
+			continue
+		}
+		if len(databases) == 0 || databases[len(databases)-1] != parts[0] {
+			databases = append(databases, parts[0])
+		}
+	}
+	return databases
+}
+
+func (self *LevelDbShard) SeriesNames(database string) []string {
+	return self.getSeriesForDatabase(database)
+}
+
 func (self *LevelDbShard) getSeriesForDatabase(database string) []string {
+	return self.getSeriesForDatabaseWithPrefix(database, "")
+}
+
+func (self *LevelDbShard) getSeriesForDatabaseWithPrefix(database, prefix string) []string {
 	it := self.db.NewIterator(self.readOptions)
 	defer it.Close()
 
-	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~")...)
+	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+prefix)...)
 	it.Seek(seekKey)
 	dbNameStart := len(DATABASE_SERIES_INDEX_PREFIX)
 	names := make([]string, 0)
@@ -621,6 +847,9 @@ func (self *LevelDbShard) getSeriesForDatabase(database string) []string {
 				break
 			}
 			name := parts[1]
+			if !strings.HasPrefix(name, prefix) {
+				break
+			}
 			names = append(names, name)
 		}
 	}
@@ -677,8 +906,14 @@ func (self *LevelDbShard) getNextIdForColumn(db, series, column *string) (ret []
 	wb := levigo.NewWriteBatch()
 	defer wb.Close()
 	wb.Put(NEXT_ID_KEY, idBytes)
-	databaseSeriesIndexKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(*db+"~"+*series)...)
-	wb.Put(databaseSeriesIndexKey, []byte{})
+	// the series is indexed when its first column is, the value of the
+	// key has the stats of the series
+	databaseSeriesIndexKey := seriesStatsKey(*db, *series)
+	if stats, err := self.db.Get(self.readOptions, databaseSeriesIndexKey); err != nil {
+		return nil, err
+	} else if stats == nil {
+		wb.Put(databaseSeriesIndexKey, []byte{})
+	}
 	seriesColumnIndexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(*db+"~"+*series+"~"+*column)...)
 	wb.Put(seriesColumnIndexKey, idBytes)
 	if err = self.db.Write(self.writeOptions, wb); err != nil {
@@ -687,7 +922,7 @@ func (self *LevelDbShard) getNextIdForColumn(db, series, column *string) (ret []
 	return idBytes, nil
 }
 
-func (self *LevelDbShard) close() {
+func (self *LevelDbShard) Close() {
 	self.closed = true
 	self.readOptions.Close()
 	self.writeOptions.Close()
@@ -726,15 +961,16 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 		if data, err := self.db.Get(self.readOptions, pointKey); err != nil {
 			return nil, err
 		} else {
+			if data == nil {
+				continue
+			}
 			fieldValue := &protocol.FieldValue{}
-			err := proto.Unmarshal(data, fieldValue)
+			err := self.valueCodec.Decode(data, fieldValue)
 			if err != nil {
 				return nil, err
 			}
-			if data != nil {
-				fieldNames = append(fieldNames, field.Name)
-				point.Values = append(point.Values, fieldValue)
-			}
+			fieldNames = append(fieldNames, field.Name)
+			point.Values = append(point.Values, fieldValue)
 		}
 	}
 
@@ -743,20 +979,23 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 	return result, nil
 }
 
-func (self *LevelDbShard) getIterators(fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*levigo.Iterator) {
+func (self *LevelDbShard) getIterators(ro *levigo.ReadOptions, fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*levigo.Iterator) {
 	iterators = make([]*levigo.Iterator, len(fields))
 	fieldNames = make([]string, len(fields))
 
 	// start the iterators to go through the series data
 	for i, field := range fields {
 		fieldNames[i] = field.Name
-		iterators[i] = self.db.NewIterator(self.readOptions)
+		iterators[i] = self.db.NewIterator(ro)
 		if isAscendingQuery {
 			iterators[i].Seek(append(field.Id, start...))
 		} else {
+			// seek past the end of the range and step back to its last point
 			iterators[i].Seek(append(append(field.Id, end...), MAX_SEQUENCE...))
 			if iterators[i].Valid() {
 				iterators[i].Prev()
+			} else {
+				iterators[i].SeekToLast()
 			}
 		}
 	}
@@ -0,0 +1,257 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	log "code.google.com/p/log4go"
+	"github.com/jmhodges/levigo"
+)
+
+// the first bytes of the backups streamed by Backup
+var SHARD_BACKUP_MAGIC = []byte("influxdb shard backup 1\n")
+
+// A point in time view of a shard, the shard keeps taking writes while
+// the snapshot is written to a backup
+type levelDbShardSnapshot struct {
+	shard    *LevelDbShard
+	snapshot *levigo.Snapshot
+}
+
+// Returns a snapshot of the shard, points written after this call
+// aren't included in the backup. The snapshot has to be released
+// before the shard is closed.
+func (self *LevelDbShard) Snapshot() cluster.LocalShardSnapshot {
+	return &levelDbShardSnapshot{self, self.db.NewSnapshot()}
+}
+
+// Writes the snapshot to a new leveldb database in the given
+// directory, which must not exist yet
+func (self *levelDbShardSnapshot) WriteTo(dir string) error {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	backup, err := levigo.Open(dir, opts)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetSnapshot(self.snapshot)
+	ro.SetFillCache(false)
+	return copyLevelDb(self.shard.db, ro, backup, self.shard.writeBatchSize)
+}
+
+// Streams the snapshot to w. Every key and value of the shard is
+// written with its length, a key of length 0 marks the end of the
+// backup so a truncated backup can't be restored.
+func (self *levelDbShardSnapshot) Backup(w io.Writer) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetSnapshot(self.snapshot)
+	ro.SetFillCache(false)
+
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(SHARD_BACKUP_MAGIC); err != nil {
+		return err
+	}
+	it := self.shard.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := writeBackupRecord(writer, it.Key()); err != nil {
+			return err
+		}
+		if err := writeBackupRecord(writer, it.Value()); err != nil {
+			return err
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	if err := writeBackupRecord(writer, nil); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func (self *levelDbShardSnapshot) Release() {
+	self.shard.db.ReleaseSnapshot(self.snapshot)
+}
+
+// Replaces the shard with the backup in the given directory. The shard
+// is closed and its data deleted first, so this should only be used on
+// shards that don't get any writes yet.
+func (self *LevelDbShardDatastore) RestoreShard(id uint32, dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Cannot find the backup of shard %d: %s", id, err)
+	}
+	shardOptions, err := self.levelDbOptions()
+	if err != nil {
+		return err
+	}
+	if err := self.DeleteShard(id); err != nil {
+		return err
+	}
+
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	backup, err := levigo.Open(dir, opts)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	shard, err := levigo.Open(self.shardDir(id), shardOptions)
+	if err != nil {
+		return err
+	}
+	defer shard.Close()
+
+	log.Info("DATASTORE: restoring shard %s from %s", self.shardDir(id), dir)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	return copyLevelDb(backup, ro, shard, self.writeBatchSize)
+}
+
+// Replaces the shard with the backup streamed from r by Backup, with
+// the same caveats as RestoreShard
+func (self *LevelDbShardDatastore) RestoreShardFrom(id uint32, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(SHARD_BACKUP_MAGIC))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, SHARD_BACKUP_MAGIC) {
+		return fmt.Errorf("The backup of shard %d isn't a shard backup", id)
+	}
+	shardOptions, err := self.levelDbOptions()
+	if err != nil {
+		return err
+	}
+	if err := self.DeleteShard(id); err != nil {
+		return err
+	}
+
+	shard, err := levigo.Open(self.shardDir(id), shardOptions)
+	if err != nil {
+		return err
+	}
+	log.Info("DATASTORE: restoring shard %s from a stream", self.shardDir(id))
+	err = readBackupRecords(reader, shard, self.writeBatchSize)
+	shard.Close()
+	if err != nil {
+		// don't leave half a shard behind
+		os.RemoveAll(self.shardDir(id))
+		return fmt.Errorf("Cannot restore shard %d: %s", id, err)
+	}
+	return nil
+}
+
+// The backups are leveldb databases, they can only be restored to the
+// shards of the leveldb engine
+func (self *LevelDbShardDatastore) levelDbOptions() (*levigo.Options, error) {
+	engine, ok := self.storageEngine.(*levelDbStorageEngine)
+	if !ok {
+		return nil, fmt.Errorf("Backups can only be restored with the %s storage engine", LEVELDB_STORAGE_ENGINE)
+	}
+	return engine.options, nil
+}
+
+func writeBackupRecord(w *bufio.Writer, data []byte) error {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBackupRecord(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func readBackupRecords(r *bufio.Reader, dst *levigo.DB, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	count := 0
+	for {
+		key, err := readBackupRecord(r)
+		if err == io.EOF {
+			return fmt.Errorf("The backup is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readBackupRecord(r)
+		if err == io.EOF {
+			return fmt.Errorf("The backup is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		wb.Put(key, value)
+		count++
+		if count >= batchSize {
+			if err := dst.Write(wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+			count = 0
+		}
+	}
+	return dst.Write(wo, wb)
+}
+
+func copyLevelDb(src *levigo.DB, ro *levigo.ReadOptions, dst *levigo.DB, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	it := src.NewIterator(ro)
+	defer it.Close()
+
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		wb.Put(it.Key(), it.Value())
+		count++
+		if count >= batchSize {
+			if err := dst.Write(wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+			count = 0
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	return dst.Write(wo, wb)
+}
@@ -0,0 +1,34 @@
+package datastore
+
+import (
+	"cluster"
+	"common"
+	"encoding/base64"
+	"protocol"
+)
+
+var cardinalityFields = []string{"database", "series", "sketch"}
+
+// Yields a point per database of the shard with the number of its series
+// and the sketch of their names, the coordinator merges the sketches of
+// the shards to estimate the series of the database in the cluster
+func (self *LevelDbShard) executeCardinalityQuery(processor cluster.QueryProcessor) error {
+	databases := self.Databases()
+	points := make([]*protocol.Point, 0, len(databases))
+	for _, database := range databases {
+		sketch := common.NewHyperLogLog()
+		names := self.getSeriesForDatabase(database)
+		for _, name := range names {
+			sketch.Add(name)
+		}
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{StringValue: protocol.String(database)},
+				&protocol.FieldValue{Int64Value: protocol.Int64(int64(len(names)))},
+				&protocol.FieldValue{StringValue: protocol.String(base64.StdEncoding.EncodeToString(sketch.Bytes()))},
+			},
+		})
+	}
+	processor.YieldSeries(&protocol.Series{Name: protocol.String("cardinality"), Fields: cardinalityFields, Points: points})
+	return nil
+}
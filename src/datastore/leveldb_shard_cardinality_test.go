@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"common"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"parser"
+	"protocol"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_CARDINALITY_DIR = "/tmp/influxdb/leveldb_shard_cardinality_test"
+
+type LevelDbCardinalitySuite struct{}
+
+var _ = Suite(&LevelDbCardinalitySuite{})
+
+func (self *LevelDbCardinalitySuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_CARDINALITY_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbCardinalitySuite) TestTheSketchesEstimateTheSeriesOfEachDatabase(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CARDINALITY_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		series := columnIndexTestSeries("web-1", now, int64(i))
+		series[0].Name = protocol.String(fmt.Sprintf("cpu.%d", i))
+		c.Assert(shard.Write("db1", series), IsNil)
+	}
+	c.Assert(shard.Write("db2", columnIndexTestSeries("web-1", now, 1)), IsNil)
+
+	queries, err := parser.ParseQuery("show cardinality")
+	c.Assert(err, IsNil)
+	processor := &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.points, HasLen, 2)
+	sketches := map[string]*common.HyperLogLog{}
+	for _, point := range processor.points {
+		registers, err := base64.StdEncoding.DecodeString(point.Values[2].GetStringValue())
+		c.Assert(err, IsNil)
+		sketches[point.Values[0].GetStringValue()], err = common.HyperLogLogFromBytes(registers)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(processor.points[0].Values[1].GetInt64Value(), Equals, int64(1000))
+	estimate := sketches["db1"].Estimate()
+	c.Assert(estimate > 950 && estimate < 1050, Equals, true)
+	c.Assert(sketches["db2"].Estimate(), Equals, uint64(1))
+	// the series that are in the shard don't change the sketches
+	c.Assert(sketches["db1"].Add("cpu.0"), Equals, false)
+	c.Assert(sketches["db2"].Add("cpu"), Equals, false)
+}
@@ -0,0 +1,433 @@
+package datastore
+
+import (
+	"bytes"
+	"common"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"parser"
+	"protocol"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+// The shards index the string values of the columns in the
+// indexed-columns setting, e.g. the host of the points. The index maps
+// the series, the column and a value to the time range of the points
+// with that value in every hour. A query with an equality on an indexed
+// column only reads the points of those ranges. The where condition is
+// still evaluated on the points that are read, so the ranges only have
+// to cover the points of the value, e.g. the ranges of a value aren't
+// updated when its points are overwritten or deleted.
+//
+// The index of a column starts with the first write that indexes it,
+// the points the series had before that are read as if the column
+// wasn't indexed.
+
+var (
+	// COLUMN_VALUE_INDEX_PREFIX is the prefix of the time ranges of the
+	// values, followed by the database, series and column names, the
+	// length of the value, the value and the start of the hour
+	COLUMN_VALUE_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF6}
+	// COLUMN_INDEX_START_PREFIX is the prefix of the time range of the
+	// points a column index doesn't cover, followed by the database,
+	// series and column names
+	COLUMN_INDEX_START_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF5}
+)
+
+// the length of the time ranges of the index in microseconds
+const COLUMN_INDEX_BUCKET_SIZE = int64(time.Hour / time.Microsecond)
+
+// The times of the first and the last point of a range in microseconds,
+// both included
+type timeRange struct {
+	start int64
+	end   int64
+}
+
+func (self *timeRange) add(timestamp int64) {
+	if timestamp < self.start {
+		self.start = timestamp
+	}
+	if timestamp > self.end {
+		self.end = timestamp
+	}
+}
+
+func (self *timeRange) encode() []byte {
+	data := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutVarint(data, self.start)
+	n += binary.PutVarint(data[n:], self.end)
+	return data[:n]
+}
+
+func decodeTimeRange(data []byte) (*timeRange, error) {
+	buffer := bytes.NewBuffer(data)
+	r := &timeRange{}
+	var err error
+	if r.start, err = binary.ReadVarint(buffer); err != nil {
+		return nil, fmt.Errorf("Invalid column index range: %s", err)
+	}
+	if r.end, err = binary.ReadVarint(buffer); err != nil {
+		return nil, fmt.Errorf("Invalid column index range: %s", err)
+	}
+	return r, nil
+}
+
+// The start of a column index is the range of the points it doesn't
+// cover, nil if it covers all of them
+func encodeColumnIndexStart(unindexed *timeRange) []byte {
+	if unindexed == nil {
+		return []byte{0}
+	}
+	return append([]byte{1}, unindexed.encode()...)
+}
+
+func decodeColumnIndexStart(data []byte) (*timeRange, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Invalid column index start")
+	}
+	if data[0] == 0 {
+		return nil, nil
+	}
+	return decodeTimeRange(data[1:])
+}
+
+func columnIndexStartKey(database, series, column string) []byte {
+	return append(append([]byte{}, COLUMN_INDEX_START_PREFIX...), database+"~"+series+"~"+column...)
+}
+
+func columnValueIndexPrefix(database, series, column, value string) []byte {
+	key := append(append([]byte{}, COLUMN_VALUE_INDEX_PREFIX...), database+"~"+series+"~"+column+"~"...)
+	length := make([]byte, binary.MaxVarintLen64)
+	key = append(key, length[:binary.PutUvarint(length, uint64(len(value)))]...)
+	return append(key, value...)
+}
+
+// Returns the start of the hour of the timestamp
+func columnIndexBucket(timestamp int64) int64 {
+	offset := timestamp % COLUMN_INDEX_BUCKET_SIZE
+	if offset < 0 {
+		offset += COLUMN_INDEX_BUCKET_SIZE
+	}
+	return timestamp - offset
+}
+
+// Sets the columns the shard indexes. The index of the columns that
+// aren't indexed anymore is dropped so it isn't used if they're indexed
+// again, it would miss the points written in between.
+func (self *LevelDbShard) setIndexedColumns(columns []string) error {
+	self.indexedColumns = make(map[string]bool, len(columns))
+	for _, column := range columns {
+		self.indexedColumns[column] = true
+	}
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	for it.Seek(COLUMN_INDEX_START_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, COLUMN_INDEX_START_PREFIX) {
+			break
+		}
+		name := string(key[len(COLUMN_INDEX_START_PREFIX):])
+		if !self.indexedColumns[name[strings.LastIndex(name, "~")+1:]] {
+			wb.Delete(key)
+		}
+	}
+	return self.db.Write(self.writeOptions, wb)
+}
+
+// Adds the time ranges of the string values of the indexed columns of
+// the series to the batch. Has to be called with the field types lock,
+// which keeps the ranges from being updated by two writes at once.
+func (self *LevelDbShard) indexColumnValues(wb *levigo.WriteBatch, database string, series []*protocol.Series) error {
+	if len(self.indexedColumns) == 0 {
+		return nil
+	}
+
+	started := map[string]bool{}
+	ranges := map[string]*timeRange{}
+	for _, s := range series {
+		for fieldIndex, field := range s.Fields {
+			if !self.indexedColumns[field] {
+				continue
+			}
+			if startKey := string(columnIndexStartKey(database, s.GetName(), field)); !started[startKey] {
+				if err := self.startColumnIndex(wb, []byte(startKey), database, s.GetName(), field); err != nil {
+					return err
+				}
+				started[startKey] = true
+			}
+
+			for _, point := range s.Points {
+				value := point.Values[fieldIndex]
+				if value == nil || value.StringValue == nil {
+					continue
+				}
+				timestamp := *point.GetTimestampInMicroseconds()
+				key := append(columnValueIndexPrefix(database, s.GetName(), field, *value.StringValue), self.byteArrayForTimeInt(columnIndexBucket(timestamp))...)
+				r := ranges[string(key)]
+				if r == nil {
+					data, err := self.db.Get(self.readOptions, key)
+					if err != nil {
+						return err
+					}
+					if data == nil {
+						r = &timeRange{timestamp, timestamp}
+					} else if r, err = decodeTimeRange(data); err != nil {
+						return err
+					}
+					ranges[string(key)] = r
+				}
+				r.add(timestamp)
+			}
+		}
+	}
+
+	for key, r := range ranges {
+		wb.Put([]byte(key), r.encode())
+	}
+	return nil
+}
+
+// Records the points of the series the index of the column won't cover
+// when it's the first time the column is indexed
+func (self *LevelDbShard) startColumnIndex(wb *levigo.WriteBatch, key []byte, database, series, column string) error {
+	if data, err := self.db.Get(self.readOptions, key); err != nil || data != nil {
+		return err
+	}
+
+	var unindexed *timeRange
+	id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+	if err != nil {
+		return err
+	}
+	if id != nil {
+		stats, err := self.getSeriesStats(database, series)
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			// there's no telling where the points of the series are
+			unindexed = &timeRange{math.MinInt64, math.MaxInt64}
+		} else if stats.PointsWritten > 0 {
+			unindexed = &timeRange{stats.MinTime, stats.MaxTime}
+		}
+	}
+	wb.Put(key, encodeColumnIndexStart(unindexed))
+	return nil
+}
+
+// Removes the index of the columns of the series
+func (self *LevelDbShard) deleteColumnIndex(wb *levigo.WriteBatch, database, series string) {
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	for _, prefix := range [][]byte{COLUMN_INDEX_START_PREFIX, COLUMN_VALUE_INDEX_PREFIX} {
+		seriesPrefix := append(append([]byte{}, prefix...), database+"~"+series+"~"...)
+		for it.Seek(seriesPrefix); it.Valid(); it.Next() {
+			key := it.Key()
+			if !bytes.HasPrefix(key, seriesPrefix) {
+				break
+			}
+			wb.Delete(key)
+		}
+	}
+}
+
+// Returns the column and the value of an equality on an indexed column
+// that has to be true for the condition to be true, e.g. host = 'web-1'
+// in host = 'web-1' and value > 5
+func indexedEquality(condition *parser.WhereCondition, indexedColumns map[string]bool) (string, string, bool) {
+	if condition == nil {
+		return "", "", false
+	}
+
+	if expr, ok := condition.GetBoolExpression(); ok {
+		if expr.Name != "=" || len(expr.Elems) != 2 {
+			return "", "", false
+		}
+		column, value := expr.Elems[0], expr.Elems[1]
+		if column.Type == parser.ValueString {
+			column, value = value, column
+		}
+		if column.Type != parser.ValueSimpleName || value.Type != parser.ValueString || !indexedColumns[column.Name] {
+			return "", "", false
+		}
+		return column.Name, value.Name, true
+	}
+
+	if condition.Operation != "AND" {
+		return "", "", false
+	}
+	left, _ := condition.GetLeftWhereCondition()
+	if column, value, ok := indexedEquality(left, indexedColumns); ok {
+		return column, value, true
+	}
+	return indexedEquality(condition.Right, indexedColumns)
+}
+
+// Returns the time ranges of the series that have the points the query
+// can match in ascending order, false if the query doesn't have an
+// equality on an indexed column
+func (self *LevelDbShard) indexedTimeRanges(querySpec *parser.QuerySpec, series string) ([]*timeRange, bool, error) {
+	if len(self.indexedColumns) == 0 {
+		return nil, false, nil
+	}
+	query := querySpec.SelectQuery()
+	// the conditions of a join are on the joined points
+	if query == nil || query.GetFromClause().Type == parser.FromClauseInnerJoin {
+		return nil, false, nil
+	}
+	column, value, ok := indexedEquality(query.GetWhereCondition(), self.indexedColumns)
+	if !ok {
+		return nil, false, nil
+	}
+
+	data, err := self.db.Get(self.readOptions, columnIndexStartKey(querySpec.Database(), series, column))
+	if err != nil || data == nil {
+		return nil, false, err
+	}
+	unindexed, err := decodeColumnIndexStart(data)
+	if err != nil {
+		return nil, false, err
+	}
+	ranges := []*timeRange{}
+	if unindexed != nil {
+		ranges = append(ranges, unindexed)
+	}
+
+	start := common.TimeToMicroseconds(querySpec.GetStartTime())
+	end := common.TimeToMicroseconds(querySpec.GetEndTime())
+	prefix := columnValueIndexPrefix(querySpec.Database(), series, column, value)
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	// the ranges of the hours before the one of the start of the query
+	// end before it
+	for it.Seek(append(prefix, self.byteArrayForTimeInt(columnIndexBucket(start))...)); it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key(), prefix) {
+			break
+		}
+		r, err := decodeTimeRange(it.Value())
+		if err != nil {
+			return nil, false, err
+		}
+		if r.start > end {
+			break
+		}
+		ranges = append(ranges, r)
+	}
+	return mergeTimeRanges(ranges, start, end), true, nil
+}
+
+type timeRanges []*timeRange
+
+func (self timeRanges) Len() int           { return len(self) }
+func (self timeRanges) Less(i, j int) bool { return self[i].start < self[j].start }
+func (self timeRanges) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the parts of the ranges between start and end in ascending
+// order, the ranges that overlap are merged
+func mergeTimeRanges(ranges []*timeRange, start, end int64) []*timeRange {
+	sort.Sort(timeRanges(ranges))
+	merged := []*timeRange{}
+	for _, r := range ranges {
+		r := &timeRange{r.start, r.end}
+		if r.start < start {
+			r.start = start
+		}
+		if r.end > end {
+			r.end = end
+		}
+		if r.start > r.end {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && r.start <= merged[last].end+1 {
+			merged[last].add(r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Reads the points of the time ranges one after the other, the ranges
+// are in the order of the query and don't overlap. The cursor of a range
+// is only opened once the points of the previous ones were read.
+type levelDbRangesCursor struct {
+	shard      *LevelDbShard
+	querySpec  *parser.QuerySpec
+	seriesName string
+	fields     []*Field
+	fieldNames []string
+	ranges     []*timeRange
+	current    *levelDbSeriesCursor
+}
+
+func (self *LevelDbShard) newRangesCursor(querySpec *parser.QuerySpec, seriesName string, fields []*Field, ranges []*timeRange) *levelDbRangesCursor {
+	fieldNames := make([]string, len(fields))
+	for i, field := range fields {
+		fieldNames[i] = field.Name
+	}
+	if !querySpec.SelectQuery().Ascending {
+		reversed := make([]*timeRange, 0, len(ranges))
+		for i := len(ranges) - 1; i >= 0; i-- {
+			reversed = append(reversed, ranges[i])
+		}
+		ranges = reversed
+	}
+	return &levelDbRangesCursor{
+		shard:      self,
+		querySpec:  querySpec,
+		seriesName: seriesName,
+		fields:     fields,
+		fieldNames: fieldNames,
+		ranges:     ranges,
+	}
+}
+
+func (self *levelDbRangesCursor) Fields() []string {
+	return self.fieldNames
+}
+
+func (self *levelDbRangesCursor) NextBatch(n int) ([]*protocol.Point, error) {
+	points := make([]*protocol.Point, 0, n)
+	for len(points) < n {
+		if self.current == nil {
+			if len(self.ranges) == 0 {
+				break
+			}
+			r := self.ranges[0]
+			self.ranges = self.ranges[1:]
+			cursor, err := self.shard.newSeriesCursorBetween(self.querySpec, self.seriesName, self.fields, common.TimeFromMicroseconds(r.start), common.TimeFromMicroseconds(r.end))
+			if err != nil {
+				return nil, err
+			}
+			self.current = cursor
+		}
+		wanted := n - len(points)
+		batch, err := self.current.NextBatch(wanted)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, batch...)
+		if len(batch) < wanted {
+			self.current.Close()
+			self.current = nil
+		}
+	}
+	return points, nil
+}
+
+func (self *levelDbRangesCursor) Close() {
+	if self.current != nil {
+		self.current.Close()
+		self.current = nil
+	}
+	self.ranges = nil
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bytes"
+	"common"
+	"os"
+	"parser"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_COLUMN_INDEX_DIR = "/tmp/influxdb/leveldb_shard_column_index_test"
+
+type LevelDbColumnIndexSuite struct{}
+
+var _ = Suite(&LevelDbColumnIndexSuite{})
+
+func (self *LevelDbColumnIndexSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_COLUMN_INDEX_DIR)
+	c.Assert(err, IsNil)
+}
+
+func columnIndexTestSeries(host string, t time.Time, value int64) []*protocol.Series {
+	point := &protocol.Point{
+		Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StringValue: protocol.String(host)},
+			&protocol.FieldValue{Int64Value: protocol.Int64(value)},
+		},
+		SequenceNumber: proto.Uint64(1),
+	}
+	point.SetTimestampInMicroseconds(common.TimeToMicroseconds(t))
+	return []*protocol.Series{&protocol.Series{Name: protocol.String("cpu"), Fields: []string{"host", "value"}, Points: []*protocol.Point{point}}}
+}
+
+func queryColumnIndexTestShard(c *C, shard *LevelDbShard, query string) []int64 {
+	queries, err := parser.ParseQuery(query)
+	c.Assert(err, IsNil)
+	processor := &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	values := []int64{}
+	for _, point := range processor.points {
+		values = append(values, point.Values[1].GetInt64Value())
+	}
+	return values
+}
+
+func (self *LevelDbColumnIndexSuite) TestEqualitiesOnIndexedColumnsOnlyReadTheirRanges(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_COLUMN_INDEX_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	c.Assert(shard.setIndexedColumns([]string{"host"}), IsNil)
+
+	now := time.Now()
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-1", now.Add(-3*time.Hour), 1)), IsNil)
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-2", now.Add(-2*time.Hour), 2)), IsNil)
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-1", now, 3)), IsNil)
+
+	// the shard doesn't filter the points, so the point of web-2 is only
+	// missing because its hour isn't read
+	c.Assert(queryColumnIndexTestShard(c, shard, "select host, value from cpu where host = 'web-1' and value > 0"), DeepEquals, []int64{3, 1})
+	c.Assert(queryColumnIndexTestShard(c, shard, "select host, value from cpu where 'web-2' = host order asc"), DeepEquals, []int64{2})
+	c.Assert(queryColumnIndexTestShard(c, shard, "select host, value from cpu where host = 'web-3'"), HasLen, 0)
+	c.Assert(queryColumnIndexTestShard(c, shard, "select host, value from cpu where host = 'web-1' or value > 0"), DeepEquals, []int64{3, 2, 1})
+
+	// the index of the series goes away with it
+	c.Assert(shard.dropSeries("db1", "cpu"), IsNil)
+	it := db.NewIterator(shard.readOptions)
+	defer it.Close()
+	it.Seek(COLUMN_VALUE_INDEX_PREFIX)
+	c.Assert(it.Valid() && bytes.HasPrefix(it.Key(), COLUMN_VALUE_INDEX_PREFIX), Equals, false)
+}
+
+func (self *LevelDbColumnIndexSuite) TestThePointsWrittenBeforeTheColumnWasIndexedAreRead(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_COLUMN_INDEX_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-1", now.Add(-3*time.Hour), 1)), IsNil)
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-2", now.Add(-2*time.Hour), 2)), IsNil)
+	c.Assert(shard.setIndexedColumns([]string{"host"}), IsNil)
+	c.Assert(shard.Write("db1", columnIndexTestSeries("web-1", now, 3)), IsNil)
+
+	c.Assert(queryColumnIndexTestShard(c, shard, "select host, value from cpu where host = 'web-1'"), DeepEquals, []int64{3, 2, 1})
+
+	// the index would miss the points written while the column isn't
+	// indexed
+	c.Assert(shard.setIndexedColumns(nil), IsNil)
+	c.Assert(shard.setIndexedColumns([]string{"host"}), IsNil)
+	data, err := db.Get(shard.readOptions, columnIndexStartKey("db1", "cpu", "host"))
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+}
+
+func (self *LevelDbColumnIndexSuite) TestTimeRangesAreClippedAndMerged(c *C) {
+	ranges := mergeTimeRanges([]*timeRange{{50, 60}, {0, 10}, {5, 20}, {21, 30}, {100, 200}}, 8, 150)
+	c.Assert(ranges, DeepEquals, []*timeRange{{8, 30}, {50, 60}, {100, 150}})
+	c.Assert(columnIndexBucket(COLUMN_INDEX_BUCKET_SIZE+5), Equals, COLUMN_INDEX_BUCKET_SIZE)
+	c.Assert(columnIndexBucket(-5), Equals, -COLUMN_INDEX_BUCKET_SIZE)
+}
@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"parser"
+	"protocol"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+// Reads the points of a series in the time range of a query. The points
+// are only read from leveldb when they are asked for, so the caller
+// decides how many points are in memory at once. All the columns are read
+// from the same snapshot, the points written while the cursor is open
+// aren't seen by any of them.
+type levelDbSeriesCursor struct {
+	shard           *LevelDbShard
+	snapshot        *levigo.Snapshot
+	readOptions     *levigo.ReadOptions
+	fields          []*Field
+	fieldNames      []string
+	iterators       []*levigo.Iterator
+	rawColumnValues []rawColumnValue
+	startTime       []byte
+	endTime         []byte
+	ascending       bool
+	done            bool
+	buffer          *bytes.Buffer
+}
+
+// Returns a cursor over the points of the columns of the series in the
+// time range of the query, the cursor must be closed. Returns a
+// FieldLookupError if the series or one of the columns isn't in the
+// shard.
+func (self *LevelDbShard) SeriesCursor(querySpec *parser.QuerySpec, seriesName string, columns []string) (cluster.SeriesCursor, error) {
+	fields, err := self.getFieldsForSeries(querySpec.Database(), seriesName, columns)
+	if err != nil {
+		return nil, err
+	}
+	return self.newSeriesCursor(querySpec, seriesName, fields)
+}
+
+func (self *LevelDbShard) newSeriesCursor(querySpec *parser.QuerySpec, seriesName string, fields []*Field) (*levelDbSeriesCursor, error) {
+	return self.newSeriesCursorBetween(querySpec, seriesName, fields, querySpec.GetStartTime(), querySpec.GetEndTime())
+}
+
+// Returns a cursor over the points between the two times, both included,
+// in the order of the query
+func (self *LevelDbShard) newSeriesCursorBetween(querySpec *parser.QuerySpec, seriesName string, fields []*Field, startTime, endTime time.Time) (*levelDbSeriesCursor, error) {
+	stats, err := self.getSeriesStats(querySpec.Database(), seriesName)
+	if err != nil {
+		return nil, err
+	}
+	if !stats.mayHavePointsBetween(startTime, endTime) {
+		// no need to look at the points
+		fieldNames := make([]string, len(fields))
+		for i, field := range fields {
+			fieldNames[i] = field.Name
+		}
+		return &levelDbSeriesCursor{shard: self, fields: fields, fieldNames: fieldNames, done: true}, nil
+	}
+
+	startTimeBytes := self.byteArrayForTime(startTime)
+	endTimeBytes := self.byteArrayForTime(endTime)
+	ascending := querySpec.SelectQuery().Ascending
+	snapshot := self.db.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snapshot)
+	fieldNames, iterators := self.getIterators(ro, fields, startTimeBytes, endTimeBytes, ascending)
+	return &levelDbSeriesCursor{
+		shard:           self,
+		snapshot:        snapshot,
+		readOptions:     ro,
+		fields:          fields,
+		fieldNames:      fieldNames,
+		iterators:       iterators,
+		rawColumnValues: make([]rawColumnValue, len(fields)),
+		startTime:       startTimeBytes,
+		endTime:         endTimeBytes,
+		ascending:       ascending,
+		buffer:          bytes.NewBuffer(nil),
+	}, nil
+}
+
+func (self *levelDbSeriesCursor) Fields() []string {
+	return self.fieldNames
+}
+
+// Returns the next n points at most, an empty batch once all the points
+// were read
+func (self *levelDbSeriesCursor) NextBatch(n int) ([]*protocol.Point, error) {
+	points := make([]*protocol.Point, 0, n)
+	for len(points) < n && !self.done {
+		point, err := self.next()
+		if err != nil {
+			return nil, err
+		}
+		if point == nil {
+			self.done = true
+			break
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func (self *levelDbSeriesCursor) Close() {
+	if self.snapshot == nil {
+		return
+	}
+	for _, it := range self.iterators {
+		it.Close()
+	}
+	self.readOptions.Close()
+	self.shard.db.ReleaseSnapshot(self.snapshot)
+	self.iterators = nil
+	self.snapshot = nil
+	self.done = true
+}
+
+// TODO: clean up, this is super gnarly
+// optimize for the case where we're pulling back only a single column or aggregate
+func (self *levelDbSeriesCursor) next() (*protocol.Point, error) {
+	fieldCount := len(self.fields)
+	rawColumnValues := self.rawColumnValues
+	isValid := false
+	point := &protocol.Point{Values: make([]*protocol.FieldValue, fieldCount, fieldCount)}
+
+	for i, it := range self.iterators {
+		if rawColumnValues[i].value != nil || !it.Valid() {
+			continue
+		}
+
+		key := it.Key()
+		if len(key) < 16 {
+			continue
+		}
+
+		if !isPointInRange(self.fields[i].Id, self.startTime, self.endTime, key) {
+			continue
+		}
+
+		value := it.Value()
+		sequenceNumber := key[16:]
+
+		rawTime := key[8:16]
+		rawColumnValues[i] = rawColumnValue{time: rawTime, sequence: sequenceNumber, value: value}
+	}
+
+	var pointTimeRaw []byte
+	var pointSequenceRaw []byte
+	// choose the highest (or lowest in case of ascending queries) timestamp
+	// and sequence number. that will become the timestamp and sequence of
+	// the next point.
+	for _, value := range rawColumnValues {
+		if value.value == nil {
+			continue
+		}
+
+		pointTimeRaw, pointSequenceRaw = value.updatePointTimeAndSequence(pointTimeRaw,
+			pointSequenceRaw, self.ascending)
+	}
+
+	for i, iterator := range self.iterators {
+		// if the value is nil or doesn't match the point's timestamp and sequence number
+		// then skip it
+		if rawColumnValues[i].value == nil ||
+			!bytes.Equal(rawColumnValues[i].time, pointTimeRaw) ||
+			!bytes.Equal(rawColumnValues[i].sequence, pointSequenceRaw) {
+
+			point.Values[i] = &protocol.FieldValue{IsNull: &TRUE}
+			continue
+		}
+
+		// if we emitted at lease one column, then we should keep
+		// trying to get more points
+		isValid = true
+
+		// advance the iterator to read a new value in the next iteration
+		if self.ascending {
+			iterator.Next()
+		} else {
+			iterator.Prev()
+		}
+
+		fv := &protocol.FieldValue{}
+		err := self.shard.valueCodec.Decode(rawColumnValues[i].value, fv)
+		if err != nil {
+			return nil, err
+		}
+		point.Values[i] = fv
+		rawColumnValues[i].value = nil
+	}
+
+	// we ran out of points
+	if !isValid {
+		return nil, nil
+	}
+
+	var sequence uint64
+	var t uint64
+
+	// set the point sequence number and timestamp
+	self.buffer.Reset()
+	self.buffer.Write(pointSequenceRaw)
+	binary.Read(self.buffer, binary.BigEndian, &sequence)
+	self.buffer.Reset()
+	self.buffer.Write(pointTimeRaw)
+	binary.Read(self.buffer, binary.BigEndian, &t)
+
+	time := self.shard.convertUintTimestampToInt64(&t)
+	point.SetTimestampInMicroseconds(time)
+	point.SequenceNumber = &sequence
+	return point, nil
+}
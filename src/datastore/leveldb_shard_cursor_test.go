@@ -0,0 +1,482 @@
+package datastore
+
+import (
+	"common"
+	"os"
+	"parser"
+	"protocol"
+	"regexp"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_CURSOR_DIR = "/tmp/influxdb/leveldb_shard_cursor_test"
+
+type LevelDbShardCursorSuite struct{}
+
+var _ = Suite(&LevelDbShardCursorSuite{})
+
+func (self *LevelDbShardCursorSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_CURSOR_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbShardCursorSuite) TestPointsAreReadInBatches(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	for i := 0; i < 25; i++ {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(now - int64(25-i)*1000000)
+		series.Points = append(series.Points, point)
+	}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+
+	queries, err := parser.ParseQuery("select value from foo where time > now() - 1h order asc;")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(&MockUser{}, "db1", queries[0])
+	cursor, err := shard.SeriesCursor(querySpec, "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+	c.Assert(cursor.Fields(), DeepEquals, []string{"value"})
+
+	values := []int64{}
+	for _, size := range []int{10, 10, 5, 0} {
+		points, err := cursor.NextBatch(10)
+		c.Assert(err, IsNil)
+		c.Assert(points, HasLen, size)
+		for _, point := range points {
+			values = append(values, point.Values[0].GetInt64Value())
+		}
+	}
+	c.Assert(values, HasLen, 25)
+	for i, value := range values {
+		c.Assert(value, Equals, int64(i))
+	}
+
+	_, err = shard.SeriesCursor(querySpec, "bar", []string{"value"})
+	c.Assert(err, FitsTypeOf, FieldLookupError{})
+}
+
+type recordingProcessor struct {
+	points []*protocol.Point
+}
+
+func (self *recordingProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	self.points = append(self.points, point)
+	return true
+}
+
+func (self *recordingProcessor) YieldSeries(series *protocol.Series) bool {
+	self.points = append(self.points, series.Points...)
+	return true
+}
+
+func (self *recordingProcessor) Close()                                    {}
+func (self *recordingProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+func (self *recordingProcessor) GetName() string                           { return "recordingProcessor" }
+
+func (self *LevelDbShardCursorSuite) TestDescendingQueriesReadOnlyTheLimit(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 10, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	for i := 0; i < 25; i++ {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(now - int64(25-i)*1000000)
+		series.Points = append(series.Points, point)
+	}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+
+	for _, query := range []string{
+		"select value from foo where time > now() - 1h limit 3 order desc;",
+		"select value from foo where time > now() - 1h order desc;",
+	} {
+		queries, err := parser.ParseQuery(query)
+		c.Assert(err, IsNil)
+		processor := &recordingProcessor{}
+		c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+		limit := queries[0].SelectQuery.Limit
+		if limit == 0 {
+			limit = 25
+		}
+		c.Assert(processor.points, HasLen, limit)
+		for i, point := range processor.points {
+			c.Assert(point.Values[0].GetInt64Value(), Equals, int64(24-i))
+		}
+	}
+}
+
+func (self *LevelDbShardCursorSuite) TestOnlyTheSelectedColumnsAreRead(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	point := &protocol.Point{
+		Values: []*protocol.FieldValue{
+			&protocol.FieldValue{Int64Value: protocol.Int64(1)},
+			&protocol.FieldValue{StringValue: protocol.String("a")},
+		},
+		SequenceNumber: proto.Uint64(1),
+	}
+	point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value", "host"}, Points: []*protocol.Point{point}}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+
+	queries, err := parser.ParseQuery("select value from foo where time > now() - 1h;")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(&MockUser{}, "db1", queries[0])
+	cursor, err := shard.SeriesCursor(querySpec, "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	c.Assert(cursor.Fields(), DeepEquals, []string{"value"})
+	cursor.Close()
+
+	// the wildcard doesn't have to be the first column
+	cursor, err = shard.SeriesCursor(querySpec, "foo", []string{"value", "*"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+	c.Assert(cursor.Fields(), HasLen, 2)
+	points, err := cursor.NextBatch(10)
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Values, HasLen, 2)
+}
+
+func (self *LevelDbShardCursorSuite) TestRegexQueriesOnlyMatchTheSeriesWithTheirPrefix(c *C) {
+	for regex, prefix := range map[string]string{
+		`^cpu\.`:   "cpu.",
+		`cpu\.`:    "",
+		`^(a|b)`:   "",
+		`(?i)^cpu`: "",
+	} {
+		c.Assert(seriesPrefixOfRegex(regexp.MustCompile(regex)), Equals, prefix)
+	}
+
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"a.cpu.idle", "cpu", "cpu.idle", "cpu.user", "mem.free"} {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+	c.Assert(shard.getSeriesForDbAndRegex("db1", regexp.MustCompile(`^cpu\.`)), DeepEquals, []string{"cpu.idle", "cpu.user"})
+	c.Assert(shard.getSeriesForDbAndRegex("db1", regexp.MustCompile(`cpu\.`)), DeepEquals, []string{"a.cpu.idle", "cpu.idle", "cpu.user"})
+}
+
+func writeCursorTestPoints(c *C, shard *LevelDbShard, count int, value int64) {
+	now := common.TimeToMicroseconds(time.Now())
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value", "other"}}
+	for i := 0; i < count; i++ {
+		point := &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: protocol.Int64(value)},
+				&protocol.FieldValue{Int64Value: protocol.Int64(value)},
+			},
+			SequenceNumber: proto.Uint64(uint64(value)),
+		}
+		point.SetTimestampInMicroseconds(now - int64(i)*1000)
+		series.Points = append(series.Points, point)
+	}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+}
+
+func (self *LevelDbShardCursorSuite) TestCursorsDontSeeTheLaterWrites(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	writeCursorTestPoints(c, shard, 10, 1)
+
+	queries, err := parser.ParseQuery("select value, other from foo where time > now() - 1h;")
+	c.Assert(err, IsNil)
+	cursor, err := shard.SeriesCursor(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), "foo", []string{"value", "other"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+
+	writeCursorTestPoints(c, shard, 10, 2)
+	points, err := cursor.NextBatch(100)
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 10)
+	for _, point := range points {
+		c.Assert(point.GetSequenceNumber(), Equals, uint64(1))
+		c.Assert(point.Values[1].GetInt64Value(), Equals, int64(1))
+	}
+}
+
+func (self *LevelDbShardCursorSuite) BenchmarkReadsWhileWriting(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	writeCursorTestPoints(c, shard, 1000, 1)
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for value := int64(2); ; value++ {
+			select {
+			case <-stop:
+				return
+			default:
+				writeCursorTestPoints(c, shard, 100, value)
+			}
+		}
+	}()
+
+	queries, err := parser.ParseQuery("select value, other from foo where time > now() - 1h;")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(&MockUser{}, "db1", queries[0])
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		cursor, err := shard.SeriesCursor(querySpec, "foo", []string{"value", "other"})
+		c.Assert(err, IsNil)
+		_, err = cursor.NextBatch(1000)
+		c.Assert(err, IsNil)
+		cursor.Close()
+	}
+	c.StopTimer()
+	close(stop)
+	<-stopped
+}
+
+func (self *LevelDbShardCursorSuite) TestSeriesMatchingARegexAreDropped(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"cpu", "temp_1", "temp_2"} {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+
+	// the dry run only returns the series
+	queries, err := parser.ParseQuery("explain drop series /^temp_/")
+	c.Assert(err, IsNil)
+	processor := &recordingSeriesNamesProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.names, DeepEquals, []string{"temp_1", "temp_2"})
+	c.Assert(shard.getSeriesForDatabase("db1"), HasLen, 3)
+
+	queries, err = parser.ParseQuery("drop series /^temp_/")
+	c.Assert(err, IsNil)
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), &recordingProcessor{}), IsNil)
+	c.Assert(shard.getSeriesForDatabase("db1"), DeepEquals, []string{"cpu"})
+}
+
+func (self *LevelDbShardCursorSuite) TestDeletesFromARegexOnlyDeleteTheirTimeRange(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	// a batch size of 1 writes the batch after every delete
+	shard, err := NewLevelDbShard(db, 100, 1, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	for _, name := range []string{"cpu", "sensor_1", "sensor_2"} {
+		points := []*protocol.Point{}
+		for i := 1; i <= 3; i++ {
+			point := &protocol.Point{
+				Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+				SequenceNumber: proto.Uint64(1),
+			}
+			point.SetTimestampInMicroseconds(common.TimeToMicroseconds(now.Add(-time.Duration(i) * time.Hour)))
+			points = append(points, point)
+		}
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: points}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+
+	queries, err := parser.ParseQuery("delete from /^sensor_/ where time > now() - 150m and time < now() - 30m")
+	c.Assert(err, IsNil)
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), &recordingProcessor{}), IsNil)
+
+	for name, expected := range map[string][]int64{"cpu": {1, 2, 3}, "sensor_1": {3}, "sensor_2": {3}} {
+		queries, err := parser.ParseQuery("select value from " + name)
+		c.Assert(err, IsNil)
+		processor := &recordingProcessor{}
+		c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+		values := []int64{}
+		for _, point := range processor.points {
+			values = append(values, point.Values[0].GetInt64Value())
+		}
+		c.Assert(values, DeepEquals, expected)
+	}
+}
+
+type recordingSeriesNamesProcessor struct {
+	recordingProcessor
+	names []string
+}
+
+func (self *recordingSeriesNamesProcessor) YieldPoint(seriesName *string, columnNames []string, point *protocol.Point) bool {
+	self.names = append(self.names, *seriesName)
+	self.points = append(self.points, point)
+	return true
+}
+
+func (self *LevelDbShardCursorSuite) TestListSeriesMatchingARegexIsLimited(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"cpu", "temp_1", "temp_2", "temp_3"} {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+
+	// the shard returns the first offset+limit names, the coordinator
+	// skips the offset once it merged the names of every shard
+	queries, err := parser.ParseQuery("list series /^temp_/ limit 1 offset 1")
+	c.Assert(err, IsNil)
+	processor := &recordingSeriesNamesProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.names, HasLen, 2)
+	for _, name := range processor.names {
+		c.Assert(name, Matches, "temp_.*")
+	}
+}
+
+func (self *LevelDbShardCursorSuite) TestListSeriesByLastWriteYieldsTheLastWriteOfEverySeries(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	write := func(name string, t time.Time) {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(common.TimeToMicroseconds(t))
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+	write("cpu", now.Add(-2*time.Hour))
+	write("cpu", now.Add(-3*time.Hour))
+	write("mem", now)
+
+	// the coordinator filters the series once it has the last write of
+	// every shard, so the limit doesn't apply
+	queries, err := parser.ParseQuery("list series where last_write < now() - 1h limit 1")
+	c.Assert(err, IsNil)
+	processor := &recordingSeriesNamesProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.names, DeepEquals, []string{"cpu", "mem"})
+	c.Assert(processor.points[0].GetTimestamp(), Equals, common.TimeToMicroseconds(now.Add(-2*time.Hour)))
+	c.Assert(processor.points[1].GetTimestamp(), Equals, common.TimeToMicroseconds(now))
+}
+
+func (self *LevelDbShardCursorSuite) TestFieldsAreListedWithTheTypeOfTheirLastValue(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_CURSOR_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	for i, value := range []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}, &protocol.FieldValue{DoubleValue: protocol.Float64(1.5)}} {
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{value, &protocol.FieldValue{StringValue: protocol.String("server1")}},
+			SequenceNumber: proto.Uint64(1),
+		}
+		point.SetTimestampInMicroseconds(now + int64(i))
+		series := &protocol.Series{Name: protocol.String("cpu"), Fields: []string{"value", "host"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+
+	queries, err := parser.ParseQuery("list fields from /^c/")
+	c.Assert(err, IsNil)
+	processor := &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	types := map[string]string{}
+	for _, point := range processor.points {
+		types[point.Values[0].GetStringValue()] = point.Values[1].GetStringValue()
+	}
+	c.Assert(types, DeepEquals, map[string]string{"value": "double", "host": "string"})
+
+	queries, err = parser.ParseQuery("list fields from mem")
+	c.Assert(err, IsNil)
+	processor = &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.points, HasLen, 0)
+}
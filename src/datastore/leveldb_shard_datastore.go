@@ -5,30 +5,39 @@ import (
 	"cluster"
 	"configuration"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"metrics"
 	"os"
 	"path/filepath"
 	"protocol"
+	"strconv"
 	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
-	"github.com/jmhodges/levigo"
 )
 
 type LevelDbShardDatastore struct {
 	baseDbDir      string
 	config         *configuration.Configuration
-	shards         map[uint32]*LevelDbShard
+	shards         map[uint32]StorageEngine
 	lastAccess     map[uint32]int64
 	shardRefCounts map[uint32]int
 	shardsToClose  map[uint32]bool
 	shardsLock     sync.RWMutex
-	levelDbOptions *levigo.Options
+	storageEngine  StorageEngineOpener
 	writeBuffer    *cluster.WriteBuffer
 	maxOpenShards  int
-	pointBatchSize int
 	writeBatchSize int
+	// the shards that weren't used for that long are closed, 0 to keep
+	// them open
+	shardIdleTimeout time.Duration
+
+	// closed to stop the retention sweeper
+	stopRetentionSweeper chan bool
+	// closed to stop closing the idle shards
+	stopIdleShardCloser chan bool
 }
 
 const (
@@ -43,6 +52,8 @@ var (
 	// This datastore implements the PersistentAtomicInteger interface. All of the persistent
 	// integers start with this prefix, followed by their name
 	ATOMIC_INCREMENT_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFD}
+	// VALUE_CODEC_KEY holds the name of the codec of the field values of the shard
+	VALUE_CODEC_KEY = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}
 	// NEXT_ID_KEY holds the next id. ids are used to "intern" timeseries and column names
 	NEXT_ID_KEY = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	// SERIES_COLUMN_INDEX_PREFIX is the prefix of the series to column names index
@@ -73,33 +84,59 @@ func NewLevelDbShardDatastore(config *configuration.Configuration) (*LevelDbShar
 	if err != nil {
 		return nil, err
 	}
-	opts := levigo.NewOptions()
-	opts.SetCache(levigo.NewLRUCache(config.LevelDbLruCacheSize))
-	opts.SetCreateIfMissing(true)
-	opts.SetBlockSize(64 * ONE_KILOBYTE)
-	filter := levigo.NewBloomFilter(SHARD_BLOOM_FILTER_BITS_PER_KEY)
-	opts.SetFilterPolicy(filter)
-	opts.SetMaxOpenFiles(config.LevelDbMaxOpenFiles)
+	storageEngine, err := newStorageEngineOpener(config)
+	if err != nil {
+		return nil, err
+	}
 
-	return &LevelDbShardDatastore{
+	store := &LevelDbShardDatastore{
 		baseDbDir:      baseDbDir,
 		config:         config,
-		shards:         make(map[uint32]*LevelDbShard),
-		levelDbOptions: opts,
+		shards:         make(map[uint32]StorageEngine),
+		storageEngine:  storageEngine,
 		maxOpenShards:  config.LevelDbMaxOpenShards,
 		lastAccess:     make(map[uint32]int64),
 		shardRefCounts: make(map[uint32]int),
 		shardsToClose:  make(map[uint32]bool),
-		pointBatchSize: config.LevelDbPointBatchSize,
 		writeBatchSize: config.LevelDbWriteBatchSize,
-	}, nil
+
+		shardIdleTimeout: config.LevelDbShardIdleTimeout,
+	}
+	metrics.Default.Gauge("datastore.open_shards", store.openShards)
+	if store.shardIdleTimeout > 0 {
+		store.stopIdleShardCloser = make(chan bool)
+		go store.closeIdleShardsPeriodically(store.stopIdleShardCloser)
+	}
+	return store, nil
+}
+
+func (self *LevelDbShardDatastore) openShards() int64 {
+	self.shardsLock.RLock()
+	defer self.shardsLock.RUnlock()
+	return int64(len(self.shards))
+}
+
+func countPointsWritten(shardId uint32, series []*protocol.Series) {
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	metrics.Default.Counter(metrics.ShardMetric(shardId, "points_written")).Add(int64(points))
 }
 
 func (self *LevelDbShardDatastore) Close() {
 	self.shardsLock.Lock()
 	defer self.shardsLock.Unlock()
+	if self.stopRetentionSweeper != nil {
+		close(self.stopRetentionSweeper)
+		self.stopRetentionSweeper = nil
+	}
+	if self.stopIdleShardCloser != nil {
+		close(self.stopIdleShardCloser)
+		self.stopIdleShardCloser = nil
+	}
 	for _, shard := range self.shards {
-		shard.close()
+		shard.Close()
 	}
 }
 
@@ -118,23 +155,32 @@ func (self *LevelDbShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalSha
 	dbDir := self.shardDir(id)
 
 	log.Info("DATASTORE: opening or creating shard %s", dbDir)
-	ldb, err := levigo.Open(dbDir, self.levelDbOptions)
+	db, err := self.storageEngine.Open(dbDir)
 	if err != nil {
 		log.Error("Error opening shard: ", err)
 		return nil, err
 	}
-
-	db, err = NewLevelDbShard(ldb, self.pointBatchSize, self.writeBatchSize)
-	if err != nil {
-		log.Error("Error creating shard: ", err)
-		ldb.Close()
-		return nil, err
-	}
 	self.shards[id] = db
+	registerShardStats(id, db)
 	self.incrementShardRefCountAndCloseOldestIfNeeded(id)
 	return db, nil
 }
 
+// Reports the stats of the engine as gauges of the shard until it's
+// closed
+func registerShardStats(id uint32, db StorageEngine) {
+	for name := range db.Stats() {
+		name := name
+		metrics.Default.Gauge(metrics.ShardMetric(id, name), func() int64 { return db.Stats()[name] })
+	}
+}
+
+func removeShardStats(id uint32, db StorageEngine) {
+	for name := range db.Stats() {
+		metrics.Default.Remove(metrics.ShardMetric(id, name))
+	}
+}
+
 func (self *LevelDbShardDatastore) incrementShardRefCountAndCloseOldestIfNeeded(id uint32) {
 	self.shardRefCounts[id] += 1
 	delete(self.shardsToClose, id)
@@ -160,13 +206,78 @@ func (self *LevelDbShardDatastore) Write(request *protocol.Request) error {
 		return err
 	}
 	defer self.ReturnShard(*request.ShardId)
-	return shardDb.Write(*request.Database, request.MultiSeries)
+	if key := request.IdempotencyKey; key != nil {
+		written, err := shardDb.WriteOnce(*request.Database, *key, request.MultiSeries)
+		if err != nil {
+			return err
+		}
+		if !written {
+			log.Debug("DATASTORE: dropping the retried write %s to shard %d", *key, *request.ShardId)
+			return nil
+		}
+	} else if err := shardDb.Write(*request.Database, request.MultiSeries); err != nil {
+		return err
+	}
+	countPointsWritten(*request.ShardId, request.MultiSeries)
+	return nil
+}
+
+// Writes the series of the requests to the same shard and database
+// with one write to the shard, in the order of the requests
+func (self *LevelDbShardDatastore) WriteBatch(requests []*protocol.Request) error {
+	for _, request := range requests {
+		if request.IdempotencyKey != nil {
+			// the writes with a key have to be checked one at a time
+			return self.writeOneByOne(requests)
+		}
+	}
+
+	type shardDatabase struct {
+		shardId  uint32
+		database string
+	}
+	seriesByShard := map[shardDatabase][]*protocol.Series{}
+	order := []shardDatabase{}
+	for _, request := range requests {
+		key := shardDatabase{request.GetShardId(), request.GetDatabase()}
+		if _, ok := seriesByShard[key]; !ok {
+			order = append(order, key)
+		}
+		seriesByShard[key] = append(seriesByShard[key], request.MultiSeries...)
+	}
+
+	for _, key := range order {
+		shardDb, err := self.GetOrCreateShard(key.shardId)
+		if err != nil {
+			return err
+		}
+		err = shardDb.Write(key.database, seriesByShard[key])
+		self.ReturnShard(key.shardId)
+		if err != nil {
+			return err
+		}
+		countPointsWritten(key.shardId, seriesByShard[key])
+	}
+	return nil
+}
+
+func (self *LevelDbShardDatastore) writeOneByOne(requests []*protocol.Request) error {
+	for _, request := range requests {
+		if err := self.Write(request); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (self *LevelDbShardDatastore) BufferWrite(request *protocol.Request) {
 	self.writeBuffer.Write(request)
 }
 
+func (self *LevelDbShardDatastore) BufferWriteWithAck(request *protocol.Request, ack chan<- error) {
+	self.writeBuffer.WriteWithAck(request, ack)
+}
+
 func (self *LevelDbShardDatastore) SetWriteBuffer(writeBuffer *cluster.WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
@@ -179,14 +290,54 @@ func (self *LevelDbShardDatastore) DeleteShard(shardId uint32) error {
 	self.shardsLock.Unlock()
 
 	if shardDb != nil {
-		shardDb.close()
+		removeShardStats(shardId, shardDb)
+		shardDb.Close()
 	}
 
+	metrics.Default.Remove(metrics.ShardMetric(shardId, "points_written"))
 	dir := self.shardDir(shardId)
 	log.Info("DATASTORE: dropping shard %s", dir)
 	return os.RemoveAll(dir)
 }
 
+func (self *LevelDbShardDatastore) CompactShard(shardId uint32) error {
+	shard, err := self.GetOrCreateShard(shardId)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(shardId)
+	log.Info("DATASTORE: compacting shard %d", shardId)
+	shard.(StorageEngine).Compact()
+	return nil
+}
+
+func (self *LevelDbShardDatastore) ShardSizes() (map[uint32]int64, error) {
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[uint32]int64, len(dirs))
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		var size int64
+		err = filepath.Walk(filepath.Join(self.baseDbDir, dir.Name()), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sizes[uint32(id)] = size
+	}
+	return sizes, nil
+}
+
 func (self *LevelDbShardDatastore) shardDir(id uint32) string {
 	return filepath.Join(self.baseDbDir, fmt.Sprintf("%.5d", id))
 }
@@ -207,10 +358,43 @@ func (self *LevelDbShardDatastore) closeOldestShard() {
 	}
 }
 
+func (self *LevelDbShardDatastore) closeIdleShardsPeriodically(stop <-chan bool) {
+	ticker := time.NewTicker(self.shardIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			self.closeIdleShards(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Closes the shards that weren't used within the idle timeout, they're
+// opened again the next time they're used. The shards that are in use
+// are closed once they're returned.
+func (self *LevelDbShardDatastore) closeIdleShards(now time.Time) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	for id, lastAccess := range self.lastAccess {
+		if now.Sub(time.Unix(lastAccess, 0)) < self.shardIdleTimeout || self.shardsToClose[id] {
+			continue
+		}
+		metrics.Default.Counter("datastore.idle_shards_closed").Inc()
+		if self.shardRefCounts[id] == 0 {
+			self.closeShard(id)
+		} else {
+			self.shardsToClose[id] = true
+		}
+	}
+}
+
 func (self *LevelDbShardDatastore) closeShard(id uint32) {
 	shard := self.shards[id]
 	if shard != nil {
-		shard.close()
+		removeShardStats(id, shard)
+		shard.Close()
 	}
 	delete(self.shardRefCounts, id)
 	delete(self.shards, id)
@@ -1,9 +1,15 @@
 package datastore
 
 import (
+	"bytes"
+	"common"
 	"configuration"
 	. "launchpad.net/gocheck"
+	"metrics"
 	"os"
+	"parser"
+	"protocol"
+	"time"
 )
 
 const TEST_DATASTORE_SHARD_DIR = "/tmp/influxdb/leveldb_shard_datastore_test"
@@ -37,3 +43,199 @@ func (self *LevelDbShardDatastoreSuite) TestWillEnforceMaxOpenShards(c *C) {
 	store.ReturnShard(uint32(2))
 	c.Assert(shard.IsClosed(), Equals, true)
 }
+
+func (self *LevelDbShardDatastoreSuite) TestIdleShardsAreClosed(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR + "/idle"
+	config.LevelDbShardIdleTimeout = time.Hour
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	idle, err := store.GetOrCreateShard(uint32(1))
+	c.Assert(err, IsNil)
+	store.ReturnShard(uint32(1))
+	inUse, err := store.GetOrCreateShard(uint32(2))
+	c.Assert(err, IsNil)
+
+	store.closeIdleShards(time.Now())
+	c.Assert(idle.IsClosed(), Equals, false)
+
+	store.closeIdleShards(time.Now().Add(2 * time.Hour))
+	c.Assert(idle.IsClosed(), Equals, true)
+	c.Assert(inUse.IsClosed(), Equals, false)
+	store.ReturnShard(uint32(2))
+	c.Assert(inUse.IsClosed(), Equals, true)
+
+	// the shard is opened again when it's used
+	shard, err := store.GetOrCreateShard(uint32(1))
+	c.Assert(err, IsNil)
+	c.Assert(shard.IsClosed(), Equals, false)
+	store.ReturnShard(uint32(1))
+}
+
+func (self *LevelDbShardDatastoreSuite) TestTheStatsOfOpenShardsAreReported(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR + "/stats"
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	_, err = store.GetOrCreateShard(uint32(3))
+	c.Assert(err, IsNil)
+	store.ReturnShard(uint32(3))
+	files, ok := metrics.Default.Snapshot()[metrics.ShardMetric(3, "leveldb.files")]
+	c.Assert(ok, Equals, true)
+	c.Assert(files >= 0, Equals, true)
+
+	c.Assert(store.DeleteShard(uint32(3)), IsNil)
+	_, ok = metrics.Default.Snapshot()[metrics.ShardMetric(3, "leveldb.files")]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestShardsCanBeRestoredFromAStreamedBackup(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.LevelDbValueCodec = COMPACT_VALUE_CODEC
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	shard, err := store.GetOrCreateShard(uint32(10))
+	c.Assert(err, IsNil)
+	sequenceNumber := uint64(1)
+	point := &protocol.Point{
+		Values:         []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: protocol.Float64(1.5)}},
+		SequenceNumber: &sequenceNumber,
+	}
+	point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+
+	snapshot := shard.Snapshot()
+	backup := bytes.NewBuffer(nil)
+	c.Assert(snapshot.Backup(backup), IsNil)
+	snapshot.Release()
+	store.ReturnShard(uint32(10))
+
+	// a truncated backup is rejected
+	truncated := bytes.NewBuffer(backup.Bytes()[:backup.Len()-1])
+	c.Assert(store.RestoreShardFrom(uint32(11), truncated), NotNil)
+
+	c.Assert(store.RestoreShardFrom(uint32(11), backup), IsNil)
+	restored, err := store.GetOrCreateShard(uint32(11))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(11))
+
+	queries, err := parser.ParseQuery("select value from foo where time > now() - 1h;")
+	c.Assert(err, IsNil)
+	cursor, err := restored.SeriesCursor(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+	points, err := cursor.NextBatch(10)
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Values[0].GetDoubleValue(), Equals, 1.5)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestUnknownStorageEnginesAreRejected(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "lmdb"
+	_, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, ErrorMatches, "Unknown storage engine lmdb.*")
+}
+
+func (self *LevelDbShardDatastoreSuite) TestExpiredPointsAreDropped(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	shard, err := store.GetOrCreateShard(uint32(20))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(20))
+	now := time.Now()
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}}
+	for i, age := range []time.Duration{2 * time.Hour, 90 * time.Minute, time.Minute} {
+		sequenceNumber := uint64(1)
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+			SequenceNumber: &sequenceNumber,
+		}
+		point.SetTimestampInMicroseconds(common.TimeToMicroseconds(now.Add(-age)))
+		series.Points = append(series.Points, point)
+	}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	c.Assert(shard.Write("db2", []*protocol.Series{series}), IsNil)
+
+	c.Assert(store.DropExpiredPoints(now, map[string]time.Duration{"db1": time.Hour}), IsNil)
+
+	queries, err := parser.ParseQuery("select value from foo where time > now() - 1d;")
+	c.Assert(err, IsNil)
+	for database, count := range map[string]int{"db1": 1, "db2": 3} {
+		cursor, err := shard.SeriesCursor(parser.NewQuerySpec(&MockUser{}, database, queries[0]), "foo", []string{"value"})
+		c.Assert(err, IsNil)
+		points, err := cursor.NextBatch(10)
+		cursor.Close()
+		c.Assert(err, IsNil)
+		c.Assert(points, HasLen, count)
+	}
+}
+
+func (self *LevelDbShardDatastoreSuite) TestExportedPointsCanBeImported(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR + "/export"
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	shard, err := store.GetOrCreateShard(uint32(30))
+	c.Assert(err, IsNil)
+	sequenceNumber := uint64(1)
+	point := &protocol.Point{
+		Values: []*protocol.FieldValue{
+			&protocol.FieldValue{DoubleValue: protocol.Float64(2)},
+			&protocol.FieldValue{Int64Value: protocol.Int64(3)},
+			&protocol.FieldValue{StringValue: protocol.String("bar")},
+		},
+		SequenceNumber: &sequenceNumber,
+	}
+	point.SetTimestampInMicroseconds(common.TimeToMicroseconds(time.Now()))
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"double", "int", "string"}, Points: []*protocol.Point{point}}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	c.Assert(shard.Write("db2", []*protocol.Series{series}), IsNil)
+	store.ReturnShard(uint32(30))
+
+	dump := bytes.NewBuffer(nil)
+	c.Assert(store.Export(dump, "db1", nil), IsNil)
+
+	config = &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR + "/import"
+	imported, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer imported.Close()
+	count, err := imported.Import(dump, "")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+
+	shard, err = imported.GetOrCreateShard(uint32(30))
+	c.Assert(err, IsNil)
+	defer imported.ReturnShard(uint32(30))
+	c.Assert(shard.(StorageEngine).Databases(), DeepEquals, []string{"db1"})
+	queries, err := parser.ParseQuery("select * from foo where time > now() - 1h;")
+	c.Assert(err, IsNil)
+	cursor, err := shard.SeriesCursor(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), "foo", []string{"double", "int", "string"})
+	c.Assert(err, IsNil)
+	defer cursor.Close()
+	points, err := cursor.NextBatch(10)
+	c.Assert(err, IsNil)
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].GetTimestamp(), Equals, point.GetTimestamp())
+	c.Assert(points[0].GetSequenceNumber(), Equals, sequenceNumber)
+	c.Assert(points[0].Values[0].GetDoubleValue(), Equals, 2.0)
+	c.Assert(points[0].Values[1].GetInt64Value(), Equals, int64(3))
+	c.Assert(points[0].Values[2].GetStringValue(), Equals, "bar")
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"protocol"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+// Writes with an idempotency key are only applied once within the dedup
+// window. The shard keeps the keys of the writes it applied with the
+// time it applied them and drops the writes whose key it already has.
+// Every replica keeps its own keys, so a retry that went through another
+// server and got other sequence numbers is dropped by all of them.
+
+const (
+	DEFAULT_WRITE_DEDUP_WINDOW = 10 * time.Minute
+	// the number of expired keys deleted with every write with a key
+	WRITE_DEDUP_PRUNE_BATCH = 100
+)
+
+var (
+	// IDEMPOTENCY_KEY_PREFIX is the prefix of the keys of the writes,
+	// their value is the time the write was applied
+	IDEMPOTENCY_KEY_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF9}
+	// IDEMPOTENCY_TIME_PREFIX is the prefix of the index of the keys by
+	// the time they were applied, used to expire them
+	IDEMPOTENCY_TIME_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF8}
+)
+
+func idempotencyKey(key string) []byte {
+	return append(append([]byte{}, IDEMPOTENCY_KEY_PREFIX...), key...)
+}
+
+func idempotencyTimeKey(t int64, key string) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(IDEMPOTENCY_TIME_PREFIX)+8+len(key)))
+	buffer.Write(IDEMPOTENCY_TIME_PREFIX)
+	binary.Write(buffer, binary.BigEndian, uint64(t))
+	buffer.WriteString(key)
+	return buffer.Bytes()
+}
+
+// Writes the series unless a write with the same key was applied within
+// the dedup window, returns false if the write was dropped
+func (self *LevelDbShard) WriteOnce(database, key string, series []*protocol.Series) (bool, error) {
+	self.dedupLock.Lock()
+	defer self.dedupLock.Unlock()
+
+	now := time.Now()
+	applied, err := self.db.Get(self.readOptions, idempotencyKey(key))
+	if err != nil {
+		return false, err
+	}
+	if len(applied) == 8 && now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(applied)))) < self.writeDedupWindow {
+		return false, nil
+	}
+
+	// the key is only kept once the points are written, a write that
+	// failed can be retried
+	if err := self.Write(database, series); err != nil {
+		return false, err
+	}
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	// pruned first, the deletes of an expired copy of the key mustn't
+	// come after the put in the batch
+	self.pruneIdempotencyKeys(wb, now.Add(-self.writeDedupWindow))
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(now.UnixNano()))
+	wb.Put(idempotencyKey(key), value)
+	wb.Put(idempotencyTimeKey(now.UnixNano(), key), []byte{})
+	return true, self.db.Write(self.writeOptions, wb)
+}
+
+// Deletes the keys that were applied before the given time, a few at a
+// time so the writes with a key stay fast
+func (self *LevelDbShard) pruneIdempotencyKeys(wb *levigo.WriteBatch, before time.Time) {
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	prefixLength := len(IDEMPOTENCY_TIME_PREFIX)
+	pruned := 0
+	for it.Seek(IDEMPOTENCY_TIME_PREFIX); it.Valid() && pruned < WRITE_DEDUP_PRUNE_BATCH; it.Next() {
+		indexKey := it.Key()
+		if len(indexKey) < prefixLength+8 || !bytes.HasPrefix(indexKey, IDEMPOTENCY_TIME_PREFIX) {
+			break
+		}
+		t := int64(binary.BigEndian.Uint64(indexKey[prefixLength : prefixLength+8]))
+		if t >= before.UnixNano() {
+			break
+		}
+		key := indexKey[prefixLength+8:]
+		wb.Delete(indexKey)
+		// the key may have been applied again since
+		if applied, err := self.db.Get(self.readOptions, idempotencyKey(string(key))); err == nil && len(applied) == 8 && int64(binary.BigEndian.Uint64(applied)) == t {
+			wb.Delete(idempotencyKey(string(key)))
+		}
+		pruned++
+	}
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"common"
+	"os"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_WRITE_DEDUP_DIR = "/tmp/influxdb/leveldb_shard_dedup_test"
+
+type LevelDbWriteDedupSuite struct{}
+
+var _ = Suite(&LevelDbWriteDedupSuite{})
+
+func (self *LevelDbWriteDedupSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_WRITE_DEDUP_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbWriteDedupSuite) TestRetriedWritesAreDropped(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_WRITE_DEDUP_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	write := func(key string, sequence uint64) bool {
+		point := &protocol.Point{
+			SequenceNumber: proto.Uint64(sequence),
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+		}
+		point.SetTimestampInMicroseconds(now)
+		series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		written, err := shard.WriteOnce("db1", key, []*protocol.Series{series})
+		c.Assert(err, IsNil)
+		return written
+	}
+
+	c.Assert(write("write-1", 1), Equals, true)
+	// the retry got another sequence number from another server
+	c.Assert(write("write-1", 2), Equals, false)
+	c.Assert(write("write-2", 3), Equals, true)
+	c.Assert(shard.writeSequence, Equals, uint64(2))
+
+	// the key is forgotten after the window
+	shard.writeDedupWindow = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	c.Assert(write("write-1", 4), Equals, true)
+	// the expired keys are pruned
+	data, err := db.Get(levigo.NewReadOptions(), idempotencyKey("write-2"))
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+}
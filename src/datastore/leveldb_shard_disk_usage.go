@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"cluster"
+	"parser"
+	"protocol"
+
+	"github.com/jmhodges/levigo"
+)
+
+// The sizes of show disk usage come from the approximate sizes leveldb
+// keeps for the ranges of its files, the writes that are still in the
+// memtable aren't counted until they're flushed to disk.
+
+var diskUsageFields = []string{
+	"series",
+	"columns",
+	"points_written",
+	"points_bytes",
+	"series_index_bytes",
+	"column_index_bytes",
+	"field_types_bytes",
+	"column_value_index_bytes",
+	"shard_bytes",
+}
+
+// the index prefixes that have the name of the database after them, the
+// series index also has the stats of the series
+var diskUsageIndexPrefixes = [][]byte{
+	DATABASE_SERIES_INDEX_PREFIX,
+	SERIES_COLUMN_INDEX_PREFIX,
+	FIELD_TYPE_PREFIX,
+	COLUMN_VALUE_INDEX_PREFIX,
+}
+
+// Yields a single point with the number of series, columns and points of
+// the database in the shard and the bytes their keys use on disk. The
+// shard_bytes are the ones of every database in the shard.
+func (self *LevelDbShard) executeDiskUsageQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	database := querySpec.Database()
+	ranges := []levigo.Range{}
+	for _, prefix := range diskUsageIndexPrefixes {
+		start := append(append([]byte{}, prefix...), database+"~"...)
+		// ~ is followed by 0x7F, so the limit is past every key of the db
+		limit := append(append([]byte{}, prefix...), database+"\x7F"...)
+		ranges = append(ranges, levigo.Range{Start: start, Limit: limit})
+	}
+	ranges = append(ranges, levigo.Range{Start: []byte{}, Limit: append(append([]byte{}, MAX_SEQUENCE...), 0xFF)})
+
+	seriesNames := self.getSeriesForDatabase(database)
+	columns := 0
+	pointsWritten := uint64(0)
+	fieldsStart := len(ranges)
+	for _, name := range seriesNames {
+		stats, err := self.getSeriesStats(database, name)
+		if err != nil {
+			return err
+		}
+		if stats != nil {
+			pointsWritten += stats.PointsWritten
+		}
+		for _, column := range self.getColumnNamesForSeries(database, name) {
+			id, err := self.getIdForDbSeriesColumn(&database, &name, &column)
+			if err != nil {
+				return err
+			}
+			if id == nil {
+				continue
+			}
+			columns++
+			limit := append(append(append([]byte{}, id...), MAX_SEQUENCE...), MAX_SEQUENCE...)
+			ranges = append(ranges, levigo.Range{Start: id, Limit: limit})
+		}
+	}
+
+	sizes := self.db.GetApproximateSizes(ranges)
+	pointsBytes := uint64(0)
+	for _, size := range sizes[fieldsStart:] {
+		pointsBytes += size
+	}
+	values := []uint64{uint64(len(seriesNames)), uint64(columns), pointsWritten, pointsBytes}
+	values = append(values, sizes[:fieldsStart]...)
+	point := &protocol.Point{Values: make([]*protocol.FieldValue, 0, len(values))}
+	for _, value := range values {
+		point.Values = append(point.Values, &protocol.FieldValue{Int64Value: protocol.Int64(int64(value))})
+	}
+	processor.YieldSeries(&protocol.Series{Name: protocol.String("disk usage"), Fields: diskUsageFields, Points: []*protocol.Point{point}})
+	return nil
+}
@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"os"
+	"parser"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_DISK_USAGE_DIR = "/tmp/influxdb/leveldb_shard_disk_usage_test"
+
+type LevelDbDiskUsageSuite struct{}
+
+var _ = Suite(&LevelDbDiskUsageSuite{})
+
+func (self *LevelDbDiskUsageSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_DISK_USAGE_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbDiskUsageSuite) TestTheDiskUsageIsTheOneOfTheDatabase(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_DISK_USAGE_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		c.Assert(shard.Write("db1", columnIndexTestSeries("web-1", now.Add(-time.Duration(i)*time.Second), int64(i))), IsNil)
+	}
+	c.Assert(shard.Write("db2", columnIndexTestSeries("web-1", now, 1)), IsNil)
+	// the writes in the memtable don't have a size yet
+	shard.Compact()
+
+	queries, err := parser.ParseQuery("show disk usage")
+	c.Assert(err, IsNil)
+	processor := &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db1", queries[0]), processor), IsNil)
+	c.Assert(processor.points, HasLen, 1)
+	values := map[string]int64{}
+	for i, field := range diskUsageFields {
+		values[field] = processor.points[0].Values[i].GetInt64Value()
+	}
+	c.Assert(values["series"], Equals, int64(1))
+	c.Assert(values["columns"], Equals, int64(2))
+	c.Assert(values["points_written"], Equals, int64(100))
+	c.Assert(values["points_bytes"] > 0, Equals, true)
+	c.Assert(values["shard_bytes"] >= values["points_bytes"], Equals, true)
+
+	processor = &recordingProcessor{}
+	c.Assert(shard.Query(parser.NewQuerySpec(&MockUser{}, "db3", queries[0]), processor), IsNil)
+	c.Assert(processor.points[0].Values[0].GetInt64Value(), Equals, int64(0))
+	c.Assert(processor.points[0].Values[3].GetInt64Value(), Equals, int64(0))
+}
@@ -0,0 +1,313 @@
+package datastore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"parser"
+	"protocol"
+	"strconv"
+	"strings"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// the first line of the dumps written by Export
+	EXPORT_HEADER = "# influxdb export 1"
+	// the points of a series are split in lines of this many points
+	EXPORT_POINTS_PER_LINE = 1000
+)
+
+// A line of a dump, some of the points of a series of a shard. The
+// points are written as [time, sequence_number, values...], the time
+// is in microseconds. Doubles always have a decimal point or an
+// exponent so they're imported as doubles and not as integers.
+type exportedSeries struct {
+	Shard    uint32          `json:"shard"`
+	Database string          `json:"database"`
+	Name     string          `json:"name"`
+	Columns  []string        `json:"columns"`
+	Points   [][]interface{} `json:"points"`
+}
+
+// Returns the ids of the shards stored on this server
+func (self *LevelDbShardDatastore) localShardIds() ([]uint32, error) {
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{}
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// Writes the points of the given shards to w as gzipped lines of json,
+// every shard on this server is exported if no shard is given and
+// every database if the database is empty. The shards are read through
+// the storage engine, so the dump can be imported in a server running
+// another engine.
+func (self *LevelDbShardDatastore) Export(w io.Writer, database string, shardIds []uint32) error {
+	if len(shardIds) == 0 {
+		ids, err := self.localShardIds()
+		if err != nil {
+			return err
+		}
+		shardIds = ids
+	}
+
+	gz := gzip.NewWriter(w)
+	writer := bufio.NewWriter(gz)
+	if _, err := fmt.Fprintln(writer, EXPORT_HEADER); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	for _, id := range shardIds {
+		if err := self.exportShard(encoder, id, database); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (self *LevelDbShardDatastore) exportShard(encoder *json.Encoder, id uint32, database string) error {
+	shard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+
+	engine := shard.(StorageEngine)
+	databases := engine.Databases()
+	if database != "" {
+		databases = []string{database}
+	}
+	for _, db := range databases {
+		for _, series := range engine.SeriesNames(db) {
+			log.Debug("DATASTORE: exporting %s.%s from shard %d", db, series, id)
+			if err := exportSeries(encoder, engine, id, db, series); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exportSeries(encoder *json.Encoder, shard StorageEngine, id uint32, database, series string) error {
+	// every point of the series, including the ones in the future
+	query := fmt.Sprintf("select * from \"%s\" where time < %du;", series, int64(math.MaxInt64/1000))
+	queries, err := parser.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	querySpec := parser.NewQuerySpec(nil, database, queries[0])
+	cursor, err := shard.SeriesCursor(querySpec, series, []string{"*"})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	columns := append([]string{"time", "sequence_number"}, cursor.Fields()...)
+	for {
+		points, err := cursor.NextBatch(EXPORT_POINTS_PER_LINE)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		line := &exportedSeries{
+			Shard:    id,
+			Database: database,
+			Name:     series,
+			Columns:  columns,
+			Points:   make([][]interface{}, 0, len(points)),
+		}
+		for _, point := range points {
+			line.Points = append(line.Points, exportPoint(point))
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+}
+
+func exportPoint(point *protocol.Point) []interface{} {
+	values := make([]interface{}, 0, len(point.Values)+2)
+	values = append(values, json.Number(strconv.FormatInt(point.GetTimestamp(), 10)))
+	values = append(values, json.Number(strconv.FormatUint(point.GetSequenceNumber(), 10)))
+	for _, value := range point.Values {
+		values = append(values, exportValue(value))
+	}
+	return values
+}
+
+func exportValue(value *protocol.FieldValue) interface{} {
+	switch {
+	case value == nil || value.GetIsNull():
+		return nil
+	case value.StringValue != nil:
+		return value.GetStringValue()
+	case value.BoolValue != nil:
+		return value.GetBoolValue()
+	case value.Int64Value != nil:
+		return json.Number(strconv.FormatInt(value.GetInt64Value(), 10))
+	case value.DoubleValue != nil:
+		f := value.GetDoubleValue()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return json.Number(s)
+	}
+	return nil
+}
+
+// Writes the points of a dump written by Export to the shards they were
+// exported from, only the points of the given database are imported if
+// it isn't empty. Returns the number of points imported.
+func (self *LevelDbShardDatastore) Import(r io.Reader, database string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	reader := bufio.NewReader(gz)
+	header, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(header) != EXPORT_HEADER {
+		return 0, fmt.Errorf("Not an influxdb export")
+	}
+
+	count := 0
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		decoder := json.NewDecoder(strings.NewReader(string(line)))
+		decoder.UseNumber()
+		exported := &exportedSeries{}
+		if err := decoder.Decode(exported); err != nil {
+			return count, fmt.Errorf("Invalid line %d: %s", lineNumber, err)
+		}
+		if database != "" && exported.Database != database {
+			continue
+		}
+		series, err := exported.toSeries()
+		if err != nil {
+			return count, fmt.Errorf("Invalid line %d: %s", lineNumber, err)
+		}
+		if err := self.importSeries(exported.Shard, exported.Database, series); err != nil {
+			return count, err
+		}
+		count += len(series.Points)
+	}
+}
+
+func (self *LevelDbShardDatastore) importSeries(id uint32, database string, series *protocol.Series) error {
+	shard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	return shard.Write(database, []*protocol.Series{series})
+}
+
+func (self *exportedSeries) toSeries() (*protocol.Series, error) {
+	if len(self.Columns) < 2 || self.Columns[0] != "time" || self.Columns[1] != "sequence_number" {
+		return nil, fmt.Errorf("the first columns must be time and sequence_number")
+	}
+	series := &protocol.Series{
+		Name:   protocol.String(self.Name),
+		Fields: self.Columns[2:],
+		Points: make([]*protocol.Point, 0, len(self.Points)),
+	}
+	for _, values := range self.Points {
+		if len(values) != len(self.Columns) {
+			return nil, fmt.Errorf("points of %s must have %d values", self.Name, len(self.Columns))
+		}
+		point, err := importPoint(values)
+		if err != nil {
+			return nil, err
+		}
+		series.Points = append(series.Points, point)
+	}
+	return series, nil
+}
+
+func importPoint(values []interface{}) (*protocol.Point, error) {
+	timestamp, ok := values[0].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("time must be a number but is %v", values[0])
+	}
+	t, err := strconv.ParseInt(string(timestamp), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sequence, ok := values[1].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("sequence_number must be a number but is %v", values[1])
+	}
+	sequenceNumber, err := strconv.ParseUint(string(sequence), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	point := &protocol.Point{
+		SequenceNumber: &sequenceNumber,
+		Values:         make([]*protocol.FieldValue, 0, len(values)-2),
+	}
+	point.SetTimestampInMicroseconds(t)
+	for _, value := range values[2:] {
+		fieldValue, err := importValue(value)
+		if err != nil {
+			return nil, err
+		}
+		point.Values = append(point.Values, fieldValue)
+	}
+	return point, nil
+}
+
+func importValue(value interface{}) (*protocol.FieldValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
+	case string:
+		return &protocol.FieldValue{StringValue: &v}, nil
+	case bool:
+		return &protocol.FieldValue{BoolValue: &v}, nil
+	case json.Number:
+		if strings.ContainsAny(string(v), ".eE") {
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return &protocol.FieldValue{DoubleValue: &f}, nil
+		}
+		i, err := v.Int64()
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.FieldValue{Int64Value: &i}, nil
+	}
+	return nil, fmt.Errorf("Unknown type %T", value)
+}
@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"common"
+	"protocol"
+
+	log "code.google.com/p/log4go"
+	"github.com/jmhodges/levigo"
+)
+
+// The shard records the type of a field with the first value written to
+// it. The coordinator checks the writes to the local shards against the
+// recorded types before they're logged, so a conflicting write is either
+// rejected or has its values coerced to the types of their fields. A
+// replica the coordinator couldn't check drops the values that don't
+// match when it writes them.
+
+const (
+	REJECT_FIELD_TYPE_CONFLICTS = "reject"
+	COERCE_FIELD_TYPE_CONFLICTS = "coerce"
+)
+
+// FIELD_TYPE_PREFIX is the prefix of the types of the fields, followed
+// by the database, series and field names
+var FIELD_TYPE_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF7}
+
+func fieldTypeKey(database, series, field string) []byte {
+	return append(append([]byte{}, FIELD_TYPE_PREFIX...), database+"~"+series+"~"+field...)
+}
+
+func (self *LevelDbShard) getRecordedFieldType(key []byte) (common.FieldType, error) {
+	data, err := self.db.Get(self.readOptions, key)
+	if err != nil || len(data) != 1 {
+		return common.FIELD_TYPE_NONE, err
+	}
+	return common.FieldType(data[0]), nil
+}
+
+// Returns the values of the series that don't match the types of their
+// fields and can't be coerced, the values that can are replaced in the
+// points. Also returns the types of the fields that don't have one yet.
+func (self *LevelDbShard) resolveFieldTypes(database string, series []*protocol.Series) (common.FieldTypeConflictError, map[string]common.FieldType, error) {
+	var conflicts common.FieldTypeConflictError
+	newTypes := map[string]common.FieldType{}
+	for _, s := range series {
+		for fieldIndex, field := range s.Fields {
+			key := fieldTypeKey(database, s.GetName(), field)
+			fieldType, ok := newTypes[string(key)]
+			if !ok {
+				var err error
+				if fieldType, err = self.getRecordedFieldType(key); err != nil {
+					return nil, nil, err
+				}
+			}
+			for _, point := range s.Points {
+				value := point.Values[fieldIndex]
+				valueType := common.FieldTypeOf(value)
+				if valueType == common.FIELD_TYPE_NONE || valueType == fieldType {
+					continue
+				}
+				if fieldType == common.FIELD_TYPE_NONE {
+					fieldType = valueType
+					newTypes[string(key)] = fieldType
+					continue
+				}
+				if self.coerceFieldTypes {
+					if coerced, ok := common.CoerceFieldValue(value, fieldType); ok {
+						point.Values[fieldIndex] = coerced
+						continue
+					}
+				}
+				conflicts = append(conflicts, &common.FieldTypeConflict{
+					Series:    s.GetName(),
+					Field:     field,
+					Point:     point,
+					Value:     value,
+					Type:      valueType,
+					FieldType: fieldType,
+				})
+			}
+		}
+	}
+	return conflicts, newTypes, nil
+}
+
+// Returns a FieldTypeConflictError if some values of the series don't
+// match the types of their fields, nothing is recorded
+func (self *LevelDbShard) CheckFieldTypes(database string, series []*protocol.Series) error {
+	self.fieldTypesLock.Lock()
+	defer self.fieldTypesLock.Unlock()
+	conflicts, _, err := self.resolveFieldTypes(database, series)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return conflicts
+	}
+	return nil
+}
+
+// Puts the new field types in the batch and returns the values the write
+// has to drop, the caller holds the field types lock until the batch is
+// written
+func (self *LevelDbShard) recordFieldTypes(wb *levigo.WriteBatch, database string, series []*protocol.Series) (map[*protocol.FieldValue]bool, error) {
+	conflicts, newTypes, err := self.resolveFieldTypes(database, series)
+	if err != nil {
+		return nil, err
+	}
+	for key, fieldType := range newTypes {
+		wb.Put([]byte(key), []byte{byte(fieldType)})
+	}
+	dropped := make(map[*protocol.FieldValue]bool, len(conflicts))
+	for _, conflict := range conflicts {
+		log.Warn("Dropping a value of a write to %s: %s", database, conflict)
+		dropped[conflict.Value] = true
+	}
+	return dropped, nil
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"common"
+	"os"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_FIELD_TYPES_DIR = "/tmp/influxdb/leveldb_shard_field_types_test"
+
+type LevelDbFieldTypesSuite struct{}
+
+var _ = Suite(&LevelDbFieldTypesSuite{})
+
+func (self *LevelDbFieldTypesSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_FIELD_TYPES_DIR)
+	c.Assert(err, IsNil)
+}
+
+func fieldTypesTestSeries(values ...*protocol.FieldValue) []*protocol.Series {
+	now := common.TimeToMicroseconds(time.Now())
+	series := &protocol.Series{Name: protocol.String("cpu"), Fields: []string{"value"}}
+	for i, value := range values {
+		point := &protocol.Point{Values: []*protocol.FieldValue{value}, SequenceNumber: proto.Uint64(1)}
+		point.SetTimestampInMicroseconds(now + int64(i))
+		series.Points = append(series.Points, point)
+	}
+	return []*protocol.Series{series}
+}
+
+func (self *LevelDbFieldTypesSuite) TestValuesOfAnotherTypeAreRejected(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_FIELD_TYPES_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	// ints and doubles are both numbers
+	c.Assert(shard.Write("db1", fieldTypesTestSeries(
+		&protocol.FieldValue{Int64Value: protocol.Int64(1)},
+		&protocol.FieldValue{DoubleValue: protocol.Float64(1.5)},
+	)), IsNil)
+
+	series := fieldTypesTestSeries(
+		&protocol.FieldValue{DoubleValue: protocol.Float64(2)},
+		&protocol.FieldValue{StringValue: protocol.String("high")},
+	)
+	err = shard.CheckFieldTypes("db1", series)
+	conflicts, ok := err.(common.FieldTypeConflictError)
+	c.Assert(ok, Equals, true)
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].Point, Equals, series[0].Points[1])
+	c.Assert(conflicts[0].Type, Equals, common.FIELD_TYPE_STRING)
+	c.Assert(conflicts[0].FieldType, Equals, common.FIELD_TYPE_NUMBER)
+
+	// the fields of another database have their own types
+	c.Assert(shard.CheckFieldTypes("db2", series), IsNil)
+
+	// a write that wasn't checked drops the value
+	c.Assert(shard.Write("db1", series), IsNil)
+	fieldType, err := shard.getFieldType("db1", "cpu", "value")
+	c.Assert(err, IsNil)
+	c.Assert(fieldType, Equals, "double")
+}
+
+func (self *LevelDbFieldTypesSuite) TestValuesOfAnotherTypeAreCoerced(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_FIELD_TYPES_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	shard.coerceFieldTypes = true
+
+	c.Assert(shard.Write("db1", fieldTypesTestSeries(&protocol.FieldValue{Int64Value: protocol.Int64(1)})), IsNil)
+
+	series := fieldTypesTestSeries(
+		&protocol.FieldValue{StringValue: protocol.String("2.5")},
+		&protocol.FieldValue{StringValue: protocol.String("high")},
+	)
+	err = shard.CheckFieldTypes("db1", series)
+	c.Assert(err, FitsTypeOf, common.FieldTypeConflictError{})
+	c.Assert(err.(common.FieldTypeConflictError), HasLen, 1)
+	c.Assert(series[0].Points[0].Values[0].GetDoubleValue(), Equals, 2.5)
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"bytes"
+
+	log "code.google.com/p/log4go"
+	"github.com/jmhodges/levigo"
+)
+
+// The problems of the series the startup check removes from the indexes
+const (
+	// the series is listed without any column
+	REPAIR_NO_COLUMNS = "no columns"
+	// none of the columns of the series has points, e.g. after a drop
+	// that deleted the points but was interrupted before it removed the
+	// series from the indexes
+	REPAIR_NO_POINTS = "no points"
+)
+
+// A series the startup check removed from the indexes of a shard
+type SeriesRepair struct {
+	Shard    uint32 `json:"shard"`
+	Database string `json:"database"`
+	Series   string `json:"series"`
+	Problem  string `json:"problem"`
+}
+
+// Cross-checks the series of every database with their columns and
+// their points, removes the series that are listed without points from
+// the indexes and returns them. Nothing can be written to the shard
+// until it's done.
+func (self *LevelDbShard) Reconcile() ([]*SeriesRepair, error) {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	repairs := []*SeriesRepair{}
+	for _, database := range self.Databases() {
+		for _, series := range self.getSeriesForDatabase(database) {
+			problem, err := self.seriesProblem(database, series)
+			if err != nil {
+				return nil, err
+			}
+			if problem == "" {
+				continue
+			}
+			self.deleteSeriesIndexes(wb, database, series)
+			repairs = append(repairs, &SeriesRepair{Database: database, Series: series, Problem: problem})
+		}
+	}
+	if len(repairs) == 0 {
+		return repairs, nil
+	}
+	return repairs, self.db.Write(self.writeOptions, wb)
+}
+
+// Returns the problem of the series, an empty string if one of its
+// columns has a point
+func (self *LevelDbShard) seriesProblem(database, series string) (string, error) {
+	columns := self.getColumnNamesForSeries(database, series)
+	if len(columns) == 0 {
+		return REPAIR_NO_COLUMNS, nil
+	}
+
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	for _, column := range columns {
+		id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+		if err != nil {
+			return "", err
+		}
+		if id == nil {
+			continue
+		}
+		it.Seek(id)
+		if it.Valid() && len(it.Key()) >= 16 && bytes.Equal(it.Key()[:8], id) {
+			return "", nil
+		}
+		if err := it.GetError(); err != nil {
+			return "", err
+		}
+	}
+	return REPAIR_NO_POINTS, nil
+}
+
+// Reconciles every shard stored on this server, it has to be done before
+// the shards are written to. The shards that can't be opened are skipped,
+// they fail when they're used.
+func (self *LevelDbShardDatastore) Reconcile() ([]*SeriesRepair, error) {
+	shardIds, err := self.localShardIds()
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []*SeriesRepair{}
+	for _, id := range shardIds {
+		shard, err := self.GetOrCreateShard(id)
+		if err != nil {
+			log.Error("Cannot check the indexes of shard %d: %s", id, err)
+			continue
+		}
+		shardRepairs, err := shard.(StorageEngine).Reconcile()
+		self.ReturnShard(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range shardRepairs {
+			r.Shard = id
+			repairs = append(repairs, r)
+		}
+	}
+	return repairs, nil
+}
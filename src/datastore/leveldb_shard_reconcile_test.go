@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"os"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_RECONCILE_DIR = "/tmp/influxdb/leveldb_shard_reconcile_test"
+
+type LevelDbReconcileSuite struct{}
+
+var _ = Suite(&LevelDbReconcileSuite{})
+
+func (self *LevelDbReconcileSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_RECONCILE_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbReconcileSuite) TestTheSeriesListedWithoutPointsAreRemoved(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_RECONCILE_DIR, opts)
+	c.Assert(err, IsNil)
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	defer shard.Close()
+
+	for _, name := range []string{"cpu", "mem"} {
+		point := &protocol.Point{
+			SequenceNumber: proto.Uint64(1),
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(1)}},
+		}
+		point.SetTimestampInMicroseconds(1000)
+		series := &protocol.Series{Name: protocol.String(name), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	}
+
+	// a drop of mem interrupted after it deleted the points
+	start := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	end := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	c.Assert(shard.deleteRangeOfSeriesCommon("db1", "mem", start, end), IsNil)
+	c.Assert(shard.SeriesNames("db1"), DeepEquals, []string{"cpu", "mem"})
+
+	repairs, err := shard.Reconcile()
+	c.Assert(err, IsNil)
+	c.Assert(repairs, DeepEquals, []*SeriesRepair{&SeriesRepair{Database: "db1", Series: "mem", Problem: REPAIR_NO_POINTS}})
+	c.Assert(shard.SeriesNames("db1"), DeepEquals, []string{"cpu"})
+	c.Assert(shard.getColumnNamesForSeries("db1", "mem"), HasLen, 0)
+
+	repairs, err = shard.Reconcile()
+	c.Assert(err, IsNil)
+	c.Assert(repairs, HasLen, 0)
+}
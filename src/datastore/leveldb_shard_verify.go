@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/jmhodges/levigo"
+)
+
+// Corruption is detected with the checksums leveldb keeps for every block
+// of its tables. With paranoid-checks a shard with a corrupt table or log
+// fails to open instead of returning partial points, Verify reads every
+// block of the shard and reports which points it couldn't read.
+
+// The points of a column of a series that couldn't be read. The
+// corruption is after the last point that could be read. The series is
+// empty if the corruption isn't in the points but in the indexes of the
+// shard, or if the shard couldn't be opened at all.
+type CorruptRange struct {
+	Shard    uint32 `json:"shard"`
+	Database string `json:"database"`
+	Series   string `json:"series"`
+	Column   string `json:"column"`
+	// the time in microseconds of the last point that could be read, 0
+	// if there's none
+	After int64  `json:"after"`
+	Error string `json:"error"`
+}
+
+func (self *LevelDbShard) Verify() []*CorruptRange {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetVerifyChecksums(true)
+	// a verification doesn't evict the blocks the queries need
+	ro.SetFillCache(false)
+
+	corrupt := []*CorruptRange{}
+	for _, database := range self.Databases() {
+		for _, series := range self.getSeriesForDatabase(database) {
+			for _, column := range self.getColumnNamesForSeries(database, series) {
+				id, err := self.getIdForDbSeriesColumn(&database, &series, &column)
+				if err != nil {
+					corrupt = append(corrupt, &CorruptRange{Database: database, Series: series, Column: column, Error: err.Error()})
+					continue
+				}
+				if id == nil {
+					continue
+				}
+				if after, err := self.verifyColumn(ro, id); err != nil {
+					corrupt = append(corrupt, &CorruptRange{Database: database, Series: series, Column: column, After: after, Error: err.Error()})
+				}
+			}
+		}
+	}
+
+	// the indexes and everything else that isn't a point
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+	}
+	if err := it.GetError(); err != nil && len(corrupt) == 0 {
+		corrupt = append(corrupt, &CorruptRange{Error: err.Error()})
+	}
+	return corrupt
+}
+
+// Reads every point of the column, returns the time of the last point
+// read before the error
+func (self *LevelDbShard) verifyColumn(ro *levigo.ReadOptions, id []byte) (int64, error) {
+	it := self.db.NewIterator(ro)
+	defer it.Close()
+	after := int64(0)
+	for it.Seek(id); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < 16 || !bytes.Equal(key[:8], id) {
+			break
+		}
+		t := binary.BigEndian.Uint64(key[8:16])
+		after = self.convertUintTimestampToInt64(&t)
+	}
+	return after, it.GetError()
+}
+
+// Verifies the given shards, or every shard stored on this server if
+// none is given. The shards that can't be opened are reported as
+// corrupt.
+func (self *LevelDbShardDatastore) Verify(shardIds []uint32) ([]*CorruptRange, error) {
+	if len(shardIds) == 0 {
+		ids, err := self.localShardIds()
+		if err != nil {
+			return nil, err
+		}
+		shardIds = ids
+	}
+
+	corrupt := []*CorruptRange{}
+	for _, id := range shardIds {
+		shard, err := self.GetOrCreateShard(id)
+		if err != nil {
+			corrupt = append(corrupt, &CorruptRange{Shard: id, Error: err.Error()})
+			continue
+		}
+		for _, r := range shard.(StorageEngine).Verify() {
+			r.Shard = id
+			corrupt = append(corrupt, r)
+		}
+		self.ReturnShard(id)
+	}
+	return corrupt, nil
+}
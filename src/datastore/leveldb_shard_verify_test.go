@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_VERIFY_DIR = "/tmp/influxdb/leveldb_shard_verify_test"
+
+type LevelDbVerifySuite struct{}
+
+var _ = Suite(&LevelDbVerifySuite{})
+
+func (self *LevelDbVerifySuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_VERIFY_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbVerifySuite) openShard(c *C) *LevelDbShard {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_VERIFY_DIR, opts)
+	c.Assert(err, IsNil)
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	return shard
+}
+
+func (self *LevelDbVerifySuite) TestCorruptPointsAreReported(c *C) {
+	shard := self.openShard(c)
+	now := common.TimeToMicroseconds(time.Now())
+	points := []*protocol.Point{}
+	for i := 0; i < 1000; i++ {
+		point := &protocol.Point{
+			SequenceNumber: proto.Uint64(1),
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+		}
+		point.SetTimestampInMicroseconds(now + int64(i))
+		points = append(points, point)
+	}
+	series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}, Points: points}
+	c.Assert(shard.Write("db1", []*protocol.Series{series}), IsNil)
+	shard.Compact()
+	c.Assert(shard.Verify(), HasLen, 0)
+	shard.Close()
+
+	// flip a byte of the first block of the points
+	tables, err := filepath.Glob(filepath.Join(TEST_VERIFY_DIR, "*.sst"))
+	c.Assert(err, IsNil)
+	c.Assert(tables, Not(HasLen), 0)
+	data, err := ioutil.ReadFile(tables[0])
+	c.Assert(err, IsNil)
+	data[10] ^= 0xFF
+	c.Assert(ioutil.WriteFile(tables[0], data, 0644), IsNil)
+
+	shard = self.openShard(c)
+	defer shard.Close()
+	corrupt := shard.Verify()
+	c.Assert(corrupt, Not(HasLen), 0)
+	c.Assert(corrupt[0].Database, Equals, "db1")
+	c.Assert(corrupt[0].Series, Equals, "foo")
+	c.Assert(corrupt[0].Column, Equals, "value")
+}
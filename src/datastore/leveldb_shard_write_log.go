@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"math"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+)
+
+// The shard logs its last LEVELDB_WRITE_LOG_SIZE writes keyed by an
+// increasing write sequence, in the same batch as the points. A replica
+// that was down asks another replica for the writes since the last
+// sequence it caught up to, which it keeps per replica. Deletes aren't
+// logged, a replica that missed a delete gets it from the tombstones.
+
+const LEVELDB_WRITE_LOG_SIZE = 10000
+
+var (
+	// WRITE_LOG_PREFIX is the prefix of the logged writes, followed by
+	// their sequence
+	WRITE_LOG_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFB}
+	// REPLICA_SEQUENCE_PREFIX is the prefix of the sequences of the other
+	// replicas the shard caught up to, followed by their server id
+	REPLICA_SEQUENCE_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFA}
+
+	writeLogRequest = protocol.Request_WRITE
+)
+
+func writeLogKey(sequence uint64) []byte {
+	key := make([]byte, len(WRITE_LOG_PREFIX)+8)
+	copy(key, WRITE_LOG_PREFIX)
+	binary.BigEndian.PutUint64(key[len(WRITE_LOG_PREFIX):], sequence)
+	return key
+}
+
+// returns the sequence of the write log key, false if the key isn't one
+func writeLogSequence(key []byte) (uint64, bool) {
+	if len(key) != len(WRITE_LOG_PREFIX)+8 || !bytes.HasPrefix(key, WRITE_LOG_PREFIX) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(key[len(WRITE_LOG_PREFIX):]), true
+}
+
+// Returns the sequence of the last logged write, 0 if nothing was
+// written to the shard since it started logging writes
+func lastWriteSequence(db *levigo.DB, ro *levigo.ReadOptions) uint64 {
+	it := db.NewIterator(ro)
+	defer it.Close()
+	it.Seek(writeLogKey(math.MaxUint64))
+	if it.Valid() {
+		it.Prev()
+	} else {
+		it.SeekToLast()
+	}
+	if !it.Valid() {
+		return 0
+	}
+	sequence, _ := writeLogSequence(it.Key())
+	return sequence
+}
+
+// Logs the write in the batch and commits it, the writes have to
+// be committed in the order of their sequence
+func (self *LevelDbShard) commitLoggedWrite(wb *levigo.WriteBatch, database string, series []*protocol.Series) error {
+	self.writeLogLock.Lock()
+	defer self.writeLogLock.Unlock()
+
+	sequence := self.writeSequence + 1
+	data, err := proto.Marshal(&protocol.Request{
+		Type:           &writeLogRequest,
+		Database:       &database,
+		MultiSeries:    series,
+		SequenceNumber: &sequence,
+	})
+	if err != nil {
+		return err
+	}
+	wb.Put(writeLogKey(sequence), data)
+	if sequence > LEVELDB_WRITE_LOG_SIZE {
+		wb.Delete(writeLogKey(sequence - LEVELDB_WRITE_LOG_SIZE))
+	}
+	if err := self.db.Write(self.writeOptions, wb); err != nil {
+		return err
+	}
+	self.writeSequence = sequence
+	return nil
+}
+
+func (self *LevelDbShard) WritesSince(sequence uint64, yield func(sequence uint64, database string, series []*protocol.Series) error) (uint64, error) {
+	self.writeLogLock.Lock()
+	last := self.writeSequence
+	self.writeLogLock.Unlock()
+	if sequence >= last {
+		return last, nil
+	}
+
+	it := self.db.NewIterator(self.readOptions)
+	defer it.Close()
+	expected := sequence + 1
+	for it.Seek(writeLogKey(expected)); it.Valid() && expected <= last; it.Next() {
+		logged, ok := writeLogSequence(it.Key())
+		if !ok || logged != expected {
+			break
+		}
+		request := &protocol.Request{}
+		if err := proto.Unmarshal(it.Value(), request); err != nil {
+			return last, err
+		}
+		if err := yield(logged, request.GetDatabase(), request.MultiSeries); err != nil {
+			return last, err
+		}
+		expected++
+	}
+	if err := it.GetError(); err != nil {
+		return last, err
+	}
+	if expected <= last {
+		return last, cluster.ErrWriteLogTruncated
+	}
+	return last, nil
+}
+
+func replicaSequenceKey(serverId uint32) []byte {
+	key := make([]byte, len(REPLICA_SEQUENCE_PREFIX)+4)
+	copy(key, REPLICA_SEQUENCE_PREFIX)
+	binary.BigEndian.PutUint32(key[len(REPLICA_SEQUENCE_PREFIX):], serverId)
+	return key
+}
+
+func (self *LevelDbShard) ReplicaSequence(serverId uint32) (uint64, error) {
+	data, err := self.db.Get(self.readOptions, replicaSequenceKey(serverId))
+	if err != nil || len(data) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (self *LevelDbShard) SetReplicaSequence(serverId uint32, sequence uint64) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, sequence)
+	return self.db.Put(self.writeOptions, replicaSequenceKey(serverId), data)
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"cluster"
+	"common"
+	"os"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_WRITE_LOG_DIR = "/tmp/influxdb/leveldb_shard_write_log_test"
+
+type LevelDbWriteLogSuite struct{}
+
+var _ = Suite(&LevelDbWriteLogSuite{})
+
+func (self *LevelDbWriteLogSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_WRITE_LOG_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *LevelDbWriteLogSuite) TestTheWritesSinceASequenceAreReplayed(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_WRITE_LOG_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	now := common.TimeToMicroseconds(time.Now())
+	for i, database := range []string{"db1", "db2", "db1"} {
+		point := &protocol.Point{
+			SequenceNumber: proto.Uint64(1),
+			Values:         []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(int64(i))}},
+		}
+		point.SetTimestampInMicroseconds(now + int64(i))
+		series := &protocol.Series{Name: protocol.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+		c.Assert(shard.Write(database, []*protocol.Series{series}), IsNil)
+	}
+
+	sequences := []uint64{}
+	databases := []string{}
+	last, err := shard.WritesSince(1, func(sequence uint64, database string, series []*protocol.Series) error {
+		sequences = append(sequences, sequence)
+		databases = append(databases, database)
+		c.Assert(series, HasLen, 1)
+		c.Assert(series[0].Points[0].Values[0].GetInt64Value(), Equals, int64(sequence-1))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, uint64(3))
+	c.Assert(sequences, DeepEquals, []uint64{2, 3})
+	c.Assert(databases, DeepEquals, []string{"db2", "db1"})
+
+	// the sequence survives a restart
+	reopened, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	c.Assert(reopened.writeSequence, Equals, uint64(3))
+
+	// writes that were dropped from the log can't be replayed
+	c.Assert(db.Delete(levigo.NewWriteOptions(), writeLogKey(1)), IsNil)
+	_, err = shard.WritesSince(0, func(uint64, string, []*protocol.Series) error { return nil })
+	c.Assert(err, Equals, cluster.ErrWriteLogTruncated)
+}
+
+func (self *LevelDbWriteLogSuite) TestTheSequencesOfTheReplicasAreKept(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_WRITE_LOG_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+
+	sequence, err := shard.ReplicaSequence(2)
+	c.Assert(err, IsNil)
+	c.Assert(sequence, Equals, uint64(0))
+	c.Assert(shard.SetReplicaSequence(2, 42), IsNil)
+	sequence, err = shard.ReplicaSequence(2)
+	c.Assert(err, IsNil)
+	c.Assert(sequence, Equals, uint64(42))
+	sequence, err = shard.ReplicaSequence(3)
+	c.Assert(err, IsNil)
+	c.Assert(sequence, Equals, uint64(0))
+}
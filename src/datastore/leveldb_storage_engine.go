@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"configuration"
+	"fmt"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+const LEVELDB_STORAGE_ENGINE = "leveldb"
+
+func init() {
+	RegisterStorageEngine(LEVELDB_STORAGE_ENGINE, newLevelDbStorageEngine)
+}
+
+// Opens the shards as leveldb databases, they all share the same lru
+// cache
+type levelDbStorageEngine struct {
+	options        *levigo.Options
+	pointBatchSize int
+	writeBatchSize int
+	valueCodec     string
+	dedupWindow    time.Duration
+	syncWrites     bool
+	coerceTypes    bool
+	indexedColumns []string
+}
+
+func newLevelDbStorageEngine(config *configuration.Configuration) (StorageEngineOpener, error) {
+	switch config.LevelDbFieldTypeConflicts {
+	case "", REJECT_FIELD_TYPE_CONFLICTS, COERCE_FIELD_TYPE_CONFLICTS:
+	default:
+		return nil, fmt.Errorf("Unknown field type conflicts setting %s, must be %s or %s", config.LevelDbFieldTypeConflicts, REJECT_FIELD_TYPE_CONFLICTS, COERCE_FIELD_TYPE_CONFLICTS)
+	}
+	valueCodec := config.LevelDbValueCodec
+	if valueCodec == "" {
+		valueCodec = PROTOBUF_VALUE_CODEC
+	}
+	if _, err := getValueCodec(valueCodec); err != nil {
+		return nil, err
+	}
+	opts := levigo.NewOptions()
+	opts.SetCache(levigo.NewLRUCache(config.LevelDbLruCacheSize))
+	opts.SetCreateIfMissing(true)
+	blockSize := config.LevelDbBlockSize
+	if blockSize == 0 {
+		blockSize = 64 * ONE_KILOBYTE
+	}
+	opts.SetBlockSize(blockSize)
+	if config.LevelDbWriteBufferSize > 0 {
+		opts.SetWriteBufferSize(config.LevelDbWriteBufferSize)
+	}
+	filter := levigo.NewBloomFilter(SHARD_BLOOM_FILTER_BITS_PER_KEY)
+	opts.SetFilterPolicy(filter)
+	opts.SetMaxOpenFiles(config.LevelDbMaxOpenFiles)
+	opts.SetParanoidChecks(config.LevelDbParanoidChecks)
+
+	return &levelDbStorageEngine{
+		options:        opts,
+		pointBatchSize: config.LevelDbPointBatchSize,
+		writeBatchSize: config.LevelDbWriteBatchSize,
+		valueCodec:     valueCodec,
+		dedupWindow:    config.LevelDbWriteDedupWindow,
+		syncWrites:     config.LevelDbSyncWrites,
+		coerceTypes:    config.LevelDbFieldTypeConflicts == COERCE_FIELD_TYPE_CONFLICTS,
+		indexedColumns: config.LevelDbIndexedColumns,
+	}, nil
+}
+
+func (self *levelDbStorageEngine) Open(dir string) (StorageEngine, error) {
+	ldb, err := levigo.Open(dir, self.options)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := NewLevelDbShard(ldb, self.pointBatchSize, self.writeBatchSize, self.valueCodec)
+	if err != nil {
+		ldb.Close()
+		return nil, err
+	}
+	if self.dedupWindow > 0 {
+		db.writeDedupWindow = self.dedupWindow
+	}
+	db.writeOptions.SetSync(self.syncWrites)
+	db.coerceFieldTypes = self.coerceTypes
+	if err := db.setIndexedColumns(self.indexedColumns); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
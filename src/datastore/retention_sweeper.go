@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Deletes the points of the databases that are past their retention from
+// the local shards every period. The retentions are asked for before
+// every sweep, so they can change while the sweeper runs.
+func (self *LevelDbShardDatastore) StartRetentionSweeper(period time.Duration, retentions func() map[string]time.Duration) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	if self.stopRetentionSweeper != nil || period <= 0 {
+		return
+	}
+	stop := make(chan bool)
+	self.stopRetentionSweeper = stop
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := self.DropExpiredPoints(time.Now(), retentions()); err != nil {
+					log.Error("DATASTORE: cannot drop the expired points: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Deletes the points older than the retention of their database from
+// every local shard, the shards that aren't open are opened for it
+func (self *LevelDbShardDatastore) DropExpiredPoints(now time.Time, retentions map[string]time.Duration) error {
+	if len(retentions) == 0 {
+		return nil
+	}
+	dirs, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		if err := self.dropExpiredPointsOfShard(uint32(id), now, retentions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *LevelDbShardDatastore) dropExpiredPointsOfShard(id uint32, now time.Time, retentions map[string]time.Duration) error {
+	shard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	for database, retention := range retentions {
+		log.Debug("DATASTORE: dropping the points of %s older than %s from shard %d", database, retention, id)
+		if err := shard.(StorageEngine).DropPointsBefore(database, now.Add(-retention)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
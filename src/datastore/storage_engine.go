@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"cluster"
+	"configuration"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The storage of the local copy of a shard, every shard is stored in a
+// directory of its own
+type StorageEngine interface {
+	cluster.LocalShardDb
+	// deletes the points of the database older than the given time
+	DropPointsBefore(database string, t time.Time) error
+	// returns the databases that have series in the shard
+	Databases() []string
+	// returns the names of the series of the database in the shard
+	SeriesNames(database string) []string
+	// returns the stats of the engine about the shard, they're reported
+	// as the metrics of the shard while it's open
+	Stats() map[string]int64
+	// reads every point of the shard, returns the ones that are corrupt
+	Verify() []*CorruptRange
+	// removes the series listed without points from the indexes
+	Reconcile() ([]*SeriesRepair, error)
+	Compact()
+	Close()
+}
+
+// Opens the shards of an engine, the datastore creates one when it
+// starts and then opens every shard with it
+type StorageEngineOpener interface {
+	// opens the shard stored in dir, creating it if it doesn't exist
+	Open(dir string) (StorageEngine, error)
+}
+
+type StorageEngineInitializer func(config *configuration.Configuration) (StorageEngineOpener, error)
+
+var storageEngines = map[string]StorageEngineInitializer{}
+
+// Makes the engine available to the storage-engine setting, the engines
+// register themselves in an init()
+func RegisterStorageEngine(name string, initializer StorageEngineInitializer) {
+	if _, ok := storageEngines[name]; ok {
+		panic(fmt.Sprintf("Storage engine %s is registered twice", name))
+	}
+	storageEngines[name] = initializer
+}
+
+func newStorageEngineOpener(config *configuration.Configuration) (StorageEngineOpener, error) {
+	name := config.StorageEngine
+	if name == "" {
+		name = LEVELDB_STORAGE_ENGINE
+	}
+	initializer, ok := storageEngines[name]
+	if !ok {
+		names := make([]string, 0, len(storageEngines))
+		for engine, _ := range storageEngines {
+			names = append(names, engine)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown storage engine %s, must be one of %v", name, names)
+	}
+	return initializer(config)
+}
@@ -0,0 +1,151 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Encodes the field values of the points written to a shard. Every point
+// of every column is a key of its own, so the codecs encode single values,
+// the blocks of leveldb are already compressed with snappy.
+type ValueCodec interface {
+	Encode(value *protocol.FieldValue) ([]byte, error)
+	Decode(data []byte, value *protocol.FieldValue) error
+}
+
+const (
+	PROTOBUF_VALUE_CODEC = "protobuf"
+	COMPACT_VALUE_CODEC  = "compact"
+)
+
+var valueCodecs = map[string]ValueCodec{
+	PROTOBUF_VALUE_CODEC: protobufValueCodec{},
+	COMPACT_VALUE_CODEC:  compactValueCodec{},
+}
+
+func getValueCodec(name string) (ValueCodec, error) {
+	codec, ok := valueCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown value codec %s", name)
+	}
+	return codec, nil
+}
+
+// the format the shards used before the codecs, the values are marshaled
+// FieldValues
+type protobufValueCodec struct{}
+
+func (self protobufValueCodec) Encode(value *protocol.FieldValue) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (self protobufValueCodec) Decode(data []byte, value *protocol.FieldValue) error {
+	return proto.Unmarshal(data, value)
+}
+
+// The first byte of the value is its kind followed by the shortest
+// encoding of the value, e.g. a double that's an integer is stored as a
+// varint. The kinds start at 0x80 which is never the first byte of a
+// marshaled FieldValue, so the codec can also decode the values written
+// before the shard switched codecs.
+type compactValueCodec struct{}
+
+const (
+	compactIntegralDouble byte = 0x80 + iota
+	compactFloat32Double
+	compactDouble
+	compactInt64
+	compactTrue
+	compactFalse
+	compactString
+)
+
+func (self compactValueCodec) Encode(value *protocol.FieldValue) ([]byte, error) {
+	switch {
+	case value.DoubleValue != nil:
+		d := *value.DoubleValue
+		if i := int64(d); float64(i) == d && !(d == 0 && math.Signbit(d)) {
+			return appendVarint(compactIntegralDouble, i), nil
+		}
+		if f := float32(d); float64(f) == d {
+			data := make([]byte, 5)
+			data[0] = compactFloat32Double
+			binary.BigEndian.PutUint32(data[1:], math.Float32bits(f))
+			return data, nil
+		}
+		data := make([]byte, 9)
+		data[0] = compactDouble
+		binary.BigEndian.PutUint64(data[1:], math.Float64bits(d))
+		return data, nil
+	case value.Int64Value != nil:
+		return appendVarint(compactInt64, *value.Int64Value), nil
+	case value.BoolValue != nil:
+		if *value.BoolValue {
+			return []byte{compactTrue}, nil
+		}
+		return []byte{compactFalse}, nil
+	case value.StringValue != nil:
+		return append([]byte{compactString}, *value.StringValue...), nil
+	}
+	// nothing compact about it, e.g. a null value
+	return proto.Marshal(value)
+}
+
+func (self compactValueCodec) Decode(data []byte, value *protocol.FieldValue) error {
+	if len(data) == 0 || data[0] < compactIntegralDouble {
+		return proto.Unmarshal(data, value)
+	}
+	kind, data := data[0], data[1:]
+	switch kind {
+	case compactIntegralDouble:
+		i, err := readVarint(data)
+		if err != nil {
+			return err
+		}
+		value.DoubleValue = proto.Float64(float64(i))
+	case compactFloat32Double:
+		if len(data) != 4 {
+			return fmt.Errorf("Invalid float32 value of length %d", len(data))
+		}
+		value.DoubleValue = proto.Float64(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+	case compactDouble:
+		if len(data) != 8 {
+			return fmt.Errorf("Invalid double value of length %d", len(data))
+		}
+		value.DoubleValue = proto.Float64(math.Float64frombits(binary.BigEndian.Uint64(data)))
+	case compactInt64:
+		i, err := readVarint(data)
+		if err != nil {
+			return err
+		}
+		value.Int64Value = proto.Int64(i)
+	case compactTrue:
+		value.BoolValue = proto.Bool(true)
+	case compactFalse:
+		value.BoolValue = proto.Bool(false)
+	case compactString:
+		value.StringValue = proto.String(string(data))
+	default:
+		return fmt.Errorf("Unknown value kind %d", kind)
+	}
+	return nil
+}
+
+func appendVarint(kind byte, i int64) []byte {
+	data := make([]byte, 1+binary.MaxVarintLen64)
+	data[0] = kind
+	n := binary.PutVarint(data[1:], i)
+	return data[:1+n]
+}
+
+func readVarint(data []byte) (int64, error) {
+	i, n := binary.Varint(data)
+	if n != len(data) {
+		return 0, fmt.Errorf("Invalid varint value")
+	}
+	return i, nil
+}
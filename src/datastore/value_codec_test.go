@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"math"
+	"os"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jmhodges/levigo"
+	. "launchpad.net/gocheck"
+)
+
+const TEST_VALUE_CODEC_DIR = "/tmp/influxdb/value_codec_test"
+
+type ValueCodecSuite struct{}
+
+var _ = Suite(&ValueCodecSuite{})
+
+func (self *ValueCodecSuite) SetUpTest(c *C) {
+	err := os.RemoveAll(TEST_VALUE_CODEC_DIR)
+	c.Assert(err, IsNil)
+}
+
+func (self *ValueCodecSuite) TestCompactValuesAreDecodedBack(c *C) {
+	values := []*protocol.FieldValue{
+		&protocol.FieldValue{DoubleValue: protocol.Float64(42)},
+		&protocol.FieldValue{DoubleValue: protocol.Float64(-1.5)},
+		&protocol.FieldValue{DoubleValue: protocol.Float64(math.Pi)},
+		&protocol.FieldValue{DoubleValue: protocol.Float64(math.Copysign(0, -1))},
+		&protocol.FieldValue{Int64Value: protocol.Int64(math.MinInt64)},
+		&protocol.FieldValue{BoolValue: proto.Bool(false)},
+		&protocol.FieldValue{StringValue: protocol.String("foo")},
+		&protocol.FieldValue{StringValue: protocol.String("")},
+	}
+	codec := compactValueCodec{}
+	for _, value := range values {
+		data, err := codec.Encode(value)
+		c.Assert(err, IsNil)
+		decoded := &protocol.FieldValue{}
+		c.Assert(codec.Decode(data, decoded), IsNil)
+		c.Assert(decoded.String(), Equals, value.String())
+	}
+
+	// integers are a lot smaller than their marshaled FieldValue
+	data, err := codec.Encode(values[0])
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 2)
+
+	// the values written with protobuf can still be read
+	data, err = protobufValueCodec{}.Encode(values[2])
+	c.Assert(err, IsNil)
+	decoded := &protocol.FieldValue{}
+	c.Assert(codec.Decode(data, decoded), IsNil)
+	c.Assert(decoded.GetDoubleValue(), Equals, math.Pi)
+}
+
+func (self *ValueCodecSuite) TestShardsKeepTheirValueCodec(c *C) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(TEST_VALUE_CODEC_DIR, opts)
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	shard, err := NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	c.Assert(shard.valueCodec, Equals, valueCodecs[COMPACT_VALUE_CODEC])
+
+	shard, err = NewLevelDbShard(db, 100, 100, PROTOBUF_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	c.Assert(shard.valueCodec, Equals, valueCodecs[COMPACT_VALUE_CODEC])
+
+	// shards with data and without a codec were created before the codecs
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	c.Assert(db.Delete(wo, VALUE_CODEC_KEY), IsNil)
+	c.Assert(db.Put(wo, NEXT_ID_KEY, []byte{1}), IsNil)
+	shard, err = NewLevelDbShard(db, 100, 100, COMPACT_VALUE_CODEC)
+	c.Assert(err, IsNil)
+	c.Assert(shard.valueCodec, Equals, valueCodecs[PROTOBUF_VALUE_CODEC])
+}
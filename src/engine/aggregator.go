@@ -2,6 +2,7 @@ package engine
 
 import (
 	"common"
+	"container/heap"
 	"fmt"
 	"math"
 	"parser"
@@ -22,6 +23,14 @@ type Aggregator interface {
 	ColumnNames() []string
 }
 
+// Implemented by the aggregators that select points of the group, e.g.
+// top(), rather than computing values from them. The selected points keep
+// their own timestamps when the selector is the only aggregator of the
+// query, the timestamps are in the order of GetValues().
+type SelectorAggregator interface {
+	GetTimestamps(state interface{}) []int64
+}
+
 // Initialize a new aggregator given the query, the function call of
 // the aggregator and the default value that should be returned if
 // the bucket doesn't have any points
@@ -34,6 +43,7 @@ func init() {
 	registeredAggregators["count"] = NewCountAggregator
 	registeredAggregators["histogram"] = NewHistogramAggregator
 	registeredAggregators["derivative"] = NewDerivativeAggregator
+	registeredAggregators["non_negative_derivative"] = NewNonNegativeDerivativeAggregator
 	registeredAggregators["difference"] = NewDifferenceAggregator
 	registeredAggregators["stddev"] = NewStandardDeviationAggregator
 	registeredAggregators["min"] = NewMinAggregator
@@ -47,6 +57,7 @@ func init() {
 	registeredAggregators["last"] = NewLastAggregator
 	registeredAggregators["top"] = NewTopAggregator
 	registeredAggregators["bottom"] = NewBottomAggregator
+	registeredAggregators["moving_average"] = NewMovingAverageAggregator
 }
 
 // used in testing to get a list of all aggregators
@@ -81,6 +92,12 @@ func wrapDefaultValue(defaultValue *parser.Value) (*protocol.FieldValue, error)
 		v, _ := strconv.Atoi(defaultValue.Name)
 		value := int64(v)
 		return &protocol.FieldValue{Int64Value: &value}, nil
+	case parser.ValueFloat:
+		value, _ := strconv.ParseFloat(defaultValue.Name, 64)
+		return &protocol.FieldValue{DoubleValue: &value}, nil
+	case parser.ValueSimpleName:
+		// fill(null) and fill(previous) are filled by the engine
+		return nil, nil
 	default:
 		return nil, fmt.Errorf("Unknown type %s", defaultValue.Type)
 	}
@@ -263,10 +280,13 @@ func NewCompositeAggregator(left, right Aggregator) (Aggregator, error) {
 
 // StandardDeviation Aggregator
 
+// The running mean and sum of the squared differences from the mean of
+// the values, they're updated with welford's method which doesn't lose
+// precision like the sum of the squares does on large values
 type StandardDeviationRunning struct {
-	count   int
-	totalX2 float64
-	totalX  float64
+	count int
+	mean  float64
+	m2    float64
 }
 
 type StandardDeviationAggregator struct {
@@ -297,8 +317,9 @@ func (self *StandardDeviationAggregator) AggregatePoint(state interface{}, p *pr
 	}
 
 	running.count++
-	running.totalX += value
-	running.totalX2 += value * value
+	delta := value - running.mean
+	running.mean += delta / float64(running.count)
+	running.m2 += delta * (value - running.mean)
 	return running, nil
 }
 
@@ -316,10 +337,7 @@ func (self *StandardDeviationAggregator) GetValues(state interface{}) [][]*proto
 		return nil
 	}
 
-	eX := r.totalX / float64(r.count)
-	eX *= eX
-	eX2 := r.totalX2 / float64(r.count)
-	standardDeviation := math.Sqrt(eX2 - eX)
+	standardDeviation := math.Sqrt(r.m2 / float64(r.count))
 
 	return [][]*protocol.FieldValue{
 		[]*protocol.FieldValue{
@@ -354,13 +372,32 @@ func NewStandardDeviationAggregator(q *parser.SelectQuery, v *parser.Value, defa
 // Derivative Aggregator
 //
 
+// The points of the group, they're sorted by time once the group is
+// complete since the points of the shards don't come in order
 type DerivativeAggregatorState struct {
-	firstValue *protocol.Point
-	lastValue  *protocol.Point
+	points []*protocol.Point
+}
+
+func (self *DerivativeAggregatorState) Len() int {
+	return len(self.points)
+}
+
+func (self *DerivativeAggregatorState) Less(i, j int) bool {
+	return pointBefore(self.points[i], self.points[j])
+}
+
+func (self *DerivativeAggregatorState) Swap(i, j int) {
+	self.points[i], self.points[j] = self.points[j], self.points[i]
 }
 
 type DerivativeAggregator struct {
 	AbstractAggregator
+	// the rate is per unit of time, a second unless the query has another
+	unit time.Duration
+	// the counters go back to zero when they're reset, the decreases
+	// between consecutive points are counted as zero
+	nonNegative  bool
+	name         string
 	defaultValue *protocol.FieldValue
 	alias        string
 }
@@ -382,21 +419,16 @@ func (self *DerivativeAggregator) AggregatePoint(state interface{}, p *protocol.
 	}
 
 	newValue := &protocol.Point{
-		Timestamp: p.Timestamp,
-		Values:    []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: &value}},
+		Timestamp:      p.Timestamp,
+		SequenceNumber: p.SequenceNumber,
+		Values:         []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: &value}},
 	}
 
 	s, ok := state.(*DerivativeAggregatorState)
 	if !ok {
 		s = &DerivativeAggregatorState{}
 	}
-
-	if s.firstValue == nil {
-		s.firstValue = newValue
-		return s, nil
-	}
-
-	s.lastValue = newValue
+	s.points = append(s.points, newValue)
 	return s, nil
 }
 
@@ -404,35 +436,56 @@ func (self *DerivativeAggregator) ColumnNames() []string {
 	if self.alias != "" {
 		return []string{self.alias}
 	}
-	return []string{"derivative"}
+	return []string{self.name}
 }
 
 func (self *DerivativeAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
 	s, ok := state.(*DerivativeAggregatorState)
 
-	if !(ok && s.firstValue != nil && s.lastValue != nil) {
+	if !ok || len(s.points) < 2 {
 		return nil
 	}
 
-	// if an old value exist, then compute the derivative and insert it in the points slice
-	deltaT := float64(*s.lastValue.Timestamp-*s.firstValue.Timestamp) / float64(time.Second/time.Microsecond)
-	deltaV := *s.lastValue.Values[0].DoubleValue - *s.firstValue.Values[0].DoubleValue
+	// the changes between consecutive points over the time between the
+	// first and the last one
+	sort.Sort(s)
+	deltaV := 0.0
+	for i := 1; i < len(s.points); i++ {
+		delta := *s.points[i].Values[0].DoubleValue - *s.points[i-1].Values[0].DoubleValue
+		if self.nonNegative && delta < 0 {
+			delta = 0
+		}
+		deltaV += delta
+	}
+	first, last := s.points[0], s.points[len(s.points)-1]
+	deltaT := float64(*last.Timestamp-*first.Timestamp) / float64(self.unit/time.Microsecond)
 	derivative := deltaV / deltaT
 	return [][]*protocol.FieldValue{
 		[]*protocol.FieldValue{
 			&protocol.FieldValue{DoubleValue: &derivative},
 		},
 	}
-	return [][]*protocol.FieldValue{}
 }
 
-func NewDerivativeAggregator(q *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
-	if len(v.Elems) != 1 {
-		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function derivative() requires exactly one argument")
+func newDerivativeAggregator(name string, v *parser.Value, defaultValue *parser.Value, nonNegative bool) (Aggregator, error) {
+	if len(v.Elems) != 1 && len(v.Elems) != 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function %s() requires one or two arguments", name)
 	}
 
 	if v.Elems[0].Type == parser.ValueWildcard {
-		return nil, common.NewQueryError(common.InvalidArgument, "function derivative() doesn't work with wildcards")
+		return nil, common.NewQueryError(common.InvalidArgument, "function %s() doesn't work with wildcards", name)
+	}
+
+	unit := time.Second
+	if len(v.Elems) == 2 {
+		if v.Elems[1].Type != parser.ValueDuration {
+			return nil, common.NewQueryError(common.InvalidArgument, "function %s() requires a duration second argument, e.g. 1s", name)
+		}
+		duration, err := common.ParseTimeDuration(v.Elems[1].Name)
+		if err != nil || time.Duration(duration) < time.Microsecond {
+			return nil, common.NewQueryError(common.InvalidArgument, "invalid duration %s of function %s()", v.Elems[1].Name, name)
+		}
+		unit = time.Duration(duration)
 	}
 
 	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
@@ -444,11 +497,22 @@ func NewDerivativeAggregator(q *parser.SelectQuery, v *parser.Value, defaultValu
 		AbstractAggregator: AbstractAggregator{
 			value: v.Elems[0],
 		},
+		unit:         unit,
+		nonNegative:  nonNegative,
+		name:         name,
 		defaultValue: wrappedDefaultValue,
 		alias:        v.Alias,
 	}, nil
 }
 
+func NewDerivativeAggregator(_ *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	return newDerivativeAggregator("derivative", v, defaultValue, false)
+}
+
+func NewNonNegativeDerivativeAggregator(_ *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	return newDerivativeAggregator("non_negative_derivative", v, defaultValue, true)
+}
+
 //
 // Difference Aggregator
 //
@@ -481,8 +545,9 @@ func (self *DifferenceAggregator) AggregatePoint(state interface{}, p *protocol.
 	}
 
 	newValue := &protocol.Point{
-		Timestamp: p.Timestamp,
-		Values:    []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: &value}},
+		Timestamp:      p.Timestamp,
+		SequenceNumber: p.SequenceNumber,
+		Values:         []*protocol.FieldValue{&protocol.FieldValue{DoubleValue: &value}},
 	}
 
 	s, ok := state.(*DifferenceAggregatorState)
@@ -490,12 +555,19 @@ func (self *DifferenceAggregator) AggregatePoint(state interface{}, p *protocol.
 		s = &DifferenceAggregatorState{}
 	}
 
-	if s.firstValue == nil {
+	// the points come in the order of the query, the difference is
+	// always the latest value minus the earliest one
+	switch {
+	case s.firstValue == nil:
 		s.firstValue = newValue
-		return s, nil
+	case pointBefore(newValue, s.firstValue):
+		if s.lastValue == nil {
+			s.lastValue = s.firstValue
+		}
+		s.firstValue = newValue
+	case s.lastValue == nil || pointBefore(s.lastValue, newValue):
+		s.lastValue = newValue
 	}
-
-	s.lastValue = newValue
 	return s, nil
 }
 
@@ -826,8 +898,19 @@ func NewMedianAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValu
 // Percentile Aggregator
 //
 
+const (
+	// groups with more values than this are summarized by a t-digest
+	// instead of keeping all their values
+	PERCENTILE_EXACT_VALUES = 10000
+	PERCENTILE_COMPRESSION  = 100
+)
+
+// The values of a group are sorted to get the exact percentile, once a
+// group has too many values they're moved to a digest which gives an
+// approximation in bounded memory
 type PercentileAggregatorState struct {
 	values          []float64
+	digest          *tDigest
 	percentileValue float64
 }
 
@@ -859,8 +942,19 @@ func (self *PercentileAggregator) AggregatePoint(state interface{}, p *protocol.
 		s = &PercentileAggregatorState{}
 	}
 
-	s.values = append(s.values, value)
+	if s.digest != nil {
+		s.digest.add(value)
+		return s, nil
+	}
 
+	s.values = append(s.values, value)
+	if len(s.values) > PERCENTILE_EXACT_VALUES {
+		s.digest = newTDigest(PERCENTILE_COMPRESSION)
+		for _, v := range s.values {
+			s.digest.add(v)
+		}
+		s.values = nil
+	}
 	return s, nil
 }
 
@@ -885,6 +979,12 @@ func (self *PercentileAggregator) GetValues(state interface{}) [][]*protocol.Fie
 
 func (self *PercentileAggregator) CalculateSummaries(state interface{}) {
 	s := state.(*PercentileAggregatorState)
+	if s.digest != nil {
+		s.percentileValue = s.digest.quantile(self.percentile / 100.0)
+		s.digest = nil
+		return
+	}
+
 	sort.Float64s(s.values)
 	length := len(s.values)
 	index := int(math.Floor(float64(length)*self.percentile/100.0+0.5)) - 1
@@ -1167,7 +1267,10 @@ func NewDistinctAggregator(_ *parser.SelectQuery, value *parser.Value, defaultVa
 // Max, Min and Sum Aggregators
 //
 
-type FirstOrLastAggregatorState *protocol.FieldValue
+type FirstOrLastAggregatorState struct {
+	value *protocol.FieldValue
+	point *protocol.Point
+}
 
 type FirstOrLastAggregator struct {
 	AbstractAggregator
@@ -1182,10 +1285,13 @@ func (self *FirstOrLastAggregator) AggregatePoint(state interface{}, p *protocol
 		return nil, err
 	}
 
-	if state == nil || !self.isFirst {
-		state = FirstOrLastAggregatorState(value)
+	// the first and last values are the ones with the earliest and latest
+	// timestamps, whatever the order of the query is
+	s, ok := state.(*FirstOrLastAggregatorState)
+	if !ok || pointBefore(p, s.point) == self.isFirst {
+		s = &FirstOrLastAggregatorState{value: value, point: p}
 	}
-	return state, nil
+	return s, nil
 }
 
 func (self *FirstOrLastAggregator) ColumnNames() []string {
@@ -1193,17 +1299,22 @@ func (self *FirstOrLastAggregator) ColumnNames() []string {
 }
 
 func (self *FirstOrLastAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
-	s := state.(FirstOrLastAggregatorState)
+	s, ok := state.(*FirstOrLastAggregatorState)
+	if !ok {
+		return [][]*protocol.FieldValue{
+			[]*protocol.FieldValue{self.defaultValue},
+		}
+	}
 	return [][]*protocol.FieldValue{
 		[]*protocol.FieldValue{
-			s,
+			s.value,
 		},
 	}
 }
 
 func NewFirstOrLastAggregator(name string, v *parser.Value, isFirst bool, defaultValue *parser.Value) (Aggregator, error) {
 	if len(v.Elems) != 1 {
-		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function max() requires only one argument")
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function %s() requires only one argument", name)
 	}
 
 	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
@@ -1233,43 +1344,174 @@ func NewLastAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue
 	return NewFirstOrLastAggregator("last", value, false, defaultValue)
 }
 
+// Returns true if the point a was written before the point b, points
+// with the same timestamp are ordered by their sequence number
+func pointBefore(a, b *protocol.Point) bool {
+	if a.GetTimestamp() != b.GetTimestamp() {
+		return a.GetTimestamp() < b.GetTimestamp()
+	}
+	return a.GetSequenceNumber() < b.GetSequenceNumber()
+}
+
 //
-// Top, Bottom aggregators
+// Moving Average Aggregator
 //
-type ByPointColumnDesc struct {
-	protocol.PointsCollection
+
+// The values of the current window and their sum, the averages of the
+// windows are kept in the order the points were aggregated
+type MovingAverageAggregatorState struct {
+	window   []float64
+	next     int
+	sum      float64
+	averages []float64
 }
-type ByPointColumnAsc struct {
-	protocol.PointsCollection
+
+type MovingAverageAggregator struct {
+	AbstractAggregator
+	windowSize   int
+	defaultValue *protocol.FieldValue
+	alias        string
 }
 
-func (s ByPointColumnDesc) Less(i, j int) bool {
-	if s.PointsCollection[i] == nil || s.PointsCollection[j] == nil {
-		return false
+func (self *MovingAverageAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
+	fieldValue, err := GetValue(self.value, self.columns, p)
+	if err != nil {
+		return nil, err
 	}
 
-	if s.PointsCollection[i].Values[0].Int64Value != nil && s.PointsCollection[j].Values[0].Int64Value != nil {
-		return *s.PointsCollection[i].Values[0].Int64Value > *s.PointsCollection[j].Values[0].Int64Value
-	} else if s.PointsCollection[i].Values[0].DoubleValue != nil && s.PointsCollection[j].Values[0].DoubleValue != nil {
-		return *s.PointsCollection[i].Values[0].DoubleValue > *s.PointsCollection[j].Values[0].DoubleValue
-	} else if s.PointsCollection[i].Values[0].StringValue != nil && s.PointsCollection[j].Values[0].StringValue != nil {
-		return *s.PointsCollection[i].Values[0].StringValue > *s.PointsCollection[j].Values[0].StringValue
+	var value float64
+	if ptr := fieldValue.Int64Value; ptr != nil {
+		value = float64(*ptr)
+	} else if ptr := fieldValue.DoubleValue; ptr != nil {
+		value = *ptr
+	} else {
+		// else ignore this point
+		return state, nil
 	}
 
-	return false
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok {
+		s = &MovingAverageAggregatorState{window: make([]float64, 0, self.windowSize)}
+	}
+
+	if len(s.window) < self.windowSize {
+		s.window = append(s.window, value)
+	} else {
+		s.sum -= s.window[s.next]
+		s.window[s.next] = value
+		s.next = (s.next + 1) % self.windowSize
+	}
+	s.sum += value
+
+	if len(s.window) == self.windowSize {
+		s.averages = append(s.averages, s.sum/float64(self.windowSize))
+	}
+	return s, nil
 }
 
-func (s ByPointColumnAsc) Less(i, j int) bool {
-	if s.PointsCollection[i] == nil || s.PointsCollection[j] == nil {
-		return false
+func (self *MovingAverageAggregator) ColumnNames() []string {
+	if self.alias != "" {
+		return []string{self.alias}
+	}
+	return []string{"moving_average"}
+}
+
+func (self *MovingAverageAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok || len(s.averages) == 0 {
+		return nil
+	}
+
+	returnValues := [][]*protocol.FieldValue{}
+	for _, average := range s.averages {
+		returnValues = append(returnValues, []*protocol.FieldValue{
+			&protocol.FieldValue{DoubleValue: protocol.Float64(average)},
+		})
+	}
+	return returnValues
+}
+
+func NewMovingAverageAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(value.Elems) != 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function moving_average() requires exactly two arguments")
+	}
+
+	if value.Elems[0].Type == parser.ValueWildcard {
+		return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() doesn't work with wildcards")
+	}
+
+	windowSize, err := strconv.Atoi(value.Elems[1].Name)
+	if err != nil || windowSize <= 0 {
+		return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() requires a positive integer second argument")
 	}
 
-	return comparePointValue(s.PointsCollection[i], s.PointsCollection[j])
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MovingAverageAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: value.Elems[0],
+		},
+		windowSize:   windowSize,
+		defaultValue: wrappedDefaultValue,
+		alias:        value.Alias,
+	}, nil
 }
 
+//
+// Top, Bottom aggregators
+//
+
+// The points with the limit highest or lowest values of the group, kept in
+// a heap whose root is the point that would be dropped first, so a group
+// takes as much memory as its limit whatever its number of points
 type TopOrBottomAggregatorState struct {
-	values  protocol.PointsCollection
-	counter int64
+	points protocol.PointsCollection
+	isTop  bool
+}
+
+func (self *TopOrBottomAggregatorState) Len() int {
+	return len(self.points)
+}
+
+func (self *TopOrBottomAggregatorState) Less(i, j int) bool {
+	return self.worse(self.points[i], self.points[j])
+}
+
+func (self *TopOrBottomAggregatorState) Swap(i, j int) {
+	self.points[i], self.points[j] = self.points[j], self.points[i]
+}
+
+func (self *TopOrBottomAggregatorState) Push(x interface{}) {
+	self.points = append(self.points, x.(*protocol.Point))
+}
+
+func (self *TopOrBottomAggregatorState) Pop() interface{} {
+	last := self.points[len(self.points)-1]
+	self.points = self.points[:len(self.points)-1]
+	return last
+}
+
+// Returns true if the point a would be dropped before the point b, of the
+// points with the same value the earliest ones are kept
+func (self *TopOrBottomAggregatorState) worse(a, b *protocol.Point) bool {
+	if self.isTop && comparePointValue(a, b) || !self.isTop && comparePointValue(b, a) {
+		return true
+	}
+	if comparePointValue(a, b) || comparePointValue(b, a) {
+		return false
+	}
+	return pointBefore(b, a)
+}
+
+// Returns the points from the highest value for top() and the lowest one
+// for bottom(), the heap is left as it is
+func (self *TopOrBottomAggregatorState) sorted() protocol.PointsCollection {
+	sorted := &TopOrBottomAggregatorState{append(protocol.PointsCollection{}, self.points...), self.isTop}
+	sort.Sort(sort.Reverse(sorted))
+	return sorted.points
 }
 
 type TopOrBottomAggregator struct {
@@ -1278,8 +1520,7 @@ type TopOrBottomAggregator struct {
 	isTop        bool
 	defaultValue *protocol.FieldValue
 	alias        string
-	limit        int64
-	target       string
+	limit        int
 }
 
 func comparePointValue(a, b *protocol.Point) bool {
@@ -1294,66 +1535,40 @@ func comparePointValue(a, b *protocol.Point) bool {
 	return false
 }
 
-func (self *TopOrBottomAggregator) comparePoint(a, b *protocol.Point, greater bool) bool {
-	result := comparePointValue(a, b)
-
-	if !greater {
-		return !result
-	} else {
-		return result
-	}
-}
-
 func (self *TopOrBottomAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
-	var s *TopOrBottomAggregatorState
 	fieldValue, err := GetValue(self.value, self.columns, p)
 	if err != nil {
 		return nil, err
 	}
 
-	if state == nil {
-		s = &TopOrBottomAggregatorState{values: protocol.PointsCollection{}}
+	value := &protocol.FieldValue{}
+	if fieldValue.Int64Value != nil {
+		value.Int64Value = fieldValue.Int64Value
+	} else if fieldValue.DoubleValue != nil {
+		value.DoubleValue = fieldValue.DoubleValue
+	} else if fieldValue.StringValue != nil {
+		value.StringValue = fieldValue.StringValue
 	} else {
-		s = state.(*TopOrBottomAggregatorState)
+		// else ignore this point
+		return state, nil
 	}
 
-	sorter := func(values protocol.PointsCollection, isTop bool) {
-		if isTop {
-			sort.Sort(ByPointColumnDesc{values})
-		} else {
-			sort.Sort(ByPointColumnAsc{values})
-		}
+	s, ok := state.(*TopOrBottomAggregatorState)
+	if !ok {
+		s = &TopOrBottomAggregatorState{points: make(protocol.PointsCollection, 0, self.limit), isTop: self.isTop}
 	}
 
-	asFieldValue := func(p *protocol.Point) *protocol.FieldValue {
-		pp := &protocol.FieldValue{}
-		if fieldValue.Int64Value != nil {
-			pp.Int64Value = fieldValue.Int64Value
-		} else if fieldValue.DoubleValue != nil {
-			pp.DoubleValue = fieldValue.DoubleValue
-		} else if fieldValue.StringValue != nil {
-			pp.StringValue = fieldValue.StringValue
-		}
-		return pp
+	newValue := &protocol.Point{
+		Timestamp:      p.Timestamp,
+		SequenceNumber: p.SequenceNumber,
+		Values:         []*protocol.FieldValue{value},
 	}
-	if s.counter < self.limit {
-		newvalue := &protocol.Point{
-			Values: []*protocol.FieldValue{asFieldValue(p)},
-		}
-		s.values = append(s.values, newvalue)
-		sorter(s.values, self.isTop)
-		s.counter++
-	} else {
-		newvalue := &protocol.Point{
-			Values: []*protocol.FieldValue{asFieldValue(p)},
-		}
-		if self.comparePoint(s.values[s.counter-1], newvalue, self.isTop) {
-			s.values = append(s.values, p)
-			sorter(s.values, self.isTop)
-			s.values = s.values[0:self.limit]
-		}
+	if len(s.points) < self.limit {
+		heap.Push(s, newValue)
+	} else if s.worse(s.points[0], newValue) {
+		s.points[0] = newValue
+		heap.Fix(s, 0)
 	}
-
 	return s, nil
 }
 
@@ -1367,18 +1582,30 @@ func (self *TopOrBottomAggregator) ColumnNames() []string {
 
 func (self *TopOrBottomAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
 	returnValues := [][]*protocol.FieldValue{}
-	if state == nil {
+	s, ok := state.(*TopOrBottomAggregatorState)
+	if !ok {
 		returnValues = append(returnValues, []*protocol.FieldValue{self.defaultValue})
 	} else {
-		s := state.(*TopOrBottomAggregatorState)
-		for _, values := range s.values {
-			returnValues = append(returnValues, []*protocol.FieldValue{values.Values[0]})
+		for _, point := range s.sorted() {
+			returnValues = append(returnValues, []*protocol.FieldValue{point.Values[0]})
 		}
 	}
 
 	return returnValues
 }
 
+func (self *TopOrBottomAggregator) GetTimestamps(state interface{}) []int64 {
+	s, ok := state.(*TopOrBottomAggregatorState)
+	if !ok {
+		return nil
+	}
+	timestamps := make([]int64, 0, len(s.points))
+	for _, point := range s.sorted() {
+		timestamps = append(timestamps, point.GetTimestamp())
+	}
+	return timestamps
+}
+
 func (self *TopOrBottomAggregator) InitializeFieldsMetadata(series *protocol.Series) error {
 	self.columns = series.Fields
 	return nil
@@ -1398,9 +1625,9 @@ func NewTopOrBottomAggregator(name string, v *parser.Value, isTop bool, defaultV
 		return nil, err
 	}
 
-	limit, err := strconv.ParseInt(v.Elems[1].Name, 10, 64)
-	if err != nil {
-		return nil, err
+	limit, err := strconv.Atoi(v.Elems[1].Name)
+	if err != nil || limit <= 0 {
+		return nil, common.NewQueryError(common.InvalidArgument, "function %s() requires a positive integer second argument", name)
 	}
 
 	return &TopOrBottomAggregator{
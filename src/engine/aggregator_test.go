@@ -0,0 +1,219 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"math"
+	"parser"
+	"protocol"
+	"time"
+)
+
+type AggregatorSuite struct{}
+
+var _ = Suite(&AggregatorSuite{})
+
+func runAggregateQuery(c *C, queryString string, points ...*protocol.Point) []*protocol.Point {
+	query, err := parser.ParseSelectQuery(queryString)
+	c.Assert(err, IsNil)
+	responses := make(chan *protocol.Response, 10)
+	engine, err := NewQueryEngine(query, responses)
+	c.Assert(err, IsNil)
+	result := []*protocol.Point{}
+	for _, series := range runEngine(engine, responses, &protocol.Series{
+		Name:   protocol.String("t"),
+		Fields: []string{"value"},
+		Points: points,
+	}) {
+		result = append(result, series.Points...)
+	}
+	return result
+}
+
+func (self *AggregatorSuite) TestFirstLastAndDifferenceAreOrderedByTime(c *C) {
+	// the points come in the default descending order of the query
+	points := runAggregateQuery(c, "select first(value), last(value), difference(value), stddev(value) from t;",
+		newPoint(3, 7), newPoint(2, 3), newPoint(1, 5))
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Values[0].GetInt64Value(), Equals, int64(5))
+	c.Assert(points[0].Values[1].GetInt64Value(), Equals, int64(7))
+	c.Assert(points[0].Values[2].GetDoubleValue(), Equals, 2.0)
+	c.Assert(points[0].Values[3].GetDoubleValue(), Equals, math.Sqrt(8.0/3.0))
+}
+
+func (self *AggregatorSuite) TestDerivativesOfCounters(c *C) {
+	// the counter is reset after 20, the points come in descending order
+	points := []*protocol.Point{newPoint(4, 15), newPoint(3, 5), newPoint(2, 20), newPoint(1, 10)}
+	result := runAggregateQuery(c, "select derivative(value), non_negative_derivative(value), non_negative_derivative(value, 1m) from t;", points...)
+	c.Assert(result, HasLen, 1)
+	c.Assert(result[0].Values[0].GetDoubleValue(), Equals, 5.0/3.0)
+	c.Assert(result[0].Values[1].GetDoubleValue(), Equals, 20.0/3.0)
+	c.Assert(result[0].Values[2].GetDoubleValue(), Equals, 400.0)
+
+	// the points of each interval are consecutive
+	result = runAggregateQuery(c, "select non_negative_derivative(value) from t group by time(10s) order asc;",
+		newPoint(1, 10), newPoint(3, 30), newPoint(11, 0), newPoint(15, 4), newPoint(16, 2))
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].Values[0].GetDoubleValue(), Equals, 10.0)
+	c.Assert(result[1].Values[0].GetDoubleValue(), Equals, 0.8)
+}
+
+func (self *AggregatorSuite) TestDerivativeRequiresADurationUnit(c *C) {
+	query, err := parser.ParseSelectQuery("select derivative(value, 'a') from t;")
+	c.Assert(err, IsNil)
+	_, err = NewQueryEngine(query, make(chan *protocol.Response, 1))
+	c.Assert(err, NotNil)
+}
+
+func (self *AggregatorSuite) TestTopAndBottomKeepTheTimestampsOfThePoints(c *C) {
+	points := []*protocol.Point{newPoint(6, 3), newPoint(5, 9), newPoint(4, 1), newPoint(3, 9), newPoint(2, 5), newPoint(1, 7)}
+
+	result := runAggregateQuery(c, "select top(value, 3) from t;", points...)
+	c.Assert(result, HasLen, 3)
+	// of the points with the same value the earliest is first
+	for i, expected := range [][2]int64{{9, 3}, {9, 5}, {7, 1}} {
+		c.Assert(result[i].Values[0].GetInt64Value(), Equals, expected[0])
+		c.Assert(result[i].GetTimestamp(), Equals, expected[1]*1000000)
+	}
+
+	result = runAggregateQuery(c, "select bottom(value, 2) from t group by time(3s) order asc;", points...)
+	c.Assert(result, HasLen, 5)
+	for i, expected := range [][2]int64{{5, 2}, {7, 1}, {1, 4}, {9, 3}, {3, 6}} {
+		c.Assert(result[i].Values[0].GetInt64Value(), Equals, expected[0])
+		c.Assert(result[i].GetTimestamp(), Equals, expected[1]*1000000)
+	}
+}
+
+func (self *AggregatorSuite) TestTopRequiresAPositiveLimit(c *C) {
+	query, err := parser.ParseSelectQuery("select top(value, 0) from t;")
+	c.Assert(err, IsNil)
+	_, err = NewQueryEngine(query, make(chan *protocol.Response, 1))
+	c.Assert(err, NotNil)
+}
+
+func (self *AggregatorSuite) TestMovingAverage(c *C) {
+	points := runAggregateQuery(c, "select moving_average(value, 2) from t group by time(10s) order asc;",
+		newPoint(1, 2), newPoint(2, 4), newPoint(3, 6), newPoint(12, 10))
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].Values[0].GetDoubleValue(), Equals, 3.0)
+	c.Assert(points[1].Values[0].GetDoubleValue(), Equals, 5.0)
+
+	points = runAggregateQuery(c, "select moving_average(value, 3) from t order asc;",
+		newPoint(1, 2), newPoint(2, 4), newPoint(3, 6), newPoint(12, 10))
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].Values[0].GetDoubleValue(), Equals, 4.0)
+	c.Assert(points[1].Values[0].GetDoubleValue(), Equals, 20.0/3.0)
+}
+
+func (self *AggregatorSuite) TestMovingAverageRequiresAWindowSize(c *C) {
+	query, err := parser.ParseSelectQuery("select moving_average(value) from t;")
+	c.Assert(err, IsNil)
+	_, err = NewQueryEngine(query, make(chan *protocol.Response, 1))
+	c.Assert(err, NotNil)
+}
+
+func (self *AggregatorSuite) TestPercentileOfLargeGroupsIsApproximated(c *C) {
+	points := []*protocol.Point{}
+	// interleave the values so they don't come sorted
+	for i := int64(0); i < 50000; i++ {
+		points = append(points, newPoint(i, 2*i+1), newPoint(i, 100000-2*i))
+	}
+	result := runAggregateQuery(c, "select percentile(value, 99), median(value) from t;", points...)
+	c.Assert(result, HasLen, 1)
+	c.Assert(math.Abs(result[0].Values[0].GetDoubleValue()-99000) < 100, Equals, true)
+	c.Assert(math.Abs(result[0].Values[1].GetDoubleValue()-50000) < 500, Equals, true)
+}
+
+func (self *AggregatorSuite) TestFillTheEmptyBuckets(c *C) {
+	points := []*protocol.Point{newPoint(1, 2), newPoint(2, 4), newPoint(31, 6)}
+
+	result := runAggregateQuery(c, "select sum(value) from t group by time(10s) fill(null) order asc;", points...)
+	c.Assert(result, HasLen, 4)
+	c.Assert(result[0].Values[0].GetDoubleValue(), Equals, 6.0)
+	c.Assert(result[1].Values[0].GetIsNull(), Equals, true)
+	c.Assert(result[2].Values[0].GetIsNull(), Equals, true)
+	c.Assert(result[3].Values[0].GetDoubleValue(), Equals, 6.0)
+
+	result = runAggregateQuery(c, "select sum(value) from t group by time(10s) fill(-1.5) order asc;", points...)
+	c.Assert(result, HasLen, 4)
+	c.Assert(result[1].Values[0].GetDoubleValue(), Equals, -1.5)
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, int64(10000000))
+
+	// the previous bucket is the previous one in time, whatever the
+	// order of the query
+	result = runAggregateQuery(c, "select sum(value) from t group by time(10s) fill(previous);",
+		newPoint(31, 6), newPoint(2, 4), newPoint(1, 1))
+	c.Assert(result, HasLen, 4)
+	c.Assert(result[0].Values[0].GetDoubleValue(), Equals, 6.0)
+	c.Assert(result[1].Values[0].GetDoubleValue(), Equals, 5.0)
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, int64(20000000))
+	c.Assert(result[3].Values[0].GetDoubleValue(), Equals, 5.0)
+	c.Assert(result[3].GetTimestampInMicroseconds(), Equals, int64(0))
+}
+
+func (self *AggregatorSuite) TestFillAcrossTheTimeRangeOfTheQuery(c *C) {
+	result := runAggregateQuery(c, "select count(value) from t group by time(10s) fill(0) where time > 0s and time < 40s order asc;",
+		newPoint(12, 2))
+	c.Assert(result, HasLen, 4)
+	c.Assert(result[0].Values[0].GetInt64Value(), Equals, int64(0))
+	c.Assert(result[1].Values[0].GetInt64Value(), Equals, int64(1))
+	c.Assert(result[3].Values[0].GetInt64Value(), Equals, int64(0))
+	c.Assert(result[3].GetTimestampInMicroseconds(), Equals, int64(30000000))
+}
+
+func (self *AggregatorSuite) TestTheBucketsOfATimeZoneStartAtItsMidnight(c *C) {
+	location, err := time.LoadLocation("America/New_York")
+	c.Assert(err, IsNil)
+	midnight := func(day int) int64 {
+		return time.Date(2014, time.March, day, 0, 0, 0, 0, location).Unix() * 1000000
+	}
+
+	// the clocks went forward on the 9th, the day is 23 hours long
+	result := runAggregateQuery(c, "select count(value) from t group by time(1d) order asc tz('America/New_York');",
+		newPoint(midnight(8)/1000000+1, 1), newPoint(midnight(9)/1000000+1, 1), newPoint(midnight(10)/1000000-1, 1), newPoint(midnight(10)/1000000, 1))
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].GetTimestampInMicroseconds(), Equals, midnight(8))
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, midnight(9))
+	c.Assert(result[1].Values[0].GetInt64Value(), Equals, int64(2))
+	c.Assert(result[2].GetTimestampInMicroseconds(), Equals, midnight(10))
+
+	result = runAggregateQuery(c, "select count(value) from t group by time(1d) fill(0) where time > '2014-03-08 00:00-05:00' and time < '2014-03-11 00:00-04:00' order asc tz('America/New_York');",
+		newPoint(midnight(9)/1000000+1, 1))
+	c.Assert(result, HasLen, 3)
+	for i, count := range []int64{0, 1, 0} {
+		c.Assert(result[i].GetTimestampInMicroseconds(), Equals, midnight(8+i))
+		c.Assert(result[i].Values[0].GetInt64Value(), Equals, count)
+	}
+}
+
+func (self *AggregatorSuite) TestCalendarIntervalsStartAtTheStartOfTheirMonthOrWeek(c *C) {
+	seconds := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix()
+	}
+
+	result := runAggregateQuery(c, "select count(value) from t group by time(1mo) fill(0) order asc;",
+		newPoint(seconds(2014, time.January, 31), 1), newPoint(seconds(2014, time.February, 1), 1), newPoint(seconds(2014, time.April, 30), 1))
+	c.Assert(result, HasLen, 4)
+	for i, count := range []int64{1, 1, 0, 1} {
+		c.Assert(result[i].GetTimestampInMicroseconds(), Equals, seconds(2014, time.January+time.Month(i), 1)*1000000)
+		c.Assert(result[i].Values[0].GetInt64Value(), Equals, count)
+	}
+
+	// the quarters
+	result = runAggregateQuery(c, "select count(value) from t group by time(3mo) order asc;",
+		newPoint(seconds(2014, time.February, 10), 1), newPoint(seconds(2014, time.May, 10), 1))
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].GetTimestampInMicroseconds(), Equals, seconds(2014, time.January, 1)*1000000)
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, seconds(2014, time.April, 1)*1000000)
+
+	// the 13th of march 2014 is a thursday
+	result = runAggregateQuery(c, "select count(value) from t group by time(1w) order asc;",
+		newPoint(seconds(2014, time.March, 13), 1), newPoint(seconds(2014, time.March, 17), 1))
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].GetTimestampInMicroseconds(), Equals, seconds(2014, time.March, 10)*1000000)
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, seconds(2014, time.March, 17)*1000000)
+
+	result = runAggregateQuery(c, "select count(value) from t group by time(1y) order asc;",
+		newPoint(seconds(2013, time.December, 31), 1), newPoint(seconds(2014, time.March, 17), 1))
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[1].GetTimestampInMicroseconds(), Equals, seconds(2014, time.January, 1)*1000000)
+}
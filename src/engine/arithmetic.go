@@ -46,16 +46,36 @@ func GetValue(value *parser.Value, fields []string, point *protocol.Point) (*pro
 	return nil, fmt.Errorf("Value cannot be evaluated for type %v", value)
 }
 
-func PlusOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
+// Evaluates the operands of a binary operator, isNull is true if any of
+// them is null, the result of the operator is null then
+func getOperands(elems []*parser.Value, fields []string, point *protocol.Point) (left, right interface{}, valueType common.Type, isNull bool, err error) {
 	leftValue, err := GetValue(elems[0], fields, point)
 	if err != nil {
-		return nil, err
+		return nil, nil, common.TYPE_UNKNOWN, false, err
+	}
+	rightValue, err := GetValue(elems[1], fields, point)
+	if err != nil {
+		return nil, nil, common.TYPE_UNKNOWN, false, err
 	}
-	rightValues, err := GetValue(elems[1], fields, point)
+	if isNullValue(leftValue) || isNullValue(rightValue) {
+		return nil, nil, common.TYPE_UNKNOWN, true, nil
+	}
+	left, right, valueType = common.CoerceValues(leftValue, rightValue)
+	return left, right, valueType, false, nil
+}
+
+func isNullValue(value *protocol.FieldValue) bool {
+	return value == nil || value.GetIsNull()
+}
+
+func PlusOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
+	left, right, valueType, isNull, err := getOperands(elems, fields, point)
 	if err != nil {
 		return nil, err
 	}
-	left, right, valueType := common.CoerceValues(leftValue, rightValues)
+	if isNull {
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
+	}
 	switch valueType {
 	case common.TYPE_DOUBLE:
 		value := left.(float64) + right.(float64)
@@ -67,16 +87,20 @@ func PlusOperator(elems []*parser.Value, fields []string, point *protocol.Point)
 	return nil, fmt.Errorf("+ operator doesn't work with %v types", valueType)
 }
 
+// The minus operator has one operand when it negates a column or an
+// expression, e.g. -value or -(a + b)
 func MinusOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
-	leftValue, err := GetValue(elems[0], fields, point)
-	if err != nil {
-		return nil, err
+	if len(elems) == 1 {
+		return negate(elems[0], fields, point)
 	}
-	rightValues, err := GetValue(elems[1], fields, point)
+
+	left, right, valueType, isNull, err := getOperands(elems, fields, point)
 	if err != nil {
 		return nil, err
 	}
-	left, right, valueType := common.CoerceValues(leftValue, rightValues)
+	if isNull {
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
+	}
 	switch valueType {
 	case common.TYPE_DOUBLE:
 		value := left.(float64) - right.(float64)
@@ -88,16 +112,33 @@ func MinusOperator(elems []*parser.Value, fields []string, point *protocol.Point
 	return nil, fmt.Errorf("- operator doesn't work with %v types", valueType)
 }
 
-func MultiplyOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
-	leftValue, err := GetValue(elems[0], fields, point)
+func negate(elem *parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
+	fieldValue, err := GetValue(elem, fields, point)
 	if err != nil {
 		return nil, err
 	}
-	rightValues, err := GetValue(elems[1], fields, point)
+	if isNullValue(fieldValue) {
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
+	}
+	switch {
+	case fieldValue.DoubleValue != nil:
+		value := -*fieldValue.DoubleValue
+		return &protocol.FieldValue{DoubleValue: &value}, nil
+	case fieldValue.Int64Value != nil:
+		value := -*fieldValue.Int64Value
+		return &protocol.FieldValue{Int64Value: &value}, nil
+	}
+	return nil, fmt.Errorf("- operator doesn't work with %v", fieldValue)
+}
+
+func MultiplyOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
+	left, right, valueType, isNull, err := getOperands(elems, fields, point)
 	if err != nil {
 		return nil, err
 	}
-	left, right, valueType := common.CoerceValues(leftValue, rightValues)
+	if isNull {
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
+	}
 	switch valueType {
 	case common.TYPE_DOUBLE:
 		value := left.(float64) * right.(float64)
@@ -109,21 +150,27 @@ func MultiplyOperator(elems []*parser.Value, fields []string, point *protocol.Po
 	return nil, fmt.Errorf("* operator doesn't work with %v types", valueType)
 }
 
+// A division by zero returns null instead of failing the query, an
+// infinity can't be returned in json
 func DivideOperator(elems []*parser.Value, fields []string, point *protocol.Point) (*protocol.FieldValue, error) {
-	leftValue, err := GetValue(elems[0], fields, point)
+	left, right, valueType, isNull, err := getOperands(elems, fields, point)
 	if err != nil {
 		return nil, err
 	}
-	rightValues, err := GetValue(elems[1], fields, point)
-	if err != nil {
-		return nil, err
+	if isNull {
+		return &protocol.FieldValue{IsNull: &TRUE}, nil
 	}
-	left, right, valueType := common.CoerceValues(leftValue, rightValues)
 	switch valueType {
 	case common.TYPE_DOUBLE:
+		if right.(float64) == 0 {
+			return &protocol.FieldValue{IsNull: &TRUE}, nil
+		}
 		value := left.(float64) / right.(float64)
 		return &protocol.FieldValue{DoubleValue: &value}, nil
 	case common.TYPE_INT:
+		if right.(int64) == 0 {
+			return &protocol.FieldValue{IsNull: &TRUE}, nil
+		}
 		value := left.(int64) / right.(int64)
 		return &protocol.FieldValue{Int64Value: &value}, nil
 	}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"common"
+	. "launchpad.net/gocheck"
+	"parser"
+)
+
+type ArithmeticSuite struct{}
+
+var _ = Suite(&ArithmeticSuite{})
+
+func (self *ArithmeticSuite) TestArithmeticOnColumns(c *C) {
+	query, err := parser.ParseSelectQuery("select (bytes_out - bytes_in) / 1024 as delta_kb, -bytes_in, bytes_in / zero from net;")
+	c.Assert(err, IsNil)
+	columns := query.GetColumnNames()
+	c.Assert(columns, HasLen, 3)
+	c.Assert(columns[0].Alias, Equals, "delta_kb")
+
+	series, err := common.StringToSeriesArray(`
+[
+ {
+   "points": [
+     {"values": [{"int64_value": 1024},{"double_value": 3072.0},{"int64_value": 0}], "timestamp": 1381346631, "sequence_number": 1}
+   ],
+   "name": "net",
+   "fields": ["bytes_in", "bytes_out", "zero"]
+ }
+]
+`)
+	c.Assert(err, IsNil)
+	point := series[0].Points[0]
+
+	value, err := GetValue(columns[0], series[0].Fields, point)
+	c.Assert(err, IsNil)
+	c.Assert(value.GetDoubleValue(), Equals, 2.0)
+
+	value, err = GetValue(columns[1], series[0].Fields, point)
+	c.Assert(err, IsNil)
+	c.Assert(value.GetInt64Value(), Equals, int64(-1024))
+
+	// a division by zero returns null
+	value, err = GetValue(columns[2], series[0].Fields, point)
+	c.Assert(err, IsNil)
+	c.Assert(value.GetIsNull(), Equals, true)
+}
+
+func (self *ArithmeticSuite) TestArithmeticWithNullColumns(c *C) {
+	query, err := parser.ParseSelectQuery("select a + b from t;")
+	c.Assert(err, IsNil)
+
+	series, err := common.StringToSeriesArray(`
+[
+ {
+   "points": [
+     {"values": [{"int64_value": 1},{"is_null": true}], "timestamp": 1381346631, "sequence_number": 1}
+   ],
+   "name": "t",
+   "fields": ["a", "b"]
+ }
+]
+`)
+	c.Assert(err, IsNil)
+	value, err := GetValue(query.GetColumnNames()[0], series[0].Fields, series[0].Points[0])
+	c.Assert(err, IsNil)
+	c.Assert(value.GetIsNull(), Equals, true)
+}
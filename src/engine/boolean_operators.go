@@ -106,6 +106,17 @@ func RegexMatcherOperator(leftValue, rightValue *protocol.FieldValue) (OperatorR
 	}
 }
 
+// Only the string values can match a regex, the other ones are invalid
+func matchesRegex(regex *regexp.Regexp, value *protocol.FieldValue) OperatorResult {
+	if value == nil || value.StringValue == nil {
+		return INVALID
+	}
+	if regex.MatchString(*value.StringValue) {
+		return MATCH
+	}
+	return NO_MATCH
+}
+
 func GreaterThanOrEqualOperator(leftValue, rightValue *protocol.FieldValue) (OperatorResult, error) {
 	v1, v2, cType := common.CoerceValues(leftValue, rightValue)
 
@@ -155,11 +166,20 @@ func GreaterThanOperator(leftValue, rightValue *protocol.FieldValue) (OperatorRe
 }
 
 func InOperator(leftValue *protocol.FieldValue, rightValue []*protocol.FieldValue) (OperatorResult, error) {
+	if leftValue == nil {
+		return INVALID, nil
+	}
+
 	for _, v := range rightValue {
+		if v == nil {
+			continue
+		}
 		v1, v2, cType := common.CoerceValues(leftValue, v)
 
 		var result bool
 
+		// a value of another type doesn't match, e.g. the string
+		// column in (1, 'a')
 		switch cType {
 		case common.TYPE_STRING:
 			result = v1.(string) == v2.(string)
@@ -169,8 +189,6 @@ func InOperator(leftValue *protocol.FieldValue, rightValue []*protocol.FieldValu
 			result = v1.(float64) == v2.(float64)
 		case common.TYPE_BOOL:
 			result = v1.(bool) == v2.(bool)
-		default:
-			return INVALID, nil
 		}
 
 		if result {
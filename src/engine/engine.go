@@ -31,6 +31,8 @@ type QueryEngine struct {
 	fields           []string
 	where            *parser.WhereCondition
 	fillWithZero     bool
+	fillWithPrevious bool
+	fillValue        *protocol.FieldValue
 
 	// output fields
 	responseChan   chan *protocol.Response
@@ -43,6 +45,8 @@ type QueryEngine struct {
 	aggregators  []Aggregator
 	elems        []*parser.Value // group by columns other than time()
 	duration     *time.Duration  // the time by duration if any
+	// the calendar interval of the time by duration if it's one
+	calendar     *parser.CalendarInterval
 	seriesStates map[string]*SeriesState
 
 	// query statistics
@@ -69,7 +73,7 @@ func (self *QueryEngine) distributeQuery(query *parser.SelectQuery, yield func(*
 	// see if this is a merge query
 	fromClause := query.GetFromClause()
 	if fromClause.Type == parser.FromClauseMerge {
-		yield = getMergeYield(fromClause.Names[0].Name.Name, fromClause.Names[1].Name.Name, query.Ascending, yield)
+		yield = getMergeYield(fromClause.GetTableNames(), query.Ascending, yield)
 	}
 
 	if fromClause.Type == parser.FromClauseInnerJoin {
@@ -86,7 +90,7 @@ func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Respo
 	queryEngine := &QueryEngine{
 		query:          query,
 		where:          query.GetWhereCondition(),
-		limiter:        NewLimiter(limit),
+		limiter:        NewLimiterWithOffset(limit, query.Offset),
 		responseChan:   responseChan,
 		seriesToPoints: make(map[string]*protocol.Series),
 		// stats stuff
@@ -204,7 +208,7 @@ func (self *QueryEngine) Close() {
 	// make sure we yield an empty series for series without points
 	fromClause := self.query.GetFromClause()
 	if fromClause.Type == parser.FromClauseMerge {
-		for _, s := range []string{fromClause.Names[0].Name.Name, fromClause.Names[1].Name.Name} {
+		for _, s := range fromClause.GetTableNames() {
 			if _, ok := self.seriesToPoints[s]; ok {
 				continue
 			}
@@ -285,6 +289,12 @@ func (self *QueryEngine) getTimestampFromPoint(point *protocol.Point) int64 {
 }
 
 func (self *QueryEngine) getTimestampBucket(timestampMicroseconds uint64) int64 {
+	if self.calendar != nil {
+		return self.getCalendarTimestampBucket(int64(timestampMicroseconds))
+	}
+	if self.query.Location != nil {
+		return self.getLocalTimestampBucket(int64(timestampMicroseconds))
+	}
 	timestampMicroseconds *= 1000 // convert to nanoseconds
 	multiplier := uint64(*self.duration)
 	return int64(timestampMicroseconds / multiplier * multiplier / 1000)
@@ -329,6 +339,7 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 
 	self.isAggregateQuery = true
 	self.duration = duration
+	self.calendar = query.GetGroupByClause().GetGroupByCalendarInterval()
 	self.aggregators = []Aggregator{}
 
 	for _, value := range query.GetColumnNames() {
@@ -355,6 +366,13 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 	}
 
 	self.fillWithZero = query.GetGroupByClause().FillWithZero
+	if self.fillWithZero {
+		self.fillWithPrevious = query.GetGroupByClause().FillWithPrevious()
+		self.fillValue, err = wrapDefaultValue(query.GetGroupByClause().FillValue)
+		if err != nil {
+			return common.NewQueryError(common.InvalidArgument, fmt.Sprintf("%s", err))
+		}
+	}
 
 	self.initializeFields()
 
@@ -504,9 +522,6 @@ func (self *QueryEngine) calculateSummariesForTable(table string) {
 }
 
 func (self *QueryEngine) runAggregatesForTable(table string) {
-	// TODO: if this is a fill query, step through [start,end] in duration
-	// steps and flush the groups for the given bucket
-
 	self.calculateSummariesForTable(table)
 
 	state := self.getSeriesState(table)
@@ -519,39 +534,35 @@ func (self *QueryEngine) runAggregatesForTable(table string) {
 
 	var err error
 	if self.duration != nil && self.fillWithZero {
-		timestampRange := state.pointsRange
-
-		// TODO: DRY this
-		if self.query.Ascending {
-			bucket := self.getTimestampBucket(uint64(timestampRange.startTime))
-			for bucket <= timestampRange.endTime {
-				timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
-				defaultChildNode := &Node{states: make([]interface{}, len(self.aggregators))}
-				err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
-					childNode := node.GetChildNode(timestamp)
-					if childNode == nil {
-						childNode = defaultChildNode
-					}
-					return f(append(v, timestamp), childNode)
-				})
-				bucket += self.duration.Nanoseconds() / 1000
-			}
-		} else {
-			bucket := self.getTimestampBucket(uint64(timestampRange.endTime))
-			for {
-				timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
-				defaultChildNode := &Node{states: make([]interface{}, len(self.aggregators))}
-				err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
-					childNode := node.GetChildNode(timestamp)
-					if childNode == nil {
-						childNode = defaultChildNode
-					}
-					return f(append(v, timestamp), childNode)
-				})
-				if bucket <= timestampRange.startTime {
-					break
+		startTime, endTime := self.getFillRange(state.pointsRange)
+		// the values of the last bucket of every group, used by fill(previous)
+		previous := map[*Node][]*protocol.Point{}
+
+		// the buckets are stepped through in ascending order so the
+		// previous bucket of a group is the one that came before in time,
+		// the points are reversed afterwards for descending queries
+		for bucket := self.getTimestampBucket(uint64(startTime)); bucket <= endTime; bucket = self.getNextTimestampBucket(bucket) {
+			timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
+			err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
+				group := append(v, timestamp)
+				childNode := node.GetChildNode(timestamp)
+				if childNode == nil {
+					points = append(points, self.getFillPoints(group, bucket, previous[node])...)
+					return nil
 				}
-				bucket -= self.duration.Nanoseconds() / 1000
+				groupPoints := self.getValuesForGroup(table, group, childNode)
+				previous[node] = groupPoints
+				points = append(points, groupPoints...)
+				return nil
+			})
+			if err != nil {
+				break
+			}
+		}
+
+		if !self.query.Ascending {
+			for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+				points[i], points[j] = points[j], points[i]
 			}
 		}
 	} else {
@@ -568,6 +579,48 @@ func (self *QueryEngine) runAggregatesForTable(table string) {
 	})
 }
 
+// The empty buckets are filled between the first and the last point of
+// the series, or across the time range of the query if it has a start
+// time, so a graph of the last hour has a point for every interval
+func (self *QueryEngine) getFillRange(pointsRange *PointRange) (int64, int64) {
+	if !self.query.IsStartTimeSpecified() {
+		return pointsRange.startTime, pointsRange.endTime
+	}
+	// the end time of the query is exclusive
+	return common.TimeToMicroseconds(self.query.GetStartTime()), common.TimeToMicroseconds(self.query.GetEndTime()) - 1
+}
+
+// Returns the points of an empty bucket, the values of the previous
+// bucket of the group for fill(previous), otherwise one point with the
+// fill value, which is null for fill(null)
+func (self *QueryEngine) getFillPoints(group []*protocol.FieldValue, timestamp int64, previous []*protocol.Point) []*protocol.Point {
+	if self.fillWithPrevious && previous != nil {
+		points := make([]*protocol.Point, 0, len(previous))
+		for _, p := range previous {
+			point := &protocol.Point{Values: p.Values}
+			point.SetTimestampInMicroseconds(timestamp)
+			points = append(points, point)
+		}
+		return points
+	}
+
+	fillValue := self.fillValue
+	if fillValue == nil {
+		fillValue = &protocol.FieldValue{IsNull: &TRUE}
+	}
+	point := &protocol.Point{}
+	point.SetTimestampInMicroseconds(timestamp)
+	for _, aggregator := range self.aggregators {
+		for _ = range aggregator.ColumnNames() {
+			point.Values = append(point.Values, fillValue)
+		}
+	}
+	for idx, _ := range self.elems {
+		point.Values = append(point.Values, group[idx])
+	}
+	return []*protocol.Point{point}
+}
+
 func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.FieldValue, node *Node) []*protocol.Point {
 
 	values := [][][]*protocol.FieldValue{}
@@ -585,6 +638,13 @@ func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.Field
 		useTimestamp = true
 	}
 
+	var timestamps []int64
+	if len(self.aggregators) == 1 {
+		if selector, ok := self.aggregators[0].(SelectorAggregator); ok {
+			timestamps = selector.GetTimestamps(node.states[0])
+		}
+	}
+
 	for idx, aggregator := range self.aggregators {
 		values = append(values, aggregator.GetValues(node.states[idx]))
 		node.states[idx] = nil
@@ -600,13 +660,15 @@ func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.Field
 
 	points := []*protocol.Point{}
 
-	for _, v := range _values {
+	for i, v := range _values {
 		/* groupPoints := []*protocol.Point{} */
 		point := &protocol.Point{
 			Values: v,
 		}
 
-		if useTimestamp {
+		if len(timestamps) == len(_values) {
+			point.SetTimestampInMicroseconds(timestamps[i])
+		} else if useTimestamp {
 			point.SetTimestampInMicroseconds(timestamp)
 		} else {
 			point.SetTimestampInMicroseconds(0)
@@ -625,20 +687,24 @@ func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.Field
 
 func (self *QueryEngine) executeArithmeticQuery(query *parser.SelectQuery, yield func(*protocol.Series) error) error {
 
-	names := map[string]*parser.Value{}
+	// the columns are returned in the order of the query, named after
+	// their alias if they have one
+	names := []string{}
+	values := []*parser.Value{}
 	for idx, v := range query.GetColumnNames() {
-		switch v.Type {
-		case parser.ValueSimpleName:
-			names[v.Name] = v
-		case parser.ValueFunctionCall:
-			names[v.Name] = v
-		case parser.ValueExpression:
-			if v.Alias != "" {
-				names[v.Alias] = v
-			} else {
-				names["expr"+strconv.Itoa(idx)] = v
+		name := v.Alias
+		if name == "" {
+			switch v.Type {
+			case parser.ValueSimpleName, parser.ValueTableName, parser.ValueFunctionCall:
+				name = v.Name
+			case parser.ValueExpression:
+				name = "expr" + strconv.Itoa(idx)
+			default:
+				continue
 			}
 		}
+		names = append(names, name)
+		values = append(values, v)
 	}
 
 	return self.distributeQuery(query, func(series *protocol.Series) error {
@@ -648,12 +714,8 @@ func (self *QueryEngine) executeArithmeticQuery(query *parser.SelectQuery, yield
 		}
 
 		newSeries := &protocol.Series{
-			Name: series.Name,
-		}
-
-		// create the new column names
-		for name, _ := range names {
-			newSeries.Fields = append(newSeries.Fields, name)
+			Name:   series.Name,
+			Fields: names,
 		}
 
 		for _, point := range series.Points {
@@ -661,8 +723,7 @@ func (self *QueryEngine) executeArithmeticQuery(query *parser.SelectQuery, yield
 				Timestamp:      point.Timestamp,
 				SequenceNumber: point.SequenceNumber,
 			}
-			for _, field := range newSeries.Fields {
-				value := names[field]
+			for _, value := range values {
 				v, err := GetValue(value, series.Fields, point)
 				if err != nil {
 					log.Error("Error in arithmetic computation: %s", err)
@@ -60,6 +60,19 @@ func matchesExpression(expr *parser.Value, fields []string, point *protocol.Poin
 	if err != nil {
 		return false, err
 	}
+
+	// the parser compiled the regex already, with the case insensitive
+	// flag if it had one
+	if regex, ok := expr.Elems[1].GetCompiledRegex(); ok && len(expr.Elems) == 2 {
+		result := matchesRegex(regex, leftValue[0])
+		switch expr.Name {
+		case "=~":
+			return result == MATCH, nil
+		case "!~":
+			return result == NO_MATCH, nil
+		}
+	}
+
 	rightValue, err := getExpressionValue(expr.Elems[1:], fields, point)
 	if err != nil {
 		return false, err
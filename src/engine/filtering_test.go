@@ -271,3 +271,66 @@ func (self *FilteringSuite) TestInequalityFiltering(c *C) {
 	c.Assert(*result.Points[0].Values[0].Int64Value, Equals, int64(100))
 	c.Assert(*result.Points[0].Values[1].Int64Value, Equals, int64(7))
 }
+
+func (self *FilteringSuite) TestInOperatorFilteringOnStringsAndNulls(c *C) {
+	queryStr := "select * from t where column_one in ('a', 1, 'c');"
+	query, err := parser.ParseSelectQuery(queryStr)
+	c.Assert(err, IsNil)
+	series, err := common.StringToSeriesArray(`
+[
+ {
+   "points": [
+     {"values": [{"string_value": "a"}], "timestamp": 1381346631, "sequence_number": 1},
+     {"values": [null], "timestamp": 1381346631, "sequence_number": 2},
+     {"values": [{"string_value": "b"}], "timestamp": 1381346631, "sequence_number": 3},
+     {"values": [{"bool_value": true}], "timestamp": 1381346631, "sequence_number": 4},
+     {"values": [{"string_value": "c"}], "timestamp": 1381346631, "sequence_number": 5}
+   ],
+   "name": "t",
+   "fields": ["column_one"]
+ }
+]
+`)
+	c.Assert(err, IsNil)
+	result, err := Filter(query, series[0])
+	c.Assert(err, IsNil)
+	c.Assert(result.Points, HasLen, 2)
+	c.Assert(*result.Points[0].Values[0].StringValue, Equals, "a")
+	c.Assert(*result.Points[1].Values[0].StringValue, Equals, "c")
+}
+
+func (self *FilteringSuite) TestCaseInsensitiveRegexFiltering(c *C) {
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"select * from t where column_one =~ /^foo/i;", []string{"foobar", "FooBaz"}},
+		{"select * from t where column_one =~ /^foo/;", []string{"foobar"}},
+		{"select * from t where column_one !~ /^foo/i;", []string{"bar"}},
+	} {
+		query, err := parser.ParseSelectQuery(test.query)
+		c.Assert(err, IsNil)
+		series, err := common.StringToSeriesArray(`
+[
+ {
+   "points": [
+     {"values": [{"string_value": "foobar"}], "timestamp": 1381346631, "sequence_number": 1},
+     {"values": [{"string_value": "FooBaz"}], "timestamp": 1381346631, "sequence_number": 2},
+     {"values": [{"int64_value": 1}], "timestamp": 1381346631, "sequence_number": 3},
+     {"values": [{"string_value": "bar"}], "timestamp": 1381346631, "sequence_number": 4}
+   ],
+   "name": "t",
+   "fields": ["column_one"]
+ }
+]
+`)
+		c.Assert(err, IsNil)
+		result, err := Filter(query, series[0])
+		c.Assert(err, IsNil)
+		values := []string{}
+		for _, point := range result.Points {
+			values = append(values, point.Values[0].GetStringValue())
+		}
+		c.Assert(values, DeepEquals, test.expected, Commentf("query: %s", test.query))
+	}
+}
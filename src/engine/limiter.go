@@ -8,17 +8,26 @@ type Limiter struct {
 	shouldLimit bool
 	limit       int
 	limits      map[string]int
+	offset      int
+	offsets     map[string]int
 }
 
 func NewLimiter(limit int) *Limiter {
+	return NewLimiterWithOffset(limit, 0)
+}
+
+func NewLimiterWithOffset(limit, offset int) *Limiter {
 	return &Limiter{
 		limit:       limit,
 		limits:      map[string]int{},
 		shouldLimit: limit > 0,
+		offset:      offset,
+		offsets:     map[string]int{},
 	}
 }
 
 func (self *Limiter) calculateLimitAndSlicePoints(series *protocol.Series) {
+	self.skipOffset(series)
 	if self.shouldLimit {
 		// if the limit is 0, stop returning any points
 		limit := self.limitForSeries(*series.Name)
@@ -36,6 +45,24 @@ func (self *Limiter) calculateLimitAndSlicePoints(series *protocol.Series) {
 	}
 }
 
+// drops the first offset points of every series, the skipped points
+// don't count towards the limit
+func (self *Limiter) skipOffset(series *protocol.Series) {
+	if self.offset <= 0 {
+		return
+	}
+	offset, ok := self.offsets[*series.Name]
+	if !ok {
+		offset = self.offset
+	}
+	skip := offset
+	if skip > len(series.Points) {
+		skip = len(series.Points)
+	}
+	series.Points = series.Points[skip:]
+	self.offsets[*series.Name] = offset - skip
+}
+
 func (self *Limiter) hitLimit(seriesName string) bool {
 	if !self.shouldLimit {
 		return false
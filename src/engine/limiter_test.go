@@ -0,0 +1,43 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"protocol"
+)
+
+type LimiterSuite struct{}
+
+var _ = Suite(&LimiterSuite{})
+
+func (self *LimiterSuite) TestOffsetPointsAreSkippedBeforeTheLimit(c *C) {
+	limiter := NewLimiterWithOffset(3, 4)
+	values := []int64{}
+	for _, batch := range [][]int64{{1, 2}, {3, 4, 5}, {6, 7, 8, 9}} {
+		series := &protocol.Series{Name: protocol.String("t"), Fields: []string{"value"}}
+		for _, value := range batch {
+			series.Points = append(series.Points, newPoint(value, value))
+		}
+		c.Assert(limiter.hitLimit("t"), Equals, false)
+		limiter.calculateLimitAndSlicePoints(series)
+		for _, point := range series.Points {
+			values = append(values, point.Values[0].GetInt64Value())
+		}
+	}
+	c.Assert(values, DeepEquals, []int64{5, 6, 7})
+	c.Assert(limiter.hitLimit("t"), Equals, true)
+
+	// every series has an offset of its own
+	series := &protocol.Series{Name: protocol.String("u"), Points: []*protocol.Point{newPoint(1, 1), newPoint(2, 2)}}
+	limiter.calculateLimitAndSlicePoints(series)
+	c.Assert(series.Points, HasLen, 0)
+}
+
+func (self *LimiterSuite) TestPassthroughHitsTheLimitOnceEverySeriesHasAllItsPoints(c *C) {
+	engine := NewPassthroughEngineWithLimit(make(chan *protocol.Response, 10), 100, 2)
+	c.Assert(engine.HitLimit([]string{"t", "u"}), Equals, false)
+	engine.YieldSeries(&protocol.Series{Name: protocol.String("t"), Points: []*protocol.Point{newPoint(1, 1), newPoint(2, 2)}})
+	c.Assert(engine.HitLimit([]string{"t", "u"}), Equals, false)
+	engine.YieldSeries(&protocol.Series{Name: protocol.String("u"), Points: []*protocol.Point{newPoint(1, 1), newPoint(2, 2), newPoint(3, 3)}})
+	c.Assert(engine.HitLimit([]string{"t", "u"}), Equals, true)
+	c.Assert(engine.HitLimit(nil), Equals, false)
+}
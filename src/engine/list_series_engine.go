@@ -37,7 +37,12 @@ func (self *ListSeriesEngine) YieldPoint(seriesName *string, columnNames []strin
 			MultiSeries: make([]*protocol.Series, 0),
 		}
 	}
-	self.response.MultiSeries = append(self.response.MultiSeries, &protocol.Series{Name: seriesName})
+	series := &protocol.Series{Name: seriesName}
+	// the point of a series listed by its last write is at that time
+	if point != nil {
+		series.Points = []*protocol.Point{point}
+	}
+	self.response.MultiSeries = append(self.response.MultiSeries, series)
 	return true
 }
 
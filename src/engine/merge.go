@@ -3,54 +3,56 @@ package engine
 import (
 	"parser"
 	"protocol"
+	"strings"
 )
 
 func getJoinYield(query *parser.SelectQuery, yield func(*protocol.Series) error) func(*protocol.Series) error {
-	var lastPoint1 *protocol.Point
-	var lastFields1 []string
-	var lastPoint2 *protocol.Point
-	var lastFields2 []string
-
-	table1 := query.GetFromClause().Names[0].GetAlias()
-	table2 := query.GetFromClause().Names[1].GetAlias()
-	name := table1 + "_join_" + table2
-
-	return mergeYield(table1, table2, false, query.Ascending, func(s *protocol.Series) error {
-		if *s.Name == table1 {
-			lastPoint1 = s.Points[len(s.Points)-1]
-			if lastFields1 == nil {
-				for _, f := range s.Fields {
-					lastFields1 = append(lastFields1, table1+"."+f)
-				}
+	tables := []string{}
+	for _, name := range query.GetFromClause().Names {
+		tables = append(tables, name.GetAlias())
+	}
+	name := strings.Join(tables, "_join_")
+	lastPoints := make([]*protocol.Point, len(tables))
+	lastFields := make([][]string, len(tables))
+
+	return mergeYield(tables, false, query.Ascending, func(s *protocol.Series) error {
+		for idx, table := range tables {
+			if *s.Name != table {
+				continue
 			}
-		}
-
-		if *s.Name == table2 {
-			lastPoint2 = s.Points[len(s.Points)-1]
-			if lastFields2 == nil {
+			lastPoints[idx] = s.Points[len(s.Points)-1]
+			if lastFields[idx] == nil {
 				for _, f := range s.Fields {
-					lastFields2 = append(lastFields2, table2+"."+f)
+					lastFields[idx] = append(lastFields[idx], table+"."+f)
 				}
 			}
 		}
 
-		if lastPoint1 == nil || lastPoint2 == nil {
-			return nil
+		// a point is joined once every series has a point
+		fields := []string{}
+		values := []*protocol.FieldValue{}
+		for idx, point := range lastPoints {
+			if point == nil {
+				return nil
+			}
+			fields = append(fields, lastFields[idx]...)
+			values = append(values, point.Values...)
 		}
 
 		newSeries := &protocol.Series{
 			Name:   &name,
-			Fields: append(lastFields1, lastFields2...),
+			Fields: fields,
 			Points: []*protocol.Point{
 				&protocol.Point{
-					Values:    append(lastPoint1.Values, lastPoint2.Values...),
-					Timestamp: lastPoint2.Timestamp,
+					Values:    values,
+					Timestamp: s.Points[len(s.Points)-1].Timestamp,
 				},
 			},
 		}
 
-		lastPoint1 = nil
-		lastPoint2 = nil
+		for idx := range lastPoints {
+			lastPoints[idx] = nil
+		}
 
 		filteredSeries, _ := Filter(query, newSeries)
 		if len(filteredSeries.Points) > 0 {
@@ -60,10 +62,10 @@ func getJoinYield(query *parser.SelectQuery, yield func(*protocol.Series) error)
 	})
 }
 
-func getMergeYield(table1, table2 string, ascending bool, yield func(*protocol.Series) error) func(*protocol.Series) error {
-	name := table1 + "_merge_" + table2
+func getMergeYield(tables []string, ascending bool, yield func(*protocol.Series) error) func(*protocol.Series) error {
+	name := strings.Join(tables, "_merge_")
 
-	return mergeYield(table1, table2, true, ascending, func(s *protocol.Series) error {
+	return mergeYield(tables, true, ascending, func(s *protocol.Series) error {
 		oldName := s.Name
 		s.Name = &name
 		s.Fields = append(s.Fields, "_orig_series")
@@ -93,27 +95,6 @@ func isLater(first *seriesMergeState, other *seriesMergeState) bool {
 	return *first.series[0].Points[0].Timestamp > *other.series[0].Points[0].Timestamp
 }
 
-func (self *seriesMergeState) flush(state *mergeState, yield func(*protocol.Series) error) error {
-	for _, s := range self.series {
-		points := []*protocol.Point{}
-
-		for _, p := range s.Points {
-			points = append(points, state.getPoint(s.Fields, p))
-		}
-
-		err := yield(&protocol.Series{
-			Name:   s.Name,
-			Fields: state.getFields(),
-			Points: points,
-		})
-		if err != nil {
-			return err
-		}
-	}
-	self.series = nil
-	return nil
-}
-
 // update the state, the points belong to this seriesMergeState (i.e. the name of the timeseries matches)
 func (self *seriesMergeState) updateState(p *protocol.Series) {
 	if *p.Name != self.name {
@@ -134,17 +115,16 @@ func (self *seriesMergeState) updateState(p *protocol.Series) {
 }
 
 type mergeState struct {
-	leftGoFirst  func(_, _ *seriesMergeState) bool
+	goFirst      func(_, _ *seriesMergeState) bool
 	fields       map[string]int
-	left         *seriesMergeState
-	right        *seriesMergeState
+	states       []*seriesMergeState
 	modifyValues bool
 }
 
 // set the fields of the other time series to null making sure that
 // the order of the null values match the order of the field
-// definitions, i.e. left timeseries first followed by values from the
-// right timeseries
+// definitions, i.e. the fields of the first timeseries followed by
+// the ones of the next timeseries
 func (self *mergeState) getPoint(fields []string, p *protocol.Point) *protocol.Point {
 	if !self.modifyValues {
 		return p
@@ -160,10 +140,9 @@ func (self *mergeState) getPoint(fields []string, p *protocol.Point) *protocol.P
 	return p
 }
 
-// set the fields of the other time series to null making sure that
-// the order of the null values match the order of the field
-// definitions, i.e. left timeseries first followed by values from the
-// right timeseries
+// returns the fields of all the timeseries in the order of their
+// definitions, i.e. the fields of the first timeseries followed by the
+// ones of the next timeseries
 func (self *mergeState) getFields() []string {
 	fields := make([]string, len(self.fields))
 	for f, i := range self.fields {
@@ -172,15 +151,28 @@ func (self *mergeState) getFields() []string {
 	return fields
 }
 
+// yields the points in the order of the query until a timeseries that
+// isn't done has no points, its next point could come first. Once the
+// other timeseries are done (i.e. we'll receive no more points for
+// them) the points of the remaining timeseries are yielded.
 func (self *mergeState) yieldNextPoints(yield func(*protocol.Series) error) error {
-	// see which point should be returned next and remove it from the
-	// series
-	for self.left.hasPoints() && self.right.hasPoints() {
-		// state is the state of the series from which the next point
+	for {
+		// next is the state of the series from which the next point
 		// will be fetched
-		next := self.right
-		if self.leftGoFirst(self.left, self.right) {
-			next = self.left
+		var next *seriesMergeState
+		for _, state := range self.states {
+			if !state.hasPoints() {
+				if !state.done {
+					return nil
+				}
+				continue
+			}
+			if next == nil || !self.goFirst(next, state) {
+				next = state
+			}
+		}
+		if next == nil {
+			return nil
 		}
 
 		fields, p := next.removeAndGetFirstPoint()
@@ -195,40 +187,32 @@ func (self *mergeState) yieldNextPoints(yield func(*protocol.Series) error) erro
 			return err
 		}
 	}
-	return nil
-}
-
-// if `other` state is done (i.e. we'll receive no more points for its
-// timeseries) then we know that we won't get any points that are
-// older than what's in `self` so we can safely flush all `self`
-// points.
-func (self *mergeState) flushIfNecessary(yield func(*protocol.Series) error) error {
-	if self.left.done && len(self.left.series) == 0 {
-		self.right.flush(self, yield)
-	}
-	if self.right.done && len(self.right.series) == 0 {
-		self.left.flush(self, yield)
-	}
-	return nil
 }
 
 func (self *mergeState) updateState(p *protocol.Series) {
-	self.left.updateState(p)
-	self.right.updateState(p)
+	for _, state := range self.states {
+		state.updateState(p)
+	}
 
 	// create the fields map
-	if self.fields == nil && self.left.fields != nil && self.right.fields != nil {
-		self.fields = make(map[string]int)
+	if self.fields != nil {
+		return
+	}
+	for _, state := range self.states {
+		if state.fields == nil {
+			return
+		}
+	}
+	self.fields = make(map[string]int)
 
-		i := 0
-		for _, s := range []*seriesMergeState{self.left, self.right} {
-			for _, f := range s.fields {
-				if _, ok := self.fields[f]; ok {
-					continue
-				}
-				self.fields[f] = i
-				i++
+	i := 0
+	for _, state := range self.states {
+		for _, f := range state.fields {
+			if _, ok := self.fields[f]; ok {
+				continue
 			}
+			self.fields[f] = i
+			i++
 		}
 	}
 }
@@ -246,14 +230,12 @@ func (self *seriesMergeState) removeAndGetFirstPoint() ([]string, *protocol.Poin
 	return fields, point
 }
 
-// returns a yield function that will sort points from table1 and
-// table2 no matter what the order in which they are received.
-func mergeYield(table1, table2 string, modifyValues bool, ascending bool, yield func(*protocol.Series) error) func(*protocol.Series) error {
-	state1 := &seriesMergeState{
-		name: table1,
-	}
-	state2 := &seriesMergeState{
-		name: table2,
+// returns a yield function that will sort points from the tables no
+// matter what the order in which they are received.
+func mergeYield(tables []string, modifyValues bool, ascending bool, yield func(*protocol.Series) error) func(*protocol.Series) error {
+	states := make([]*seriesMergeState, 0, len(tables))
+	for _, table := range tables {
+		states = append(states, &seriesMergeState{name: table})
 	}
 
 	whoGoFirst := isEarlier
@@ -262,20 +244,13 @@ func mergeYield(table1, table2 string, modifyValues bool, ascending bool, yield
 	}
 
 	state := &mergeState{
-		left:         state1,
-		right:        state2,
-		leftGoFirst:  whoGoFirst,
+		states:       states,
+		goFirst:      whoGoFirst,
 		modifyValues: modifyValues,
 	}
 
 	return func(p *protocol.Series) error {
-
 		state.updateState(p)
-
-		if err := state.flushIfNecessary(yield); err != nil {
-			return err
-		}
-
 		return state.yieldNextPoints(yield)
 	}
 }
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"protocol"
+)
+
+type MergeSuite struct{}
+
+var _ = Suite(&MergeSuite{})
+
+func (self *MergeSuite) TestMergingManySeries(c *C) {
+	timestamps := []int64{}
+	names := []string{}
+	yield := getMergeYield([]string{"cpu.1", "cpu.2", "cpu.3"}, true, func(s *protocol.Series) error {
+		c.Assert(s.GetName(), Equals, "cpu.1_merge_cpu.2_merge_cpu.3")
+		c.Assert(s.Fields, DeepEquals, []string{"value", "_orig_series"})
+		for _, p := range s.Points {
+			timestamps = append(timestamps, p.GetTimestamp()/1000000)
+			names = append(names, p.Values[1].GetStringValue())
+		}
+		return nil
+	})
+
+	for _, s := range []*protocol.Series{
+		{Name: protocol.String("cpu.1"), Fields: []string{"value"}, Points: []*protocol.Point{newPoint(1, 1), newPoint(5, 1)}},
+		{Name: protocol.String("cpu.3"), Fields: []string{"value"}, Points: []*protocol.Point{newPoint(2, 3)}},
+		{Name: protocol.String("cpu.2"), Fields: []string{"value"}, Points: []*protocol.Point{newPoint(3, 2)}},
+		{Name: protocol.String("cpu.1"), Fields: []string{"value"}},
+		{Name: protocol.String("cpu.3"), Fields: []string{"value"}, Points: []*protocol.Point{newPoint(4, 3)}},
+		{Name: protocol.String("cpu.2"), Fields: []string{"value"}},
+		{Name: protocol.String("cpu.3"), Fields: []string{"value"}},
+	} {
+		c.Assert(yield(s), IsNil)
+	}
+
+	c.Assert(timestamps, DeepEquals, []int64{1, 2, 3, 4, 5})
+	c.Assert(names, DeepEquals, []string{"cpu.1", "cpu.3", "cpu.2", "cpu.3", "cpu.1"})
+}
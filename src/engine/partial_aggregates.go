@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"parser"
+	"protocol"
+	"strings"
+)
+
+// Aggregates of a bucket that can be computed from the aggregates of
+// parts of the bucket. A mergeable query is aggregated by every shard
+// and the coordinator only merges the partial aggregates of the buckets
+// that span several shards, instead of getting the raw points of every
+// shard.
+var mergeFunctions = map[string]func(a, b float64) float64{
+	"count": func(a, b float64) float64 { return a + b },
+	"sum":   func(a, b float64) float64 { return a + b },
+	"min":   math.Min,
+	"max":   math.Max,
+}
+
+// Returns true if the partial aggregates of the query computed by the
+// shards can be merged into the aggregates of the whole query
+func IsMergeable(query *parser.SelectQuery) bool {
+	if !query.HasAggregates() {
+		return false
+	}
+	fromClause := query.GetFromClause()
+	if fromClause.Type == parser.FromClauseInnerJoin || fromClause.Type == parser.FromClauseMerge {
+		return false
+	}
+	for _, value := range query.GetColumnNames() {
+		if !value.IsFunctionCall() {
+			continue
+		}
+		if _, ok := mergeFunctions[strings.ToLower(value.Name)]; !ok {
+			return false
+		}
+		if len(value.Elems) != 1 || value.Elems[0].Type != parser.ValueSimpleName {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the engine a shard uses to compute the partial aggregates of a
+// mergeable query. The limit and fill() of the query are left to the
+// coordinator, which sees every bucket.
+func NewPartialQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) (*QueryEngine, error) {
+	queryEngine, err := NewQueryEngine(query, responseChan)
+	if err != nil {
+		return nil, err
+	}
+	queryEngine.limiter = NewLimiter(0)
+	queryEngine.fillWithZero = false
+	return queryEngine, nil
+}
+
+// Returns the engine the coordinator uses to merge the partial
+// aggregates of a mergeable query the shards send back
+func NewMergingQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) (*QueryEngine, error) {
+	if !IsMergeable(query) {
+		return nil, fmt.Errorf("The aggregates of %s can't be merged", query.GetQueryString())
+	}
+	queryEngine, err := NewQueryEngine(query, responseChan)
+	if err != nil {
+		return nil, err
+	}
+	functions := make([]string, 0, len(queryEngine.aggregators))
+	for _, value := range query.GetColumnNames() {
+		if value.IsFunctionCall() {
+			functions = append(functions, strings.ToLower(value.Name))
+		}
+	}
+	for idx, aggregator := range queryEngine.aggregators {
+		queryEngine.aggregators[idx] = &partialAggregateMerger{
+			partial: aggregator,
+			isCount: functions[idx] == "count",
+			merge:   mergeFunctions[functions[idx]],
+		}
+	}
+	return queryEngine, nil
+}
+
+// Merges the values of the column of a partial aggregate, the buckets
+// without any partial aggregate get the default value of the aggregate
+type partialAggregateMerger struct {
+	partial     Aggregator
+	isCount     bool
+	merge       func(a, b float64) float64
+	columnIndex int
+}
+
+func (self *partialAggregateMerger) InitializeFieldsMetadata(series *protocol.Series) error {
+	name := self.partial.ColumnNames()[0]
+	for idx, field := range series.Fields {
+		if field == name {
+			self.columnIndex = idx
+			return nil
+		}
+	}
+	return fmt.Errorf("Partial aggregate %s is missing from series %s", name, series.GetName())
+}
+
+func (self *partialAggregateMerger) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
+	fieldValue := p.Values[self.columnIndex]
+	var value float64
+	if ptr := fieldValue.Int64Value; ptr != nil {
+		value = float64(*ptr)
+	} else if ptr := fieldValue.DoubleValue; ptr != nil {
+		value = *ptr
+	} else {
+		return state, nil
+	}
+	if state == nil {
+		return value, nil
+	}
+	return self.merge(state.(float64), value), nil
+}
+
+func (self *partialAggregateMerger) GetValues(state interface{}) [][]*protocol.FieldValue {
+	if state == nil {
+		return self.partial.GetValues(nil)
+	}
+	value := &protocol.FieldValue{DoubleValue: protocol.Float64(state.(float64))}
+	if self.isCount {
+		value = &protocol.FieldValue{Int64Value: protocol.Int64(int64(state.(float64)))}
+	}
+	return [][]*protocol.FieldValue{[]*protocol.FieldValue{value}}
+}
+
+func (self *partialAggregateMerger) CalculateSummaries(state interface{}) {
+}
+
+func (self *partialAggregateMerger) ColumnNames() []string {
+	return self.partial.ColumnNames()
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+)
+
+type PartialAggregatesSuite struct{}
+
+var _ = Suite(&PartialAggregatesSuite{})
+
+func newPoint(timestamp, value int64) *protocol.Point {
+	point := &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: protocol.Int64(value)}}}
+	point.SetTimestampInMicroseconds(timestamp * 1000000)
+	return point
+}
+
+// runs the points through the engine and returns the points it sends back
+func runEngine(engine *QueryEngine, responses chan *protocol.Response, series ...*protocol.Series) []*protocol.Series {
+	done := make(chan []*protocol.Series)
+	go func() {
+		result := []*protocol.Series{}
+		for response := range responses {
+			if response.GetType() == endStreamResponse {
+				done <- result
+				return
+			}
+			if response.Series != nil && len(response.Series.Points) > 0 {
+				result = append(result, response.Series)
+			}
+		}
+	}()
+	for _, s := range series {
+		engine.YieldSeries(s)
+	}
+	engine.Close()
+	return <-done
+}
+
+func (self *PartialAggregatesSuite) TestMergingThePartialAggregatesOfTheShards(c *C) {
+	query, err := parser.ParseSelectQuery("select count(value), min(value), max(value) from t group by time(10s) order asc;")
+	c.Assert(err, IsNil)
+	c.Assert(IsMergeable(query), Equals, true)
+
+	shards := [][]*protocol.Point{
+		{newPoint(1, 5), newPoint(2, 3)},
+		{newPoint(3, 7), newPoint(12, 1)},
+	}
+	partials := []*protocol.Series{}
+	for _, points := range shards {
+		responses := make(chan *protocol.Response, 10)
+		engine, err := NewPartialQueryEngine(query, responses)
+		c.Assert(err, IsNil)
+		partials = append(partials, runEngine(engine, responses, &protocol.Series{
+			Name:   protocol.String("t"),
+			Fields: []string{"value"},
+			Points: points,
+		})...)
+	}
+
+	responses := make(chan *protocol.Response, 10)
+	engine, err := NewMergingQueryEngine(query, responses)
+	c.Assert(err, IsNil)
+	merged := runEngine(engine, responses, partials...)
+
+	points := []*protocol.Point{}
+	for _, series := range merged {
+		c.Assert(series.Fields, DeepEquals, []string{"count", "min", "max"})
+		points = append(points, series.Points...)
+	}
+	c.Assert(points, HasLen, 2)
+	c.Assert(points[0].Values[0].GetInt64Value(), Equals, int64(3))
+	c.Assert(points[0].Values[1].GetDoubleValue(), Equals, 3.0)
+	c.Assert(points[0].Values[2].GetDoubleValue(), Equals, 7.0)
+	c.Assert(points[1].Values[0].GetInt64Value(), Equals, int64(1))
+	c.Assert(points[1].Values[1].GetDoubleValue(), Equals, 1.0)
+	c.Assert(points[1].Values[2].GetDoubleValue(), Equals, 1.0)
+}
+
+func (self *PartialAggregatesSuite) TestOnlySomeAggregatesAreMergeable(c *C) {
+	for query, mergeable := range map[string]bool{
+		"select sum(value), count(value) from t group by time(1h);": true,
+		"select mean(value) from t group by time(1h);":              false,
+		"select percentile(value, 90) from t;":                      false,
+		"select count(distinct(value)) from t;":                     false,
+		"select value from t;":                                      false,
+	} {
+		q, err := parser.ParseSelectQuery(query)
+		c.Assert(err, IsNil)
+		c.Assert(IsMergeable(q), Equals, mergeable, Commentf(query))
+	}
+}
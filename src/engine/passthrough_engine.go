@@ -30,10 +30,14 @@ func NewPassthroughEngine(responseChan chan *protocol.Response, maxPointsInRespo
 }
 
 func NewPassthroughEngineWithLimit(responseChan chan *protocol.Response, maxPointsInResponse, limit int) *PassthroughEngine {
+	return NewPassthroughEngineWithLimitAndOffset(responseChan, maxPointsInResponse, limit, 0)
+}
+
+func NewPassthroughEngineWithLimitAndOffset(responseChan chan *protocol.Response, maxPointsInResponse, limit, offset int) *PassthroughEngine {
 	passthroughEngine := &PassthroughEngine{
 		responseChan:        responseChan,
 		maxPointsInResponse: maxPointsInResponse,
-		limiter:             NewLimiter(limit),
+		limiter:             NewLimiterWithOffset(limit, offset),
 		responseType:        &queryResponse,
 		runStartTime:        0,
 		runEndTime:          0,
@@ -98,6 +102,17 @@ func (self *PassthroughEngine) Close() {
 	self.responseChan <- response
 }
 
+// Returns true if every one of the series got all the points the limit
+// lets through, the points that come after would be dropped
+func (self *PassthroughEngine) HitLimit(seriesNames []string) bool {
+	for _, name := range seriesNames {
+		if !self.limiter.hitLimit(name) {
+			return false
+		}
+	}
+	return len(seriesNames) > 0
+}
+
 func (self *PassthroughEngine) SetShardInfo(shardId int, shardLocal bool) {
 	//EXPLAIN doens't really work with this query (yet ?)
 }
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"fmt"
+	"parser"
+	"strings"
+)
+
+// The processors that can tell which stages the points of a query go
+// through, explain queries return them in their query plan
+type StagedQueryProcessor interface {
+	Stages() []string
+}
+
+// Returns the stages of the engine in the order the points go through
+// them
+func (self *QueryEngine) Stages() []string {
+	stages := []string{}
+	switch self.query.GetFromClause().Type {
+	case parser.FromClauseMerge:
+		stages = append(stages, "merge")
+	case parser.FromClauseInnerJoin:
+		stages = append(stages, "join")
+	}
+
+	if self.isAggregateQuery {
+		functions := []string{}
+		for _, value := range self.query.GetColumnNames() {
+			if value.IsFunctionCall() {
+				functions = append(functions, strings.ToLower(value.Name))
+			}
+		}
+		stage := "aggregate"
+		if len(self.aggregators) > 0 {
+			if _, ok := self.aggregators[0].(*partialAggregateMerger); ok {
+				stage = "merge partial aggregates"
+			}
+		}
+		stage = fmt.Sprintf("%s %s", stage, strings.Join(functions, ", "))
+		if groupBy := self.query.GetGroupByClause(); len(groupBy.Elems) > 0 {
+			stage = fmt.Sprintf("%s group by %s", stage, groupBy.GetString())
+		}
+		stages = append(stages, stage)
+	} else if containsArithmeticOperators(self.query) {
+		stages = append(stages, "arithmetic")
+	}
+
+	return append(stages, self.limiter.stages()...)
+}
+
+func (self *PassthroughEngine) Stages() []string {
+	return append([]string{"passthrough"}, self.limiter.stages()...)
+}
+
+func (self *Limiter) stages() []string {
+	stages := []string{}
+	if self.offset > 0 {
+		stages = append(stages, fmt.Sprintf("offset %d", self.offset))
+	}
+	if self.shouldLimit {
+		stages = append(stages, fmt.Sprintf("limit %d", self.limit))
+	}
+	return stages
+}
@@ -0,0 +1,35 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"parser"
+)
+
+type QueryPlanSuite struct{}
+
+var _ = Suite(&QueryPlanSuite{})
+
+func (self *QueryPlanSuite) TestStagesOfTheEngines(c *C) {
+	query, err := parser.ParseSelectQuery("select count(value), max(value) from t group by time(1m) limit 5;")
+	c.Assert(err, IsNil)
+
+	engine, err := NewQueryEngine(query, nil)
+	c.Assert(err, IsNil)
+	c.Assert(engine.Stages(), DeepEquals, []string{"aggregate count, max group by time(1m)", "limit 5"})
+
+	engine, err = NewPartialQueryEngine(query, nil)
+	c.Assert(err, IsNil)
+	c.Assert(engine.Stages(), DeepEquals, []string{"aggregate count, max group by time(1m)"})
+
+	engine, err = NewMergingQueryEngine(query, nil)
+	c.Assert(err, IsNil)
+	c.Assert(engine.Stages(), DeepEquals, []string{"merge partial aggregates count, max group by time(1m)", "limit 5"})
+
+	query, err = parser.ParseSelectQuery("select a + b from t merge u;")
+	c.Assert(err, IsNil)
+	engine, err = NewQueryEngine(query, nil)
+	c.Assert(err, IsNil)
+	c.Assert(engine.Stages(), DeepEquals, []string{"merge", "arithmetic"})
+
+	c.Assert(NewPassthroughEngineWithLimitAndOffset(nil, 1, 10, 2).Stages(), DeepEquals, []string{"passthrough", "offset 2", "limit 10"})
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"sort"
+)
+
+// A t-digest, a sketch of the distribution of the values that answers
+// quantiles with a bounded amount of memory. The values are kept as
+// centroids, a mean and the number of values it stands for, which are
+// smaller near the tails of the distribution so the extreme quantiles
+// stay accurate. See https://github.com/tdunning/t-digest
+type tDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []float64
+	count       float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type centroidsByMean []centroid
+
+func (self centroidsByMean) Len() int           { return len(self) }
+func (self centroidsByMean) Less(i, j int) bool { return self[i].mean < self[j].mean }
+func (self centroidsByMean) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// The higher the compression the more centroids are kept, the digest
+// keeps roughly 2 * compression centroids
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		buffer:      make([]float64, 0, int(compression)*5),
+	}
+}
+
+func (self *tDigest) add(value float64) {
+	self.buffer = append(self.buffer, value)
+	if len(self.buffer) == cap(self.buffer) {
+		self.compress()
+	}
+}
+
+// Merges the buffered values into the centroids
+func (self *tDigest) compress() {
+	if len(self.buffer) == 0 {
+		return
+	}
+
+	all := make([]centroid, 0, len(self.centroids)+len(self.buffer))
+	all = append(all, self.centroids...)
+	for _, value := range self.buffer {
+		all = append(all, centroid{value, 1})
+		self.count++
+	}
+	self.buffer = self.buffer[:0]
+	sort.Sort(centroidsByMean(all))
+
+	merged := make([]centroid, 0, len(self.centroids))
+	current := all[0]
+	seen := 0.0
+	for _, next := range all[1:] {
+		q := (seen + current.weight + next.weight/2) / self.count
+		limit := 4 * self.count * q * (1 - q) / self.compression
+		if current.weight+next.weight <= limit {
+			current.mean += (next.mean - current.mean) * next.weight / (current.weight + next.weight)
+			current.weight += next.weight
+			continue
+		}
+		seen += current.weight
+		merged = append(merged, current)
+		current = next
+	}
+	self.centroids = append(merged, current)
+}
+
+// Returns the value at the quantile q, between 0 and 1, the values
+// between the centers of two centroids are interpolated
+func (self *tDigest) quantile(q float64) float64 {
+	self.compress()
+	if len(self.centroids) == 0 {
+		return 0
+	}
+	if len(self.centroids) == 1 {
+		return self.centroids[0].mean
+	}
+
+	rank := q * self.count
+	seen := 0.0
+	for idx, c := range self.centroids {
+		center := seen + c.weight/2
+		if rank < center {
+			if idx == 0 {
+				return c.mean
+			}
+			previous := self.centroids[idx-1]
+			previousCenter := seen - previous.weight/2
+			return previous.mean + (c.mean-previous.mean)*(rank-previousCenter)/(center-previousCenter)
+		}
+		seen += c.weight
+	}
+	return self.centroids[len(self.centroids)-1].mean
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"common"
+	"time"
+)
+
+// The group by time buckets of a query with a tz clause start at the
+// same wall clock time in its zone, e.g. at midnight for time(1d), so
+// the buckets of the days with a daylight saving time change are 23 or
+// 25 hours long. The buckets of the calendar intervals, like time(1mo),
+// start at the midnight of the first day of their week, month or year.
+
+// Returns the wall clock time of the timestamp in the zone as
+// microseconds since the epoch
+func toWallClock(timestamp int64, location *time.Location) int64 {
+	_, offset := common.TimeFromMicroseconds(timestamp).In(location).Zone()
+	return timestamp + int64(offset)*int64(time.Second/time.Microsecond)
+}
+
+// Returns the timestamp of the wall clock time in the zone, a wall clock
+// time that happens twice is one of its two timestamps
+func fromWallClock(wallClock int64, location *time.Location) int64 {
+	t := common.TimeFromMicroseconds(wallClock)
+	return common.TimeToMicroseconds(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location))
+}
+
+func (self *QueryEngine) getLocalTimestampBucket(timestamp int64) int64 {
+	interval := self.duration.Nanoseconds() / 1000
+	wallClock := toWallClock(timestamp, self.query.Location)
+	offset := wallClock % interval
+	if offset < 0 {
+		offset += interval
+	}
+	bucket := fromWallClock(wallClock-offset, self.query.Location)
+	if bucket > timestamp {
+		// a daylight saving time change skipped the start of the bucket,
+		// it's taken with the offset of the timestamp instead
+		return timestamp - offset
+	}
+	return bucket
+}
+
+func (self *QueryEngine) getCalendarTimestampBucket(timestamp int64) int64 {
+	return common.TimeToMicroseconds(self.calendar.BucketStart(common.TimeFromMicroseconds(timestamp), self.getLocation()))
+}
+
+// Returns the start of the bucket that comes after the one that starts
+// at bucket
+func (self *QueryEngine) getNextTimestampBucket(bucket int64) int64 {
+	if self.calendar != nil {
+		return common.TimeToMicroseconds(self.calendar.NextBucketStart(common.TimeFromMicroseconds(bucket), self.getLocation()))
+	}
+	interval := self.duration.Nanoseconds() / 1000
+	if self.query.Location == nil {
+		return bucket + interval
+	}
+	next := fromWallClock(toWallClock(bucket, self.query.Location)+interval, self.query.Location)
+	if next <= bucket {
+		return bucket + interval
+	}
+	return next
+}
+
+func (self *QueryEngine) getLocation() *time.Location {
+	if self.query.Location == nil {
+		return time.UTC
+	}
+	return self.query.Location
+}
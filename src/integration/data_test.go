@@ -317,6 +317,61 @@ func (self *DataTestSuite) DifferenceGroupValues(c *C) (Fun, Fun) {
 		}
 }
 
+// the outer query aggregates the means of the inner query
+func (self *DataTestSuite) SubQuery(c *C) (Fun, Fun) {
+	return func(client Client) {
+			data := `
+[
+  {
+	"points": [
+	[1399590700, 10.0],
+	[1399590710, 30.0],
+	[1399590760, 50.0],
+	[1399590770, 70.0],
+	[1399590820,  5.0]
+	],
+	"name": "test_sub_query",
+	"columns": ["time", "value"]
+  }
+]`
+			client.WriteJsonData(data, c, influxdb.Second)
+		}, func(client Client) {
+			serieses := client.RunQuery("select max(avg_val) from (select mean(value) as avg_val from test_sub_query group by time(1m))", c, "m")
+			c.Assert(serieses, HasLen, 1)
+			maps := ToMap(serieses[0])
+			c.Assert(maps, HasLen, 1)
+			c.Assert(maps[0]["max"], Equals, 60.0)
+		}
+}
+
+func (self *DataTestSuite) SelectIntoQuery(c *C) (Fun, Fun) {
+	return func(client Client) {
+			data := `
+[
+  {
+	"points": [
+	[1399590700, 10.0],
+	[1399590710, 30.0],
+	[1399590760, 50.0],
+	[1399590770, 70.0]
+	],
+	"name": "test_select_into",
+	"columns": ["time", "value"]
+  }
+]`
+			client.WriteJsonData(data, c, influxdb.Second)
+		}, func(client Client) {
+			serieses := client.RunQuery("select mean(value) from test_select_into group by time(1m) where time > 1399590600s into test_select_into_1m", c, "m")
+			c.Assert(serieses, HasLen, 0)
+			serieses = client.RunQuery("select mean from test_select_into_1m order asc", c, "m")
+			c.Assert(serieses, HasLen, 1)
+			maps := ToMap(serieses[0])
+			c.Assert(maps, HasLen, 2)
+			c.Assert(maps[0]["mean"], Equals, 20.0)
+			c.Assert(maps[1]["mean"], Equals, 60.0)
+		}
+}
+
 // issue 578
 func (self *DataTestSuite) ParanthesesAlias(c *C) (Fun, Fun) {
 	return func(client Client) {
@@ -361,7 +416,7 @@ func (self *DataTestSuite) WhereAndLimit(c *C) (Fun, Fun) {
 ]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			serieses := client.RunQuery("explain select * from /test_where_and_limit/ where host = 'hosta' limit 1", c, "m")
+			serieses := SeriesNamed(client.RunQuery("explain select * from /test_where_and_limit/ where host = 'hosta' limit 1", c, "m"), "explain query")
 			c.Assert(serieses, HasLen, 1)
 			maps := ToMap(serieses[0])
 			c.Assert(maps, HasLen, 1)
@@ -658,7 +713,7 @@ func (self *DataTestSuite) ExplainsWithPassthrough(c *C) (Fun, Fun) {
   }]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select val_1 from test_explain_passthrough where time > now() - 1h", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select val_1 from test_explain_passthrough where time > now() - 1h", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -750,7 +805,7 @@ func (self *DataTestSuite) ExplainsWithPassthroughAndLimit(c *C) (Fun, Fun) {
 
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select val_1 from test_explain_passthrough_limit where time > now() - 1h limit 1", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select val_1 from test_explain_passthrough_limit where time > now() - 1h limit 1", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -765,6 +820,34 @@ func (self *DataTestSuite) ExplainsWithPassthroughAndLimit(c *C) (Fun, Fun) {
 		}
 }
 
+func (self *DataTestSuite) ExplainsReturnTheQueryPlan(c *C) (Fun, Fun) {
+	return func(client Client) {
+			data := `
+  [{
+    "points": [
+        ["val1", 2],
+        ["val1", 3]
+    ],
+    "name": "test_explain_plan",
+    "columns": ["val_1", "val_2"]
+  }]`
+			client.WriteJsonData(data, c)
+		}, func(client Client) {
+			series := SeriesNamed(client.RunQuery("explain select val_1 from test_explain_plan where time > now() - 1h limit 1", c, "m"), "query plan")
+			c.Assert(series, HasLen, 1)
+			maps := ToMap(series[0])
+			c.Assert(len(maps) > 0, Equals, true)
+			for _, point := range maps {
+				c.Assert(point["series"], Equals, "test_explain_plan")
+				c.Assert(point["regex"], Equals, false)
+				c.Assert(point["columns"], Equals, "val_1")
+				c.Assert(point["point_limit"], Equals, 1.0)
+				c.Assert(point["shard_stages"], Equals, "limit 1")
+				c.Assert(point["coordinator_stages"], Equals, "passthrough, limit 1")
+			}
+		}
+}
+
 func (self *DataTestSuite) ExplainsWithNonLocalAggregator(c *C) (Fun, Fun) {
 	return func(client Client) {
 			data := `
@@ -779,7 +862,7 @@ func (self *DataTestSuite) ExplainsWithNonLocalAggregator(c *C) (Fun, Fun) {
   }]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select count(val_1) from test_explain_non_local where time > now() - 1h", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select count(val_1) from test_explain_non_local where time > now() - 1h", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -816,7 +899,7 @@ func (self *DataTestSuite) ExplainsWithNonLocalAggregatorAndRegex(c *C) (Fun, Fu
   }]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select count(val_1) from /.*test_explain_non_local_regex.*/ where time > now() - 1h", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select count(val_1) from /.*test_explain_non_local_regex.*/ where time > now() - 1h", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -841,7 +924,7 @@ func (self *DataTestSuite) ExplainsWithLocalAggregator(c *C) (Fun, Fun) {
   }]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select count(val_1) from test_local_aggregator group by time(1h) where time > now() - 1h", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select count(val_1) from test_local_aggregator group by time(1h) where time > now() - 1h", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -910,7 +993,7 @@ func (self *DataTestSuite) ExplainsWithLocalAggregatorAndRegex(c *C) (Fun, Fun)
 ]`
 			client.WriteJsonData(data, c)
 		}, func(client Client) {
-			series := client.RunQuery("explain select count(val_1) from /.*test_local_aggregator_regex.*/ group by time(1h) where time > now() - 1h", c, "m")
+			series := SeriesNamed(client.RunQuery("explain select count(val_1) from /.*test_local_aggregator_regex.*/ group by time(1h) where time > now() - 1h", c, "m"), "explain query")
 			c.Assert(series, HasLen, 1)
 			c.Assert(series[0].Name, Equals, "explain query")
 			c.Assert(series[0].Columns, HasLen, 7) // 6 columns plus the time column
@@ -0,0 +1,15 @@
+package helpers
+
+import influxdb "github.com/influxdb/influxdb-go"
+
+// Returns the series with the given name, e.g. the "explain query" stats
+// without the query plan and trace that come with them
+func SeriesNamed(series []*influxdb.Series, name string) []*influxdb.Series {
+	named := []*influxdb.Series{}
+	for _, s := range series {
+		if s.Name == name {
+			named = append(named, s)
+		}
+	}
+	return named
+}
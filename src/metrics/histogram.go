@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// The bucket bounds of the latencies in milliseconds
+var LatencyBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// Counts the values in buckets. A bucket counts the values up to its
+// bound that are greater than the bound of the previous bucket, the
+// last one the values greater than all the bounds.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+	max    float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := append([]float64{}, bounds...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		bounds: sorted,
+		counts: make([]int64, len(sorted)+1),
+	}
+}
+
+func (self *Histogram) Update(value float64) {
+	idx := sort.SearchFloat64s(self.bounds, value)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[idx]++
+	self.count++
+	self.sum += value
+	if value > self.max || self.count == 1 {
+		self.max = value
+	}
+}
+
+// Returns the count, the sum, the mean, the max and the 50th, 90th and
+// 99th percentiles of the values. The percentiles are the bounds of the
+// buckets they fall in, the max if they're in the last bucket.
+func (self *Histogram) Snapshot() map[string]float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	snapshot := map[string]float64{
+		"count": float64(self.count),
+		"sum":   self.sum,
+		"max":   self.max,
+		"mean":  0,
+		"p50":   self.percentile(0.5),
+		"p90":   self.percentile(0.9),
+		"p99":   self.percentile(0.99),
+	}
+	if self.count > 0 {
+		snapshot["mean"] = self.sum / float64(self.count)
+	}
+	return snapshot
+}
+
+func (self *Histogram) percentile(p float64) float64 {
+	if self.count == 0 {
+		return 0
+	}
+	rank := int64(p*float64(self.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for idx, count := range self.counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if idx == len(self.bounds) || self.bounds[idx] > self.max {
+			return self.max
+		}
+		return self.bounds[idx]
+	}
+	return self.max
+}
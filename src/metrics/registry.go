@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// The registry the packages of the server report their metrics to
+var Default = NewRegistry()
+
+// A registry of named counters, gauges and histograms. The metrics are
+// created the first time they're asked for, so the packages don't have
+// to know about each other.
+type Registry struct {
+	lock       sync.RWMutex
+	counters   map[string]*Counter
+	gauges     map[string]func() int64
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   map[string]*Counter{},
+		gauges:     map[string]func() int64{},
+		histograms: map[string]*Histogram{},
+	}
+}
+
+// Returns the counter with the given name, creates it if it doesn't
+// exist
+func (self *Registry) Counter(name string) *Counter {
+	self.lock.RLock()
+	counter := self.counters[name]
+	self.lock.RUnlock()
+	if counter != nil {
+		return counter
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if counter = self.counters[name]; counter == nil {
+		counter = &Counter{}
+		self.counters[name] = counter
+	}
+	return counter
+}
+
+// Reports the value the function returns under the given name, the
+// function is called every time the metrics are read and replaces the
+// gauge that had the name before
+func (self *Registry) Gauge(name string, value func() int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.gauges[name] = value
+}
+
+// Returns the histogram with the given name, creates it with the given
+// bucket bounds if it doesn't exist
+func (self *Registry) Histogram(name string, bounds []float64) *Histogram {
+	self.lock.RLock()
+	histogram := self.histograms[name]
+	self.lock.RUnlock()
+	if histogram != nil {
+		return histogram
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if histogram = self.histograms[name]; histogram == nil {
+		histogram = NewHistogram(bounds)
+		self.histograms[name] = histogram
+	}
+	return histogram
+}
+
+// Removes the metric with the given name, e.g. the metrics of a shard
+// that was dropped
+func (self *Registry) Remove(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.counters, name)
+	delete(self.gauges, name)
+	delete(self.histograms, name)
+}
+
+// Returns the current value of every metric. The histograms are
+// reported as their count, sum, mean and percentiles, e.g.
+// query.duration_ms.p99.
+func (self *Registry) Snapshot() map[string]float64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	snapshot := map[string]float64{}
+	for name, counter := range self.counters {
+		snapshot[name] = float64(counter.Count())
+	}
+	for name, gauge := range self.gauges {
+		snapshot[name] = float64(gauge())
+	}
+	for name, histogram := range self.histograms {
+		for key, value := range histogram.Snapshot() {
+			snapshot[name+"."+key] = value
+		}
+	}
+	return snapshot
+}
+
+// Returns the snapshot of the default registry with the runtime stats
+// of the process, which are under runtime.
+func Snapshot() map[string]float64 {
+	snapshot := Default.Snapshot()
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	snapshot["runtime.goroutines"] = float64(runtime.NumGoroutine())
+	snapshot["runtime.heap_alloc"] = float64(memStats.HeapAlloc)
+	snapshot["runtime.heap_objects"] = float64(memStats.HeapObjects)
+	snapshot["runtime.sys"] = float64(memStats.Sys)
+	snapshot["runtime.gc.count"] = float64(memStats.NumGC)
+	snapshot["runtime.gc.pause_total_ns"] = float64(memStats.PauseTotalNs)
+	if memStats.NumGC > 0 {
+		snapshot["runtime.gc.last_pause_ns"] = float64(memStats.PauseNs[(memStats.NumGC+255)%256])
+	}
+	return snapshot
+}
+
+// Returns the names of the snapshot in order
+func SortedNames(snapshot map[string]float64) []string {
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the name of the metric of a shard, e.g. shards.12.points_written
+func ShardMetric(shardId uint32, name string) string {
+	return fmt.Sprintf("shards.%d.%s", shardId, name)
+}
+
+// Returns the name of the metric of a database, e.g.
+// databases.db1.points_in_future
+func DatabaseMetric(db string, name string) string {
+	return fmt.Sprintf("databases.%s.%s", db, name)
+}
+
+// Returns the name of the metric of the writes buffered for a server that
+// is down, e.g. hinted_handoff.2.pending
+func HandoffMetric(serverId uint32, name string) string {
+	return fmt.Sprintf("hinted_handoff.%d.%s", serverId, name)
+}
+
+type Counter struct {
+	count int64
+}
+
+func (self *Counter) Inc() {
+	atomic.AddInt64(&self.count, 1)
+}
+
+func (self *Counter) Add(n int64) {
+	atomic.AddInt64(&self.count, n)
+}
+
+func (self *Counter) Count() int64 {
+	return atomic.LoadInt64(&self.count)
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+func (self *RegistrySuite) TestSnapshotHasTheValuesOfAllTheMetrics(c *C) {
+	registry := NewRegistry()
+	registry.Counter("writes.points").Add(10)
+	registry.Counter("writes.points").Inc()
+	registry.Gauge("shards.open", func() int64 { return 3 })
+	registry.Histogram("query.duration_ms", LatencyBuckets).Update(7)
+
+	snapshot := registry.Snapshot()
+	c.Assert(snapshot["writes.points"], Equals, float64(11))
+	c.Assert(snapshot["shards.open"], Equals, float64(3))
+	c.Assert(snapshot["query.duration_ms.count"], Equals, float64(1))
+	c.Assert(snapshot["query.duration_ms.p50"], Equals, float64(7))
+
+	registry.Remove("writes.points")
+	_, ok := registry.Snapshot()["writes.points"]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *RegistrySuite) TestHistogramPercentilesAreTheBoundsOfTheirBuckets(c *C) {
+	histogram := NewHistogram([]float64{10, 1, 100})
+	for i := 0; i < 90; i++ {
+		histogram.Update(0.5)
+	}
+	for i := 0; i < 9; i++ {
+		histogram.Update(50)
+	}
+	histogram.Update(500)
+
+	snapshot := histogram.Snapshot()
+	c.Assert(snapshot["count"], Equals, float64(100))
+	c.Assert(snapshot["max"], Equals, float64(500))
+	c.Assert(snapshot["p50"], Equals, float64(1))
+	c.Assert(snapshot["p90"], Equals, float64(1))
+	c.Assert(snapshot["p99"], Equals, float64(100))
+	c.Assert(snapshot["mean"], Equals, (90*0.5+9*50+500)/100)
+	// the values past the last bound are reported as the max
+	c.Assert(histogram.percentile(1), Equals, float64(500))
+}
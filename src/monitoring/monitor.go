@@ -0,0 +1,114 @@
+// package monitoring writes the metrics of the server into a database of
+// the cluster, so the cluster can be graphed with itself
+package monitoring
+
+import (
+	"cluster"
+	. "common"
+	"configuration"
+	"coordinator"
+	"metrics"
+	"protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+type Monitor struct {
+	database      string
+	retention     string
+	interval      time.Duration
+	server        string
+	coordinator   coordinator.Coordinator
+	clusterConfig *cluster.ClusterConfiguration
+	user          *cluster.ClusterAdmin
+	stop          chan bool
+}
+
+func NewMonitor(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Monitor {
+	return &Monitor{
+		database:      config.MonitoringDatabase,
+		retention:     config.MonitoringRetention,
+		interval:      config.MonitoringInterval,
+		server:        config.ProtobufConnectionString(),
+		coordinator:   coord,
+		clusterConfig: clusterConfig,
+		stop:          make(chan bool),
+	}
+}
+
+// only call this function after everything (i.e. Raft) is initialized,
+// so that there's at least 1 admin user
+func (self *Monitor) getAuth() {
+	names := self.clusterConfig.GetClusterAdmins()
+	self.user = self.clusterConfig.GetClusterAdmin(names[0])
+}
+
+// Creates the database if it doesn't exist, sets its retention and
+// writes the metrics every interval until the monitor is closed
+func (self *Monitor) Start() error {
+	self.getAuth()
+	err := self.coordinator.CreateDatabase(self.user, self.database)
+	if _, ok := err.(DatabaseExistsError); err != nil && !ok {
+		return err
+	}
+	if err := self.coordinator.SetDatabaseRetention(self.user, self.database, self.retention); err != nil {
+		return err
+	}
+	go self.writeMetrics()
+	return nil
+}
+
+func (self *Monitor) Close() {
+	close(self.stop)
+}
+
+func (self *Monitor) writeMetrics() {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			series := metricsSeries(metrics.Snapshot(), self.server, now)
+			if err := self.writePoints(series); err != nil {
+				log.Warn("Monitor: failed to write the metrics to %s: %s", self.database, err)
+			}
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+func (self *Monitor) writePoints(series []*protocol.Series) error {
+	err := self.coordinator.WriteSeriesData(self.user, self.database, series)
+	if _, ok := err.(AuthorizationError); ok {
+		// user information got stale, get a fresh one (this should happen rarely)
+		self.getAuth()
+		err = self.coordinator.WriteSeriesData(self.user, self.database, series)
+	}
+	return err
+}
+
+// Returns a series per metric with one point, the value of the metric
+// and the server it's from
+func metricsSeries(snapshot map[string]float64, server string, now time.Time) []*protocol.Series {
+	timestamp := TimeToMicroseconds(now)
+	series := make([]*protocol.Series, 0, len(snapshot))
+	for _, name := range metrics.SortedNames(snapshot) {
+		value := snapshot[name]
+		series = append(series, &protocol.Series{
+			Name:   protocol.String(name),
+			Fields: []string{"value", "server"},
+			Points: []*protocol.Point{
+				&protocol.Point{
+					Timestamp: protocol.Int64(timestamp),
+					Values: []*protocol.FieldValue{
+						&protocol.FieldValue{DoubleValue: protocol.Float64(value)},
+						&protocol.FieldValue{StringValue: protocol.String(server)},
+					},
+				},
+			},
+		})
+	}
+	return series
+}
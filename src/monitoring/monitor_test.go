@@ -0,0 +1,32 @@
+package monitoring
+
+import (
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type MonitorSuite struct{}
+
+var _ = Suite(&MonitorSuite{})
+
+func (self *MonitorSuite) TestEveryMetricIsASeriesWithTheServer(c *C) {
+	now := time.Unix(1400000000, 0)
+	snapshot := map[string]float64{"write.points": 10, "datastore.open_shards": 2}
+	series := metricsSeries(snapshot, "localhost:8099", now)
+	c.Assert(series, HasLen, 2)
+	c.Assert(series[0].GetName(), Equals, "datastore.open_shards")
+	c.Assert(series[1].GetName(), Equals, "write.points")
+	c.Assert(series[1].Fields, DeepEquals, []string{"value", "server"})
+	c.Assert(series[1].Points, HasLen, 1)
+	point := series[1].Points[0]
+	c.Assert(point.GetTimestamp(), Equals, int64(1400000000000000))
+	c.Assert(point.Values[0].GetDoubleValue(), Equals, float64(10))
+	c.Assert(point.Values[1].GetStringValue(), Equals, "localhost:8099")
+}
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CalendarUnit int
+
+const (
+	CalendarWeeks CalendarUnit = iota
+	CalendarMonths
+	CalendarYears
+)
+
+// A group by time interval of whole weeks, months or years. Its buckets
+// start at the start of a week, which is a monday, of a month or of a
+// year instead of every fixed duration since the epoch, e.g. the buckets
+// of time(3mo) are the quarters and the ones of time(2w) start every
+// other monday.
+type CalendarInterval struct {
+	Unit  CalendarUnit
+	Count int
+}
+
+var calendarUnits = map[string]CalendarUnit{
+	"w":  CalendarWeeks,
+	"mo": CalendarMonths,
+	"y":  CalendarYears,
+}
+
+// Returns nil unless the interval is a whole number of weeks, months or
+// years, e.g. 1w, 3mo or 1y
+func parseCalendarInterval(interval string) *CalendarInterval {
+	for suffix, unit := range calendarUnits {
+		if !strings.HasSuffix(interval, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(interval[:len(interval)-len(suffix)])
+		if err != nil || count <= 0 {
+			return nil
+		}
+		return &CalendarInterval{unit, count}
+	}
+	return nil
+}
+
+// The interval as the duration of its average bucket, for the code that
+// only needs to know roughly how long the buckets are
+func (self *CalendarInterval) approximateDuration() time.Duration {
+	day := 24 * time.Hour
+	switch self.Unit {
+	case CalendarWeeks:
+		return time.Duration(self.Count) * 7 * day
+	case CalendarMonths:
+		return time.Duration(self.Count) * 30 * day
+	default:
+		return time.Duration(self.Count) * 365 * day
+	}
+}
+
+// Returns the start of the bucket of the time in the zone
+func (self *CalendarInterval) BucketStart(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+	switch self.Unit {
+	case CalendarWeeks:
+		// the first monday after the epoch, the weeks are counted from it
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		days := int(day.Sub(time.Date(1970, time.January, 5, 0, 0, 0, 0, time.UTC)) / (24 * time.Hour))
+		days -= floorMod(days, 7*self.Count)
+		return time.Date(1970, time.January, 5+days, 0, 0, 0, 0, location)
+	case CalendarMonths:
+		months := (t.Year()-1970)*12 + int(t.Month()) - 1
+		months -= floorMod(months, self.Count)
+		return time.Date(1970, time.January+time.Month(months), 1, 0, 0, 0, 0, location)
+	default:
+		years := t.Year() - 1970
+		years -= floorMod(years, self.Count)
+		return time.Date(1970+years, time.January, 1, 0, 0, 0, 0, location)
+	}
+}
+
+// Returns the start of the bucket that comes after the one that starts
+// at start
+func (self *CalendarInterval) NextBucketStart(start time.Time, location *time.Location) time.Time {
+	start = start.In(location)
+	switch self.Unit {
+	case CalendarWeeks:
+		return start.AddDate(0, 0, 7*self.Count)
+	case CalendarMonths:
+		return start.AddDate(0, self.Count, 0)
+	default:
+		return start.AddDate(self.Count, 0, 0)
+	}
+}
+
+func floorMod(value, divisor int) int {
+	mod := value % divisor
+	if mod < 0 {
+		mod += divisor
+	}
+	return mod
+}
@@ -14,6 +14,7 @@ void free_table_name(table_name *name)
 {
   free_value(name->name);
   free(name->alias);
+  free(name->database);
   free(name);
 }
 void
@@ -30,6 +31,10 @@ void
 free_from_clause(from_clause *f)
 {
   free_table_name_array(f->names);
+  if (f->subquery) {
+    free_select_query(f->subquery);
+    free(f->subquery);
+  }
   free(f);
 }
 
@@ -105,6 +110,8 @@ free_select_query (select_query *q)
     free(q->into_clause);
   }
 
+  free(q->time_zone);
+
   if (q->from_clause) {
     // free the from clause
     free_from_clause(q->from_clause);
@@ -130,6 +137,24 @@ free_drop_series_query (drop_series_query *q)
   free_value(q->name);
 }
 
+void
+free_list_series_query (list_series_query *q)
+{
+  if (q->name) {
+    free_value(q->name);
+  }
+
+  if (q->where_condition) {
+    free_condition(q->where_condition);
+  }
+}
+
+void
+free_list_fields_query (list_fields_query *q)
+{
+  free_value(q->name);
+}
+
 void
 close_query (query *q)
 {
@@ -147,10 +172,24 @@ close_query (query *q)
     free(q->drop_series_query);
   }
 
+  if (q->list_series_query) {
+    free_list_series_query(q->list_series_query);
+    free(q->list_series_query);
+  }
+
+  if (q->list_fields_query) {
+    free_list_fields_query(q->list_fields_query);
+    free(q->list_fields_query);
+  }
+
   if (q->drop_query) {
     free(q->drop_query);
   }
 
+  if (q->kill_query) {
+    free(q->kill_query);
+  }
+
   if (q->delete_query) {
     free_delete_query(q->delete_query);
     free(q->delete_query);
@@ -15,6 +15,7 @@ const (
 	FromClauseArray     FromClauseType = C.FROM_ARRAY
 	FromClauseMerge     FromClauseType = C.FROM_MERGE
 	FromClauseInnerJoin FromClauseType = C.FROM_INNER_JOIN
+	FromClauseSubQuery  FromClauseType = C.FROM_SUBQUERY
 )
 
 func (self *TableName) GetAlias() string {
@@ -34,22 +35,83 @@ func (self *TableName) GetAliasString() string {
 type TableName struct {
 	Name  *Value
 	Alias string
+	// the database the series is read from if it isn't the one of the
+	// query, e.g. "metrics".."cpu.load"
+	Database string
+}
+
+// Returns the name with its database if it has one, e.g.
+// "metrics"..cpu.load
+func (self *TableName) GetNameString() string {
+	if self.Database != "" {
+		return fmt.Sprintf("\"%s\"..%s", self.Database, self.Name.GetString())
+	}
+	return self.Name.GetString()
+}
+
+// Returns the databases other than db the series of the from clause are
+// read from
+func (self *FromClause) GetOtherDatabases(db string) []string {
+	databases := []string{}
+	for _, name := range self.Names {
+		if name.Database == "" || name.Database == db {
+			continue
+		}
+		found := false
+		for _, other := range databases {
+			found = found || other == name.Database
+		}
+		if !found {
+			databases = append(databases, name.Database)
+		}
+	}
+	return databases
 }
 
 type FromClause struct {
 	Type  FromClauseType
 	Names []*TableName
+	// the inner query of a select from a subquery, Names is empty then
+	SubQuery *SelectQuery
+	// the regex of a merge or join of the series matching it, the
+	// coordinator replaces Names with the matching series
+	Regex *Value
+}
+
+// Returns the names of the series of the from clause
+func (self *FromClause) GetTableNames() []string {
+	names := make([]string, 0, len(self.Names))
+	for _, name := range self.Names {
+		names = append(names, name.Name.Name)
+	}
+	return names
+}
+
+// Returns a copy of the merge or join of a regex with the series
+// matching the regex
+func (self *FromClause) WithTableNames(names []string) *FromClause {
+	tables := make([]*TableName, 0, len(names))
+	for _, name := range names {
+		tables = append(tables, &TableName{Name: &Value{Name: name, Type: ValueSimpleName}})
+	}
+	return &FromClause{Type: self.Type, Names: tables, Regex: self.Regex}
 }
 
 func (self *FromClause) GetString() string {
 	buffer := bytes.NewBufferString("")
-	switch self.Type {
-	case FromClauseMerge:
-		fmt.Fprintf(buffer, "%s%s merge %s %s", self.Names[0].Name.GetString(), self.Names[1].GetAliasString(),
-			self.Names[1].Name.GetString(), self.Names[1].GetAliasString())
-	case FromClauseInnerJoin:
-		fmt.Fprintf(buffer, "%s%s inner join %s%s", self.Names[0].Name.GetString(), self.Names[0].GetAliasString(),
-			self.Names[1].Name.GetString(), self.Names[1].GetAliasString())
+	switch {
+	case self.Regex != nil && self.Type == FromClauseMerge:
+		fmt.Fprintf(buffer, "merge(%s)", self.Regex.GetString())
+	case self.Regex != nil && self.Type == FromClauseInnerJoin:
+		fmt.Fprintf(buffer, "join(%s)", self.Regex.GetString())
+	case self.Type == FromClauseMerge:
+		fmt.Fprintf(buffer, "%s%s merge %s %s", self.Names[0].GetNameString(), self.Names[1].GetAliasString(),
+			self.Names[1].GetNameString(), self.Names[1].GetAliasString())
+	case self.Type == FromClauseSubQuery:
+		fmt.Fprintf(buffer, "(%s)", self.SubQuery.GetQueryStringWithTimeCondition())
+	case self.Type == FromClauseInnerJoin:
+		fmt.Fprintf(buffer, "%s%s inner join %s%s", self.Names[0].GetNameString(), self.Names[0].GetAliasString(),
+			self.Names[1].GetNameString(), self.Names[1].GetAliasString())
 	default:
 		names := make([]string, 0, len(self.Names))
 		for _, t := range self.Names {
@@ -57,7 +119,7 @@ func (self *FromClause) GetString() string {
 			if t.Alias != "" {
 				alias = fmt.Sprintf(" as %s", t.Alias)
 			}
-			names = append(names, fmt.Sprintf("%s%s", t.Name.GetString(), alias))
+			names = append(names, fmt.Sprintf("%s%s", t.GetNameString(), alias))
 		}
 		buffer.WriteString(strings.Join(names, ","))
 	}
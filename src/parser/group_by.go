@@ -28,6 +28,10 @@ func (self GroupByClause) GetGroupByTime() (*time.Duration, error) {
 				log.Debug("Get a time function without a duration argument %v", groupBy.Elems[0].Type)
 			}
 			arg := groupBy.Elems[0].Name
+			if interval := parseCalendarInterval(arg); interval != nil {
+				duration := interval.approximateDuration()
+				return &duration, nil
+			}
 			durationInt, err := common.ParseTimeDuration(arg)
 			if err != nil {
 				return nil, common.NewQueryError(common.InvalidArgument, fmt.Sprintf("invalid argument %s to the time function", arg))
@@ -39,6 +43,28 @@ func (self GroupByClause) GetGroupByTime() (*time.Duration, error) {
 	return nil, nil
 }
 
+// Returns the calendar interval of the time function, nil if the group
+// by doesn't have one
+func (self GroupByClause) GetGroupByCalendarInterval() *CalendarInterval {
+	for _, groupBy := range self.Elems {
+		if groupBy.IsFunctionCall() && strings.ToLower(groupBy.Name) == "time" && len(groupBy.Elems) == 1 {
+			return parseCalendarInterval(groupBy.Elems[0].Name)
+		}
+	}
+	return nil
+}
+
+// Returns true if the empty buckets are filled with nulls
+func (self *GroupByClause) FillWithNull() bool {
+	return self.FillWithZero && self.FillValue.Type == ValueSimpleName && strings.ToLower(self.FillValue.Name) == "null"
+}
+
+// Returns true if the empty buckets are filled with the values of the
+// previous bucket of their group
+func (self *GroupByClause) FillWithPrevious() bool {
+	return self.FillWithZero && self.FillValue.Type == ValueSimpleName && strings.ToLower(self.FillValue.Name) == "previous"
+}
+
 func (self *GroupByClause) GetString() string {
 	buffer := bytes.NewBufferString("")
 
@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The values of the $placeholders of a query. They're bound while the
+// query is parsed and keep their type, a string parameter is always a
+// string literal and can't change the query around it.
+type Parameters map[string]interface{}
+
+// Replaces the placeholders of the value and its elements with the
+// values of their parameters, a placeholder without a parameter is an
+// error
+func (self Parameters) bindValue(value *Value) error {
+	for _, elem := range value.Elems {
+		if err := self.bindValue(elem); err != nil {
+			return err
+		}
+	}
+	if value.Type != ValueParameter {
+		return nil
+	}
+
+	parameter, ok := self[value.Name]
+	if !ok {
+		return fmt.Errorf("Parameter $%s isn't bound", value.Name)
+	}
+	switch x := parameter.(type) {
+	case string:
+		// string literals can't escape their quotes
+		if strings.Contains(x, "'") {
+			return fmt.Errorf("Parameter $%s can't contain a single quote", value.Name)
+		}
+		value.Type, value.Name = ValueString, x
+	case bool:
+		value.Type, value.Name = ValueBool, strconv.FormatBool(x)
+	case int:
+		value.Type, value.Name = ValueInt, strconv.Itoa(x)
+	case int64:
+		value.Type, value.Name = ValueInt, strconv.FormatInt(x, 10)
+	case float64:
+		value.Type, value.Name = ValueFloat, formatFloatParameter(x)
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			value.Type, value.Name = ValueInt, strconv.FormatInt(i, 10)
+		} else if f, err := x.Float64(); err == nil {
+			value.Type, value.Name = ValueFloat, formatFloatParameter(f)
+		} else {
+			return fmt.Errorf("Parameter $%s isn't a valid number: %s", value.Name, x)
+		}
+	default:
+		return fmt.Errorf("Parameter $%s has an unsupported type %T", value.Name, parameter)
+	}
+	return nil
+}
+
+func (self Parameters) bindValues(values []*Value) error {
+	for _, value := range values {
+		if err := self.bindValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self Parameters) bindCondition(condition *WhereCondition) error {
+	if condition == nil {
+		return nil
+	}
+	if expr, ok := condition.GetBoolExpression(); ok {
+		return self.bindValue(expr)
+	}
+	left, _ := condition.GetLeftWhereCondition()
+	if err := self.bindCondition(left); err != nil {
+		return err
+	}
+	return self.bindCondition(condition.Right)
+}
+
+// the float has to parse as a float again when the query is sent to
+// the other servers
+func formatFloatParameter(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
@@ -43,8 +43,12 @@ type SelectQuery struct {
 	groupByClause *GroupByClause
 	IntoClause    *IntoClause
 	Limit         int
+	Offset        int
 	Ascending     bool
 	Explain       bool
+	// the zone of the tz clause the group by time buckets start in, nil
+	// for UTC
+	Location *time.Location
 }
 
 type ListType int
@@ -52,22 +56,120 @@ type ListType int
 const (
 	Series ListType = iota
 	ContinuousQueries
+	Stats
+	Queries
+	Fields
+	SlowQueries
+	DiskUsage
+	Cardinality
 )
 
 type ListQuery struct {
 	Type ListType
+	// the regex the names of the listed series match, nil to list every
+	// series
+	Regex *Value
+	// the series whose fields are listed, empty if they're the ones
+	// matching the regex
+	Series string
+	// how many series to list after skipping the first Offset ones in
+	// the order of their names, 0 lists all of them
+	Limit  int
+	Offset int
+	// only the series whose last point is after LastWriteAfter and
+	// before LastWriteBefore are listed, a zero time doesn't bound it
+	LastWriteAfter  time.Time
+	LastWriteBefore time.Time
+}
+
+// Returns true if the series are listed by the time of their last point,
+// e.g. list series where last_write < now() - 1h
+func (self *ListQuery) HasLastWriteCondition() bool {
+	return !self.LastWriteAfter.IsZero() || !self.LastWriteBefore.IsZero()
+}
+
+// Returns whether a series whose last point is at t is listed
+func (self *ListQuery) MatchesLastWrite(t time.Time) bool {
+	return (self.LastWriteAfter.IsZero() || t.After(self.LastWriteAfter)) &&
+		(self.LastWriteBefore.IsZero() || t.Before(self.LastWriteBefore))
+}
+
+// Returns whether the series with the name is listed, ignoring the limit
+func (self *ListQuery) Matches(name string) bool {
+	if self.Series != "" {
+		return name == self.Series
+	}
+	if self.Regex == nil {
+		return true
+	}
+	regex, _ := self.Regex.GetCompiledRegex()
+	return regex.MatchString(name)
+}
+
+func (self *ListQuery) GetQueryString() string {
+	if self.Type == DiskUsage {
+		return "show disk usage"
+	}
+	if self.Type == Cardinality {
+		return "show cardinality"
+	}
+	if self.Type == Fields {
+		if self.Regex != nil {
+			return "list fields from " + self.Regex.GetString()
+		}
+		return "list fields from " + self.Series
+	}
+	buffer := bytes.NewBufferString("list series")
+	if self.Regex != nil {
+		fmt.Fprintf(buffer, " %s", self.Regex.GetString())
+	}
+	// the times are absolute so the other servers list the same series
+	conditions := []string{}
+	if !self.LastWriteAfter.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("last_write > %du", self.LastWriteAfter.UnixNano()/1000))
+	}
+	if !self.LastWriteBefore.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("last_write < %du", self.LastWriteBefore.UnixNano()/1000))
+	}
+	if len(conditions) > 0 {
+		fmt.Fprintf(buffer, " where %s", strings.Join(conditions, " and "))
+	}
+	if self.Limit > 0 {
+		fmt.Fprintf(buffer, " limit %d", self.Limit)
+		if self.Offset > 0 {
+			fmt.Fprintf(buffer, " offset %d", self.Offset)
+		}
+	}
+	return buffer.String()
 }
 
 type DropQuery struct {
 	Id int
 }
 
+// Kills the running query with the id, the ids are the ones of show queries
+type KillQuery struct {
+	Id int
+}
+
 type DropSeriesQuery struct {
-	tableName string
+	name *Value
+	// explain drop series only returns the series that would be dropped
+	Explain bool
 }
 
+// Returns the name of the series, the pattern of a regex drop
 func (self *DropSeriesQuery) GetTableName() string {
-	return self.tableName
+	return self.name.Name
+}
+
+func (self *DropSeriesQuery) GetTableValue() *Value {
+	return self.name
+}
+
+// Returns the regex, if the series to drop are the ones matching it
+func (self *DropSeriesQuery) GetRegex() (*regexp.Regexp, bool) {
+	return self.name.GetCompiledRegex()
 }
 
 type DeleteQuery struct {
@@ -81,6 +183,7 @@ type Query struct {
 	ListQuery       *ListQuery
 	DropSeriesQuery *DropSeriesQuery
 	DropQuery       *DropQuery
+	KillQuery       *KillQuery
 }
 
 func (self *IntoClause) GetString() string {
@@ -102,7 +205,7 @@ func (self *Query) commonGetQueryString(withTime bool) string {
 		}
 		return self.SelectQuery.GetQueryString()
 	} else if self.ListQuery != nil {
-		return "list series"
+		return self.ListQuery.GetQueryString()
 	} else if self.DeleteQuery != nil {
 		return self.DeleteQuery.GetQueryString(withTime)
 	}
@@ -121,10 +224,34 @@ func (self *Query) IsListSeriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == Series
 }
 
+func (self *Query) IsListFieldsQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == Fields
+}
+
 func (self *Query) IsListContinuousQueriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == ContinuousQueries
 }
 
+func (self *Query) IsShowStatsQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == Stats
+}
+
+func (self *Query) IsShowQueriesQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == Queries
+}
+
+func (self *Query) IsShowSlowQueriesQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == SlowQueries
+}
+
+func (self *Query) IsShowDiskUsageQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == DiskUsage
+}
+
+func (self *Query) IsShowCardinalityQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == Cardinality
+}
+
 func (self *DeleteQuery) GetQueryString(withTime bool) string {
 	buffer := bytes.NewBufferString("delete ")
 	fmt.Fprintf(buffer, "from %s", self.FromClause.GetString())
@@ -140,6 +267,20 @@ func (self *SelectQuery) GetColumnNames() []*Value {
 	return self.ColumnNames
 }
 
+// Returns a copy of the query without the offset that returns the
+// points the offset would skip too
+func (self *SelectQuery) WithoutOffset() *SelectQuery {
+	if self.Offset == 0 {
+		return self
+	}
+	query := *self
+	if query.Limit > 0 {
+		query.Limit += query.Offset
+	}
+	query.Offset = 0
+	return &query
+}
+
 func (self *SelectQuery) IsExplainQuery() bool {
 	return self.Explain
 }
@@ -178,6 +319,9 @@ func (self *SelectQuery) commonGetQueryStringWithTimes(withTime, withIntoClause
 
 	if self.Limit > 0 {
 		fmt.Fprintf(buffer, " limit %d", self.Limit)
+		if self.Offset > 0 {
+			fmt.Fprintf(buffer, " offset %d", self.Offset)
+		}
 	}
 
 	if self.Ascending {
@@ -188,6 +332,10 @@ func (self *SelectQuery) commonGetQueryStringWithTimes(withTime, withIntoClause
 		fmt.Fprintf(buffer, " into %s", clause.GetString())
 	}
 
+	if self.Location != nil {
+		fmt.Fprintf(buffer, " tz('%s')", self.Location)
+	}
+
 	return buffer.String()
 }
 
@@ -234,8 +382,17 @@ func (self *SelectQuery) GetSinglePointQuerySequenceNumber() (int64, error) {
 	return sequence_number, nil
 }
 
+// A select with an into clause and no time condition is continuous,
+// it runs over the points of every group by interval
 func (self *SelectQuery) IsContinuousQuery() bool {
-	return self.GetIntoClause() != nil
+	return self.GetIntoClause() != nil && !self.IsStartTimeSpecified()
+}
+
+// A select with an into clause and a time condition runs once, it
+// writes the points of its time range into the target, e.g. to backfill
+// a series
+func (self *SelectQuery) IsSelectIntoQuery() bool {
+	return self.GetIntoClause() != nil && self.IsStartTimeSpecified()
 }
 
 func (self *SelectQuery) IsValidContinuousQuery() bool {
@@ -327,6 +484,15 @@ func GetGroupByClause(groupByClause *C.groupby_clause) (*GroupByClause, error) {
 		}
 
 		fillValue = fun.Elems[0]
+		switch fillValue.Type {
+		case ValueInt, ValueFloat:
+		case ValueSimpleName:
+			if name := strings.ToLower(fillValue.Name); name != "null" && name != "previous" {
+				return nil, fmt.Errorf("`fill` accepts null, previous or a number, not %s", fillValue.Name)
+			}
+		default:
+			return nil, fmt.Errorf("`fill` accepts null, previous or a number, not %s", fillValue.GetString())
+		}
 		fillWithZero = true
 	}
 
@@ -407,6 +573,9 @@ func GetTableName(name *C.table_name) (*TableName, error) {
 	if name.alias != nil {
 		table.Alias = C.GoString(name.alias)
 	}
+	if name.database != nil {
+		table.Database = C.GoString(name.database)
+	}
 
 	return table, nil
 }
@@ -426,12 +595,25 @@ func GetTableNameArray(array *C.table_name_array) ([]*TableName, error) {
 	return tableNamesSlice, nil
 }
 
-func GetFromClause(fromClause *C.from_clause) (*FromClause, error) {
+func GetFromClause(fromClause *C.from_clause, params Parameters) (*FromClause, error) {
 	arr, err := GetTableNameArray(fromClause.names)
 	if err != nil {
 		return nil, err
 	}
-	return &FromClause{FromClauseType(fromClause.from_clause_type), arr}, nil
+	from := &FromClause{Type: FromClauseType(fromClause.from_clause_type), Names: arr}
+	if (from.Type == FromClauseMerge || from.Type == FromClauseInnerJoin) && len(arr) == 1 {
+		from.Regex = arr[0].Name
+	}
+	if fromClause.subquery != nil {
+		from.SubQuery, err = parseSelectQuery(fromClause.subquery, params)
+		if err != nil {
+			return nil, err
+		}
+		if from.SubQuery.GetIntoClause() != nil {
+			return nil, fmt.Errorf("A subquery can't have an into clause")
+		}
+	}
+	return from, nil
 }
 
 func GetIntoClause(intoClause *C.into_clause) (*IntoClause, error) {
@@ -543,6 +725,12 @@ func ParseSelectQuery(query string) (*SelectQuery, error) {
 }
 
 func ParseQuery(query string) ([]*Query, error) {
+	return ParseQueryWithParameters(query, nil)
+}
+
+// Parses the query and binds its $placeholders to the parameters, the
+// query can't have placeholders without a parameter
+func ParseQueryWithParameters(query string, params Parameters) ([]*Query, error) {
 	queryString := C.CString(query)
 	defer C.free(unsafe.Pointer(queryString))
 	q := C.parse_query(queryString)
@@ -560,23 +748,59 @@ func ParseQuery(query string) ([]*Query, error) {
 		}
 	}
 
-	if q.list_series_query != 0 {
-		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Series}}}, nil
+	if q.list_series_query != nil {
+		listQuery, err := parseListSeriesQuery(q.list_series_query, params)
+		if err != nil {
+			return nil, err
+		}
+		return []*Query{&Query{QueryString: query, ListQuery: listQuery}}, nil
+	}
+
+	if q.list_fields_query != nil {
+		listQuery, err := parseListFieldsQuery(q.list_fields_query)
+		if err != nil {
+			return nil, err
+		}
+		return []*Query{&Query{QueryString: query, ListQuery: listQuery}}, nil
 	}
 
 	if q.list_continuous_queries_query != 0 {
 		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: ContinuousQueries}}}, nil
 	}
 
+	if q.show_stats_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Stats}}}, nil
+	}
+
+	if q.show_queries_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Queries}}}, nil
+	}
+
+	if q.show_slow_queries_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: SlowQueries}}}, nil
+	}
+
+	if q.show_disk_usage_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: DiskUsage}}}, nil
+	}
+
+	if q.show_cardinality_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: Cardinality}}}, nil
+	}
+
+	if q.kill_query != nil {
+		return []*Query{&Query{QueryString: query, KillQuery: &KillQuery{Id: int(q.kill_query.id)}}}, nil
+	}
+
 	if q.select_query != nil {
-		selectQuery, err := parseSelectQuery(q.select_query)
+		selectQuery, err := parseSelectQuery(q.select_query, params)
 		if err != nil {
 			return nil, err
 		}
 
 		return []*Query{&Query{QueryString: query, SelectQuery: selectQuery}}, nil
 	} else if q.delete_query != nil {
-		deleteQuery, err := parseDeleteQuery(q.delete_query)
+		deleteQuery, err := parseDeleteQuery(q.delete_query, params)
 		if err != nil {
 			return nil, err
 		}
@@ -593,6 +817,97 @@ func ParseQuery(query string) ([]*Query, error) {
 	return nil, fmt.Errorf("Unknown query type encountered")
 }
 
+func parseListSeriesQuery(listSeriesQuery *C.list_series_query, params Parameters) (*ListQuery, error) {
+	query := &ListQuery{Type: Series}
+	// the limit is -1 without a limit clause
+	if limit := int(listSeriesQuery.limit); limit > 0 {
+		query.Limit = limit
+		query.Offset = int(listSeriesQuery.offset)
+	}
+	if listSeriesQuery.name != nil {
+		regex, err := GetValue(listSeriesQuery.name)
+		if err != nil {
+			return nil, err
+		}
+		query.Regex = regex
+	}
+	if listSeriesQuery.where_condition != nil {
+		condition, err := GetWhereCondition(listSeriesQuery.where_condition)
+		if err != nil {
+			return nil, err
+		}
+		if err := params.bindCondition(condition); err != nil {
+			return nil, err
+		}
+		if err := parseLastWriteCondition(condition, query); err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+// the operators of the last_write conditions with the column on the right
+var flippedOperators = map[string]string{">": "<", ">=": "<=", "<": ">", "<=": ">="}
+
+// Sets the bounds of the last write of the listed series from the where
+// clause of list series, it can only compare last_write with times and
+// combine the comparisons with and
+func parseLastWriteCondition(condition *WhereCondition, query *ListQuery) error {
+	if left, ok := condition.GetLeftWhereCondition(); ok {
+		if condition.Operation != "AND" {
+			return fmt.Errorf("The conditions of list series can only be combined with and")
+		}
+		if err := parseLastWriteCondition(left, query); err != nil {
+			return err
+		}
+		return parseLastWriteCondition(condition.Right, query)
+	}
+
+	expr, _ := condition.GetBoolExpression()
+	isLastWrite := func(value *Value) bool {
+		return value.Type == ValueSimpleName && value.Name == "last_write"
+	}
+	if expr.Type != ValueExpression || len(expr.Elems) != 2 {
+		return fmt.Errorf("Invalid list series condition %s, it can only compare last_write with a time", expr.GetString())
+	}
+	operator, timeValue := expr.Name, expr.Elems[1]
+	if isLastWrite(expr.Elems[1]) {
+		operator, timeValue = flippedOperators[expr.Name], expr.Elems[0]
+	} else if !isLastWrite(expr.Elems[0]) {
+		return fmt.Errorf("Invalid list series condition %s, it can only compare last_write with a time", expr.GetString())
+	}
+	nanos, err := parseTime(timeValue)
+	if err != nil {
+		return err
+	}
+	// the times of the points are in microseconds
+	t := time.Unix(0, nanos).UTC()
+	switch operator {
+	case ">":
+		query.LastWriteAfter = t
+	case ">=":
+		query.LastWriteAfter = t.Add(-time.Microsecond)
+	case "<":
+		query.LastWriteBefore = t
+	case "<=":
+		query.LastWriteBefore = t.Add(time.Microsecond)
+	default:
+		return fmt.Errorf("last_write can only be compared with <, <=, > or >=")
+	}
+	return nil
+}
+
+func parseListFieldsQuery(listFieldsQuery *C.list_fields_query) (*ListQuery, error) {
+	name, err := GetValue(listFieldsQuery.name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := name.GetCompiledRegex(); ok {
+		return &ListQuery{Type: Fields, Regex: name}, nil
+	}
+	return &ListQuery{Type: Fields, Series: name.Name}, nil
+}
+
 func parseDropSeriesQuery(queryStirng string, dropSeriesQuery *C.drop_series_query) (*DropSeriesQuery, error) {
 	name, err := GetValue(dropSeriesQuery.name)
 	if err != nil {
@@ -600,11 +915,12 @@ func parseDropSeriesQuery(queryStirng string, dropSeriesQuery *C.drop_series_que
 	}
 
 	return &DropSeriesQuery{
-		tableName: name.Name,
+		name:    name,
+		Explain: dropSeriesQuery.explain != 0,
 	}, nil
 }
 
-func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.condition) (SelectDeleteCommonQuery, error) {
+func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.condition, params Parameters) (SelectDeleteCommonQuery, error) {
 
 	goQuery := SelectDeleteCommonQuery{
 		BasicQuery: BasicQuery{
@@ -616,7 +932,7 @@ func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.c
 	var err error
 
 	// get the from clause
-	goQuery.FromClause, err = GetFromClause(fromClause)
+	goQuery.FromClause, err = GetFromClause(fromClause, params)
 	if err != nil {
 		return goQuery, err
 	}
@@ -629,6 +945,11 @@ func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.c
 		}
 	}
 
+	// the time conditions can have placeholders too
+	if err := params.bindCondition(goQuery.Condition); err != nil {
+		return goQuery, err
+	}
+
 	var startTime, endTime *time.Time
 	goQuery.Condition, endTime, err = getTime(goQuery.GetWhereCondition(), false)
 	if err != nil {
@@ -651,14 +972,14 @@ func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.c
 	return goQuery, nil
 }
 
-func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
+func parseSelectQuery(q *C.select_query, params Parameters) (*SelectQuery, error) {
 	limit := q.limit
 	if limit == -1 {
 		// no limit by default
 		limit = 0
 	}
 
-	basicQuery, err := parseSelectDeleteCommonQuery(q.from_clause, q.where_condition)
+	basicQuery, err := parseSelectDeleteCommonQuery(q.from_clause, q.where_condition, params)
 	if err != nil {
 		return nil, err
 	}
@@ -666,6 +987,7 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 	goQuery := &SelectQuery{
 		SelectDeleteCommonQuery: basicQuery,
 		Limit:     int(limit),
+		Offset:    int(q.offset),
 		Ascending: q.ascending != 0,
 		Explain:   q.explain != 0,
 	}
@@ -675,6 +997,9 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := params.bindValues(goQuery.ColumnNames); err != nil {
+		return nil, err
+	}
 
 	// get the group by clause
 	if q.group_by == nil {
@@ -684,6 +1009,9 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := params.bindValues(goQuery.groupByClause.Elems); err != nil {
+			return nil, err
+		}
 	}
 
 	// get the into clause
@@ -692,11 +1020,18 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 		return goQuery, err
 	}
 
+	if q.time_zone != nil {
+		name := C.GoString(q.time_zone)
+		if goQuery.Location, err = time.LoadLocation(name); err != nil {
+			return nil, fmt.Errorf("Unknown time zone %s", name)
+		}
+	}
+
 	return goQuery, nil
 }
 
-func parseDeleteQuery(query *C.delete_query) (*DeleteQuery, error) {
-	basicQuery, err := parseSelectDeleteCommonQuery(query.from_clause, query.where_condition)
+func parseDeleteQuery(query *C.delete_query, params Parameters) (*DeleteQuery, error) {
+	basicQuery, err := parseSelectDeleteCommonQuery(query.from_clause, query.where_condition, params)
 	if err != nil {
 		return nil, err
 	}
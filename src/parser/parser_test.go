@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"encoding/json"
 	"fmt"
 	. "launchpad.net/gocheck"
 	"testing"
@@ -79,8 +80,11 @@ func (self *QueryParserSuite) TestGetQueryString(c *C) {
 		"select value from t where c = '5'",
 		"select value from t where c = '5' limit 1",
 		"select value from t where c = '5' limit 1 order asc",
+		"select value from t where c = '5' limit 1 offset 2 order asc",
 		"select a.value, b.value from foo as a inner join bar as b where c = '5' limit 1 order asc",
 		"select count(value) from t group by time(1h)",
+		"select (bytes_out - bytes_in) / 1024 as delta_kb, -bytes_in from t",
+		"select max(avg_val) from (select mean(value) as avg_val from cpu group by time(1m) where time > now() - 1h)",
 		"select count(value) from t group by time(1h) into value.hourly",
 		"select count(value), host from t group by time(1h), host into value.hourly.[:host]",
 		"select count(value), host from t group by time(1h), host where time > now() - 1h into value.hourly.[:host]",
@@ -150,6 +154,30 @@ func (self *QueryParserSuite) TestParseDropSeries(c *C) {
 	q := _q.DropSeriesQuery
 
 	c.Assert(q.GetTableName(), Equals, "foobar")
+	_, ok := q.GetRegex()
+	c.Assert(ok, Equals, false)
+	c.Assert(q.Explain, Equals, false)
+}
+
+func (self *QueryParserSuite) TestParseDropSeriesWithRegex(c *C) {
+	queries, err := ParseQuery("explain drop series /^temp_/")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	q := queries[0].DropSeriesQuery
+	c.Assert(q, NotNil)
+	c.Assert(q.Explain, Equals, true)
+	regex, ok := q.GetRegex()
+	c.Assert(ok, Equals, true)
+	c.Assert(regex.MatchString("temp_1"), Equals, true)
+	c.Assert(regex.MatchString("cpu"), Equals, false)
+
+	queries, err = ParseQuery("drop series /^temp_/i")
+	c.Assert(err, IsNil)
+	q = queries[0].DropSeriesQuery
+	c.Assert(q.Explain, Equals, false)
+	regex, ok = q.GetRegex()
+	c.Assert(ok, Equals, true)
+	c.Assert(regex.MatchString("TEMP_1"), Equals, true)
 }
 
 func (self *QueryParserSuite) TestGetQueryStringForContinuousQuery(c *C) {
@@ -238,6 +266,23 @@ func (self *QueryParserSuite) TestParseFromWithMergedTable(c *C) {
 	c.Assert(fromClause.Names[1].Name.Name, Equals, "user.signups")
 }
 
+func (self *QueryParserSuite) TestParseFromWithQualifiedTable(c *C) {
+	q, err := ParseSelectQuery(`select * from "metrics".."cpu.load" merge cpu;`)
+	c.Assert(err, IsNil)
+	fromClause := q.GetFromClause()
+	c.Assert(fromClause.Type, Equals, FromClauseMerge)
+	c.Assert(fromClause.Names, HasLen, 2)
+	c.Assert(fromClause.Names[0].Database, Equals, "metrics")
+	c.Assert(fromClause.Names[0].Name.Name, Equals, "cpu.load")
+	c.Assert(fromClause.Names[1].Database, Equals, "")
+	c.Assert(fromClause.GetOtherDatabases("db1"), DeepEquals, []string{"metrics"})
+	c.Assert(fromClause.GetOtherDatabases("metrics"), HasLen, 0)
+
+	q, err = ParseSelectQuery(fromClause.GetString())
+	c.Assert(err, IsNil)
+	c.Assert(q.GetFromClause().Names[0].Database, Equals, "metrics")
+}
+
 func (self *QueryParserSuite) TestMultipleAggregateFunctions(c *C) {
 	q, err := ParseSelectQuery("select first(bar), last(bar) from foo")
 	c.Assert(err, IsNil)
@@ -263,6 +308,79 @@ func (self *QueryParserSuite) TestParseListSeries(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(queries, HasLen, 1)
 	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].ListQuery.Regex, IsNil)
+	c.Assert(queries[0].ListQuery.Limit, Equals, 0)
+}
+
+func (self *QueryParserSuite) TestParseListSeriesWithRegexAndLimit(c *C) {
+	queries, err := ParseQuery("list series /^cpu\\./i limit 10 offset 20")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	listQuery := queries[0].ListQuery
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, true)
+	c.Assert(listQuery.Limit, Equals, 10)
+	c.Assert(listQuery.Offset, Equals, 20)
+	c.Assert(listQuery.Matches("CPU.idle"), Equals, true)
+	c.Assert(listQuery.Matches("mem.free"), Equals, false)
+	c.Assert(queries[0].GetQueryString(), Equals, "list series /^cpu\\./i limit 10 offset 20")
+
+	queries, err = ParseQuery("list series limit 5")
+	c.Assert(err, IsNil)
+	c.Assert(queries[0].ListQuery.Limit, Equals, 5)
+	c.Assert(queries[0].ListQuery.Matches("anything"), Equals, true)
+}
+
+func (self *QueryParserSuite) TestParseListSeriesByLastWrite(c *C) {
+	queries, err := ParseQuery("list series /^cpu/ where last_write < now() - 1h limit 10")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	listQuery := queries[0].ListQuery
+	c.Assert(listQuery.HasLastWriteCondition(), Equals, true)
+	c.Assert(listQuery.Limit, Equals, 10)
+	c.Assert(listQuery.MatchesLastWrite(time.Now().Add(-2*time.Hour)), Equals, true)
+	c.Assert(listQuery.MatchesLastWrite(time.Now().Add(-time.Minute)), Equals, false)
+
+	queries, err = ParseQuery("list series where 1400000000s <= last_write and last_write < 1400003600s")
+	c.Assert(err, IsNil)
+	listQuery = queries[0].ListQuery
+	c.Assert(listQuery.MatchesLastWrite(time.Unix(1400000000, 0)), Equals, true)
+	c.Assert(listQuery.MatchesLastWrite(time.Unix(1400003600, 0)), Equals, false)
+	c.Assert(listQuery.MatchesLastWrite(time.Unix(1399999999, 0)), Equals, false)
+	c.Assert(queries[0].GetQueryString(), Equals, "list series where last_write > 1399999999999999u and last_write < 1400003600000000u")
+
+	queries, err = ParseQuery("list series")
+	c.Assert(err, IsNil)
+	c.Assert(queries[0].ListQuery.HasLastWriteCondition(), Equals, false)
+
+	for _, query := range []string{
+		"list series where host = 'a'",
+		"list series where last_write = now()",
+		"list series where last_write < now() - 1h or last_write > now()",
+	} {
+		_, err := ParseQuery(query)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (self *QueryParserSuite) TestParseListFields(c *C) {
+	queries, err := ParseQuery("list fields from cpu.idle")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListFieldsQuery(), Equals, true)
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, false)
+	listQuery := queries[0].ListQuery
+	c.Assert(listQuery.Series, Equals, "cpu.idle")
+	c.Assert(listQuery.Matches("cpu.idle"), Equals, true)
+	c.Assert(listQuery.Matches("cpu.idle.2"), Equals, false)
+	c.Assert(queries[0].GetQueryString(), Equals, "list fields from cpu.idle")
+
+	queries, err = ParseQuery("list fields from /^cpu\\./")
+	c.Assert(err, IsNil)
+	listQuery = queries[0].ListQuery
+	c.Assert(listQuery.Series, Equals, "")
+	c.Assert(listQuery.Matches("cpu.idle"), Equals, true)
+	c.Assert(listQuery.Matches("mem.free"), Equals, false)
+	c.Assert(queries[0].GetQueryString(), Equals, "list fields from /^cpu\\./")
 }
 
 // issue #267
@@ -486,6 +604,72 @@ func (self *QueryParserSuite) TestParseSelectWithTimeString(c *C) {
 	c.Assert(milliseconds, Equals, int64(232))
 }
 
+func (self *QueryParserSuite) TestParseSelectWithZoneOffsetTimeString(c *C) {
+	for actual, expected := range map[string]string{
+		"2013-08-15 15:14:26Z":      "2013-08-15 15:14:26",
+		"2013-08-15T15:14:26Z":      "2013-08-15 15:14:26",
+		"2013-08-15 15:14:26-05:00": "2013-08-15 20:14:26",
+		"2013-08-15 15:14 +0530":    "2013-08-15 09:44:00",
+		"2013-08-15T01+02":          "2013-08-14 23:00:00",
+	} {
+		t, err := time.Parse("2006-01-02 15:04:05", expected)
+		c.Assert(err, IsNil)
+		q, err := ParseSelectQuery(fmt.Sprintf("select value from t where time > '%s';", actual))
+		c.Assert(err, IsNil)
+		c.Assert(q.GetStartTime(), Equals, t, Commentf("time: %s", actual))
+	}
+
+	_, err := ParseSelectQuery("select value from t where time > '2013-08-15 15:14:26+25:00';")
+	c.Assert(err, NotNil)
+}
+
+func (self *QueryParserSuite) TestParseSelectWithCalendarInterval(c *C) {
+	for interval, expected := range map[string]*CalendarInterval{
+		"1w":   &CalendarInterval{CalendarWeeks, 1},
+		"3mo":  &CalendarInterval{CalendarMonths, 3},
+		"1y":   &CalendarInterval{CalendarYears, 1},
+		"30d":  nil,
+		"1.5w": nil,
+		"5m":   nil,
+	} {
+		q, err := ParseSelectQuery(fmt.Sprintf("select count(value) from t group by time(%s);", interval))
+		c.Assert(err, IsNil)
+		c.Assert(q.GetGroupByClause().GetGroupByCalendarInterval(), DeepEquals, expected, Commentf("interval: %s", interval))
+		duration, err := q.GetGroupByClause().GetGroupByTime()
+		c.Assert(err, IsNil)
+		c.Assert(duration, NotNil)
+	}
+
+	// the months are about 30 days long for the code that doesn't use the
+	// calendar
+	q, err := ParseSelectQuery("select count(value) from t group by time(1mo);")
+	c.Assert(err, IsNil)
+	duration, err := q.GetGroupByClause().GetGroupByTime()
+	c.Assert(err, IsNil)
+	c.Assert(*duration, Equals, 30*24*time.Hour)
+	c.Assert(q.GetQueryString(), Equals, "select count(value) from t group by time(1mo)")
+}
+
+func (self *QueryParserSuite) TestParseSelectWithTimeZone(c *C) {
+	q, err := ParseSelectQuery("select count(value) from t group by time(1d) where time > now() - 7d tz('America/New_York');")
+	c.Assert(err, IsNil)
+	c.Assert(q.Location, NotNil)
+	c.Assert(q.Location.String(), Equals, "America/New_York")
+	c.Assert(q.GetQueryString(), Matches, ".* tz\\('America/New_York'\\)$")
+
+	// the query string has to parse to the same query on the other servers
+	q, err = ParseSelectQuery(q.GetQueryString())
+	c.Assert(err, IsNil)
+	c.Assert(q.Location.String(), Equals, "America/New_York")
+
+	q, err = ParseSelectQuery("select count(value) from t group by time(1d);")
+	c.Assert(err, IsNil)
+	c.Assert(q.Location, IsNil)
+
+	_, err = ParseSelectQuery("select count(value) from t group by time(1d) tz('Nowhere/Atlantis');")
+	c.Assert(err, NotNil)
+}
+
 func (self *QueryParserSuite) TestParseSelectWithAnd(c *C) {
 	q, err := ParseSelectQuery("select value from cpu.idle where value > exp() * 2 and value < exp() * 3;")
 	c.Assert(err, IsNil)
@@ -654,6 +838,25 @@ func (self *QueryParserSuite) TestParseSelectWithOrderByAndLimit(c *C) {
 	c.Assert(q.Ascending, Equals, false)
 }
 
+func (self *QueryParserSuite) TestParseSelectWithLimitAndOffset(c *C) {
+	q, err := ParseSelectQuery("select value from t limit 10 offset 5 order asc;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Limit, Equals, 10)
+	c.Assert(q.Offset, Equals, 5)
+	c.Assert(q.Ascending, Equals, true)
+
+	q, err = ParseSelectQuery("select value from t order desc limit 10 offset 5;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Offset, Equals, 5)
+
+	q, err = ParseSelectQuery("select value from t limit 10;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Offset, Equals, 0)
+
+	_, err = ParseSelectQuery("select value from t offset 5;")
+	c.Assert(err, NotNil)
+}
+
 func (self *QueryParserSuite) TestParseFromWithNestedFunctions2(c *C) {
 	q, err := ParseSelectQuery("select count(distinct(email)) from user.events where time>now()-1d group by time(15m);")
 	c.Assert(err, IsNil)
@@ -724,6 +927,33 @@ func (self *QueryParserSuite) TestQueryWithArithmeticColumns(c *C) {
 	c.Assert(q.ColumnNames[0].Elems[1].Name, Equals, "value")
 }
 
+func (self *QueryParserSuite) TestQueryWithAliasedArithmeticColumns(c *C) {
+	q, err := ParseSelectQuery("select (bytes_out - bytes_in) / 1024 as delta_kb, -bytes_in, -(a * 2) from net")
+	c.Assert(err, IsNil)
+	c.Assert(q.ColumnNames, HasLen, 3)
+
+	// (bytes_out - bytes_in) / 1024
+	delta := q.ColumnNames[0]
+	c.Assert(delta.Alias, Equals, "delta_kb")
+	c.Assert(delta.Name, Equals, "/")
+	c.Assert(delta.Elems[0].Name, Equals, "-")
+	c.Assert(delta.Elems[0].Elems[0].Name, Equals, "bytes_out")
+	c.Assert(delta.Elems[0].Elems[1].Name, Equals, "bytes_in")
+	c.Assert(delta.Elems[1].Name, Equals, "1024")
+
+	// the unary minus is an expression with one operand
+	negated := q.ColumnNames[1]
+	c.Assert(int(negated.Type), Equals, ValueExpression)
+	c.Assert(negated.Name, Equals, "-")
+	c.Assert(negated.Elems, HasLen, 1)
+	c.Assert(negated.Elems[0].Name, Equals, "bytes_in")
+
+	negated = q.ColumnNames[2]
+	c.Assert(negated.Elems, HasLen, 1)
+	c.Assert(negated.Elems[0].Name, Equals, "*")
+	c.Assert(negated.GetString(), Equals, "-(a * 2)")
+}
+
 func (self *QueryParserSuite) TestParseSelectWithComplexArithmeticOperations(c *C) {
 	q, err := ParseSelectQuery("select value from cpu.idle where .30 < value * 1 / 3 ;")
 	c.Assert(err, IsNil)
@@ -826,6 +1056,19 @@ func (self *QueryParserSuite) TestParseContinuousQueryCreation(c *C) {
 	c.Assert(clause.Target, DeepEquals, &Value{"bar", "", ValueSimpleName, nil, nil, false})
 }
 
+func (self *QueryParserSuite) TestParseSelectIntoQuery(c *C) {
+	q, err := ParseSelectQuery("select mean(value) from cpu group by time(5m) where time > now() - 7d into cpu_5m;")
+	c.Assert(err, IsNil)
+	c.Assert(q.IsContinuousQuery(), Equals, false)
+	c.Assert(q.IsSelectIntoQuery(), Equals, true)
+	c.Assert(q.GetIntoClause().Target.Name, Equals, "cpu_5m")
+
+	q, err = ParseSelectQuery("select mean(value) from cpu group by time(5m) into cpu_5m;")
+	c.Assert(err, IsNil)
+	c.Assert(q.IsContinuousQuery(), Equals, true)
+	c.Assert(q.IsSelectIntoQuery(), Equals, false)
+}
+
 func (self *QueryParserSuite) TestParseRecursiveContinuousQueries(c *C) {
 	query := `select * from /^stats\\..*/ into bar;`
 	q, err := ParseSelectQuery(query)
@@ -910,6 +1153,50 @@ func (self *QueryParserSuite) TestParseContinuousQueryList(c *C) {
 	c.Assert(queries[0].IsListContinuousQueriesQuery(), Equals, true)
 }
 
+func (self *QueryParserSuite) TestParseShowStats(c *C) {
+	queries, err := ParseQuery("show stats")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].IsShowStatsQuery(), Equals, true)
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, false)
+}
+
+func (self *QueryParserSuite) TestParseShowAndKillQueries(c *C) {
+	queries, err := ParseQuery("show queries")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsShowQueriesQuery(), Equals, true)
+	c.Assert(queries[0].IsShowStatsQuery(), Equals, false)
+
+	queries, err = ParseQuery("show slow queries")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsShowSlowQueriesQuery(), Equals, true)
+	c.Assert(queries[0].IsShowQueriesQuery(), Equals, false)
+
+	queries, err = ParseQuery("show disk usage")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsShowDiskUsageQuery(), Equals, true)
+	c.Assert(queries[0].GetQueryString(), Equals, "show disk usage")
+
+	queries, err = ParseQuery("show cardinality")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsShowCardinalityQuery(), Equals, true)
+	c.Assert(queries[0].GetQueryString(), Equals, "show cardinality")
+
+	queries, err = ParseQuery("kill query 12")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].KillQuery, NotNil)
+	c.Assert(queries[0].KillQuery.Id, Equals, 12)
+
+	_, err = ParseQuery("kill query")
+	c.Assert(err, NotNil)
+}
+
 // For issue #466 - allow all characters in column names - https://github.com/influxdb/influxdb/issues/267
 func (self *QueryParserSuite) TestParseColumnWithPeriodOrDash(c *C) {
 	query := "select count(\"column-a.foo\") as \"count-column-a.foo\" from seriesA;"
@@ -960,3 +1247,87 @@ func (self *QueryParserSuite) TestQueryParenthesesValueShouldSupportAliases(c *C
 // TODO:
 // insert into user.events.count.per_day select count(*) from user.events where time<forever group by time(1d)
 // insert into :series_name.percentiles.95 select percentile(95,value) from stats.* where time<forever group by time(1d)
+
+func (self *QueryParserSuite) TestParseFillValues(c *C) {
+	for query, previous := range map[string]bool{
+		"select sum(value) from t group by time(1m) fill(null);":     false,
+		"select sum(value) from t group by time(1m) fill(previous);": true,
+		"select sum(value) from t group by time(1m) fill(-1.5);":     false,
+	} {
+		q, err := ParseSelectQuery(query)
+		c.Assert(err, IsNil)
+		c.Assert(q.GetGroupByClause().FillWithZero, Equals, true)
+		c.Assert(q.GetGroupByClause().FillWithPrevious(), Equals, previous)
+	}
+
+	_, err := ParseSelectQuery("select sum(value) from t group by time(1m) fill(foo);")
+	c.Assert(err, NotNil)
+}
+
+func (self *QueryParserSuite) TestParseSubQuery(c *C) {
+	q, err := ParseSelectQuery("select max(avg_val) from (select mean(value) as avg_val from cpu group by time(1m)) where avg_val > 10;")
+	c.Assert(err, IsNil)
+	fromClause := q.GetFromClause()
+	c.Assert(fromClause.Type, Equals, FromClauseSubQuery)
+	c.Assert(fromClause.Names, HasLen, 0)
+	c.Assert(q.GetWhereCondition(), NotNil)
+
+	inner := fromClause.SubQuery
+	c.Assert(inner.GetFromClause().Names[0].Name.Name, Equals, "cpu")
+	c.Assert(inner.GetColumnNames()[0].Alias, Equals, "avg_val")
+	c.Assert(inner.GetGroupByClause().Elems, HasLen, 1)
+
+	_, err = ParseSelectQuery("select * from (select * from cpu into foo);")
+	c.Assert(err, NotNil)
+}
+
+func (self *QueryParserSuite) TestParseQueryWithParameters(c *C) {
+	params := Parameters{"host": "server' or 1=1", "limit": json.Number("10"), "start": json.Number("1399590700"), "ratio": 0.5}
+	_, err := ParseQueryWithParameters("select * from cpu where host = $host;", params)
+	c.Assert(err, NotNil)
+
+	params["host"] = "server1"
+	queries, err := ParseQueryWithParameters("select percentile(value, $limit) from cpu where host = $host and value > $ratio and time > $start;", params)
+	c.Assert(err, IsNil)
+	q := queries[0].SelectQuery
+	c.Assert(q.GetColumnNames()[0].Elems[1], DeepEquals, &Value{"10", "", ValueInt, nil, nil, false})
+	c.Assert(q.GetStartTime().Unix(), Equals, int64(1399590700))
+	left, _ := q.GetWhereCondition().GetLeftWhereCondition()
+	expr, _ := left.GetBoolExpression()
+	c.Assert(expr.Elems[1], DeepEquals, &Value{"server1", "", ValueString, nil, nil, false})
+	expr, _ = q.GetWhereCondition().Right.GetBoolExpression()
+	c.Assert(expr.Elems[1], DeepEquals, &Value{"0.5", "", ValueFloat, nil, nil, false})
+
+	// a string parameter stays a string, even if it looks like a number
+	queries, err = ParseQueryWithParameters("select * from cpu where host = $host;", Parameters{"host": "1"})
+	c.Assert(err, IsNil)
+	expr, _ = queries[0].SelectQuery.GetWhereCondition().GetBoolExpression()
+	c.Assert(expr.Elems[1].Type, Equals, ValueString)
+	c.Assert(queries[0].SelectQuery.GetQueryString(), Equals, "select * from cpu where host = '1'")
+
+	_, err = ParseQueryWithParameters("select * from cpu where host = $unbound;", params)
+	c.Assert(err, NotNil)
+	_, err = ParseQuery("select * from cpu where host = $host;")
+	c.Assert(err, NotNil)
+}
+
+func (self *QueryParserSuite) TestParseMergeAndJoinOfRegex(c *C) {
+	for query, fromType := range map[string]FromClauseType{
+		"select * from merge(/^cpu\\.\\d+$/);": FromClauseMerge,
+		"select * from join(/^cpu\\.\\d+$/);":  FromClauseInnerJoin,
+	} {
+		q, err := ParseSelectQuery(query)
+		c.Assert(err, IsNil)
+		fromClause := q.GetFromClause()
+		c.Assert(fromClause.Type, Equals, fromType)
+		c.Assert(fromClause.Regex, NotNil)
+		regex, ok := fromClause.Regex.GetCompiledRegex()
+		c.Assert(ok, Equals, true)
+		c.Assert(regex.MatchString("cpu.1"), Equals, true)
+		c.Assert(regex.MatchString("cpu.idle"), Equals, false)
+
+		expanded := fromClause.WithTableNames([]string{"cpu.1", "cpu.2", "cpu.3"})
+		c.Assert(expanded.GetTableNames(), DeepEquals, []string{"cpu.1", "cpu.2", "cpu.3"})
+		c.Assert(expanded.GetString(), Equals, fromClause.GetString())
+	}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"common"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
@@ -205,15 +206,22 @@ func (self *BasicQuery) GetEndTime() time.Time {
 	return self.endTime
 }
 
+// Returns true if the query has a condition of the form time >
+// start_time, otherwise its start time is the earliest time
+func (self *BasicQuery) IsStartTimeSpecified() bool {
+	return self.startTime.Unix() > math.MinInt64/1000000000
+}
+
 // parse time that matches the following format:
-//   2006-01-02 [15[:04[:05[.000]]]]
-// notice, hour, minute and seconds are optional
+//   2006-01-02 [15[:04[:05[.000]]][Z|+07[:00]]]
+// notice, hour, minute and seconds are optional. The date and the time
+// can be separated by a T too. The times without a zone offset are UTC.
 var time_regex *regexp.Regexp
 
 func init() {
 	var err error
 	time_regex, err = regexp.Compile(
-		"^([0-9]{4}|[0-9]{2})-[0-9]{1,2}-[0-9]{1,2}( [0-9]{1,2}(:[0-9]{1,2}(:[0-9]{1,2}?(\\.[0-9]+)?)?)?)?$")
+		"^([0-9]{4}|[0-9]{2})-[0-9]{1,2}-[0-9]{1,2}([ T][0-9]{1,2}(:[0-9]{1,2}(:[0-9]{1,2}?(\\.[0-9]+)?)?)?( ?(Z|[+-][0-9]{2}(:?[0-9]{2})?))?)?$")
 	if err != nil {
 		panic(err)
 	}
@@ -225,6 +233,20 @@ func parseTimeString(t string) (*time.Time, error) {
 		return nil, fmt.Errorf("%s isn't a valid time string", t)
 	}
 
+	if zone := submatches[6]; zone != "" {
+		offset, err := parseZoneOffset(submatches[7])
+		if err != nil {
+			return nil, err
+		}
+		local, err := parseTimeString(strings.Replace(t[:len(t)-len(zone)], "T", " ", 1))
+		if err != nil {
+			return nil, err
+		}
+		utc := local.Add(-offset)
+		return &utc, nil
+	}
+	t = strings.Replace(t, "T", " ", 1)
+
 	if submatches[5] != "" || submatches[4] != "" {
 		t, err := time.Parse("2006-01-02 15:04:05", t)
 		return &t, err
@@ -244,6 +266,32 @@ func parseTimeString(t string) (*time.Time, error) {
 	return &_t, err
 }
 
+// Returns the offset of a zone like Z, +07, -0530 or +05:30
+func parseZoneOffset(zone string) (time.Duration, error) {
+	if zone == "Z" {
+		return 0, nil
+	}
+	digits := strings.Replace(zone[1:], ":", "", 1)
+	hours, err := strconv.Atoi(digits[:2])
+	if err != nil {
+		return 0, err
+	}
+	minutes := 0
+	if len(digits) > 2 {
+		if minutes, err = strconv.Atoi(digits[2:]); err != nil {
+			return 0, err
+		}
+	}
+	if hours > 14 || minutes > 59 {
+		return 0, fmt.Errorf("Invalid zone offset %s", zone)
+	}
+	offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
 func parseTimeWithoutSuffix(value string) (int64, error) {
 	var err error
 	var f float64
@@ -15,8 +15,15 @@ type QuerySpec struct {
 	endTime                     time.Time
 	seriesValuesAndColumns      map[*Value][]string
 	RunAgainstAllServersInShard bool
+	QuorumRead                  bool
+	PartialAggregation          bool
+	TraceId                     string
 	groupByInterval             *time.Duration
 	groupByColumnCount          int
+	// closed when the query is killed or its client went away
+	Cancelled <-chan bool
+	// the span of the coordinator the spans of the shards go under
+	ParentSpanId uint64
 }
 
 func NewQuerySpec(user common.User, database string, query *Query) *QuerySpec {
@@ -45,6 +52,17 @@ func (self *QuerySpec) GetEndTime() time.Time {
 	return time.Now()
 }
 
+// Returns true if the query was killed or its client went away, the
+// shards stop reading points once it is
+func (self *QuerySpec) IsCancelled() bool {
+	select {
+	case <-self.Cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
 func (self *QuerySpec) Database() string {
 	return self.database
 }
@@ -92,8 +110,7 @@ func (self *QuerySpec) SeriesValuesAndColumns() map[*Value][]string {
 		}
 	} else if self.query.DropSeriesQuery != nil {
 		self.seriesValuesAndColumns = make(map[*Value][]string)
-		value := &Value{Name: self.query.DropSeriesQuery.GetTableName()}
-		self.seriesValuesAndColumns[value] = nil
+		self.seriesValuesAndColumns[self.query.DropSeriesQuery.GetTableValue()] = nil
 	}
 	return self.seriesValuesAndColumns
 }
@@ -172,6 +189,18 @@ func (self *QuerySpec) IsListSeriesQuery() bool {
 	return self.query.IsListSeriesQuery()
 }
 
+func (self *QuerySpec) IsListFieldsQuery() bool {
+	return self.query.IsListFieldsQuery()
+}
+
+func (self *QuerySpec) IsShowDiskUsageQuery() bool {
+	return self.query.IsShowDiskUsageQuery()
+}
+
+func (self *QuerySpec) IsShowCardinalityQuery() bool {
+	return self.query.IsShowCardinalityQuery()
+}
+
 func (self *QuerySpec) IsDeleteFromSeriesQuery() bool {
 	return self.query.DeleteQuery != nil
 }
@@ -203,10 +232,31 @@ func (self *QuerySpec) ReadsFromMultipleSeries() bool {
 	return len(self.SeriesValuesAndColumns()) > 1
 }
 
+// Returns true for explain drop series, which doesn't drop anything
+func (self *QuerySpec) IsDropSeriesDryRun() bool {
+	return self.query.DropSeriesQuery != nil && self.query.DropSeriesQuery.Explain
+}
+
 func (self *QuerySpec) IsDestructiveQuery() bool {
-	return self.query.DeleteQuery != nil || self.query.DropQuery != nil || self.query.DropSeriesQuery != nil
+	return self.query.DeleteQuery != nil || self.query.DropQuery != nil || (self.query.DropSeriesQuery != nil && !self.IsDropSeriesDryRun())
 }
 
 func (self *QuerySpec) HasAggregates() bool {
 	return self.SelectQuery() != nil && self.SelectQuery().HasAggregates()
 }
+
+// Returns the number of points of a series that are enough to answer
+// the query, 0 if all the points in the time range are needed. The
+// points are read in the order of the query, so the limit of a query
+// that yields the raw points is also the number of points it needs, plus
+// the points its offset skips.
+func (self *QuerySpec) PointLimit() int {
+	query := self.SelectQuery().WithoutOffset()
+	if query.Limit <= 0 || query.HasAggregates() || query.GetWhereCondition() != nil {
+		return 0
+	}
+	if query.GetFromClause().Type == FromClauseInnerJoin {
+		return 0
+	}
+	return query.Limit
+}
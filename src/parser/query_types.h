@@ -31,7 +31,8 @@ typedef struct value_t {
     VALUE_DURATION,
     VALUE_WILDCARD,
     VALUE_FUNCTION_CALL,
-    VALUE_EXPRESSION
+    VALUE_EXPRESSION,
+    VALUE_PARAMETER
   } value_type;
   char *alias;
   char is_case_insensitive;
@@ -61,6 +62,9 @@ typedef struct {
 typedef struct {
   value *name;
   char *alias;
+  // the database of a qualified name, e.g. "metrics".."cpu.load", NULL
+  // for the series of the database of the query
+  char *database;
 } table_name;
 
 typedef struct {
@@ -68,31 +72,40 @@ typedef struct {
   table_name **elems;
 } table_name_array;
 
+typedef struct select_query select_query;
+
 typedef struct {
   enum {
     FROM_ARRAY,
     FROM_MERGE,
-    FROM_INNER_JOIN
+    FROM_INNER_JOIN,
+    FROM_SUBQUERY
   } from_clause_type;
   // in case of merge or join, it's guaranteed that the names array
-  // will have two table names only and they aren't regex.
+  // will have two table names only and they aren't regex, or a single
+  // regex for a merge or join of the series matching it.
   table_name_array *names;
+  // the inner query of a select from a subquery, the names array is
+  // empty then
+  select_query *subquery;
 } from_clause;
 
 typedef struct {
   value *target;
 } into_clause;
 
-typedef struct {
+struct select_query {
   value_array *c;
   from_clause *from_clause;
   groupby_clause *group_by;
   into_clause *into_clause;
   condition *where_condition;
   int limit;
+  int offset;
   char ascending;
   char explain;
-} select_query;
+  char *time_zone; // the name of the zone of the tz clause, NULL without one
+};
 
 typedef struct {
   from_clause *from_clause;
@@ -102,19 +115,42 @@ typedef struct {
 
 typedef struct {
   value *name;
+  char explain;
 } drop_series_query;
 
+typedef struct {
+  value *name; // the regex of the series names, NULL for every series
+  condition *where_condition; // the last_write condition, NULL without one
+  int limit;
+  int offset;
+} list_series_query;
+
+typedef struct {
+  value *name; // the series or the regex of the series
+} list_fields_query;
+
 typedef struct {
   int id;
 } drop_query;
 
+typedef struct {
+  int id;
+} kill_query;
+
 typedef struct {
   select_query *select_query;
   delete_query *delete_query;
   drop_series_query *drop_series_query;
   drop_query *drop_query;
-  char list_series_query;
+  kill_query *kill_query;
+  list_series_query *list_series_query;
+  list_fields_query *list_fields_query;
   char list_continuous_queries_query;
+  char show_stats_query;
+  char show_queries_query;
+  char show_slow_queries_query;
+  char show_disk_usage_query;
+  char show_cardinality_query;
   error *error;
 } query;
 
@@ -124,6 +160,7 @@ void free_value_array(value_array *array);
 void free_value(value *value);
 void free_condition(condition *condition);
 void free_error (error *error);
+void free_select_query (select_query *q);
 
 // this is the api that is used in GO
 query parse_query(char *const query_s);
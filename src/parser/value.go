@@ -25,6 +25,7 @@ const (
 	ValueWildcard               = C.VALUE_WILDCARD
 	ValueFunctionCall           = C.VALUE_FUNCTION_CALL
 	ValueExpression             = C.VALUE_EXPRESSION
+	ValueParameter              = C.VALUE_PARAMETER
 )
 
 type Value struct {
@@ -48,11 +49,17 @@ func (self *Value) GetString() string {
 	buffer := bytes.NewBufferString("")
 	switch self.Type {
 	case ValueExpression:
-		fmt.Fprintf(buffer, "%s %s %s", self.Elems[0].GetString(), self.Name, self.Elems[1].GetString())
+		if len(self.Elems) == 1 {
+			fmt.Fprintf(buffer, "%s%s", self.Name, self.Elems[0].getOperandString())
+			break
+		}
+		fmt.Fprintf(buffer, "%s %s %s", self.Elems[0].getOperandString(), self.Name, self.Elems[1].getOperandString())
 	case ValueFunctionCall:
 		fmt.Fprintf(buffer, "%s(%s)", self.Name, Values(self.Elems).GetString())
 	case ValueString:
 		fmt.Fprintf(buffer, "'%s'", self.Name)
+	case ValueParameter:
+		fmt.Fprintf(buffer, "$%s", self.Name)
 	case ValueRegex:
 		fmt.Fprintf(buffer, "/%s/", self.Name)
 		if self.IsInsensitive {
@@ -68,3 +75,12 @@ func (self *Value) GetString() string {
 
 	return buffer.String()
 }
+
+// nested expressions are wrapped in parenthesis to keep the precedence
+// of the query when it's parsed again
+func (self *Value) getOperandString() string {
+	if self.Type == ValueExpression {
+		return "(" + self.GetString() + ")"
+	}
+	return self.GetString()
+}
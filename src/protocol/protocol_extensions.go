@@ -5,15 +5,28 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"time"
 
 	"math"
 
 	"code.google.com/p/goprotobuf/proto"
 )
 
+// Bumped when the messages change in a way that servers running an older
+// version can't handle
+const PROTOCOL_VERSION = 2
+
+// The first version that can compute the partial aggregates of a query
+const PARTIAL_AGGREGATION_PROTOCOL_VERSION = 2
+
+// The timestamps of the points are in microseconds since the epoch, the
+// apis convert the timestamps of their clients from and to it
+const TIMESTAMP_PRECISION = time.Microsecond
+
 var String = proto.String
 var Float64 = proto.Float64
 var Int64 = proto.Int64
+var Uint32 = proto.Uint32
 
 func DecodePoint(buff *bytes.Buffer) (point *Point, err error) {
 	point = &Point{}
@@ -60,6 +73,22 @@ func (self *FieldValue) GetValue() (interface{}, bool) {
 	return nil, true
 }
 
+// Returns the name of the type of the value, string, double, int64 or
+// bool, an empty string for a null value
+func (self *FieldValue) GetTypeName() string {
+	switch {
+	case self.StringValue != nil:
+		return "string"
+	case self.DoubleValue != nil:
+		return "double"
+	case self.Int64Value != nil:
+		return "int64"
+	case self.BoolValue != nil:
+		return "bool"
+	}
+	return ""
+}
+
 func (self *Point) GetFieldValue(idx int) interface{} {
 	v := self.Values[idx]
 	// issue #27
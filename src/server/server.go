@@ -2,13 +2,18 @@ package server
 
 import (
 	"admin"
+	"api/collectd"
 	"api/graphite"
 	"api/http"
+	"api/opentsdb"
 	"api/udp"
 	"cluster"
 	"configuration"
 	"coordinator"
 	"datastore"
+	"encoding/json"
+	"fmt"
+	"monitoring"
 	"runtime"
 	"time"
 	"wal"
@@ -23,13 +28,17 @@ type Server struct {
 	ClusterConfig  *cluster.ClusterConfiguration
 	HttpApi        *http.HttpServer
 	GraphiteApi    *graphite.Server
+	CollectdApi    *collectd.Server
+	OpenTsdbApi    *opentsdb.Server
 	UdpApi         *udp.Server
 	UdpServers     []*udp.Server
 	AdminServer    *admin.HttpServer
+	Monitor        *monitoring.Monitor
 	Coordinator    coordinator.Coordinator
 	Config         *configuration.Configuration
 	RequestHandler *coordinator.ProtobufRequestHandler
 	stopped        bool
+	coordinator    *coordinator.CoordinatorImpl
 	writeLog       *wal.WAL
 	shardStore     *datastore.LevelDbShardDatastore
 }
@@ -41,8 +50,14 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 		return nil, err
 	}
 
+	tlsConfig, err := coordinator.NewClusterTlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
 	newClient := func(connectString string) cluster.ServerConnection {
-		return coordinator.NewProtobufClient(connectString, config.ProtobufTimeout.Duration)
+		pool := coordinator.NewProtobufConnectionPool(connectString, config.ProtobufConnections, config.ProtobufTimeout.Duration, config.ProtobufRequestTimeout)
+		pool.EnableTls(tlsConfig)
+		return pool
 	}
 	writeLog, err := wal.NewWAL(config)
 	if err != nil {
@@ -50,19 +65,41 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 	}
 
 	clusterConfig := cluster.NewClusterConfiguration(config, writeLog, shardDb, newClient)
+	shardDb.StartRetentionSweeper(config.RetentionSweepPeriod, clusterConfig.GetDatabaseRetentions)
 	raftServer := coordinator.NewRaftServer(config, clusterConfig)
+	raftServer.EnableTls(tlsConfig)
+	if err := raftServer.SetRollups(config.Rollups); err != nil {
+		return nil, err
+	}
 	clusterConfig.LocalRaftName = raftServer.GetRaftName()
 	clusterConfig.SetShardCreator(raftServer)
 	clusterConfig.CreateFutureShardsAutomaticallyBeforeTimeComes()
 
 	coord := coordinator.NewCoordinatorImpl(config, raftServer, clusterConfig)
+	if err := coord.SetIngestProcessors(config.IngestProcessors); err != nil {
+		return nil, err
+	}
 	requestHandler := coordinator.NewProtobufRequestHandler(coord, clusterConfig)
 	protobufServer := coordinator.NewProtobufServer(config.ProtobufListenString(), requestHandler)
+	protobufServer.EnableTls(tlsConfig)
 
 	raftServer.AssignCoordinator(coord)
 	httpApi := http.NewHttpServer(config.ApiHttpPortString(), config.ApiReadTimeout, config.AdminAssetsDir, coord, coord, clusterConfig, raftServer)
-	httpApi.EnableSsl(config.ApiHttpSslPortString(), config.ApiHttpCertPath)
-	graphiteApi := graphite.NewServer(config, coord, clusterConfig)
+	httpApi.EnableSsl(config.ApiHttpSslPortString(), config.ApiHttpCertPath, config.ApiHttpKeyPath)
+	httpApi.SetMaxWriteBodySize(config.ApiMaxWriteBodySize)
+	graphiteApi, err := graphite.NewServer(config, coord, clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	var collectdApi *collectd.Server
+	if config.CollectdEnabled {
+		// types.db is only read when collectd is enabled
+		collectdApi, err = collectd.NewServer(config, coord, clusterConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	openTsdbApi := opentsdb.NewServer(config, coord, clusterConfig)
 	adminServer := admin.NewHttpServer(config.AdminAssetsDir, config.AdminHttpPortString())
 
 	return &Server{
@@ -71,7 +108,10 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 		ClusterConfig:  clusterConfig,
 		HttpApi:        httpApi,
 		GraphiteApi:    graphiteApi,
+		CollectdApi:    collectdApi,
+		OpenTsdbApi:    openTsdbApi,
 		Coordinator:    coord,
+		coordinator:    coord,
 		AdminServer:    adminServer,
 		Config:         config,
 		RequestHandler: requestHandler,
@@ -79,6 +119,31 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 		shardStore:     shardDb}, nil
 }
 
+// What the server repaired and replayed when it started
+type recoveryReport struct {
+	// the series removed from the indexes of the local shards
+	Repairs []*datastore.SeriesRepair `json:"repairs"`
+	// the requests of the wal replayed to each server, by server id
+	ReplayedRequests map[string]int `json:"replayedRequests"`
+}
+
+// Logs the report as json, every repair is also logged on its own line
+func logRecoveryReport(repairs []*datastore.SeriesRepair, replayed map[uint32]int) {
+	report := &recoveryReport{Repairs: repairs, ReplayedRequests: map[string]int{}}
+	for serverId, count := range replayed {
+		report.ReplayedRequests[fmt.Sprint(serverId)] = count
+	}
+	for _, r := range repairs {
+		log.Warn("Removed the series %s of %s from the indexes of shard %d: %s", r.Series, r.Database, r.Shard, r.Problem)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Error("Cannot encode the recovery report: %s", err)
+		return
+	}
+	log.Info("Recovery report: %s", data)
+}
+
 func (self *Server) ListenAndServe() error {
 	err := self.RaftServer.ListenAndServe()
 	if err != nil {
@@ -115,19 +180,38 @@ func (self *Server) ListenAndServe() error {
 		log.Info("Connection string changed successfully")
 	}
 
+	if self.ClusterConfig.LocalServer.FailureDomain != self.Config.FailureDomain {
+		log.Info("Changing the failure domain of the server from '%s' to '%s'", self.ClusterConfig.LocalServer.FailureDomain, self.Config.FailureDomain)
+		if err := self.RaftServer.SetFailureDomain(self.ClusterConfig.LocalServer.Id, self.Config.FailureDomain); err != nil {
+			log.Error("Cannot change the failure domain of the server: %s", err)
+		}
+	}
+
+	// the shards are checked before the other servers and the wal can
+	// write to them
+	log.Info("Checking the indexes of the shards...")
+	repairs, err := self.shardStore.Reconcile()
+	if err != nil {
+		return err
+	}
+
 	go self.ProtobufServer.ListenAndServe()
 
 	log.Info("Recovering from log...")
-	err = self.ClusterConfig.RecoverFromWAL()
+	replayed, err := self.ClusterConfig.RecoverFromWAL()
 	if err != nil {
 		return err
 	}
 	log.Info("recovered")
+	logRecoveryReport(repairs, replayed)
+	self.ClusterConfig.PeriodicallyRepairShards()
+	self.ClusterConfig.PeriodicallySweepOrphanedShards()
 
 	err = self.Coordinator.(*coordinator.CoordinatorImpl).ConnectToProtobufServers(self.RaftServer.GetRaftName())
 	if err != nil {
 		return err
 	}
+	self.Coordinator.(*coordinator.CoordinatorImpl).StartReplication()
 	log.Info("Starting admin interface on port %d", self.Config.AdminHttpPort)
 	go self.AdminServer.ListenAndServe()
 	if self.Config.GraphiteEnabled {
@@ -139,6 +223,24 @@ func (self *Server) ListenAndServe() error {
 		}
 	}
 
+	if self.CollectdApi != nil {
+		if self.Config.CollectdPort <= 0 || self.Config.CollectdDatabase == "" {
+			log.Warn("Cannot start collectd server. please check your configuration")
+		} else {
+			log.Info("Starting Collectd Listener on port %d", self.Config.CollectdPort)
+			go self.CollectdApi.ListenAndServe()
+		}
+	}
+
+	if self.Config.OpenTsdbEnabled {
+		if self.Config.OpenTsdbPort <= 0 || self.Config.OpenTsdbDatabase == "" {
+			log.Warn("Cannot start opentsdb server. please check your configuration")
+		} else {
+			log.Info("Starting OpenTSDB Listener on port %d", self.Config.OpenTsdbPort)
+			go self.OpenTsdbApi.ListenAndServe()
+		}
+	}
+
 	// UDP input
 	for _, udpInput := range self.Config.UdpServers {
 		port := udpInput.Port
@@ -153,7 +255,7 @@ func (self *Server) ListenAndServe() error {
 
 		addr := self.Config.UdpInputPortString(port)
 
-		server := udp.NewServer(addr, database, self.Coordinator, self.ClusterConfig)
+		server := udp.NewServer(addr, database, udpInput.BatchSize, udpInput.BatchTimeout.Duration, self.Coordinator, self.ClusterConfig)
 		self.UdpServers = append(self.UdpServers, server)
 		go server.ListenAndServe()
 	}
@@ -163,6 +265,15 @@ func (self *Server) ListenAndServe() error {
 		go self.startReportingLoop()
 	}
 
+	if self.Config.MonitoringEnabled {
+		log.Info("Writing the metrics to %s every %s", self.Config.MonitoringDatabase, self.Config.MonitoringInterval)
+		self.Monitor = monitoring.NewMonitor(self.Config, self.Coordinator, self.ClusterConfig)
+		if err := self.Monitor.Start(); err != nil {
+			log.Error("Cannot start writing the metrics to %s: %s", self.Config.MonitoringDatabase, err)
+			self.Monitor = nil
+		}
+	}
+
 	// start processing continuous queries
 	self.RaftServer.StartProcessingContinuousQueries()
 
@@ -209,6 +320,12 @@ func (self *Server) reportStats() {
 	}
 }
 
+// Reloads the config file, the errors and the settings that need a
+// restart are logged
+func (self *Server) Reload() {
+	self.coordinator.ReloadConfigurationFile()
+}
+
 func (self *Server) Stop() {
 	if self.stopped {
 		return
@@ -220,10 +337,36 @@ func (self *Server) Stop() {
 	self.HttpApi.Close()
 	log.Info("Api server stopped")
 
+	if self.CollectdApi != nil {
+		log.Info("Stopping collectd server")
+		self.CollectdApi.Close()
+		log.Info("collectd server stopped")
+	}
+
+	log.Info("Stopping udp servers")
+	for _, server := range self.UdpServers {
+		server.Close()
+	}
+	log.Info("udp servers stopped")
+
+	log.Info("Stopping opentsdb server")
+	self.OpenTsdbApi.Close()
+	log.Info("opentsdb server stopped")
+
+	if self.Monitor != nil {
+		log.Info("Stopping monitor")
+		self.Monitor.Close()
+		log.Info("monitor stopped")
+	}
+
 	log.Info("Stopping admin server")
 	self.AdminServer.Close()
 	log.Info("admin server stopped")
 
+	// the listeners are closed, the requests they already took can finish
+	// before the shards go away
+	self.coordinator.Drain(self.Config.ShutdownTimeout)
+
 	log.Info("Stopping raft server")
 	self.RaftServer.Close()
 	log.Info("Raft server stopped")
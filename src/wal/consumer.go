@@ -0,0 +1,104 @@
+package wal
+
+import (
+	"fmt"
+	"protocol"
+)
+
+// Consumers tail every request logged in the wal, e.g. to feed the
+// writes to another system. Like the servers, a consumer acks the last
+// request it processed and the log files are kept until every consumer
+// acked their requests. The positions of the consumers are saved with
+// the bookmarks, a consumer gets the requests it acked after the last
+// bookmark again if the server crashes.
+
+type consumerAction int
+
+const (
+	subscribeConsumer consumerAction = iota
+	ackConsumer
+	unsubscribeConsumer
+	positionOfConsumer
+)
+
+// Starts the consumer at the given request number, or moves it there if
+// it already exists. A request number of 0 starts a new consumer at the
+// first request in the wal and leaves an existing one where it is.
+func (self *WAL) Subscribe(name string, requestNumber uint32) error {
+	_, err := self.sendConsumerEntry(name, requestNumber, subscribeConsumer)
+	return err
+}
+
+// Marks the requests up to the given request number as processed by the
+// consumer
+func (self *WAL) Ack(name string, requestNumber uint32) error {
+	_, err := self.sendConsumerEntry(name, requestNumber, ackConsumer)
+	return err
+}
+
+// Removes the consumer, the log files it was the last one to need are
+// deleted
+func (self *WAL) Unsubscribe(name string) error {
+	_, err := self.sendConsumerEntry(name, 0, unsubscribeConsumer)
+	return err
+}
+
+// Yields the requests of all the shards after the last request the
+// consumer acked. Returns an error if some of them were deleted because
+// the wal got bigger than its max size.
+func (self *WAL) ReplayToConsumer(name string, yield func(request *protocol.Request, shardId uint32) error) error {
+	lastRequestNumber, err := self.sendConsumerEntry(name, 0, positionOfConsumer)
+	if err != nil {
+		return err
+	}
+	requestNumber := lastRequestNumber + 1
+	if len(self.logFiles) > 0 && requestNumber != self.state.LargestRequestNumber+1 && !self.isInRange(requestNumber) {
+		return fmt.Errorf("The requests of consumer %s starting at %d were deleted from the wal", name, requestNumber)
+	}
+	return self.RecoverServerFromRequestNumber(requestNumber, nil, yield)
+}
+
+func (self *WAL) sendConsumerEntry(name string, requestNumber uint32, action consumerAction) (uint32, error) {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &consumerEntry{confirmationChan, name, requestNumber, action}
+	confirmation := <-confirmationChan
+	return confirmation.requestNumber, confirmation.err
+}
+
+func (self *WAL) processConsumerEntry(e *consumerEntry) {
+	lastRequestNumber, ok := self.state.ConsumerLastRequestNumber[e.name]
+	if !ok && e.action != subscribeConsumer {
+		e.confirmation <- &confirmation{0, fmt.Errorf("Consumer %s doesn't exist", e.name)}
+		return
+	}
+
+	switch e.action {
+	case subscribeConsumer:
+		if ok && e.requestNumber == 0 {
+			break
+		}
+		requestNumber := e.requestNumber
+		if requestNumber == 0 {
+			requestNumber = uint32(self.state.FirstSuffix)
+			if len(self.logFiles) == 0 {
+				requestNumber = self.state.LargestRequestNumber + 1
+			}
+		}
+		lastRequestNumber = requestNumber - 1
+		self.state.ConsumerLastRequestNumber[e.name] = lastRequestNumber
+		logger.Info("Consumer %s starts at request %d", e.name, requestNumber)
+		e.confirmation <- &confirmation{lastRequestNumber, self.bookmark()}
+		return
+	case ackConsumer:
+		lastRequestNumber = e.requestNumber
+		self.state.ConsumerLastRequestNumber[e.name] = lastRequestNumber
+		self.deleteCommittedLogFiles()
+	case unsubscribeConsumer:
+		delete(self.state.ConsumerLastRequestNumber, e.name)
+		logger.Info("Removed consumer %s", e.name)
+		self.deleteCommittedLogFiles()
+		e.confirmation <- &confirmation{0, self.bookmark()}
+		return
+	}
+	e.confirmation <- &confirmation{lastRequestNumber, nil}
+}
@@ -2,6 +2,7 @@ package wal
 
 import (
 	"protocol"
+	"time"
 )
 
 type closeEntry struct {
@@ -20,8 +21,23 @@ type commitEntry struct {
 	requestNumber uint32
 }
 
+// fsyncs the log file if anything was appended since the last fsync
+type flushEntry struct{}
+
+type consumerEntry struct {
+	confirmation  chan *confirmation
+	name          string
+	requestNumber uint32
+	action        consumerAction
+}
+
+type statsEntry struct {
+	stats chan *Stats
+}
+
 type appendEntry struct {
 	confirmation chan *confirmation
 	request      *protocol.Request
 	shardId      uint32
+	enqueued     time.Time
 }
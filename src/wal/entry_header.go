@@ -2,19 +2,40 @@ package wal
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 )
 
+// the high bit of the length is set for the entries that are compressed,
+// entries that were written before compression existed never have it set
+const compressedEntryFlag = 1 << 31
+
+// the next bit is set for the entries whose header ends with the crc32
+// of the request, the entries written before the checksums don't have it
+const checksummedEntryFlag = 1 << 30
+
 type entryHeader struct {
 	requestNumber uint32
 	shardId       uint32
 	length        uint32
+	compressed    bool
+	checksummed   bool
+	checksum      uint32
 }
 
 func (self *entryHeader) Write(w io.Writer) (int, error) {
 	size := 0
 
-	for _, n := range []uint32{self.requestNumber, self.shardId, self.length} {
+	length := self.length
+	if self.compressed {
+		length |= compressedEntryFlag
+	}
+	fields := []uint32{self.requestNumber, self.shardId, length}
+	if self.checksummed {
+		fields[2] |= checksummedEntryFlag
+		fields = append(fields, self.checksum)
+	}
+	for _, n := range fields {
 		if err := binary.Write(w, binary.BigEndian, n); err != nil {
 			return size, err
 		}
@@ -32,5 +53,30 @@ func (self *entryHeader) Read(r io.Reader) (int, error) {
 		}
 		size += 4
 	}
-	return size, nil
+	self.compressed = self.length&compressedEntryFlag != 0
+	self.checksummed = self.length&checksummedEntryFlag != 0
+	self.length &^= compressedEntryFlag | checksummedEntryFlag
+	if !self.checksummed {
+		return size, nil
+	}
+	// the header is torn if the checksum is missing
+	if err := binary.Read(r, binary.BigEndian, &self.checksum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return size, err
+	}
+	return size + 4, nil
+}
+
+// sets the checksum of the request bytes that follow the header
+func (self *entryHeader) setChecksum(bytes []byte) {
+	self.checksummed = true
+	self.checksum = crc32.ChecksumIEEE(bytes)
+}
+
+// returns false if the request bytes don't match the checksum, the
+// entries without a checksum can't be verified
+func (self *entryHeader) verify(bytes []byte) bool {
+	return !self.checksummed || crc32.ChecksumIEEE(bytes) == self.checksum
 }
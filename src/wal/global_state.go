@@ -26,6 +26,9 @@ type GlobalState struct {
 	// committed request number per server
 	ServerLastRequestNumber map[uint32]uint32
 
+	// acked request number per consumer
+	ConsumerLastRequestNumber map[string]uint32
+
 	// path to the state file
 	path string
 }
@@ -33,8 +36,9 @@ type GlobalState struct {
 func newGlobalState(path string) (*GlobalState, error) {
 	f, err := os.Open(path)
 	state := &GlobalState{
-		ServerLastRequestNumber: map[uint32]uint32{},
-		ShardLastSequenceNumber: map[uint32]uint64{},
+		ServerLastRequestNumber:   map[uint32]uint32{},
+		ShardLastSequenceNumber:   map[uint32]uint64{},
+		ConsumerLastRequestNumber: map[string]uint32{},
 		path: path,
 	}
 	if os.IsNotExist(err) {
@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"bytes"
 	"configuration"
 	"fmt"
 	"io"
@@ -12,12 +13,19 @@ import (
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
+	"code.google.com/p/snappy-go/snappy"
 )
 
 type log struct {
-	closed                 bool
-	fileSize               uint64
-	file                   *os.File
+	closed   bool
+	fileSize uint64
+	// the size of the file on disk, it's bigger than fileSize if the
+	// file was preallocated or recycled
+	allocatedSize int64
+	file          *os.File
+	// the requests appended since the last write, they're written to the
+	// file at once
+	pending                bytes.Buffer
 	requestsSinceLastFlush int
 	config                 *configuration.Configuration
 	cachedSuffix           int
@@ -37,11 +45,12 @@ func newLog(file *os.File, config *configuration.Configuration) (*log, error) {
 	}
 
 	l := &log{
-		file:         file,
-		fileSize:     size,
-		closed:       false,
-		config:       config,
-		cachedSuffix: suffix,
+		file:          file,
+		fileSize:      size,
+		allocatedSize: info.Size(),
+		closed:        false,
+		config:        config,
+		cachedSuffix:  suffix,
 	}
 
 	return l, l.check()
@@ -52,6 +61,7 @@ func (self *log) check() error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	info, err := file.Stat()
 	if err != nil {
 		return err
@@ -61,28 +71,85 @@ func (self *log) check() error {
 	if err != nil {
 		return err
 	}
+	previous := uint32(0)
 	for {
 		n, hdr, err := self.getNextHeader(file)
+		if err == io.ErrUnexpectedEOF {
+			return self.truncate(offset, size, "the last header is incomplete")
+		}
 		if err != nil {
 			return err
 		}
-		if n == 0 || hdr.length == 0 {
-			return self.file.Truncate(offset)
+		if n == 0 {
+			return self.truncate(offset, size, "the last header is incomplete")
+		}
+		if self.isPastTheLastRequest(hdr, previous) {
+			// the rest of the file is preallocated or left from before
+			// the file was recycled, it's overwritten by the next requests
+			logger.Debug("The requests of %s end at %d", self.file.Name(), offset)
+			self.fileSize = uint64(offset)
+			return nil
 		}
 		if offset+int64(n)+int64(hdr.length) > size {
 			// file is incomplete, truncate
-			return self.file.Truncate(offset)
+			return self.truncate(offset, size, fmt.Sprintf("request %d is incomplete", hdr.requestNumber))
 		}
-		if err := self.skipRequest(file, hdr); err != nil {
+		if hdr.checksummed {
+			bytes := make([]byte, hdr.length)
+			if _, err := io.ReadFull(file, bytes); err != nil {
+				return err
+			}
+			if !hdr.verify(bytes) {
+				return self.truncate(offset, size, fmt.Sprintf("the checksum of request %d doesn't match", hdr.requestNumber))
+			}
+		} else if err := self.skipRequest(file, hdr); err != nil {
 			return err
 		}
 		offset += int64(n) + int64(hdr.length)
+		previous = hdr.requestNumber
+	}
+}
+
+// Returns true if the header doesn't belong to a request of this file.
+// The requests of a file have increasing request numbers starting at
+// the suffix of the file, they're followed by an empty header or by the
+// end of the file.
+func (self *log) isPastTheLastRequest(hdr *entryHeader, previous uint32) bool {
+	if hdr.length == 0 || hdr.requestNumber < uint32(self.suffix()) {
+		return true
 	}
+	return previous != 0 && hdr.requestNumber <= previous
 }
 
+// Truncates the log file to the end of the last valid request. Whatever
+// follows was torn by a crash or is corrupt and would be replayed as
+// garbage.
+func (self *log) truncate(offset, size int64, reason string) error {
+	if offset < size {
+		logger.Warn("Truncating %s to %d bytes, discarding the last %d bytes because %s", self.file.Name(), offset, size-offset, reason)
+		self.fileSize = uint64(offset)
+		self.allocatedSize = offset
+	}
+	return self.file.Truncate(offset)
+}
+
+// Makes the file at least size bytes big, so the requests don't have
+// to allocate the blocks they're written to
+func (self *log) preallocate(size int64) error {
+	if self.allocatedSize >= size {
+		return nil
+	}
+	if err := preallocate(self.file, size); err != nil {
+		return err
+	}
+	self.allocatedSize = size
+	return nil
+}
+
+// the offset of the end of the last request, including the requests
+// that weren't written yet
 func (self *log) offset() int64 {
-	offset, _ := self.file.Seek(0, os.SEEK_CUR)
-	return offset
+	return int64(self.fileSize)
 }
 
 func (self *log) suffix() int {
@@ -91,11 +158,17 @@ func (self *log) suffix() int {
 
 // this is for testing only
 func (self *log) syncFile() error {
+	if err := self.writePending(); err != nil {
+		return err
+	}
 	return self.file.Sync()
 }
 
 func (self *log) close() error {
 	logger.Debug("Closing %s", self.file.Name())
+	if err := self.writePending(); err != nil {
+		logger.Error("Cannot write the last requests to %s: %s", self.file.Name(), err)
+	}
 	return self.file.Close()
 }
 
@@ -110,28 +183,55 @@ func (self *log) appendRequest(request *protocol.Request, shardId uint32) error
 	if err != nil {
 		return err
 	}
-	// every request is preceded with the length, shard id and the request number
+	if self.config.WalCompress {
+		bytes, err = snappy.Encode(nil, bytes)
+		if err != nil {
+			return err
+		}
+	}
+	// every request is preceded with the length, shard id, the request
+	// number and the checksum of the request
 	hdr := &entryHeader{
 		shardId:       shardId,
 		requestNumber: request.GetRequestNumber(),
 		length:        uint32(len(bytes)),
+		compressed:    self.config.WalCompress,
 	}
-	writtenHdrBytes, err := hdr.Write(self.file)
+	hdr.setChecksum(bytes)
+	hdrBytes, err := hdr.Write(&self.pending)
 	if err != nil {
-		logger.Error("Error while writing header: %s", err)
 		return err
 	}
-	written, err := self.file.Write(bytes)
+	self.pending.Write(bytes)
+	self.fileSize += uint64(hdrBytes + len(bytes))
+	return nil
+}
+
+// writes the requests appended since the last write to the file
+func (self *log) writePending() error {
+	if self.pending.Len() == 0 {
+		return nil
+	}
+	size := self.pending.Len()
+	offset := int64(self.fileSize) - int64(size)
+	if int64(self.fileSize) < self.allocatedSize {
+		// the rest of the file may have old requests if it was recycled
+		(&entryHeader{}).Write(&self.pending)
+	}
+	written, err := self.file.WriteAt(self.pending.Bytes(), offset)
+	self.pending.Reset()
+	if end := offset + int64(written); end > self.allocatedSize {
+		self.allocatedSize = end
+	}
 	if err != nil {
-		logger.Error("Error while writing request: %s", err)
+		logger.Error("Error while writing requests: %s", err)
 		return err
 	}
-	if written < len(bytes) {
-		err = fmt.Errorf("Couldn't write entire request")
-		logger.Error("Error while writing request: %s", err)
+	if written < size {
+		err = fmt.Errorf("Couldn't write entire requests")
+		logger.Error("Error while writing requests: %s", err)
 		return err
 	}
-	self.fileSize += uint64(writtenHdrBytes + written)
 	return nil
 }
 
@@ -197,6 +297,7 @@ func (self *log) skipRequest(file *os.File, hdr *entryHeader) (err error) {
 }
 
 func (self *log) skipToRequest(file *os.File, requestNumber uint32) error {
+	previous := uint32(0)
 	for {
 		n, hdr, err := self.getNextHeader(file)
 		if n == 0 {
@@ -206,10 +307,11 @@ func (self *log) skipToRequest(file *os.File, requestNumber uint32) error {
 		if err != nil {
 			return err
 		}
-		if hdr.requestNumber < requestNumber {
+		if hdr.requestNumber < requestNumber && !self.isPastTheLastRequest(hdr, previous) {
 			if err := self.skipRequest(file, hdr); err != nil {
 				return err
 			}
+			previous = hdr.requestNumber
 			continue
 		}
 		// seek back to the beginning of the request header
@@ -231,6 +333,7 @@ func (self *log) replayFromFileLocation(file *os.File,
 	}
 
 	defer func() { close(replayChan) }()
+	previous := uint32(0)
 	for {
 		numberOfBytes, hdr, err := self.getNextHeader(file)
 		if numberOfBytes == 0 {
@@ -242,6 +345,11 @@ func (self *log) replayFromFileLocation(file *os.File,
 			return
 		}
 
+		if self.isPastTheLastRequest(hdr, previous) {
+			break
+		}
+		previous = hdr.requestNumber
+
 		ok := false
 		if len(shardIdsSet) == 0 {
 			ok = true
@@ -270,6 +378,20 @@ func (self *log) replayFromFileLocation(file *os.File,
 			return
 		}
 
+		if !hdr.verify(bytes) {
+			err = fmt.Errorf("The checksum of request %d in %s doesn't match", hdr.requestNumber, file.Name())
+			sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
+			return
+		}
+
+		if hdr.compressed {
+			bytes, err = snappy.Decode(nil, bytes)
+			if err != nil {
+				sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
+				return
+			}
+		}
+
 		req := &protocol.Request{}
 		err = req.Decode(bytes)
 		if err != nil {
@@ -0,0 +1,20 @@
+// +build !linux
+
+package wal
+
+import (
+	"os"
+)
+
+// other systems don't have fallocate, the file is only extended with a
+// hole that reads as zeros
+func preallocate(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return file.Truncate(size)
+}
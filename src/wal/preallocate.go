@@ -0,0 +1,14 @@
+// +build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocates the blocks of the file up to size, the new blocks read as
+// zeros
+func preallocate(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
@@ -0,0 +1,185 @@
+package wal
+
+import (
+	"fmt"
+	"metrics"
+	"sync"
+	"time"
+)
+
+// the weight of the latest append in the moving average of the append
+// latency
+const APPEND_LATENCY_WEIGHT = 0.1
+
+type Stats struct {
+	LogFiles int   `json:"logFiles"`
+	Size     int64 `json:"size"`
+	// the number of requests in the log files
+	Requests uint32 `json:"requests"`
+	// the size of the log files that will be deleted once every server
+	// committed their requests
+	ReclaimableSize int64 `json:"reclaimableSize"`
+	// the log files deleted before every server committed their requests
+	// because the wal got bigger than its max size
+	DroppedLogFiles int `json:"droppedLogFiles"`
+	// the deleted log files that are kept to be recycled
+	SpareLogFiles int `json:"spareLogFiles"`
+	// the moving average and the max of the time it takes to log a
+	// request, including the time it waits for the wal
+	AppendLatencyMs    float64 `json:"appendLatencyMs"`
+	MaxAppendLatencyMs float64 `json:"maxAppendLatencyMs"`
+	// how far behind the servers and the consumers are
+	Servers   []*LagStats `json:"servers"`
+	Consumers []*LagStats `json:"consumers"`
+	// the replays that are running
+	Replays []*ReplayStats `json:"replays"`
+}
+
+type LagStats struct {
+	// the id of the server or the name of the consumer
+	Name              string `json:"name"`
+	LastRequestNumber uint32 `json:"lastRequestNumber"`
+	PendingRequests   uint32 `json:"pendingRequests"`
+	// the size of the requests in the log files after the last request,
+	// give or take an index entry
+	PendingSize int64 `json:"pendingSize"`
+}
+
+type ReplayStats struct {
+	FromRequestNumber uint32    `json:"fromRequestNumber"`
+	ToRequestNumber   uint32    `json:"toRequestNumber"`
+	Replayed          int       `json:"replayed"`
+	Started           time.Time `json:"started"`
+}
+
+// the replays that are running, they don't happen on the goroutine that
+// processes the entries
+type replays struct {
+	lock    sync.Mutex
+	nextId  int
+	running map[int]*ReplayStats
+}
+
+func (self *replays) start(from, to uint32) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.running == nil {
+		self.running = map[int]*ReplayStats{}
+	}
+	self.nextId++
+	self.running[self.nextId] = &ReplayStats{from, to, 0, time.Now()}
+	return self.nextId
+}
+
+func (self *replays) replayed(id int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.running[id].Replayed++
+}
+
+func (self *replays) finish(id int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.running, id)
+}
+
+func (self *replays) stats() []*ReplayStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := make([]*ReplayStats, 0, len(self.running))
+	for _, replay := range self.running {
+		replayStats := *replay
+		stats = append(stats, &replayStats)
+	}
+	return stats
+}
+
+// Reports the depth of the wal to the default registry, the gauges
+// are removed before the wal closes since Stats blocks once it's closed
+func (self *WAL) registerMetrics() {
+	metrics.Default.Gauge("wal.requests", func() int64 {
+		return int64(self.Stats().Requests)
+	})
+	metrics.Default.Gauge("wal.size", func() int64 {
+		return self.Stats().Size
+	})
+	// the requests of the server that's the furthest behind
+	metrics.Default.Gauge("wal.pending_requests", func() int64 {
+		var pending uint32
+		for _, server := range self.Stats().Servers {
+			if server.PendingRequests > pending {
+				pending = server.PendingRequests
+			}
+		}
+		return int64(pending)
+	})
+}
+
+func (self *WAL) unregisterMetrics() {
+	for _, name := range []string{"wal.requests", "wal.size", "wal.pending_requests"} {
+		metrics.Default.Remove(name)
+	}
+}
+
+func (self *WAL) updateAppendLatency(latency time.Duration) {
+	if latency > self.maxAppendLatency {
+		self.maxAppendLatency = latency
+	}
+	if self.appendLatency == 0 {
+		self.appendLatency = latency
+		return
+	}
+	self.appendLatency = time.Duration(APPEND_LATENCY_WEIGHT*float64(latency) + (1-APPEND_LATENCY_WEIGHT)*float64(self.appendLatency))
+}
+
+func (self *WAL) stats() *Stats {
+	stats := &Stats{
+		LogFiles:           len(self.logFiles),
+		Size:               self.size(),
+		DroppedLogFiles:    self.droppedLogFiles,
+		SpareLogFiles:      len(self.spareLogFiles),
+		AppendLatencyMs:    float64(self.appendLatency) / float64(time.Millisecond),
+		MaxAppendLatencyMs: float64(self.maxAppendLatency) / float64(time.Millisecond),
+		Servers:            []*LagStats{},
+		Consumers:          []*LagStats{},
+		Replays:            self.replays.stats(),
+	}
+	// the last log file is still written to, all the others would be
+	// deleted if every server committed their requests
+	if len(self.logFiles) > 0 {
+		stats.ReclaimableSize = stats.Size - int64(self.logFiles[len(self.logFiles)-1].fileSize)
+		stats.Requests = self.state.LargestRequestNumber - uint32(self.state.FirstSuffix) + 1
+	}
+	for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+		stats.Servers = append(stats.Servers, self.lagStats(fmt.Sprintf("%d", serverId), requestNumber))
+	}
+	for name, requestNumber := range self.state.ConsumerLastRequestNumber {
+		stats.Consumers = append(stats.Consumers, self.lagStats(name, requestNumber))
+	}
+	return stats
+}
+
+func (self *WAL) lagStats(name string, lastRequestNumber uint32) *LagStats {
+	stats := &LagStats{Name: name, LastRequestNumber: lastRequestNumber}
+	// nothing is pending if the server caught up or the requests it
+	// needs were deleted
+	requestNumber := lastRequestNumber + 1
+	if len(self.logFiles) == 0 || lastRequestNumber == self.state.LargestRequestNumber || !self.isInRange(requestNumber) {
+		return stats
+	}
+	stats.PendingRequests = self.state.LargestRequestNumber - lastRequestNumber
+
+	idx := len(self.logIndex) - 1
+	offset := self.logIndex[idx].requestOrLastOffset(requestNumber)
+	for logIdx, logIndex := range self.logIndex {
+		if o := logIndex.requestOffset(requestNumber); o != -1 {
+			idx, offset = logIdx, o
+			break
+		}
+	}
+	stats.PendingSize = -offset
+	for _, logFile := range self.logFiles[idx:] {
+		stats.PendingSize += int64(logFile.fileSize)
+	}
+	return stats
+}
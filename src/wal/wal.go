@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"bytes"
 	"configuration"
 	"fmt"
 	"math"
@@ -9,6 +10,7 @@ import (
 	"protocol"
 	"sort"
 	"strings"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
@@ -22,29 +24,37 @@ type WAL struct {
 	serverId          uint32
 	nextLogFileSuffix int
 	entries           chan interface{}
+	closing           chan struct{}
 
 	// counters to force index creation, bookmark and flushing
 	requestsSinceLastFlush    int
+	bytesSinceLastFlush       int64
 	requestsSinceLastBookmark int
 	requestsSinceLastIndex    int
 	requestsSinceRotation     int
+
+	// log files deleted because the wal got bigger than its max size
+	droppedLogFiles int
+	// deleted log files that are reused for the next log files
+	spareLogFiles []string
+
+	appendLatency    time.Duration
+	maxAppendLatency time.Duration
+	replays          replays
 }
 
 const HOST_ID_OFFSET = uint64(10000)
 
+// the most requests logged with one write
+const MAX_GROUP_COMMIT_REQUESTS = 1000
+
 func NewWAL(config *configuration.Configuration) (*WAL, error) {
 	if config.WalDir == "" {
 		return nil, fmt.Errorf("wal directory cannot be empty")
 	}
 
 	logger.Info("Opening wal in %s", config.WalDir)
-	_, err := os.Stat(config.WalDir)
-
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(config.WalDir, 0755)
-	}
-
-	if err != nil {
+	if err := prepareWalDir(config); err != nil {
 		return nil, err
 	}
 
@@ -70,9 +80,14 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 		logIndex: []*index{},
 		state:    state,
 		entries:  make(chan interface{}, 10),
+		closing:  make(chan struct{}),
 	}
 
 	for _, name := range names {
+		if strings.HasPrefix(name, "spare.") {
+			wal.spareLogFiles = append(wal.spareLogFiles, path.Join(config.WalDir, name))
+			continue
+		}
 		if !strings.HasPrefix(name, "log.") {
 			continue
 		}
@@ -101,6 +116,10 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 	}
 
 	go wal.processEntries()
+	if config.WalSyncPolicy == configuration.WAL_SYNC_INTERVAL {
+		go wal.periodicallyFlush()
+	}
+	wal.registerMetrics()
 
 	return wal, err
 }
@@ -122,6 +141,14 @@ func (self *WAL) Commit(requestNumber uint32, serverId uint32) error {
 	return confirmation.err
 }
 
+// Returns the size of the log files and how much of it is only kept
+// because some servers didn't commit their requests yet
+func (self *WAL) Stats() *Stats {
+	statsChan := make(chan *Stats)
+	self.entries <- &statsEntry{statsChan}
+	return <-statsChan
+}
+
 func (self *WAL) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
 	requestNumber, ok := self.state.ServerLastRequestNumber[serverId]
 	requestNumber += 1
@@ -161,6 +188,9 @@ func (self *WAL) RecoverServerFromRequestNumber(requestNumber uint32, shardIds [
 		return nil
 	}
 
+	replay := self.replays.start(requestNumber, self.state.LargestRequestNumber)
+	defer self.replays.finish(replay)
+
 	for idx, logIndex := range self.logIndex {
 		logger.Debug("Trying to find request %d in %s", requestNumber, self.logFiles[idx].file.Name())
 		if firstOffset = logIndex.requestOffset(requestNumber); firstOffset != -1 {
@@ -208,6 +238,7 @@ outer:
 				stopChan <- struct{}{}
 				return err
 			}
+			self.replays.replayed(replay)
 			count++
 		}
 		close(stopChan)
@@ -224,6 +255,7 @@ func (self *WAL) closeWithoutBookmarking() error {
 }
 
 func (self *WAL) closeCommon(shouldBookmark bool) error {
+	self.unregisterMetrics()
 	confirmationChan := make(chan *confirmation)
 	self.entries <- &closeEntry{confirmationChan, shouldBookmark}
 	confirmation := <-confirmationChan
@@ -232,6 +264,7 @@ func (self *WAL) closeCommon(shouldBookmark bool) error {
 
 func (self *WAL) processClose(shouldBookmark bool) error {
 	logger.Info("Closing WAL")
+	close(self.closing)
 	for idx, logFile := range self.logFiles {
 		logFile.syncFile()
 		logFile.close()
@@ -248,13 +281,29 @@ func (self *WAL) processClose(shouldBookmark bool) error {
 // PRIVATE functions
 
 func (self *WAL) processEntries() {
+	// the entry that ended the last group of appends
+	var next interface{}
 	for {
-		e := <-self.entries
+		e := next
+		if e == nil {
+			e = <-self.entries
+		}
+		next = nil
 		switch x := e.(type) {
 		case *commitEntry:
 			self.processCommitEntry(x)
 		case *appendEntry:
-			self.processAppendEntry(x)
+			var entries []*appendEntry
+			entries, next = self.groupAppends(x)
+			self.processAppendEntries(entries)
+		case *flushEntry:
+			if self.requestsSinceLastFlush > 0 {
+				self.flush()
+			}
+		case *consumerEntry:
+			self.processConsumerEntry(x)
+		case *statsEntry:
+			x.stats <- self.stats()
 		case *bookmarkEntry:
 			err := self.bookmark()
 			if err != nil {
@@ -289,14 +338,71 @@ func (self *WAL) assignSequenceNumbers(shardId uint32, request *protocol.Request
 	}
 }
 
-func (self *WAL) processAppendEntry(e *appendEntry) {
+// Takes the appends that are waiting for the wal, and the ones that come
+// in during the group commit window, to log them with one write and one
+// fsync. Returns the appends and the entry that isn't an append, if one
+// came in before the group was complete.
+func (self *WAL) groupAppends(first *appendEntry) ([]*appendEntry, interface{}) {
+	entries := []*appendEntry{first}
+	var window <-chan time.Time
+	if self.config.WalGroupCommitWindow > 0 {
+		window = time.After(self.config.WalGroupCommitWindow)
+	}
+	for len(entries) < MAX_GROUP_COMMIT_REQUESTS {
+		var e interface{}
+		if window == nil {
+			select {
+			case e = <-self.entries:
+			default:
+				return entries, nil
+			}
+		} else {
+			select {
+			case e = <-self.entries:
+			case <-window:
+				return entries, nil
+			}
+		}
+		entry, ok := e.(*appendEntry)
+		if !ok {
+			return entries, e
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Logs the requests and confirms them once they're written to the log
+// file, and fsynced if the sync policy asks for it
+func (self *WAL) processAppendEntries(entries []*appendEntry) {
+	confirmations := make([]*confirmation, len(entries))
+	for idx, e := range entries {
+		confirmations[idx] = self.processAppendEntry(e)
+	}
+
+	var err error
+	if len(self.logFiles) > 0 {
+		if err = self.logFiles[len(self.logFiles)-1].writePending(); err == nil {
+			self.conditionalBookmarkAndIndex()
+		}
+	}
+
+	for idx, e := range entries {
+		if confirmations[idx].err == nil && err != nil {
+			confirmations[idx] = &confirmation{0, err}
+		}
+		e.confirmation <- confirmations[idx]
+		self.updateAppendLatency(time.Since(e.enqueued))
+	}
+}
+
+func (self *WAL) processAppendEntry(e *appendEntry) *confirmation {
 	nextRequestNumber := self.state.getNextRequestNumber()
 	e.request.RequestNumber = proto.Uint32(nextRequestNumber)
 
 	if len(self.logFiles) == 0 {
 		if _, err := self.createNewLog(nextRequestNumber); err != nil {
-			e.confirmation <- &confirmation{0, err}
-			return
+			return &confirmation{0, err}
 		}
 		self.state.FirstSuffix = int(nextRequestNumber)
 	}
@@ -304,11 +410,12 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 	lastLogFile := self.logFiles[len(self.logFiles)-1]
 	self.assignSequenceNumbers(e.shardId, e.request)
 	logger.Debug("appending request %d", e.request.GetRequestNumber())
+	sizeBefore := lastLogFile.fileSize
 	err := lastLogFile.appendRequest(e.request, e.shardId)
 	if err != nil {
-		e.confirmation <- &confirmation{0, err}
-		return
+		return &confirmation{0, err}
 	}
+	self.bytesSinceLastFlush += int64(lastLogFile.fileSize - sizeBefore)
 	self.state.CurrentFileOffset = self.logFiles[len(self.logFiles)-1].offset()
 
 	self.requestsSinceLastIndex++
@@ -317,39 +424,107 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 	self.requestsSinceRotation++
 	logger.Debug("requestsSinceRotation: %d", self.requestsSinceRotation)
 	if rotated, err := self.rotateTheLogFile(nextRequestNumber); err != nil || rotated {
-		e.confirmation <- &confirmation{e.request.GetRequestNumber(), err}
-		return
+		if err == nil {
+			self.dropLogFilesOverMaxSize()
+		}
+		return &confirmation{e.request.GetRequestNumber(), err}
 	}
-
-	self.conditionalBookmarkAndIndex()
-	e.confirmation <- &confirmation{e.request.GetRequestNumber(), nil}
+	return &confirmation{e.request.GetRequestNumber(), nil}
 }
 
 func (self *WAL) processCommitEntry(e *commitEntry) {
 	logger.Debug("commiting %d for server %d", e.requestNumber, e.serverId)
 	self.state.commitRequestNumber(e.serverId, e.requestNumber)
+	self.deleteCommittedLogFiles()
+	e.confirmation <- &confirmation{0, nil}
+}
+
+// deletes the log files whose requests were committed by every server
+// and acked by every consumer
+func (self *WAL) deleteCommittedLogFiles() {
 	idx := self.firstLogFile()
 	if idx == 0 {
-		e.confirmation <- &confirmation{0, nil}
 		return
 	}
 
+	logger.Debug("Removing some unneeded log files: %d", idx)
+	self.deleteLogFiles(idx)
+}
+
+// Deletes the oldest log files until the wal is smaller than its max
+// size, even if some servers still need their requests. The last log
+// file is never deleted.
+func (self *WAL) dropLogFilesOverMaxSize() {
+	if self.config.WalMaxSize == 0 {
+		return
+	}
+	size := self.size()
+	count := 0
+	for ; count < len(self.logFiles)-1 && size > self.config.WalMaxSize; count++ {
+		size -= int64(self.logFiles[count].fileSize)
+	}
+	if count == 0 {
+		return
+	}
+
+	for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+		for idx, logIndex := range self.logIndex[:count] {
+			if logIndex.requestOffset(requestNumber) != -1 {
+				logger.Warn("The wal is bigger than %d bytes, deleting %s although server %d didn't commit its requests",
+					self.config.WalMaxSize, self.logFiles[idx].file.Name(), serverId)
+				break
+			}
+		}
+	}
+	for name, requestNumber := range self.state.ConsumerLastRequestNumber {
+		for idx, logIndex := range self.logIndex[:count] {
+			if logIndex.requestOffset(requestNumber+1) != -1 {
+				logger.Warn("The wal is bigger than %d bytes, deleting %s although consumer %s didn't ack its requests",
+					self.config.WalMaxSize, self.logFiles[idx].file.Name(), name)
+				break
+			}
+		}
+	}
+	self.droppedLogFiles += count
+	self.deleteLogFiles(count)
+}
+
+// deletes the first count log files and their indices
+func (self *WAL) deleteLogFiles(count int) {
 	var unusedLogFiles []*log
 	var unusedLogIndex []*index
 
-	logger.Debug("Removing some unneeded log files: %d", idx)
-	unusedLogFiles, self.logFiles = self.logFiles[:idx], self.logFiles[idx:]
-	unusedLogIndex, self.logIndex = self.logIndex[:idx], self.logIndex[idx:]
+	unusedLogFiles, self.logFiles = self.logFiles[:count], self.logFiles[count:]
+	unusedLogIndex, self.logIndex = self.logIndex[:count], self.logIndex[count:]
 	for logIdx, logFile := range unusedLogFiles {
-		logger.Info("Deleting %s", logFile.file.Name())
 		logFile.close()
-		logFile.delete()
+		if len(self.spareLogFiles) < self.config.WalRecycleLogFiles {
+			spare := path.Join(self.config.WalDir, fmt.Sprintf("spare.%d", logFile.suffix()))
+			if err := os.Rename(logFile.file.Name(), spare); err == nil {
+				logger.Info("Keeping %s to recycle it", logFile.file.Name())
+				self.spareLogFiles = append(self.spareLogFiles, spare)
+			} else {
+				logger.Error("Cannot keep %s to recycle it: %s", logFile.file.Name(), err)
+				logFile.delete()
+			}
+		} else {
+			logger.Info("Deleting %s", logFile.file.Name())
+			logFile.delete()
+		}
 		logIndex := unusedLogIndex[logIdx]
 		logIndex.close()
 		logIndex.delete()
 	}
 	self.state.FirstSuffix = self.logFiles[0].suffix()
-	e.confirmation <- &confirmation{0, nil}
+}
+
+// the size of all the log files in bytes
+func (self *WAL) size() int64 {
+	size := int64(0)
+	for _, logFile := range self.logFiles {
+		size += int64(logFile.fileSize)
+	}
+	return size
 }
 
 // creates a new log file using the next suffix and initializes its
@@ -357,19 +532,50 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 func (self *WAL) createNewLog(firstRequestNumber uint32) (*log, error) {
 	self.nextLogFileSuffix++
 	logFileName := path.Join(self.config.WalDir, fmt.Sprintf("log.%d", firstRequestNumber))
+	if len(self.spareLogFiles) > 0 {
+		spare := self.spareLogFiles[len(self.spareLogFiles)-1]
+		self.spareLogFiles = self.spareLogFiles[:len(self.spareLogFiles)-1]
+		if err := recycleLogFile(spare, logFileName); err != nil {
+			logger.Error("Cannot recycle %s: %s", spare, err)
+			os.Remove(spare)
+		}
+	}
 	log, _, err := self.openLog(logFileName)
 	if err != nil {
 		return nil, err
 	}
+	if self.config.WalPreallocate {
+		if err := log.preallocate(self.config.WalMaxLogFileSize); err != nil {
+			logger.Warn("Cannot preallocate %s: %s", logFileName, err)
+		}
+	}
 	self.state.CurrentFileSuffix = log.suffix()
 	self.state.CurrentFileOffset = 0
 	return log, nil
 }
 
+// Renames the spare to the new log file and empties the first header, so
+// the requests left in the file aren't taken for the requests of the new
+// log file
+func recycleLogFile(spare, logFileName string) error {
+	if err := os.Rename(spare, logFileName); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(logFileName, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buffer := &bytes.Buffer{}
+	(&entryHeader{}).Write(buffer)
+	_, err = file.WriteAt(buffer.Bytes(), 0)
+	return err
+}
+
 func (self *WAL) openLog(logFileName string) (*log, *index, error) {
 	logger.Info("Opening log file %s", logFileName)
 
-	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -396,7 +602,7 @@ func (self *WAL) openLog(logFileName string) (*log, *index, error) {
 // should be marked as committed for each server as it gets confirmed.
 func (self *WAL) AssignSequenceNumbersAndLog(request *protocol.Request, shard Shard) (uint32, error) {
 	confirmationChan := make(chan *confirmation)
-	self.entries <- &appendEntry{confirmationChan, request, shard.Id()}
+	self.entries <- &appendEntry{confirmationChan, request, shard.Id(), time.Now()}
 	confirmation := <-confirmationChan
 
 	// we should panic if the wal cannot append the request
@@ -415,6 +621,12 @@ func (self *WAL) firstLogFile() int {
 				return idx
 			}
 		}
+		for _, requestNumber := range self.state.ConsumerLastRequestNumber {
+			// the consumers need the requests after the one they acked
+			if logIndex.requestOffset(requestNumber+1) != -1 {
+				return idx
+			}
+		}
 	}
 
 	if len(self.logIndex) > 0 {
@@ -424,7 +636,13 @@ func (self *WAL) firstLogFile() int {
 }
 
 func (self *WAL) shouldRotateTheLogFile() bool {
-	return self.requestsSinceRotation >= self.config.WalRequestsPerLogFile
+	if self.requestsSinceRotation >= self.config.WalRequestsPerLogFile {
+		return true
+	}
+	if maxSize := self.config.WalMaxLogFileSize; maxSize > 0 && len(self.logFiles) > 0 {
+		return int64(self.logFiles[len(self.logFiles)-1].fileSize) >= maxSize
+	}
+	return false
 }
 
 func (self *WAL) recover() error {
@@ -525,14 +743,46 @@ func (self *WAL) conditionalBookmarkAndIndex() {
 		self.bookmark()
 	}
 
-	if self.requestsSinceLastFlush >= self.config.WalFlushAfterRequests || shouldFlush {
+	if self.shouldFlush() || shouldFlush {
 		self.flush()
 	}
 }
 
+func (self *WAL) shouldFlush() bool {
+	switch self.config.WalSyncPolicy {
+	case configuration.WAL_SYNC_ALWAYS:
+		return true
+	case configuration.WAL_SYNC_INTERVAL:
+		// periodicallyFlush takes care of it
+		return false
+	case configuration.WAL_SYNC_BYTES:
+		return self.bytesSinceLastFlush >= self.config.WalSyncAfterBytes
+	}
+	return self.requestsSinceLastFlush >= self.config.WalFlushAfterRequests
+}
+
+// fsyncs the log file every sync interval until the wal is closed
+func (self *WAL) periodicallyFlush() {
+	ticker := time.NewTicker(self.config.WalSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.closing:
+			return
+		}
+		select {
+		case self.entries <- &flushEntry{}:
+		case <-self.closing:
+			return
+		}
+	}
+}
+
 func (self *WAL) flush() error {
 	logger.Debug("Fsyncing the log file to disk")
 	self.requestsSinceLastFlush = 0
+	self.bytesSinceLastFlush = 0
 	lastEntryIndex := len(self.logFiles) - 1
 	if err := self.logFiles[lastEntryIndex].syncFile(); err != nil {
 		return err
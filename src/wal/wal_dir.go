@@ -0,0 +1,108 @@
+package wal
+
+import (
+	"configuration"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	logger "code.google.com/p/log4go"
+)
+
+// the file in the data directory that has the wal directory the server
+// used last
+const WAL_DIR_FILE = "wal_dir"
+
+// Makes sure the server can write to the wal directory and moves the
+// log files there from the wal directory the server used before, if it
+// changed. The log files are only deleted from the old directory once
+// they're in the new one, so a server that stops while moving them moves
+// them again on the next start.
+func prepareWalDir(config *configuration.Configuration) error {
+	if err := os.MkdirAll(config.WalDir, 0755); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(config.WalDir, "write_check")
+	if err != nil {
+		return fmt.Errorf("Cannot write to the wal directory %s: %s", config.WalDir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	if config.DataDir == "" {
+		return nil
+	}
+	walDir, err := filepath.Abs(config.WalDir)
+	if err != nil {
+		return err
+	}
+	dirFile := path.Join(config.DataDir, WAL_DIR_FILE)
+	previous, err := ioutil.ReadFile(dirFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	previousDir := strings.TrimSpace(string(previous))
+	if previousDir != "" && previousDir != walDir {
+		if err := moveWalFiles(previousDir, walDir); err != nil {
+			return fmt.Errorf("Cannot move the wal from %s to %s: %s", previousDir, walDir, err)
+		}
+	}
+	if previousDir == walDir {
+		return nil
+	}
+	return ioutil.WriteFile(dirFile, []byte(walDir+"\n"), 0644)
+}
+
+func moveWalFiles(from, to string) error {
+	files, err := ioutil.ReadDir(from)
+	if os.IsNotExist(err) {
+		logger.Warn("The previous wal directory %s doesn't exist anymore", from)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		logger.Info("Moving %s from %s to %s", file.Name(), from, to)
+		if err := moveFile(path.Join(from, file.Name()), path.Join(to, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renames the file, or copies it if the directories are on different
+// devices
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
@@ -4,6 +4,7 @@ import (
 	. "checkers"
 	"configuration"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
@@ -387,7 +388,7 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{1, 1, 500}
+	hdr := &entryHeader{requestNumber: 1, shardId: 1, length: 500}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	// write an incomplete request, 200 bytes as opposed to 500 bytes in
@@ -410,14 +411,14 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	// make sure the file is truncated
 	info, err := file.Stat()
 	c.Assert(err, IsNil)
-	c.Assert(info.Size(), Equals, int64(69))
+	c.Assert(info.Size(), Equals, int64(73))
 	// make sure appending a new request will increase the size of the
 	// file by just that request
 	_, err = wal.AssignSequenceNumbersAndLog(req, &MockShard{id: 1})
 	c.Assert(err, IsNil)
 	info, err = file.Stat()
 	c.Assert(err, IsNil)
-	c.Assert(info.Size(), Equals, int64(69*2))
+	c.Assert(info.Size(), Equals, int64(73*2))
 
 	requests = []*protocol.Request{}
 	wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
@@ -436,7 +437,7 @@ func (_ *WalSuite) TestAnotherRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{0, 0, 0}
+	hdr := &entryHeader{}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	defer file.Close()
@@ -453,6 +454,44 @@ func (_ *WalSuite) TestAnotherRecoveryFromCrash(c *C) {
 	c.Assert(requests, HasLen, 1)
 }
 
+func (_ *WalSuite) TestRecoveryFromCorruptRequest(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 2; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Close(), IsNil)
+	// flip the last byte of the second request
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	info, err := file.Stat()
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(73*2))
+	b := make([]byte, 1)
+	_, err = file.ReadAt(b, info.Size()-1)
+	c.Assert(err, IsNil)
+	b[0] ^= 0xff
+	_, err = file.WriteAt(b, info.Size()-1)
+	c.Assert(err, IsNil)
+
+	// the WAL should truncate to just the first request
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	requests := []*protocol.Request{}
+	err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 1)
+	info, err = file.Stat()
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(73))
+}
+
 func (_ *WalSuite) TestRecoverWithNonWriteRequests(c *C) {
 	wal := newWal(c)
 	requestType := protocol.Request_QUERY
@@ -635,3 +674,319 @@ func (_ *WalSuite) TestSequenceNumberAssignmentPerServer(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(request.MultiSeries[0].Points[0].GetSequenceNumber(), Not(Equals), anotherRequest.MultiSeries[0].Points[0].GetSequenceNumber())
 }
+
+func (_ *WalSuite) TestReplayOfCompressedAndUncompressedRequests(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 4; i++ {
+		// turn compression on and off like a restart with another config would
+		wal.config.WalCompress = i%2 == 1
+		request := generateRequest(i + 1)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.closeWithoutBookmarking(), IsNil)
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+
+	requests := []*protocol.Request{}
+	err = wal.RecoverServerFromRequestNumber(uint32(1), []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 4)
+	for i, request := range requests {
+		c.Assert(request.MultiSeries[0].Points, HasLen, i+1)
+	}
+}
+
+func (_ *WalSuite) TestSyncAfterBytes(c *C) {
+	wal := newWal(c)
+	wal.config.WalSyncPolicy = configuration.WAL_SYNC_BYTES
+	wal.config.WalSyncAfterBytes = 1000
+	flushed := false
+	for i := 0; i < 100; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+		c.Assert(wal.bytesSinceLastFlush < 1000, Equals, true)
+		if wal.requestsSinceLastFlush == 0 {
+			flushed = true
+		}
+	}
+	c.Assert(flushed, Equals, true)
+}
+
+func (_ *WalSuite) TestSyncInterval(c *C) {
+	dir := c.MkDir()
+	config := &configuration.Configuration{
+		WalDir: dir,
+		WalBookmarkAfterRequests: 1000,
+		WalIndexAfterRequests:    1000,
+		WalFlushAfterRequests:    1000,
+		WalRequestsPerLogFile:    10000,
+		WalSyncPolicy:            configuration.WAL_SYNC_INTERVAL,
+		WalSyncInterval:          10 * time.Millisecond,
+	}
+	wal, err := NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.requestsSinceLastFlush, Equals, 1)
+	time.Sleep(50 * time.Millisecond)
+	// goes through the same channel as the flushes
+	c.Assert(wal.CreateCheckpoint(), IsNil)
+	c.Assert(wal.requestsSinceLastFlush, Equals, 0)
+	c.Assert(wal.Close(), IsNil)
+}
+
+func (_ *WalSuite) TestLogFilesAreRotatedOnceTheyReachTheirMaxSize(c *C) {
+	wal := newWal(c)
+	wal.config.WalMaxLogFileSize = 1000
+	for i := 0; i < 100; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	stats := wal.Stats()
+	c.Assert(stats.LogFiles > 1, Equals, true)
+	c.Assert(stats.ReclaimableSize > 0, Equals, true)
+	c.Assert(stats.ReclaimableSize < stats.Size, Equals, true)
+	c.Assert(stats.DroppedLogFiles, Equals, 0)
+
+	// every log file is deleted once the server committed the last request but the current one
+	c.Assert(wal.Commit(100, 2), IsNil)
+	stats = wal.Stats()
+	c.Assert(stats.LogFiles, Equals, 1)
+	c.Assert(stats.ReclaimableSize, Equals, int64(0))
+}
+
+func (_ *WalSuite) TestLogFilesAreDroppedOnceTheWalReachesItsMaxSize(c *C) {
+	wal := newWal(c)
+	wal.config.WalMaxLogFileSize = 1000
+	wal.config.WalMaxSize = 3000
+	// server 2 never commits anything
+	c.Assert(wal.Commit(1, 2), IsNil)
+	for i := 0; i < 300; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	stats := wal.Stats()
+	c.Assert(stats.Size <= 3000+1000, Equals, true)
+	c.Assert(stats.DroppedLogFiles > 0, Equals, true)
+
+	// the requests of the dropped log files aren't replayed anymore
+	requests := []*protocol.Request{}
+	err := wal.RecoverServerFromRequestNumber(uint32(wal.state.FirstSuffix), []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(requests) < 300, Equals, true)
+	c.Assert(requests[len(requests)-1].GetRequestNumber(), Equals, uint32(300))
+}
+
+func (_ *WalSuite) TestConsumersGetTheRequestsTheyDidNotAck(c *C) {
+	wal := newWal(c)
+	c.Assert(wal.Subscribe("cdc", 0), IsNil)
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: uint32(i + 1)})
+		c.Assert(err, IsNil)
+	}
+
+	replay := func() []uint32 {
+		requestNumbers := []uint32{}
+		err := wal.ReplayToConsumer("cdc", func(req *protocol.Request, shardId uint32) error {
+			requestNumbers = append(requestNumbers, req.GetRequestNumber())
+			return nil
+		})
+		c.Assert(err, IsNil)
+		return requestNumbers
+	}
+	c.Assert(replay(), DeepEquals, []uint32{1, 2, 3})
+	c.Assert(wal.Ack("cdc", 2), IsNil)
+	c.Assert(replay(), DeepEquals, []uint32{3})
+
+	// the position of the consumer survives a restart
+	c.Assert(wal.Close(), IsNil)
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(replay(), DeepEquals, []uint32{3})
+
+	c.Assert(wal.Unsubscribe("cdc"), IsNil)
+	c.Assert(wal.Ack("cdc", 3), NotNil)
+	c.Assert(wal.ReplayToConsumer("cdc", nil), NotNil)
+}
+
+func (_ *WalSuite) TestLogFilesAreKeptUntilTheConsumersAckTheirRequests(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 2
+	c.Assert(wal.Subscribe("cdc", 0), IsNil)
+	for i := 0; i < 6; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	// the server needs the log file of the last request it committed
+	// and the one that's written to
+	c.Assert(wal.Commit(6, 2), IsNil)
+	c.Assert(wal.Stats().LogFiles, Equals, 4)
+	c.Assert(wal.Ack("cdc", 6), IsNil)
+	c.Assert(wal.Stats().LogFiles, Equals, 2)
+}
+
+func (_ *WalSuite) TestStatsReportHowFarBehindTheServersAre(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(1, 2), IsNil)
+	c.Assert(wal.Commit(3, 3), IsNil)
+	stats := wal.Stats()
+	c.Assert(stats.Requests, Equals, uint32(3))
+	c.Assert(stats.MaxAppendLatencyMs >= stats.AppendLatencyMs, Equals, true)
+	c.Assert(stats.Servers, HasLen, 2)
+	for _, server := range stats.Servers {
+		switch server.Name {
+		case "2":
+			c.Assert(server.PendingRequests, Equals, uint32(2))
+			c.Assert(server.PendingSize > 0, Equals, true)
+			c.Assert(server.PendingSize <= stats.Size, Equals, true)
+		case "3":
+			c.Assert(server.PendingRequests, Equals, uint32(0))
+			c.Assert(server.PendingSize, Equals, int64(0))
+		default:
+			c.Fatalf("unexpected server %s", server.Name)
+		}
+	}
+	c.Assert(stats.Replays, HasLen, 0)
+}
+
+func (_ *WalSuite) TestConcurrentAppendsAreLoggedTogether(c *C) {
+	wal := newWal(c)
+	wal.config.WalGroupCommitWindow = 20 * time.Millisecond
+	wal.config.WalSyncPolicy = configuration.WAL_SYNC_ALWAYS
+	requestNumbers := make(chan uint32, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			requestNumber, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+			c.Check(err, IsNil)
+			requestNumbers <- requestNumber
+		}()
+	}
+	seen := map[uint32]bool{}
+	for i := 0; i < 10; i++ {
+		seen[<-requestNumbers] = true
+	}
+	c.Assert(seen, HasLen, 10)
+
+	requests := 0
+	err := wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		c.Assert(seen[req.GetRequestNumber()], Equals, true)
+		requests++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 10)
+}
+
+func replayedRequestNumbers(c *C, wal *WAL, requestNumber uint32) []uint32 {
+	requestNumbers := []uint32{}
+	err := wal.RecoverServerFromRequestNumber(requestNumber, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requestNumbers = append(requestNumbers, req.GetRequestNumber())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	return requestNumbers
+}
+
+func (_ *WalSuite) TestPreallocatedLogFilesAreReplayed(c *C) {
+	wal := newWal(c)
+	wal.config.WalMaxLogFileSize = 64 * 1024
+	wal.config.WalPreallocate = true
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	info, err := os.Stat(path.Join(wal.config.WalDir, "log.1"))
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(64*1024))
+	c.Assert(replayedRequestNumbers(c, wal, 1), DeepEquals, []uint32{1, 2, 3})
+
+	c.Assert(wal.Close(), IsNil)
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(replayedRequestNumbers(c, wal, 1), DeepEquals, []uint32{1, 2, 3, 4})
+}
+
+func (_ *WalSuite) TestDeletedLogFilesAreRecycled(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 2
+	wal.config.WalRecycleLogFiles = 2
+	for i := 0; i < 6; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(6, 2), IsNil)
+	c.Assert(wal.Stats().SpareLogFiles, Equals, 2)
+
+	// log.9 is the recycled log.3
+	for i := 0; i < 2; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Stats().SpareLogFiles, Equals, 1)
+	c.Assert(replayedRequestNumbers(c, wal, 7), DeepEquals, []uint32{7, 8})
+
+	// the old requests of the recycled file aren't replayed after a restart
+	c.Assert(wal.Close(), IsNil)
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(wal.Stats().SpareLogFiles, Equals, 1)
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(replayedRequestNumbers(c, wal, 7), DeepEquals, []uint32{7, 8, 9})
+}
+
+func (_ *WalSuite) TestTheLogFilesAreMovedToTheNewWalDir(c *C) {
+	config := &configuration.Configuration{
+		DataDir:                  c.MkDir(),
+		WalDir:                   c.MkDir(),
+		WalBookmarkAfterRequests: 1000,
+		WalIndexAfterRequests:    1000,
+		WalFlushAfterRequests:    1000,
+		WalRequestsPerLogFile:    2,
+	}
+	oldDir := config.WalDir
+	wal, err := NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Close(), IsNil)
+
+	config.WalDir = path.Join(c.MkDir(), "wal")
+	wal, err = NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(replayedRequestNumbers(c, wal, 1), DeepEquals, []uint32{1, 2, 3})
+	names, err := ioutil.ReadDir(oldDir)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+	_, err = wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(wal.Close(), IsNil)
+
+	// the server remembers the new dir
+	wal, err = NewWAL(config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	c.Assert(replayedRequestNumbers(c, wal, 1), DeepEquals, []uint32{1, 2, 3, 4})
+}